@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	detect "github.com/codectx/tokens/services/detect"
+	embed "github.com/codectx/tokens/services/embed"
+	index "github.com/codectx/tokens/services/index"
+	"gopkg.in/yaml.v3"
+)
+
+// evalQuery is a query of an eval set with the files expected to answer it.
+type evalQuery struct {
+	Query string `yaml:"query"`
+	// Relevant lists paths relative to the indexed root.
+	Relevant []string `yaml:"relevant"`
+}
+
+// loadEvalSet reads a YAML list of eval queries.
+func loadEvalSet(path string) ([]evalQuery, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var qs []evalQuery
+	if err := yaml.Unmarshal(b, &qs); err != nil {
+		return nil, fmt.Errorf("failed to parse eval set: %w", err)
+	}
+	for i, q := range qs {
+		if q.Query == "" || len(q.Relevant) == 0 {
+			return nil, fmt.Errorf("eval query %d needs a query and at least one relevant path", i+1)
+		}
+		for j, p := range q.Relevant {
+			qs[i].Relevant[j] = filepath.ToSlash(filepath.Clean(p))
+		}
+	}
+	return qs, nil
+}
+
+// abReport holds the retrieval quality and latency of one provider.
+type abReport struct {
+	name     string
+	docs     int
+	failures int
+	dims     int
+	docMs    []int
+	queryMs  []int
+	recall   float64
+	mrr      float64
+	// annRecall is the share of the exact top k the approximate graph found.
+	annRecall float64
+	// ranks is the rank of the first relevant file per query, 0 when missed.
+	ranks []int
+}
+
+// runAB embeds a sample of the corpus and an eval set with two providers and
+// reports their retrieval quality and latency side by side.
+func runAB(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("ab")
+	o := &options{}
+	o.register(fs)
+	left := fs.String("a", "ollama", "first provider, `provider[:model]`")
+	right := fs.String("b", "voyage", "second provider, `provider[:model]`")
+	evalFile := fs.String("queries", "eval.yaml", "eval set: a YAML list of {query, relevant} entries")
+	sample := fs.Int("sample", 200, "number of files to embed, relevant files included")
+	seed := fs.Uint64("seed", 1, "seed used to sample files")
+	k := fs.Int("k", 10, "cutoff for recall@k and MRR")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	wd := "."
+	if fs.NArg() > 0 {
+		wd = fs.Arg(0)
+	}
+
+	queries, err := loadEvalSet(*evalFile)
+	if err != nil {
+		return err
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	providers := make([]embed.Provider, 2)
+	for i, spec := range []string{*left, *right} {
+		if providers[i], err = embed.ParseProvider(spec, a.ollama); err != nil {
+			return err
+		}
+	}
+
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	files, err := sampleFiles(ctx, src, wd, queries, *sample, *seed)
+	if err != nil {
+		return err
+	}
+	l.Info("ab", "files", len(files), "queries", len(queries), "a", providers[0].Name(), "b", providers[1].Name())
+
+	reports := make([]*abReport, 2)
+	for i, p := range providers {
+		if reports[i], err = evaluate(ctx, a, p, src, wd, files, queries, *k); err != nil {
+			return err
+		}
+	}
+
+	printABReport(reports, queries, *k)
+	return nil
+}
+
+// sampleFiles returns the ids of every relevant file plus randomly chosen
+// others, up to n in total.
+func sampleFiles(ctx context.Context, src source, wd string, queries []evalQuery, n int, seed uint64) ([]string, error) {
+	relevant := map[string]bool{}
+	for _, q := range queries {
+		for _, p := range q.Relevant {
+			relevant[p] = true
+		}
+	}
+
+	var picked, others []string
+	err := src.walk(ctx, func(id string) {
+		if relevant[relPath(wd, id)] {
+			picked = append(picked, id)
+		} else {
+			others = append(others, id)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(picked) < len(relevant) {
+		return nil, fmt.Errorf("only %d of the %d relevant files of the eval set were found under %s", len(picked), len(relevant), wd)
+	}
+
+	sort.Strings(others)
+	r := rand.New(rand.NewPCG(seed, seed))
+	r.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	if room := n - len(picked); room > 0 {
+		picked = append(picked, others[:min(room, len(others))]...)
+	}
+	return picked, nil
+}
+
+// evaluate embeds files and queries with p and scores its rankings. Vectors
+// are kept in memory so the stored index is left untouched. Every query is
+// also searched exhaustively, to measure the recall of the approximate graph;
+// with -exact the exhaustive results are the ones scored.
+func evaluate(ctx context.Context, a *app, p embed.Provider, src source, wd string, files []string, queries []evalQuery, k int) (*abReport, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	rep := &abReport{name: p.Name()}
+	var opts []index.Option
+	if a.opts.f16 {
+		opts = append(opts, index.WithFloat16())
+	}
+	idx, exact := index.NewIndexService(opts...), index.NewExactIndexService(opts...)
+	for _, id := range files {
+		f, err := src.read(id)
+		if err != nil {
+			l.Debug("Failed to read file", "path", id, "error", err)
+			continue
+		}
+		text, _, err := fileText(ctx, a, id, f)
+		if err != nil {
+			l.Debug("Failed to decode file", "path", id, "error", err)
+			continue
+		}
+		if generated, _ := detect.Generated([]byte(text)); generated && a.opts.generated == generatedSkip {
+			continue
+		}
+
+		start := time.Now()
+		embedCtx, cancel := withTimeout(ctx, a.opts.embedTimeout)
+		vec, _, err := p.Embed(embedCtx, text)
+		cancel()
+		if err != nil {
+			l.Debug("Failed to embed text", "provider", rep.name, "path", id, "error", err)
+			rep.failures++
+			continue
+		}
+		rep.docMs = append(rep.docMs, int(time.Since(start).Milliseconds()))
+		rep.docs++
+		rep.dims = len(vec)
+		idx.Add(relPath(wd, id), vec)
+		exact.Add(relPath(wd, id), vec)
+	}
+	if rep.docs == 0 {
+		return nil, fmt.Errorf("%s failed to embed any file", rep.name)
+	}
+
+	for _, q := range queries {
+		start := time.Now()
+		embedCtx, cancel := withTimeout(ctx, a.opts.embedTimeout)
+		vec, _, err := p.Embed(embedCtx, q.Query)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("%s failed to embed query %q: %w", rep.name, q.Query, err)
+		}
+		rep.queryMs = append(rep.queryMs, int(time.Since(start).Milliseconds()))
+
+		relevant := map[string]bool{}
+		for _, p := range q.Relevant {
+			relevant[p] = true
+		}
+		approx, want := idx.Search(vec, k), exact.Search(vec, k)
+		rep.annRecall += recallOf(approx, want)
+		results := approx
+		if a.opts.exact {
+			results = want
+		}
+
+		found, rank := 0, 0
+		for i, r := range results {
+			if relevant[r.ID] {
+				found++
+				if rank == 0 {
+					rank = i + 1
+				}
+			}
+		}
+		rep.recall += float64(found) / float64(len(relevant))
+		if rank > 0 {
+			rep.mrr += 1 / float64(rank)
+		}
+		rep.ranks = append(rep.ranks, rank)
+	}
+	rep.recall /= float64(len(queries))
+	rep.mrr /= float64(len(queries))
+	rep.annRecall /= float64(len(queries))
+	return rep, nil
+}
+
+// recallOf returns the share of want found in got, 1 when want is empty.
+func recallOf(got, want []index.Result) float64 {
+	if len(want) == 0 {
+		return 1
+	}
+	ids := map[string]bool{}
+	for _, r := range got {
+		ids[r.ID] = true
+	}
+	found := 0
+	for _, r := range want {
+		if ids[r.ID] {
+			found++
+		}
+	}
+	return float64(found) / float64(len(want))
+}
+
+// printABReport prints the summary metrics followed by per-query ranks.
+func printABReport(reports []*abReport, queries []evalQuery, k int) {
+	a, b := reports[0], reports[1]
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "metric\t%s\t%s\tdelta\n", a.name, b.name)
+	row := func(metric, format string, va, vb float64) {
+		fmt.Fprintf(w, "%s\t"+format+"\t"+format+"\t%+"+format[1:]+"\n", metric, va, vb, vb-va)
+	}
+	row(fmt.Sprintf("recall@%d", k), "%.3f", a.recall, b.recall)
+	row("mrr", "%.3f", a.mrr, b.mrr)
+	row(fmt.Sprintf("ann recall@%d", k), "%.3f", a.annRecall, b.annRecall)
+	row("embed ms (mean)", "%.1f", mean(a.docMs), mean(b.docMs))
+	row("embed ms (p95)", "%.0f", percentile(a.docMs, 0.95), percentile(b.docMs, 0.95))
+	row("query ms (mean)", "%.1f", mean(a.queryMs), mean(b.queryMs))
+	row("files", "%.0f", float64(a.docs), float64(b.docs))
+	row("failures", "%.0f", float64(a.failures), float64(b.failures))
+	row("dimensions", "%.0f", float64(a.dims), float64(b.dims))
+
+	fmt.Fprintf(w, "\nquery\t%s\t%s\t\n", a.name, b.name)
+	for i, q := range queries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", q.Query, rankCell(a.ranks[i]), rankCell(b.ranks[i]))
+	}
+	w.Flush()
+}
+
+// rankCell formats the rank of the first relevant file.
+func rankCell(rank int) string {
+	if rank == 0 {
+		return "miss"
+	}
+	return fmt.Sprintf("#%d", rank)
+}
+
+// relPath returns id relative to the indexed root, using slashes.
+func relPath(wd, id string) string {
+	rel, err := filepath.Rel(osPath(pathID(wd)), osPath(id))
+	if err != nil {
+		return id
+	}
+	return filepath.ToSlash(rel)
+}
+
+// mean returns the average of ms, or 0 when empty.
+func mean(ms []int) float64 {
+	if len(ms) == 0 {
+		return 0
+	}
+	var sum int
+	for _, v := range ms {
+		sum += v
+	}
+	return float64(sum) / float64(len(ms))
+}
+
+// percentile returns the p-th percentile of ms, or 0 when empty.
+func percentile(ms []int, p float64) float64 {
+	if len(ms) == 0 {
+		return 0
+	}
+	s := append([]int(nil), ms...)
+	sort.Ints(s)
+	return float64(s[int(p*float64(len(s)-1))])
+}
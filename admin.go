@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	embed "github.com/codectx/tokens/services/embed"
+	remote "github.com/codectx/tokens/services/remote"
+)
+
+// adminErrors is how many of the latest errors /admin/errors keeps.
+const adminErrors = 100
+
+// admin serves h to requests bearing the -admin-token.
+func (s *server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(s.flags.adminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// writeJSON writes v as the JSON body of an admin response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleAdminConfig returns the value of every flag the server runs with,
+// after the config files, reloads and the adjustments of serve, such as
+// the lexical mode it falls back to. Credentials are redacted.
+func (s *server) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	values := parsedFlags(s.app.opts.fs)
+	s.mu.RUnlock()
+	for name, v := range values {
+		values[name] = redactFlag(v)
+	}
+	if values["admin-token"] != "" {
+		values["admin-token"] = "<redacted>"
+	}
+	writeJSON(w, http.StatusOK, values)
+}
+
+// redactFlag hides the credentials a flag value may hold: the MotherDuck
+// token of -db, and the userinfo and query of every URL of it, which hold
+// the passwords of -embed-cache and the signatures of presigned -remote or
+// -webhooks URLs.
+func redactFlag(v string) string {
+	parts := strings.Split(v, ",")
+	for i, p := range parts {
+		parts[i] = remote.Redact(redactDSN(p))
+	}
+	return strings.Join(parts, ",")
+}
+
+// adminQueues is the JSON body returned by /admin/queues.
+type adminQueues struct {
+	// Indexing counts the files waiting in the indexing run in progress,
+	// by priority; nil between runs.
+	Indexing *queueDepth `json:"indexing"`
+	// Webhooks is the number of events waiting for delivery.
+	Webhooks int `json:"webhooks"`
+	// Retry is the number of files that failed to embed, retried by the
+	// next run.
+	Retry int `json:"retry"`
+	// Work is the number of files queued by coordinate and not indexed yet.
+	Work int `json:"work"`
+}
+
+// queueDepth counts the files of the indexing queue.
+type queueDepth struct {
+	High   int `json:"high"`
+	Normal int `json:"normal"`
+	Low    int `json:"low"`
+}
+
+// handleAdminQueues returns the depth of the queues of the served
+// namespace.
+func (s *server) handleAdminQueues(w http.ResponseWriter, r *http.Request) {
+	var res adminQueues
+	if q := s.app.indexing.Load(); q != nil {
+		n := q.waiting()
+		res.Indexing = &queueDepth{High: n[priorityHigh], Normal: n[priorityNormal], Low: n[priorityLow]}
+	}
+	if s.app.events != nil {
+		res.Webhooks = len(s.app.events.queue)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	db, err := s.app.store(s.namespace)
+	if err != nil {
+		http.Error(w, "failed to open the index", http.StatusInternalServerError)
+		return
+	}
+	pending, err := db.Pending(r.Context())
+	if err != nil {
+		http.Error(w, "failed to read the retry queue", http.StatusInternalServerError)
+		return
+	}
+	res.Retry = len(pending)
+	if res.Work, err = db.WorkLeft(r.Context()); err != nil {
+		http.Error(w, "failed to read the work queue", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleAdminErrors returns the latest errors logged, newest first, up to n.
+func (s *server) handleAdminErrors(w http.ResponseWriter, r *http.Request) {
+	n := adminErrors
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			http.Error(w, "invalid n parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, s.errors.latest(n))
+}
+
+// adminProviders is the JSON body returned by /admin/providers.
+type adminProviders struct {
+	Providers []embed.ProviderStats `json:"providers"`
+	// Breaker is the state of the circuit breaker, when enabled.
+	Breaker string `json:"breaker,omitempty"`
+	// Concurrency is the number of concurrent embeddings, when tuned.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// handleAdminProviders returns the latency of every embedding provider.
+func (s *server) handleAdminProviders(w http.ResponseWriter, r *http.Request) {
+	res := adminProviders{Providers: []embed.ProviderStats{}}
+	if s.app.stats != nil {
+		res.Providers = s.app.stats.Snapshot()
+	}
+	if s.app.breaker != nil {
+		res.Breaker = s.app.breaker.State().String()
+	}
+	if s.app.adaptive != nil {
+		res.Concurrency = s.app.adaptive.Limit()
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// adminReindex is the JSON body returned by /admin/reindex.
+type adminReindex struct {
+	Path  string `json:"path"`
+	Files int    `json:"files"`
+	Force bool   `json:"force"`
+}
+
+// handleAdminReindex indexes the files under the path parameter, a file or
+// a directory relative to the served path, in the background: changed
+// files are re-embedded, every file with force=true. It returns once they
+// are listed.
+func (s *server) handleAdminReindex(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "missing path parameter", http.StatusBadRequest)
+		return
+	}
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	idx, ok := s.indexes[s.namespace]
+	switch {
+	case s.app.readOnly:
+		http.Error(w, "read-only: the database can't be written to", http.StatusConflict)
+		return
+	case s.lex != nil || !ok:
+		http.Error(w, "no vector index to reindex in lexical mode", http.StatusServiceUnavailable)
+		return
+	}
+
+	// ids are the served path joined with the file's path under it
+	under := contextFiles{pathID(filepath.Join(s.root, path))}
+	var files []string
+	if err := s.src.walk(r.Context(), func(id string) {
+		if under.has(id) {
+			files = append(files, id)
+		}
+	}); err != nil {
+		http.Error(w, "failed to list files", http.StatusInternalServerError)
+		return
+	}
+	if len(files) == 0 {
+		http.Error(w, "no file under path", http.StatusNotFound)
+		return
+	}
+
+	db, err := s.app.store(s.namespace)
+	if err != nil {
+		http.Error(w, "failed to open the index", http.StatusInternalServerError)
+		return
+	}
+
+	// shutdown waits for the files being indexed, and stops the others
+	s.writes.Add(1)
+	go func() {
+		defer s.writes.Done()
+		ctx := context.WithoutCancel(s.ctx)
+		if force {
+			ctx = context.WithValue(ctx, ForceCtxKey, true)
+		}
+		start := time.Now()
+		for _, id := range files {
+			if s.ctx.Err() != nil || s.app.throttle.wait(s.ctx) != nil {
+				return
+			}
+			if err := handleAndRecord(ctx, s.app, db, idx, s.src, nil, id); err != nil {
+				s.log.Error("Failed to handle file", "error", err)
+			}
+		}
+		s.log.Info("reindexed", "path", path, "files", len(files), "force", force, "elapsed", time.Since(start).Round(time.Millisecond))
+	}()
+	s.log.Info("reindexing", "path", path, "files", len(files), "force", force)
+	writeJSON(w, http.StatusAccepted, adminReindex{Path: path, Files: len(files), Force: force})
+}
+
+// errorLog is a slog handler keeping the latest records of level error, for
+// /admin/errors, before passing every record on.
+type errorLog struct {
+	slog.Handler
+	ring *errorRing
+	// attrs are those of the logger, added to the records kept.
+	attrs []slog.Attr
+}
+
+// errorRing holds the latest errors, oldest first from next once full.
+type errorRing struct {
+	mu      sync.Mutex
+	entries []loggedError
+	next    int
+}
+
+// loggedError is an error logged.
+type loggedError struct {
+	Time    time.Time         `json:"time"`
+	Message string            `json:"message"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+}
+
+// newErrorLog wraps h, keeping the latest adminErrors errors.
+func newErrorLog(h slog.Handler) *errorLog {
+	return &errorLog{Handler: h, ring: &errorRing{}}
+}
+
+func (e *errorLog) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelError {
+		le := loggedError{Time: r.Time, Message: r.Message, Attrs: map[string]string{}}
+		for _, a := range e.attrs {
+			le.Attrs[a.Key] = a.Value.String()
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			le.Attrs[a.Key] = a.Value.String()
+			return true
+		})
+		e.ring.add(le)
+	}
+	return e.Handler.Handle(ctx, r)
+}
+
+func (e *errorLog) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &errorLog{Handler: e.Handler.WithAttrs(attrs), ring: e.ring, attrs: append(e.attrs[:len(e.attrs):len(e.attrs)], attrs...)}
+}
+
+func (e *errorLog) WithGroup(name string) slog.Handler {
+	return &errorLog{Handler: e.Handler.WithGroup(name), ring: e.ring, attrs: e.attrs}
+}
+
+// latest returns up to n of the errors kept, newest first.
+func (e *errorLog) latest(n int) []loggedError {
+	e.ring.mu.Lock()
+	defer e.ring.mu.Unlock()
+	out := []loggedError{}
+	for i := len(e.ring.entries) - 1; i >= 0 && len(out) < n; i-- {
+		out = append(out, e.ring.entries[(e.ring.next+i)%len(e.ring.entries)])
+	}
+	return out
+}
+
+// add keeps le, dropping the oldest error once full.
+func (r *errorRing) add(le loggedError) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.entries) < adminErrors {
+		r.entries = append(r.entries, le)
+		return
+	}
+	r.entries[r.next] = le
+	r.next = (r.next + 1) % adminErrors
+}
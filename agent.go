@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	detect "github.com/codectx/tokens/services/detect"
+	store "github.com/codectx/tokens/services/store"
+	symbols "github.com/codectx/tokens/services/symbols"
+)
+
+// Schemas of the JSON output for agents, given in its schema field. Within
+// a version fields are only ever added; renaming or removing one bumps it.
+const (
+	searchSchema = "codectx.search/v1"
+	fetchSchema  = "codectx.fetch/v1"
+)
+
+const (
+	// chunkLines is the maximum number of lines of a chunk.
+	chunkLines = 60
+	// preambleSymbol names the chunk of the lines before the first
+	// declaration of a file, and of files without declarations.
+	preambleSymbol = "_"
+	// maxSymbolLength bounds the symbol part of chunk ids, cutting long
+	// markdown headings.
+	maxSymbolLength = 64
+	// chunkHashLength is the number of hex digits of the content hash in
+	// chunk ids.
+	chunkHashLength = 12
+	// snippetLines is the number of lines of a chunk quoted in a result,
+	// around its line best matching the query.
+	snippetLines = 5
+)
+
+// chunk is a range of lines of an indexed file, as returned by fetch.
+type chunk struct {
+	ID       string `json:"chunk_id"`
+	Path     string `json:"path"`
+	Language string `json:"language,omitempty"`
+	// Kind is that of the declaration of the chunk, as kind: filters
+	// match, empty for the lines before the first one.
+	Kind string `json:"kind,omitempty"`
+	// StartLine and EndLine are 1-based and inclusive.
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Content   string `json:"content"`
+	// RequestedID is the id fetched when it named an earlier content of
+	// the same declaration, whose current content ID names.
+	RequestedID string `json:"requested_id,omitempty"`
+}
+
+// agentSearch is the search output for agents, schema codectx.search/v1.
+type agentSearch struct {
+	Schema  string `json:"schema"`
+	Query   string `json:"query"`
+	QueryID string `json:"query_id"`
+	Mode    string `json:"mode"`
+	// IndexVersion is that of the searched index when served.
+	IndexVersion uint64        `json:"index_version,omitempty"`
+	Results      []agentResult `json:"results"`
+}
+
+// agentResult is a result of an agentSearch: the chunk of a file best
+// matching the query, whose full content fetch returns by its id.
+type agentResult struct {
+	Rank      int    `json:"rank"`
+	ChunkID   string `json:"chunk_id"`
+	Path      string `json:"path"`
+	Language  string `json:"language,omitempty"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	// Line is the line best matching the query, quoted by Snippet.
+	Line    int     `json:"line"`
+	Score   float32 `json:"score"`
+	Snippet string  `json:"snippet"`
+	// Tests are the test files of Path, with -tests pair.
+	Tests []string `json:"tests,omitempty"`
+	// Author is the dominant git blame author of the lines of the chunk,
+	// and LastCommit the last commit that modified them, with -blame.
+	Author     string `json:"author,omitempty"`
+	LastCommit string `json:"last_commit,omitempty"`
+}
+
+// agentFetch is the fetch output for agents, schema codectx.fetch/v1.
+type agentFetch struct {
+	Schema string  `json:"schema"`
+	Chunks []chunk `json:"chunks"`
+	// Missing lists the requested ids that match no chunk of an indexed
+	// file, such as those of files since deleted from the index.
+	Missing []string `json:"missing"`
+}
+
+// declarations returns the top-level declarations the file id, detected as
+// language, is chunked at: those found by the -chunker plugin, else by the
+// symbols package.
+func (a *app) declarations(ctx context.Context, id, language, text string) []symbols.Decl {
+	if a.chunker != nil {
+		decls, err := a.chunker.Chunk(ctx, id, language, text)
+		if err != nil {
+			l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+			l.Warn("Failed to chunk with the plugin, using the built-in chunker", "path", id, "error", err)
+		}
+		if len(decls) > 0 {
+			out := make([]symbols.Decl, len(decls))
+			for i, d := range decls {
+				out[i] = symbols.Decl{Name: d.Name, Line: d.Line - 1, Kind: d.Kind}
+			}
+			sort.SliceStable(out, func(i, j int) bool { return out[i].Line < out[j].Line })
+			return out
+		}
+	}
+	return symbols.Declarations(language, text)
+}
+
+// chunkFile splits the text of the file id, detected as language, into
+// chunks: one per top-level
+// declaration of decls, the lines before the first one in a chunk of their
+// own, and declarations longer than chunkLines cut into pieces of that many
+// lines. Files without declarations are cut every chunkLines lines.
+func chunkFile(id, language, text string, decls []symbols.Decl) []chunk {
+	text = strings.TrimRight(text, "\n")
+	lines := strings.Split(text, "\n")
+
+	type segment struct {
+		symbol string
+		kind   string
+		start  int
+	}
+	segments := []segment{{symbol: preambleSymbol}}
+	for _, d := range decls {
+		last := &segments[len(segments)-1]
+		switch {
+		case d.Line == last.start:
+			// nothing before the declaration
+			last.symbol, last.kind = d.Name, d.Kind
+		case d.Line > last.start:
+			segments = append(segments, segment{symbol: d.Name, kind: d.Kind, start: d.Line})
+		}
+	}
+
+	var chunks []chunk
+	seen := map[string]int{}
+	for i, s := range segments {
+		end := len(lines)
+		if i+1 < len(segments) {
+			end = segments[i+1].start
+		}
+		// blank lines between declarations belong to neither
+		for end > s.start+1 && strings.TrimSpace(lines[end-1]) == "" {
+			end--
+		}
+		for piece, start := 0, s.start; start < end; piece, start = piece+1, start+chunkLines {
+			stop := min(start+chunkLines, end)
+			symbol := s.symbol
+			if piece > 0 {
+				symbol = fmt.Sprintf("%s+%d", symbol, piece)
+			}
+			content := strings.Join(lines[start:stop], "\n")
+			cid := chunkID(id, symbol, content)
+			// identical declarations of the same name
+			if seen[cid]++; seen[cid] > 1 {
+				cid = fmt.Sprintf("%s~%d", cid, seen[cid])
+			}
+			chunks = append(chunks, chunk{
+				ID:        cid,
+				Path:      id,
+				Language:  language,
+				Kind:      s.kind,
+				StartLine: start + 1,
+				EndLine:   stop,
+				Content:   content,
+			})
+		}
+	}
+	return chunks
+}
+
+// chunkID returns the id of the chunk of the file id declaring symbol, with
+// the given content: id#symbol@hash. It only changes with the content of the
+// chunk, not with its position in the file nor with the rest of the file.
+func chunkID(id, symbol, content string) string {
+	safe := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.+-", r) {
+			return r
+		}
+		return '-'
+	}, symbol)
+	if r := []rune(safe); len(r) > maxSymbolLength {
+		safe = string(r[:maxSymbolLength])
+	}
+	return id + "#" + safe + "@" + computeHash([]byte(content))[:chunkHashLength]
+}
+
+// chunkPath returns the id of the file of a chunk id.
+func chunkPath(chunkID string) (string, bool) {
+	i := strings.LastIndex(chunkID, "#")
+	if i <= 0 {
+		return "", false
+	}
+	return chunkID[:i], true
+}
+
+// chunkSymbol returns the symbol part of a chunk id.
+func chunkSymbol(chunkID string) string {
+	symbol, _, _ := strings.Cut(chunkID[strings.LastIndex(chunkID, "#")+1:], "@")
+	return symbol
+}
+
+// kindLines returns lines with those of the chunks of other kinds than
+// kinds blanked, unless no chunk is of kinds, or kinds is empty.
+func kindLines(lines []string, chunks []chunk, kinds []string) []string {
+	if len(kinds) == 0 || !slices.ContainsFunc(chunks, func(c chunk) bool { return slices.Contains(kinds, c.Kind) }) {
+		return lines
+	}
+	out := make([]string, len(lines))
+	for _, c := range chunks {
+		if slices.Contains(kinds, c.Kind) {
+			copy(out[c.StartLine-1:c.EndLine], lines[c.StartLine-1:c.EndLine])
+		}
+	}
+	return out
+}
+
+// grepLines returns lines with those of the chunks not matching grep
+// blanked, unless no chunk matches it, or grep is nil.
+func grepLines(lines []string, chunks []chunk, grep *regexp.Regexp) []string {
+	if grep == nil || !slices.ContainsFunc(chunks, grepped(grep)) {
+		return lines
+	}
+	out := make([]string, len(lines))
+	for _, c := range chunks {
+		if grep.MatchString(c.Content) {
+			copy(out[c.StartLine-1:c.EndLine], lines[c.StartLine-1:c.EndLine])
+		}
+	}
+	return out
+}
+
+// fileChunks reads the file id and splits it into chunks, also returning
+// its lines.
+func fileChunks(ctx context.Context, a *app, src source, id, language string) ([]chunk, []string, error) {
+	text, err := readText(ctx, a, src, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if language == "" {
+		language = detect.Language(id, []byte(text))
+	}
+	return chunkFile(id, language, text, a.declarations(ctx, id, language, text)), strings.Split(text, "\n"), nil
+}
+
+// agentResults returns the results of hits for agents, each pointing to the
+// chunk of its file best matching query, among those of kinds and those
+// matching grep when given, and attributed to the blame db recorded for it.
+func agentResults(ctx context.Context, a *app, db store.StorageService, src source, query string, kinds []string, grep *regexp.Regexp, hits []hit) ([]agentResult, error) {
+	results := []agentResult{}
+	for i, h := range hits {
+		chunks, lines, err := fileChunks(ctx, a, src, h.ID, h.Meta.Language)
+		if err != nil {
+			return nil, err
+		}
+		line := bestLine(grepLines(kindLines(lines, chunks, kinds), chunks, grep), query)
+		c := chunks[len(chunks)-1]
+		for _, cc := range chunks {
+			if line < cc.EndLine {
+				c = cc
+				break
+			}
+		}
+		// no line of the chunks of kinds matches the query
+		if j := slices.IndexFunc(chunks, func(c chunk) bool { return slices.Contains(kinds, c.Kind) }); j >= 0 && !slices.Contains(kinds, c.Kind) {
+			c, line = chunks[j], chunks[j].StartLine-1
+		}
+		// no line of the chunks matching grep matches the query
+		if grep != nil && !grep.MatchString(c.Content) {
+			j := slices.IndexFunc(chunks, func(c chunk) bool { return grepped(grep)(c) && (len(kinds) == 0 || slices.Contains(kinds, c.Kind)) })
+			if j < 0 {
+				j = slices.IndexFunc(chunks, grepped(grep))
+			}
+			if j >= 0 {
+				c, line = chunks[j], chunks[j].StartLine-1
+				if k := slices.IndexFunc(lines[c.StartLine-1:c.EndLine], grep.MatchString); k >= 0 {
+					line += k
+				}
+			}
+		}
+
+		start := max(line-snippetLines/2, c.StartLine-1)
+		end := min(start+snippetLines, c.EndLine)
+		author, commit, err := chunkBlame(ctx, db, h.ID, c)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, agentResult{
+			Rank:       i + 1,
+			ChunkID:    c.ID,
+			Path:       h.ID,
+			Language:   c.Language,
+			StartLine:  c.StartLine,
+			EndLine:    c.EndLine,
+			Line:       line + 1,
+			Score:      h.Score,
+			Snippet:    strings.Join(lines[start:end], "\n"),
+			Tests:      h.Tests,
+			Author:     author,
+			LastCommit: commit,
+		})
+	}
+	return results, nil
+}
+
+// chunkBlame returns the author and last commit recorded for the chunk c of
+// the file id, empty when it wasn't blamed or has changed since.
+func chunkBlame(ctx context.Context, db store.StorageService, id string, c chunk) (string, string, error) {
+	hashes, err := db.ChunkHashes(ctx, id)
+	if err != nil {
+		return "", "", err
+	}
+	hash := computeHash([]byte(c.Content))
+	for _, h := range hashes {
+		if h.Hash == hash && h.StartLine == c.StartLine {
+			return h.Author, h.LastCommit, nil
+		}
+	}
+	return "", "", nil
+}
+
+// fetchChunks returns the chunks of ids, and the ids matching no chunk of a
+// file of db. Only indexed files are read, whatever path an id names.
+func fetchChunks(ctx context.Context, a *app, db store.StorageService, src source, ids []string) ([]chunk, []string, error) {
+	chunks, missing := []chunk{}, []string{}
+	byFile := map[string][]chunk{}
+	for _, id := range ids {
+		path, ok := chunkPath(id)
+		if !ok {
+			missing = append(missing, id)
+			continue
+		}
+		if _, ok := byFile[path]; !ok {
+			rows, err := db.Get(ctx, []string{path})
+			if err != nil {
+				return nil, nil, err
+			}
+			var cs []chunk
+			if len(rows) > 0 {
+				// files removed since they were indexed are missing
+				cs, _, _ = fileChunks(ctx, a, src, path, rows[0].Language)
+			}
+			byFile[path] = cs
+		}
+		if c, ok := resolveChunk(byFile[path], id); ok {
+			chunks = append(chunks, c)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return chunks, missing, nil
+}
+
+// resolveChunk returns the chunk of id among the chunks of its file. When
+// the chunk has changed since id was given, the chunk of the same symbol is
+// returned instead, with RequestedID set to id.
+func resolveChunk(chunks []chunk, id string) (chunk, bool) {
+	for _, c := range chunks {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	symbol := chunkSymbol(id)
+	for _, c := range chunks {
+		if chunkSymbol(c.ID) == symbol {
+			c.RequestedID = id
+			return c, true
+		}
+	}
+	return chunk{}, false
+}
+
+// runFetch prints the contents of chunks by the ids search results give
+// them, in the codectx.fetch/v1 schema.
+func runFetch(ctx context.Context, args []string) error {
+	fs := newFlagSet("fetch")
+	o := &options{}
+	o.register(fs)
+	// fetching reads files, it never embeds
+	fs.Set("mode", modeLexical)
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("usage: fetch CHUNK-ID...")
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	src, err := newSource(ctx, a, ".")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+	chunks, missing, err := fetchChunks(ctx, a, db, src, fs.Args())
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(agentFetch{Schema: fetchSchema, Chunks: chunks, Missing: missing})
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	remote "github.com/codectx/tokens/services/remote"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// backupSchema is the schema of the manifest of a backup.
+const backupSchema = "codectx.backup/v1"
+
+const (
+	// backupTime names backups by when they were taken, so that they sort
+	// oldest first.
+	backupTime = "20060102T150405Z"
+	// manifestFile, databaseFile and vectorsFile are the files of a backup.
+	manifestFile = "manifest.json"
+	databaseFile = "index.db"
+	vectorsFile  = "vectors.vec"
+)
+
+// backupManifest describes a backup, schema codectx.backup/v1.
+type backupManifest struct {
+	Schema  string    `json:"schema"`
+	Created time.Time `json:"created"`
+	// DB and Vectors are the paths the files were backed up from.
+	DB      string        `json:"db"`
+	Vectors string        `json:"vectors,omitempty"`
+	Indexes []backupIndex `json:"indexes"`
+	Files   []backupFile  `json:"files"`
+}
+
+// backupIndex is an index of a backed up database.
+type backupIndex struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+}
+
+// backupFile is a file of a backup and its checksum.
+type backupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// runBackup snapshots the database, the -vectors file and their metadata
+// into a timestamped directory, optionally uploads it, and removes the
+// oldest backups beyond -keep.
+func runBackup(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("backup")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeLexical) // backing up doesn't embed
+	dir := fs.String("dir", "", "`directory` of the backups (default <db>.backups)")
+	keep := fs.Int("keep", 7, "number of backups kept in -dir, the oldest removed first; 0 keeps them all")
+	upload := fs.String("upload", "", "s3://, gs:// or http(s):// `prefix` the backup is also uploaded under, as <prefix>/<backup>/<file>")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if *keep < 0 {
+		return errors.New("-keep must be 0 or more")
+	}
+	path, err := localDBPath(o, "backup")
+	if err != nil {
+		return err
+	}
+	if *dir == "" {
+		*dir = path + ".backups"
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	namespaces, err := store.Namespaces(ctx, a.database)
+	if err != nil {
+		return err
+	}
+	m := backupManifest{Schema: backupSchema, Created: time.Now().UTC(), DB: path, Vectors: o.vectors}
+	for _, ns := range namespaces {
+		m.Indexes = append(m.Indexes, backupIndex{Name: ns.Name, Files: ns.Rows})
+	}
+
+	// Written aside, so that an interrupted backup is never restored
+	name := m.Created.Format(backupTime)
+	tmp := filepath.Join(*dir, "."+name+".partial")
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := copyDatabase(ctx, a, filepath.Join(tmp, databaseFile)); err != nil {
+		return err
+	}
+	files := []string{databaseFile}
+	if o.vectors != "" {
+		if err := copyFile(o.vectors, filepath.Join(tmp, vectorsFile)); err != nil {
+			return err
+		}
+		files = append(files, vectorsFile)
+	}
+	for _, f := range files {
+		sum, err := checksum(filepath.Join(tmp, f))
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, sum)
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, manifestFile), append(b, '\n'), 0o644); err != nil {
+		return err
+	}
+	final := filepath.Join(*dir, name)
+	if err := os.Rename(tmp, final); err != nil {
+		return err
+	}
+	var size int64
+	for _, f := range m.Files {
+		size += f.Size
+	}
+	l.Info("backed up", "db", path, "backup", final, "size", formatBytes(size))
+
+	if *upload != "" {
+		// the manifest last, so that a backup is complete once it's listed
+		for _, f := range append(files, manifestFile) {
+			r, err := remote.NewRemoteService(strings.TrimSuffix(*upload, "/") + "/" + name + "/" + f)
+			if err != nil {
+				return err
+			}
+			if err := r.Push(ctx, filepath.Join(final, f)); err != nil {
+				return fmt.Errorf("failed to upload %s: %w", f, err)
+			}
+		}
+		l.Info("uploaded", "backup", name, "prefix", *upload)
+	}
+
+	if *keep > 0 {
+		backups, err := listBackups(*dir)
+		if err != nil {
+			return err
+		}
+		for _, old := range backups[:max(len(backups)-*keep, 0)] {
+			if err := os.RemoveAll(filepath.Join(*dir, old)); err != nil {
+				return err
+			}
+			l.Debug("removed backup", "backup", old)
+		}
+	}
+	return nil
+}
+
+// runRestore replaces the database, and the -vectors file when one was
+// backed up, with a backup: the latest in -dir by default. The backup is
+// copied next to the database and renamed over it last, and the replaced
+// database is kept as <db>.before-restore, or <db>.before-restore.<time>
+// when an earlier restore kept one.
+func runRestore(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("restore")
+	o := &options{}
+	o.register(fs)
+	dir := fs.String("dir", "", "`directory` of the backups (default <db>.backups)")
+	from := fs.String("from", "", "s3://, gs:// or http(s):// `prefix` backup -upload'ed the backup to, downloaded into -dir first")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	path, err := localDBPath(o, "restore")
+	if err != nil {
+		return err
+	}
+	if *dir == "" {
+		*dir = path + ".backups"
+	}
+
+	name := fs.Arg(0)
+	switch {
+	case *from != "":
+		if _, err := time.Parse(backupTime, name); err != nil {
+			return fmt.Errorf("-from needs the name of the backup to download, as in %s", backupTime)
+		}
+		if err := downloadBackup(ctx, *from, *dir, name); err != nil {
+			return err
+		}
+	case name == "":
+		backups, err := listBackups(*dir)
+		if err != nil {
+			return err
+		}
+		if len(backups) == 0 {
+			return fmt.Errorf("no backups in %s", *dir)
+		}
+		name = backups[len(backups)-1]
+	}
+	// a name, or the path of a backup anywhere
+	backup := name
+	if !strings.ContainsRune(name, os.PathSeparator) {
+		backup = filepath.Join(*dir, name)
+	}
+
+	m, err := verifyBackup(backup)
+	if err != nil {
+		return fmt.Errorf("backup %s: %w", backup, err)
+	}
+
+	// the manifest names the path vectors were backed up from, which a
+	// downloaded backup could point anywhere
+	hasVectors := slices.ContainsFunc(m.Files, func(f backupFile) bool { return f.Name == vectorsFile })
+	if hasVectors && o.vectors == "" {
+		l.Warn("the backup holds a vectors file, set -vectors to restore it", "backed up from", m.Vectors)
+	}
+
+	tmp := path + ".restore"
+	if err := copyFile(filepath.Join(backup, databaseFile), tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	previous, err := keepPrevious(path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// the log of the replaced database must not be replayed into the backup
+	if err := os.Remove(path + ".wal"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	l.Info("restored", "backup", backup, "created", m.Created, "db", path, "previous", previous)
+
+	if hasVectors && o.vectors != "" {
+		if err := copyFile(filepath.Join(backup, vectorsFile), o.vectors); err != nil {
+			return err
+		}
+		l.Info("restored vectors", "file", o.vectors)
+	}
+	return nil
+}
+
+// keepPrevious keeps the database at path, and its write-ahead log, under a
+// new name, leaving them in place, and returns that name, empty when there
+// is no database. Names of earlier restores aren't reused.
+func keepPrevious(path string) (string, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	previous := path + ".before-restore"
+	if _, err := os.Stat(previous); err == nil {
+		previous += "." + time.Now().UTC().Format(backupTime)
+	}
+	for _, suffix := range []string{"", ".wal"} {
+		src, dst := path+suffix, previous+suffix
+		if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		// a hard link keeps a large database without copying it
+		if err := os.Link(src, dst); err == nil {
+			continue
+		}
+		if err := copyFile(src, dst); err != nil {
+			return "", err
+		}
+	}
+	return previous, nil
+}
+
+// localDBPath returns the path of the database file set by -db, which cmd
+// can't work on when it is hosted by MotherDuck or a copy of -remote.
+func localDBPath(o *options, cmd string) (string, error) {
+	if o.remote != "" {
+		return "", fmt.Errorf("%s works on a local database: drop -remote", cmd)
+	}
+	path, _, _ := strings.Cut(o.db, "?")
+	if strings.HasPrefix(path, motherDuckPrefix) {
+		return "", fmt.Errorf("%s works on a local database, MotherDuck manages its storage", cmd)
+	}
+	return path, nil
+}
+
+// listBackups returns the names of the backups in dir, oldest first.
+func listBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if _, err := time.Parse(backupTime, e.Name()); err == nil && e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// downloadBackup downloads the backup name uploaded under prefix into dir,
+// the manifest first to know its files. The manifest comes from the remote
+// too, so its checksums only catch corruption: names other than those of a
+// backup's files are refused before anything is written.
+func downloadBackup(ctx context.Context, prefix, dir, name string) error {
+	tmp := filepath.Join(dir, "."+name+".partial")
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	pull := func(f string) error {
+		r, err := remote.NewRemoteService(strings.TrimSuffix(prefix, "/") + "/" + name + "/" + f)
+		if err != nil {
+			return err
+		}
+		if err := r.Pull(ctx, filepath.Join(tmp, f)); err != nil {
+			return fmt.Errorf("failed to download %s: %w", f, err)
+		}
+		return nil
+	}
+	if err := pull(manifestFile); err != nil {
+		return err
+	}
+	m, err := readManifest(tmp)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, f := range m.Files {
+		if f.Name != databaseFile && f.Name != vectorsFile || seen[f.Name] {
+			return fmt.Errorf("backup %s: unexpected file %q in the manifest", name, f.Name)
+		}
+		seen[f.Name] = true
+	}
+	for _, f := range m.Files {
+		if err := pull(f.Name); err != nil {
+			return err
+		}
+	}
+	os.RemoveAll(filepath.Join(dir, name))
+	return os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// verifyBackup returns the manifest of the backup in dir once its files are
+// checked against it.
+func verifyBackup(dir string) (backupManifest, error) {
+	m, err := readManifest(dir)
+	if err != nil {
+		return m, err
+	}
+	hasDB := false
+	for _, want := range m.Files {
+		if want.Name != databaseFile && want.Name != vectorsFile {
+			return m, fmt.Errorf("unknown file %s", want.Name)
+		}
+		hasDB = hasDB || want.Name == databaseFile
+		got, err := checksum(filepath.Join(dir, want.Name))
+		if err != nil {
+			return m, err
+		}
+		if got != want {
+			return m, fmt.Errorf("%s is corrupt: %d bytes of sha256 %s, want %d bytes of %s", want.Name, got.Size, got.SHA256, want.Size, want.SHA256)
+		}
+	}
+	if !hasDB {
+		return m, fmt.Errorf("no %s", databaseFile)
+	}
+	return m, nil
+}
+
+// readManifest reads the manifest of the backup in dir.
+func readManifest(dir string) (backupManifest, error) {
+	var m backupManifest
+	b, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.Schema != backupSchema {
+		return m, fmt.Errorf("unsupported manifest schema %q, want %s", m.Schema, backupSchema)
+	}
+	return m, nil
+}
+
+// checksum returns the size and SHA-256 of the file at path.
+func checksum(path string) (backupFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return backupFile{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return backupFile{}, err
+	}
+	return backupFile{Name: filepath.Base(path), Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// copyFile copies the file at src to dst, through a temporary file renamed
+// in place so that dst is never left truncated.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
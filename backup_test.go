@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestDownloadBackupNames checks that a manifest listing files other than
+// those of a backup is refused before anything is downloaded.
+func TestDownloadBackupNames(t *testing.T) {
+	const name = "20240301T120000Z"
+	var fetched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, manifestFile) {
+			w.Write([]byte(`{"schema":"` + backupSchema + `","files":[{"name":"index.db"},{"name":"../../outside"}]}`))
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	defer srv.Close()
+
+	dir := filepath.Join(t.TempDir(), "backups")
+	err := downloadBackup(context.Background(), srv.URL+"/backups", dir, name)
+	if err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Fatalf("downloadBackup = %v, want the file refused", err)
+	}
+	if len(fetched) != 1 {
+		t.Errorf("fetched %v, want only the manifest", fetched)
+	}
+	if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+		t.Errorf("the backup was stored: %v", err)
+	}
+}
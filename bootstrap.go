@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"time"
+
+	embed "github.com/codectx/tokens/services/embed"
+	ollama "github.com/ollama/ollama/api"
+)
+
+// ollamaStartTimeout bounds how long bootstrap waits for a launched Ollama.
+const ollamaStartTimeout = 60 * time.Second
+
+// bootstrapOllama makes sure an Ollama server is reachable, launching one when
+// it isn't, and that the embedding model has been pulled. The returned stop
+// function terminates an Ollama process started by bootstrap.
+func bootstrapOllama(ctx context.Context, client *ollama.Client, compose string) (func(), error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+	stop := func() {}
+
+	if err := client.Heartbeat(ctx); err != nil {
+		l.Info("ollama is not reachable, launching it", "error", err)
+
+		switch {
+		case compose != "":
+			cmd := exec.CommandContext(ctx, "docker", "compose", "-f", compose, "up", "-d", "ollama")
+			cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+			if err := cmd.Run(); err != nil {
+				return stop, fmt.Errorf("failed to start compose stack: %w", err)
+			}
+		default:
+			bin, err := exec.LookPath("ollama")
+			if err != nil {
+				return stop, errors.New("ollama is not running and not installed; install it or pass -compose")
+			}
+			cmd := exec.Command(bin, "serve")
+			if err := cmd.Start(); err != nil {
+				return stop, fmt.Errorf("failed to launch ollama: %w", err)
+			}
+			stop = func() {
+				cmd.Process.Kill()
+				cmd.Wait()
+			}
+		}
+
+		if err := waitForOllama(ctx, client); err != nil {
+			stop()
+			return func() {}, err
+		}
+	}
+
+	l.Info("ensuring embedding model is available")
+	var last string
+	err := embed.EnsureModel(ctx, client, func(p ollama.ProgressResponse) {
+		if p.Status != last {
+			last = p.Status
+			l.Info("pull", "status", p.Status)
+		}
+	})
+	if err != nil {
+		stop()
+		return func() {}, err
+	}
+
+	return stop, nil
+}
+
+// waitForOllama polls the Ollama heartbeat until it answers or times out.
+func waitForOllama(ctx context.Context, client *ollama.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, ollamaStartTimeout)
+	defer cancel()
+
+	t := time.NewTicker(500 * time.Millisecond)
+	defer t.Stop()
+
+	for {
+		if err := client.Heartbeat(ctx); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("ollama did not become ready within %s", ollamaStartTimeout)
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	detect "github.com/codectx/tokens/services/detect"
+	embed "github.com/codectx/tokens/services/embed"
+	git "github.com/codectx/tokens/services/git"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// chunkWorkers is the number of files whose chunks are embedded
+// concurrently.
+const chunkWorkers = 4
+
+// embedChunks returns the embedded chunks of the files ids, by file then
+// line. Chunks whose content didn't change since they were stored keep
+// their vector, others are embedded and stored unless the database is
+// read-only. Files that can't be read are skipped; the chunks of files no
+// longer indexed are removed.
+func embedChunks(ctx context.Context, a *app, db store.StorageService, src source, ids []string) ([]store.Chunk, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	stored, err := db.Chunks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[string]store.Chunk{}
+	counts := map[string]int{}
+	for _, c := range stored {
+		byID[c.ID] = c
+		counts[c.File]++
+	}
+
+	var (
+		mu       sync.Mutex
+		out      []store.Chunk
+		embedded int
+		wg       sync.WaitGroup
+	)
+	files := make(chan string, 5)
+	for i := 0; i < chunkWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range files {
+				chunks, n, err := embedFileChunks(ctx, a, src, id, byID)
+				if err != nil {
+					l.Error("Failed to embed chunks", "path", id, "error", err)
+					continue
+				}
+				changed := n > 0 || len(chunks) != counts[id]
+				for _, c := range chunks {
+					// moved by edits above it
+					changed = changed || byID[c.ID].StartLine != c.StartLine
+				}
+				if changed && !a.readOnly {
+					if err := db.ReplaceChunks(ctx, id, chunks); err != nil {
+						l.Error("Failed to store chunks", "path", id, "error", err)
+					}
+				}
+				mu.Lock()
+				out = append(out, chunks...)
+				embedded += n
+				mu.Unlock()
+			}
+		}()
+	}
+	indexed := map[string]bool{}
+	for _, id := range ids {
+		indexed[id] = true
+		files <- id
+	}
+	close(files)
+	wg.Wait()
+
+	if !a.readOnly {
+		for file := range counts {
+			if indexed[file] {
+				continue
+			}
+			if err := db.ReplaceChunks(ctx, file, nil); err != nil {
+				l.Error("Failed to remove chunks", "path", file, "error", err)
+			}
+		}
+	}
+	l.Info("chunks", "files", len(ids), "chunks", len(out), "embedded", embedded)
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].File != out[j].File {
+			return out[i].File < out[j].File
+		}
+		return out[i].StartLine < out[j].StartLine
+	})
+	return out, nil
+}
+
+// embedFileChunks returns the embedded chunks of the file id, reusing the
+// vectors of stored, by chunk id, and the number of chunks it embedded.
+func embedFileChunks(ctx context.Context, a *app, src source, id string, stored map[string]store.Chunk) ([]store.Chunk, int, error) {
+	chunks, _, err := fileChunks(ctx, a, src, id, "")
+	if err != nil {
+		// rows of files outside the walked tree
+		l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+		l.Debug("skip unreadable", "path", id, "error", err)
+		return nil, 0, nil
+	}
+	out, _, embedded, err := embedChunkList(ctx, a, id, detect.Language(id, nil), chunks, stored)
+	return out, embedded, err
+}
+
+// embedChunkList embeds the chunks of the file id, detected as language,
+// reusing the vectors of
+// stored, by chunk id. It returns the embedded chunks, the sum of the
+// metadata of the embeddings it made, and their number. Blank chunks are
+// left out.
+func embedChunkList(ctx context.Context, a *app, id, language string, chunks []chunk, stored map[string]store.Chunk) ([]store.Chunk, embed.Meta, int, error) {
+	var (
+		out      []store.Chunk
+		sum      embed.Meta
+		embedded int
+	)
+	for _, c := range chunks {
+		if strings.TrimSpace(c.Content) == "" {
+			continue
+		}
+		sc := store.Chunk{ID: c.ID, File: id, StartLine: c.StartLine, EndLine: c.EndLine}
+		if s, ok := stored[c.ID]; ok {
+			sc.Vector = s.Vector
+		} else {
+			vec, meta, err := a.embedText(ctx, id, language, c.Content)
+			if err != nil {
+				return nil, sum, 0, err
+			}
+			sc.Vector = vec
+			sum.Tokens += meta.Tokens
+			sum.Duration += meta.Duration
+			sum.ProviderName, sum.ProviderModel = meta.ProviderName, meta.ProviderModel
+			embedded++
+		}
+		out = append(out, sc)
+	}
+	return out, sum, embedded, nil
+}
+
+// embedWindowed embeds the file id, split into chunks, chunk by chunk,
+// re-embedding only the chunks whose content changed since the file was
+// last embedded, and returns the mean of their vectors weighted by their
+// lines as the vector of the file. Only the vectors of chunks that changed
+// are stored and removed. Files without content are embedded whole.
+func embedWindowed(ctx context.Context, a *app, db store.StorageService, id, language, text string, chunks []chunk) ([]float32, embed.Meta, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	stored, err := db.FileChunks(ctx, id)
+	if err != nil {
+		return nil, embed.Meta{}, err
+	}
+	byID := make(map[string]store.Chunk, len(stored))
+	for _, c := range stored {
+		byID[c.ID] = c
+	}
+	embedded, meta, n, err := embedChunkList(ctx, a, id, language, chunks, byID)
+	if err != nil {
+		return nil, meta, err
+	}
+	if len(embedded) == 0 {
+		return a.embedText(ctx, id, language, text)
+	}
+
+	var (
+		remove []string
+		add    []store.Chunk
+		kept   = map[string]bool{}
+	)
+	for _, c := range embedded {
+		kept[c.ID] = true
+		if _, ok := byID[c.ID]; !ok {
+			add = append(add, c)
+		}
+	}
+	for _, c := range stored {
+		if !kept[c.ID] {
+			remove = append(remove, c.ID)
+		}
+	}
+	if err := db.UpdateChunks(ctx, id, remove, add); err != nil {
+		return nil, meta, err
+	}
+	l.Debug("windowed", "path", id, "chunks", len(embedded), "embedded", n)
+	return meanVector(embedded), meta, nil
+}
+
+// chunkDiff is how the chunks of a file changed since it was last indexed,
+// by key: its symbol, suffixed with ~n for the nth chunk of the same symbol.
+type chunkDiff struct {
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+	Modified []string `json:"modified,omitempty"`
+	// Moved counts the unchanged chunks now at other lines.
+	Moved int `json:"moved,omitempty"`
+
+	// remove and add are the changes to the chunk_hashes rows of the file.
+	remove []string
+	add    []store.ChunkHash
+}
+
+// chunkHashes returns the chunk_hashes rows of the chunks of the file id.
+func chunkHashes(id string, chunks []chunk) []store.ChunkHash {
+	out := make([]store.ChunkHash, 0, len(chunks))
+	seen := map[string]int{}
+	for _, c := range chunks {
+		key := chunkSymbol(c.ID)
+		if seen[key]++; seen[key] > 1 {
+			key = fmt.Sprintf("%s~%d", key, seen[key])
+		}
+		out = append(out, store.ChunkHash{File: id, Key: key, Hash: computeHash([]byte(c.Content)), StartLine: c.StartLine, EndLine: c.EndLine})
+	}
+	return out
+}
+
+// diffChunks returns how the chunks of a file changed from old to cur.
+func diffChunks(old, cur []store.ChunkHash) chunkDiff {
+	var d chunkDiff
+	was := make(map[string]store.ChunkHash, len(old))
+	for _, h := range old {
+		was[h.Key] = h
+	}
+	for _, h := range cur {
+		prev, ok := was[h.Key]
+		delete(was, h.Key)
+		switch {
+		case !ok:
+			d.Added = append(d.Added, h.Key)
+		case prev.Hash != h.Hash:
+			d.Modified = append(d.Modified, h.Key)
+			d.remove = append(d.remove, h.Key)
+		case prev.StartLine != h.StartLine || prev.EndLine != h.EndLine:
+			d.Moved++
+			d.remove = append(d.remove, h.Key)
+		default:
+			continue
+		}
+		d.add = append(d.add, h)
+	}
+	for _, h := range old {
+		if _, ok := was[h.Key]; ok {
+			d.Removed = append(d.Removed, h.Key)
+			d.remove = append(d.remove, h.Key)
+		}
+	}
+	return d
+}
+
+// recordChunks diffs the chunks of the file id against those it was split
+// into when it was last indexed, and stores only the rows that changed,
+// attributed to the authors of their lines in blame when given.
+func recordChunks(ctx context.Context, db store.StorageService, id string, chunks []chunk, blame *git.Blame) (chunkDiff, error) {
+	old, err := db.ChunkHashes(ctx, id)
+	if err != nil {
+		return chunkDiff{}, err
+	}
+	d := diffChunks(old, chunkHashes(id, chunks))
+	if blame != nil {
+		for i, h := range d.add {
+			cb := blame.Lines(h.StartLine, h.EndLine)
+			d.add[i].Author, d.add[i].LastCommit = cb.Author, cb.LastCommit
+		}
+	}
+	if len(d.remove) > 0 || len(d.add) > 0 {
+		if err := db.UpdateChunkHashes(ctx, id, d.remove, d.add); err != nil {
+			return chunkDiff{}, err
+		}
+	}
+	return d, nil
+}
+
+// blameChunks attributes the chunks the file id was split into when it was
+// last indexed to the authors of their lines in blame.
+func blameChunks(ctx context.Context, db store.StorageService, id string, blame git.Blame) error {
+	hashes, err := db.ChunkHashes(ctx, id)
+	if err != nil || len(hashes) == 0 {
+		return err
+	}
+	keys := make([]string, len(hashes))
+	for i, h := range hashes {
+		cb := blame.Lines(h.StartLine, h.EndLine)
+		hashes[i].Author, hashes[i].LastCommit = cb.Author, cb.LastCommit
+		keys[i] = h.Key
+	}
+	return db.UpdateChunkHashes(ctx, id, keys, hashes)
+}
+
+// meanVector returns the mean of the vectors of chunks weighted by their
+// number of lines.
+func meanVector(chunks []store.Chunk) []float32 {
+	mean := make([]float32, len(chunks[0].Vector))
+	var total float32
+	for _, c := range chunks {
+		w := float32(c.EndLine - c.StartLine + 1)
+		for j := range mean {
+			if j < len(c.Vector) {
+				mean[j] += w * c.Vector[j]
+			}
+		}
+		total += w
+	}
+	for j := range mean {
+		mean[j] /= total
+	}
+	return mean
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	cluster "github.com/codectx/tokens/services/cluster"
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+	summary "github.com/codectx/tokens/services/summary"
+)
+
+// clustersSchema is the schema of the JSON output of cluster.
+const clustersSchema = "codectx.clusters/v1"
+
+const (
+	// representatives is the default number of files listed per topic,
+	// those nearest to its centroid.
+	representatives = 3
+	// labelFiles bounds the files a label is generated from.
+	labelFiles = 8
+	// labelExcerpt bounds the text of a file without a stored summary sent
+	// to label its topic, in bytes.
+	labelExcerpt = 600
+)
+
+// member is a file of a topic, at its distance from the centroid.
+type member struct {
+	Path     string  `json:"path"`
+	Distance float32 `json:"distance"`
+}
+
+// topic is a cluster of similar files.
+type topic struct {
+	Label string `json:"label,omitempty"`
+	Size  int    `json:"size"`
+	// Spread is the mean distance of the files to the centroid, lower
+	// for tighter topics.
+	Spread float32 `json:"spread"`
+	// Representatives are the files nearest to the centroid.
+	Representatives []member `json:"representatives"`
+	// Files are every file of the topic, nearest first.
+	Files []member `json:"files"`
+}
+
+// clustersOutput is the JSON output of cluster, schema codectx.clusters/v1.
+type clustersOutput struct {
+	Schema string  `json:"schema"`
+	Index  string  `json:"index"`
+	Topics []topic `json:"topics"`
+}
+
+// runCluster groups the files of a stored index by the similarity of their
+// vectors with k-means and lists each group with the files nearest to its
+// centroid, largest first, for an overview of an unfamiliar repo. -labels
+// names every group with a generative model.
+func runCluster(ctx context.Context, args []string) error {
+	fs := newFlagSet("cluster")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeLexical) // clustering stored vectors doesn't embed
+	k := fs.Int("clusters", 0, "number of topics, 0 for about the square root of half the files")
+	reps := fs.Int("representatives", representatives, "number of files listed per topic")
+	labels := fs.Bool("labels", false, "name every topic with the -summary-model generative model")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if *k < 0 || *reps < 1 {
+		return fmt.Errorf("invalid -clusters %d or -representatives %d", *k, *reps)
+	}
+	wd := "."
+	if fs.NArg() > 0 {
+		wd = fs.Arg(0)
+	}
+	// keep stdout for the topics
+	l := newLogger(os.Stderr)
+	ctx = context.WithValue(ctx, LoggerCtxKey, l)
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+
+	all, err := db.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(all))
+	for id, e := range all {
+		if len(e.Vector) > 0 {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("index %s has no vectors, index it with embeddings first", displayName(o.namespace))
+	}
+	// k-means is deterministic for vectors in the same order
+	sort.Strings(ids)
+	vectors := make([][]float32, len(ids))
+	for i, id := range ids {
+		vectors[i] = all[id].Vector
+	}
+	if *k == 0 {
+		*k = topicCount(len(ids))
+	}
+
+	out := clustersOutput{Schema: clustersSchema, Index: displayName(o.namespace), Topics: []topic{}}
+	for _, group := range cluster.KMeans(vectors, *k) {
+		members := make([][]float32, len(group))
+		for i, v := range group {
+			members[i] = vectors[v]
+		}
+		c := cluster.Centroid(members)
+		t := topic{Size: len(group)}
+		var sum float32
+		for _, v := range group {
+			d := index.CosineDistance(c, vectors[v])
+			sum += d
+			t.Files = append(t.Files, member{Path: ids[v], Distance: d})
+		}
+		t.Spread = sum / float32(len(group))
+		sort.SliceStable(t.Files, func(i, j int) bool { return t.Files[i].Distance < t.Files[j].Distance })
+		out.Topics = append(out.Topics, t)
+	}
+	sort.SliceStable(out.Topics, func(i, j int) bool { return out.Topics[i].Size > out.Topics[j].Size })
+
+	if *labels {
+		if err := labelTopics(ctx, a, db, wd, out.Topics); err != nil {
+			return err
+		}
+	}
+	for i := range out.Topics {
+		t := &out.Topics[i]
+		for j := range t.Files {
+			t.Files[j].Path = relPath(wd, t.Files[j].Path)
+		}
+		t.Representatives = t.Files[:min(len(t.Files), *reps)]
+	}
+	l.Info("clustered", "index", out.Index, "files", len(ids), "topics", len(out.Topics))
+
+	if o.json {
+		return json.NewEncoder(os.Stdout).Encode(out)
+	}
+	for i, t := range out.Topics {
+		label := t.Label
+		if label == "" {
+			label = "(unlabelled)"
+		}
+		fmt.Printf("%d. %s: %d files, spread %.3f\n", i+1, label, t.Size, t.Spread)
+		for _, m := range t.Representatives {
+			fmt.Printf("   %s\n", m.Path)
+		}
+	}
+	return nil
+}
+
+// topicCount is the default number of topics of n vectors, about the square
+// root of half of them.
+func topicCount(n int) int {
+	return max(2, int(math.Round(math.Sqrt(float64(n)/2))))
+}
+
+// labelTopics names every topic from the stored summaries of its files
+// nearest to the centroid, else from their first lines. Topics whose label
+// fails are left unlabelled.
+func labelTopics(ctx context.Context, a *app, db store.StorageService, wd string, topics []topic) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	sums, err := db.Summaries(ctx, store.SummaryFile)
+	if err != nil {
+		return err
+	}
+	summaries := map[string]string{}
+	for _, s := range sums {
+		summaries[s.ID] = s.Text
+	}
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	labeller := summary.NewSummaryService(a.ollama, a.opts.summaryModel)
+	for i := range topics {
+		t := &topics[i]
+		files := map[string]string{}
+		for _, m := range t.Files[:min(len(t.Files), labelFiles)] {
+			text, ok := summaries[m.Path]
+			if !ok {
+				text, _ = readText(ctx, a, src, m.Path)
+				text = excerpt(text, labelExcerpt)
+			}
+			files[relPath(wd, m.Path)] = text
+		}
+		label, err := labeller.Label(ctx, files)
+		if err != nil {
+			l.Warn("Failed to label topic", "topic", i+1, "error", err)
+			continue
+		}
+		t.Label = label
+	}
+	return nil
+}
+
+// excerpt cuts text to n bytes, at a line break when there is one.
+func excerpt(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	text = text[:n]
+	if i := strings.LastIndexByte(text, '\n'); i > 0 {
+		text = text[:i]
+	}
+	return text
+}
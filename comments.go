@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+	symbols "github.com/codectx/tokens/services/symbols"
+)
+
+// recordDocs embeds the comments and docstrings of the file id apart from
+// its code for -doc-weight, unless they were embedded from the same
+// comments. Files without comments have their vector removed.
+func recordDocs(ctx context.Context, a *app, db store.StorageService, id, language, text string) error {
+	comments := symbols.Comments(language, text)
+	if comments == "" {
+		return db.DeleteDoc(ctx, id)
+	}
+	hash := computeHash([]byte(comments))
+	if match, err := db.MatchDoc(ctx, id, hash); err != nil || match {
+		return err
+	}
+	vec, _, err := a.embedText(ctx, id, language, comments)
+	if err != nil {
+		return err
+	}
+	return db.UpsertDoc(ctx, id, hash, vec)
+}
+
+// docCandidates returns the files whose comments are nearest to the query
+// but are missing from hits, so that a file documenting what is asked for
+// competes even when its code is far from it.
+func docCandidates(ctx context.Context, db store.StorageService, req searchRequest, hits []hit) ([]hit, error) {
+	seen := make(map[string]bool, len(hits))
+	for _, h := range hits {
+		seen[h.ID] = true
+	}
+	docs, err := db.Docs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type match struct {
+		id string
+		d  float32
+	}
+	var matches []match
+	for id, vec := range docs {
+		if !seen[id] && len(vec) == len(req.Vector) {
+			matches = append(matches, match{id, index.CosineDistance(req.Vector, vec)})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].d != matches[j].d {
+			return matches[i].d < matches[j].d
+		}
+		return matches[i].id < matches[j].id
+	})
+	if len(matches) > req.K {
+		matches = matches[:req.K]
+	}
+
+	picked := make([]string, len(matches))
+	for i, m := range matches {
+		picked[i] = m.id
+	}
+	return vectorHits(ctx, db, req, picked)
+}
+
+// docDistances returns the distance of the comments of each of hits to the
+// query, for the files with comments.
+func docDistances(ctx context.Context, db store.StorageService, req searchRequest, hits []hit) (map[string]float32, error) {
+	ids := make([]string, len(hits))
+	for i, h := range hits {
+		ids[i] = h.ID
+	}
+	docs, err := db.Docs(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]float32, len(docs))
+	for id, vec := range docs {
+		if len(vec) == len(req.Vector) {
+			out[id] = index.CosineDistance(req.Vector, vec)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	store "github.com/codectx/tokens/services/store"
+)
+
+// runCompact drops the rows left behind by deleted files in every index of
+// the database, rewrites the -vectors file, and copies the database into a
+// new file of only its live rows, reporting the space reclaimed. DuckDB
+// reuses the blocks of deleted rows but never shrinks its file otherwise.
+func runCompact(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("compact")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeLexical) // compacting doesn't embed
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	path, err := localDBPath(o, "compact")
+	if err != nil {
+		return err
+	}
+
+	before := fileSize(path) + fileSize(path+".wal")
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			a.Close()
+		}
+	}()
+	if a.readOnly {
+		return errors.New("compact needs to write to the database")
+	}
+
+	namespaces, err := store.Namespaces(ctx, a.database)
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		db, err := a.store(ns.Name)
+		if err != nil {
+			return err
+		}
+		n, err := db.DropOrphans(ctx)
+		if err != nil {
+			return fmt.Errorf("index %s: %w", displayName(ns.Name), err)
+		}
+		l.Info("dropped orphans", "index", displayName(ns.Name), "rows", n)
+	}
+
+	if a.vectors != nil {
+		ns := a.vectors.Namespace()
+		db, err := a.store(ns)
+		if err != nil {
+			return err
+		}
+		all, err := db.GetAll(ctx)
+		if err != nil {
+			return err
+		}
+		was := fileSize(o.vectors)
+		if err := rewriteVectors(ctx, a, ns, commonDims(all)); err != nil {
+			return err
+		}
+		l.Info("rewrote vectors", "file", o.vectors, "before", formatBytes(was), "after", formatBytes(fileSize(o.vectors)))
+	}
+
+	tmp := path + ".compact"
+	os.Remove(tmp)
+	if err := copyDatabase(ctx, a, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	closed = true
+	if err := a.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// The copy was checkpointed, a log of the old file must not be replayed
+	// onto it
+	os.Remove(path + ".wal")
+
+	after := fileSize(path)
+	l.Info("compacted", "db", path, "before", formatBytes(before), "after", formatBytes(after), "reclaimed", formatBytes(max(before-after, 0)))
+	return nil
+}
+
+// copyDatabase checkpoints the database of a and copies its tables into a
+// new database file at path.
+func copyDatabase(ctx context.Context, a *app, path string) error {
+	// ATTACH holds for the connection it runs on
+	conn, err := a.database.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var name string
+	if err := conn.QueryRowContext(ctx, "SELECT current_database();").Scan(&name); err != nil {
+		return fmt.Errorf("failed to name the database: %w", err)
+	}
+	for _, q := range []string{
+		"CHECKPOINT;",
+		"ATTACH '" + strings.ReplaceAll(path, "'", "''") + "' AS compacted;",
+		`COPY FROM DATABASE "` + strings.ReplaceAll(name, `"`, `""`) + `" TO compacted;`,
+		"DETACH compacted;",
+	} {
+		if _, err := conn.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("failed to copy the database: %w", err)
+		}
+	}
+	return nil
+}
+
+// fileSize returns the size of the file at path, 0 when it doesn't exist.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// runIndexes lists the named indexes stored in the database.
+func runIndexes(ctx context.Context, args []string) error {
+	fs := newFlagSet("indexes")
+	o := &options{}
+	o.register(fs)
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	namespaces, err := store.Namespaces(ctx, a.database)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tFILES")
+	for _, ns := range namespaces {
+		name := ns.Name
+		if name == "" {
+			name = "(default)"
+		}
+		if ns.Name == o.namespace {
+			name += " *"
+		}
+		fmt.Fprintf(w, "%s\t%d\n", name, ns.Rows)
+	}
+	return w.Flush()
+}
+
+// runCompare runs the same queries against two indexes and prints their
+// results side by side.
+func runCompare(ctx context.Context, args []string) error {
+	fs := newFlagSet("compare")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeVector) // needs embeddings
+	left := fs.String("a", "", "first index to compare (default index when empty)")
+	right := fs.String("b", "", "second index to compare")
+	queriesFile := fs.String("queries", "", "file with one query per line, in addition to queries given as arguments")
+	k := fs.Int("k", defaultTopK, "number of results per query")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	for _, ns := range []string{*left, *right} {
+		if err := store.ValidateNamespace(ns); err != nil {
+			return err
+		}
+	}
+	if *left == *right {
+		return fmt.Errorf("-a and -b must name different indexes")
+	}
+
+	queries := fs.Args()
+	if *queriesFile != "" {
+		qs, err := readLines(*queriesFile)
+		if err != nil {
+			return err
+		}
+		queries = append(queries, qs...)
+	}
+	if len(queries) == 0 {
+		return fmt.Errorf("no queries: pass them as arguments or with -queries")
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	names := []string{*left, *right}
+	dbs := make([]store.StorageService, 2)
+	idxs := make([]index.IndexService, 2)
+	for i, ns := range names {
+		if dbs[i], err = a.store(ns); err != nil {
+			return err
+		}
+		if idxs[i], err = loadIndex(ctx, a, ns); err != nil {
+			return fmt.Errorf("failed to load index %q: %w", ns, err)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, query := range queries {
+		q, _, err := a.embedQuery(ctx, query)
+		if err != nil {
+			return fmt.Errorf("failed to embed query: %w", err)
+		}
+
+		results := make([][]hit, 2)
+		for i := range idxs {
+			if d := idxs[i].Dims(); d != 0 && d != len(q) {
+				return fmt.Errorf("index %q holds %d-dimensional vectors but the query has %d; was it built with another provider?", names[i], d, len(q))
+			}
+			if results[i], err = searchIndex(ctx, a, dbs[i], idxs[i], searchRequest{Vector: q, K: *k, Author: o.author, Languages: o.languages()}); err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(w, "\nquery: %s\t\t\toverlap: %.2f\n", query, overlap(results[0], results[1]))
+		fmt.Fprintf(w, "#\t%s\t\t%s\n", displayName(names[0]), displayName(names[1]))
+		for rank := 0; rank < *k; rank++ {
+			fmt.Fprintf(w, "%d\t%s\t\t%s\n", rank+1, cell(results[0], rank), cell(results[1], rank))
+		}
+	}
+	return w.Flush()
+}
+
+// cell formats the result at rank, or a dash when there is none.
+func cell(hits []hit, rank int) string {
+	if rank >= len(hits) {
+		return "-"
+	}
+	return fmt.Sprintf("%s (%.3f)", hits[rank].ID, hits[rank].Score)
+}
+
+// overlap returns the Jaccard similarity of the two result sets.
+func overlap(a, b []hit) float64 {
+	set := map[string]bool{}
+	for _, h := range a {
+		set[h.ID] = true
+	}
+	shared := 0
+	for _, h := range b {
+		if set[h.ID] {
+			shared++
+		}
+	}
+	union := len(a) + len(b) - shared
+	if union == 0 {
+		return 1
+	}
+	return float64(shared) / float64(union)
+}
+
+// displayName names the default index explicitly.
+func displayName(ns string) string {
+	if ns == "" {
+		return "(default)"
+	}
+	return ns
+}
+
+// readLines returns the non-blank lines of a file, skipping # comments.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			out = append(out, line)
+		}
+	}
+	return out, sc.Err()
+}
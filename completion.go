@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	detect "github.com/codectx/tokens/services/detect"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// completeCommand is the hidden command completion scripts call with the
+// words of the command line, the one being completed last.
+const completeCommand = "__complete"
+
+// completing is set while completing, so that newFlagSet hands flag sets
+// over to flagsOf instead of printing help.
+var completing bool
+
+// flagSetOf carries a flag set out of a command run by flagsOf.
+type flagSetOf struct {
+	fs *flag.FlagSet
+}
+
+// candidate is a completion of the current word.
+type candidate struct {
+	value string
+	desc  string
+}
+
+// completionScripts are the completion scripts by shell, formatted with the
+// program name. They call the program back to complete each word, falling
+// back to file names when it has no candidates.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for %[1]s
+_%[1]s() {
+	local IFS=$'\n'
+	COMPREPLY=($("${COMP_WORDS[0]}" ` + completeCommand + ` "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null | cut -f1))
+}
+complete -o default -F _%[1]s %[1]s
+`,
+	"zsh": `#compdef %[1]s
+# zsh completion for %[1]s
+_%[1]s() {
+	local -a candidates
+	local line
+	for line in ${(f)"$(${words[1]} ` + completeCommand + ` "${(@)words[2,CURRENT]}" 2>/dev/null)"}; do
+		candidates+=("${${line%%%%$'\t'*}//:/\\:}:${line#*$'\t'}")
+	done
+	if (( ${#candidates} )); then
+		_describe %[1]s candidates
+	else
+		_files
+	fi
+}
+compdef _%[1]s %[1]s
+`,
+	"fish": `# fish completion for %[1]s
+complete -c %[1]s -a '(%[1]s ` + completeCommand + ` (commandline -opc)[2..-1] (commandline -ct) 2>/dev/null)'
+`,
+}
+
+// runCompletion prints the completion script of a shell.
+func runCompletion(ctx context.Context, args []string) error {
+	fs := newFlagSet("completion")
+	name := fs.String("name", programName, "name of the program to complete")
+	fs.Parse(args)
+
+	script, ok := completionScripts[fs.Arg(0)]
+	if fs.NArg() != 1 || !ok {
+		fs.Usage()
+		return fmt.Errorf("usage: completion bash|zsh|fish")
+	}
+	fmt.Printf(script, *name)
+	return nil
+}
+
+// runComplete prints the candidates of the last word of args, one per line
+// with its description after a tab.
+func runComplete(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	completing = true
+	for _, c := range complete(ctx, args[:len(args)-1], args[len(args)-1]) {
+		fmt.Printf("%s\t%s\n", c.value, c.desc)
+	}
+	return nil
+}
+
+// complete returns the candidates of cur, typed after words.
+func complete(ctx context.Context, words []string, cur string) []candidate {
+	command := ""
+	if len(words) > 0 {
+		if _, ok := commands[words[0]]; ok {
+			command, words = words[0], words[1:]
+		}
+	}
+	fs := flagsOf(ctx, command)
+	if fs == nil {
+		return nil
+	}
+
+	// the value of the previous flag
+	if n := len(words); n > 0 && isFlag(words[n-1]) && !strings.Contains(words[n-1], "=") {
+		if f := fs.Lookup(strings.TrimLeft(words[n-1], "-")); f != nil && !isBoolFlag(f) {
+			return filter(flagValues(ctx, command, f.Name, cur, words), cur)
+		}
+	}
+	args := positional(fs, words)
+	if isFlag(cur) && len(args) == 0 {
+		return filter(flagCandidates(fs, strings.Repeat("-", len(cur)-len(strings.TrimLeft(cur, "-")))), cur)
+	}
+
+	var out []candidate
+	switch command {
+	case "":
+		if len(words) == 0 {
+			for _, name := range commandNames() {
+				out = append(out, candidate{name, helps[name].summary})
+			}
+		}
+	case "queries":
+		switch {
+		case len(args) == 0:
+			out = values("save", "list", "delete", "run")
+		case args[0] == "delete" && len(args) == 1, args[0] == "run":
+			out = savedQueries(ctx, words)
+		}
+	case "auth":
+		switch {
+		case len(args) == 0:
+			out = values("login", "logout", "status")
+		case args[0] == "status", len(args) == 1:
+			out = values(keyedProviders...)
+		}
+	case "completion":
+		if len(args) == 0 {
+			out = values("bash", "zsh", "fish")
+		}
+	case "config":
+		switch {
+		case len(args) == 0:
+			out = values("list", "get", "path")
+		case args[0] == "get" && len(args) == 1:
+			out = configKeys(ctx)
+		}
+	case "feedback":
+		if len(args) == 2 {
+			out = values("good", "bad")
+		}
+	}
+	return filter(out, cur)
+}
+
+// flagsOf returns the flag set of command, "" for the search run without a
+// subcommand. Commands are run with -h, for which newFlagSet panics with
+// their flag set before they do anything else.
+func flagsOf(ctx context.Context, command string) (fs *flag.FlagSet) {
+	if command == "" {
+		fs = newFlagSet("")
+		(&options{}).register(fs)
+		return fs
+	}
+	run, ok := commands[command]
+	if !ok || command == completeCommand {
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			f, ok := r.(flagSetOf)
+			if !ok {
+				panic(r)
+			}
+			fs = f.fs
+		}
+	}()
+	run(ctx, []string{"-h"})
+	return nil
+}
+
+// positional returns the arguments of words after the flags, where the flag
+// package stops parsing.
+func positional(fs *flag.FlagSet, words []string) []string {
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		if w == "--" {
+			return words[i+1:]
+		}
+		if !isFlag(w) {
+			return words[i:]
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(w, "-"), "=")
+		if f := fs.Lookup(name); f != nil && !hasValue && !isBoolFlag(f) {
+			i++
+		}
+	}
+	return nil
+}
+
+// flagCandidates lists the flags of fs with the given dashes.
+func flagCandidates(fs *flag.FlagSet, dashes string) []candidate {
+	var out []candidate
+	fs.VisitAll(func(f *flag.Flag) {
+		_, usage := flag.UnquoteUsage(f)
+		out = append(out, candidate{dashes + f.Name, usage})
+	})
+	return out
+}
+
+// flagValues completes the value of the flag name of command.
+func flagValues(ctx context.Context, command, name, cur string, words []string) []candidate {
+	switch name {
+	case "index", "namespace":
+		return indexNames(ctx, words)
+	case "a", "b":
+		if command == "compare" {
+			return indexNames(ctx, words)
+		}
+		return values("ollama", "voyage", "onnx:")
+	case "provider":
+		return values("ollama", "voyage", "onnx:")
+	case "mode":
+		return values(modeAuto, modeVector, modeLexical)
+	case "space-policy":
+		return values(spaceRefuse, spaceReembed)
+	case "engine":
+		return values(engineAuto, engineFlat, engineHNSW, engineDuckDB)
+	case "generated":
+		return values(generatedSkip, generatedDownweight, generatedKeep)
+	case "encoding", "fallback-encoding":
+		return values("auto", "utf-8", "utf-16le", "utf-16be", "windows-1252", "iso-8859-2", "shift_jis", "gbk")
+	case "lang":
+		// complete the last of a comma-separated list
+		done, _ := cutLast(cur, ",")
+		var out []candidate
+		for _, lang := range detect.Languages() {
+			out = append(out, candidate{done + lang, ""})
+		}
+		return out
+	}
+	return nil
+}
+
+// cutLast splits s after the last sep, keeping sep in before.
+func cutLast(s, sep string) (before, after string) {
+	i := strings.LastIndex(s, sep)
+	return s[:i+1], s[i+1:]
+}
+
+// indexNames lists the named indexes of the database selected by words.
+func indexNames(ctx context.Context, words []string) []candidate {
+	db, err := completionDB(ctx, words)
+	if err != nil {
+		return nil
+	}
+	defer db.Close()
+	namespaces, err := store.Namespaces(ctx, db)
+	if err != nil {
+		return nil
+	}
+	var out []candidate
+	for _, ns := range namespaces {
+		if ns.Name != "" {
+			out = append(out, candidate{ns.Name, fmt.Sprintf("%d files", ns.Rows)})
+		}
+	}
+	return out
+}
+
+// savedQueries lists the names of the saved queries.
+func savedQueries(ctx context.Context, words []string) []candidate {
+	db, err := completionDB(ctx, words)
+	if err != nil {
+		return nil
+	}
+	defer db.Close()
+	qs, err := store.NewQueryStore(db)
+	if err != nil {
+		return nil
+	}
+	saved, err := qs.List(ctx)
+	if err != nil {
+		return nil
+	}
+	var out []candidate
+	for _, q := range saved {
+		out = append(out, candidate{q.Name, q.Query})
+	}
+	return out
+}
+
+// completionDB opens the database set by -db in words, else by the config
+// files or the default, read-only.
+func completionDB(ctx context.Context, words []string) (*sql.DB, error) {
+	o := &options{}
+	fs := flag.NewFlagSet(completeCommand, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	o.register(fs)
+	for i, w := range words {
+		name, value, ok := strings.Cut(strings.TrimLeft(w, "-"), "=")
+		if !isFlag(w) || name != "db" {
+			continue
+		}
+		if !ok && i+1 < len(words) {
+			value = words[i+1]
+		}
+		fs.Set("db", value)
+	}
+	if err := applyConfig(fs, "."); err != nil {
+		return nil, err
+	}
+	o.readOnly = true
+	db, _, err := openDB(ctx, o)
+	return db, err
+}
+
+// configKeys lists the flags of every command, which config files may set.
+func configKeys(ctx context.Context) []candidate {
+	seen := map[string]bool{}
+	var out []candidate
+	for _, command := range append([]string{""}, commandNames()...) {
+		fs := flagsOf(ctx, command)
+		if fs == nil {
+			continue
+		}
+		for _, c := range flagCandidates(fs, "") {
+			if !seen[c.value] {
+				seen[c.value] = true
+				out = append(out, c)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].value < out[j].value })
+	return out
+}
+
+// commandNames lists the visible commands, sorted.
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		if name != completeCommand {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// values returns candidates without descriptions.
+func values(vs ...string) []candidate {
+	out := make([]candidate, len(vs))
+	for i, v := range vs {
+		out[i] = candidate{value: v}
+	}
+	return out
+}
+
+// filter keeps the candidates starting with cur.
+func filter(cs []candidate, cur string) []candidate {
+	var out []candidate
+	for _, c := range cs {
+		if strings.HasPrefix(c.value, cur) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// isFlag reports whether w looks like a flag.
+func isFlag(w string) bool {
+	return len(w) > 1 && w[0] == '-'
+}
+
+// isBoolFlag reports whether f takes no value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// repoConfigFile is the per-repository config, looked up from the
+	// indexed path up to the repository root.
+	repoConfigFile = ".codectx.yaml"
+	// configEnvKey holds environment variables rather than a flag.
+	configEnvKey = "env"
+)
+
+// repoConfigKeys are the flags a .codectx.yaml may set: what is indexed and
+// how results are ranked. A cloned repository isn't trusted like the user's
+// own config, so keys naming a command, a URL, a database or another file are
+// ignored in it, and so is env.
+var repoConfigKeys = map[string]bool{
+	"index": true, "namespace": true, "no-default-ignores": true, "generated": true,
+	"encoding": true, "fallback-encoding": true, "windowed": true, "normalize": true,
+	"preprocess": true, "blame": true, "tests": true, "lang": true, "by-dir": true,
+	"depth": true, "path-weight": true, "doc-weight": true, "multi-vector-weight": true,
+	"sparse-weight": true, "lexical-weight": true, "clean-query": true, "boilerplate": true,
+	"not-weight": true, "mode": true, "deterministic": true, "workers": true,
+	"max-workers": true, "max-cpu": true, "max-embeds-per-min": true, "batch-size": true,
+	"batch-tokens": true, "max-input-tokens": true, "truncate": true, "space-policy": true,
+	"log-level": true, "shard": true, "exact": true, "flat-limit": true, "engine": true,
+	"memory-limit": true, "latency-target": true, "f16": true, "k": true,
+}
+
+// envFlags are the flags defaulting to an environment variable, which the
+// config files don't override when it is set.
+var envFlags = map[string]string{
+	"index":        "CODECTX_INDEX",
+	"namespace":    "CODECTX_INDEX",
+	"db":           "CODECTX_DB",
+	"remote":       "CODECTX_REMOTE",
+	"embed-cache":  "CODECTX_EMBED_CACHE",
+	"ollama-hosts": "OLLAMA_HOSTS",
+	"admin-token":  "CODECTX_ADMIN_TOKEN",
+}
+
+// config is the content of a config file: flag values by flag name, without
+// the dash, and environment variables under env, such as API keys.
+type config struct {
+	flags map[string]string
+	env   map[string]string
+}
+
+// globalConfigPath returns $XDG_CONFIG_HOME/codectx/config.yaml, defaulting
+// to ~/.config/codectx/config.yaml, or $CODECTX_CONFIG when set.
+func globalConfigPath() string {
+	if p := os.Getenv("CODECTX_CONFIG"); p != "" {
+		return p
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "codectx", "config.yaml")
+}
+
+// findRepoConfig returns the path of the .codectx.yaml closest to dir,
+// stopping at the repository root, or "" when there is none.
+func findRepoConfig(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		p := filepath.Join(dir, repoConfigFile)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readConfig parses the config file at path; a missing file is empty.
+func readConfig(path string) (config, error) {
+	c := config{flags: map[string]string{}, env: map[string]string{}}
+	if path == "" {
+		return c, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+
+	var raw map[string]any
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return c, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for key, v := range raw {
+		if key == configEnvKey {
+			env, ok := v.(map[string]any)
+			if !ok {
+				return c, fmt.Errorf("%s: %s must map variable names to values", path, configEnvKey)
+			}
+			for name, value := range env {
+				c.env[name] = fmt.Sprint(value)
+			}
+			continue
+		}
+		value, err := configValue(v)
+		if err != nil {
+			return c, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+		c.flags[key] = value
+	}
+	return c, nil
+}
+
+// configValue formats a YAML value as a flag value; lists are joined by
+// commas, as in lang: [go, python].
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ","), nil
+	case map[string]any:
+		return "", errors.New("expected a value or a list, not a map")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// trusted returns c restricted to what a repository file may set, and the
+// keys left out, sorted.
+func (c config) trusted() (config, []string) {
+	out := config{flags: map[string]string{}, env: map[string]string{}}
+	var ignored []string
+	for k, v := range c.flags {
+		if repoConfigKeys[k] {
+			out.flags[k] = v
+		} else {
+			ignored = append(ignored, k)
+		}
+	}
+	for name := range c.env {
+		ignored = append(ignored, configEnvKey+"."+name)
+	}
+	sort.Strings(ignored)
+	return out, ignored
+}
+
+// merge overrides the values of c with those of other.
+func (c config) merge(other config) {
+	for k, v := range other.flags {
+		c.flags[k] = v
+	}
+	for k, v := range other.env {
+		c.env[k] = v
+	}
+}
+
+// applyConfig sets the flags of fs left unset on the command line, and by
+// their environment variable, from the global config, overridden by the
+// repoConfigKeys of the .codectx.yaml of dir, and the environment variables
+// the global config lists that aren't already set. Keys that aren't flags of
+// fs belong to other commands and are ignored.
+func applyConfig(fs *flag.FlagSet, dir string) error {
+	c, err := readConfig(globalConfigPath())
+	if err != nil {
+		return err
+	}
+	repo, err := readConfig(findRepoConfig(dir))
+	if err != nil {
+		return err
+	}
+	repo, _ = repo.trusted()
+	c.merge(repo)
+
+	for name, value := range c.env {
+		if _, ok := os.LookupEnv(name); !ok {
+			os.Setenv(name, value)
+		}
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	names := make([]string, 0, len(c.flags))
+	for name := range c.flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if set[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if env, ok := envFlags[name]; ok && os.Getenv(env) != "" {
+			continue
+		}
+		if err := fs.Set(name, c.flags[name]); err != nil {
+			return fmt.Errorf("invalid config value of %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// runConfig shows the values the config files set for a path, the current
+// directory by default, and which file sets each.
+func runConfig(ctx context.Context, args []string) error {
+	fs := newFlagSet("config")
+	fs.Parse(args)
+
+	action, dir := fs.Arg(0), "."
+	if action == "get" && fs.NArg() > 2 {
+		dir = fs.Arg(2)
+	} else if action != "get" && fs.NArg() > 1 {
+		dir = fs.Arg(1)
+	}
+	globalPath, repoPath := globalConfigPath(), findRepoConfig(dir)
+	global, err := readConfig(globalPath)
+	if err != nil {
+		return err
+	}
+	repo, err := readConfig(repoPath)
+	if err != nil {
+		return err
+	}
+	repo, ignored := repo.trusted()
+
+	// source returns the file setting key, the repository one first
+	source := func(key string) (string, string, bool) {
+		if v, ok := repo.flags[key]; ok {
+			return v, repoPath, true
+		}
+		v, ok := global.flags[key]
+		return v, globalPath, ok
+	}
+
+	switch action {
+	case "path":
+		if repoPath == "" {
+			repoPath = "(none)"
+		}
+		fmt.Printf("global: %s\nrepository: %s\n", globalPath, repoPath)
+		return nil
+	case "get":
+		if fs.NArg() < 2 {
+			return fmt.Errorf("usage: config get KEY [path]")
+		}
+		v, _, ok := source(fs.Arg(1))
+		if !ok {
+			return fmt.Errorf("%s is not set by the config files", fs.Arg(1))
+		}
+		fmt.Println(v)
+		return nil
+	case "list":
+		merged := config{flags: map[string]string{}, env: map[string]string{}}
+		merged.merge(global)
+		merged.merge(repo)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE\tFILE")
+		for _, key := range sortedKeys(merged.flags) {
+			v, file, _ := source(key)
+			fmt.Fprintf(w, "%s\t%s\t%s\n", key, v, file)
+		}
+		// environment values are often secrets, only their source is shown
+		for _, name := range sortedKeys(merged.env) {
+			fmt.Fprintf(w, "%s.%s\t(set)\t%s\n", configEnvKey, name, globalPath)
+		}
+		for _, key := range ignored {
+			fmt.Fprintf(w, "%s\t(ignored: not a repository key)\t%s\n", key, repoPath)
+		}
+		return w.Flush()
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+// sortedKeys returns the keys of m, sorted.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRepoConfig checks that a .codectx.yaml only sets tuning flags: not a
+// command, a database, nor environment variables, and not over $CODECTX_*.
+func TestRepoConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, ".git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	repo := "lang: [go, python]\nindex: theirs\nprovider: exec:./pwn\nchunker: ./pwn\ndb: /tmp/elsewhere.db\nenv:\n  CODECTX_TEST_INJECTED: yes\n"
+	if err := os.WriteFile(filepath.Join(dir, repoConfigFile), []byte(repo), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CODECTX_CONFIG", filepath.Join(dir, "missing.yaml"))
+	t.Setenv("CODECTX_INDEX", "mine")
+	t.Setenv("CODECTX_DB", "")
+
+	fs := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	o := &options{}
+	o.register(fs)
+	if err := applyConfig(fs, dir); err != nil {
+		t.Fatal(err)
+	}
+	if o.lang != "go,python" {
+		t.Errorf("lang = %q, want go,python", o.lang)
+	}
+	if o.namespace != "mine" {
+		t.Errorf("index = %q, want $CODECTX_INDEX", o.namespace)
+	}
+	for name, got := range map[string]string{"provider": o.provider, "chunker": o.chunker, "db": o.db} {
+		if got != fs.Lookup(name).DefValue {
+			t.Errorf("%s = %q, set by the repository config", name, got)
+		}
+	}
+	if _, ok := os.LookupEnv("CODECTX_TEST_INJECTED"); ok {
+		t.Error("the repository config set an environment variable")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	detect "github.com/codectx/tokens/services/detect"
+)
+
+// clipboardCommands are the commands tried in order to write the clipboard on
+// each OS; on Linux, Wayland first, then X11.
+var clipboardCommands = map[string][][]string{
+	"darwin":  {{"pbcopy"}},
+	"windows": {{"clip"}},
+	"linux": {
+		{"wl-copy"},
+		{"xclip", "-selection", "clipboard"},
+		{"xsel", "--clipboard", "--input"},
+	},
+}
+
+// contextBlock formats hits as context to paste into a chat: the query, then
+// each file as a fenced block headed by its path. With lines > 0, files are
+// cut to that many lines around their line best matching query.
+func contextBlock(ctx context.Context, a *app, src source, root, query string, hits []hit, lines int) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Files relevant to: %s\n", query)
+	for _, h := range hits {
+		text, err := readText(ctx, a, src, h.ID)
+		if err != nil {
+			return "", err
+		}
+		all := strings.Split(strings.TrimRight(text, "\n"), "\n")
+		start, end := 0, len(all)
+		if lines > 0 && len(all) > lines {
+			start = min(max(bestLine(all, query)-lines/3, 0), len(all)-lines)
+			end = start + lines
+		}
+		body := strings.Join(all[start:end], "\n")
+
+		language := h.Meta.Language
+		if language == "" {
+			language = detect.Language(h.ID, []byte(text))
+		}
+		path := relPath(root, h.ID)
+		if start > 0 || end < len(all) {
+			path = fmt.Sprintf("%s (lines %d-%d of %d)", path, start+1, end, len(all))
+		}
+		fence := codeFence(body)
+		fmt.Fprintf(&b, "\n%s\n%s%s\n%s\n%s\n", path, fence, language, body, fence)
+	}
+	return b.String(), nil
+}
+
+// codeFence returns a backtick fence longer than any run of backticks in
+// body, so that fences within it don't close the block.
+func codeFence(body string) string {
+	longest, run := 0, 0
+	for _, r := range body {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+// copyToClipboard writes text to the system clipboard with the first
+// clipboard tool of the OS that is installed.
+func copyToClipboard(text string) error {
+	for _, args := range clipboardCommands[runtime.GOOS] {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	return errors.New("no clipboard tool found (pbcopy, clip, wl-copy, xclip or xsel): use -copy-file instead")
+}
+
+// copyContext writes the context block of hits to file, or to the clipboard
+// when file is empty.
+func copyContext(ctx context.Context, a *app, src source, root, query string, hits []hit, file string, lines int) error {
+	block, err := contextBlock(ctx, a, src, root, query, hits, lines)
+	if err != nil {
+		return err
+	}
+	if file != "" {
+		return os.WriteFile(file, []byte(block), 0o644)
+	}
+	return copyToClipboard(block)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// processCPU reports no CPU time: only unix is measured, elsewhere -max-cpu
+// has no effect.
+func processCPU() (time.Duration, bool) { return 0, false }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// dirCandidates is how many file matches are aggregated per directory
+	// result, since directories need many files to compare fairly.
+	dirCandidates = 20
+	// dirDecay weighs the n-th best file of a directory by dirDecay^n, so
+	// several relevant files beat one but can't drown a perfect match.
+	dirDecay = 0.5
+)
+
+// dirHit is a directory ranked by the relevance of its files.
+type dirHit struct {
+	Dir string `json:"dir"`
+	// Relevance is the decayed sum of the file relevances; higher is better.
+	Relevance float32 `json:"relevance"`
+	// Files is the number of matching files aggregated.
+	Files int `json:"files"`
+	// Top is the most relevant file of the directory.
+	Top string `json:"top"`
+}
+
+// aggregateDirs groups hits by directory, relative to root and cut to depth
+// components when depth is positive, and returns the k most relevant.
+func aggregateDirs(hits []hit, root string, depth, k int) []dirHit {
+	byDir := map[string][]hit{}
+	for _, h := range hits {
+		dir := dirOf(h.ID, root, depth)
+		byDir[dir] = append(byDir[dir], h)
+	}
+
+	dirs := make([]dirHit, 0, len(byDir))
+	for dir, hs := range byDir {
+		sort.Slice(hs, func(i, j int) bool { return hs[i].less(hs[j]) })
+		d := dirHit{Dir: dir, Files: len(hs), Top: hs[0].ID}
+		weight := float32(1)
+		for _, h := range hs {
+			// scores are distance-like: lower is better
+			d.Relevance += weight * max(1-h.Score, 0)
+			weight *= dirDecay
+		}
+		dirs = append(dirs, d)
+	}
+
+	sort.Slice(dirs, func(i, j int) bool {
+		if dirs[i].Relevance != dirs[j].Relevance {
+			return dirs[i].Relevance > dirs[j].Relevance
+		}
+		return dirs[i].Dir < dirs[j].Dir
+	})
+	if len(dirs) > k {
+		dirs = dirs[:k]
+	}
+	return dirs
+}
+
+// dirOf returns the directory of path relative to root, keeping at most
+// depth components when depth is positive.
+func dirOf(path, root string, depth int) string {
+	dir := filepath.Dir(path)
+	if rel, err := filepath.Rel(root, dir); err == nil && !strings.HasPrefix(rel, "..") {
+		dir = rel
+	}
+	dir = filepath.ToSlash(dir)
+	if depth > 0 && dir != "." {
+		if parts := strings.Split(dir, "/"); len(parts) > depth {
+			dir = strings.Join(parts[:depth], "/")
+		}
+	}
+	return dir
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+
+	remote "github.com/codectx/tokens/services/remote"
+)
+
+// localDB is the database indexes are built in by default.
+const localDB = "local.db"
+
+// motherDuckPrefix starts DSNs of databases hosted by MotherDuck.
+const motherDuckPrefix = "md:"
+
+// openDB connects to the database set by -db, or to the cached copy of
+// -remote, and checks that it answers. It reports whether the connection is
+// read-only, either because -read-only is set, the DSN asks for it, or it is
+// a copy of -remote, whose changes the next pull would discard.
+func openDB(ctx context.Context, o *options) (*sql.DB, bool, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	dsn := o.db
+	if o.remote != "" {
+		if dsn != localDB {
+			return nil, false, fmt.Errorf("-db and -remote are exclusive")
+		}
+		r, err := remote.NewRemoteService(o.remote)
+		if err != nil {
+			return nil, false, err
+		}
+		dsn, err = remote.Cached(ctx, r, o.remoteTTL, func(err error) {
+			l.Warn("remote index unavailable, using cached copy", "remote", r.URL(), "error", err)
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		l.Debug("using remote index", "remote", r.URL(), "cache", dsn)
+	}
+
+	dsn, readOnly, err := prepareDSN(dsn, o.readOnly || o.remote != "")
+	if err != nil {
+		return nil, false, err
+	}
+
+	db, err := sql.Open("duckdb", dsn)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to connect to DuckDB at %s: %w", redactDSN(dsn), err)
+	}
+	pingCtx, cancel := withTimeout(ctx, o.dbTimeout)
+	defer cancel()
+	if err := db.PingContext(pingCtx); err != nil {
+		db.Close()
+		return nil, false, fmt.Errorf("failed to connect to DuckDB at %s: %w", redactDSN(dsn), err)
+	}
+	l.Debug("connected to DuckDB", "dsn", redactDSN(dsn), "read_only", readOnly)
+	return db, readOnly, nil
+}
+
+// prepareDSN validates dsn, adds read-only access when requested, and
+// reports whether the resulting connection is read-only.
+func prepareDSN(dsn string, readOnly bool) (string, bool, error) {
+	if strings.TrimSpace(dsn) == "" {
+		return "", false, fmt.Errorf("empty -db: use a file path or md:<database>")
+	}
+
+	path, rawQuery, _ := strings.Cut(dsn, "?")
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid -db parameters %q: %w", rawQuery, err)
+	}
+
+	if strings.HasPrefix(path, motherDuckPrefix) && params.Get("motherduck_token") == "" &&
+		os.Getenv("motherduck_token") == "" && os.Getenv("MOTHERDUCK_TOKEN") == "" {
+		return "", false, fmt.Errorf("MotherDuck needs a token: set $MOTHERDUCK_TOKEN or add ?motherduck_token=<token> to -db")
+	}
+
+	if readOnly {
+		params.Set("access_mode", "read_only")
+	}
+	readOnly = strings.EqualFold(params.Get("access_mode"), "read_only")
+
+	if len(params) == 0 {
+		return path, readOnly, nil
+	}
+	return path + "?" + params.Encode(), readOnly, nil
+}
+
+// redactDSN hides the MotherDuck token of dsn so that it can be logged.
+func redactDSN(dsn string) string {
+	path, rawQuery, ok := strings.Cut(dsn, "?")
+	if !ok {
+		return dsn
+	}
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return path
+	}
+	if params.Has("motherduck_token") {
+		params.Set("motherduck_token", "REDACTED")
+	}
+	return path + "?" + params.Encode()
+}
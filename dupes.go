@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// dupesSchema is the schema of the JSON output of dupes.
+const dupesSchema = "codectx.dupes/v1"
+
+const (
+	// dupeSimilarity is the default minimum cosine similarity of reported
+	// pairs of chunks.
+	dupeSimilarity = 0.95
+	// dupeLines is the default minimum number of non-blank lines of the
+	// chunks compared, shorter ones being alike by construction.
+	dupeLines = 5
+	// dupeNeighbors is the number of nearest chunks of other files each
+	// chunk is compared with.
+	dupeNeighbors = 10
+)
+
+// dupeChunk is one side of a duplicate.
+type dupeChunk struct {
+	Path      string `json:"path"`
+	ChunkID   string `json:"chunk_id"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+}
+
+// dupe is a pair of similar chunks of different files.
+type dupe struct {
+	Similarity float32   `json:"similarity"`
+	A          dupeChunk `json:"a"`
+	B          dupeChunk `json:"b"`
+}
+
+// dupesOutput is the JSON output of dupes, schema codectx.dupes/v1.
+type dupesOutput struct {
+	Schema string `json:"schema"`
+	Index  string `json:"index"`
+	Dupes  []dupe `json:"dupes"`
+}
+
+// runDupes reports the pairs of chunks of different files whose vectors are
+// at least -threshold similar, most similar first: likely copy-pasted code.
+// Chunks are embedded on first use and stored for the next runs.
+func runDupes(ctx context.Context, args []string) error {
+	fs := newFlagSet("dupes")
+	o := &options{}
+	o.register(fs)
+	threshold := fs.Float64("threshold", dupeSimilarity, "minimum cosine similarity of reported pairs of chunks, up to 1")
+	minLines := fs.Int("min-lines", dupeLines, "minimum number of non-blank lines of the chunks compared")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if *threshold <= 0 || *threshold > 1 {
+		return fmt.Errorf("invalid -threshold %g, must be in (0, 1]", *threshold)
+	}
+	wd := "."
+	if fs.NArg() > 0 {
+		wd = fs.Arg(0)
+	}
+	// keep stdout for the report
+	l := newLogger(os.Stderr)
+	ctx = context.WithValue(ctx, LoggerCtxKey, l)
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	if a.emb == nil {
+		return fmt.Errorf("dupes compares embedded chunks and needs an embedding provider")
+	}
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+
+	ids, err := db.IDs(ctx)
+	if err != nil {
+		return err
+	}
+	chunks, err := embedChunks(ctx, a, db, src, ids)
+	if err != nil {
+		return err
+	}
+	chunks = comparableChunks(ctx, a, src, chunks, *minLines)
+
+	idx := index.NewExactIndexService()
+	byID := make(map[string]store.Chunk, len(chunks))
+	for _, c := range chunks {
+		idx.Add(c.ID, c.Vector)
+		byID[c.ID] = c
+	}
+	out := dupesOutput{Schema: dupesSchema, Index: displayName(o.namespace), Dupes: []dupe{}}
+	seen := map[[2]string]bool{}
+	for _, c := range chunks {
+		for _, r := range crossFileNeighbors(idx, byID, c, dupeNeighbors, *threshold) {
+			sim := 1 - r.Distance
+			first, second := c, byID[r.ID]
+			if second.File < first.File {
+				first, second = second, first
+			}
+			pair := [2]string{first.ID, second.ID}
+			if seen[pair] {
+				continue
+			}
+			seen[pair] = true
+			out.Dupes = append(out.Dupes, dupe{Similarity: sim, A: dupeSide(wd, first), B: dupeSide(wd, second)})
+		}
+	}
+	sort.SliceStable(out.Dupes, func(i, j int) bool {
+		if out.Dupes[i].Similarity != out.Dupes[j].Similarity {
+			return out.Dupes[i].Similarity > out.Dupes[j].Similarity
+		}
+		return out.Dupes[i].A.ChunkID < out.Dupes[j].A.ChunkID
+	})
+	l.Info("dupes", "index", out.Index, "chunks", len(chunks), "dupes", len(out.Dupes))
+
+	if o.json {
+		return json.NewEncoder(os.Stdout).Encode(out)
+	}
+	for _, d := range out.Dupes {
+		fmt.Printf("%.3f  %s:%d-%d  %s:%d-%d\n", d.Similarity,
+			d.A.Path, d.A.StartLine, d.A.EndLine, d.B.Path, d.B.StartLine, d.B.EndLine)
+	}
+	return nil
+}
+
+// comparableChunks returns the chunks worth comparing: those of at least
+// minLines non-blank lines, leaving out the preambles of files with
+// declarations, whose package clauses and imports look alike everywhere.
+func comparableChunks(ctx context.Context, a *app, src source, chunks []store.Chunk, minLines int) []store.Chunk {
+	declared := map[string]bool{}
+	for _, c := range chunks {
+		if !strings.HasPrefix(chunkSymbol(c.ID), preambleSymbol) {
+			declared[c.File] = true
+		}
+	}
+
+	var out []store.Chunk
+	lines := map[string][]string{}
+	for _, c := range chunks {
+		if declared[c.File] && strings.HasPrefix(chunkSymbol(c.ID), preambleSymbol) {
+			continue
+		}
+		if _, ok := lines[c.File]; !ok {
+			text, _ := readText(ctx, a, src, c.File)
+			lines[c.File] = strings.Split(text, "\n")
+		}
+		n := 0
+		for i := c.StartLine - 1; i < c.EndLine && i < len(lines[c.File]); i++ {
+			if strings.TrimSpace(lines[c.File][i]) != "" {
+				n++
+			}
+		}
+		if n >= minLines {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// crossFileNeighbors returns up to n of the chunks of idx nearest to c that
+// belong to other files and are at least threshold similar, nearest first.
+// The search is widened as long as the chunks of the file of c crowd them
+// out, until the chunks found fall under threshold or every one was found.
+func crossFileNeighbors(idx index.IndexService, byID map[string]store.Chunk, c store.Chunk, n int, threshold float64) []index.Result {
+	for k := n + 1; ; k *= 2 {
+		results := idx.Search(c.Vector, k)
+		var out []index.Result
+		for _, r := range results {
+			if float64(1-r.Distance) < threshold {
+				return out
+			}
+			if byID[r.ID].File == c.File {
+				continue
+			}
+			if out = append(out, r); len(out) == n {
+				return out
+			}
+		}
+		if len(results) < k {
+			return out
+		}
+	}
+}
+
+// dupeSide returns the side of a duplicate of chunk c, its path relative
+// to wd.
+func dupeSide(wd string, c store.Chunk) dupeChunk {
+	return dupeChunk{Path: relPath(wd, c.File), ChunkID: c.ID, StartLine: c.StartLine, EndLine: c.EndLine}
+}
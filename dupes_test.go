@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// TestCrossFileNeighbors checks that the chunks of a file nearer to one of
+// its chunks than any other file don't crowd out the duplicate of another
+// file.
+func TestCrossFileNeighbors(t *testing.T) {
+	idx := index.NewExactIndexService()
+	byID := map[string]store.Chunk{}
+	add := func(c store.Chunk) {
+		idx.Add(c.ID, c.Vector)
+		byID[c.ID] = c
+	}
+	c := store.Chunk{ID: "a.go#0", File: "a.go", Vector: []float32{1, 0}}
+	add(c)
+	for i := 1; i <= 3*dupeNeighbors; i++ {
+		add(store.Chunk{ID: fmt.Sprintf("a.go#%d", i), File: "a.go", Vector: []float32{1, 0.001 * float32(i)}})
+	}
+	add(store.Chunk{ID: "b.go#0", File: "b.go", Vector: []float32{1, 0.2}})
+	add(store.Chunk{ID: "c.go#0", File: "c.go", Vector: []float32{0, 1}})
+
+	got := crossFileNeighbors(idx, byID, c, dupeNeighbors, 0.95)
+	if len(got) != 1 || got[0].ID != "b.go#0" {
+		t.Fatalf("neighbours = %v, want b.go#0 only", got)
+	}
+	if got := crossFileNeighbors(idx, byID, c, dupeNeighbors, 0.999); len(got) != 0 {
+		t.Errorf("neighbours above 0.999 = %v, want none", got)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	embed "github.com/codectx/tokens/services/embed"
+	// Registers the fake provider
+	embedtest "github.com/codectx/tokens/services/embed/embedtest"
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// fixtureRepo is the repo of the golden corpus.
+const fixtureRepo = defaultGoldenDir + "/repo"
+
+// testContext returns a context carrying a logger that discards its output.
+func testContext() context.Context {
+	return context.WithValue(context.Background(), LoggerCtxKey, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// newTestApp returns an app embedding with the fake provider into a
+// database of its own, set up with flags.
+func newTestApp(t *testing.T, ctx context.Context, flags ...string) *app {
+	t.Helper()
+	fs := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	o := &options{}
+	o.register(fs)
+	fs.Set("provider", "fake")
+	fs.Set("db", filepath.Join(t.TempDir(), "test.db"))
+	fs.Set("mode", modeVector)
+	if err := fs.Parse(flags); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.validate(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newApp(ctx, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+// searchTree indexes the tree at root with a, into an index of the engine a
+// is set up with, and returns the paths of the top k results of query,
+// relative to root, and the engine used.
+func searchTree(t *testing.T, ctx context.Context, a *app, root, query string, k int) ([]string, string) {
+	t.Helper()
+	root, err := filepath.Abs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := newSource(ctx, a, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	q, _, err := a.embedQuery(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := a.store(a.opts.namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := a.newIndex(ctx, src.shard, 0, len(q))
+	indexTree(ctx, a, db, idx, src, q)
+	if idx.Len() == 0 {
+		t.Fatal("indexed no files")
+	}
+	hits, err := searchIndex(ctx, a, db, idx, searchRequest{Query: query, Vector: q, K: k, Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, h := range hits {
+		rel, err := filepath.Rel(root, h.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, filepath.ToSlash(rel))
+	}
+	return got, a.opts.planEngine(idx.Len(), len(q)).engine
+}
+
+// TestSearchEngines indexes the fixture repo with the fake provider and
+// checks that the hnsw graph finds what an exhaustive scan does.
+func TestSearchEngines(t *testing.T) {
+	ctx := testContext()
+	const query = "least recently used cache eviction"
+
+	flat, engine := searchTree(t, ctx, newTestApp(t, ctx, "-engine", engineFlat), fixtureRepo, query, 3)
+	if engine != engineFlat {
+		t.Fatalf("engine = %s, want %s", engine, engineFlat)
+	}
+	graph, engine := searchTree(t, ctx, newTestApp(t, ctx, "-engine", engineHNSW), fixtureRepo, query, 3)
+	if engine != engineHNSW {
+		t.Fatalf("engine = %s, want %s", engine, engineHNSW)
+	}
+	if len(graph) == 0 || graph[0] != "cache/lru.go" {
+		t.Errorf("hnsw results = %v, want cache/lru.go first", graph)
+	}
+	if !slices.Equal(graph, flat) {
+		t.Errorf("hnsw results = %v, want those of the flat index %v", graph, flat)
+	}
+}
+
+// TestHNSWNearest checks that the graph returns the nearest fake vectors of
+// the fixture files, the file itself first.
+func TestHNSWNearest(t *testing.T) {
+	ctx := testContext()
+	a := newTestApp(t, ctx)
+	idx := index.NewIndexService()
+	texts := map[string]string{
+		"retry.go": "retry failed requests with exponential backoff",
+		"lru.go":   "least recently used cache eviction",
+		"flags.go": "parse command line flags",
+		"token.go": "validate the bearer token signature and expiry",
+	}
+	for id, text := range texts {
+		v, _, err := a.embedQuery(ctx, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.Add(id, v)
+	}
+	for id, text := range texts {
+		v, _, err := a.embedQuery(ctx, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := idx.Search(v, 1)
+		if len(res) != 1 || res[0].ID != id {
+			t.Errorf("Search(%q) = %v, want %s", text, res, id)
+		}
+	}
+}
+
+// TestDeterministicHNSW checks that -deterministic builds seeded graphs
+// rather than refusing -engine hnsw, and that they find the same files.
+func TestDeterministicHNSW(t *testing.T) {
+	ctx := testContext()
+	const query = "parse command line flags"
+
+	first, engine := searchTree(t, ctx, newTestApp(t, ctx, "-deterministic", "-engine", engineHNSW), fixtureRepo, query, 5)
+	if engine != engineHNSW {
+		t.Fatalf("engine = %s, want %s", engine, engineHNSW)
+	}
+	second, _ := searchTree(t, ctx, newTestApp(t, ctx, "-deterministic", "-engine", engineHNSW), fixtureRepo, query, 5)
+	if len(first) == 0 || !slices.Equal(first, second) {
+		t.Errorf("second run found %v, first %v", second, first)
+	}
+}
+
+// TestDeterministicExports indexes the fixture repo twice with
+// -deterministic, into databases of their own, and checks that both export
+// the same graph and vector files byte for byte.
+func TestDeterministicExports(t *testing.T) {
+	ctx := testContext()
+	root, err := filepath.Abs(fixtureRepo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := []string{"-provider", "fake", "-deterministic", "-engine", engineHNSW}
+
+	var runs [2]map[string][]byte
+	for i := range runs {
+		dir := t.TempDir()
+		db := filepath.Join(dir, "test.db")
+		a := newTestApp(t, ctx, append(flags, "-db", db)...)
+		searchTree(t, ctx, a, root, "parse command line flags", 5)
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		runs[i] = map[string][]byte{}
+		for _, export := range []struct {
+			name string
+			run  func(context.Context, []string) error
+			args []string
+		}{
+			{"graph.json", runExportGraph, []string{"-format", "json"}},
+			{"graph.dot", runExportGraph, nil},
+			{"vectors.vec", runExportVectors, nil},
+		} {
+			out := filepath.Join(dir, export.name)
+			args := append(append(append(slices.Clone(flags), "-db", db, "-o", out), export.args...), root)
+			if err := export.run(ctx, args); err != nil {
+				t.Fatalf("exporting %s: %v", export.name, err)
+			}
+			if runs[i][export.name], err = os.ReadFile(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for name, first := range runs[0] {
+		if len(first) == 0 || !bytes.Equal(first, runs[1][name]) {
+			t.Errorf("%s differs between runs: %d and %d bytes", name, len(first), len(runs[1][name]))
+		}
+	}
+}
+
+// TestRevSubdirectory reads a revision from a subdirectory of its
+// repository: the files under it are listed with the ids of the working
+// tree, and read from the tree of the revision. Paths missing from it don't
+// exist.
+func TestRevSubdirectory(t *testing.T) {
+	ctx := testContext()
+	root := t.TempDir()
+	files := map[string]string{"top.go": "package top\n", "sub/a.go": "package sub\n", "sub/d/b.go": "package d\n"}
+	for name, text := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"add", "-A"}, {"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-qm", "init"}} {
+		if out, err := exec.Command("git", append([]string{"-C", root}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+
+	src, err := newSource(ctx, newTestApp(t, ctx, "-rev", "HEAD"), filepath.Join(root, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	var ids []string
+	if err := src.walk(ctx, func(id string) { ids = append(ids, id) }); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(ids)
+	want := []string{pathID(filepath.Join(root, "sub", "a.go")), pathID(filepath.Join(root, "sub", "d", "b.go"))}
+	if !slices.Equal(ids, want) {
+		t.Fatalf("walk = %v, want %v", ids, want)
+	}
+	for _, id := range ids {
+		b, err := src.read(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(root, osPath(id))
+		if want := files[filepath.ToSlash(rel)]; string(b) != want {
+			t.Errorf("read(%s) = %q, want %q", id, b, want)
+		}
+	}
+	// deleted from the tree of the revision, so it leaves the retry queue
+	if _, err := src.read(pathID(filepath.Join(root, "sub", "gone.go"))); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("read of a path missing at the revision = %v, want fs.ErrNotExist", err)
+	}
+}
+
+// TestFailedReembed re-indexes a changed file while the provider fails: the
+// file keeps its former vector, and its update is ended rather than left to
+// be rolled back.
+func TestFailedReembed(t *testing.T) {
+	ctx := testContext()
+	root := t.TempDir()
+	path := filepath.Join(root, "a.go")
+	if err := os.WriteFile(path, []byte("package a\n\n// retry the request\nfunc retry() {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a := newTestApp(t, ctx)
+	p := embedtest.NewProvider(0)
+	a.emb = embed.FromProvider(p)
+	db, err := a.store(a.opts.namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reindex := func() {
+		src, err := newSource(ctx, a, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+		indexTree(ctx, a, db, a.newIndex(ctx, src.shard, 0, embedtest.DefaultDims), src, nil)
+	}
+
+	reindex()
+	before, err := db.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before) != 1 {
+		t.Fatalf("indexed %d files, want 1", len(before))
+	}
+
+	p.Fail(errors.New("provider down"))
+	if err := os.WriteFile(path, []byte("package a\n\n// parse the flags\nfunc parse() {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reindex()
+	after, err := db.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("after the failed re-embed the rows are %v, want %v", after, before)
+	}
+	unfinished, err := db.Unfinished(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfinished) != 0 {
+		t.Errorf("Unfinished = %v, want none", unfinished)
+	}
+}
+
+// TestPruneDeleted deletes a file from an indexed tree and checks that a
+// rescan removes it from the index and the database, records its deletion
+// and emits a deleted event, keeping the other files.
+func TestPruneDeleted(t *testing.T) {
+	ctx := testContext()
+	root := t.TempDir()
+	for name, text := range map[string]string{
+		"a.go": "package a\n\n// retry the request\nfunc retry() {}\n",
+		"b.go": "package a\n\n// parse the flags\nfunc parse() {}\n",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := newTestApp(t, ctx)
+	a.events = newEvents(ctx, nil)
+	events, cancel := a.events.subscribe()
+	defer cancel()
+	db, err := a.store(a.opts.namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := newSource(ctx, a, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	idx := a.newIndex(ctx, src.shard, 0, embedtest.DefaultDims)
+	indexTree(ctx, a, db, idx, src, nil)
+	if got := pruneDeleted(ctx, a, db, idx, src); len(got) != 0 {
+		t.Fatalf("removed %v before any deletion", got)
+	}
+
+	deleted := filepath.Join(root, "b.go")
+	if err := os.Remove(deleted); err != nil {
+		t.Fatal(err)
+	}
+	if got := pruneDeleted(ctx, a, db, idx, src); !slices.Equal(got, []string{deleted}) {
+		t.Fatalf("removed %v, want %s", got, deleted)
+	}
+	ids, err := db.IDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(root, "a.go")}; !slices.Equal(ids, want) {
+		t.Errorf("stored %v, want %v", ids, want)
+	}
+	if idx.Len() != 1 {
+		t.Errorf("index holds %d files, want 1", idx.Len())
+	}
+	history, err := db.Events(ctx, deleted, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Action != eventDeleted {
+		t.Errorf("history = %v, want a %s event", history, eventDeleted)
+	}
+	// events are published before pruneDeleted returns
+	var paths []string
+	for len(events) > 0 {
+		if ev := <-events; ev.Type == "deleted" {
+			paths = append(paths, ev.Path)
+		}
+	}
+	if !slices.Equal(paths, []string{deleted}) {
+		t.Errorf("deleted events for %v, want %s", paths, deleted)
+	}
+}
+
+// TestBlameBackfill indexes a repository without -blame, then with it: the
+// unchanged files are blamed once, with their chunks each attributed to the
+// author of its lines, and files blame finds no author of aren't blamed on
+// every run.
+func TestBlameBackfill(t *testing.T) {
+	ctx := testContext()
+	root := t.TempDir()
+	path := filepath.Join(root, "a.go")
+	git := func(args ...string) {
+		t.Helper()
+		if out, err := exec.Command("git", append([]string{"-C", root}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+	}
+	commit := func(author, text string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "-A")
+		git("-c", "user.name="+author, "-c", "user.email="+author+"@example.com", "commit", "-qm", author)
+	}
+	git("init", "-q")
+	alice := "package a\n\n// retry the request\nfunc retry() {\n\tretry()\n}\n"
+	commit("alice", alice)
+	commit("bob", alice+"\n// parse the flags\nfunc parse() {}\n")
+	// never committed, so blame finds no author
+	untracked := filepath.Join(root, "b.go")
+	if err := os.WriteFile(untracked, []byte("package a\n\n// close the file\nfunc close() {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestApp(t, ctx)
+	db, err := a.store(a.opts.namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reindex := func() {
+		src, err := newSource(ctx, a, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+		indexTree(ctx, a, db, a.newIndex(ctx, src.shard, 0, embedtest.DefaultDims), src, nil)
+	}
+	reindex()
+	a.opts.blame = true
+	reindex()
+
+	rows, err := db.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := rows[path]; !e.Blamed || e.Author != "alice" || e.LastCommit == "" {
+		t.Errorf("a.go blamed %v to %q at %q, want alice", e.Blamed, e.Author, e.LastCommit)
+	}
+	if e := rows[untracked]; !e.Blamed || e.Author != "" {
+		t.Errorf("b.go blamed %v to %q, want blamed to nobody", e.Blamed, e.Author)
+	}
+	hashes, err := db.ChunkHashes(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authors := map[string]string{}
+	for _, h := range hashes {
+		authors[h.Key] = h.Author
+	}
+	if authors["retry"] != "alice" || authors["parse"] != "bob" {
+		t.Errorf("chunks blamed to %v, want retry to alice and parse to bob", authors)
+	}
+}
+
+// firstLines summarizes texts by their first line, for tests.
+type firstLines struct{}
+
+func (firstLines) File(ctx context.Context, path, text string) (string, error) {
+	first, _, _ := strings.Cut(text, "\n")
+	return first, nil
+}
+
+func (firstLines) Package(ctx context.Context, dir string, files map[string]string) (string, error) {
+	return fmt.Sprintf("%d files", len(files)), nil
+}
+
+func (firstLines) Cluster(ctx context.Context, summaries []string) (string, error) {
+	return strings.Join(summaries, "; "), nil
+}
+
+func (firstLines) Label(ctx context.Context, files map[string]string) (string, error) {
+	return "label", nil
+}
+
+func (firstLines) Model() string { return "first-lines" }
+
+// TestSummarizeHits indexes a tree with -summaries and checks that indexing
+// summarizes nothing, and that only the files of the hits returned are
+// summarized afterwards, along with their package.
+func TestSummarizeHits(t *testing.T) {
+	ctx := testContext()
+	root := t.TempDir()
+	for name, text := range map[string]string{
+		"a.go": "package a\n\n// retry the request\nfunc retry() {}\n",
+		"b.go": "package a\n\n// parse the flags\nfunc parse() {}\n",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := newTestApp(t, ctx, "-summaries")
+	a.summaries = firstLines{}
+	db, err := a.store(a.opts.namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := newSource(ctx, a, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	idx := a.newIndex(ctx, src.shard, 0, embedtest.DefaultDims)
+	indexTree(ctx, a, db, idx, src, nil)
+	if sums, err := db.Summaries(ctx, store.SummaryFile); err != nil || len(sums) != 0 {
+		t.Fatalf("indexing summarized %v (%v), want nothing", sums, err)
+	}
+
+	returned := filepath.Join(root, "a.go")
+	summarizeHits(ctx, a, db, src, []hit{{Result: index.Result{ID: returned}}})
+	sums, err := db.Summaries(ctx, store.SummaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sums) != 1 || sums[0].ID != returned || sums[0].Text != "package a" {
+		t.Errorf("file summaries = %v, want one of %s", sums, returned)
+	}
+	pkgs, err := db.Summaries(ctx, store.SummaryPackage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 1 || pkgs[0].Text != "1 files" {
+		t.Errorf("package summaries = %v, want one of the returned file", pkgs)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// defaultEditor is run when neither $VISUAL nor $EDITOR is set.
+const defaultEditor = "vi"
+
+// Editors whose command line doesn't take +line, by executable name.
+var (
+	// vscodeEditors open file:line with -g.
+	vscodeEditors = map[string]bool{"code": true, "code-insiders": true, "codium": true, "cursor": true}
+	// colonEditors open file:line as is.
+	colonEditors = map[string]bool{"subl": true, "zed": true}
+	// jetbrainsEditors are the JetBrains IDE launchers, which take --line.
+	jetbrainsEditors = map[string]bool{
+		"idea": true, "goland": true, "pycharm": true, "webstorm": true, "phpstorm": true,
+		"clion": true, "rider": true, "rubymine": true, "rustrover": true, "datagrip": true,
+	}
+)
+
+// editorCommand returns the command opening the file at path on line, in
+// $VISUAL, else $EDITOR. The editor may be given with arguments, as in
+// EDITOR="code -w". VS Code and its forks are passed -g path:line, Sublime
+// Text and Zed path:line, JetBrains IDEs --line line path and every other
+// editor +line path, which vi, vim, nano and emacs understand.
+func editorCommand(path string, line int) *exec.Cmd {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	args := strings.Fields(editor)
+	if len(args) == 0 {
+		args = []string{defaultEditor}
+	}
+	line = max(line, 1)
+
+	name := strings.ToLower(filepath.Base(args[0]))
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	name = strings.TrimSuffix(name, "64")
+	switch {
+	case vscodeEditors[name]:
+		args = append(args, "-g", fmt.Sprintf("%s:%d", path, line))
+	case colonEditors[name]:
+		args = append(args, fmt.Sprintf("%s:%d", path, line))
+	case jetbrainsEditors[name]:
+		args = append(args, "--line", fmt.Sprint(line), path)
+	default:
+		args = append(args, fmt.Sprintf("+%d", line), path)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd
+}
+
+// openHit opens the file of h in the editor at its line best matching query.
+func openHit(ctx context.Context, a *app, src source, h hit, query string) error {
+	text, err := readText(ctx, a, src, h.ID)
+	if err != nil {
+		return err
+	}
+	line := bestLine(strings.Split(text, "\n"), query) + 1
+	if err := editorCommand(osPath(h.ID), line).Run(); err != nil {
+		return fmt.Errorf("failed to run the editor: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+//go:build embedtest
+
+package main
+
+// Register the fake provider, for trying codectx out without a model
+import _ "github.com/codectx/tokens/services/embed/embedtest"
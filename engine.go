@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// Vector index engines.
+const (
+	engineAuto   = "auto"
+	engineFlat   = "flat"
+	engineHNSW   = "hnsw"
+	engineDuckDB = "duckdb-vss"
+)
+
+const (
+	// assumedDims stands in for the dimension of vectors not embedded yet.
+	assumedDims = 768
+	// graphNodeBytes is the rough memory of an hnsw node besides its vector:
+	// its key and neighbour lists.
+	graphNodeBytes = 512
+	// flatRate is how many vector components a CPU compares per second in a
+	// flat search, a conservative figure for the SIMD kernels.
+	flatRate = 4e9
+)
+
+// enginePlan is the engine chosen for an index, and why.
+type enginePlan struct {
+	engine string
+	reason string
+	files  int
+	dims   int
+	// flatMemory and graphMemory estimate the heap held by the in-memory
+	// engines.
+	flatMemory  int64
+	graphMemory int64
+	// flatLatency is the estimated duration of a flat search.
+	flatLatency time.Duration
+	// grows is set when a flat index moves into a graph once it outgrows
+	// -flat-limit while indexing.
+	grows bool
+	// scan is set when the DuckDB engine scans its table rather than build
+	// the HNSW index of vss, which is held in memory.
+	scan bool
+}
+
+// planEngine picks the engine of an index of files vectors of dims
+// dimensions, 0 when unknown. -engine or -exact override the policy, which
+// otherwise keeps vectors out of the heap when they don't fit -memory-limit,
+// and searches them exhaustively while that is within -flat-limit and
+// -latency-target. Vectors kept out of the heap are scanned in DuckDB: its
+// vss extension holds HNSW indexes in memory, which wouldn't fit either.
+func (o *options) planEngine(files, dims int) enginePlan {
+	if dims == 0 {
+		dims = assumedDims
+	}
+	elem := int64(4)
+	if o.f16 {
+		elem = 2
+	}
+	p := enginePlan{files: files, dims: dims}
+	p.flatMemory = int64(files) * int64(dims) * elem
+	p.graphMemory = p.flatMemory + int64(files)*graphNodeBytes
+	p.flatLatency = time.Duration(float64(files) * float64(dims) / flatRate / float64(runtime.GOMAXPROCS(0)) * float64(time.Second))
+
+	fast := o.latencyTarget == 0 || p.flatLatency <= o.latencyTarget
+	switch {
+	case o.exact:
+		p.engine, p.reason = engineFlat, "set by -exact"
+	case o.engine != engineAuto:
+		p.engine, p.reason = o.engine, "set by -engine"
+	case o.memoryLimit > 0 && p.flatMemory <= int64(o.memoryLimit) && p.graphMemory > int64(o.memoryLimit) && fast:
+		p.engine, p.reason = engineFlat, "the graph would exceed -memory-limit, the vectors alone fit it"
+	case o.memoryLimit > 0 && p.graphMemory > int64(o.memoryLimit):
+		p.engine, p.reason, p.scan = engineDuckDB, "the vectors would exceed -memory-limit, scanned in DuckDB", true
+	case files <= o.flatLimit && fast:
+		p.engine, p.reason, p.grows = engineFlat, "within -flat-limit", true
+	case files <= o.flatLimit:
+		p.engine, p.reason = engineHNSW, "a flat search exceeds -latency-target"
+	default:
+		p.engine, p.reason = engineHNSW, "beyond -flat-limit"
+	}
+	return p
+}
+
+// storedFiles returns the number of files stored in namespace ns, 0 when it
+// can't be counted.
+func storedFiles(ctx context.Context, a *app, ns string) int {
+	namespaces, err := store.Namespaces(ctx, a.database)
+	if err != nil {
+		return 0
+	}
+	for _, n := range namespaces {
+		if n.Name == ns {
+			return n.Rows
+		}
+	}
+	return 0
+}
+
+// byteSize is a flag holding a number of bytes, given with an optional KB,
+// MB, GB or TB suffix.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	if b == nil || *b == 0 {
+		return "0"
+	}
+	return formatBytes(int64(*b))
+}
+
+func (b *byteSize) Set(value string) error {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	mult := int64(1)
+	for i, unit := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(s, unit) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, unit)), 1<<(10*(i+1))
+			break
+		}
+	}
+	s = strings.TrimSuffix(s, "B")
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q: use a number of bytes, optionally with KB, MB, GB or TB", value)
+	}
+	*b = byteSize(n * float64(mult))
+	return nil
+}
+
+// formatBytes formats n bytes with a binary unit.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 3; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGT"[exp])
+}
+
+// runStats shows the size of an index, its files per language and the
+// engine searches use for it.
+func runStats(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("stats")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeLexical) // stats don't need embeddings
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	files, dims := storedFiles(ctx, a, o.namespace), 0
+	if a.vectors != nil && a.vectors.Namespace() == o.namespace {
+		files, dims = a.vectors.Len(), a.vectors.Dims()
+	} else if files > 0 {
+		db, err := a.store(o.namespace)
+		if err != nil {
+			return err
+		}
+		all, err := db.GetAll(ctx)
+		if err != nil {
+			return err
+		}
+		for _, e := range all {
+			dims = len(e.Vector)
+			break
+		}
+	}
+	p := o.planEngine(files, dims)
+
+	engine := p.engine
+	if p.engine == engineDuckDB {
+		idx, err := index.NewDuckDBIndexService(ctx, a.database, !p.scan, func(err error) { l.Debug("DuckDB index failed", "error", err) })
+		switch {
+		case err != nil:
+			engine += " (unavailable, falls back to hnsw)"
+		case p.scan:
+			engine += " (scanning)"
+		case index.VSS(idx):
+			engine += " (hnsw index)"
+		default:
+			engine += " (vss extension unavailable, scanning)"
+		}
+	}
+	limit := "none"
+	if o.memoryLimit > 0 {
+		limit = o.memoryLimit.String()
+	}
+	target := "none"
+	if o.latencyTarget > 0 {
+		target = o.latencyTarget.String()
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "index\t%s\n", displayName(o.namespace))
+	fmt.Fprintf(w, "files\t%d\n", p.files)
+	fmt.Fprintf(w, "dimensions\t%d\n", p.dims)
+	fmt.Fprintf(w, "engine\t%s\n", engine)
+	fmt.Fprintf(w, "reason\t%s\n", p.reason)
+	fmt.Fprintf(w, "flat memory\t%s\n", formatBytes(p.flatMemory))
+	fmt.Fprintf(w, "graph memory\t%s\n", formatBytes(p.graphMemory))
+	fmt.Fprintf(w, "flat latency\t%s\n", p.flatLatency)
+	fmt.Fprintf(w, "flat limit\t%d\n", o.flatLimit)
+	fmt.Fprintf(w, "memory limit\t%s\n", limit)
+	fmt.Fprintf(w, "latency target\t%s\n", target)
+
+	if files > 0 {
+		db, err := a.store(o.namespace)
+		if err != nil {
+			return err
+		}
+		counts, err := db.Languages(ctx)
+		if err != nil {
+			return err
+		}
+		langs := make([]string, 0, len(counts))
+		for lang := range counts {
+			langs = append(langs, lang)
+		}
+		sort.Slice(langs, func(i, j int) bool {
+			if counts[langs[i]] != counts[langs[j]] {
+				return counts[langs[i]] > counts[langs[j]]
+			}
+			return langs[i] < langs[j]
+		})
+		fmt.Fprintf(w, "\nlanguage\tfiles\n")
+		for _, lang := range langs {
+			name := lang
+			if name == "" {
+				name = "(unknown)"
+			}
+			fmt.Fprintf(w, "%s\t%d\n", name, counts[lang])
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventBuffer is how many events wait for delivery to webhooks, or to a
+// single subscriber, before newer ones are dropped.
+const eventBuffer = 1024
+
+// indexEvent reports that a file was re-embedded, renamed or deleted.
+type indexEvent struct {
+	Type      string `json:"type"`
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	// From is the former path of a renamed file.
+	From string    `json:"from,omitempty"`
+	Time time.Time `json:"time"`
+	// Chunks is how the chunks of the file changed.
+	Chunks *chunkDiff `json:"chunks,omitempty"`
+}
+
+// events fans index events out to webhooks and API subscribers, so that
+// downstream caches can invalidate their own state. A nil *events drops
+// every event.
+type events struct {
+	l        *slog.Logger
+	webhooks []string
+	client   *http.Client
+	queue    chan indexEvent
+
+	mu   sync.Mutex
+	subs map[chan indexEvent]struct{}
+}
+
+// newEvents returns an events hub posting every event to webhooks until ctx
+// is done.
+func newEvents(ctx context.Context, webhooks []string) *events {
+	e := &events{
+		l:        ctx.Value(LoggerCtxKey).(*slog.Logger),
+		webhooks: webhooks,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan indexEvent, eventBuffer),
+		subs:     map[chan indexEvent]struct{}{},
+	}
+	if len(webhooks) > 0 {
+		go e.deliver(ctx)
+	}
+	return e
+}
+
+// parseWebhooks returns the comma-separated webhook URLs of list.
+func parseWebhooks(list string) ([]string, error) {
+	var urls []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q", s)
+		}
+		urls = append(urls, s)
+	}
+	return urls, nil
+}
+
+// publish sends ev to every subscriber and queues it for the webhooks,
+// without blocking indexing on slow consumers.
+func (e *events) publish(ev indexEvent) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	e.mu.Unlock()
+
+	if len(e.webhooks) == 0 {
+		return
+	}
+	select {
+	case e.queue <- ev:
+	default:
+		e.l.Warn("webhook queue full, dropping event", "path", ev.Path)
+	}
+}
+
+// subscribe returns a channel receiving every event published until cancel
+// is called.
+func (e *events) subscribe() (<-chan indexEvent, func()) {
+	ch := make(chan indexEvent, eventBuffer)
+	e.mu.Lock()
+	e.subs[ch] = struct{}{}
+	e.mu.Unlock()
+	return ch, func() {
+		e.mu.Lock()
+		delete(e.subs, ch)
+		e.mu.Unlock()
+	}
+}
+
+// deliver posts queued events to the webhooks, one JSON event per request.
+func (e *events) deliver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-e.queue:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			for _, url := range e.webhooks {
+				if err := e.post(ctx, url, b); err != nil {
+					e.l.Warn("failed to deliver event", "webhook", url, "path", ev.Path, "error", err)
+				}
+			}
+		}
+	}
+}
+
+// post sends one event body to url.
+func (e *events) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
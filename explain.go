@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// explanation breaks down how the score of a hit was computed. Signals that
+// didn't contribute are nil.
+type explanation struct {
+	// Similarity is the cosine similarity of the query and file vectors.
+	Similarity *float32 `json:"similarity,omitempty"`
+	// Distance is the cosine distance the vector score starts from.
+	Distance *float32 `json:"distance,omitempty"`
+	// BM25 is the lexical score.
+	BM25 *float64 `json:"bm25,omitempty"`
+	// Rerank is the score of a reranking model.
+	Rerank *float32 `json:"rerank,omitempty"`
+	// Base is the score before boosts; lower is better.
+	Base   float32 `json:"base"`
+	Boosts []boost `json:"boosts"`
+	// Final is the score results are ordered by; lower is better.
+	Final float32 `json:"final"`
+}
+
+// explain returns the score breakdown of h.
+func explain(h hit) explanation {
+	e := explanation{Boosts: h.Boosts, Final: h.Score, Rerank: h.Rerank}
+	if e.Boosts == nil {
+		e.Boosts = []boost{}
+	}
+
+	e.Base = h.Score
+	for _, b := range h.Boosts {
+		e.Base -= b.Delta
+	}
+
+	if h.Vector != nil {
+		sim, dist := 1-h.Distance, h.Distance
+		e.Similarity, e.Distance = &sim, &dist
+	}
+	if h.Vector == nil || h.Lexical > 0 {
+		// in hybrid search, BM25 contributes the lexical boost
+		bm25 := h.Lexical
+		e.BM25 = &bm25
+	}
+	return e
+}
+
+// printExplanations writes the score breakdown of each hit.
+func printExplanations(w io.Writer, hits []hit) {
+	for i, h := range hits {
+		e := explain(h)
+		fmt.Fprintf(w, "#%d %s\n", i+1, h.ID)
+		if e.Similarity != nil {
+			fmt.Fprintf(w, "   vector similarity  %.4f (distance %.4f)\n", *e.Similarity, *e.Distance)
+		} else {
+			fmt.Fprintf(w, "   vector similarity  -\n")
+		}
+		if e.BM25 != nil && e.Similarity != nil {
+			fmt.Fprintf(w, "   lexical bm25       %.4f (see the lexical boost)\n", *e.BM25)
+		} else if e.BM25 != nil {
+			fmt.Fprintf(w, "   lexical bm25       %.4f (base %.4f = 1/(1+bm25))\n", *e.BM25, e.Base)
+		} else {
+			fmt.Fprintf(w, "   lexical bm25       -\n")
+		}
+		if e.Rerank != nil {
+			fmt.Fprintf(w, "   rerank             %.4f\n", *e.Rerank)
+		} else {
+			fmt.Fprintf(w, "   rerank             -\n")
+		}
+		if len(e.Boosts) == 0 {
+			fmt.Fprintf(w, "   boosts             none\n")
+		} else {
+			parts := make([]string, len(e.Boosts))
+			for j, b := range e.Boosts {
+				parts[j] = fmt.Sprintf("%s %+.4f", b.Reason, b.Delta)
+			}
+			fmt.Fprintf(w, "   boosts             %s\n", strings.Join(parts, ", "))
+		}
+		fmt.Fprintf(w, "   final score        %.4f (lower is better)\n", e.Final)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runFeedback records whether a result of a logged query was relevant, or
+// exports the judgments as an eval set for ab.
+func runFeedback(ctx context.Context, args []string) error {
+	fs := newFlagSet("feedback")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeLexical) // judgments don't need embeddings
+	export := fs.String("export", "", "write the good judgments to `file` as an eval set for ab, instead of recording one")
+	root := fs.String("root", ".", "with -export, the indexed path that relevant files are made relative to")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+
+	if *export != "" {
+		return exportFeedback(ctx, a, *export, *root)
+	}
+
+	if fs.NArg() != 3 {
+		fs.Usage()
+		return fmt.Errorf("usage: feedback QUERY-ID RESULT good|bad")
+	}
+	qid, result, verdict := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+	if verdict != "good" && verdict != "bad" {
+		return fmt.Errorf("invalid judgment %q: use good or bad", verdict)
+	}
+
+	if _, ok, err := db.LoggedQuery(ctx, qid); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("unknown query id %q", qid)
+	}
+
+	// Results are stored under the path they were indexed with, which may
+	// be absolute
+	id := pathID(result)
+	rows, err := db.Get(ctx, []string{id})
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		abs, err := filepath.Abs(result)
+		if err != nil {
+			return err
+		}
+		id = pathID(abs)
+		if rows, err = db.Get(ctx, []string{id}); err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return fmt.Errorf("%s is not in the index", result)
+		}
+	}
+
+	return db.RecordFeedback(ctx, qid, id, verdict == "good")
+}
+
+// exportFeedback writes every query with at least one good result as an eval
+// set, with relevant paths relative to root.
+func exportFeedback(ctx context.Context, a *app, path, root string) error {
+	db, err := a.store(a.opts.namespace)
+	if err != nil {
+		return err
+	}
+	judgments, err := db.Judgments(ctx)
+	if err != nil {
+		return err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+
+	var (
+		set  []evalQuery
+		last string
+	)
+	for _, j := range judgments {
+		if j.Votes <= 0 {
+			continue
+		}
+		if j.QueryID != last {
+			set = append(set, evalQuery{Query: j.Query})
+			last = j.QueryID
+		}
+		id, err := filepath.Abs(osPath(j.ID))
+		if err != nil {
+			return err
+		}
+		q := &set[len(set)-1]
+		q.Relevant = append(q.Relevant, relPath(root, id))
+	}
+	if len(set) == 0 {
+		return fmt.Errorf("no results were judged good yet")
+	}
+
+	b, err := yaml.Marshal(set)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
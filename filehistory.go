@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	store "github.com/codectx/tokens/services/store"
+)
+
+// Actions of the events recorded in the history of a file.
+const (
+	eventEmbedded   = "embedded"
+	eventSkipped    = "skipped"
+	eventFailed     = "failed"
+	eventRolledBack = "rolled-back"
+	eventDropped    = "dropped"
+	eventRenamed    = "renamed"
+	eventDeleted    = "deleted"
+)
+
+// recordEvent appends e to the history of its file, which only logs
+// failures to: indexing goes on without it.
+func recordEvent(ctx context.Context, db store.StorageService, e store.IndexEvent) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+	if err := db.RecordEvent(ctx, e); err != nil {
+		l.Error("Failed to record index event", "path", e.ID, "action", e.Action, "error", err)
+	}
+}
+
+// fileHistory is the output of `history -json`.
+type fileHistory struct {
+	Path string `json:"path"`
+	// Indexed is set when the file has a vector, embedded from the content
+	// of Hash by Model.
+	Indexed bool   `json:"indexed"`
+	Hash    string `json:"hash,omitempty"`
+	Model   string `json:"model,omitempty"`
+	// Current is unchanged, changed or missing: how the file on disk
+	// compares to what was embedded.
+	Current string         `json:"current,omitempty"`
+	Events  []historyEvent `json:"events"`
+}
+
+// historyEvent is a store.IndexEvent as `history -json` prints it.
+type historyEvent struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+	Tokens     int       `json:"tokens,omitempty"`
+	Provider   string    `json:"provider,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// runFileHistory prints what indexing did to a file, newest first, and
+// whether it changed since it was embedded, to tell why its results look
+// stale or wrong.
+func runFileHistory(ctx context.Context, args []string) error {
+	fs := newFlagSet("history")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeLexical) // reading the history doesn't embed
+	n := fs.Int("n", 20, "number of events shown, newest first, 0 for all")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: history [flags] PATH")
+	}
+	id := pathID(filepath.Clean(fs.Arg(0)))
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+	h := fileHistory{Path: id, Events: []historyEvent{}}
+	rows, err := db.Get(ctx, []string{id})
+	if err != nil {
+		return err
+	}
+	if len(rows) > 0 {
+		h.Indexed, h.Hash, h.Model = true, rows[0].Hash, rows[0].Model
+		switch b, err := os.ReadFile(osPath(id)); {
+		case err != nil:
+			h.Current = "missing"
+		case computeHash(b) == h.Hash:
+			h.Current = "unchanged"
+		default:
+			h.Current = "changed"
+		}
+	}
+	events, err := db.Events(ctx, id, *n)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		h.Events = append(h.Events, historyEvent{Time: e.Time, Action: e.Action, DurationMS: e.Duration.Milliseconds(),
+			Tokens: e.Tokens, Provider: e.Provider, Hash: e.Hash, Detail: e.Detail})
+	}
+
+	if o.json {
+		return json.NewEncoder(os.Stdout).Encode(h)
+	}
+	switch {
+	case !h.Indexed:
+		fmt.Printf("%s: not indexed in %s\n", id, displayName(o.namespace))
+	case h.Model != "":
+		fmt.Printf("%s: embedded from %s by %s, %s since\n", id, h.Hash, h.Model, h.Current)
+	default:
+		fmt.Printf("%s: embedded from %s, %s since\n", id, h.Hash, h.Current)
+	}
+	if len(events) == 0 {
+		fmt.Println("no events recorded")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTION\tDURATION\tTOKENS\tPROVIDER\tHASH\tDETAIL")
+	for _, e := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Action,
+			e.Duration.Round(time.Millisecond), e.Tokens, e.Provider, e.Hash, e.Detail)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	detect "github.com/codectx/tokens/services/detect"
+	symbols "github.com/codectx/tokens/services/symbols"
+	goignore "github.com/cyber-nic/go-gitignore"
+)
+
+// parsedQuery is a query split into the text searched and the filters its
+// fields set, as in `lang:go path:services/** kind:func "storage upsert"`,
+// or exclude when negated, as in `-path:vendor/**`. Words shaped like a
+// field of another name, such as a URL, are text.
+type parsedQuery struct {
+	Text    string
+	Filters queryFilters
+	Exclude queryFilters
+}
+
+// queryFilters are the values of the fields of a query.
+type queryFilters struct {
+	// Languages are the lang: values, as -lang takes them.
+	Languages []string
+	// Paths are the path: globs, matched like .gitignore patterns against
+	// paths relative to the searched path.
+	Paths []string
+	// Kinds are the kind: values, among symbols.Kinds.
+	Kinds []string
+	// Authors are the author: values, as -author takes them.
+	Authors []string
+}
+
+// parseQuery parses the fields of query out of its text. Values and text
+// may be double-quoted to hold spaces; the quotes are dropped.
+func parseQuery(query string) (parsedQuery, error) {
+	words, err := queryWords(query)
+	if err != nil {
+		return parsedQuery{}, err
+	}
+	var (
+		pq   parsedQuery
+		text []string
+	)
+	for _, w := range words {
+		name, negated := strings.CutPrefix(w, "-")
+		field, value, ok := strings.Cut(name, ":")
+		if !ok || !isQueryField(field) {
+			text = append(text, strings.ReplaceAll(w, `"`, ""))
+			continue
+		}
+		value = strings.ReplaceAll(value, `"`, "")
+		if value == "" {
+			return parsedQuery{}, fmt.Errorf("missing value of %s: in the query", name[:len(field)])
+		}
+		f := &pq.Filters
+		if negated {
+			f = &pq.Exclude
+		}
+		switch field {
+		case "lang":
+			f.Languages = append(f.Languages, parseLanguages(value)...)
+		case "path":
+			f.Paths = append(f.Paths, value)
+		case "kind":
+			for _, kind := range strings.Split(value, ",") {
+				if !slices.Contains(symbols.Kinds, kind) {
+					return parsedQuery{}, fmt.Errorf("invalid kind:%s in the query, want one of %s", kind, strings.Join(symbols.Kinds, ", "))
+				}
+				f.Kinds = append(f.Kinds, kind)
+			}
+		case "author":
+			f.Authors = append(f.Authors, value)
+		}
+	}
+	pq.Text = strings.Join(text, " ")
+	if strings.TrimSpace(pq.Text) == "" {
+		return parsedQuery{}, errors.New("the query has no text to search besides its filters")
+	}
+	return pq, nil
+}
+
+// isQueryField reports whether name is a field of the query syntax.
+func isQueryField(name string) bool {
+	switch name {
+	case "lang", "path", "kind", "author":
+		return true
+	}
+	return false
+}
+
+// queryWords splits query at spaces outside double quotes, keeping the
+// quotes.
+func queryWords(query string) ([]string, error) {
+	var (
+		words  []string
+		cur    strings.Builder
+		inside bool
+	)
+	for _, r := range query {
+		switch {
+		case r == '"':
+			inside = !inside
+			cur.WriteRune(r)
+		case !inside && unicode.IsSpace(r):
+			if cur.Len() > 0 {
+				words = append(words, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if inside {
+		return nil, errors.New("unterminated quote in the query")
+	}
+	if cur.Len() > 0 {
+		words = append(words, cur.String())
+	}
+	return words, nil
+}
+
+// apply sets the filters of pq on req, over those of the flags and request
+// parameters, and its text as the query. Of several author: values, the
+// last is kept.
+func (pq parsedQuery) apply(req *searchRequest) {
+	req.Query = pq.Text
+	if len(pq.Filters.Languages) > 0 {
+		req.Languages = pq.Filters.Languages
+	}
+	if n := len(pq.Filters.Authors); n > 0 {
+		req.Author = pq.Filters.Authors[n-1]
+	}
+	req.Paths = pq.Filters.Paths
+	req.Kinds = pq.Filters.Kinds
+	req.Exclude = pq.Exclude
+}
+
+// parseGrep compiles the -grep pattern, nil when empty.
+func parseGrep(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+// grepped returns a function reporting whether the content of a chunk
+// matches re.
+func grepped(re *regexp.Regexp) func(chunk) bool {
+	return func(c chunk) bool { return re.MatchString(c.Content) }
+}
+
+// globs returns the matcher of the path globs, nil without any.
+func globs(paths []string) *goignore.GitIgnore {
+	if len(paths) == 0 {
+		return nil
+	}
+	return goignore.CompileIgnoreLines(paths...)
+}
+
+// excluded reports whether the file of h is left out by the exclusions of
+// ex, but those of kinds, whose files are read by declaring.
+func (ex queryFilters) excluded(h hit, paths *goignore.GitIgnore, root string) bool {
+	if slices.Contains(ex.Languages, h.Meta.Language) {
+		return true
+	}
+	for _, author := range ex.Authors {
+		if h.Meta.Author != "" && strings.Contains(strings.ToLower(h.Meta.Author), strings.ToLower(author)) {
+			return true
+		}
+	}
+	return paths != nil && paths.MatchesPath(relPath(root, h.ID))
+}
+
+// readFilters reports whether the request has filters reading the files.
+func (req searchRequest) readFilters() bool {
+	return len(req.Kinds) > 0 || len(req.Exclude.Kinds) > 0 || req.Grep != nil
+}
+
+// matching keeps the best req.K hits with a chunk matching req.Grep, whose
+// file declares a symbol of one of req.Kinds and some symbol of another kind
+// than those of req.Exclude.Kinds, reading files in ranking order until
+// enough are found.
+func matching(ctx context.Context, a *app, req searchRequest, hits []hit) []hit {
+	out := hits[:0]
+	for _, h := range hits {
+		if len(out) == req.K {
+			break
+		}
+		text, err := readText(ctx, a, req.Src, h.ID)
+		if err != nil {
+			continue
+		}
+		// chunked as agent results are, to point them to the matching chunk
+		language := h.Meta.Language
+		if language == "" {
+			language = detect.Language(h.ID, []byte(text))
+		}
+		decls := a.declarations(ctx, h.ID, language, text)
+		if req.Grep != nil && !slices.ContainsFunc(chunkFile(h.ID, language, text, decls), grepped(req.Grep)) {
+			continue
+		}
+		if len(req.Kinds) == 0 && len(req.Exclude.Kinds) == 0 {
+			out = append(out, h)
+			continue
+		}
+		wanted := len(req.Kinds) == 0 || slices.ContainsFunc(decls, func(d symbols.Decl) bool { return slices.Contains(req.Kinds, d.Kind) })
+		// files declaring nothing are kept, there is nothing to exclude
+		other := len(decls) == 0 || slices.ContainsFunc(decls, func(d symbols.Decl) bool { return !slices.Contains(req.Exclude.Kinds, d.Kind) })
+		if wanted && other {
+			out = append(out, h)
+		}
+	}
+	return out
+}
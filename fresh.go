@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// modTime returns the modification time of the file id in the working tree,
+// false for files of a git revision or that can't be read.
+func modTime(a *app, id string) (time.Time, bool) {
+	if a.opts.rev != "" {
+		return time.Time{}, false
+	}
+	info, err := os.Stat(osPath(id))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return info.ModTime(), true
+}
+
+// handleAndRecord handles the file at path, then records its modification
+// time, read before the file, so that -fresh knows it's up to date.
+func handleAndRecord(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, src source, q []float32, path string) error {
+	mtime, ok := modTime(a, path)
+	if err := handleFile(ctx, a, db, idx, src, q, path); err != nil {
+		return err
+	}
+	if ok {
+		return db.SetModTime(ctx, path, mtime)
+	}
+	return nil
+}
+
+// refreshChanged brings idx, loaded from db, up to date with src for
+// -fresh: files modified since they were last indexed, or never indexed,
+// are handled until budget runs out, and files gone from src are left out of
+// idx when every file was listed.
+func refreshChanged(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, src source, q []float32, budget time.Duration) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+	start := time.Now()
+	deadline := start.Add(budget)
+
+	rollBackUpdates(ctx, db, idx)
+	indexed, err := db.ModTimes(ctx)
+	if err != nil {
+		l.Error("Failed to read modification times", "error", err)
+		return
+	}
+	ids, err := db.IDs(ctx)
+	if err != nil {
+		l.Error("Failed to list files", "error", err)
+		return
+	}
+
+	// List the changed files, the walk counting against the budget
+	walkCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	walked := map[string]bool{}
+	rules := loadPathRules(ctx, db)
+	var changed, pinned []string
+	err = src.walk(walkCtx, func(id string) {
+		if rules.excluded(id) {
+			return
+		}
+		walked[id] = true
+		// the store keeps microseconds
+		if rules.pinned(id) {
+			pinned = append(pinned, id)
+		} else if mtime, ok := modTime(a, id); !ok || !mtime.Truncate(time.Microsecond).Equal(indexed[id]) {
+			changed = append(changed, id)
+		}
+	})
+	// Pinned files are re-checked first, whatever their modification time
+	changed = append(pinned, changed...)
+	complete := err == nil
+	if err != nil && walkCtx.Err() == nil {
+		l.Error("Failed to list files", "error", err)
+	}
+
+	// Files in flight finish past the deadline, so none is left half done
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		next    int
+		handled int
+	)
+	for i := 0; i < a.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				if next == len(changed) || time.Now().After(deadline) {
+					mu.Unlock()
+					return
+				}
+				path := changed[next]
+				next++
+				mu.Unlock()
+
+				if err := handleAndRecord(ctx, a, db, idx, src, q, path); err != nil {
+					l.Error("Failed to handle file", "error", err)
+				}
+				mu.Lock()
+				handled++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	removed := 0
+	if complete {
+		for _, id := range ids {
+			if !walked[id] && idx.Delete(id) {
+				removed++
+			}
+		}
+	}
+	if stale := len(changed) - handled; stale > 0 || !complete {
+		l.Warn("fresh budget exhausted, some results may be stale", "budget", budget, "listed", len(walked), "stale", stale, "refreshed", handled)
+	} else {
+		l.Info("fresh", "changed", len(changed), "removed", removed, "ms", time.Since(start).Milliseconds())
+	}
+}
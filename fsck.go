@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	store "github.com/codectx/tokens/services/store"
+	vecfile "github.com/codectx/tokens/services/vecfile"
+)
+
+// problem is an inconsistency found by fsck, and how -repair fixes it.
+type problem struct {
+	check  string
+	path   string
+	detail string
+	repair func(ctx context.Context) error
+}
+
+// runFsck checks that the stored rows of an index are consistent with each
+// other, with the graph searches are run on and with the files they were
+// read from, and with -repair fixes what it found.
+func runFsck(ctx context.Context, args []string) error {
+	fs := newFlagSet("fsck")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeLexical) // checking doesn't embed
+	repair := fs.Bool("repair", false, "fix the problems found: files with bad rows are dropped, to be indexed from scratch by the next run")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	wd := "."
+	if fs.NArg() > 0 {
+		wd = fs.Arg(0)
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	if *repair && a.readOnly {
+		return fmt.Errorf("-repair needs to write to the database")
+	}
+
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+	problems, err := fsck(ctx, a, db, src)
+	if err != nil {
+		return err
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("%s is consistent\n", displayName(o.namespace))
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tPATH\tPROBLEM")
+	repaired := 0
+	for _, p := range problems {
+		status := ""
+		if *repair {
+			if err := p.repair(ctx); err != nil {
+				status = fmt.Sprintf(" (repair failed: %v)", err)
+			} else {
+				status = " (repaired)"
+				repaired++
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s%s\n", p.check, p.path, p.detail, status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	switch {
+	case !*repair:
+		return fmt.Errorf("%d problems found: fix them with -repair", len(problems))
+	case repaired < len(problems):
+		return fmt.Errorf("%d of %d problems repaired", repaired, len(problems))
+	}
+	fmt.Printf("%d problems repaired\n", repaired)
+	return nil
+}
+
+// fsck returns the problems of the index stored in db for the files of src:
+//   - updates journaled and never ended
+//   - rows without a vector, with another dimension than most rows, or with
+//     values that aren't finite
+//   - nodes of the -vectors file the graph is loaded from without a row,
+//     rows without a node, and nodes whose vector differs from their row
+//   - chunks whose line range doesn't fit the text of their file, or of
+//     files without a row
+func fsck(ctx context.Context, a *app, db store.StorageService, src source) ([]problem, error) {
+	var problems []problem
+	forget := func(id string) func(ctx context.Context) error {
+		return func(ctx context.Context) error { return forgetFile(ctx, db, id) }
+	}
+
+	unfinished, err := db.Unfinished(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range unfinished {
+		problems = append(problems, problem{"journal", e.ID, "update begun " + e.Started.Format("2006-01-02 15:04:05") + " never ended",
+			func(ctx context.Context) error { return rollBackUpdate(ctx, db, e.ID) }})
+	}
+
+	all, err := db.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(all))
+	for id := range all {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Rows of the dimension of most vectors are valid
+	dims := commonDims(all)
+	valid := make(map[string]bool, len(all))
+	for _, id := range ids {
+		vec := all[id].Vector
+		switch {
+		case len(vec) == 0:
+			problems = append(problems, problem{"vector", id, "row without a vector", forget(id)})
+		case len(vec) != dims:
+			problems = append(problems, problem{"vector", id, fmt.Sprintf("vector of %d dimensions, most have %d", len(vec), dims), forget(id)})
+		case slices.ContainsFunc(vec, func(v float32) bool { return math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) }):
+			problems = append(problems, problem{"vector", id, "vector holds values that aren't finite", forget(id)})
+		default:
+			valid[id] = true
+		}
+	}
+
+	chunks, err := db.Chunks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byFile := map[string][]store.Chunk{}
+	for _, c := range chunks {
+		byFile[c.File] = append(byFile[c.File], c)
+	}
+	var orphans []string
+	for file := range byFile {
+		if _, ok := all[file]; !ok {
+			orphans = append(orphans, file)
+		}
+	}
+	sort.Strings(orphans)
+	for _, file := range orphans {
+		problems = append(problems, problem{"chunks", file, fmt.Sprintf("%d chunks of a file without a row", len(byFile[file])), forget(file)})
+	}
+
+	for _, id := range ids {
+		if !valid[id] {
+			continue
+		}
+		hashes, err := db.ChunkHashes(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		type span struct{ start, end int }
+		var spans []span
+		for _, c := range byFile[id] {
+			spans = append(spans, span{c.StartLine, c.EndLine})
+		}
+		for _, h := range hashes {
+			spans = append(spans, span{h.StartLine, h.EndLine})
+		}
+		if len(spans) == 0 {
+			continue
+		}
+		text, err := readText(ctx, a, src, id)
+		if err != nil {
+			problems = append(problems, problem{"chunks", id, err.Error(), forget(id)})
+			continue
+		}
+		lines := strings.Count(text, "\n") + 1
+		for _, s := range spans {
+			if s.start < 1 || s.end < s.start || s.end > lines {
+				problems = append(problems, problem{"chunks", id, fmt.Sprintf("chunk of lines %d-%d, the file has %d", s.start, s.end, lines), forget(id)})
+				break
+			}
+		}
+	}
+
+	// Graphs are built from the rows, unless loaded from a -vectors file
+	if a.vectors != nil && a.vectors.Namespace() == a.opts.namespace {
+		// rewritten once, after the rows were repaired
+		var (
+			rewritten bool
+			werr      error
+		)
+		rewrite := func(ctx context.Context) error {
+			if !rewritten {
+				rewritten, werr = true, rewriteVectors(ctx, a, a.opts.namespace, dims)
+			}
+			return werr
+		}
+		nodes := make(map[string]bool, a.vectors.Len())
+		for i := range a.vectors.Len() {
+			id := a.vectors.ID(i)
+			nodes[id] = true
+			switch e, ok := all[id]; {
+			case !ok:
+				problems = append(problems, problem{"graph", id, "node of " + a.opts.vectors + " without a row", rewrite})
+			case valid[id] && !slices.Equal(e.Vector, a.vectors.Vector(i)):
+				problems = append(problems, problem{"graph", id, "node of " + a.opts.vectors + " with another vector than its row", rewrite})
+			}
+		}
+		for _, id := range ids {
+			if valid[id] && !nodes[id] {
+				problems = append(problems, problem{"graph", id, "row without a node in " + a.opts.vectors, rewrite})
+			}
+		}
+	}
+	return problems, nil
+}
+
+// commonDims returns the dimension of most of the vectors of rows, the
+// largest on a tie, 0 when none has a vector.
+func commonDims(rows map[string]store.Embedding) int {
+	counts := map[int]int{}
+	for _, e := range rows {
+		counts[len(e.Vector)]++
+	}
+	dims, most := 0, 0
+	for d, n := range counts {
+		if d > 0 && (n > most || n == most && d > dims) {
+			dims, most = d, n
+		}
+	}
+	return dims
+}
+
+// rewriteVectors replaces the -vectors file with the rows of namespace ns of
+// dims dimensions, as export-vectors would write it. The new file is renamed
+// over the old one, which stays mapped until the app is closed.
+func rewriteVectors(ctx context.Context, a *app, ns string, dims int) error {
+	db, err := a.store(ns)
+	if err != nil {
+		return err
+	}
+	all, err := db.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	entries := make([]vecfile.Entry, 0, len(all))
+	for id, e := range all {
+		if len(e.Vector) == dims {
+			entries = append(entries, vecfile.Entry{ID: id, Shard: e.Shard, Vector: e.Vector})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	tmp := a.opts.vectors + ".tmp"
+	if err := vecfile.Write(tmp, ns, entries); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write vectors: %w", err)
+	}
+	return os.Rename(tmp, a.opts.vectors)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	lexical "github.com/codectx/tokens/services/lexical"
+)
+
+// defaultGoldenDir holds the fixture repo and golden files checked by the
+// golden command.
+const defaultGoldenDir = "testdata/e2e"
+
+// goldenFile is a set of queries and the results expected of them when the
+// fixture repo is indexed with the fake provider.
+type goldenFile struct {
+	// Flags are the search flags the repo is indexed and searched with, on
+	// top of -provider fake and a database of their own.
+	Flags []string `json:"flags,omitempty"`
+	// K is the number of results checked per query, defaultTopK when 0.
+	K       int           `json:"k,omitempty"`
+	Queries []goldenQuery `json:"queries"`
+}
+
+// goldenQuery is a query and the paths of its expected results, relative to
+// the fixture repo, best first.
+type goldenQuery struct {
+	Query string   `json:"query"`
+	Want  []string `json:"want"`
+}
+
+// runGolden indexes the fixture repo of a golden directory, its repo
+// subdirectory, and checks that the queries of each of its golden*.json
+// files still return the results they record, in order.
+func runGolden(ctx context.Context, args []string) error {
+	fs := newFlagSet("golden")
+	update := fs.Bool("update", false, "record the current results in the golden files instead of checking them")
+	fs.Parse(args)
+
+	dir := defaultGoldenDir
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "golden*.json"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no golden*.json files in %s", dir)
+	}
+
+	// keep stdout for the report
+	ctx = context.WithValue(ctx, LoggerCtxKey, newLogger(os.Stderr))
+
+	var failed int
+	for _, path := range files {
+		n, err := checkGolden(ctx, os.Stdout, filepath.Join(dir, "repo"), path, *update)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		failed += n
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d golden queries returned other results: if the change is intended, record them with -update", failed)
+	}
+	return nil
+}
+
+// checkGolden indexes repo as the golden file at path says, runs its
+// queries, reports each to w and returns how many returned other results.
+// With update, the results are written to the golden file instead.
+func checkGolden(ctx context.Context, w io.Writer, repo, path string, update bool) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var g goldenFile
+	if err := json.Unmarshal(b, &g); err != nil {
+		return 0, fmt.Errorf("invalid golden file: %w", err)
+	}
+	if len(g.Queries) == 0 {
+		return 0, errors.New("no queries")
+	}
+	if g.K == 0 {
+		g.K = defaultTopK
+	}
+
+	tmp, err := os.MkdirTemp("", "codectx-golden-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+
+	fs := flag.NewFlagSet(filepath.Base(path), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	o := &options{}
+	o.register(fs)
+	fs.Set("provider", "fake")
+	fs.Set("db", filepath.Join(tmp, "golden.db"))
+	fs.Set("mode", modeVector)
+	if err := fs.Parse(g.Flags); err != nil {
+		return 0, fmt.Errorf("invalid flags: %w", err)
+	}
+	if fs.NArg() > 0 {
+		return 0, fmt.Errorf("flags hold arguments %q", fs.Args())
+	}
+	if err := o.validate(); err != nil {
+		return 0, err
+	}
+
+	root, err := filepath.Abs(repo)
+	if err != nil {
+		return 0, err
+	}
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return 0, err
+	}
+	defer a.Close()
+	src, err := newSource(ctx, a, root)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return 0, err
+	}
+	vectors := make([][]float32, len(g.Queries))
+	for i, q := range g.Queries {
+		if vectors[i], _, err = a.embedQuery(ctx, q.Query); err != nil {
+			return 0, fmt.Errorf("failed to embed query: %w", err)
+		}
+	}
+	idx := a.newIndex(ctx, src.shard, 0, len(vectors[0]))
+	indexTree(ctx, a, db, idx, src, vectors[0])
+	// searches are measured with every file summarized
+	if a.summaries != nil {
+		summarizeTree(ctx, a, db, src)
+	}
+	var lex lexical.LexicalService
+	if o.lexicalWeight > 0 {
+		lex = lexical.NewLexicalService()
+		indexLexical(ctx, a, lex, src)
+	}
+
+	fmt.Fprintf(w, "%s %v\n", filepath.Base(path), g.Flags)
+	var failed int
+	for i, q := range g.Queries {
+		hits, err := searchIndex(ctx, a, db, idx, searchRequest{Query: q.Query, Vector: vectors[i], K: g.K,
+			Languages: o.languages(), Tests: o.tests, Root: root, Lex: lex})
+		if err != nil {
+			return 0, err
+		}
+		got := make([]string, len(hits))
+		for j, h := range hits {
+			rel, err := filepath.Rel(root, h.ID)
+			if err != nil {
+				return 0, err
+			}
+			got[j] = filepath.ToSlash(rel)
+		}
+
+		switch {
+		case update:
+			g.Queries[i].Want = got
+			fmt.Fprintf(w, "  recorded %q\n", q.Query)
+		case slices.Equal(got, q.Want):
+			fmt.Fprintf(w, "  ok       %q\n", q.Query)
+		default:
+			failed++
+			fmt.Fprintf(w, "  FAIL     %q\n    want %v\n    got  %v\n", q.Query, q.Want, got)
+		}
+	}
+
+	if update {
+		b, err := json.MarshalIndent(g, "", "  ")
+		if err != nil {
+			return 0, err
+		}
+		if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+			return 0, err
+		}
+	}
+	return failed, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// TestGolden checks that the queries of the golden files of the fixture
+// corpus still return the results they record, like the golden command.
+// It indexes the corpus once per golden file, so -short skips it.
+func TestGolden(t *testing.T) {
+	if testing.Short() {
+		t.Skip("indexes the golden corpus")
+	}
+	files, err := filepath.Glob(filepath.Join(defaultGoldenDir, "golden*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("no golden*.json files in %s", defaultGoldenDir)
+	}
+	for _, path := range files {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			var report bytes.Buffer
+			failed, err := checkGolden(testContext(), &report, fixtureRepo, path, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failed > 0 {
+				t.Errorf("%d queries returned other results: if the change is intended, record them with go run -tags embedtest . golden -update\n%s", failed, &report)
+			}
+		})
+	}
+}
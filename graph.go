@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	cluster "github.com/codectx/tokens/services/cluster"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// graphSchema is the schema of the JSON output of export-graph.
+const graphSchema = "codectx.graph/v1"
+
+const (
+	graphDot  = "dot"
+	graphJSON = "json"
+	// graphNeighbors is the default number of nearest neighbours linked to
+	// every file.
+	graphNeighbors = 5
+)
+
+// graphNode is a file of the exported graph, at its projection on the plane.
+type graphNode struct {
+	Path     string  `json:"path"`
+	Language string  `json:"language,omitempty"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	// Summary is the stored summary of the file, when -summaries made one.
+	Summary string `json:"summary,omitempty"`
+}
+
+// graphEdge links a file to one of its nearest neighbours.
+type graphEdge struct {
+	Source   string  `json:"source"`
+	Target   string  `json:"target"`
+	Distance float32 `json:"distance"`
+}
+
+// graphOutput is the JSON output of export-graph, schema codectx.graph/v1.
+type graphOutput struct {
+	Schema string      `json:"schema"`
+	Index  string      `json:"index"`
+	Nodes  []graphNode `json:"nodes"`
+	Edges  []graphEdge `json:"edges"`
+}
+
+// runExportGraph writes the files of a stored index linked to their nearest
+// neighbours, as Graphviz DOT or as JSON also placing every file on a 2D
+// projection of the vectors, so that the way a codebase clusters can be
+// plotted.
+func runExportGraph(ctx context.Context, args []string) error {
+	fs := newFlagSet("export-graph")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeLexical) // exporting doesn't embed
+	format := fs.String("format", graphDot, "output format, dot or json")
+	neighbors := fs.Int("neighbors", graphNeighbors, "number of nearest neighbours linked to every file")
+	out := fs.String("o", "", "output `file` (default stdout)")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if *format != graphDot && *format != graphJSON {
+		return fmt.Errorf("invalid -format %q, must be dot or json", *format)
+	}
+	if *neighbors < 1 {
+		return fmt.Errorf("invalid -neighbors %d, must be at least 1", *neighbors)
+	}
+	wd := "."
+	if fs.NArg() > 0 {
+		wd = fs.Arg(0)
+	}
+	// keep stdout for the graph
+	l := newLogger(os.Stderr)
+	ctx = context.WithValue(ctx, LoggerCtxKey, l)
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+
+	all, err := db.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	idx, err := loadIndex(ctx, a, o.namespace)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(all))
+	for id := range all {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	sums, err := db.Summaries(ctx, store.SummaryFile)
+	if err != nil {
+		return err
+	}
+	summaries := map[string]string{}
+	for _, s := range sums {
+		summaries[s.ID] = s.Text
+	}
+
+	g := graphOutput{Schema: graphSchema, Index: displayName(o.namespace), Nodes: []graphNode{}, Edges: []graphEdge{}}
+	vectors := make([][]float32, len(ids))
+	for i, id := range ids {
+		vectors[i] = all[id].Vector
+	}
+	for i, p := range cluster.Project(vectors) {
+		id := ids[i]
+		g.Nodes = append(g.Nodes, graphNode{Path: relPath(wd, id), Language: all[id].Language, X: p[0], Y: p[1], Summary: summaries[id]})
+	}
+
+	// neighbours are symmetric more often than not, link each pair once
+	linked := map[[2]string]bool{}
+	for _, id := range ids {
+		for _, r := range idx.Search(all[id].Vector, *neighbors+1) {
+			pair := [2]string{min(id, r.ID), max(id, r.ID)}
+			if r.ID == id || linked[pair] {
+				continue
+			}
+			if _, ok := all[r.ID]; !ok {
+				continue
+			}
+			linked[pair] = true
+			g.Edges = append(g.Edges, graphEdge{Source: relPath(wd, pair[0]), Target: relPath(wd, pair[1]), Distance: r.Distance})
+		}
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("failed to create graph file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	if *format == graphJSON {
+		enc := json.NewEncoder(bw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(g)
+	} else {
+		err = writeDot(bw, g)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write graph: %w", err)
+	}
+	l.Info("exported graph", "index", g.Index, "format", *format, "nodes", len(g.Nodes), "edges", len(g.Edges))
+	return nil
+}
+
+// writeDot writes g as an undirected Graphviz graph. Edges are weighted by
+// similarity and sized by distance, so that layouts such as neato draw
+// similar files close together.
+func writeDot(w io.Writer, g graphOutput) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "graph %s {\n", strconv.Quote(g.Index))
+	b.WriteString("  node [shape=box, fontsize=10];\n")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(&b, "  %s", strconv.Quote(n.Path))
+		if n.Language != "" {
+			fmt.Fprintf(&b, " [group=%s]", strconv.Quote(n.Language))
+		}
+		b.WriteString(";\n")
+	}
+	for _, e := range g.Edges {
+		// dot only takes integer weights
+		fmt.Fprintf(&b, "  %s -- %s [weight=%d, len=%.3f];\n",
+			strconv.Quote(e.Source), strconv.Quote(e.Target), max(0, int(100*(1-e.Distance))), 0.5+2*e.Distance)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// handleHealth answers /healthz: the process is up and serving HTTP, the
+// indexes may still be loading.
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReady answers /readyz: 200 once the indexes are loaded and until
+// shutdown begins, 503 otherwise, so that no search is routed to a server
+// that can't answer it.
+func (s *server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// whenReady serves h once the indexes are loaded, and 503 before.
+func (s *server) whenReady(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// open marks s ready once the served path is indexed, unless shutdown has
+// begun, and waits until serving ends.
+func (s *server) open(ctx context.Context, served <-chan error, args ...any) error {
+	s.writes.Done()
+	if ctx.Err() == nil {
+		s.ready.Store(true)
+		s.log.Info("serving", args...)
+	}
+	return <-served
+}
+
+// drain stops httpSrv accepting requests and waits up to timeout for those
+// in flight and the files being indexed, after marking s unready.
+func (s *server) drain(httpSrv *http.Server, timeout time.Duration) {
+	s.ready.Store(false)
+	s.log.Info("shutting down", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := httpSrv.Shutdown(ctx)
+	writes := make(chan struct{})
+	go func() {
+		s.writes.Wait()
+		close(writes)
+	}()
+	select {
+	case <-writes:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.log.Warn("shutdown timed out, dropping the requests and writes in flight", "timeout", timeout)
+		httpSrv.Close()
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// programName is the name of the installed binary, as in the Docker image.
+const programName = "codectx"
+
+// commandHelp documents a command in its -h output.
+type commandHelp struct {
+	// usage lists the arguments after the command name.
+	usage string
+	// summary says what the command does, in one sentence.
+	summary string
+	// examples are command lines, without the program name.
+	examples []string
+}
+
+// helps documents each command by name, "" for the search run without a
+// subcommand.
+var helps = map[string]commandHelp{
+	"": {
+		usage:   "[flags] [path] [query]",
+		summary: "Index path, re-embedding changed files, and show the files most relevant to query, prompted for when missing.",
+		examples: []string{
+			`. "where are retries configured"`,
+			`-index backend -lang go /some/path "payment retries"`,
+			`/some/path 'lang:go path:services/** kind:func "storage upsert"'`,
+			`-not "test helpers" /some/path 'http client retries -path:vendor/**'`,
+			`-grep 'ctx\.Done\(\)' /some/path "cancel long running work"`,
+			`-boilerplate "in our monorepo" /some/path "where is the code that refreshes tokens?"`,
+			`-tests pair /some/path "token refresh"`,
+			`-explain -lexical-weight 0.3 /some/path "storage service upsert"`,
+			`-no-walk -by-dir /some/path "authentication"`,
+			`-fresh 2s /some/path "session expiry"`,
+			`-summaries /some/path "how are webhooks retried"`,
+			`-hierarchy /some/path "how is authentication layered"`,
+			`-embed-cache redis://cache.internal:6379 /some/path "session expiry"`,
+			`-batch-size 32 -max-input-tokens 8192 -truncate middle /some/path "session expiry"`,
+			`-provider ollama,voyage /some/path "session expiry"`,
+			`-open 1 /some/path "rate limiter"`,
+			`-copy /some/path "how are webhooks retried"`,
+			`-json -no-walk /some/path "session expiry"`,
+		},
+	},
+	"serve": {
+		usage:   "[flags] [path]",
+		summary: "Index path and serve search requests over HTTP.",
+		examples: []string{
+			"serve /some/path",
+			"serve -index backend -addr :9090 -rescan 1m /some/path",
+			"serve -no-walk -tokens tokens.txt /some/path",
+			"serve -rescan 5m -drain-timeout 20s /some/path",
+			"serve -admin-token $ADMIN_TOKEN /some/path",
+			"serve -public -public-paths docs,services -public-max-k 5 /some/path",
+		},
+	},
+	"pause": {
+		usage:    "[-addr URL] [-token TOKEN]",
+		summary:  "Pause the background indexing of a running serve; files being indexed finish.",
+		examples: []string{"pause", "pause -addr http://localhost:9090 -token $TOKEN"},
+	},
+	"resume": {
+		usage:    "[-addr URL] [-token TOKEN]",
+		summary:  "Resume the background indexing of a running serve.",
+		examples: []string{"resume"},
+	},
+	"reload": {
+		usage:    "[-addr URL] [-token TOKEN]",
+		summary:  "Reload the configuration of a running serve, keeping its indexes loaded; SIGHUP does the same.",
+		examples: []string{"reload", "reload -addr http://localhost:9090 -token $TOKEN"},
+	},
+	"index-history": {
+		usage:   "[flags] [path] [query]",
+		summary: "Embed recent commit messages, and optionally pull requests, and show the entries most relevant to query.",
+		examples: []string{
+			`index-history -n 1000 /some/path "why was the cache removed"`,
+			"index-history -github owner/repo /some/path",
+		},
+	},
+	"history": {
+		usage:   "[flags] PATH",
+		summary: "Show when the file at PATH was embedded, skipped or failed, by which provider, and whether it changed since.",
+		examples: []string{
+			"history services/store/store.go",
+			"history -n 0 -json -index backend /some/path/main.go",
+		},
+	},
+	"pin": {
+		usage:   "[flags] PATTERN...",
+		summary: "Pin the files matching PATTERN, re-checked before every search; -remove drops the rule, -list lists the rules.",
+		examples: []string{
+			"pin services/store/store.go",
+			"pin -index backend -remove services/store/",
+		},
+	},
+	"exclude": {
+		usage:   "[flags] PATTERN...",
+		summary: "Leave the files matching PATTERN out of indexing and results, without editing .astignore; -remove includes them again.",
+		examples: []string{
+			`exclude fixtures/ "*.snap"`,
+			"exclude -list",
+		},
+	},
+	"indexes": {
+		usage:    "[flags]",
+		summary:  "List the named indexes stored in the database and their sizes.",
+		examples: []string{"indexes", "indexes -db /data/codectx.db"},
+	},
+	"fetch": {
+		usage:   "[flags] CHUNK-ID...",
+		summary: "Print the content of chunks by the ids that -json search results give them, as JSON.",
+		examples: []string{
+			`fetch "/some/path/services/store/store.go#storageService.Upsert@3f728a713c52"`,
+			`fetch -index backend "/some/path/main.go#main@466058585b91"`,
+		},
+	},
+	"def": {
+		usage:   "[flags] SYMBOL [path]",
+		summary: "Index path and print where SYMBOL is defined, falling back to similar names, then to a semantic search when none matches.",
+		examples: []string{
+			"def Upsert .",
+			"def -json storageService.Upsert /some/path",
+			`def -no-walk "parse config" /some/path`,
+		},
+	},
+	"refs": {
+		usage:   "[flags] SYMBOL [path]",
+		summary: "Index path and print where SYMBOL is used, falling back to similar names, then to a semantic search when none matches.",
+		examples: []string{
+			"refs Upsert .",
+			"refs -json -index backend retryPolicy /some/path",
+		},
+	},
+	"tui": {
+		usage:   "[flags] [path]",
+		summary: "Index path, then search it as the query is typed, preview the results and open them in $EDITOR.",
+		examples: []string{
+			"tui .",
+			"tui -no-walk -lang go /some/path",
+			"tui -mode lexical -k 50 /some/path",
+		},
+	},
+	"compare": {
+		usage:   "[flags] -a INDEX -b INDEX [query...]",
+		summary: "Run the same queries against two indexes and show their results side by side.",
+		examples: []string{
+			`compare -a main -b feature-x "retry policy" "rate limiting"`,
+			"compare -a main -b feature-x -queries queries.txt",
+		},
+	},
+	"ab": {
+		usage:   "[flags] [path]",
+		summary: "Embed a sample of the corpus and an eval set with two providers and report their retrieval quality and latency.",
+		examples: []string{
+			"ab -a ollama -b voyage -queries eval.yaml /some/path",
+			"ab -exact -sample 500 /some/path",
+		},
+	},
+	"retry-failed": {
+		usage:    "[flags] [path]",
+		summary:  "Re-embed the files that failed during previous runs.",
+		examples: []string{"retry-failed -list", "retry-failed /some/path"},
+	},
+	"fsck": {
+		usage:    "[flags] [path]",
+		summary:  "Check that the rows of an index agree with each other, its graph and its files, and repair them.",
+		examples: []string{"fsck /some/path", "fsck -index backend -repair /some/path"},
+	},
+	"compact": {
+		usage:    "[flags]",
+		summary:  "Drop the rows left behind by deleted files and shrink the database file, reporting the space reclaimed.",
+		examples: []string{"compact", "compact -db team.db -vectors main.vec"},
+	},
+	"backup": {
+		usage:    "[flags]",
+		summary:  "Snapshot the database and vectors file into a timestamped backup, optionally uploaded, keeping the latest ones.",
+		examples: []string{"backup", "backup -keep 14 -upload s3://team-bucket/codectx-backups"},
+	},
+	"restore": {
+		usage:    "[flags] [backup]",
+		summary:  "Replace the database, and vectors file, with a backup, the latest by default.",
+		examples: []string{"restore", "restore 20240301T120000Z", "restore -from s3://team-bucket/codectx-backups 20240301T120000Z"},
+	},
+	"coordinate": {
+		usage:    "[flags] [path]",
+		summary:  "Queue the files of path in batches for work processes sharing the database to index, and wait until they are done.",
+		examples: []string{"coordinate -db md:codectx /src/monorepo", "coordinate -db md:codectx -batch 256 -wait=false /src/monorepo", "coordinate -queue redis://queue:6379 /src/monorepo"},
+	},
+	"work": {
+		usage:    "[flags] [path]",
+		summary:  "Claim batches queued by coordinate and embed their files into the shared database, until the queue stays empty.",
+		examples: []string{"work -db md:codectx /src/monorepo", "work -db md:codectx -provider ollama -workers 8 -idle 0 /src/monorepo", "work -queue redis://queue:6379 -provider queue:redis://queue:6379 /src/monorepo"},
+	},
+	"embedder": {
+		usage:    "[flags]",
+		summary:  "Embed the texts that processes using -provider queue:<broker> publish, with the local provider.",
+		examples: []string{"embedder -queue redis://queue:6379", "embedder -queue nats://queue:4222 -provider ollama -ollama-hosts gpu0,gpu1"},
+	},
+	"queries": {
+		usage:   "[flags] save NAME QUERY | list | delete NAME | run [NAME...]",
+		summary: "Manage saved queries, and run them to see how their results changed since the last run.",
+		examples: []string{
+			`queries save retries "where are retries configured"`,
+			"queries run",
+			"queries -update=false run retries",
+		},
+	},
+	"golden": {
+		usage:   "[-update] [dir]",
+		summary: "Index the fixture repo of dir with the fake provider, built with -tags embedtest, and check that the queries of its golden*.json files still return the recorded results, " + defaultGoldenDir + " by default.",
+		examples: []string{
+			"golden",
+			"golden -update",
+		},
+	},
+	"export-vectors": {
+		usage:    "[flags]",
+		summary:  "Write the vectors of a stored index to a flat file that -vectors memory-maps.",
+		examples: []string{"export-vectors -index backend -o backend.vec"},
+	},
+	"export-graph": {
+		usage:   "[flags] [path]",
+		summary: "Write the files of a stored index linked to their nearest neighbours, as Graphviz DOT or JSON with a 2D projection.",
+		examples: []string{
+			"export-graph -index backend . | neato -Tsvg -o backend.svg",
+			"export-graph -format json -neighbors 3 -o graph.json /some/path",
+		},
+	},
+	"cluster": {
+		usage:   "[flags] [path]",
+		summary: "Group the files of a stored index into topics by the similarity of their vectors, with the files nearest to each.",
+		examples: []string{
+			"cluster -index backend /some/path",
+			"cluster -clusters 12 -labels -json .",
+		},
+	},
+	"dupes": {
+		usage:   "[flags] [path]",
+		summary: "Report pairs of similar chunks of different files, likely copy-pasted code.",
+		examples: []string{
+			"dupes /some/path",
+			"dupes -threshold 0.9 -min-lines 10 -json .",
+		},
+	},
+	"outliers": {
+		usage:   "[flags] [path]",
+		summary: "Report the files no saved query finds and the chunks farthest from the topics they find, hinting at dead or undocumented code.",
+		examples: []string{
+			"outliers /some/path",
+			"outliers -queries eval.txt -k 20 -json .",
+		},
+	},
+	"push": {
+		usage:    "[flags]",
+		summary:  "Upload the database to -remote so that others can search it.",
+		examples: []string{"push -remote s3://team-bucket/codectx/local.db"},
+	},
+	"pull": {
+		usage:    "[flags]",
+		summary:  "Refresh the cached copy of -remote regardless of its age.",
+		examples: []string{"pull -remote s3://team-bucket/codectx/local.db"},
+	},
+	"feedback": {
+		usage:   "[flags] QUERY-ID RESULT good|bad | feedback -export FILE",
+		summary: "Record whether a result of a logged query was relevant, or export the judgments as an eval set.",
+		examples: []string{
+			"feedback 984e18fe20 services/store/store.go good",
+			"feedback -export eval.yaml -root /some/path",
+		},
+	},
+	"stats": {
+		usage:    "[flags]",
+		summary:  "Show the size of an index, its files per language and the engine searches use for it.",
+		examples: []string{"stats", "stats -index backend -memory-limit 4GB"},
+	},
+	"auth": {
+		usage:   "[flags] login PROVIDER | logout PROVIDER | status [PROVIDER...]",
+		summary: "Store the API keys of embedding providers in the OS keyring, or where a password manager holds them.",
+		examples: []string{
+			"auth login voyage",
+			"auth -ref op://Dev/Voyage/credential login voyage",
+			"auth status",
+		},
+	},
+	"completion": {
+		usage:   "[flags] bash|zsh|fish",
+		summary: "Print the shell completion script, completing commands, flags, index names and config keys.",
+		examples: []string{
+			`completion bash > /etc/bash_completion.d/codectx`,
+			`completion zsh > "${fpath[1]}/_codectx"`,
+			"completion fish > ~/.config/fish/completions/codectx.fish",
+		},
+	},
+	"config": {
+		usage:   "[flags] list [path] | get KEY [path] | path [path]",
+		summary: "Show the values set by the config files, and which file sets them.",
+		examples: []string{
+			"config list",
+			"config get provider",
+			"config path /some/path",
+		},
+	},
+}
+
+// newFlagSet returns the flag set of command, "" for the search run without
+// a subcommand, whose -h shows the command's summary, usage, examples and
+// flags.
+func newFlagSet(command string) *flag.FlagSet {
+	fs := flag.NewFlagSet(strings.TrimSpace(programName+" "+command), flag.ExitOnError)
+	fs.Usage = func() {
+		if completing {
+			// hand the flag set over to flagsOf
+			panic(flagSetOf{fs})
+		}
+		printHelp(fs, command)
+	}
+	return fs
+}
+
+// printHelp writes the help of command, followed by the defaults of fs.
+func printHelp(fs *flag.FlagSet, command string) {
+	w := fs.Output()
+	h := helps[command]
+	fmt.Fprintf(w, "%s\n\nUsage:\n  %s %s\n", h.summary, fs.Name(), h.usage)
+	if command == "" {
+		fmt.Fprintf(w, "  %s COMMAND [flags] [args]\n\nCommands:\n", programName)
+		for _, name := range commandNames() {
+			fmt.Fprintf(w, "  %-16s%s\n", name, helps[name].summary)
+		}
+	}
+	if len(h.examples) > 0 {
+		fmt.Fprintln(w, "\nExamples:")
+		for _, e := range h.examples {
+			fmt.Fprintf(w, "  %s %s\n", programName, e)
+		}
+	}
+	fmt.Fprintln(w, "\nFlags:")
+	fs.PrintDefaults()
+	if command == "" {
+		fmt.Fprintf(w, "\nRun '%s COMMAND -h' for the help of a command.\n", programName)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	cluster "github.com/codectx/tokens/services/cluster"
+	store "github.com/codectx/tokens/services/store"
+)
+
+const (
+	// clusterSize is the number of files or clusters summarized together,
+	// on average, at each level of the hierarchy.
+	clusterSize = 8
+	// maxLevels bounds the height of the hierarchy.
+	maxLevels = 6
+	// treeBeam is the number of clusters followed down each level of the
+	// hierarchy when searching it.
+	treeBeam = 3
+)
+
+// buildHierarchy clusters the file summaries of db by similarity and
+// summarizes each cluster, then clusters and summarizes those clusters, and
+// so on until at most clusterSize are left at the top. Clusters whose
+// members didn't change keep their summary; those no longer part of the
+// hierarchy are deleted.
+func buildHierarchy(ctx context.Context, a *app, db store.StorageService) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	nodes, err := db.Summaries(ctx, store.SummaryFile)
+	if err != nil {
+		return err
+	}
+	stored, err := db.Summaries(ctx, store.SummaryCluster)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]store.Summary, len(stored))
+	for _, s := range stored {
+		known[s.ID] = s
+	}
+
+	keep := map[string]bool{}
+	for level := 1; level <= maxLevels && len(nodes) > clusterSize; level++ {
+		vectors := make([][]float32, len(nodes))
+		for i, n := range nodes {
+			vectors[i] = n.Vector
+		}
+		groups := cluster.KMeans(vectors, (len(nodes)+clusterSize-1)/clusterSize)
+		if len(groups) >= len(nodes) {
+			// too few distinct vectors to cluster further
+			break
+		}
+
+		next := make([]store.Summary, 0, len(groups))
+		for _, g := range groups {
+			// a cluster is named after its members and their content,
+			// so that unchanged clusters are found again
+			var b strings.Builder
+			children := make([]string, len(g))
+			texts := make([]string, len(g))
+			for j, i := range g {
+				fmt.Fprintf(&b, "%s\x00%s\n", nodes[i].ID, nodes[i].Hash)
+				children[j], texts[j] = nodes[i].ID, nodes[i].Text
+			}
+			hash := computeHash([]byte(b.String()))
+			id := fmt.Sprintf("%d:%s", level, hash[:12])
+			keep[id] = true
+			if s, ok := known[id]; ok {
+				next = append(next, s)
+				continue
+			}
+
+			text, err := a.summaries.Cluster(ctx, texts)
+			if err != nil {
+				return err
+			}
+			s, err := embedSummary(ctx, a, db, store.Summary{ID: id, Kind: store.SummaryCluster, Hash: hash, Text: text, Level: level, Children: children})
+			if err != nil {
+				return err
+			}
+			next = append(next, s)
+		}
+		l.Debug("hierarchy level", "level", level, "clusters", len(next))
+		nodes = next
+	}
+
+	for _, s := range stored {
+		if !keep[s.ID] {
+			if err := db.DeleteSummary(ctx, store.SummaryCluster, s.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hierarchyHits searches the hierarchy from the top: the treeBeam clusters
+// best matching the query at each level, then the children of those among
+// the clusters of the level below, down to the clusters of files. Their
+// files are picked by their summaries; best matching file summaries of
+// other clusters fill in when there are too few. The clusters followed are
+// logged, their summaries giving an overview for questions about the whole
+// repository. The ids of every summarized file are also returned.
+func hierarchyHits(ctx context.Context, db store.StorageService, req searchRequest) ([]hit, map[string]bool, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	files, err := nearestSummaries(ctx, db, store.SummaryFile, req.Vector)
+	if err != nil || len(files) == 0 {
+		return nil, nil, err
+	}
+	clusters, err := db.Summaries(ctx, store.SummaryCluster)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byID := make(map[string]store.Summary, len(clusters))
+	top := 0
+	for _, c := range clusters {
+		byID[c.ID] = c
+		top = max(top, c.Level)
+	}
+	var level []store.Summary
+	for _, c := range clusters {
+		if c.Level == top {
+			level = append(level, c)
+		}
+	}
+
+	leaves := map[string]bool{}
+	for len(level) > 0 {
+		beam := rankSummaries(level, req.Vector)
+		beam = beam[:min(len(beam), treeBeam)]
+		level = nil
+		for _, c := range beam {
+			l.Info("cluster", "level", c.Level, "distance", c.distance, "members", len(c.Children), "summary", c.Text)
+			for _, child := range c.Children {
+				if c.Level == 1 {
+					leaves[child] = true
+				} else if s, ok := byID[child]; ok {
+					level = append(level, s)
+				}
+			}
+		}
+	}
+	return pickSummaries(ctx, db, req, files, func(id string) bool { return leaves[id] })
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// historyNamespace is where commit messages are indexed by default.
+const historyNamespace = "history"
+
+// githubClient bounds GitHub API calls so a stalled response can't hang indexing.
+var githubClient = &http.Client{Timeout: 30 * time.Second}
+
+// historyDoc is a commit message or pull request description.
+type historyDoc struct {
+	// ID is `commit:<sha>` or `pr:<number>`.
+	ID string
+	// Title is the commit subject or PR title, used for display.
+	Title string
+	// Text is what gets embedded.
+	Text string
+}
+
+// runIndexHistory embeds recent commit messages, and optionally GitHub pull
+// request descriptions, into a separate namespace. When a query is given,
+// the most relevant history entries are displayed.
+func runIndexHistory(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("index-history")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeVector) // needs embeddings
+	fs.Set("namespace", historyNamespace)
+	maxCommits := fs.Int("n", 500, "number of recent commits to index")
+	repo := fs.String("github", "", "also index pull request descriptions of `owner/repo` (uses GITHUB_TOKEN)")
+	maxPRs := fs.Int("prs", 100, "number of recent pull requests to index with -github")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	wd, query := ".", ""
+	if fs.NArg() > 0 {
+		wd = fs.Arg(0)
+	}
+	if fs.NArg() > 1 {
+		query = fs.Arg(1)
+	}
+
+	docs, err := gitCommits(ctx, wd, *maxCommits)
+	if err != nil {
+		return err
+	}
+	if *repo != "" {
+		prs, err := githubPullRequests(ctx, *repo, *maxPRs)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, prs...)
+	}
+	l.Debug("history", "docs", len(docs))
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+	idx := index.NewIndexService()
+	indexHistory(ctx, a, db, idx, docs)
+
+	if query == "" {
+		return nil
+	}
+
+	q, _, err := a.embedQuery(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to embed query: %w", err)
+	}
+
+	titles := make(map[string]string, len(docs))
+	for _, d := range docs {
+		titles[d.ID] = d.Title
+	}
+	for _, n := range idx.Search(q, defaultTopK) {
+		l.Info("neighbour", "id", n.ID, "title", titles[n.ID], "distance", n.Distance)
+	}
+	return nil
+}
+
+// indexHistory embeds docs that aren't stored yet and adds all of them to idx.
+func indexHistory(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, docs []historyDoc) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	work := make(chan historyDoc, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < a.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				hash := computeHash([]byte(d.Text))
+
+				match, err := db.MatchHash(ctx, d.ID, hash)
+				if err != nil {
+					l.Error("Failed to compare hash", "error", err)
+					continue
+				}
+				if match {
+					b, err := db.Get(ctx, []string{d.ID})
+					if err != nil || len(b) == 0 {
+						l.Error("Failed to get embedding", "id", d.ID, "error", err)
+						continue
+					}
+					idx.Add(d.ID, b[0].Vector)
+					continue
+				}
+
+				vec, _, err := a.emb.Get(ctx, d.Text)
+				if err != nil {
+					l.Error("Failed to embed text", "id", d.ID, "error", err)
+					continue
+				}
+				if err := db.Upsert(ctx, store.Embedding{ID: d.ID, Hash: hash, Vector: vec, Model: a.space}); err != nil {
+					l.Error("Failed to create embedding", "error", err)
+					continue
+				}
+				idx.Add(d.ID, vec)
+			}
+		}()
+	}
+
+	for _, d := range docs {
+		work <- d
+	}
+	close(work)
+	wg.Wait()
+}
+
+// gitCommits returns the last n commits of the repository at wd.
+func gitCommits(ctx context.Context, wd string, n int) ([]historyDoc, error) {
+	// unit and record separators can't appear in commit messages
+	out, err := exec.CommandContext(ctx, "git", "-C", wd, "log", fmt.Sprintf("-n%d", n),
+		"--format=%H%x1f%an%x1f%s%x1f%b%x1e").Output()
+	if err != nil {
+		return nil, fmt.Errorf("git log failed: %w", err)
+	}
+
+	var docs []historyDoc
+	for _, rec := range strings.Split(string(out), "\x1e") {
+		f := strings.Split(strings.TrimSpace(rec), "\x1f")
+		if len(f) != 4 {
+			continue
+		}
+		sha, author, subject, body := f[0], f[1], f[2], strings.TrimSpace(f[3])
+		docs = append(docs, historyDoc{
+			ID:    "commit:" + sha,
+			Title: subject,
+			Text:  strings.TrimSpace(subject + "\n\n" + body + "\n\nauthor: " + author),
+		})
+	}
+	return docs, nil
+}
+
+// githubPullRequests returns the descriptions of the most recently updated
+// pull requests of repo.
+func githubPullRequests(ctx context.Context, repo string, n int) ([]historyDoc, error) {
+	var docs []historyDoc
+	for page := 1; len(docs) < n; page++ {
+		url := fmt.Sprintf("https://api.github.com/repos/%s/pulls?state=all&sort=updated&direction=desc&per_page=100&page=%d", repo, page)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := githubClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute HTTP request: %w", err)
+		}
+		var prs []struct {
+			Number int    `json:"number"`
+			Title  string `json:"title"`
+			Body   string `json:"body"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&prs)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GitHub API returned %s", resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal JSON: %w", err)
+		}
+		if len(prs) == 0 {
+			break
+		}
+
+		for _, pr := range prs {
+			if len(docs) == n {
+				break
+			}
+			docs = append(docs, historyDoc{
+				ID:    fmt.Sprintf("pr:%d", pr.Number),
+				Title: pr.Title,
+				Text:  strings.TrimSpace(pr.Title + "\n\n" + pr.Body),
+			})
+		}
+	}
+	return docs, nil
+}
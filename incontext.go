@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// inContextExclude leaves the files already in context out of results.
+	inContextExclude = "exclude"
+	// inContextDownrank ranks them below other files of similar relevance.
+	inContextDownrank = "downrank"
+	// inContextPenalty is added to the distance of files already in context
+	// when they are down-ranked.
+	inContextPenalty = 0.15
+)
+
+// contextFiles are the ids of the files an editor or agent already has in
+// its context; a directory stands for every file under it.
+type contextFiles []string
+
+// parseContextFiles returns the files of the comma-separated paths, which
+// are absolute or relative to root.
+func parseContextFiles(root string, paths ...string) contextFiles {
+	base, err := filepath.Abs(osPath(pathID(root)))
+	if err != nil {
+		base = root
+	}
+	var out contextFiles
+	for _, list := range paths {
+		for _, p := range strings.Split(list, ",") {
+			if p = strings.TrimSpace(p); p == "" {
+				continue
+			}
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(base, p)
+			}
+			out = append(out, pathID(filepath.Clean(p)))
+		}
+	}
+	return out
+}
+
+// has reports whether the file id is in context.
+func (c contextFiles) has(id string) bool {
+	for _, p := range c {
+		if id == p || strings.HasPrefix(id, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,950 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	charset "github.com/codectx/tokens/services/charset"
+	detect "github.com/codectx/tokens/services/detect"
+	embed "github.com/codectx/tokens/services/embed"
+	extract "github.com/codectx/tokens/services/extract"
+	git "github.com/codectx/tokens/services/git"
+	index "github.com/codectx/tokens/services/index"
+	lexical "github.com/codectx/tokens/services/lexical"
+	store "github.com/codectx/tokens/services/store"
+	vecfile "github.com/codectx/tokens/services/vecfile"
+	goignore "github.com/cyber-nic/go-gitignore"
+)
+
+// source lists and reads the files to index.
+type source interface {
+	// walk calls fn with the id of every file to index.
+	walk(ctx context.Context, fn func(id string)) error
+	// read returns the content of a file listed by walk.
+	read(id string) ([]byte, error)
+	// blame returns the ownership of a file listed by walk.
+	blame(ctx context.Context, id string) (git.Blame, error)
+	// shard returns the top-level directory of a file listed by walk, empty
+	// for files at the root.
+	shard(id string) string
+	// foldCase reports whether file names are case-insensitive, so ids
+	// differing only by case name the same file.
+	foldCase() bool
+	// Close releases the resources held by the source.
+	Close() error
+}
+
+// newSource returns the working tree at wd, or its git object store at the
+// revision selected by -rev. When indexing a revision without an explicit
+// namespace, the namespace defaults to rev_<sha>.
+func newSource(ctx context.Context, a *app, wd string) (source, error) {
+	if a.opts.rev == "" {
+		return &fsSource{wd: wd, ignore: a.ignore, fold: caseInsensitive(wd)}, nil
+	}
+
+	sha, err := git.ResolveRev(ctx, wd, a.opts.rev)
+	if err != nil {
+		return nil, err
+	}
+	if a.opts.namespace == "" {
+		a.opts.namespace = "rev_" + sha[:12]
+	}
+
+	prefix, err := git.Prefix(ctx, wd)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := git.NewBlobReader(ctx, wd)
+	if err != nil {
+		return nil, err
+	}
+	return &revSource{repo: wd, prefix: prefix, rev: sha, ignore: a.ignore, blobs: blobs}, nil
+}
+
+// fsSource reads files from the working tree.
+type fsSource struct {
+	wd     string
+	ignore *goignore.GitIgnore
+	fold   bool
+}
+
+// walk lists every file under wd that isn't ignored.
+func (s *fsSource) walk(ctx context.Context, fn func(id string)) error {
+	// Walk through all files in the current directory
+	return filepath.Walk(s.wd, func(path string, info os.FileInfo, err error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Skip directories
+		info, err = os.Stat(path)
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			// Don't descend into ignored directories such as node_modules/
+			if path != s.wd && s.ignore.MatchesPath(path+"/") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Skip files that match the ignore patterns
+		if s.ignore.MatchesPath(path) {
+			return nil
+		}
+
+		fn(pathID(path))
+
+		return nil
+	})
+}
+
+// read returns the content of the file at path.
+func (s *fsSource) read(path string) ([]byte, error) {
+	return os.ReadFile(osPath(path))
+}
+
+// blame runs git blame on the working tree file.
+func (s *fsSource) blame(ctx context.Context, path string) (git.Blame, error) {
+	dir, file := filepath.Split(osPath(path))
+	if dir == "" {
+		dir = "."
+	}
+	return git.BlameFile(ctx, dir, file, "")
+}
+
+// shard returns the top-level directory of path under wd.
+func (s *fsSource) shard(path string) string {
+	rel, err := filepath.Rel(s.wd, osPath(path))
+	if err != nil {
+		return ""
+	}
+	return topLevelDir(filepath.ToSlash(rel))
+}
+
+// foldCase reports whether the filesystem under wd is case-insensitive.
+func (s *fsSource) foldCase() bool {
+	return s.fold
+}
+
+// Close is a no-op.
+func (s *fsSource) Close() error {
+	return nil
+}
+
+// revSource reads files from the git object store at a fixed revision, so
+// the working tree is never touched. Ids are the repository path joined with
+// the file path, matching the ids of the working tree.
+type revSource struct {
+	repo string
+	// prefix is the path of repo in the tree of rev, when it is a
+	// subdirectory of the repository.
+	prefix string
+	rev    string
+	ignore *goignore.GitIgnore
+	blobs  *git.BlobReader
+}
+
+// walk lists every file of the revision that isn't ignored.
+func (s *revSource) walk(ctx context.Context, fn func(id string)) error {
+	paths, err := git.RevFiles(ctx, s.repo, s.rev)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := filepath.Join(s.repo, strings.TrimPrefix(p, s.prefix))
+		if s.ignore.MatchesPath(path) {
+			continue
+		}
+		fn(pathID(path))
+	}
+	return nil
+}
+
+// read returns the blob of id at the revision.
+func (s *revSource) read(id string) ([]byte, error) {
+	return s.blobs.Read(s.rev, s.prefix+s.relative(id))
+}
+
+// blame runs git blame at the revision.
+func (s *revSource) blame(ctx context.Context, id string) (git.Blame, error) {
+	return git.BlameFile(ctx, s.repo, s.relative(id), s.rev)
+}
+
+// Close stops the blob reader.
+func (s *revSource) Close() error {
+	return s.blobs.Close()
+}
+
+// shard returns the top-level directory of id in the repository.
+func (s *revSource) shard(id string) string {
+	return topLevelDir(s.relative(id))
+}
+
+// foldCase is false: git paths are case-sensitive.
+func (s *revSource) foldCase() bool {
+	return false
+}
+
+// topLevelDir returns the first directory of the slash-separated relative
+// path rel, empty for files at the root.
+func topLevelDir(rel string) string {
+	dir, _, ok := strings.Cut(rel, "/")
+	if !ok || dir == ".." {
+		return ""
+	}
+	return dir
+}
+
+// relative returns the path of id under repo.
+func (s *revSource) relative(id string) string {
+	rel, err := filepath.Rel(s.repo, osPath(id))
+	if err != nil {
+		return id
+	}
+	return filepath.ToSlash(rel)
+}
+
+// indexTree adds every file listed by src to idx, embedding only new or
+// changed files. Files are queued by priority, see priority. Summaries are
+// left to summarizeTree and summarizeHits.
+// When q is set, the distance of each file to the query is logged.
+func indexTree(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, src source, q []float32) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	// Files just opened or edited are dequeued first, the backfill of new
+	// files last
+	indexing := newQueue()
+	a.indexing.Store(indexing)
+	defer a.indexing.CompareAndSwap(indexing, nil)
+	rollBackUpdates(ctx, db, idx)
+	known := indexedFiles(ctx, db)
+	ctx = withRenameCandidates(ctx, db, src.foldCase())
+	rules := loadPathRules(ctx, db)
+
+	numWorkers := a.workers()
+
+	// create wait group for workers
+	var wg sync.WaitGroup
+
+	// create go routine workers that pop from the indexing queue to perform work
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer l.Debug("worker", "id", id, "state", "done")
+			defer wg.Done()
+
+			for {
+				path, ok := indexing.pop()
+				if !ok || ctx.Err() != nil {
+					return
+				}
+				// held back while paused or over -max-cpu
+				if err := a.throttle.wait(ctx); err != nil {
+					return
+				}
+				// a file begun is written whole, even once ctx is done
+				if err := handleAndRecord(context.WithoutCancel(ctx), a, db, idx, src, q, path); err != nil {
+					l.Error("Failed to handle file", "error", err)
+				}
+			}
+		}(i)
+	}
+
+	walkCtx, cancel := withTimeout(ctx, a.opts.walkTimeout)
+	defer cancel()
+	err := src.walk(walkCtx, func(path string) {
+		if !rules.excluded(path) {
+			indexing.push(path, priority(a, known, path))
+		}
+	})
+	if err != nil {
+		l.Error("Failed to list files", "error", err)
+	}
+
+	// Inform workers that there is no more work
+	indexing.close()
+	l.Debug("done walking the tree", "high", indexing.counts[priorityHigh], "normal", indexing.counts[priorityNormal], "low", indexing.counts[priorityLow])
+
+	// Wait for all workers to finish
+	wg.Wait()
+	if a.adaptive != nil {
+		l.Debug("done indexing", "concurrency", a.adaptive.Limit())
+	}
+	if ctx.Err() != nil {
+		l.Info("indexing interrupted, the files left are indexed by the next run")
+		return
+	}
+
+	// Retry the files that failed in earlier runs, once their backoff passed
+	if err := retryFailed(ctx, a, db, idx, src, q, false); err != nil {
+		l.Error("Failed to retry files", "error", err)
+	}
+	if paths := a.undecodable.drain(); len(paths) > 0 {
+		l.Warn("skipped undecodable files", "count", len(paths), "paths", paths, "encoding", a.opts.encoding)
+	}
+}
+
+// pruneDeleted removes the files of db that src no longer lists from db and
+// idx, records their deletion and emits a deleted event for each, and
+// returns their ids. Nothing is removed unless every file was listed.
+func pruneDeleted(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, src source) []string {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	ids, err := db.IDs(ctx)
+	if err != nil {
+		l.Error("Failed to list indexed files", "error", err)
+		return nil
+	}
+	walkCtx, cancel := withTimeout(ctx, a.opts.walkTimeout)
+	defer cancel()
+	walked := map[string]bool{}
+	if err := src.walk(walkCtx, func(path string) { walked[path] = true }); err != nil {
+		l.Error("Failed to list files, keeping those gone from the tree", "error", err)
+		return nil
+	}
+
+	var removed []string
+	for _, id := range ids {
+		if walked[id] {
+			continue
+		}
+		if err := db.Delete(ctx, id); err != nil {
+			l.Error("Failed to remove deleted file", "path", id, "error", err)
+			continue
+		}
+		idx.Delete(id)
+		recordEvent(ctx, db, store.IndexEvent{ID: id, Action: eventDeleted, Detail: "gone from the tree"})
+		a.events.publish(indexEvent{Type: "deleted", Namespace: a.opts.namespace, Path: id, Time: time.Now()})
+		removed = append(removed, id)
+	}
+	if len(removed) > 0 {
+		// their chunks, symbols and summaries go with them
+		if _, err := db.DropOrphans(ctx); err != nil {
+			l.Error("Failed to remove the rows of deleted files", "error", err)
+		}
+		l.Info("removed deleted files", "count", len(removed))
+	}
+	return removed
+}
+
+// withTimeout bounds ctx to d, or only makes it cancellable when d is zero.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// indexLexical adds the text of every file listed by src to lex, without
+// calling the embedding provider.
+func indexLexical(ctx context.Context, a *app, lex lexical.LexicalService, src source) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	paths := make(chan string, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				f, err := src.read(path)
+				if err != nil {
+					l.Error("Failed to read file", "path", path, "error", err)
+					continue
+				}
+				text, _, err := fileText(ctx, a, path, f)
+				if err != nil {
+					continue
+				}
+				if generated, _ := detect.Generated([]byte(text)); generated && a.opts.generated == generatedSkip {
+					continue
+				}
+				lex.Add(path, text)
+			}
+		}()
+	}
+
+	walkCtx, cancel := withTimeout(ctx, a.opts.walkTimeout)
+	defer cancel()
+	if err := src.walk(walkCtx, func(path string) { paths <- path }); err != nil {
+		l.Error("Failed to list files", "error", err)
+	}
+	close(paths)
+	wg.Wait()
+}
+
+// loadIndex builds an index of namespace ns from the vectors file set by
+// -vectors when it was exported from ns, else from every embedding stored in
+// the database. Sharded indexes build their shards in parallel.
+func loadIndex(ctx context.Context, a *app, ns string) (index.IndexService, error) {
+	db, err := a.store(ns)
+	if err != nil {
+		return nil, err
+	}
+	return loadIndexFrom(ctx, a, db, ns)
+}
+
+// loadIndexFrom is loadIndex reading the embeddings of namespace ns from db.
+func loadIndexFrom(ctx context.Context, a *app, db store.StorageService, ns string) (index.IndexService, error) {
+	var entries []vecfile.Entry
+	if a.vectors != nil && a.vectors.Namespace() == ns {
+		entries = make([]vecfile.Entry, a.vectors.Len())
+		for i := range entries {
+			entries[i] = vecfile.Entry{ID: a.vectors.ID(i), Shard: a.vectors.Shard(i), Vector: a.vectors.Vector(i)}
+		}
+	} else {
+		all, err := db.GetAll(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Vectors of another model don't compare to those of the query
+		other := 0
+		for id, e := range all {
+			if e.Model != "" && a.space != "" && e.Model != a.space {
+				other++
+				continue
+			}
+			entries = append(entries, vecfile.Entry{ID: id, Shard: e.Shard, Vector: e.Vector})
+		}
+		if other > 0 {
+			l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+			l.Warn("left out vectors of another model", "index", displayName(ns), "files", other, "model", a.space)
+		}
+	}
+
+	// in id order, so that equally close files rank the same every time
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	shards := map[string][]vecfile.Entry{}
+	owner := make(map[string]string, len(entries))
+	for _, e := range entries {
+		shards[e.Shard] = append(shards[e.Shard], e)
+		owner[e.ID] = e.Shard
+	}
+
+	dims := 0
+	if len(entries) > 0 {
+		dims = len(entries[0].Vector)
+	}
+	idx := a.newIndex(ctx, func(id string) string { return owner[id] }, len(entries), dims)
+	if !a.opts.shard {
+		for _, e := range entries {
+			idx.Add(e.ID, e.Vector)
+		}
+		return idx, nil
+	}
+
+	var wg sync.WaitGroup
+	for _, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, e := range shard {
+				idx.Add(e.ID, e.Vector)
+			}
+		}()
+	}
+	wg.Wait()
+	return idx, nil
+}
+
+// blameFile returns the blame of path, empty when the file isn't tracked by
+// git or git is unavailable.
+func blameFile(ctx context.Context, src source, path string) git.Blame {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	b, err := src.blame(ctx, path)
+	if err != nil {
+		l.Debug("Failed to blame file", "path", path, "error", err)
+		return git.Blame{}
+	}
+	return b
+}
+
+// fileText returns the text to embed for the content f of path: the output of
+// its extractor, else f transcoded to UTF-8 according to -encoding. It fails
+// with charset.ErrUndecodable when f isn't text in that encoding.
+func fileText(ctx context.Context, a *app, path string, f []byte) (string, bool, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	text, extracted, err := extract.Text(path, f)
+	if err != nil {
+		l.Debug("Failed to extract text, embedding raw content", "path", path, "error", err)
+	}
+	if extracted {
+		return text, true, nil
+	}
+	b, enc, err := charset.Decode(f, a.opts.encoding, a.opts.fallbackEncoding)
+	if err != nil {
+		return "", false, err
+	}
+	if enc != "utf-8" {
+		l.Debug("transcoded", "path", path, "encoding", enc)
+	}
+	return string(b), false, nil
+}
+
+// embedText embeds text, of the file at path detected as language, once
+// rewritten by the -preprocess and -normalize pipeline. Warnings of the text
+// cut to fit -max-input-tokens name the file.
+func (a *app) embedText(ctx context.Context, path, language, text string) ([]float32, embed.Meta, error) {
+	t, err := a.preprocess.Process(path, language, text)
+	if err != nil {
+		return nil, embed.Meta{}, fmt.Errorf("failed to preprocess %s: %w", path, err)
+	}
+	if l, ok := ctx.Value(LoggerCtxKey).(*slog.Logger); ok {
+		ctx = context.WithValue(ctx, LoggerCtxKey, l.With("path", path))
+	}
+	return a.emb.Get(ctx, t)
+}
+
+// embedQuery embeds query, once stripped of its boilerplate by -clean-query,
+// as a query for providers embedding queries apart from documents.
+func (a *app) embedQuery(ctx context.Context, query string) ([]float32, embed.Meta, error) {
+	return a.emb.Get(embed.AsQuery(ctx), a.cleaner.Clean(query))
+}
+
+// readText returns the text of the indexed file id, as fileText gives it.
+func readText(ctx context.Context, a *app, src source, id string) (string, error) {
+	f, err := src.read(id)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", id, err)
+	}
+	text, _, err := fileText(ctx, a, id, f)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", id, err)
+	}
+	return text, nil
+}
+
+// skipped collects the paths of files left out of an indexing run.
+type skipped struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+// add records path.
+func (s *skipped) add(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paths = append(s.paths, path)
+}
+
+// drain returns the recorded paths, sorted, and forgets them.
+func (s *skipped) drain() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := s.paths
+	s.paths = nil
+	sort.Strings(paths)
+	return paths
+}
+
+// moveAliases drops the rows of the file at path stored under another
+// spelling of its id: with backslashes, as indexed on Windows before ids were
+// normalized, or with another case on case-insensitive filesystems. The rows
+// of one with the same hash, in every table, are moved to path instead, and
+// true is returned, so the file isn't embedded again.
+func moveAliases(ctx context.Context, db store.StorageService, idx index.IndexService, src source, path, hash string) (bool, error) {
+	ids, err := aliasIDs(ctx, db, src, path)
+	if err != nil {
+		return false, err
+	}
+	moved := false
+	for _, id := range ids {
+		forgetAlias(ctx, id)
+		idx.Delete(id)
+		if !moved {
+			match, err := db.MatchHash(ctx, id, hash)
+			if err != nil {
+				return false, err
+			}
+			if match {
+				if err := db.Rename(ctx, id, path); err != nil {
+					return false, err
+				}
+				forgetRenamed(ctx, hash, id)
+				moved = true
+				continue
+			}
+		}
+		if err := db.Delete(ctx, id); err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// aliasKey is the id of a file that its aliases share: with slashes, and in
+// lower case when fold is set.
+func aliasKey(id string, fold bool) string {
+	id = strings.ReplaceAll(id, `\`, "/")
+	if fold {
+		id = strings.ToLower(id)
+	}
+	return id
+}
+
+// aliasIDs returns the ids the file at path is stored under besides path,
+// from the candidates of the pass when there are some, else from db.
+func aliasIDs(ctx context.Context, db store.StorageService, src source, path string) ([]string, error) {
+	c, ok := ctx.Value(renamesCtxKey).(*renameCandidates)
+	if !ok {
+		aliases, err := db.Aliases(ctx, path, src.foldCase())
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]string, len(aliases))
+		for i, e := range aliases {
+			ids[i] = e.ID
+		}
+		return ids, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.DeleteFunc(slices.Clone(c.aliases[aliasKey(path, c.fold)]), func(id string) bool { return id == path }), nil
+}
+
+// forgetAlias drops id from the aliases of the pass once it is moved or
+// deleted.
+func forgetAlias(ctx context.Context, id string) {
+	if c, ok := ctx.Value(renamesCtxKey).(*renameCandidates); ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		key := aliasKey(id, c.fold)
+		c.aliases[key] = slices.DeleteFunc(c.aliases[key], func(s string) bool { return s == id })
+	}
+}
+
+// renameCandidates are the ids stored when an indexing pass starts, by the
+// hash of their content. Files renamed during the pass are found among them
+// rather than by a query per new file, which scans the whole table. Their
+// aliases are found the same way, among the ids by aliasKey.
+type renameCandidates struct {
+	mu  sync.Mutex
+	ids map[string][]string
+	// aliases holds the ids by aliasKey, those that other spellings of a
+	// path may be stored under: every id when fold is set, else those with
+	// backslashes.
+	aliases map[string][]string
+	fold    bool
+}
+
+// renamesCtxKey holds the renameCandidates of the current indexing pass.
+const renamesCtxKey ContextKey = "renames"
+
+// withRenameCandidates returns ctx carrying the ids stored in db by hash,
+// and by aliasKey for a source folding case when fold is set, or ctx itself
+// when they can't be listed.
+func withRenameCandidates(ctx context.Context, db store.StorageService, fold bool) context.Context {
+	ids, err := db.Hashes(ctx)
+	if err != nil {
+		ctx.Value(LoggerCtxKey).(*slog.Logger).Warn("Failed to list stored hashes, renames are looked up per file", "error", err)
+		return ctx
+	}
+	aliases := map[string][]string{}
+	for _, group := range ids {
+		for _, id := range group {
+			if fold || strings.Contains(id, `\`) {
+				key := aliasKey(id, fold)
+				aliases[key] = append(aliases[key], id)
+			}
+		}
+	}
+	return context.WithValue(ctx, renamesCtxKey, &renameCandidates{ids: ids, aliases: aliases, fold: fold})
+}
+
+// hashIDs returns the ids stored with hash, from the candidates of the pass
+// when there are some, else from db.
+func hashIDs(ctx context.Context, db store.StorageService, hash string) ([]string, error) {
+	c, ok := ctx.Value(renamesCtxKey).(*renameCandidates)
+	if !ok {
+		return db.HashIDs(ctx, hash)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.ids[hash]), nil
+}
+
+// forgetRenamed drops id from the candidates of the pass once it is moved.
+func forgetRenamed(ctx context.Context, hash, id string) {
+	if c, ok := ctx.Value(renamesCtxKey).(*renameCandidates); ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.ids[hash] = slices.DeleteFunc(c.ids[hash], func(s string) bool { return s == id })
+	}
+}
+
+// moveRenamed moves to path the rows of a file renamed to it: those stored
+// with the same hash under an id gone from src. It returns true when it
+// found one, so the file isn't embedded again and its chunks keep their
+// vectors. Files still on disk are copies, embedded on their own.
+func moveRenamed(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, src source, path, hash string) (bool, error) {
+	ids, err := hashIDs(ctx, db, hash)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		if id == path {
+			continue
+		}
+		if _, err := src.read(id); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := db.Rename(ctx, id, path); err != nil {
+			return false, err
+		}
+		forgetRenamed(ctx, hash, id)
+		idx.Delete(id)
+		recordEvent(ctx, db, store.IndexEvent{ID: path, Action: eventRenamed, Provider: a.space, Hash: hash, Detail: "from " + id})
+		a.events.publish(indexEvent{Type: "renamed", Namespace: a.opts.namespace, Path: path, From: id, Time: time.Now()})
+		// another worker may have moved the same row to a copy first
+		return db.MatchHash(ctx, path, hash)
+	}
+	return false, nil
+}
+
+// handleFile reads the file at the given path, computes its hash, and embeds its content.
+func handleFile(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, src source, q []float32, path string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+	start := time.Now()
+
+	// read file content
+	f, err := src.read(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+
+	// Extract meaningful text from structured formats such as notebooks,
+	// else transcode the content to UTF-8
+	text, extracted, err := fileText(ctx, a, path, f)
+	if err != nil {
+		l.Debug("skip undecodable", "path", path, "error", err)
+		a.undecodable.add(path)
+		recordEvent(ctx, db, store.IndexEvent{ID: path, Action: eventSkipped, Duration: time.Since(start), Hash: computeHash(f), Detail: "undecodable: " + err.Error()})
+		if err := db.Delete(ctx, path); err != nil {
+			l.Error("Failed to delete embedding", "error", err)
+		}
+		return nil
+	}
+
+	// Skip generated and minified files unless configured otherwise
+	generated, reason := detect.Generated([]byte(text))
+	if generated && a.opts.generated == generatedSkip {
+		l.Debug("skip generated", "path", path, "reason", reason)
+		recordEvent(ctx, db, store.IndexEvent{ID: path, Action: eventSkipped, Duration: time.Since(start), Hash: computeHash(f), Detail: "generated: " + reason})
+		if err := db.Delete(ctx, path); err != nil {
+			l.Error("Failed to delete embedding", "error", err)
+		}
+		return nil
+	}
+
+	// Compute content hash
+	hash := computeHash(f)
+
+	// Determine if file has changed
+	match, err := db.MatchHash(ctx, path, hash)
+	if err != nil {
+		l.Error("Failed to compare hash", "error", err)
+		return nil
+	}
+	if !match {
+		// The file may be stored under another spelling of its path
+		if match, err = moveAliases(ctx, db, idx, src, path, hash); err != nil {
+			return queueRetry(ctx, db, path, fmt.Errorf("failed to move embedding: %w", err))
+		}
+	}
+	if !match {
+		// The file may have been renamed since it was indexed
+		if match, err = moveRenamed(ctx, a, db, idx, src, path, hash); err != nil {
+			return queueRetry(ctx, db, path, fmt.Errorf("failed to move renamed embedding: %w", err))
+		}
+	}
+
+	// If hash is the same, file has not changed, unless it is re-embedded
+	// anyway
+	if match && ctx.Value(ForceCtxKey) == nil {
+		// get from db
+		b, err := db.Get(ctx, []string{path})
+		if err != nil {
+			l.Error("Failed to get embedding", "error", err)
+			return nil
+		}
+		// Add to graph
+		idx.Add(path, b[0].Vector)
+
+		// Backfill blame, shard, language and model metadata for rows indexed
+		// without it. Blame is only attempted once, as it finds nothing
+		// when git is unavailable or the file isn't committed.
+		e := b[0]
+		backfill := false
+		var blame *git.Blame
+		if a.opts.blame && !e.Blamed {
+			fb := blameFile(ctx, src, path)
+			blame = &fb
+			e.Author, e.LastCommit, e.Blamed = fb.Author, fb.LastCommit, true
+			if err := blameChunks(ctx, db, path, fb); err != nil {
+				l.Error("Failed to blame chunks", "error", err)
+			}
+			backfill = true
+		}
+		if shard := src.shard(path); e.Shard != shard {
+			e.Shard = shard
+			backfill = true
+		}
+		if lang := detect.Language(path, []byte(text)); e.Language != lang {
+			e.Language = lang
+			backfill = true
+		}
+		if e.Model == "" && a.space != "" {
+			e.Model = a.space
+			backfill = true
+		}
+		if backfill {
+			if err := db.Upsert(ctx, e); err != nil {
+				l.Error("Failed to update embedding", "error", err)
+			}
+		}
+		if err := recordSymbols(ctx, db, path, hash, e.Language, text); err != nil {
+			l.Error("Failed to record symbols", "error", err)
+		}
+		if a.opts.docWeight > 0 {
+			if err := recordDocs(ctx, a, db, path, e.Language, text); err != nil {
+				l.Error("Failed to embed comments", "error", err)
+			}
+		}
+		if a.opts.multiVectorWeight > 0 {
+			if err := recordMultiVectors(ctx, a, db, path, e.Language, text); err != nil {
+				l.Error("Failed to embed segments", "error", err)
+			}
+		}
+		if a.sparse != nil {
+			if err := recordSparse(ctx, a, db, path, e.Language, text); err != nil {
+				l.Error("Failed to encode sparse vector", "error", err)
+			}
+		}
+		// Record the chunks of files indexed without them, so that their
+		// next change is diffed
+		if hashes, err := db.ChunkHashes(ctx, path); err == nil && len(hashes) == 0 {
+			if _, err := recordChunks(ctx, db, path, chunkFile(path, e.Language, text, a.declarations(ctx, path, e.Language, text)), blame); err != nil {
+				l.Error("Failed to record chunks", "error", err)
+			}
+		}
+
+		// Skip
+		if q != nil {
+			d1, d2, _ := getDistance(q, b[0].Vector)
+			l.Debug("match", "path", path, "d1", d1, "d2", d2)
+		}
+		return nil
+	}
+
+	// Failures are recorded in the history of the file, then retried. They
+	// happen before its row is written with the new hash, so its former rows
+	// are kept, and out of date with the file until the retry.
+	fail := func(err error) error {
+		if end := db.EndUpdate(ctx, path); end != nil {
+			l.Error("Failed to end update", "error", end)
+		}
+		recordEvent(ctx, db, store.IndexEvent{ID: path, Action: eventFailed, Duration: time.Since(start), Provider: a.space, Hash: hash, Detail: err.Error()})
+		return queueRetry(ctx, db, path, err)
+	}
+
+	// Journal the rewrite of the rows of the file, rolled back by the next
+	// run unless it ends
+	if err := db.BeginUpdate(ctx, path, hash); err != nil {
+		return fail(err)
+	}
+
+	// Embed, only the changed chunks of files embedded by chunk
+	language := detect.Language(path, []byte(text))
+	chunks := chunkFile(path, language, text, a.declarations(ctx, path, language, text))
+	var (
+		vec  []float32
+		meta embed.Meta
+	)
+	if a.opts.windowed {
+		vec, meta, err = embedWindowed(ctx, a, db, path, language, text, chunks)
+	} else {
+		vec, meta, err = a.embedText(ctx, path, language, text)
+	}
+	// vec, meta, err := emb.Voyage(vKey, string(f))
+	if err != nil {
+		return fail(err)
+	}
+
+	// Upsert
+	e := store.Embedding{ID: path, Hash: hash, Vector: vec, Generated: generated, Shard: src.shard(path), Language: language, Model: a.space}
+	var blame *git.Blame
+	if a.opts.blame {
+		fb := blameFile(ctx, src, path)
+		blame = &fb
+		e.Author, e.LastCommit, e.Blamed = fb.Author, fb.LastCommit, true
+	}
+	if err := db.Upsert(ctx, e); err != nil {
+		return fail(fmt.Errorf("failed to create embedding: %w", err))
+	}
+
+	if err := recordSymbols(ctx, db, path, hash, e.Language, text); err != nil {
+		l.Error("Failed to record symbols", "error", err)
+	}
+	if a.opts.docWeight > 0 {
+		if err := recordDocs(ctx, a, db, path, e.Language, text); err != nil {
+			l.Error("Failed to embed comments", "error", err)
+		}
+	}
+	if a.opts.multiVectorWeight > 0 {
+		if err := recordMultiVectors(ctx, a, db, path, e.Language, text); err != nil {
+			l.Error("Failed to embed segments", "error", err)
+		}
+	}
+	if a.sparse != nil {
+		if err := recordSparse(ctx, a, db, path, e.Language, text); err != nil {
+			l.Error("Failed to encode sparse vector", "error", err)
+		}
+	}
+	ev := indexEvent{Type: "indexed", Namespace: a.opts.namespace, Path: path, Time: time.Now()}
+	diff, err := recordChunks(ctx, db, path, chunks, blame)
+	if err != nil {
+		l.Error("Failed to record chunks", "error", err)
+	} else {
+		ev.Chunks = &diff
+	}
+
+	// Add to graph
+	idx.Add(path, vec)
+	if err := db.EndUpdate(ctx, path); err != nil {
+		l.Error("Failed to end update", "error", err)
+	}
+	a.events.publish(ev)
+	embedded := store.IndexEvent{ID: path, Action: eventEmbedded, Duration: time.Since(start), Tokens: meta.Tokens, Provider: a.space, Hash: hash}
+	switch {
+	case meta.ProviderName == "cache":
+		embedded.Detail = "from -embed-cache"
+	case ctx.Value(ForceCtxKey) != nil:
+		embedded.Detail = "forced"
+	}
+	recordEvent(ctx, db, embedded)
+
+	attrs := []any{"path", path, "extracted", extracted, "emb_ms", meta.Duration, "tokens", meta.Tokens, "total_ms", time.Since(start).Milliseconds(),
+		"added", len(diff.Added), "removed", len(diff.Removed), "modified", len(diff.Modified), "moved", diff.Moved}
+	if q != nil {
+		d1, d2, _ := getDistance(q, vec)
+		attrs = append(attrs, "d1", d1, "d2", d2)
+	}
+	l.Debug("diff", attrs...)
+	return nil
+}
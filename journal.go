@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// processStart is when this process started. Updates journaled since are
+// its own, in progress or failed and kept, never left by a crash.
+var processStart = time.Now()
+
+// rollBackUpdates drops the rows of the files whose update was journaled and
+// never ended, such as when the process crashed between writing the vector
+// of a file and its chunks, and removes them from idx. Their stored hash
+// could otherwise match the content on disk and keep the rest of their rows
+// stale. The walk that follows indexes them from scratch, so that the graph,
+// built from the rows, never holds a vector the database doesn't. Only the
+// updates begun before this process started are rolled back: the others may
+// be in progress, by a reindex or another pass.
+func rollBackUpdates(ctx context.Context, db store.StorageService, idx index.IndexService) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	unfinished, err := db.Unfinished(ctx)
+	if err != nil {
+		l.Error("Failed to read the journal", "error", err)
+		return
+	}
+	for _, e := range unfinished {
+		if !e.Started.Before(processStart) {
+			continue
+		}
+		if err := rollBackUpdate(ctx, db, e.ID); err != nil {
+			l.Error("Failed to roll back update", "path", e.ID, "error", err)
+			continue
+		}
+		idx.Delete(e.ID)
+		l.Warn("rolled back unfinished update", "path", e.ID, "started", e.Started)
+		recordEvent(ctx, db, store.IndexEvent{ID: e.ID, Action: eventRolledBack, Hash: e.Hash,
+			Detail: "update begun " + e.Started.Format("2006-01-02 15:04:05") + " never ended"})
+	}
+}
+
+// rollBackUpdate forgets the file id, then removes it from the journal.
+func rollBackUpdate(ctx context.Context, db store.StorageService, id string) error {
+	if err := forgetFile(ctx, db, id); err != nil {
+		return err
+	}
+	return db.EndUpdate(ctx, id)
+}
+
+// forgetFile drops the vector and chunks of the file id and its modification
+// time, so that the next run, -fresh included, indexes it from scratch.
+// Symbols and comments are recorded with the hash of their content, and
+// replaced when the file is indexed again.
+func forgetFile(ctx context.Context, db store.StorageService, id string) error {
+	if err := db.Delete(ctx, id); err != nil {
+		return err
+	}
+	if err := db.ReplaceChunks(ctx, id, nil); err != nil {
+		return err
+	}
+	hashes, err := db.ChunkHashes(ctx, id)
+	if err != nil {
+		return err
+	}
+	if len(hashes) > 0 {
+		keys := make([]string, len(hashes))
+		for i, h := range hashes {
+			keys[i] = h.Key
+		}
+		if err := db.UpdateChunkHashes(ctx, id, keys, nil); err != nil {
+			return err
+		}
+	}
+	return db.SetModTime(ctx, id, time.Time{})
+}
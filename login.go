@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	secrets "github.com/codectx/tokens/services/secrets"
+	"golang.org/x/term"
+)
+
+// keyedProviders are the embedding providers that need an API key.
+var keyedProviders = []string{"voyage"}
+
+// runAuth stores the API keys of embedding providers in the OS keyring, or
+// references to them in a password manager, so they don't need to be set in
+// the environment.
+func runAuth(ctx context.Context, args []string) error {
+	fs := newFlagSet("auth")
+	ref := fs.String("ref", "", "with login, read the key from this password manager entry instead of storing it: op://vault/item/field or pass:path")
+	fs.Parse(args)
+
+	switch action := fs.Arg(0); action {
+	case "login":
+		if fs.NArg() != 2 {
+			return fmt.Errorf("usage: auth [-ref REF] login PROVIDER")
+		}
+		return login(fs.Arg(1), *ref)
+	case "logout":
+		if fs.NArg() != 2 {
+			return fmt.Errorf("usage: auth logout PROVIDER")
+		}
+		if err := secrets.Remove(fs.Arg(1)); err != nil {
+			return err
+		}
+		fmt.Printf("removed the %s key from the keyring\n", fs.Arg(1))
+		return nil
+	case "status":
+		providers := fs.Args()[1:]
+		if len(providers) == 0 {
+			providers = keyedProviders
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PROVIDER\tKEY")
+		for _, p := range providers {
+			fmt.Fprintf(w, "%s\t%s\n", p, keySource(p))
+		}
+		return w.Flush()
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+// login stores the key of provider in the keyring: ref when set, after
+// checking that it can be read, else the key read from stdin.
+func login(provider, ref string) error {
+	value := ref
+	if ref != "" {
+		if !secrets.IsReference(ref) {
+			return fmt.Errorf("invalid -ref %q: use op://vault/item/field or pass:path", ref)
+		}
+		if _, err := secrets.Resolve(ref); err != nil {
+			return err
+		}
+	} else {
+		key, err := readKey(fmt.Sprintf("%s API key: ", provider))
+		if err != nil {
+			return err
+		}
+		value = key
+	}
+	if value == "" {
+		return errors.New("no key given")
+	}
+
+	if err := secrets.Store(provider, value); err != nil {
+		return err
+	}
+	fmt.Printf("stored the %s key in the keyring\n", provider)
+	return nil
+}
+
+// readKey reads a line from stdin, prompting without echo when it is a
+// terminal.
+func readKey(prompt string) (string, error) {
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		key, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read key: %w", err)
+		}
+		return strings.TrimSpace(string(key)), nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read key: %w", err)
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// keySource describes where the key of provider is read from, in the order
+// embed.APIKey looks.
+func keySource(provider string) string {
+	env := strings.ToUpper(provider) + "_API_KEY"
+	switch {
+	case os.Getenv(env) != "":
+		return "$" + env
+	case os.Getenv(env+"_FILE") != "":
+		return "$" + env + "_FILE"
+	}
+	source, err := secrets.Source(provider)
+	if err != nil {
+		return "none"
+	}
+	return source
+}
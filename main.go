@@ -7,22 +7,35 @@ import (
 	"crypto/md5"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	charset "github.com/codectx/tokens/services/charset"
+	crypt "github.com/codectx/tokens/services/crypt"
 	embed "github.com/codectx/tokens/services/embed"
+	ignore "github.com/codectx/tokens/services/ignore"
+	index "github.com/codectx/tokens/services/index"
+	lexical "github.com/codectx/tokens/services/lexical"
+	normalize "github.com/codectx/tokens/services/normalize"
+	plugin "github.com/codectx/tokens/services/plugin"
+	preprocess "github.com/codectx/tokens/services/preprocess"
 	store "github.com/codectx/tokens/services/store"
+	summary "github.com/codectx/tokens/services/summary"
+	vcache "github.com/codectx/tokens/services/vcache"
+	vecfile "github.com/codectx/tokens/services/vecfile"
 	goignore "github.com/cyber-nic/go-gitignore"
 	ollama "github.com/ollama/ollama/api"
-
-	"github.com/coder/hnsw"
-	"github.com/sugarme/tokenizer"
-	"github.com/sugarme/tokenizer/pretrained"
 )
 
 // ContextKey is an alias for string type
@@ -31,26 +44,288 @@ type ContextKey string
 const (
 	// LoggerCtxKey is the string used to extract logger
 	LoggerCtxKey ContextKey = "logger"
+	// ForceCtxKey is set to re-embed files even when they are unchanged
+	ForceCtxKey ContextKey = "force"
 )
 
+// commands maps subcommand names to their entry points. Without a
+// subcommand the tree is indexed and queried. It is set by init, since help
+// and completion look commands up from within them.
+var commands map[string]func(ctx context.Context, args []string) error
+
+func init() {
+	commands = map[string]func(ctx context.Context, args []string) error{
+		"serve":          runServe,
+		"pause":          runPause,
+		"resume":         runResume,
+		"reload":         runReload,
+		"index-history":  runIndexHistory,
+		"history":        runFileHistory,
+		"pin":            runPin,
+		"exclude":        runExclude,
+		"indexes":        runIndexes,
+		"compare":        runCompare,
+		"ab":             runAB,
+		"retry-failed":   runRetryFailed,
+		"fsck":           runFsck,
+		"compact":        runCompact,
+		"backup":         runBackup,
+		"restore":        runRestore,
+		"coordinate":     runCoordinate,
+		"work":           runWork,
+		"embedder":       runEmbedder,
+		"queries":        runQueries,
+		"golden":         runGolden,
+		"export-vectors": runExportVectors,
+		"export-graph":   runExportGraph,
+		"cluster":        runCluster,
+		"dupes":          runDupes,
+		"outliers":       runOutliers,
+		"push":           runPush,
+		"pull":           runPull,
+		"feedback":       runFeedback,
+		"stats":          runStats,
+		"auth":           runAuth,
+		"completion":     runCompletion,
+		"config":         runConfig,
+		"tui":            runTUI,
+		"fetch":          runFetch,
+		"def":            runDef,
+		"refs":           runRefs,
+		completeCommand:  runComplete,
+	}
+}
+
 func main() {
 	begin := time.Now()
 
-	mu := sync.Mutex{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := newLogger(os.Stdout)
+	ctx = context.WithValue(ctx, LoggerCtxKey, l)
+
+	// Subcommands
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(ctx, os.Args[2:]); err != nil {
+				l.Error("Command failed", "command", os.Args[1], "error", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fs := newFlagSet("")
+	o := &options{}
+	o.register(fs)
+	fs.Parse(os.Args[1:])
 
-	wd, query, err := getWorkingDirAndQuery(os.Args)
+	if err := o.validate(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if o.json {
+		// keep stdout for the JSON output
+		l = newLogger(os.Stderr)
+		ctx = context.WithValue(ctx, LoggerCtxKey, l)
+	}
+
+	wd, query, err := getWorkingDirAndQuery(append([]string{os.Args[0]}, fs.Args()...))
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 	slog.Debug("begin", "path", wd, "query", query)
+	pq, err := parseQuery(query)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	a, err := newApp(ctx, o)
+	if err != nil {
+		l.Error("Failed to setup", "error", err)
+		os.Exit(1)
+	}
+	defer a.Close()
+
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		l.Error("Failed to open source", "error", err)
+		os.Exit(1)
+	}
+	defer src.Close()
 
+	db, err := a.store(o.namespace)
+	if err != nil {
+		l.Error("Failed to open the index", "error", err)
+		os.Exit(1)
+	}
+
+	// Search
+	mode := o.mode
+	var q []float32
+	if mode != modeLexical {
+		q, _, err = a.embedQuery(ctx, pq.Text)
+		// q, _, err := a.emb.Voyage(vKey, query)
+		if err != nil && mode == modeVector {
+			l.Error("Failed to embed query", "error", err)
+			return
+		}
+		if err != nil {
+			l.Warn("embedding provider unavailable, falling back to lexical search", "error", err)
+			mode = modeLexical
+		} else {
+			mode = modeVector
+		}
+	}
+	// the negative query only weighs on vector ranking
+	var not []float32
+	if mode == modeVector && o.not != "" {
+		if not, _, err = a.embedQuery(ctx, o.not); err != nil {
+			l.Error("Failed to embed the -not query", "error", err)
+			return
+		}
+	}
+
+	var neighbors []hit
+	req := searchRequest{Query: query, Vector: q, K: 1, Author: o.author, Languages: o.languages(), Tests: o.tests, Root: wd,
+		InContext: parseContextFiles(wd, o.inContext), InContextMode: o.inContextMode, Src: src, Not: not}
+	// valid, it was just validated
+	req.Grep, _ = parseGrep(o.grep)
+	pq.apply(&req)
+	if o.byDir {
+		req.K = defaultTopK * dirCandidates
+	}
+	req.K = max(req.K, o.open)
+	if o.copy || o.json {
+		req.K = max(req.K, defaultTopK)
+	}
+	if mode == modeLexical {
+		lex := lexical.NewLexicalService()
+		indexLexical(ctx, a, lex, src)
+		neighbors, err = searchLexical(ctx, a, db, lex, req)
+	} else {
+		var idx index.IndexService
+		if a.readOnly || o.noWalk {
+			// nothing can or should be re-embedded, search what is stored
+			idx, err = loadIndex(ctx, a, o.namespace)
+		} else if o.fresh > 0 {
+			// only re-check the files modified since they were indexed
+			if idx, err = loadIndex(ctx, a, o.namespace); err == nil {
+				refreshChanged(ctx, a, db, idx, src, q, o.fresh)
+			}
+		} else {
+			idx = a.newIndex(ctx, src.shard, storedFiles(ctx, a, o.namespace), len(q))
+			a.opened.add(req.InContext)
+			indexTree(ctx, a, db, idx, src, q)
+		}
+		if o.lexicalWeight > 0 {
+			req.Lex = lexical.NewLexicalService()
+			indexLexical(ctx, a, req.Lex, src)
+		}
+		if err == nil {
+			neighbors, err = searchIndex(ctx, a, db, idx, req)
+		}
+	}
+	if err != nil {
+		l.Error("Failed to search", "error", err)
+		return
+	}
+	if o.tests == testsPair {
+		if err := pairTests(ctx, a, db, src, wd, neighbors); err != nil {
+			l.Warn("Failed to pair tests", "error", err)
+		}
+	}
+
+	// Log the query so that its results can be given feedback, unless
+	// the database is read-only. Its id is that of its text, which its
+	// votes are looked up by whatever the filters.
+	qid := queryID(pq.Text)
+	if !a.readOnly {
+		if err := db.LogQuery(ctx, qid, query); err != nil {
+			l.Warn("Failed to log query", "error", err)
+		}
+	}
+	l.Info("query", "id", qid, "query", query)
+
+	// Summarize the files returned once they are displayed, rather than
+	// the whole tree before answering
+	if a.summaries != nil && !a.readOnly {
+		defer summarizeHits(ctx, a, db, src, neighbors)
+	}
+
+	// Display
+	if o.json {
+		results, err := agentResults(ctx, a, db, src, pq.Text, pq.Filters.Kinds, req.Grep, neighbors)
+		if err != nil {
+			l.Error("Failed to read results", "error", err)
+			os.Exit(1)
+		}
+		json.NewEncoder(os.Stdout).Encode(agentSearch{Schema: searchSchema, Query: query, QueryID: qid, Mode: mode, Results: results})
+		return
+	}
+	if o.byDir {
+		for _, d := range aggregateDirs(neighbors, wd, o.depth, defaultTopK) {
+			l.Info("directory", "mode", mode, "dir", d.Dir, "relevance", d.Relevance, "files", d.Files, "top", d.Top)
+		}
+		fmt.Println(time.Since(begin).Milliseconds())
+		return
+	}
+	for _, n := range neighbors {
+		attrs := []any{"mode", mode, "path", n.ID}
+		if mode == modeLexical {
+			attrs = append(attrs, "bm25", n.Lexical)
+		} else {
+			d1, d2, d3 := getDistance(q, n.Vector)
+			attrs = append(attrs, "d1", d1, "d2", d2, "d3", d3)
+		}
+		attrs = append(attrs, "score", n.Score)
+		if n.Meta.Language != "" {
+			attrs = append(attrs, "lang", n.Meta.Language)
+		}
+		if n.Meta.Author != "" {
+			attrs = append(attrs, "author", n.Meta.Author, "commit", n.Meta.LastCommit)
+		}
+		if len(n.Tests) > 0 {
+			attrs = append(attrs, "tests", n.Tests)
+		}
+		l.Info("neighbour", attrs...)
+	}
+	if o.explain {
+		printExplanations(os.Stdout, neighbors)
+	}
+	if o.copy {
+		dest := "clipboard"
+		if o.copyFile != "" {
+			dest = o.copyFile
+		}
+		if err := copyContext(ctx, a, src, wd, pq.Text, neighbors, o.copyFile, o.copyLines); err != nil {
+			l.Error("Failed to copy results", "error", err)
+		} else {
+			l.Info("copied results", "files", len(neighbors), "to", dest)
+		}
+	}
+	if o.open > 0 {
+		if o.open > len(neighbors) {
+			l.Error("Failed to open result", "n", o.open, "results", len(neighbors))
+		} else if err := openHit(ctx, a, src, neighbors[o.open-1], pq.Text); err != nil {
+			l.Error("Failed to open result", "error", err)
+		}
+	}
+
+	fmt.Println(time.Since(begin).Milliseconds())
+}
+
+// logLevel is the minimum level of the lines logged, set by -log-level.
+var logLevel = new(slog.LevelVar)
+
+// newLogger returns the text logger shared by all commands, writing to w.
+func newLogger(w io.Writer) *slog.Logger {
 	opts := &slog.HandlerOptions{
 		AddSource: true,
-		// Level:     slog.LevelDebug,
+		Level:     logLevel,
 		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
 			if a.Key == slog.TimeKey {
 				a.Key = "ts"
@@ -65,10 +340,440 @@ func main() {
 			return a
 		},
 	}
-	handler := slog.NewTextHandler(os.Stdout, opts)
-	l := slog.New(handler)
+	handler := slog.NewTextHandler(w, opts)
+	return slog.New(handler)
+}
 
-	ctx = context.WithValue(ctx, LoggerCtxKey, l)
+// options holds the flags shared by every command.
+type options struct {
+	namespace        string
+	noDefaultIgnores bool
+	generated        string
+	blame            bool
+	windowed         bool
+	normalize        string
+	preprocess       string
+	chunker          string
+	reranker         string
+	sandbox          bool
+	deterministic    bool
+	author           string
+	rev              string
+	embedTimeout     time.Duration
+	dbTimeout        time.Duration
+	walkTimeout      time.Duration
+	breakerFailures  int
+	breakerCooldown  time.Duration
+	workers          int
+	maxWorkers       int
+	maxCPU           float64
+	maxEmbedsPerMin  int
+	ollamaHosts      string
+	provider         string
+	mode             string
+	explain          bool
+	byDir            bool
+	open             int
+	copy             bool
+	copyFile         string
+	copyLines        int
+	json             bool
+	depth            int
+	db               string
+	readOnly         bool
+	remote           string
+	remoteTTL        time.Duration
+	shard            bool
+	vectors          string
+	f16              bool
+	exact            bool
+	flatLimit        int
+	engine           string
+	memoryLimit      byteSize
+	latencyTarget    time.Duration
+	noWalk           bool
+	fresh            time.Duration
+	pathWeight       float64
+	lexicalWeight    float64
+	docWeight        float64
+	cleanQuery       bool
+	boilerplate      string
+	grep             string
+	not              string
+	notWeight        float64
+	summaries        bool
+	summaryModel     string
+	hierarchy        bool
+	tests            string
+	inContext        string
+	inContextMode    string
+	lang             string
+	encoding         string
+	fallbackEncoding string
+	logLevel         string
+	// multiVectorWeight is the share of late interaction in ranking.
+	multiVectorWeight float64
+	// sparse is the -sparse provider, weighed by sparseWeight.
+	sparse       string
+	sparseWeight float64
+	// embedCache is the -embed-cache URL, its Redis keys kept for
+	// embedCacheTTL.
+	embedCache    string
+	embedCacheTTL time.Duration
+	// batchSize, batchTokens and maxInputTokens bound the requests made to
+	// the provider, texts over maxInputTokens cut by the truncate policy.
+	batchSize      int
+	batchTokens    int
+	maxInputTokens int
+	truncate       string
+	// spacePolicy handles indexes embedded with another provider or model.
+	spacePolicy string
+	// fs is the flag set of the command, that config files apply to.
+	fs *flag.FlagSet
+}
+
+// register adds the shared flags to fs.
+func (o *options) register(fs *flag.FlagSet) {
+	o.fs = fs
+	fs.StringVar(&o.namespace, "index", os.Getenv("CODECTX_INDEX"), "name of the index to read and write (default $CODECTX_INDEX)")
+	fs.StringVar(&o.namespace, "namespace", os.Getenv("CODECTX_INDEX"), "alias of -index")
+	fs.BoolVar(&o.noDefaultIgnores, "no-default-ignores", false, "don't skip the built-in ecosystem ignore patterns (vendor/, node_modules/, ...)")
+	fs.StringVar(&o.generated, "generated", generatedSkip, "how to treat generated and minified files: skip, downweight or keep")
+	fs.StringVar(&o.encoding, "encoding", charset.Auto, "encoding of the files to index, transcoded to UTF-8: auto to detect UTF-8 and UTF-16, or a label such as utf-16le, latin1 or shift_jis")
+	fs.StringVar(&o.fallbackEncoding, "fallback-encoding", "windows-1252", "with -encoding auto, encoding of files that aren't UTF-8 or UTF-16; empty to skip them")
+	fs.BoolVar(&o.windowed, "windowed", false, "embed changed files chunk by chunk and store the mean of the chunk vectors as the file's, so that an edit only re-embeds the chunks it changed")
+	fs.StringVar(&o.normalize, "normalize", "", "comma-separated normalizations of the text embedded, not of the text shown: license to strip license headers, literals to replace long base64 and hex literals, whitespace to collapse whitespace, or all")
+	fs.StringVar(&o.preprocess, "preprocess", "", "comma-separated `rules` rewriting the text embedded per file type, PATTERN=STEP+STEP, where PATTERN is a file name glob or lang:<language>, as in *.pb.go=redact+protobuf-accessors,*=redact; files matching no rule get -normalize")
+	fs.BoolVar(&o.blame, "blame", false, "record the dominant git blame author and last commit of each file")
+	fs.StringVar(&o.author, "author", "", "only return files whose dominant author contains this value")
+	fs.StringVar(&o.inContext, "in-context", "", "comma-separated `paths` of files or directories already in the context of an editor or agent, absolute or relative to the searched path")
+	fs.StringVar(&o.inContextMode, "in-context-mode", inContextExclude, "how to treat the files of -in-context: exclude to leave them out of results, or downrank to rank them below other files of similar relevance")
+	fs.StringVar(&o.tests, "tests", testsKeep, "how to treat test files: keep to rank them like other files, exclude to leave them out, or pair to list the tests of each result by their names and imports")
+	fs.StringVar(&o.lang, "lang", "", "only return files detected as one of these comma-separated languages, e.g. go,python")
+	fs.StringVar(&o.rev, "rev", "", "index files from the git object store at this revision instead of the working tree")
+	fs.DurationVar(&o.embedTimeout, "embed-timeout", time.Minute, "maximum duration of a single embedding request (0 for none)")
+	fs.DurationVar(&o.dbTimeout, "db-timeout", 10*time.Second, "maximum duration of a single database query (0 for none)")
+	fs.DurationVar(&o.walkTimeout, "walk-timeout", 0, "maximum duration of listing the files to index (0 for none)")
+	fs.IntVar(&o.open, "open", 0, "open the nth result in $VISUAL or $EDITOR at its line best matching the query (0 only lists results)")
+	fs.BoolVar(&o.json, "json", false, "print the results as JSON for agents, in the versioned codectx.search/v1 schema, with chunk ids that fetch reads")
+	fs.BoolVar(&o.copy, "copy", false, "copy the top results to the clipboard as a context block of fenced files, to paste into a chat")
+	fs.StringVar(&o.copyFile, "copy-file", "", "write the context block of -copy to this `file` instead of the clipboard")
+	fs.IntVar(&o.copyLines, "copy-lines", 80, "with -copy, cut files to this many lines around their line best matching the query (0 copies whole files)")
+	fs.BoolVar(&o.byDir, "by-dir", false, "rank directories by the relevance of their files instead of ranking files")
+	fs.IntVar(&o.depth, "depth", 0, "with -by-dir, group files by their first n directory levels (0 for their own directory)")
+	fs.Float64Var(&o.pathWeight, "path-weight", 0.2, "score bonus of files whose path fuzzily matches words of the query, e.g. store.go for \"store upsert\" (0 disables it)")
+	fs.Float64Var(&o.docWeight, "doc-weight", 0, "embed the comments and docstrings of files apart from their code, and blend this share of their distance to the query into the code's, 0 to 1 (0 disables it)")
+	fs.Float64Var(&o.multiVectorWeight, "multi-vector-weight", 0, "experimental: embed every few lines of files apart, storing a vector per segment, and each word of queries, and blend this share of their MaxSim late interaction distance into that of files, 0 to 1 (0 disables it)")
+	fs.StringVar(&o.sparse, "sparse", "", "hybrid search: also encode files and queries with a sparse model such as SPLADE, tei:<url> of a text-embeddings-inference server or, with the embedtest build tag, fake, and fuse its matches with the nearest vectors")
+	fs.Float64Var(&o.sparseWeight, "sparse-weight", 0.3, "with -sparse, score bonus of the best sparse match of a query, the others getting their share of it, 0 to 1")
+	fs.Float64Var(&o.lexicalWeight, "lexical-weight", 0, "hybrid search: score bonus of files matching the query words and identifier parts by BM25 (0 searches vectors only)")
+	fs.BoolVar(&o.cleanQuery, "clean-query", false, "strip boilerplate such as \"where is the code that\" or \"in this repo\" from queries before embedding them")
+	fs.StringVar(&o.boilerplate, "boilerplate", "", "with -clean-query, comma-separated phrases stripped from queries besides the built-in ones, e.g. \"in our monorepo,for the backend\"")
+	fs.StringVar(&o.grep, "grep", "", "only keep the results with a chunk matching this regular expression, e.g. \"ctx\\.Done\\(\\)\", to combine semantic recall with exact matches")
+	fs.StringVar(&o.not, "not", "", "negative query: lower files by their similarity to this text, e.g. \"test helpers\", to prune noisy matches")
+	fs.Float64Var(&o.notWeight, "not-weight", 0.3, "with -not, share of the similarity to the negative query added to the score of files, 0 to 1")
+	fs.BoolVar(&o.summaries, "summaries", false, "summarize files and packages with a generative model, in the background when serving and the files returned otherwise, embed the summaries and search them first, for more precise results in large repos")
+	fs.BoolVar(&o.hierarchy, "hierarchy", false, "cluster the summaries of similar files, summarize the clusters recursively and search by traversing them from the top, for questions about the whole repo (implies -summaries)")
+	fs.StringVar(&o.summaryModel, "summary-model", summary.DefaultModel, "Ollama `model` writing the summaries of -summaries")
+	fs.BoolVar(&o.explain, "explain", false, "show how the score of each result was computed")
+	fs.StringVar(&o.mode, "mode", modeAuto, "search mode: vector, lexical (BM25, no embedding provider) or auto to fall back to lexical when the provider is unavailable")
+	fs.StringVar(&o.provider, "provider", "ollama", "embedding provider: ollama, ollama:<model>, voyage[:<model>], exec:<plugin command>, wasm:<plugin module>, with the embedtest build tag, fake[:<dimensions>] (vectors hashed from words, for tests), or, with the onnx build tag, onnx:<model dir>; or a comma-separated list of them, the first that answers used")
+	fs.StringVar(&o.chunker, "chunker", "", "`command` of a plugin, or wasm:<module>, finding the declarations files are chunked at, falling back to the built-in chunker for files it returns none for")
+	fs.StringVar(&o.reranker, "reranker", "", "`command` of a plugin, or wasm:<module>, reordering the best results by their relevance to the query")
+	fs.BoolVar(&o.sandbox, "sandbox", false, "only run plugins that are WebAssembly modules, refusing executables")
+	fs.StringVar(&o.ollamaHosts, "ollama-hosts", os.Getenv("OLLAMA_HOSTS"), "comma-separated Ollama endpoints to spread embeddings across (default $OLLAMA_HOSTS, else $OLLAMA_HOST)")
+	fs.BoolVar(&o.deterministic, "deterministic", false, "index reproducibly: one worker, files in walk order and seeded hnsw graphs, so that runs over the same tree export identical files")
+	fs.IntVar(&o.workers, "workers", 0, "fixed number of concurrent embeddings; 0 tunes it from provider latency and errors")
+	fs.IntVar(&o.maxWorkers, "max-workers", 16, "upper bound of concurrent embeddings when -workers is 0")
+	fs.Float64Var(&o.maxCPU, "max-cpu", 0, "percent of the machine's CPU that indexing may use before workers wait, 0 for no limit")
+	fs.IntVar(&o.maxEmbedsPerMin, "max-embeds-per-min", 0, "maximum embedding requests a minute, queries included, 0 for no limit")
+	fs.IntVar(&o.batchSize, "batch-size", 0, "most texts sent per provider request, packing the embeddings waiting while a request is in flight (0 for the provider's limit, 1 sends each alone)")
+	fs.IntVar(&o.batchTokens, "batch-tokens", 0, "most tokens sent per provider request with -batch-size (0 for the provider's limit)")
+	fs.IntVar(&o.maxInputTokens, "max-input-tokens", 0, "cut texts over this many tokens by -truncate, with a warning, instead of leaving them to the provider (0 for the context of the model when known)")
+	fs.StringVar(&o.truncate, "truncate", embed.TruncateSplit, "policy of texts over -max-input-tokens: split at line breaks, embedding the mean of their parts, or drop their head, tail or middle")
+	fs.StringVar(&o.spacePolicy, "space-policy", spaceRefuse, "policy of indexes embedded with another provider or model than the one used: refuse to fail, falling back to lexical search in auto mode, or reembed to embed them again")
+	fs.IntVar(&o.breakerFailures, "breaker-failures", 5, "consecutive embedding failures that pause embedding (0 disables the breaker)")
+	fs.DurationVar(&o.breakerCooldown, "breaker-cooldown", 30*time.Second, "how long embedding pauses before the provider is tried again")
+	fs.StringVar(&o.logLevel, "log-level", "info", "minimum level of the lines logged: debug, info, warn or error")
+	db := os.Getenv("CODECTX_DB")
+	if db == "" {
+		db = localDB
+	}
+	fs.StringVar(&o.db, "db", db, "DuckDB database: a file path, optionally with ?access_mode=read_only, or md:<database> for MotherDuck (default $CODECTX_DB, else local.db)")
+	fs.BoolVar(&o.readOnly, "read-only", false, "open the database read-only, e.g. with a MotherDuck read-scaling token; searches use the stored index as is")
+	fs.BoolVar(&o.noWalk, "no-walk", false, "search the stored index as is, without walking the tree to re-embed changed files first")
+	fs.DurationVar(&o.fresh, "fresh", 0, "search the stored index after re-embedding only the files modified since they were last indexed, within this time budget (0 walks and hashes every file)")
+	fs.BoolVar(&o.shard, "shard", false, "keep one vector graph per top-level directory, searched in parallel, for large monorepos")
+	fs.BoolVar(&o.exact, "exact", false, "compare queries with every stored vector instead of searching the approximate graph, slower on large indexes but never missing a neighbour")
+	fs.IntVar(&o.flatLimit, "flat-limit", 20000, "search indexes of up to this many files exhaustively, only building the approximate graph for larger ones (0 to always build it)")
+	fs.StringVar(&o.engine, "engine", engineAuto, "vector index engine: flat, hnsw, duckdb-vss, or auto to pick one from the index size, -memory-limit and -latency-target")
+	fs.Var(&o.memoryLimit, "memory-limit", "with -engine auto, keep vectors in DuckDB instead of memory when they would exceed this size, e.g. 4GB (0 for no limit)")
+	fs.DurationVar(&o.latencyTarget, "latency-target", 0, "with -engine auto, build the approximate graph when a flat search would take longer (0 for no target)")
+	fs.BoolVar(&o.f16, "f16", false, "hold vectors as float16 in memory, halving the RAM of large indexes at a small cost in precision")
+	fs.StringVar(&o.vectors, "vectors", "", "memory-map the vectors of a stored index from this `file`, written by export-vectors, instead of reading them from the database")
+	fs.StringVar(&o.remote, "remote", os.Getenv("CODECTX_REMOTE"), "shared index database, s3://, gs:// or http(s):// URL, searched through a local cached copy (default $CODECTX_REMOTE)")
+	fs.DurationVar(&o.remoteTTL, "remote-ttl", 10*time.Minute, "how long the cached copy of -remote is used before it is pulled again")
+	fs.StringVar(&o.embedCache, "embed-cache", os.Getenv("CODECTX_EMBED_CACHE"), "shared cache of embedding vectors by hash of model and text, http(s):// or redis(s):// URL, consulted before the provider (default $CODECTX_EMBED_CACHE)")
+	fs.DurationVar(&o.embedCacheTTL, "embed-cache-ttl", 30*24*time.Hour, "how long vectors stored in a redis(s):// -embed-cache are kept (0 keeps them forever)")
+}
+
+// languages returns the languages listed by -lang.
+func (o *options) languages() []string {
+	return parseLanguages(o.lang)
+}
+
+// parseLanguages splits a comma-separated list of languages.
+func parseLanguages(list string) []string {
+	var out []string
+	for _, lang := range strings.Split(list, ",") {
+		if lang = strings.ToLower(strings.TrimSpace(lang)); lang != "" {
+			out = append(out, lang)
+		}
+	}
+	return out
+}
+
+// validate sets the flags left unset on the command line from the config
+// files, those of the path argument when it is a directory, then checks them.
+func (o *options) validate() error {
+	dir := "."
+	if info, err := os.Stat(o.fs.Arg(0)); o.fs.NArg() > 0 && err == nil && info.IsDir() {
+		dir = o.fs.Arg(0)
+	}
+	if err := applyConfig(o.fs, dir); err != nil {
+		return err
+	}
+
+	switch o.generated {
+	case generatedSkip, generatedDownweight, generatedKeep:
+	default:
+		return fmt.Errorf("invalid -generated value %q: use skip, downweight or keep", o.generated)
+	}
+	switch o.mode {
+	case modeAuto, modeVector, modeLexical:
+	default:
+		return fmt.Errorf("invalid -mode value %q: use auto, vector or lexical", o.mode)
+	}
+	switch o.tests {
+	case testsKeep, testsExclude, testsPair:
+	default:
+		return fmt.Errorf("invalid -tests value %q: use keep, exclude or pair", o.tests)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(o.logLevel)); err != nil {
+		return fmt.Errorf("invalid -log-level value %q: use debug, info, warn or error", o.logLevel)
+	}
+	logLevel.Set(level)
+	if o.chunker != "" && strings.TrimSpace(o.chunker) == "" {
+		return errors.New("-chunker needs the command of a plugin")
+	}
+	if o.reranker != "" && strings.TrimSpace(o.reranker) == "" {
+		return errors.New("-reranker needs the command of a plugin")
+	}
+	if o.deterministic && o.workers > 1 {
+		return errors.New("-deterministic indexes with a single worker: drop -workers")
+	}
+	if o.sandbox {
+		plugins := map[string]string{"-chunker": o.chunker, "-reranker": o.reranker}
+		for _, spec := range o.providers() {
+			if name, command, _ := strings.Cut(spec, ":"); name == "exec" {
+				plugins["-provider"] = command
+			}
+		}
+		for flag, command := range plugins {
+			if command != "" && !strings.HasPrefix(command, "wasm:") {
+				return fmt.Errorf("-sandbox only runs WebAssembly plugins: use %s wasm:<module>", flag)
+			}
+		}
+	}
+	if o.docWeight < 0 || o.docWeight > 1 {
+		return fmt.Errorf("invalid -doc-weight value %v: use a share between 0 and 1", o.docWeight)
+	}
+	if _, err := parseGrep(o.grep); err != nil {
+		return fmt.Errorf("invalid -grep value: %w", err)
+	}
+	if o.multiVectorWeight < 0 || o.multiVectorWeight > 1 {
+		return fmt.Errorf("invalid -multi-vector-weight value %v: use a share between 0 and 1", o.multiVectorWeight)
+	}
+	if o.sparse != "" {
+		if _, err := embed.ParseSparseProvider(o.sparse); err != nil {
+			return fmt.Errorf("invalid -sparse value: %w", err)
+		}
+	}
+	if o.sparseWeight < 0 || o.sparseWeight > 1 {
+		return fmt.Errorf("invalid -sparse-weight value %v: use a share between 0 and 1", o.sparseWeight)
+	}
+	if o.notWeight < 0 || o.notWeight > 1 {
+		return fmt.Errorf("invalid -not-weight value %v: use a share between 0 and 1", o.notWeight)
+	}
+	if _, err := normalize.Parse(o.normalize); err != nil {
+		return fmt.Errorf("invalid -normalize value: %w", err)
+	}
+	if _, err := preprocess.Parse(o.pipeline()); err != nil {
+		return fmt.Errorf("invalid -preprocess value: %w", err)
+	}
+	if o.fresh > 0 && o.noWalk {
+		return errors.New("-fresh refreshes changed files, it can't be used with -no-walk")
+	}
+	if o.fresh > 0 && o.rev != "" {
+		return errors.New("-fresh compares modification times in the working tree, it can't be used with -rev")
+	}
+	if o.maxCPU < 0 || o.maxCPU > 100 {
+		return fmt.Errorf("invalid -max-cpu value %v: use a percent between 0 and 100", o.maxCPU)
+	}
+	if o.maxEmbedsPerMin < 0 {
+		return fmt.Errorf("invalid -max-embeds-per-min value %d", o.maxEmbedsPerMin)
+	}
+	if o.batchSize < 0 {
+		return fmt.Errorf("invalid -batch-size value %d", o.batchSize)
+	}
+	if o.batchTokens < 0 {
+		return fmt.Errorf("invalid -batch-tokens value %d", o.batchTokens)
+	}
+	if o.maxInputTokens < 0 {
+		return fmt.Errorf("invalid -max-input-tokens value %d", o.maxInputTokens)
+	}
+	if _, err := embed.ParseTruncate(o.truncate); err != nil {
+		return fmt.Errorf("invalid -truncate value: %w", err)
+	}
+	if len(o.providers()) == 0 {
+		return errors.New("-provider needs at least one provider")
+	}
+	switch o.spacePolicy {
+	case spaceRefuse, spaceReembed:
+	default:
+		return fmt.Errorf("invalid -space-policy value %q: use refuse or reembed", o.spacePolicy)
+	}
+	if o.embedCacheTTL < 0 {
+		return fmt.Errorf("invalid -embed-cache-ttl value %v", o.embedCacheTTL)
+	}
+	switch o.inContextMode {
+	case inContextExclude, inContextDownrank:
+	default:
+		return fmt.Errorf("invalid -in-context-mode value %q: use exclude or downrank", o.inContextMode)
+	}
+	switch o.engine {
+	case engineAuto, engineFlat, engineHNSW, engineDuckDB:
+	default:
+		return fmt.Errorf("invalid -engine value %q: use auto, flat, hnsw or duckdb-vss", o.engine)
+	}
+	if _, err := charset.Lookup(o.encoding); err != nil {
+		return fmt.Errorf("invalid -encoding value: %w", err)
+	}
+	if o.fallbackEncoding != "" {
+		if _, err := charset.Lookup(o.fallbackEncoding); err != nil {
+			return fmt.Errorf("invalid -fallback-encoding value: %w", err)
+		}
+	}
+	if o.open < 0 {
+		return fmt.Errorf("invalid -open value %d: results are numbered from 1", o.open)
+	}
+	if o.open > 0 && o.byDir {
+		return errors.New("-open opens files, it can't be used with -by-dir")
+	}
+	if o.copyFile != "" {
+		o.copy = true
+	}
+	if o.hierarchy {
+		o.summaries = true
+	}
+	if o.copy && o.byDir {
+		return errors.New("-copy copies files, it can't be used with -by-dir")
+	}
+	if o.json && o.byDir {
+		return errors.New("-json lists files, it can't be used with -by-dir")
+	}
+	return store.ValidateNamespace(o.namespace)
+}
+
+// boilerplatePhrases returns the phrases -clean-query strips from queries, none
+// when disabled.
+func (o *options) boilerplatePhrases() []string {
+	if !o.cleanQuery {
+		return nil
+	}
+	phrases := slices.Clone(normalize.Boilerplate)
+	for _, p := range strings.Split(o.boilerplate, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			phrases = append(phrases, p)
+		}
+	}
+	return phrases
+}
+
+// pipeline returns the -preprocess rules, followed by a rule applying the
+// -normalize steps to every other file.
+func (o *options) pipeline() string {
+	spec := o.preprocess
+	if steps, _ := normalize.Parse(o.normalize); len(steps) > 0 {
+		spec += ",*=" + strings.Join(steps, "+")
+	}
+	return spec
+}
+
+// app holds the services shared by every command.
+type app struct {
+	opts     *options
+	database *sql.DB
+	// readOnly is set when the database can't be written to.
+	readOnly  bool
+	storeOpts []store.Option
+	// stores holds the storage service of each namespace opened, whose
+	// tables are created and migrated once.
+	storesMu sync.Mutex
+	stores   map[string]store.StorageService
+	ollama   *ollama.Client
+	emb      embed.EmbeddingService
+	// summaries writes file and package summaries; nil without -summaries.
+	summaries summary.SummaryService
+	ignore    *goignore.GitIgnore
+	// caps are the capabilities of the -provider, zero without one.
+	caps embed.Capabilities
+	// space names the provider and model embedding vectors, which tags
+	// them in the store; empty without one.
+	space string
+	// breaker pauses embedding while the provider is failing; nil when disabled.
+	breaker *embed.Breaker
+	// adaptive tunes embedding concurrency; nil when -workers is fixed.
+	adaptive *embed.Adaptive
+	// stats records the latency of every embedding provider; nil without
+	// one.
+	stats *embed.Stats
+	// indexing is the queue of the indexing run in progress, if any.
+	indexing atomic.Pointer[queue]
+	// events is notified of re-embedded files; nil unless serving.
+	events *events
+	// vectors is the mapped -vectors file, nil when unset.
+	vectors *vecfile.File
+	// undecodable collects the files skipped for their encoding, reported at
+	// the end of each indexing run.
+	undecodable skipped
+	// opened holds the files named by -in-context and in_context, indexed
+	// before the others.
+	opened opened
+	// throttle holds back indexing workers while paused or over -max-cpu.
+	throttle throttle
+	// preprocess rewrites the text embedded, by -preprocess and -normalize.
+	preprocess *preprocess.Pipeline
+	// sparse is the -sparse model, nil when unset.
+	sparse embed.SparseProvider
+	// paths holds the stored paths that queries are fuzzily matched
+	// against, by -path-weight.
+	paths pathCache
+	// vcache is the -embed-cache consulted before the provider, nil when
+	// unset.
+	vcache vcache.Cache
+	// cleaner strips boilerplate from the queries embedded, by -clean-query.
+	cleaner *normalize.QueryCleaner
+	// chunker and reranker are the -chunker and -reranker plugins, nil when
+	// unset.
+	chunker  *plugin.Plugin
+	reranker *plugin.Plugin
+}
+
+// newApp connects to DuckDB and Ollama and loads the tokenizer.
+func newApp(ctx context.Context, o *options) (*app, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
 
 	// read voyageAPIKeyPath from env var
 	// voyageAPIKeyPath := os.Getenv("VOYAGE_API_KEY_FILE")
@@ -84,202 +789,367 @@ func main() {
 	// }
 	// vKey := strings.TrimSpace(string(voyageKey))
 
-	// Setup logger
-	globIgnorePatterns, err := goignore.CompileIgnoreFile(".astignore")
+	globIgnorePatterns := loadIgnore(ctx, o)
 
-	database, err := sql.Open("duckdb", "local.db")
+	// Setup optional encryption at rest
+	storeOpts := []store.Option{store.WithTimeout(o.dbTimeout)}
+	key, err := crypt.LoadKey()
 	if err != nil {
-		l.Error("Failed to connect to DuckDB", "error", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to load encryption key: %w", err)
 	}
-	defer database.Close()
-
-	// Setup storage service
-	db := store.NewStorageService(database)
-
-	// Setup Ollama
-	os.Setenv("OLLAMA_HOST", "http://127.0.0.1:11434")
-	oClient, err := ollama.ClientFromEnvironment()
-	if err != nil {
-		l.Error("Failed to create Ollama client", "error", err)
-		os.Exit(1)
+	if key != nil {
+		c, err := crypt.NewAESGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup encryption: %w", err)
+		}
+		storeOpts = append(storeOpts, store.WithCipher(c))
+		l.Debug("encryption at rest enabled")
 	}
 
-	// Setup tokenizer to measure tokens
-	configFile, err := tokenizer.CachedPath("bert-base-uncased", "tokenizer.json")
+	database, readOnly, err := openDB(ctx, o)
 	if err != nil {
-		l.Error("Failed to get cached path", "error", err)
-		os.Exit(1)
+		return nil, err
 	}
-	tk, err := pretrained.FromFile(configFile)
-	if err != nil {
-		l.Error("Failed to load tokenizer", "error", err)
-		os.Exit(1)
+	if readOnly {
+		storeOpts = append(storeOpts, store.WithReadOnly())
 	}
 
-	// Create embedding service
-	emb := embed.NewEmbedService(oClient, tk)
+	// Map exported vectors rather than decoding them from rows
+	var vectors *vecfile.File
+	if o.vectors != "" {
+		if vectors, err = vecfile.Open(o.vectors); err != nil {
+			return nil, err
+		}
+		l.Debug("mapped vectors", "file", o.vectors, "index", vectors.Namespace(), "count", vectors.Len(), "dims", vectors.Dims())
+	}
 
-	// Search
-	q, _, err := emb.Get(ctx, query)
-	// q, _, err := emb.Voyage(vKey, query)
-	if err != nil {
-		l.Error("Failed to embed query", "error", err)
-		return
+	a := &app{
+		opts:      o,
+		database:  database,
+		readOnly:  readOnly,
+		vectors:   vectors,
+		storeOpts: storeOpts,
+		ignore:    globIgnorePatterns,
+		throttle:  throttle{maxCPU: o.maxCPU},
+	}
+	if err := a.setupEmbedding(ctx); err != nil {
+		database.Close()
+		return nil, err
+	}
+	a.preprocess, _ = preprocess.Parse(o.pipeline())
+	a.cleaner = normalize.NewQueryCleaner(o.boilerplatePhrases())
+	if o.sparse != "" {
+		a.sparse, _ = embed.ParseSparseProvider(o.sparse)
 	}
+	if o.chunker != "" {
+		a.chunker, _ = plugin.New(o.chunker)
+	}
+	if o.reranker != "" {
+		a.reranker, _ = plugin.New(o.reranker)
+	}
+	if a.emb != nil && o.summaries {
+		a.summaries = summary.NewSummaryService(a.ollama, o.summaryModel)
+	}
+	return a, nil
+}
 
-	// make string channel of 5
-	indexing := make(chan string, 5)
+// setupEmbedding connects to Ollama and sets up the first provider of
+// -provider that answers, unless in lexical mode, behind the concurrency
+// tuner, the breaker, the rate limit and the -embed-cache. Without a
+// provider, or with one the index wasn't embedded with and -space-policy
+// refuse, auto mode falls back to lexical.
+func (a *app) setupEmbedding(ctx context.Context) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+	o := a.opts
 
-	done := atomic.Bool{}
-	done.Store(false)
+	// Setup Ollama, possibly several instances
+	var (
+		clients []*ollama.Client
+		err     error
+	)
+	if o.ollamaHosts != "" {
+		clients, err = embed.ParseHosts(o.ollamaHosts)
+	} else {
+		if os.Getenv("OLLAMA_HOST") == "" {
+			os.Setenv("OLLAMA_HOST", "http://127.0.0.1:11434")
+		}
+		var c *ollama.Client
+		c, err = ollama.ClientFromEnvironment()
+		clients = []*ollama.Client{c}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create Ollama client: %w", err)
+	}
+	a.ollama = clients[0]
 
-	numWorkers := 4
+	// Lexical search works without a provider, so don't fail without one
+	if o.mode != modeLexical {
+		a.stats = embed.NewStats()
+		a.emb, a.caps, a.space, err = selectEmbedder(ctx, o, clients, a.stats)
+		if err == nil {
+			err = a.checkSpace(ctx)
+		}
+		if err != nil && o.mode == modeVector {
+			return err
+		}
+		if err != nil {
+			l.Warn("embedding provider unavailable, falling back to lexical search", "error", err)
+			o.mode = modeLexical
+			a.emb, a.caps, a.space = nil, embed.Capabilities{}, ""
+		}
+	}
+	if len(clients) > 1 {
+		l.Debug("ollama pool", "hosts", len(clients))
+	}
+	if a.emb == nil {
+		return nil
+	}
 
-	g := hnsw.NewGraph[string]()
+	// Tune concurrency to what the provider sustains, starting from the old fixed 4
+	if o.workers <= 0 && !o.deterministic {
+		a.adaptive = embed.NewAdaptive(a.emb, 1, o.maxWorkers, 4, func(limit int) {
+			l.Debug("embedding concurrency", "limit", limit)
+		})
+		a.emb = a.adaptive
+	}
 
-	// create wait group for workers
-	var wg sync.WaitGroup
+	// Pause embedding instead of failing every file while the provider is down
+	if o.breakerFailures > 0 {
+		a.breaker = embed.NewBreaker(a.emb, o.breakerFailures, o.breakerCooldown, func(state embed.BreakerState, err error) {
+			switch state {
+			case embed.BreakerOpen:
+				l.Warn("embedding paused: provider is failing", "cooldown", o.breakerCooldown, "error", err)
+			case embed.BreakerHalfOpen:
+				l.Debug("embedding provider probe")
+			case embed.BreakerClosed:
+				l.Info("embedding resumed")
+			}
+		})
+		a.emb = a.breaker
+	}
 
-	// create 4 go routine workers that read from the indexing channel to perform work
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func(id int) {
-			defer l.Debug("worker", "id", id, "state", "done")
-			defer wg.Done()
+	// Stay within the provider's quota; waiting doesn't trip the breaker
+	a.emb = embed.WithRateLimit(a.emb, o.maxEmbedsPerMin)
 
-			for {
-				select {
-				case path := <-indexing:
-					if err := handleFile(ctx, &mu, db, emb, g, q, path); err != nil {
-						l.Error("Failed to handle file", "error", err)
-					}
-				}
+	// Cached vectors skip the provider, its quota and its breaker altogether
+	if o.embedCache != "" {
+		if a.vcache, err = vcache.New(ctx, o.embedCache, o.embedCacheTTL); err != nil {
+			return err
+		}
+		a.emb = vcache.Wrap(a.emb, a.vcache, a.space, o.limits(a.caps), a.caps.Dims, func(err error) {
+			l.Debug("embedding cache unavailable", "cache", a.vcache.Name(), "error", err)
+		})
+	}
+	return nil
+}
 
-				if done.Load() {
-					return
-				}
+// loadIgnore compiles the patterns of .astignore, after the built-in
+// ecosystem defaults unless -no-default-ignores is set.
+func loadIgnore(ctx context.Context, o *options) *goignore.GitIgnore {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
 
-			}
-		}(i)
+	var defaults []string
+	if !o.noDefaultIgnores {
+		defaults = ignore.Defaults()
 	}
+	patterns, err := goignore.CompileIgnoreFileAndLines(".astignore", defaults...)
+	if err != nil {
+		l.Debug("no ignore file", "error", err)
+		patterns = goignore.CompileIgnoreLines(defaults...)
+	}
+	return patterns
+}
 
-	// Walk through all files in the current directory
-	filepath.Walk(wd, func(path string, info os.FileInfo, err error) error {
-		// Skip directories
-		info, err = os.Stat(path)
-		if err != nil || info.IsDir() {
-			return nil
-		}
-		// Skip files that match the ignore patterns
-		if globIgnorePatterns.MatchesPath(path) {
-			return nil
-		}
-
-		indexing <- path
+// newEmbedder returns the embedding service of the provider spec, its
+// latency recorded by stats, the capabilities of the provider and its
+// name. Ollama
+// embeddings are spread across every client, recorded by host. Requests are
+// packed and texts cut within the limits given by -batch-size, -batch-tokens
+// and -max-input-tokens, else by the capabilities, their tokens counted with
+// the tokenizer of the model.
+func newEmbedder(ctx context.Context, o *options, spec string, clients []*ollama.Client, stats *embed.Stats) (embed.EmbeddingService, embed.Capabilities, string, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
 
-		return nil
-	})
+	// Count tokens with the vocabulary of the model, else estimate them
+	tk, err := embed.TokenizerFor(spec)
+	if err != nil {
+		l.Debug("estimating tokens", "provider", spec, "reason", err)
+	}
+	l.Debug("tokenizer", "provider", spec, "tokenizer", tk.Name())
 
-	// Inform workers that there is no more work
-	done.Store(true)
-	l.Debug("done walking the tree")
+	p, err := embed.ParseProvider(spec, clients[0])
+	if err != nil {
+		return nil, embed.Capabilities{}, "", err
+	}
+	caps := p.Capabilities()
+	limits := o.limits(caps)
+	l.Debug("embedding capabilities", "provider", p.Name(), "max_input_tokens", caps.MaxInputTokens, "max_batch_size", caps.MaxBatchSize,
+		"max_batch_tokens", caps.MaxBatchTokens, "dims", caps.Dims, "input_types", caps.InputTypes)
 
-	// Wait for all workers to finish
-	wg.Wait()
+	if spec != "ollama" {
+		svc := embed.FromProvider(p)
+		if limits.MaxBatchSize > 1 || limits.MaxTokens > 0 {
+			svc = embed.NewBatcher(p, limits, tk.Count, onTruncate(ctx, limits))
+		}
+		return stats.Wrap(p.Name(), embed.WithTimeout(svc, o.embedTimeout)), caps, p.Name(), nil
+	}
 
-	// Display
-	neighbors := g.Search(q, 1)
-	for _, n := range neighbors {
-		d1, d2, d3 := getDistance(q, n.Value)
-		l.Info("neighbour", "path", n.Key, "d1", d1, "d2", d2, "d3", d3)
+	// ParseHosts keeps the hosts of -ollama-hosts in order
+	var hosts []string
+	for _, h := range strings.Split(o.ollamaHosts, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	services := make([]embed.EmbeddingService, len(clients))
+	for i, c := range clients {
+		name := "ollama"
+		if len(clients) > 1 {
+			name += " " + hosts[i]
+		}
+		svc := embed.NewEmbedService(c, tk)
+		if limits.MaxBatchSize > 1 || limits.MaxTokens > 0 {
+			p, _ := embed.ParseProvider("ollama", c)
+			svc = embed.NewBatcher(p, limits, tk.Count, onTruncate(ctx, limits))
+		}
+		services[i] = stats.Wrap(name, embed.WithTimeout(svc, o.embedTimeout))
 	}
+	return embed.NewPool(services), caps, p.Name(), nil
+}
 
-	fmt.Println(time.Since(begin).Milliseconds())
+// limits returns the bounds of embedding requests set by the flags, those
+// left at 0 set by the capabilities of the provider.
+func (o *options) limits(caps embed.Capabilities) embed.Limits {
+	l := embed.Limits{MaxTokens: o.maxInputTokens, Truncate: o.truncate, MaxBatchSize: o.batchSize, MaxBatchTokens: o.batchTokens}
+	if l.MaxTokens == 0 {
+		l.MaxTokens = caps.MaxInputTokens
+	}
+	if l.MaxBatchSize == 0 {
+		l.MaxBatchSize = max(caps.MaxBatchSize, 1)
+	}
+	if l.MaxBatchTokens == 0 {
+		l.MaxBatchTokens = caps.MaxBatchTokens
+	}
+	return l
 }
 
-func getDistance(q, v []float32) (float32, float32, float32) {
-	var sum float32
-	for i := range q {
-		sum += (q[i] - v[i]) * (q[i] - v[i])
+// onTruncate returns the logger of the texts cut to fit limits, warning with
+// the logger of the context of the embedding, which embedText tags with the
+// path of the file.
+func onTruncate(ctx context.Context, limits embed.Limits) func(context.Context, embed.Truncation) {
+	fallback := ctx.Value(LoggerCtxKey).(*slog.Logger)
+	return func(ctx context.Context, t embed.Truncation) {
+		l, ok := ctx.Value(LoggerCtxKey).(*slog.Logger)
+		if !ok {
+			l = fallback
+		}
+		l.Warn("embedding input truncated", "policy", t.Policy, "tokens", t.Tokens, "kept", t.Kept, "max_input_tokens", limits.MaxTokens)
 	}
+}
 
-	d1 := hnsw.CosineDistance(q, v)
-	d2 := hnsw.EuclideanDistance(q, v)
-	return d1, d2, sum
+// Close releases the database connection.
+func (a *app) Close() error {
+	if a.vectors != nil {
+		a.vectors.Close()
+	}
+	if a.vcache != nil {
+		a.vcache.Close()
+	}
+	for _, p := range []*plugin.Plugin{a.chunker, a.reranker} {
+		if p != nil {
+			p.Close()
+		}
+	}
+	return a.database.Close()
 }
 
-// computeHash returns the MD5 hash of the given data
-func computeHash(data []byte) string {
-	hasher := md5.New()
-	hasher.Write(data)
-	return hex.EncodeToString(hasher.Sum(nil))
+// workers returns how many goroutines feed the embedding stage, one with
+// -deterministic. When concurrency is tuned, the extra workers wait for a
+// free slot.
+func (a *app) workers() int {
+	if a.opts.deterministic {
+		return 1
+	}
+	if a.opts.workers > 0 {
+		return a.opts.workers
+	}
+	return max(a.opts.maxWorkers, 1)
 }
 
-// handleFile reads the file at the given path, computes its hash, and embeds its content.
-func handleFile(ctx context.Context, mu *sync.Mutex, db store.StorageService, emb embed.EmbeddingService, g *hnsw.Graph[string], q []float32, path string) error {
-	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
-	start := time.Now()
+// deterministicSeed seeds the hnsw graphs built with -deterministic.
+const deterministicSeed = 1
 
-	// read file content
-	f, err := os.ReadFile(path)
-	if err != nil {
-		l.Error("Failed to read file", "error", err)
-		os.Exit(1)
-	}
+// newIndex returns an empty index for about files vectors of dims
+// dimensions, 0 when unknown, on the engine planned from the flags. Graphs
+// are sharded by shardOf when -shard is set, seeded with -deterministic, and
+// in-memory engines hold float16 vectors with -f16.
+func (a *app) newIndex(ctx context.Context, shardOf func(id string) string, files, dims int) index.IndexService {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
 
-	// Compute content hash
-	hash := computeHash(f)
+	p := a.opts.planEngine(files, dims)
+	l.Info("index engine", "engine", p.engine, "reason", p.reason, "files", files)
 
-	// Determine if file has changed
-	match, err := db.MatchHash(ctx, path, hash)
-	if err != nil {
-		l.Error("Failed to compare hash", "error", err)
-		return nil
+	var opts []index.Option
+	if a.opts.f16 {
+		opts = append(opts, index.WithFloat16())
 	}
-
-	// If hash is the same, file has not changed
-	if match {
-		// get from db
-		b, err := db.Get(ctx, []string{path})
-		if err != nil {
-			l.Error("Failed to get embedding", "error", err)
-			return nil
+	if a.opts.deterministic {
+		opts = append(opts, index.WithSeed(deterministicSeed))
+	}
+	switch p.engine {
+	case engineDuckDB:
+		idx, err := index.NewDuckDBIndexService(ctx, a.database, !p.scan, func(err error) { l.Warn("DuckDB index failed", "error", err) })
+		if err == nil {
+			if !p.scan && !index.VSS(idx) {
+				l.Warn("DuckDB vss extension unavailable, searches scan every vector")
+			}
+			return idx
 		}
-		// Add to graph
-		mu.Lock()
-		g.Add(hnsw.MakeNode(path, b[0].Vector))
-		mu.Unlock()
-
-		// Skip
-		d1, d2, _ := getDistance(q, b[0].Vector)
-		l.Debug("match", "path", path, "d1", d1, "d2", d2)
-		return nil
+		l.Warn("Failed to create DuckDB index, using hnsw", "error", err)
+	case engineFlat:
+		if !p.grows {
+			// a single exhaustive scan is already parallel, shards add nothing
+			return index.NewExactIndexService(opts...)
+		}
+		opts = append(opts, index.WithFlatLimit(a.opts.flatLimit))
+	}
+	if a.opts.shard {
+		return index.NewShardedIndexService(shardOf, opts...)
 	}
+	return index.NewIndexService(opts...)
+}
 
-	// Embed
-	vec, meta, err := emb.Get(ctx, string(f))
-	// vec, meta, err := emb.Voyage(vKey, string(f))
+// store returns the storage service scoped to namespace ns, opened on first
+// use.
+func (a *app) store(ns string) (store.StorageService, error) {
+	a.storesMu.Lock()
+	defer a.storesMu.Unlock()
+	if s, ok := a.stores[ns]; ok {
+		return s, nil
+	}
+	opts := append([]store.Option{store.WithNamespace(ns)}, a.storeOpts...)
+	s, err := store.NewStorageService(a.database, opts...)
 	if err != nil {
-		l.Error("Failed to embed text", "error", err)
-		return nil
+		return nil, err
 	}
-
-	// Upsert
-	if err := db.Upsert(ctx, path, hash, vec); err != nil {
-		l.Error("Failed to create embedding", "error", err)
-		return nil
+	if a.stores == nil {
+		a.stores = map[string]store.StorageService{}
 	}
+	a.stores[ns] = s
+	return s, nil
+}
 
-	// Add to graph
-	mu.Lock()
-	g.Add(hnsw.MakeNode(path, vec))
-	mu.Unlock()
-
-	d1, d2, _ := getDistance(q, vec)
+func getDistance(q, v []float32) (float32, float32, float32) {
+	d1 := index.CosineDistance(q, v)
+	d2 := index.EuclideanDistance(q, v)
+	return d1, d2, d2 * d2
+}
 
-	l.Debug("diff", "path", path, "d1", d1, "d2", d2, "emb_ms", meta.Duration, "tokens", meta.Tokens, "total_ms", time.Since(start).Milliseconds())
-	return nil
+// computeHash returns the MD5 hash of the given data
+func computeHash(data []byte) string {
+	hasher := md5.New()
+	hasher.Write(data)
+	return hex.EncodeToString(hasher.Sum(nil))
 }
 
 // promptForUserQuery prompts the user to input a search query
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	embed "github.com/codectx/tokens/services/embed"
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+const (
+	// segmentLines is the number of non-blank lines embedded together as a
+	// segment of a file by -multi-vector-weight.
+	segmentLines = 4
+	// queryWordVectors caps the number of words of a query embedded apart.
+	queryWordVectors = 16
+)
+
+// segments splits text into runs of segmentLines non-blank lines.
+func segments(text string) []string {
+	var (
+		out []string
+		cur []string
+	)
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if cur = append(cur, line); len(cur) == segmentLines {
+			out = append(out, strings.Join(cur, "\n"))
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		out = append(out, strings.Join(cur, "\n"))
+	}
+	return out
+}
+
+// recordMultiVectors embeds the segments of the file id one by one for
+// -multi-vector-weight, unless they were embedded from the same text.
+func recordMultiVectors(ctx context.Context, a *app, db store.StorageService, id, language, text string) error {
+	hash := computeHash([]byte(text))
+	if match, err := db.MatchMultiVectors(ctx, id, hash); err != nil || match {
+		return err
+	}
+	var vectors [][]float32
+	for _, seg := range segments(text) {
+		vec, _, err := a.embedText(ctx, id, language, seg)
+		if err != nil {
+			return err
+		}
+		vectors = append(vectors, vec)
+	}
+	return db.ReplaceMultiVectors(ctx, id, hash, vectors)
+}
+
+// queryVectors returns the vectors of req.Query late interaction matches
+// segments with: that of the whole query, then those of its distinct words.
+func queryVectors(ctx context.Context, a *app, req searchRequest) ([][]float32, error) {
+	out := [][]float32{req.Vector}
+	var words []string
+	for _, w := range strings.Fields(strings.ToLower(a.cleaner.Clean(req.Query))) {
+		if len([]rune(w)) > 1 && !slices.Contains(words, w) && len(words) < queryWordVectors {
+			words = append(words, w)
+		}
+	}
+	// a single word is the query itself
+	if len(words) < 2 {
+		return out, nil
+	}
+	for _, w := range words {
+		vec, _, err := a.emb.Get(embed.AsQuery(ctx), w)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, vec)
+	}
+	return out, nil
+}
+
+// maxSim returns the late interaction distance of the query vectors to the
+// segments of a file: one minus the mean, over the query vectors, of their
+// best cosine similarity to a segment.
+func maxSim(query, segments [][]float32) float32 {
+	var sum float32
+	for _, q := range query {
+		best := float32(-1)
+		for _, s := range segments {
+			best = max(best, 1-index.CosineDistance(q, s))
+		}
+		sum += best
+	}
+	return 1 - sum/float32(len(query))
+}
+
+// multiVectorDistances returns the late interaction distance of req to each
+// of hits with segments.
+func multiVectorDistances(ctx context.Context, a *app, db store.StorageService, req searchRequest, hits []hit) (map[string]float32, error) {
+	ids := make([]string, len(hits))
+	for i, h := range hits {
+		ids[i] = h.ID
+	}
+	multi, err := db.MultiVectors(ctx, ids...)
+	if err != nil || len(multi) == 0 {
+		return nil, err
+	}
+	query, err := queryVectors(ctx, a, req)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]float32, len(multi))
+	for id, segs := range multi {
+		// segments embedded by another model
+		if len(segs[0]) == len(req.Vector) {
+			out[id] = maxSim(query, segs)
+		}
+	}
+	return out, nil
+}
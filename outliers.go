@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	cluster "github.com/codectx/tokens/services/cluster"
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// outliersSchema is the schema of the JSON output of outliers.
+const outliersSchema = "codectx.outliers/v1"
+
+const (
+	// outlierDistance is the default minimum distance of an outlier chunk
+	// to the centroids of the topics queries find.
+	outlierDistance = 0.35
+	// outlierLimit is the default number of outlier chunks listed.
+	outlierLimit = 20
+)
+
+// outlier is a chunk far from every topic the queries find.
+type outlier struct {
+	Path      string `json:"path"`
+	ChunkID   string `json:"chunk_id"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	// Distance is the cosine distance to the nearest centroid of a topic
+	// the queries find.
+	Distance float32 `json:"distance"`
+}
+
+// outliersOutput is the JSON output of outliers, schema codectx.outliers/v1.
+type outliersOutput struct {
+	Schema  string `json:"schema"`
+	Index   string `json:"index"`
+	Queries int    `json:"queries"`
+	// Orphans are the files in none of the top k results of the queries.
+	Orphans  []string  `json:"orphans"`
+	Outliers []outlier `json:"outliers"`
+}
+
+// runOutliers runs a standard set of queries, the saved queries and those
+// of -queries, and reports the files none of them finds, then the chunks
+// farthest from the topics they find. Either hints at dead or undocumented
+// code. Topics are k-means clusters of the chunk vectors; a topic is found
+// when one of its chunks is among the k nearest chunks of a query.
+func runOutliers(ctx context.Context, args []string) error {
+	fs := newFlagSet("outliers")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeVector) // needs embeddings
+	queriesFile := fs.String("queries", "", "file with one query per line, in addition to the saved queries")
+	k := fs.Int("k", defaultTopK, "number of results of the queries of -queries, and of chunks found per query")
+	distance := fs.Float64("distance", outlierDistance, "minimum cosine distance of outlier chunks to the topics the queries find")
+	limit := fs.Int("limit", outlierLimit, "number of outlier chunks listed, farthest first")
+	minLines := fs.Int("min-lines", dupeLines, "minimum number of non-blank lines of the chunks compared")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if *k < 1 || *limit < 0 {
+		return fmt.Errorf("invalid -k %d or -limit %d", *k, *limit)
+	}
+	wd := "."
+	if fs.NArg() > 0 {
+		wd = fs.Arg(0)
+	}
+	// keep stdout for the report
+	l := newLogger(os.Stderr)
+	ctx = context.WithValue(ctx, LoggerCtxKey, l)
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	qs, err := store.NewQueryStore(a.database)
+	if err != nil {
+		return err
+	}
+	saved, err := qs.List(ctx)
+	if err != nil {
+		return err
+	}
+	if *queriesFile != "" {
+		lines, err := readLines(*queriesFile)
+		if err != nil {
+			return fmt.Errorf("failed to read queries: %w", err)
+		}
+		for _, q := range lines {
+			saved = append(saved, store.SavedQuery{Query: q, K: *k})
+		}
+	}
+	if len(saved) == 0 {
+		return fmt.Errorf("no queries: save some with `queries save NAME QUERY` or pass -queries")
+	}
+
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+	idx, err := loadIndex(ctx, a, o.namespace)
+	if err != nil {
+		return err
+	}
+	ids, err := db.IDs(ctx)
+	if err != nil {
+		return err
+	}
+	chunks, err := embedChunks(ctx, a, db, src, ids)
+	if err != nil {
+		return err
+	}
+	chunks = comparableChunks(ctx, a, src, chunks, *minLines)
+
+	// k-means is deterministic for vectors in the same order
+	vectors := make([][]float32, len(chunks))
+	chunkIdx := index.NewExactIndexService()
+	position := make(map[string]int, len(chunks))
+	for i, c := range chunks {
+		vectors[i] = c.Vector
+		chunkIdx.Add(c.ID, c.Vector)
+		position[c.ID] = i
+	}
+	topics := cluster.KMeans(vectors, topicCount(len(chunks)))
+	topicOf := make([]int, len(chunks))
+	for t, group := range topics {
+		for _, i := range group {
+			topicOf[i] = t
+		}
+	}
+
+	found := map[string]bool{}
+	foundTopics := map[int]bool{}
+	for _, q := range saved {
+		vec, _, err := a.embedQuery(ctx, q.Query)
+		if err != nil {
+			return fmt.Errorf("failed to embed query %q: %w", q.Query, err)
+		}
+		hits, err := searchIndex(ctx, a, db, idx, searchRequest{Query: q.Query, Vector: vec, K: q.K, Root: wd})
+		if err != nil {
+			return err
+		}
+		for _, h := range hits {
+			found[h.ID] = true
+		}
+		for _, r := range chunkIdx.Search(vec, *k) {
+			foundTopics[topicOf[position[r.ID]]] = true
+		}
+	}
+
+	out := outliersOutput{Schema: outliersSchema, Index: displayName(o.namespace), Queries: len(saved), Orphans: []string{}, Outliers: []outlier{}}
+	for _, id := range ids {
+		if !found[id] {
+			out.Orphans = append(out.Orphans, relPath(wd, id))
+		}
+	}
+	sort.Strings(out.Orphans)
+
+	var centroids [][]float32
+	for t, group := range topics {
+		if !foundTopics[t] {
+			continue
+		}
+		members := make([][]float32, len(group))
+		for i, v := range group {
+			members[i] = vectors[v]
+		}
+		centroids = append(centroids, cluster.Centroid(members))
+	}
+	for _, c := range chunks {
+		if len(centroids) == 0 {
+			break
+		}
+		nearest := index.CosineDistance(c.Vector, centroids[0])
+		for _, centroid := range centroids[1:] {
+			nearest = min(nearest, index.CosineDistance(c.Vector, centroid))
+		}
+		if float64(nearest) >= *distance {
+			out.Outliers = append(out.Outliers, outlier{Path: relPath(wd, c.File), ChunkID: c.ID, StartLine: c.StartLine, EndLine: c.EndLine, Distance: nearest})
+		}
+	}
+	sort.SliceStable(out.Outliers, func(i, j int) bool { return out.Outliers[i].Distance > out.Outliers[j].Distance })
+	out.Outliers = out.Outliers[:min(len(out.Outliers), *limit)]
+	l.Info("outliers", "index", out.Index, "queries", len(saved), "topics", len(topics), "found", len(foundTopics),
+		"orphans", len(out.Orphans), "outliers", len(out.Outliers))
+
+	if o.json {
+		return json.NewEncoder(os.Stdout).Encode(out)
+	}
+	fmt.Printf("Files found by none of %d queries (%d):\n", len(saved), len(out.Orphans))
+	for _, p := range out.Orphans {
+		fmt.Printf("  %s\n", p)
+	}
+	fmt.Printf("\nChunks farthest from the topics the queries find (%d):\n", len(out.Outliers))
+	for _, c := range out.Outliers {
+		fmt.Printf("  %.3f  %s:%d-%d\n", c.Distance, c.Path, c.StartLine, c.EndLine)
+	}
+	return nil
+}
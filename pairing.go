@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+
+	detect "github.com/codectx/tokens/services/detect"
+	store "github.com/codectx/tokens/services/store"
+	symbols "github.com/codectx/tokens/services/symbols"
+)
+
+const (
+	// testsKeep ranks test files like any other file.
+	testsKeep = "keep"
+	// testsExclude leaves test files out of results.
+	testsExclude = "exclude"
+	// testsPair lists the tests of each result along with it.
+	testsPair = "pair"
+	// pairedTests bounds the number of tests listed per result.
+	pairedTests = 5
+)
+
+// testFile is an indexed test file.
+type testFile struct {
+	id string
+	// subject is the base name of the file it tests, when its name gives it.
+	subject  string
+	language string
+	imports  []string
+}
+
+// isTest reports whether the file id under root is a test file.
+func isTest(root, id string) bool {
+	_, ok := detect.Test(relPath(root, id))
+	return ok
+}
+
+// pairTests sets the Tests of every hit that isn't a test itself: first the
+// test files named after it, nearest first, then those importing it, such
+// as the Go tests of its package or the JavaScript tests importing it by a
+// relative path.
+func pairTests(ctx context.Context, a *app, db store.StorageService, src source, root string, hits []hit) error {
+	ids, err := db.IDs(ctx)
+	if err != nil {
+		return err
+	}
+	var tests []testFile
+	for _, id := range ids {
+		subject, ok := detect.Test(relPath(root, id))
+		if !ok {
+			continue
+		}
+		t := testFile{id: id, subject: subject}
+		// tests removed since they were indexed import nothing
+		if text, err := readText(ctx, a, src, id); err == nil {
+			t.language = detect.Language(id, []byte(text))
+			t.imports = symbols.Imports(t.language, text)
+		}
+		tests = append(tests, t)
+	}
+
+	for i := range hits {
+		h := &hits[i]
+		h.Tests = nil
+		if isTest(root, h.ID) {
+			continue
+		}
+		stem := strings.TrimSuffix(path.Base(h.ID), path.Ext(h.ID))
+		var named, importing []string
+		for _, t := range tests {
+			switch {
+			case t.subject == stem:
+				named = append(named, t.id)
+			case importsFile(t, root, h.ID):
+				importing = append(importing, t.id)
+			}
+		}
+		sort.SliceStable(named, func(i, j int) bool {
+			return sharedDirs(named[i], h.ID) > sharedDirs(named[j], h.ID)
+		})
+		if tests := append(named, importing...); len(tests) > 0 {
+			h.Tests = tests[:min(len(tests), pairedTests)]
+		}
+	}
+	return nil
+}
+
+// importsFile reports whether the test t imports the file id under root.
+func importsFile(t testFile, root, id string) bool {
+	dir := path.Dir(id)
+	noExt := strings.TrimSuffix(id, path.Ext(id))
+	if t.language == "go" && path.Ext(id) == ".go" {
+		// tests of the package, or of another importing it
+		if path.Dir(t.id) == dir {
+			return true
+		}
+		rel := relPath(root, dir)
+		for _, imp := range t.imports {
+			if rel != "." && strings.HasSuffix(imp, "/"+rel) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, imp := range t.imports {
+		var target string
+		switch {
+		case strings.HasPrefix(imp, "./") || strings.HasPrefix(imp, "../"):
+			target = path.Join(path.Dir(t.id), imp)
+		case t.language == "python" && strings.HasPrefix(imp, "."):
+			// from .module or ..package.module
+			up := len(imp) - len(strings.TrimLeft(imp, "."))
+			base := path.Dir(t.id)
+			for i := 1; i < up; i++ {
+				base = path.Dir(base)
+			}
+			target = path.Join(base, strings.ReplaceAll(imp[up:], ".", "/"))
+		case t.language == "c" || t.language == "cpp":
+			target = path.Join(path.Dir(t.id), imp)
+		default:
+			// dotted or qualified modules, matched by the end of the path
+			mod := strings.NewReplacer(".", "/", "::", "/", `\`, "/").Replace(imp)
+			mod = strings.TrimPrefix(strings.TrimPrefix(mod, "crate/"), "super/")
+			if strings.HasSuffix(noExt, "/"+mod) {
+				return true
+			}
+			continue
+		}
+		if target == id || target == noExt || target+"/index" == noExt ||
+			strings.TrimSuffix(target, path.Ext(target)) == noExt {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedDirs counts the leading directories the paths a and b have in
+// common.
+func sharedDirs(a, b string) int {
+	as, bs := strings.Split(path.Dir(a), "/"), strings.Split(path.Dir(b), "/")
+	n := 0
+	for n < len(as) && n < len(bs) && as[n] == bs[n] {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Windows prefixes of paths longer than MAX_PATH, which ids never carry.
+const (
+	longPathPrefix = `\\?\`
+	longUNCPrefix  = `\\?\UNC\`
+)
+
+// pathID returns the id of the file at the OS path p: p with forward slashes
+// and without the long path prefix of Windows, so that an index built on
+// Windows matches the same files however their path was spelled, and reads
+// the same on other platforms. The os package adds the prefix back to long
+// paths by itself.
+func pathID(p string) string {
+	switch {
+	case strings.HasPrefix(p, longUNCPrefix):
+		p = `\\` + p[len(longUNCPrefix):]
+	case strings.HasPrefix(p, longPathPrefix):
+		p = p[len(longPathPrefix):]
+	}
+	return filepath.ToSlash(p)
+}
+
+// osPath returns the OS path of the file with id.
+func osPath(id string) string {
+	return filepath.FromSlash(id)
+}
+
+// caseInsensitive reports whether the filesystem holding dir ignores case in
+// file names, as it does by default on Windows and macOS. It is probed by
+// looking dir up with its case swapped, and is false when dir has no letters.
+func caseInsensitive(dir string) bool {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	swapped := strings.Map(func(r rune) rune {
+		if unicode.IsUpper(r) {
+			return unicode.ToLower(r)
+		}
+		return unicode.ToUpper(r)
+	}, abs)
+	if swapped == abs {
+		return false
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return false
+	}
+	other, err := os.Stat(swapped)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(info, other)
+}
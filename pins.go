@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+	goignore "github.com/cyber-nic/go-gitignore"
+)
+
+// pathRules are the patterns of an index pinned with `pin` and excluded
+// with `exclude`, matched against file ids like those of .astignore.
+type pathRules struct {
+	pin, exclude *goignore.GitIgnore
+	// sum tells the rules apart, empty without any.
+	sum string
+}
+
+// loadPathRules returns the path rules of the index of db, none when they
+// can't be read.
+func loadPathRules(ctx context.Context, db store.StorageService) pathRules {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	rules, err := db.PathRules(ctx)
+	if err != nil {
+		l.Debug("no path rules", "error", err)
+		return pathRules{}
+	}
+	if len(rules) == 0 {
+		return pathRules{}
+	}
+	var pins, excludes []string
+	h := sha1.New()
+	for _, r := range rules {
+		switch r.Rule {
+		case store.RulePin:
+			pins = append(pins, r.Pattern)
+		case store.RuleExclude:
+			excludes = append(excludes, r.Pattern)
+		}
+		fmt.Fprintf(h, "%s\x00%s\n", r.Rule, r.Pattern)
+	}
+	return pathRules{pin: globs(pins), exclude: globs(excludes), sum: hex.EncodeToString(h.Sum(nil))[:10]}
+}
+
+// pinned reports whether the file id is pinned.
+func (r pathRules) pinned(id string) bool {
+	return r.pin != nil && r.pin.MatchesPath(id) && !r.excluded(id)
+}
+
+// excluded reports whether the file id is excluded, which wins over a pin.
+func (r pathRules) excluded(id string) bool {
+	return r.exclude != nil && r.exclude.MatchesPath(id)
+}
+
+// refreshPinned handles the stored files pinned by rules again, so that
+// searches find them as they are on disk however long ago the tree was
+// indexed. Unchanged files are skipped by their hash, and files gone from
+// disk are left out of idx.
+func refreshPinned(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, src source, rules pathRules) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	if rules.pin == nil || a.emb == nil || a.readOnly {
+		return
+	}
+	ids, err := db.IDs(ctx)
+	if err != nil {
+		l.Error("Failed to list files", "error", err)
+		return
+	}
+	for _, id := range ids {
+		if !rules.pinned(id) {
+			continue
+		}
+		// a file begun is written whole, even once ctx is done
+		err := handleAndRecord(context.WithoutCancel(ctx), a, db, idx, src, nil, id)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			idx.Delete(id)
+		case err != nil:
+			l.Error("Failed to handle file", "error", err)
+		}
+	}
+}
+
+// rulePattern returns the pattern of arg with forward slashes and without
+// a leading ./, so that it matches file ids, keeping the trailing slash of
+// directories.
+func rulePattern(arg string) string {
+	pattern := pathID(filepath.Clean(arg))
+	if strings.HasSuffix(arg, "/") || strings.HasSuffix(arg, string(filepath.Separator)) {
+		pattern += "/"
+	}
+	return pattern
+}
+
+// runPin pins paths: the files they match are re-checked before every
+// search.
+func runPin(ctx context.Context, args []string) error {
+	return runPathRule(ctx, "pin", store.RulePin, args)
+}
+
+// runExclude excludes paths: the files they match are left out of indexing
+// and of results, without editing ignore files.
+func runExclude(ctx context.Context, args []string) error {
+	return runPathRule(ctx, "exclude", store.RuleExclude, args)
+}
+
+// runPathRule applies rule to the patterns of args, or with -remove drops
+// their rules, or with -list lists the rules of the index.
+func runPathRule(ctx context.Context, command, rule string, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet(command)
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeLexical) // rules don't embed
+	remove := fs.Bool("remove", false, "drop the rules of the patterns instead, pins and exclusions alike")
+	list := fs.Bool("list", false, "list the pinned and excluded patterns of the index")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if !*list && fs.NArg() == 0 {
+		return fmt.Errorf("usage: %s [flags] PATTERN...", command)
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+
+	if *list {
+		rules, err := db.PathRules(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PATTERN\tRULE\tADDED")
+		for _, r := range rules {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.Pattern, r.Rule, r.Added.Local().Format("2006-01-02 15:04:05"))
+		}
+		return w.Flush()
+	}
+	if a.readOnly {
+		return fmt.Errorf("%s needs to write to the database", command)
+	}
+	for _, arg := range fs.Args() {
+		pattern := rulePattern(arg)
+		if *remove {
+			had, err := db.DeletePathRule(ctx, pattern)
+			if err != nil {
+				return err
+			}
+			if !had {
+				l.Warn("no rule to remove", "pattern", pattern)
+			}
+			continue
+		}
+		if err := db.SetPathRule(ctx, pattern, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
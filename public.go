@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// validatePublic checks the -public flags: the demo is anonymous, so
+// -tokens is refused rather than half applied.
+func (so *serveOptions) validatePublic() error {
+	if !so.public {
+		return nil
+	}
+	switch {
+	case so.tokensFile != "":
+		return errors.New("-public serves anonymous requests: drop -tokens")
+	case so.publicRPS <= 0:
+		return errors.New("-public-rps must be positive")
+	case so.publicMaxK < 1:
+		return errors.New("-public-max-k must be at least 1")
+	case so.publicSnippet < 0:
+		return errors.New("-public-snippet can't be negative")
+	}
+	return nil
+}
+
+// limited serves h to each client address within -public-rps, and 429
+// beyond.
+func (s *server) limited(h http.HandlerFunc) http.HandlerFunc {
+	if !s.flags.public {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.limiter.Allow(clientAddr(r)) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// clientAddr returns the IP address a request comes from. Behind a reverse
+// proxy, every request comes from the proxy.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parseAllowlist returns the files of -public-paths, comma-separated paths
+// relative to the served path root, with the ids walking root gives them.
+func parseAllowlist(root, paths string) contextFiles {
+	var out contextFiles
+	for _, p := range strings.Split(paths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, pathID(filepath.Join(root, p)))
+		}
+	}
+	return out
+}
+
+// allowed reports whether the file id may be returned to the public: any
+// file unless -public-paths lists some.
+func (s *server) allowed(id string) bool {
+	return len(s.allowlist) == 0 || s.allowlist.has(id)
+}
+
+// publicHits removes from hits what the public may not read: the paired
+// test files outside -public-paths, the results being filtered by search.
+func (s *server) publicHits(hits []hit) {
+	for i := range hits {
+		hits[i].Tests = slices.DeleteFunc(hits[i].Tests, func(id string) bool { return !s.allowed(id) })
+	}
+}
+
+// clip cuts text to -public-snippet characters in public mode.
+func (s *server) clip(text string) string {
+	n := s.flags.publicSnippet
+	if !s.flags.public || utf8.RuneCountInString(text) <= n {
+		return text
+	}
+	for i := range text {
+		if n == 0 {
+			return text[:i]
+		}
+		n--
+	}
+	return text
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	store "github.com/codectx/tokens/services/store"
+)
+
+// runQueries manages saved queries: save, list, delete, and run, which
+// compares the results against the previous run of each query.
+func runQueries(ctx context.Context, args []string) error {
+	fs := newFlagSet("queries")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeVector) // needs embeddings
+	k := fs.Int("k", defaultTopK, "number of results kept per saved query")
+	update := fs.Bool("update", true, "with run, record the new results as the baseline of the next run")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	qs, err := store.NewQueryStore(a.database)
+	if err != nil {
+		return err
+	}
+
+	switch action := fs.Arg(0); action {
+	case "save":
+		if fs.NArg() != 3 {
+			return fmt.Errorf("usage: queries save NAME QUERY")
+		}
+		return qs.Save(ctx, store.SavedQuery{Name: fs.Arg(1), Query: fs.Arg(2), K: *k})
+	case "delete":
+		if fs.NArg() != 2 {
+			return fmt.Errorf("usage: queries delete NAME")
+		}
+		return qs.Remove(ctx, fs.Arg(1))
+	case "list":
+		saved, err := qs.List(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tK\tQUERY")
+		for _, q := range saved {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", q.Name, q.K, q.Query)
+		}
+		return w.Flush()
+	case "run":
+		return runSavedQueries(ctx, a, qs, fs.Args()[1:], *update)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+// runSavedQueries runs the named saved queries, or all of them, against the
+// stored index and prints how their results changed since the last run.
+func runSavedQueries(ctx context.Context, a *app, qs store.QueryStore, names []string, update bool) error {
+	saved, err := qs.List(ctx)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		wanted := map[string]bool{}
+		for _, n := range names {
+			wanted[n] = true
+		}
+		var selected []store.SavedQuery
+		for _, q := range saved {
+			if wanted[q.Name] {
+				selected = append(selected, q)
+				delete(wanted, q.Name)
+			}
+		}
+		for n := range wanted {
+			return fmt.Errorf("no saved query named %q", n)
+		}
+		saved = selected
+	}
+	if len(saved) == 0 {
+		return fmt.Errorf("no saved queries: add one with `queries save NAME QUERY`")
+	}
+
+	ns := a.opts.namespace
+	db, err := a.store(ns)
+	if err != nil {
+		return err
+	}
+	idx, err := loadIndex(ctx, a, ns)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 1, ' ', 0)
+	for _, q := range saved {
+		vec, _, err := a.embedQuery(ctx, q.Query)
+		if err != nil {
+			return fmt.Errorf("failed to embed query %q: %w", q.Name, err)
+		}
+		hits, err := searchIndex(ctx, a, db, idx, searchRequest{Query: q.Query, Vector: vec, K: q.K, Author: a.opts.author, Languages: a.opts.languages()})
+		if err != nil {
+			return err
+		}
+		if err := db.LogQuery(ctx, queryID(q.Query), q.Query); err != nil {
+			return err
+		}
+		current := make([]store.SavedResult, len(hits))
+		for i, h := range hits {
+			current[i] = store.SavedResult{Rank: i + 1, Path: h.ID, Score: h.Score}
+		}
+
+		previous, runAt, err := qs.Results(ctx, q.Name, ns)
+		if err != nil {
+			return err
+		}
+		printResultDiff(w, q, previous, runAt, current)
+
+		if update {
+			if err := qs.SetResults(ctx, q.Name, ns, current); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// printResultDiff lists the current results of q, marking each as new (+),
+// unchanged (=), moved up (^) or down (v), followed by the dropped ones (-).
+func printResultDiff(w *tabwriter.Writer, q store.SavedQuery, previous []store.SavedResult, runAt time.Time, current []store.SavedResult) {
+	if len(previous) == 0 {
+		fmt.Fprintf(w, "\n%s: %q [%s] (first run)\n", q.Name, q.Query, queryID(q.Query))
+	} else {
+		fmt.Fprintf(w, "\n%s: %q [%s] (compared to %s)\n", q.Name, q.Query, queryID(q.Query), runAt.Format("2006-01-02 15:04"))
+	}
+
+	was := make(map[string]int, len(previous))
+	for _, r := range previous {
+		was[r.Path] = r.Rank
+	}
+	var moved int
+	seen := map[string]bool{}
+	for _, r := range current {
+		seen[r.Path] = true
+		mark, note := "+", "new"
+		if len(previous) == 0 {
+			mark, note = " ", ""
+		} else if old, ok := was[r.Path]; ok {
+			switch {
+			case old == r.Rank:
+				mark, note = "=", ""
+			case old > r.Rank:
+				mark, note = "^", fmt.Sprintf("was #%d", old)
+			default:
+				mark, note = "v", fmt.Sprintf("was #%d", old)
+			}
+		}
+		if mark != "=" && mark != " " {
+			moved++
+		}
+		fmt.Fprintf(w, "  %s\t#%d\t%s\t%.4f\t%s\n", mark, r.Rank, r.Path, r.Score, note)
+	}
+	for _, r := range previous {
+		if !seen[r.Path] {
+			moved++
+			fmt.Fprintf(w, "  -\t\t%s\t%.4f\twas #%d\n", r.Path, r.Score, r.Rank)
+		}
+	}
+	if len(previous) > 0 && moved == 0 {
+		fmt.Fprintln(w, "  unchanged")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	store "github.com/codectx/tokens/services/store"
+)
+
+// Priorities of the indexing queue, dequeued highest first.
+const (
+	// priorityHigh is for files just opened or edited.
+	priorityHigh = iota
+	// priorityNormal is for files already indexed, re-embedded if changed.
+	priorityNormal
+	// priorityLow is for the backfill of files not indexed yet.
+	priorityLow
+	priorities
+)
+
+// recentEdit is how long a file is indexed first after it is modified or
+// named as open by an editor.
+const recentEdit = 10 * time.Minute
+
+// queue is the indexing queue: the walk pushes paths at a priority and the
+// workers pop the oldest path of the highest priority waiting.
+type queue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	levels [priorities][]string
+	counts [priorities]int
+	closed bool
+}
+
+func newQueue() *queue {
+	q := &queue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// waiting returns the number of paths waiting, by priority.
+func (q *queue) waiting() [priorities]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var n [priorities]int
+	for p := range q.levels {
+		n[p] = len(q.levels[p])
+	}
+	return n
+}
+
+// push enqueues path at priority p.
+func (q *queue) push(path string, p int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.levels[p] = append(q.levels[p], path)
+	q.counts[p]++
+	q.cond.Signal()
+}
+
+// close tells the workers no more paths will be pushed.
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// pop blocks until a path is waiting and returns it, or returns false once
+// the queue is closed and empty.
+func (q *queue) pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for p := range q.levels {
+			if len(q.levels[p]) > 0 {
+				path := q.levels[p][0]
+				q.levels[p] = q.levels[p][1:]
+				return path, true
+			}
+		}
+		if q.closed {
+			return "", false
+		}
+		q.cond.Wait()
+	}
+}
+
+// opened records the files editors and agents report holding, which are
+// indexed first for recentEdit.
+type opened struct {
+	mu    sync.Mutex
+	files map[string]time.Time
+}
+
+// add records files as opened now.
+func (o *opened) add(files contextFiles) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.files == nil {
+		o.files = map[string]time.Time{}
+	}
+	for _, f := range files {
+		o.files[f] = time.Now()
+	}
+}
+
+// has reports whether id, or a directory holding it, was opened within
+// recentEdit, forgetting older entries.
+func (o *opened) has(id string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var recent contextFiles
+	for f, at := range o.files {
+		if time.Since(at) > recentEdit {
+			delete(o.files, f)
+			continue
+		}
+		recent = append(recent, f)
+	}
+	return recent.has(id)
+}
+
+// indexedFiles returns the set of files db holds, to tell the backfill of
+// new files apart.
+func indexedFiles(ctx context.Context, db store.StorageService) map[string]bool {
+	ids, err := db.IDs(ctx)
+	if err != nil {
+		return nil
+	}
+	known := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		known[id] = true
+	}
+	return known
+}
+
+// priority returns the queue priority of the file id: high when opened or
+// modified within recentEdit, low when not indexed yet, else normal. The
+// modification time of files of a git revision isn't looked at. With
+// -deterministic every file is normal, indexed in walk order.
+func priority(a *app, known map[string]bool, id string) int {
+	if a.opts.deterministic {
+		return priorityNormal
+	}
+	if a.opened.has(id) {
+		return priorityHigh
+	}
+	if mtime, ok := modTime(a, id); ok && time.Since(mtime) < recentEdit {
+		return priorityHigh
+	}
+	if !known[id] {
+		return priorityLow
+	}
+	return priorityNormal
+}
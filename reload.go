@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// reloadable are the flags a running serve applies on reload: read by
+// every search request, and by nothing indexing in the background.
+var reloadable = map[string]bool{
+	"k":               true,
+	"path-weight":     true,
+	"lexical-weight":  true,
+	"grep":            true,
+	"not":             true,
+	"not-weight":      true,
+	"author":          true,
+	"lang":            true,
+	"tests":           true,
+	"in-context":      true,
+	"in-context-mode": true,
+	"by-dir":          true,
+	"depth":           true,
+	"explain":         true,
+	"log-level":       true,
+}
+
+// configReload is the JSON body returned by /config/reload.
+type configReload struct {
+	// Applied are the flags changed, with their new values.
+	Applied map[string]string `json:"applied"`
+	// Restart lists the flags changed that only apply once serve restarts.
+	Restart []string `json:"restart,omitempty"`
+}
+
+// reloadConfig parses the command line of serve again, with the config
+// files as they are now, and applies the reloadable flags that changed.
+// The indexes stay loaded; nothing is applied when the new flags are
+// invalid.
+func (s *server) reloadConfig() (configReload, error) {
+	if !s.ready.Load() {
+		return configReload{}, errors.New("the indexes are still loading")
+	}
+	fs, o, so := newServeFlags()
+	fs.Parse(s.args)
+	// validate sets the log level
+	level := logLevel.Level()
+	err := o.validate()
+	if err == nil {
+		err = so.validate()
+	}
+	if err != nil {
+		logLevel.Set(level)
+		return configReload{}, err
+	}
+
+	res := configReload{Applied: map[string]string{}}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, value := range parsedFlags(fs) {
+		if s.parsed[name] == value {
+			continue
+		}
+		// hybrid search needs the lexical index built at startup
+		if !reloadable[name] || name == "lexical-weight" && s.hybrid == nil && o.lexicalWeight > 0 {
+			res.Restart = append(res.Restart, name)
+			continue
+		}
+		// valid, it was just parsed
+		s.app.opts.fs.Set(name, value)
+		s.parsed[name] = value
+		res.Applied[name] = value
+	}
+	sort.Strings(res.Restart)
+	// the responses cached and tagged were searched with the previous
+	// defaults
+	if len(res.Applied) > 0 {
+		s.results.clear()
+		s.epoch = newEpoch()
+	}
+	return res, nil
+}
+
+// parsedFlags returns the values of the flags of fs, by name.
+func parsedFlags(fs *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	return values
+}
+
+// reconfigure reloads the configuration and logs the outcome.
+func (s *server) reconfigure() (configReload, error) {
+	res, err := s.reloadConfig()
+	if err != nil {
+		s.log.Error("failed to reload the configuration, keeping the current one", "error", err)
+		return res, err
+	}
+	s.log.Info("configuration reloaded", "applied", res.Applied)
+	if len(res.Restart) > 0 {
+		s.log.Warn("configuration changes that need a restart", "flags", res.Restart)
+	}
+	return res, nil
+}
+
+// reloadOnHangup reloads the configuration on every SIGHUP until ctx is
+// done.
+func (s *server) reloadOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			s.reconfigure()
+		}
+	}
+}
+
+// handleReload reloads the configuration and returns what changed. Only
+// tokens of the served namespace may reload it.
+func (s *server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if s.auth != nil {
+		t, ok := s.auth.Authenticate(bearerToken(r))
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if t.Namespace != s.namespace {
+			http.Error(w, "forbidden: the configuration belongs to the served namespace", http.StatusForbidden)
+			return
+		}
+	}
+	res, err := s.reconfigure()
+	if err != nil {
+		http.Error(w, "invalid configuration: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// runReload reloads the configuration of a running serve and prints the
+// flags that changed.
+func runReload(ctx context.Context, args []string) error {
+	fs := newFlagSet("reload")
+	addr := fs.String("addr", "http://localhost:8080", "URL of the running serve")
+	token := fs.String("token", "", "bearer token of the served namespace when serve has -tokens, else its -admin-token")
+	fs.Parse(args)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(*addr, "/")+"/config/reload", nil)
+	if err != nil {
+		return err
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reload the configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to reload the configuration: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var res configReload
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("failed to read the reloaded configuration: %w", err)
+	}
+	if len(res.Applied) == 0 && len(res.Restart) == 0 {
+		fmt.Println("configuration unchanged")
+	}
+	for _, name := range sortedKeys(res.Applied) {
+		fmt.Printf("-%s=%s\n", name, res.Applied[name])
+	}
+	if len(res.Restart) > 0 {
+		fmt.Printf("restart serve to apply: -%s\n", strings.Join(res.Restart, ", -"))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	remote "github.com/codectx/tokens/services/remote"
+)
+
+// runPush uploads the database file set by -db to -remote so that others
+// can search it.
+func runPush(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("push")
+	o := &options{}
+	o.register(fs)
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	r, err := remoteOf(o)
+	if err != nil {
+		return err
+	}
+	path, _, _ := strings.Cut(o.db, "?")
+	if strings.HasPrefix(path, motherDuckPrefix) {
+		return fmt.Errorf("cannot push %s: MotherDuck databases are already shared", path)
+	}
+
+	// Fold the write-ahead log into the database file before copying it
+	db, err := sql.Open("duckdb", path)
+	if err != nil {
+		return fmt.Errorf("failed to connect to DuckDB: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, "CHECKPOINT;"); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to checkpoint %s: %w", path, err)
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	if err := r.Push(ctx, path); err != nil {
+		return err
+	}
+	l.Info("pushed", "db", path, "remote", r.URL())
+	return nil
+}
+
+// runPull refreshes the cached copy of -remote regardless of its age.
+func runPull(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("pull")
+	o := &options{}
+	o.register(fs)
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+
+	r, err := remoteOf(o)
+	if err != nil {
+		return err
+	}
+	var stale error
+	path, err := remote.Cached(ctx, r, 0, func(err error) { stale = err })
+	if err != nil {
+		return err
+	}
+	if stale != nil {
+		return fmt.Errorf("failed to pull %s: %w", r.URL(), stale)
+	}
+	l.Info("pulled", "remote", r.URL(), "cache", path)
+	return nil
+}
+
+// remoteOf returns the remote set by -remote.
+func remoteOf(o *options) (remote.RemoteService, error) {
+	if o.remote == "" {
+		return nil, fmt.Errorf("no remote: set -remote or $CODECTX_REMOTE")
+	}
+	return remote.NewRemoteService(o.remote)
+}
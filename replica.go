@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// replica follows the snapshots of a database published by another process,
+// for serve -replica: a database file the writer replaces, e.g. by renaming
+// a copy over it, or a directory of backups whose latest is served.
+type replica struct {
+	source string
+	// dir holds the private copies of the snapshots, so that the writer can
+	// replace or rotate them while they are served.
+	dir string
+	// version identifies the snapshot last copied.
+	version string
+	copies  int
+}
+
+// newReplica returns a replica of source, copying its snapshots to a
+// temporary directory removed by Close.
+func newReplica(source string) (*replica, error) {
+	if _, err := os.Stat(source); err != nil {
+		return nil, fmt.Errorf("invalid -replica: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "codectx-replica-")
+	if err != nil {
+		return nil, err
+	}
+	return &replica{source: source, dir: dir}, nil
+}
+
+// latest returns the path of the current snapshot of the source and a
+// version that changes with it.
+func (r *replica) latest() (string, string, error) {
+	info, err := os.Stat(r.source)
+	if err != nil {
+		return "", "", err
+	}
+	if !info.IsDir() {
+		return r.source, fmt.Sprintf("%d@%d", info.Size(), info.ModTime().UnixNano()), nil
+	}
+	backups, err := listBackups(r.source)
+	if err != nil {
+		return "", "", err
+	}
+	if len(backups) == 0 {
+		return "", "", fmt.Errorf("no backups in %s", r.source)
+	}
+	name := backups[len(backups)-1]
+	return filepath.Join(r.source, name, databaseFile), name, nil
+}
+
+// fetch copies the current snapshot when it changed since the last one, and
+// returns the path of the copy, empty when it didn't change.
+func (r *replica) fetch() (string, error) {
+	path, version, err := r.latest()
+	if err != nil || version == r.version {
+		return "", err
+	}
+	if path != r.source {
+		if _, err := verifyBackup(filepath.Dir(path)); err != nil {
+			return "", fmt.Errorf("backup %s: %w", filepath.Dir(path), err)
+		}
+	}
+	r.copies++
+	dst := filepath.Join(r.dir, fmt.Sprintf("snapshot-%d.db", r.copies))
+	if err := copyFile(path, dst); err != nil {
+		return "", err
+	}
+	// A file written in place may have changed while it was copied
+	if _, again, err := r.latest(); err != nil || again != version {
+		os.Remove(dst)
+		return "", err
+	}
+	r.version = version
+	return dst, nil
+}
+
+// Close removes the copies of the snapshots.
+func (r *replica) Close() error {
+	return os.RemoveAll(r.dir)
+}
+
+// follow reloads the database and indexes of s from the latest snapshot of
+// r every interval, until ctx is done.
+func (s *server) follow(ctx context.Context, r *replica, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			path, err := r.fetch()
+			if err != nil {
+				s.log.Warn("failed to read replica snapshot, serving the previous one", "replica", r.source, "error", err)
+				continue
+			}
+			if path == "" {
+				continue
+			}
+			if err := s.reload(ctx, path); err != nil {
+				s.log.Warn("failed to load replica snapshot, serving the previous one", "replica", r.source, "error", err)
+				os.Remove(path)
+			}
+		}
+	}
+}
+
+// reload opens the snapshot at path read-only and builds the indexes of
+// every served namespace from it, then swaps them in at once. Requests in
+// flight finish on the previous snapshot, which is closed after them.
+func (s *server) reload(ctx context.Context, path string) error {
+	dsn, _, err := prepareDSN(path, true)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("duckdb", dsn)
+	if err != nil {
+		return err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return err
+	}
+
+	// a snapshot is a change of every index, whose version goes on from
+	// that of the previous one
+	s.mu.RLock()
+	namespaces := make([]string, 0, len(s.indexes))
+	versions := map[string]uint64{}
+	for ns, idx := range s.indexes {
+		namespaces = append(namespaces, ns)
+		versions[ns] = index.Version(idx)
+	}
+	s.mu.RUnlock()
+
+	indexes := make(map[string]index.IndexService, len(namespaces))
+	files := 0
+	for _, ns := range namespaces {
+		opts := append([]store.Option{store.WithNamespace(ns)}, s.app.storeOpts...)
+		nsdb, err := store.NewStorageService(db, opts...)
+		if err != nil {
+			db.Close()
+			return err
+		}
+		idx, err := loadIndexFrom(ctx, s.app, nsdb, ns)
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("failed to load namespace %q: %w", ns, err)
+		}
+		indexes[ns] = index.NewVersionedIndexService(idx, versions[ns]+1)
+		files += idx.Len()
+	}
+
+	s.mu.Lock()
+	old, oldPath := s.app.database, s.snapshot
+	s.app.database, s.indexes, s.snapshot = db, indexes, path
+	s.results.clear()
+	s.mu.Unlock()
+
+	old.Close()
+	if oldPath != "" {
+		os.Remove(oldPath)
+	}
+	s.log.Info("loaded replica snapshot", "namespaces", len(indexes), "files", files)
+	return nil
+}
+
+// locked serves h holding the read lock of s, so that a replica doesn't swap
+// the database and indexes under a request.
+func (s *server) locked(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		h(w, r)
+	}
+}
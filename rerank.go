@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sort"
+
+	plugin "github.com/codectx/tokens/services/plugin"
+)
+
+const (
+	// rerankDepth is how many of the best hits the -reranker plugin
+	// reorders, at least the number of results asked for.
+	rerankDepth = 20
+	// rerankChars bounds the text of each file sent to the reranker.
+	rerankChars = 4000
+)
+
+// rerank reorders the best hits of ranked, sorted by score, by the relevance
+// the -reranker plugin gives each of them for the query, setting their Rerank
+// score. Files are read from the working tree. On failure, the order is kept.
+func rerank(ctx context.Context, a *app, req searchRequest, ranked []hit) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	top := ranked[:min(len(ranked), max(req.K, rerankDepth))]
+	docs := make([]plugin.Document, len(top))
+	for i, h := range top {
+		docs[i].ID = h.ID
+		if f, err := os.ReadFile(osPath(h.ID)); err == nil {
+			text, _, _ := fileText(ctx, a, h.ID, f)
+			docs[i].Text = text[:min(len(text), rerankChars)]
+		}
+	}
+	scores, err := a.reranker.Rerank(ctx, req.Query, docs)
+	if err != nil {
+		l.Warn("Failed to rerank, keeping the vector order", "error", err)
+		return
+	}
+	for i := range top {
+		top[i].Rerank = &scores[i]
+	}
+	sort.SliceStable(top, func(i, j int) bool { return *top[i].Rerank > *top[j].Rerank })
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultCache holds the latest search responses of a server, so that
+// agents repeating a query in a tool loop get the same answer without
+// embedding it again. A nil cache holds nothing.
+type resultCache struct {
+	mu   sync.Mutex
+	size int
+	// order holds the cached responses, most recently used first.
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// cachedResult is a search response as written.
+type cachedResult struct {
+	key  string
+	body []byte
+}
+
+// newResultCache returns a cache of up to size responses, nil when size is 0.
+func newResultCache(size int) *resultCache {
+	if size <= 0 {
+		return nil
+	}
+	return &resultCache{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// resultKey identifies the response to the search parameters of a request of
+// namespace ns, while its index is at version, its store at generation and
+// its path rules are those of sum. The defaults the parameters fall back to
+// are those of the flags, which a reload clears the cache for.
+func resultKey(ns string, version, generation uint64, sum string, params url.Values) string {
+	return fmt.Sprintf("%s\x00%d\x00%d\x00%s\x00%s", ns, version, generation, sum, params.Encode())
+}
+
+// get returns the response cached under key.
+func (c *resultCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedResult).body, true
+}
+
+// put caches body under key, evicting the least recently used response once
+// full.
+func (c *resultCache) put(key string, body []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*cachedResult).body = body
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedResult{key: key, body: body})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResult).key)
+	}
+}
+
+// clear drops every cached response.
+func (c *resultCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	clear(c.entries)
+}
+
+// newEpoch returns a new epoch for the entity tags of a server.
+func newEpoch() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// etag returns the entity tag of the search responses of namespace ns at
+// version and generation, with the path rules of sum. Clients sending it
+// back in If-None-Match get 304 Not Modified until the index, the rows
+// stored alongside it or its rules change.
+func (s *server) etag(ns string, version, generation uint64, sum string) string {
+	if sum != "" {
+		return fmt.Sprintf(`"%s-%s-%d-%d-%s"`, s.epoch, ns, version, generation, sum)
+	}
+	return fmt.Sprintf(`"%s-%s-%d-%d"`, s.epoch, ns, version, generation)
+}
+
+// matchETag reports whether the If-None-Match header lists tag, or is *.
+// Weak tags match as well, If-None-Match comparing weakly.
+func matchETag(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeBody writes the JSON search response body, tagged with tag unless it
+// is empty. Clients may store it, revalidating it with its tag.
+func writeBody(w http.ResponseWriter, tag string, body []byte) {
+	if tag != "" {
+		w.Header().Set("ETag", tag)
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
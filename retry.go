@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// runRetryFailed re-embeds the files that failed during previous runs.
+func runRetryFailed(ctx context.Context, args []string) error {
+	flags := newFlagSet("retry-failed")
+	o := &options{}
+	o.register(flags)
+	flags.Set("mode", modeVector) // needs embeddings
+	list := flags.Bool("list", false, "only list the files waiting to be retried")
+	flags.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	wd := "."
+	if flags.NArg() > 0 {
+		wd = flags.Arg(0)
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+	if *list {
+		pending, err := db.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "PATH\tATTEMPTS\tLAST ATTEMPT\tERROR")
+		for _, r := range pending {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", r.ID, r.Attempts, r.LastAttempt.Format("2006-01-02 15:04:05"), r.Error)
+		}
+		return w.Flush()
+	}
+
+	return retryFailed(ctx, a, db, index.NewIndexService(), src, nil, true)
+}
+
+const (
+	// maxRetries is how many times a file fails before indexing runs stop
+	// retrying it; retry-failed still does.
+	maxRetries = 5
+	// retryBackoff is how long a file waits after its first failure to be
+	// retried, doubled with every further one.
+	retryBackoff = time.Minute
+)
+
+// retryDue reports whether r is retried by an indexing run at now: once its
+// backoff passed since its last attempt, and while it failed fewer than
+// maxRetries times.
+func retryDue(r store.Retry, now time.Time) bool {
+	if r.Attempts >= maxRetries {
+		return false
+	}
+	wait := retryBackoff << max(r.Attempts-1, 0)
+	return !now.Before(r.LastAttempt.Add(wait))
+}
+
+// queueRetry records that path failed to embed so it is retried later.
+func queueRetry(ctx context.Context, db store.StorageService, path string, cause error) error {
+	if err := db.RecordFailure(ctx, path, cause); err != nil {
+		return fmt.Errorf("%w (and failed to queue retry: %v)", cause, err)
+	}
+	return fmt.Errorf("%w (queued for retry)", cause)
+}
+
+// retryFailed re-handles the files in the retry queue, every one when all
+// is set, else only those retryDue, so that a file failing during a run
+// isn't handled again by the same run. Files that succeed, disappeared or
+// are unchanged since they were indexed leave the queue.
+func retryFailed(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, src source, q []float32, all bool) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	pending, err := db.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if !all {
+		now := time.Now()
+		pending = slices.DeleteFunc(pending, func(r store.Retry) bool { return !retryDue(r, now) })
+	}
+	var fixed int
+	for _, r := range pending {
+		if _, err := src.read(r.ID); errors.Is(err, fs.ErrNotExist) {
+			l.Debug("retry dropped", "path", r.ID)
+			if err := db.ClearFailure(ctx, r.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := a.throttle.wait(ctx); err != nil {
+			return err
+		}
+		if err := handleAndRecord(ctx, a, db, idx, src, q, r.ID); err != nil {
+			l.Debug("retry failed", "path", r.ID, "attempts", r.Attempts+1, "error", err)
+			continue
+		}
+		if err := db.ClearFailure(ctx, r.ID); err != nil {
+			return err
+		}
+		fixed++
+	}
+	if len(pending) > 0 {
+		l.Info("retried failed files", "pending", len(pending), "fixed", fixed, "failing", len(pending)-fixed)
+	}
+	return nil
+}
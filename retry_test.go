@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	store "github.com/codectx/tokens/services/store"
+)
+
+// TestRetryDue checks that failed files wait twice as long after every
+// failure, and stop being retried by indexing runs after maxRetries.
+func TestRetryDue(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		attempts int
+		ago      time.Duration
+		want     bool
+	}{
+		{"failed in this run", 1, 0, false},
+		{"first backoff", 1, time.Minute, true},
+		{"second failure", 2, time.Minute, false},
+		{"second backoff", 2, 2 * time.Minute, true},
+		{"fourth backoff", 4, 7 * time.Minute, false},
+		{"fourth backoff passed", 4, 8 * time.Minute, true},
+		{"gave up", maxRetries, 24 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		r := store.Retry{ID: "a.go", Attempts: tt.attempts, LastAttempt: now.Add(-tt.ago)}
+		if got := retryDue(r, now); got != tt.want {
+			t.Errorf("%s: retryDue = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	fuzzy "github.com/codectx/tokens/services/fuzzy"
+	index "github.com/codectx/tokens/services/index"
+	lexical "github.com/codectx/tokens/services/lexical"
+	store "github.com/codectx/tokens/services/store"
+)
+
+const (
+	generatedSkip       = "skip"
+	generatedDownweight = "downweight"
+	generatedKeep       = "keep"
+
+	// modeAuto searches vectors, falling back to lexical search when the
+	// embedding provider is unavailable.
+	modeAuto    = "auto"
+	modeVector  = "vector"
+	modeLexical = "lexical"
+
+	// generatedPenalty is added to the distance of generated files when
+	// they are down-weighted.
+	generatedPenalty = 0.2
+	// overfetch is how many extra candidates are considered per result so
+	// that re-ranking can promote hits beyond the raw top k.
+	overfetch = 4
+	// feedbackBoost is subtracted from the score of a result per net good
+	// judgment given to it for the same query, up to feedbackCap votes.
+	feedbackBoost = 0.05
+	feedbackCap   = 3
+)
+
+// searchRequest describes a single search.
+type searchRequest struct {
+	// Query is the raw query, used by lexical search.
+	Query string
+	// Vector is the embedded query.
+	Vector []float32
+	// K is the number of results to return.
+	K int
+	// Author, when set, only keeps files whose dominant author contains it.
+	Author string
+	// Languages, when set, only keeps files detected as one of them.
+	Languages []string
+	// Tests is how test files are treated, testsKeep when empty; only
+	// testsExclude changes ranking.
+	Tests string
+	// InContext are the files the caller already has in context, left out
+	// of results or down-ranked as InContextMode says, inContextExclude
+	// when empty.
+	InContext     contextFiles
+	InContextMode string
+	// Allowed, when set, only keeps the files under one of them, as serve
+	// -public-paths does.
+	Allowed contextFiles
+	// Paths, when set, only keeps the files matching one of these globs,
+	// and Kinds those declaring a symbol of one of these kinds, read from
+	// Src; both are set by the fields of the query.
+	Paths []string
+	Kinds []string
+	// Exclude leaves out the files matching any of its filters, set by the
+	// negated fields of the query; files declaring only symbols of its
+	// kinds are read from Src.
+	Exclude queryFilters
+	Src     source
+	// Grep, when set, only keeps the files with a chunk matching it, read
+	// from Src.
+	Grep *regexp.Regexp
+	// Not is the embedded negative query: the similarity of every file to
+	// it, times -not-weight, is added to its score.
+	Not []float32
+	// Root is the indexed path, which paths are matched against the query
+	// relative to.
+	Root string
+	// Sparse holds the dot product of the sparse vector of the query with
+	// that of each file matching it, by file, set by searchIndex with
+	// -sparse; they are blended into ranking with -sparse-weight.
+	Sparse map[string]float32
+	// Lex, when set, holds the text of the searched files, whose BM25 scores
+	// are blended into vector ranking with -lexical-weight.
+	Lex lexical.LexicalService
+}
+
+// hit is a ranked search result.
+type hit struct {
+	index.Result
+	// Score is the adjusted distance used for ranking; lower is better.
+	Score float32
+	// Lexical is the BM25 score of lexical matches; higher is better.
+	Lexical float64
+	// Boosts are the adjustments added to the base score, in order.
+	Boosts []boost
+	// Meta is the stored row of the match.
+	Meta store.Embedding
+	// Tests are the test files of the match, set by pairTests.
+	Tests []string
+	// Rerank is the relevance the -reranker plugin gave the match; higher
+	// is better.
+	Rerank *float32
+}
+
+// boost is a ranking adjustment applied to a hit.
+type boost struct {
+	Reason string  `json:"reason"`
+	Delta  float32 `json:"delta"`
+}
+
+// less orders hits by score, then by path, so that equal scores rank the
+// same way on every run whatever order candidates were found in.
+func (h hit) less(o hit) bool {
+	if h.Score != o.Score {
+		return h.Score < o.Score
+	}
+	return h.ID < o.ID
+}
+
+// adjust adds delta to the score of h and records why.
+func (h *hit) adjust(reason string, delta float32) {
+	h.Score += delta
+	h.Boosts = append(h.Boosts, boost{Reason: reason, Delta: delta})
+}
+
+// searchIndex returns the best matches for the request, re-ranking the
+// nearest neighbours with metadata stored alongside their vectors. With
+// -summaries, candidates are first picked by their file and package
+// summaries, or by traversing the clusters of summaries with -hierarchy,
+// along with the nearest neighbours not summarized yet.
+func searchIndex(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, req searchRequest) ([]hit, error) {
+	var (
+		hits       []hit
+		summarized map[string]bool
+		err        error
+	)
+	switch {
+	case a.opts.hierarchy:
+		hits, summarized, err = hierarchyHits(ctx, db, req)
+	case a.opts.summaries:
+		hits, summarized, err = summaryHits(ctx, db, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range idx.Search(req.Vector, candidates(req)) {
+		if !summarized[r.ID] {
+			hits = append(hits, hit{Result: r, Score: r.Distance})
+		}
+	}
+	if a.opts.pathWeight > 0 {
+		extra, err := pathCandidates(ctx, a, db, idx, req, hits)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, extra...)
+	}
+	if req.Lex != nil && a.opts.lexicalWeight > 0 {
+		extra, err := lexicalCandidates(ctx, db, req, hits)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, extra...)
+	}
+	if a.sparse != nil && req.Query != "" && a.opts.sparseWeight > 0 {
+		if req.Sparse, err = sparseScores(ctx, a, db, req); err != nil {
+			return nil, err
+		}
+		extra, err := sparseCandidates(ctx, db, req, hits)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, extra...)
+	}
+	if a.opts.docWeight > 0 {
+		extra, err := docCandidates(ctx, db, req, hits)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, extra...)
+	}
+	if len(req.Languages) > 0 {
+		extra, err := languageCandidates(ctx, db, req, hits)
+		if err != nil {
+			return nil, err
+		}
+		hits = append(hits, extra...)
+	}
+	return rank(ctx, a, db, req, hits)
+}
+
+// languageCandidates returns every file of the requested languages missing
+// from hits when there are few of them, since the nearest vectors of the
+// whole index may not include any. Larger languages are left to the nearest
+// vectors, which then hold enough of them.
+func languageCandidates(ctx context.Context, db store.StorageService, req searchRequest, hits []hit) ([]hit, error) {
+	ids, err := db.IDs(ctx, req.Languages...)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > candidates(req) {
+		return nil, nil
+	}
+	seen := make(map[string]bool, len(hits))
+	for _, h := range hits {
+		seen[h.ID] = true
+	}
+	missing := ids[:0]
+	for _, id := range ids {
+		if !seen[id] {
+			missing = append(missing, id)
+		}
+	}
+	return vectorHits(ctx, db, req, missing)
+}
+
+// lexicalCandidates returns the best BM25 matches of the query missing from
+// hits, so that files naming its identifiers compete with the nearest
+// vectors.
+func lexicalCandidates(ctx context.Context, db store.StorageService, req searchRequest, hits []hit) ([]hit, error) {
+	seen := make(map[string]bool, len(hits))
+	for _, h := range hits {
+		seen[h.ID] = true
+	}
+	var ids []string
+	for _, r := range req.Lex.Search(req.Query, candidates(req)) {
+		if !seen[r.ID] {
+			ids = append(ids, r.ID)
+		}
+	}
+	return vectorHits(ctx, db, req, ids)
+}
+
+// pathCandidates returns the files whose path best matches the query but
+// are missing from hits, so that "store upsert" finds store.go even when its
+// vector is not among the nearest.
+func pathCandidates(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, req searchRequest, hits []hit) ([]hit, error) {
+	seen := make(map[string]bool, len(hits))
+	for _, h := range hits {
+		seen[h.ID] = true
+	}
+
+	paths, err := a.paths.get(ctx, db, idx, req.Root)
+	if err != nil {
+		return nil, err
+	}
+	type match struct {
+		id    string
+		score float64
+	}
+	var matches []match
+	filter := fuzzy.NewFilter(req.Query)
+	for _, p := range paths {
+		if seen[p.id] || !filter.May(p.path) {
+			continue
+		}
+		if s := fuzzy.Score(req.Query, p.rel); s > 0 {
+			matches = append(matches, match{p.id, s})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].id < matches[j].id
+	})
+	if len(matches) > req.K {
+		matches = matches[:req.K]
+	}
+
+	picked := make([]string, len(matches))
+	for i, m := range matches {
+		picked[i] = m.id
+	}
+	return vectorHits(ctx, db, req, picked)
+}
+
+// pathCache holds the stored paths pathCandidates matches queries against,
+// prepared for one version of each versioned index, so that serve reads and
+// prepares them again only once an index changed.
+type pathCache struct {
+	mu      sync.Mutex
+	entries map[index.IndexService]cachedPaths
+}
+
+// maxCachedPaths bounds the indexes whose paths are cached: replicas
+// replace theirs with every snapshot.
+const maxCachedPaths = 8
+
+// cachedPaths are the paths of the files of an index at version, relative
+// to root.
+type cachedPaths struct {
+	version uint64
+	root    string
+	paths   []storedPath
+}
+
+// storedPath is the path of a stored file, relative to the searched root.
+type storedPath struct {
+	id, rel string
+	path    fuzzy.Path
+}
+
+// get returns the paths of the files stored in db, relative to root, those
+// cached when idx is versioned and hasn't changed since.
+func (c *pathCache) get(ctx context.Context, db store.StorageService, idx index.IndexService, root string) ([]storedPath, error) {
+	version, versioned := index.Version(idx), index.Versioned(idx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[idx]; versioned && ok && e.version == version && e.root == root {
+		return e.paths, nil
+	}
+
+	ids, err := db.IDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]storedPath, len(ids))
+	for i, id := range ids {
+		rel := relPath(root, id)
+		paths[i] = storedPath{id: id, rel: rel, path: fuzzy.NewPath(rel)}
+	}
+	if versioned {
+		if c.entries == nil || len(c.entries) >= maxCachedPaths {
+			c.entries = map[index.IndexService]cachedPaths{}
+		}
+		c.entries[idx] = cachedPaths{version: version, root: root, paths: paths}
+	}
+	return paths, nil
+}
+
+// vectorHits returns hits for the stored files ids, scored by the distance
+// of their vector to the query.
+func vectorHits(ctx context.Context, db store.StorageService, req searchRequest, ids []string) ([]hit, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	rows, err := db.Get(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	var out []hit
+	for _, e := range rows {
+		if len(e.Vector) != len(req.Vector) {
+			continue
+		}
+		d := index.CosineDistance(req.Vector, e.Vector)
+		out = append(out, hit{Result: index.Result{ID: e.ID, Distance: d, Vector: e.Vector}, Score: d})
+	}
+	return out, nil
+}
+
+// searchLexical returns the best BM25 matches for the request. Scores are
+// mapped to (0, 1], lower is better, to rank like distances.
+func searchLexical(ctx context.Context, a *app, db store.StorageService, lex lexical.LexicalService, req searchRequest) ([]hit, error) {
+	results := lex.Search(req.Query, candidates(req))
+	hits := make([]hit, len(results))
+	for i, r := range results {
+		hits[i] = hit{Result: index.Result{ID: r.ID}, Score: float32(1 / (1 + r.Score)), Lexical: r.Score}
+	}
+	return rank(ctx, a, db, req, hits)
+}
+
+// queryID identifies a query in the query log, so that feedback given to
+// its results applies whenever the same query is searched again.
+func queryID(query string) string {
+	sum := sha1.Sum([]byte(strings.TrimSpace(query)))
+	return hex.EncodeToString(sum[:])[:10]
+}
+
+// candidates returns how many raw matches to consider for the request.
+func candidates(req searchRequest) int {
+	n := req.K * overfetch
+	if req.filtered() {
+		// filters discard candidates, so look further
+		n *= overfetch
+	}
+	return n
+}
+
+// filtered reports whether the request has filters discarding candidates.
+func (req searchRequest) filtered() bool {
+	ex := req.Exclude
+	return req.Author != "" || len(req.Languages) > 0 || len(req.Allowed) > 0 || len(req.Paths) > 0 || len(req.Kinds) > 0 ||
+		len(ex.Languages) > 0 || len(ex.Paths) > 0 || len(ex.Kinds) > 0 || len(ex.Authors) > 0 || req.Grep != nil
+}
+
+// rank filters and re-ranks hits with their stored metadata, then with the
+// -reranker plugin, keeping the best req.K.
+func rank(ctx context.Context, a *app, db store.StorageService, req searchRequest, hits []hit) ([]hit, error) {
+	if len(hits) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, len(hits))
+	for i, h := range hits {
+		ids[i] = h.ID
+	}
+	rows, err := db.Get(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]store.Embedding, len(rows))
+	for _, e := range rows {
+		meta[e.ID] = e
+	}
+
+	votes, err := db.Votes(ctx, queryID(req.Query))
+	if err != nil {
+		return nil, err
+	}
+	var docs map[string]float32
+	if a.opts.docWeight > 0 && req.Vector != nil {
+		if docs, err = docDistances(ctx, db, req, hits); err != nil {
+			return nil, err
+		}
+	}
+	var multi map[string]float32
+	if a.opts.multiVectorWeight > 0 && req.Vector != nil {
+		if multi, err = multiVectorDistances(ctx, a, db, req, hits); err != nil {
+			return nil, err
+		}
+	}
+
+	// sparse scores are unbounded: the best match of the query gets the
+	// whole weight
+	var bestSparse float32
+	for _, s := range req.Sparse {
+		bestSparse = max(bestSparse, s)
+	}
+
+	rules := loadPathRules(ctx, db)
+	author := strings.ToLower(req.Author)
+	paths := globs(req.Paths)
+	excludedPaths := globs(req.Exclude.Paths)
+	langs := map[string]bool{}
+	for _, lang := range req.Languages {
+		langs[lang] = true
+	}
+
+	ranked := make([]hit, 0, len(hits))
+	for _, h := range hits {
+		h.Meta = meta[h.ID]
+		if len(req.Allowed) > 0 && !req.Allowed.has(h.ID) {
+			continue
+		}
+		if rules.excluded(h.ID) {
+			continue
+		}
+		if paths != nil && !paths.MatchesPath(relPath(req.Root, h.ID)) {
+			continue
+		}
+		if author != "" && !strings.Contains(strings.ToLower(h.Meta.Author), author) {
+			continue
+		}
+		if len(langs) > 0 && !langs[h.Meta.Language] {
+			continue
+		}
+		if req.Exclude.excluded(h, excludedPaths, req.Root) {
+			continue
+		}
+		if req.Tests == testsExclude && isTest(req.Root, h.ID) {
+			continue
+		}
+		if req.InContext.has(h.ID) {
+			if req.InContextMode != inContextDownrank {
+				continue
+			}
+			h.adjust("in-context", inContextPenalty)
+		}
+		if h.Meta.Generated && a.opts.generated == generatedDownweight {
+			h.adjust("generated", generatedPenalty)
+		}
+		if v := max(-feedbackCap, min(votes[h.ID], feedbackCap)); v != 0 {
+			h.adjust("feedback", -feedbackBoost*float32(v))
+		}
+		if a.opts.pathWeight > 0 {
+			if s := fuzzy.Score(req.Query, relPath(req.Root, h.ID)); s > 0 {
+				h.adjust("path", -float32(a.opts.pathWeight*s))
+			}
+		}
+		// blend the distance of the comments into that of the code
+		if d, ok := docs[h.ID]; ok {
+			h.adjust("docs", float32(a.opts.docWeight)*(d-h.Distance))
+		}
+		// and the late interaction distance of its segments
+		if d, ok := multi[h.ID]; ok {
+			h.adjust("maxsim", float32(a.opts.multiVectorWeight)*(d-h.Distance))
+		}
+		if len(req.Not) > 0 && len(h.Meta.Vector) == len(req.Not) {
+			if sim := 1 - index.CosineDistance(req.Not, h.Meta.Vector); sim > 0 {
+				h.adjust("not", float32(a.opts.notWeight)*sim)
+			}
+		}
+		if s := req.Sparse[h.ID]; s > 0 {
+			h.adjust("sparse", -float32(a.opts.sparseWeight)*s/bestSparse)
+		}
+		if req.Lex != nil && a.opts.lexicalWeight > 0 {
+			if bm25 := req.Lex.Score(req.Query, h.ID); bm25 > 0 {
+				h.Lexical = bm25
+				h.adjust("lexical", -float32(a.opts.lexicalWeight*bm25/(1+bm25)))
+			}
+		}
+		ranked = append(ranked, h)
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		return ranked[i].less(ranked[j])
+	})
+	if a.reranker != nil && req.Query != "" && len(ranked) > 0 {
+		rerank(ctx, a, req, ranked)
+	}
+	if req.readFilters() {
+		ranked = matching(ctx, a, req, ranked)
+	}
+	if len(ranked) > req.K {
+		ranked = ranked[:req.K]
+	}
+	return ranked, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestSearchTies checks that files scoring the same, being copies of each
+// other, rank by path whatever the engine and the order they were indexed in.
+func TestSearchTies(t *testing.T) {
+	ctx := testContext()
+	root := t.TempDir()
+	copies := []string{"c.go", "a.go", "d/b.go", "b.go"}
+	for _, name := range copies {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("package x\n\n// retry the request with backoff\nfunc retry() {}\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "other.go"), []byte("package x\n\n// parse flags\nfunc parse() {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a.go", "b.go", "c.go", "d/b.go"}
+	for _, engine := range []string{engineFlat, engineHNSW} {
+		t.Run(engine, func(t *testing.T) {
+			got, _ := searchTree(t, ctx, newTestApp(t, ctx, "-engine", engine), root, "retry the request with backoff", len(want))
+			if !slices.Equal(got, want) {
+				t.Errorf("results = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestGrep checks that -grep keeps the files with a chunk matching it, not
+// those matching it across chunks, and that agent results point to the
+// matching chunk.
+func TestGrep(t *testing.T) {
+	ctx := testContext()
+	root := t.TempDir()
+	files := map[string]string{
+		"a.go": "package x\n\n// retry waits with backoff\nfunc retry() {}\n",
+		"b.go": "package x\n\n// retry parses the backoff\nfunc parse() {}\n\n// wait returns once ctx is done\nfunc wait(ctx context.Context) {\n\t<-ctx.Done()\n}\n",
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := newTestApp(t, ctx, "-engine", engineFlat)
+	src, err := newSource(ctx, a, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	query := "retry with backoff"
+	q, _, err := a.embedQuery(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := a.store(a.opts.namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := a.newIndex(ctx, src.shard, 0, len(q))
+	indexTree(ctx, a, db, idx, src, q)
+
+	for _, c := range []struct {
+		pattern string
+		want    []string
+		chunk   string
+	}{
+		{`ctx\.Done\(\)`, []string{"b.go"}, "b.go#wait@"},
+		{`(?s)parse.*ctx\.Done`, nil, ""},
+		{`backoff`, []string{"a.go", "b.go"}, ""},
+	} {
+		t.Run(c.pattern, func(t *testing.T) {
+			re, err := parseGrep(c.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hits, err := searchIndex(ctx, a, db, idx, searchRequest{Query: query, Vector: q, K: 2, Root: root, Src: src, Grep: re})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, h := range hits {
+				got = append(got, filepath.Base(h.ID))
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, c.want) {
+				t.Fatalf("results = %v, want %v", got, c.want)
+			}
+			if c.chunk == "" {
+				return
+			}
+			results, err := agentResults(ctx, a, db, src, query, nil, re, hits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id := results[0].ChunkID; !strings.HasPrefix(id, filepath.Join(root, c.chunk)) {
+				t.Errorf("chunk = %s, want %s", id, c.chunk)
+			}
+		})
+	}
+}
@@ -0,0 +1,958 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	auth "github.com/codectx/tokens/services/auth"
+	embed "github.com/codectx/tokens/services/embed"
+	index "github.com/codectx/tokens/services/index"
+	lexical "github.com/codectx/tokens/services/lexical"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// defaultTopK is the number of results returned when a request doesn't set k.
+const defaultTopK = 5
+
+// serveOptions are the flags of serve on top of the shared options.
+type serveOptions struct {
+	addr           string
+	tokensFile     string
+	bootstrap      bool
+	compose        string
+	requestTimeout time.Duration
+	webhooks       string
+	rescan         time.Duration
+	replicaOf      string
+	replicaPoll    time.Duration
+	drainTimeout   time.Duration
+	topK           int
+	adminToken     string
+	public         bool
+	publicRPS      float64
+	publicMaxK     int
+	publicPaths    string
+	publicSnippet  int
+	resultCache    int
+}
+
+// newServeFlags returns the flag set of serve, with the shared options.
+func newServeFlags() (*flag.FlagSet, *options, *serveOptions) {
+	fs := newFlagSet("serve")
+	o := &options{}
+	o.register(fs)
+	so := &serveOptions{}
+	fs.StringVar(&so.addr, "addr", ":8080", "address to listen on")
+	fs.StringVar(&so.tokensFile, "tokens", "", "file of `<token> <namespace> [rps]` entries; empty disables authentication")
+	fs.BoolVar(&so.bootstrap, "bootstrap", false, "launch Ollama and pull the embedding model if needed")
+	fs.StringVar(&so.compose, "compose", "", "compose file used by -bootstrap to start Ollama when it isn't installed")
+	fs.DurationVar(&so.requestTimeout, "request-timeout", 30*time.Second, "maximum duration of a search request")
+	fs.StringVar(&so.webhooks, "webhooks", "", "comma-separated URLs that every re-indexed file is POSTed to as a JSON event")
+	fs.DurationVar(&so.rescan, "rescan", 0, "re-index the served path at this interval, re-embedding changed files; 0 disables")
+	fs.StringVar(&so.replicaOf, "replica", "", "serve read-only the database `file` another process publishes, or the latest of a directory of backups, reloading it when it changes")
+	fs.DurationVar(&so.replicaPoll, "replica-poll", 10*time.Second, "interval at which -replica is checked for a new snapshot")
+	fs.DurationVar(&so.drainTimeout, "drain-timeout", 25*time.Second, "how long a SIGTERM waits for the searches and index writes in flight before exiting")
+	fs.IntVar(&so.topK, "k", defaultTopK, "number of results of a search request that doesn't set k")
+	fs.StringVar(&so.adminToken, "admin-token", "", "bearer `token` of the /admin endpoints, disabled when empty (default $CODECTX_ADMIN_TOKEN)")
+	fs.BoolVar(&so.public, "public", false, "serve a public demo: anonymous searches rate-limited per client, capped and clipped, without the endpoints that control serve")
+	fs.Float64Var(&so.publicRPS, "public-rps", 1, "requests per second allowed to each client address with -public")
+	fs.IntVar(&so.publicMaxK, "public-max-k", 10, "maximum number of results of a search with -public")
+	fs.StringVar(&so.publicPaths, "public-paths", "", "comma-separated files and directories under the served path that -public returns; empty returns all")
+	fs.IntVar(&so.publicSnippet, "public-snippet", 200, "maximum number of characters of the snippets and chunks returned with -public")
+	fs.IntVar(&so.resultCache, "result-cache", 256, "number of search responses kept to answer repeated queries until the index changes; 0 disables")
+	return fs, o, so
+}
+
+// validate checks the serve flags, defaulting -admin-token to
+// $CODECTX_ADMIN_TOKEN.
+func (so *serveOptions) validate() error {
+	if so.adminToken == "" {
+		so.adminToken = os.Getenv("CODECTX_ADMIN_TOKEN")
+	}
+	if so.topK < 1 {
+		return fmt.Errorf("invalid -k value %d", so.topK)
+	}
+	if so.resultCache < 0 {
+		return fmt.Errorf("invalid -result-cache value %d", so.resultCache)
+	}
+	return so.validatePublic()
+}
+
+// server answers search requests against one index per namespace.
+type server struct {
+	app *app
+	log *slog.Logger
+	// auth is nil when serving without authentication.
+	auth auth.AuthService
+	// namespace is searched by unauthenticated requests.
+	namespace string
+	indexes   map[string]index.IndexService
+	// root is the served path, directories are reported relative to it.
+	root string
+	// src reads the files of the served namespace, for agent results and
+	// fetched chunks.
+	src source
+	// flags are the serve flags, and args the command line they were
+	// parsed from, read again by a reload. parsed holds the values of
+	// every flag as parsed, before serve adjusts any, and as reloaded.
+	flags  *serveOptions
+	args   []string
+	parsed map[string]string
+	// lex is set when serving in lexical mode, for the served namespace only.
+	lex lexical.LexicalService
+	// hybrid is the lexical index of the served namespace, blended into vector
+	// ranking when -lexical-weight is set.
+	hybrid lexical.LexicalService
+	// sessions expand follow-up queries of requests that set session.
+	sessions sessions
+	// results caches search responses by their parameters and the version
+	// of the index they were searched in; nil with -result-cache 0.
+	results *resultCache
+	// epoch tells apart the responses of this process, until a reload
+	// changes its flags, from those of one at the same index version, in
+	// entity tags. It is written holding mu.
+	epoch string
+	// mu is held by the requests reading the database and indexes, and by
+	// a replica swapping them for those of a new snapshot, at snapshot.
+	mu       sync.RWMutex
+	snapshot string
+	// ctx is done once shutdown begins.
+	ctx context.Context
+	// errors keeps the latest errors logged, for /admin/errors.
+	errors *errorLog
+	// limiter throttles the clients of -public, which returns only the
+	// files under allowlist when set.
+	limiter   *auth.Limiter
+	allowlist contextFiles
+	// ready is set once the indexes are loaded, for /readyz.
+	ready atomic.Bool
+	// writes counts the indexing of the served path, at startup and by
+	// -rescan, and its summarizing, that shutdown waits for.
+	writes sync.WaitGroup
+	// summarizing is held while the served path is summarized.
+	summarizing sync.Mutex
+}
+
+// searchResponse is the JSON body returned by /search.
+type searchResponse struct {
+	Namespace string `json:"namespace"`
+	// IndexVersion increases with every change of the index of Namespace,
+	// and is part of the ETag of the response.
+	IndexVersion uint64 `json:"index_version"`
+	// Mode is vector or lexical, when no embedding provider is available.
+	Mode  string `json:"mode"`
+	Query string `json:"query"`
+	// QueryID identifies the query when giving feedback on its results.
+	QueryID string `json:"query_id"`
+	// Session echoes the session parameter, Expanded is the query searched
+	// once expanded with the previous turns of the session.
+	Session  string         `json:"session,omitempty"`
+	Expanded string         `json:"expanded,omitempty"`
+	Results  []searchResult `json:"results"`
+	// Directories is set instead of Results for group=dir requests.
+	Directories []dirHit `json:"directories,omitempty"`
+}
+
+// searchResult is a single match in a searchResponse.
+type searchResult struct {
+	Path     string  `json:"path"`
+	Distance float32 `json:"distance"`
+	Score    float32 `json:"score"`
+	BM25     float64 `json:"bm25,omitempty"`
+	// Explain is set when the request asks for explain=true.
+	Explain    *explanation `json:"explain,omitempty"`
+	Author     string       `json:"author,omitempty"`
+	LastCommit string       `json:"last_commit,omitempty"`
+	Language   string       `json:"language,omitempty"`
+	// Tests are the test files of the result, for tests=pair requests.
+	Tests []string `json:"tests,omitempty"`
+}
+
+// runServe indexes the given path and serves search requests over HTTP.
+func runServe(ctx context.Context, args []string) error {
+	// Keep the latest errors for /admin/errors
+	errs := newErrorLog(ctx.Value(LoggerCtxKey).(*slog.Logger).Handler())
+	l := slog.New(errs)
+	ctx = context.WithValue(ctx, LoggerCtxKey, l)
+
+	fs, o, so := newServeFlags()
+	fs.Parse(args)
+
+	wd := "."
+	if fs.NArg() > 0 {
+		wd = fs.Arg(0)
+	}
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if err := so.validate(); err != nil {
+		return err
+	}
+	parsed := parsedFlags(fs)
+
+	var rep *replica
+	if so.replicaOf != "" {
+		switch {
+		case o.db != localDB || o.remote != "":
+			return errors.New("-replica serves its own snapshots: drop -db and -remote")
+		case o.vectors != "":
+			return errors.New("-replica loads the vectors of each snapshot: drop -vectors")
+		case so.rescan > 0:
+			return errors.New("-replica is read-only: drop -rescan")
+		case o.engine == engineDuckDB || o.memoryLimit > 0:
+			return errors.New("-replica keeps indexes in memory: drop -engine duckdb-vss and -memory-limit")
+		case so.replicaPoll <= 0:
+			return errors.New("-replica-poll must be positive")
+		}
+		var err error
+		if rep, err = newReplica(so.replicaOf); err != nil {
+			return err
+		}
+		defer rep.Close()
+		if o.db, err = rep.fetch(); err != nil {
+			return err
+		}
+		o.readOnly = true
+	}
+
+	srv := &server{log: l, namespace: o.namespace, indexes: map[string]index.IndexService{}, flags: so, args: args, parsed: parsed, errors: errs,
+		results: newResultCache(so.resultCache), epoch: newEpoch()}
+
+	if so.tokensFile != "" {
+		tokens, err := auth.LoadTokens(so.tokensFile)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			if err := store.ValidateNamespace(t.Namespace); err != nil {
+				return err
+			}
+		}
+		srv.auth = auth.NewAuthService(tokens)
+	} else if !so.public {
+		l.Warn("serving without authentication")
+	}
+	if so.public {
+		srv.limiter = auth.NewLimiter(so.publicRPS)
+		srv.allowlist = parseAllowlist(wd, so.publicPaths)
+	}
+
+	hooks, err := parseWebhooks(so.webhooks)
+	if err != nil {
+		return err
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	srv.app = a
+	a.events = newEvents(ctx, hooks)
+	if rep != nil {
+		srv.snapshot = o.db
+	}
+
+	// Answer health checks while the indexes load, until SIGTERM
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv.ctx = ctx
+	srv.writes.Add(1)
+	served, err := srv.listen(ctx, so.addr, so.requestTimeout, so.drainTimeout)
+	if err != nil {
+		return err
+	}
+	go srv.reloadOnHangup(ctx)
+
+	if so.bootstrap {
+		stop, err := bootstrapOllama(ctx, a.ollama, so.compose)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	// Index the served path, then load every other namespace from the store
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srv.namespace = o.namespace
+	srv.root = wd
+	srv.src = src
+
+	// Check the provider upfront rather than failing every file
+	if o.mode == modeAuto {
+		if _, _, err := a.emb.Get(ctx, "ping"); err != nil {
+			l.Warn("embedding provider unavailable, serving lexical search only", "error", err)
+			o.mode = modeLexical
+		}
+	}
+	if o.mode == modeLexical {
+		srv.lex = lexical.NewLexicalService()
+		indexLexical(ctx, a, srv.lex, src)
+		return srv.open(ctx, served, "addr", so.addr, "path", wd, "namespace", o.namespace, "mode", modeLexical)
+	}
+
+	var idx index.IndexService
+	if a.readOnly || o.noWalk {
+		if idx, err = loadIndex(ctx, a, o.namespace); err != nil {
+			return fmt.Errorf("failed to load namespace %q: %w", o.namespace, err)
+		}
+		idx = index.NewVersionedIndexService(idx, 0)
+		l.Info("loaded stored index", "namespace", o.namespace, "files", idx.Len())
+	} else {
+		idx = index.NewVersionedIndexService(a.newIndex(ctx, src.shard, storedFiles(ctx, a, o.namespace), a.caps.Dims), 0)
+		db, err := a.store(o.namespace)
+		if err != nil {
+			return err
+		}
+		indexTree(ctx, a, db, idx, src, nil)
+		if ctx.Err() != nil {
+			return srv.open(ctx, served)
+		}
+		srv.summarize(ctx, db, src)
+	}
+	srv.indexes[o.namespace] = idx
+	if o.lexicalWeight > 0 {
+		srv.hybrid = lexical.NewLexicalService()
+		indexLexical(ctx, a, srv.hybrid, src)
+	}
+	if so.rescan > 0 && !a.readOnly {
+		srv.writes.Add(1)
+		go srv.rescan(ctx, idx, src, so.rescan)
+	}
+
+	if srv.auth != nil {
+		for _, ns := range srv.auth.Namespaces() {
+			if _, ok := srv.indexes[ns]; ok {
+				continue
+			}
+			idx, err := loadIndex(ctx, a, ns)
+			if err != nil {
+				return fmt.Errorf("failed to load namespace %q: %w", ns, err)
+			}
+			srv.indexes[ns] = index.NewVersionedIndexService(idx, 0)
+			l.Debug("loaded namespace", "namespace", ns, "size", idx.Len())
+		}
+	}
+
+	if rep != nil {
+		go srv.follow(ctx, rep, so.replicaPoll)
+	}
+
+	return srv.open(ctx, served, "addr", so.addr, "path", wd, "namespace", o.namespace, "mode", modeVector)
+}
+
+// rescan re-indexes the served path every interval until ctx is done.
+// Unchanged files are skipped by their hash, changed ones re-embedded, and
+// deleted ones removed.
+func (s *server) rescan(ctx context.Context, idx index.IndexService, src source, interval time.Duration) {
+	defer s.writes.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			db, err := s.app.store(s.namespace)
+			if err != nil {
+				s.log.Error("Failed to open the index", "error", err)
+				continue
+			}
+			indexTree(ctx, s.app, db, idx, src, nil)
+			if ctx.Err() != nil {
+				return
+			}
+			removed := pruneDeleted(ctx, s.app, db, idx, src)
+			if s.hybrid != nil {
+				for _, id := range removed {
+					s.hybrid.Delete(id)
+				}
+				indexLexical(ctx, s.app, s.hybrid, src)
+			}
+			s.summarize(ctx, db, src)
+		}
+	}
+}
+
+// summarize summarizes the changed files of the served path in the
+// background with -summaries, while searches are answered from the
+// summaries stored so far. A pass still running is left to finish.
+func (s *server) summarize(ctx context.Context, db store.StorageService, src source) {
+	if s.app.summaries == nil || !s.summarizing.TryLock() {
+		return
+	}
+	s.writes.Add(1)
+	go func() {
+		defer s.writes.Done()
+		defer s.summarizing.Unlock()
+		summarizeTree(ctx, s.app, db, src)
+	}()
+}
+
+// listen starts serving HTTP requests on addr, then drains them for up to
+// drain once ctx is done. The returned channel receives the error serving
+// ended with, nil after a shutdown.
+func (s *server) listen(ctx context.Context, addr string, timeout, drain time.Duration) (<-chan error, error) {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /search", s.limited(s.whenReady(s.locked(s.handleSearch))))
+	api.HandleFunc("GET /fetch", s.limited(s.whenReady(s.locked(s.handleFetch))))
+	// anyone may call a public serve, so nothing controls it
+	if !s.flags.public {
+		api.HandleFunc("GET /index", s.handleIndexing)
+		api.HandleFunc("POST /index/pause", s.control(s.handleIndexing))
+		api.HandleFunc("POST /index/resume", s.control(s.handleIndexing))
+		api.HandleFunc("POST /config/reload", s.control(s.whenReady(s.handleReload)))
+	}
+	if s.flags.adminToken != "" {
+		api.HandleFunc("GET /admin/config", s.admin(s.handleAdminConfig))
+		api.HandleFunc("GET /admin/queues", s.admin(s.handleAdminQueues))
+		api.HandleFunc("GET /admin/errors", s.admin(s.handleAdminErrors))
+		api.HandleFunc("GET /admin/providers", s.admin(s.handleAdminProviders))
+		api.HandleFunc("POST /admin/reindex", s.admin(s.whenReady(s.handleAdminReindex)))
+	}
+
+	// Event streams are long-lived, so they bypass the request timeout
+	mux := http.NewServeMux()
+	if !s.flags.public {
+		mux.HandleFunc("GET /events", s.handleEvents)
+	}
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.Handle("/", http.TimeoutHandler(api, timeout, "request timed out"))
+
+	httpSrv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		// requests carry the logger, without being cancelled by ctx so that
+		// shutdown lets them finish
+		BaseContext: func(net.Listener) context.Context { return context.WithoutCancel(ctx) },
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("listening", "addr", addr)
+
+	served := make(chan error, 1)
+	go func() {
+		if err := httpSrv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			served <- err
+		}
+	}()
+	done := make(chan error, 1)
+	go func() {
+		select {
+		case err := <-served:
+			done <- err
+		case <-ctx.Done():
+			s.drain(httpSrv, drain)
+			done <- nil
+		}
+	}()
+	return done, nil
+}
+
+// handleSearch embeds the q parameter and returns the k nearest files.
+func (s *server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	ns := s.namespace
+	if s.auth != nil {
+		t, ok := s.auth.Authenticate(bearerToken(r))
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !s.auth.Allow(t) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		ns = t.Namespace
+	}
+
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		http.Error(w, "missing q parameter", http.StatusBadRequest)
+		return
+	}
+	pq, err := parseQuery(query)
+	if err != nil {
+		http.Error(w, "invalid q parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	k := s.flags.topK
+	if v := r.URL.Query().Get("k"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid k parameter", http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+	if s.flags.public {
+		k = min(k, s.flags.publicMaxK)
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "agent" {
+		http.Error(w, "invalid format parameter", http.StatusBadRequest)
+		return
+	}
+	if format == "agent" && ns != s.namespace {
+		http.Error(w, "namespace unavailable in agent format", http.StatusServiceUnavailable)
+		return
+	}
+
+	byDir, depth := s.app.opts.byDir, s.app.opts.depth
+	switch r.URL.Query().Get("group") {
+	case "":
+	case "dir":
+		byDir = true
+	case "file":
+		byDir = false
+	default:
+		http.Error(w, "invalid group parameter", http.StatusBadRequest)
+		return
+	}
+	if v := r.URL.Query().Get("depth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid depth parameter", http.StatusBadRequest)
+			return
+		}
+		depth = n
+	}
+
+	author := r.URL.Query().Get("author")
+	if author == "" {
+		author = s.app.opts.author
+	}
+
+	// Follow-ups search with the context of the previous turns
+	sessionID := r.URL.Query().Get("session")
+	sessionKey := ns + "/" + sessionID
+	searched := pq.Text
+	if sessionID != "" {
+		searched = s.sessions.expand(sessionKey, pq.Text)
+	}
+
+	tests := s.app.opts.tests
+	switch v := r.URL.Query().Get("tests"); v {
+	case "":
+	case testsKeep, testsExclude, testsPair:
+		tests = v
+	default:
+		http.Error(w, "invalid tests parameter", http.StatusBadRequest)
+		return
+	}
+
+	// Editors and agents name the files they already hold
+	inContext := parseContextFiles(s.root, append([]string{s.app.opts.inContext}, r.URL.Query()["in_context"]...)...)
+	// and are re-indexed first by the next -rescan, unless anyone may
+	if !s.flags.public {
+		s.app.opened.add(inContext)
+	}
+	inContextMode := s.app.opts.inContextMode
+	switch v := r.URL.Query().Get("in_context_mode"); v {
+	case "":
+	case inContextExclude, inContextDownrank:
+		inContextMode = v
+	default:
+		http.Error(w, "invalid in_context_mode parameter", http.StatusBadRequest)
+		return
+	}
+
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = s.app.opts.lang
+	}
+	grep := r.URL.Query().Get("grep")
+	if grep == "" {
+		grep = s.app.opts.grep
+	}
+	re, err := parseGrep(grep)
+	if err != nil {
+		http.Error(w, "invalid grep parameter", http.StatusBadRequest)
+		return
+	}
+	not := r.URL.Query().Get("not")
+	if not == "" {
+		not = s.app.opts.not
+	}
+
+	req := searchRequest{Query: searched, K: k, Author: author, Languages: parseLanguages(lang), Tests: tests, Root: s.root,
+		InContext: inContext, InContextMode: inContextMode, Allowed: s.allowlist, Src: s.src, Grep: re}
+	pq.apply(&req)
+	req.Query = searched
+	if byDir {
+		req.K = k * dirCandidates
+	}
+
+	db, err := s.app.store(ns)
+	if err != nil {
+		http.Error(w, "failed to open the index", http.StatusInternalServerError)
+		return
+	}
+
+	// Pinned files of the served path are re-checked before every search
+	rules := loadPathRules(r.Context(), db)
+	if idx, ok := s.indexes[ns]; ok && ns == s.namespace && s.lex == nil {
+		refreshPinned(r.Context(), s.app, db, idx, s.src, rules)
+	}
+
+	// Queries are logged whether they are answered from the cache or not
+	qid := queryID(pq.Text)
+	if !s.app.readOnly && !s.flags.public {
+		if err := db.LogQuery(r.Context(), qid, query); err != nil {
+			s.log.Warn("failed to log query", "error", err)
+		}
+	}
+
+	// Repeated queries are answered as before until the index, the rows
+	// stored alongside it or its path rules change; sessions expand each
+	// query with the previous ones
+	version, generation := index.Version(s.indexes[ns]), db.Generation()
+	var key, tag string
+	if sessionID == "" {
+		key, tag = resultKey(ns, version, generation, rules.sum, r.URL.Query()), s.etag(ns, version, generation, rules.sum)
+		if matchETag(r.Header.Get("If-None-Match"), tag) {
+			w.Header().Set("ETag", tag)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if body, ok := s.results.get(key); ok {
+			writeBody(w, tag, body)
+			return
+		}
+	}
+
+	var (
+		hits []hit
+		mode = modeVector
+	)
+	if s.lex != nil {
+		mode = modeLexical
+		if ns != s.namespace {
+			http.Error(w, "namespace unavailable in lexical mode", http.StatusServiceUnavailable)
+			return
+		}
+		hits, err = searchLexical(r.Context(), s.app, db, s.lex, req)
+	} else {
+		idx, ok := s.indexes[ns]
+		if !ok {
+			http.Error(w, "namespace not found", http.StatusNotFound)
+			return
+		}
+
+		// Fail fast rather than queue requests behind a paused provider
+		if s.app.breaker != nil && s.app.breaker.State() == embed.BreakerOpen {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s.app.breaker.RetryAfter().Seconds()))))
+			http.Error(w, "embedding provider unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		req.Vector, _, err = s.app.embedQuery(r.Context(), searched)
+		if err != nil {
+			http.Error(w, "failed to embed query", http.StatusBadGateway)
+			return
+		}
+		if not != "" {
+			if req.Not, _, err = s.app.embedQuery(r.Context(), not); err != nil {
+				http.Error(w, "failed to embed not parameter", http.StatusBadGateway)
+				return
+			}
+		}
+		if ns == s.namespace {
+			req.Lex = s.hybrid
+		}
+		hits, err = searchIndex(r.Context(), s.app, db, idx, req)
+	}
+	if err != nil {
+		http.Error(w, "search failed", http.StatusInternalServerError)
+		return
+	}
+	if tests == testsPair && ns == s.namespace {
+		if err := pairTests(r.Context(), s.app, db, s.src, s.root, hits); err != nil {
+			s.log.Warn("failed to pair tests", "error", err)
+		}
+	}
+	if s.flags.public {
+		s.publicHits(hits)
+	}
+
+	if sessionID != "" {
+		ids := make([]string, len(hits))
+		for i, h := range hits {
+			ids[i] = h.ID
+		}
+		s.sessions.record(sessionKey, pq.Text, ids)
+	}
+
+	if format == "agent" {
+		results, err := agentResults(r.Context(), s.app, db, s.src, pq.Text, pq.Filters.Kinds, re, hits)
+		if err != nil {
+			http.Error(w, "failed to read results", http.StatusInternalServerError)
+			return
+		}
+		for i := range results {
+			results[i].Snippet = s.clip(results[i].Snippet)
+		}
+		s.writeResult(w, key, tag, agentSearch{Schema: searchSchema, Query: query, QueryID: qid, Mode: mode, IndexVersion: version, Results: results})
+		return
+	}
+
+	if byDir {
+		res := searchResponse{Namespace: ns, IndexVersion: version, Mode: mode, Query: query, QueryID: qid, Session: sessionID, Results: []searchResult{}}
+		if searched != pq.Text {
+			res.Expanded = searched
+		}
+		res.Directories = aggregateDirs(hits, s.root, depth, k)
+		s.writeResult(w, key, tag, res)
+		return
+	}
+
+	withExplain := s.app.opts.explain
+	if v := r.URL.Query().Get("explain"); v != "" {
+		withExplain, _ = strconv.ParseBool(v)
+	}
+
+	res := searchResponse{Namespace: ns, IndexVersion: version, Mode: mode, Query: query, QueryID: qid, Session: sessionID, Results: []searchResult{}}
+	if searched != pq.Text {
+		res.Expanded = searched
+	}
+	for _, n := range hits {
+		var e *explanation
+		if withExplain {
+			x := explain(n)
+			e = &x
+		}
+		res.Results = append(res.Results, searchResult{
+			Path:       n.ID,
+			Distance:   n.Distance,
+			Score:      n.Score,
+			BM25:       n.Lexical,
+			Explain:    e,
+			Author:     n.Meta.Author,
+			LastCommit: n.Meta.LastCommit,
+			Language:   n.Meta.Language,
+			Tests:      n.Tests,
+		})
+	}
+	s.writeResult(w, key, tag, res)
+}
+
+// writeResult writes the search response v with the entity tag tag, and
+// caches it under key, unless they are empty.
+func (s *server) writeResult(w http.ResponseWriter, key, tag string, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "failed to encode results", http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+	if key != "" {
+		s.results.put(key, body)
+	}
+	writeBody(w, tag, body)
+}
+
+// handleFetch returns the chunks named by the id parameters, which agent
+// search results give, in the codectx.fetch/v1 schema.
+func (s *server) handleFetch(w http.ResponseWriter, r *http.Request) {
+	ns := s.namespace
+	if s.auth != nil {
+		t, ok := s.auth.Authenticate(bearerToken(r))
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !s.auth.Allow(t) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		ns = t.Namespace
+	}
+	if ns != s.namespace {
+		http.Error(w, "namespace unavailable for fetch", http.StatusServiceUnavailable)
+		return
+	}
+
+	ids := r.URL.Query()["id"]
+	if len(ids) == 0 {
+		http.Error(w, "missing id parameter", http.StatusBadRequest)
+		return
+	}
+	// the chunks of files the public may not read are missing
+	var denied []string
+	if len(s.allowlist) > 0 {
+		ids = slices.DeleteFunc(slices.Clone(ids), func(id string) bool {
+			path, ok := chunkPath(id)
+			if ok && !s.allowed(path) {
+				denied = append(denied, id)
+				return true
+			}
+			return false
+		})
+	}
+	db, err := s.app.store(ns)
+	if err != nil {
+		http.Error(w, "failed to open the index", http.StatusInternalServerError)
+		return
+	}
+	chunks, missing, err := fetchChunks(r.Context(), s.app, db, s.src, ids)
+	if err != nil {
+		http.Error(w, "fetch failed", http.StatusInternalServerError)
+		return
+	}
+	missing = append(missing, denied...)
+	for i := range chunks {
+		chunks[i].Content = s.clip(chunks[i].Content)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(agentFetch{Schema: fetchSchema, Chunks: chunks, Missing: missing})
+}
+
+// handleEvents streams the index events of the caller's namespace as
+// server-sent events until the client disconnects.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	ns := s.namespace
+	if s.auth != nil {
+		t, ok := s.auth.Authenticate(bearerToken(r))
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ns = t.Namespace
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, cancel := s.app.events.subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-ch:
+			if ev.Namespace != ns {
+				continue
+			}
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b)
+			flusher.Flush()
+		}
+	}
+}
+
+// indexStatus is the state of background indexing returned by /index.
+type indexStatus struct {
+	Paused bool `json:"paused"`
+	// CPU is the percent of the machine's CPU used over the last second.
+	CPU             float64 `json:"cpu"`
+	MaxCPU          float64 `json:"max_cpu,omitempty"`
+	MaxEmbedsPerMin int     `json:"max_embeds_per_min,omitempty"`
+}
+
+// handleIndexing pauses or resumes the indexing of the served path, by
+// -rescan and retries, and returns its state. Only tokens of the served
+// namespace may control it.
+func (s *server) handleIndexing(w http.ResponseWriter, r *http.Request) {
+	if s.auth != nil {
+		t, ok := s.auth.Authenticate(bearerToken(r))
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if t.Namespace != s.namespace {
+			http.Error(w, "forbidden: indexing belongs to the served namespace", http.StatusForbidden)
+			return
+		}
+	}
+	th := &s.app.throttle
+	switch r.URL.Path {
+	case "/index/pause":
+		th.pause()
+		s.log.Info("indexing paused")
+	case "/index/resume":
+		th.resume()
+		s.log.Info("indexing resumed")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(indexStatus{Paused: th.isPaused(), CPU: th.cpuUsage(), MaxCPU: th.maxCPU, MaxEmbedsPerMin: s.app.opts.maxEmbedsPerMin})
+}
+
+// control guards the endpoints that change a running serve when it has no
+// -tokens to check: they then take the admin token, or only requests from
+// this machine when there is none, rather than anyone who can reach -addr.
+func (s *server) control(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case s.auth != nil:
+		case s.flags.adminToken != "":
+			if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(s.flags.adminToken)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		case !loopback(r.RemoteAddr):
+			http.Error(w, "forbidden: set -admin-token to control serve from other machines", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// loopback reports whether the client address addr is on this machine.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// bearerToken extracts the token from an `Authorization: Bearer` header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if v, ok := strings.CutPrefix(h, "Bearer "); ok {
+		return strings.TrimSpace(v)
+	}
+	return ""
+}
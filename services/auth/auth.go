@@ -0,0 +1,164 @@
+// Package auth provides token authentication and rate limiting for serve mode.
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRPS is the request rate allowed for tokens that don't set one.
+const DefaultRPS = 5
+
+// Token grants access to a single namespace.
+type Token struct {
+	// Value is the secret presented as a bearer token.
+	Value string
+	// Namespace is the index namespace the token may search.
+	Namespace string
+	// RPS is the sustained number of requests per second allowed.
+	RPS float64
+}
+
+// AuthService defines the interface for authenticating and throttling requests.
+type AuthService interface {
+	// Authenticate returns the token matching value, if any.
+	Authenticate(value string) (Token, bool)
+	// Allow reports whether the token may make another request right now.
+	Allow(t Token) bool
+	// Namespaces returns the distinct namespaces referenced by all tokens.
+	Namespaces() []string
+}
+
+// authService implements AuthService.
+type authService struct {
+	tokens map[string]Token
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewAuthService returns an AuthService for the given tokens.
+func NewAuthService(tokens []Token) AuthService {
+	m := make(map[string]Token, len(tokens))
+	for _, t := range tokens {
+		m[t.Value] = t
+	}
+	return &authService{tokens: m, buckets: map[string]*bucket{}}
+}
+
+// LoadTokens reads tokens from a file with one `<token> <namespace> [rps]`
+// entry per line. Blank lines and lines starting with # are ignored. Use `-`
+// as the namespace to grant access to the default namespace.
+func LoadTokens(path string) ([]Token, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tokens file: %w", err)
+	}
+	defer f.Close()
+
+	var tokens []Token
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("tokens file line %d: expected `<token> <namespace> [rps]`", n)
+		}
+
+		t := Token{Value: fields[0], Namespace: fields[1], RPS: DefaultRPS}
+		if t.Namespace == "-" {
+			t.Namespace = ""
+		}
+		if len(fields) == 3 {
+			rps, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil || rps <= 0 {
+				return nil, fmt.Errorf("tokens file line %d: invalid rps %q", n, fields[2])
+			}
+			t.RPS = rps
+		}
+		tokens = append(tokens, t)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// Authenticate returns the token matching value, if any.
+func (s *authService) Authenticate(value string) (Token, bool) {
+	t, ok := s.tokens[value]
+	return t, ok
+}
+
+// Allow reports whether the token may make another request right now.
+func (s *authService) Allow(t Token) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[t.Value]
+	if !ok {
+		b = newBucket(t.RPS)
+		s.buckets[t.Value] = b
+	}
+	return b.take(time.Now())
+}
+
+// Namespaces returns the distinct namespaces referenced by all tokens.
+func (s *authService) Namespaces() []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, t := range s.tokens {
+		if !seen[t.Namespace] {
+			seen[t.Namespace] = true
+			out = append(out, t.Namespace)
+		}
+	}
+	return out
+}
+
+// bucket is a token bucket refilled at rate tokens per second.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns a full bucket allowing bursts of twice the rate.
+func newBucket(rate float64) *bucket {
+	burst := 2 * rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take consumes a token if one is available.
+func (b *bucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket has refilled by now, as if never taken.
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// limiterSweep is how often a Limiter forgets the keys whose bucket has
+// refilled, so that clients seen once don't accumulate.
+const limiterSweep = time.Minute
+
+// Limiter throttles requests by key, such as the address of a client, each
+// key allowed the same sustained number of requests per second.
+type Limiter struct {
+	rps float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// NewLimiter returns a Limiter allowing rps requests per second per key.
+func NewLimiter(rps float64) *Limiter {
+	return &Limiter{rps: rps, buckets: map[string]*bucket{}, swept: time.Now()}
+}
+
+// Allow reports whether key may make another request right now.
+func (l *Limiter) Allow(key string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > limiterSweep {
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newBucket(l.rps)
+		l.buckets[key] = b
+	}
+	return b.take(now)
+}
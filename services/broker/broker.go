@@ -0,0 +1,85 @@
+// Package broker passes messages between processes through an external
+// message queue: Redis lists or NATS JetStream streams. Redis also stores
+// the values processes share, with KV.
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// ErrClosed is returned by the subscriptions of a closed broker.
+var ErrClosed = errors.New("broker closed")
+
+// DefaultAckWait is how long a message received is held for its subscriber
+// when Subscribe isn't given a time.
+const DefaultAckWait = time.Minute
+
+// BrokerService publishes messages to subjects, each delivered to one of
+// the subscribers of its subject. Delivery is at least once: messages are
+// kept until a subscriber acknowledges them, whether anyone is subscribed
+// when they are published or not.
+type BrokerService interface {
+	// Publish sends msg to subject.
+	Publish(ctx context.Context, subject string, msg []byte) error
+	// Subscribe starts receiving the messages of subject. A message not
+	// acknowledged within ackWait of its delivery, DefaultAckWait when 0,
+	// is delivered again, to this subscriber or another.
+	Subscribe(ctx context.Context, subject string, ackWait time.Duration) (Subscription, error)
+	// Name returns the URL of the broker, without credentials.
+	Name() string
+	// Close releases the connections of the broker.
+	Close() error
+}
+
+// Subscription receives the messages of a subject.
+type Subscription interface {
+	// Next blocks until a message is received and returns it, or fails
+	// once ctx is done.
+	Next(ctx context.Context) (Message, error)
+	// Close stops receiving messages.
+	Close() error
+}
+
+// Message is a message received, delivered again unless acknowledged.
+type Message struct {
+	Data []byte
+	ack  func(ctx context.Context) error
+}
+
+// Ack acknowledges m once it is handled, so that it isn't delivered again.
+func (m Message) Ack(ctx context.Context) error {
+	if m.ack == nil {
+		return nil
+	}
+	return m.ack(ctx)
+}
+
+// NewBrokerService connects to the broker at rawURL: redis://, rediss://
+// (over TLS), with an optional user, password and database number, or
+// nats:// or tls:// (over TLS) with an optional user and password, or
+// token.
+func NewBrokerService(ctx context.Context, rawURL string) (BrokerService, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL: %w", err)
+	}
+	switch u.Scheme {
+	case "redis", "rediss":
+		return newRedis(ctx, u)
+	case "nats", "tls":
+		return newNATS(ctx, rawURL, u)
+	default:
+		return nil, fmt.Errorf("unsupported broker %q: use redis://, rediss://, nats:// or tls://", redact(u))
+	}
+}
+
+// redact returns u without its password or token.
+func redact(u *url.URL) string {
+	c := *u
+	c.User = nil
+	return c.String()
+}
@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// KV stores values under keys shared between processes, on the Redis server
+// brokers use.
+type KV interface {
+	// Get returns the value of key, and false when missing or expired.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value under key, expiring after ttl unless it is 0.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Name returns the URL of the server, without credentials.
+	Name() string
+	// Close releases the connections of the store.
+	Close() error
+}
+
+// NewKV connects to the Redis server at rawURL, redis:// or rediss:// like
+// NewBrokerService.
+func NewKV(ctx context.Context, rawURL string) (KV, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported key-value store %q: use redis:// or rediss://", redact(u))
+	}
+	return newRedis(ctx, u)
+}
+
+// Get returns the value of key.
+func (b *redisBroker) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	v, err := b.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	return v, true, nil
+}
+
+// Set stores value under key, expiring after ttl unless it is 0.
+func (b *redisBroker) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := b.client.Set(ctx, key, value, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to set %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// natsStream is the JetStream stream holding the messages of every
+	// subject under codectx., each kept until a subscriber acknowledges it.
+	natsStream = "CODECTX"
+	// natsMaxAge drops the messages nobody acknowledged, such as the replies
+	// to a process that exited.
+	natsMaxAge = 7 * 24 * time.Hour
+	// natsInactive drops the consumers of subjects nobody subscribes to
+	// anymore.
+	natsInactive = time.Hour
+	// natsPoll bounds how long a pull waits, so that Next notices when its
+	// context is done.
+	natsPoll = time.Second
+)
+
+// natsBroker publishes to and pulls from a JetStream stream, through a
+// client that reconnects when the connection drops.
+type natsBroker struct {
+	u  *url.URL
+	nc *nats.Conn
+	js jetstream.JetStream
+}
+
+// newNATS connects to the NATS server at rawURL and creates the stream of
+// codectx. subjects unless it exists.
+func newNATS(ctx context.Context, rawURL string, u *url.URL) (*natsBroker, error) {
+	nc, err := nats.Connect(rawURL, nats.Name("codectx"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", redact(u), err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", redact(u), err)
+	}
+	_, err = js.CreateStream(ctx, jetstream.StreamConfig{
+		Name:      natsStream,
+		Subjects:  []string{"codectx.>"},
+		Retention: jetstream.WorkQueuePolicy,
+		MaxAge:    natsMaxAge,
+	})
+	if err != nil && !errors.Is(err, jetstream.ErrStreamNameAlreadyInUse) {
+		nc.Close()
+		return nil, fmt.Errorf("failed to create stream %s on %s: %w", natsStream, redact(u), err)
+	}
+	return &natsBroker{u: u, nc: nc, js: js}, nil
+}
+
+// Publish adds msg to the stream, once the server stored it.
+func (b *natsBroker) Publish(ctx context.Context, subject string, msg []byte) error {
+	if _, err := b.js.Publish(ctx, subject, msg); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", subject, err)
+	}
+	return nil
+}
+
+// Subscribe pulls the messages of subject through the durable consumer
+// every subscriber of subject shares, each message going to one of them.
+func (b *natsBroker) Subscribe(ctx context.Context, subject string, ackWait time.Duration) (Subscription, error) {
+	if ackWait <= 0 {
+		ackWait = DefaultAckWait
+	}
+	c, err := b.js.CreateOrUpdateConsumer(ctx, natsStream, jetstream.ConsumerConfig{
+		Durable:           strings.NewReplacer(".", "_", "*", "_", ">", "_").Replace(subject),
+		FilterSubject:     subject,
+		AckPolicy:         jetstream.AckExplicitPolicy,
+		AckWait:           ackWait,
+		InactiveThreshold: natsInactive,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", subject, err)
+	}
+	return &natsSub{b: b, c: c, subject: subject}, nil
+}
+
+// Name returns the URL of the server.
+func (b *natsBroker) Name() string {
+	return redact(b.u)
+}
+
+// Close closes the connection. Messages received and not acknowledged are
+// delivered again once their ack wait is over.
+func (b *natsBroker) Close() error {
+	b.nc.Close()
+	return nil
+}
+
+// natsSub pulls the messages of a subject one at a time, so that none waits
+// in a subscriber busy with another.
+type natsSub struct {
+	b       *natsBroker
+	c       jetstream.Consumer
+	subject string
+}
+
+// Next pulls the next message, waiting for one.
+func (s *natsSub) Next(ctx context.Context) (Message, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return Message{}, err
+		}
+		if s.b.nc.IsClosed() {
+			return Message{}, ErrClosed
+		}
+		wait := natsPoll
+		if d, ok := ctx.Deadline(); ok {
+			wait = min(wait, max(time.Until(d), time.Millisecond))
+		}
+		msg, err := s.c.Next(jetstream.FetchMaxWait(wait))
+		switch {
+		case errors.Is(err, nats.ErrTimeout):
+			continue
+		case errors.Is(err, nats.ErrConnectionClosed):
+			return Message{}, ErrClosed
+		case err != nil:
+			return Message{}, fmt.Errorf("failed to receive from %s: %w", s.subject, err)
+		}
+		return Message{Data: msg.Data(), ack: msg.DoubleAck}, nil
+	}
+}
+
+// Close is a no-op: the consumer outlives the subscription, for the others
+// and the next ones.
+func (s *natsSub) Close() error {
+	return nil
+}
@@ -0,0 +1,160 @@
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPoll bounds how long a BLMOVE blocks, so that Next notices when its
+// context is done, and expired messages are put back in time.
+const redisPoll = time.Second
+
+// redisBroker queues the messages of a subject in the Redis list of that
+// name: RPUSH publishes, and subscribers move the oldest to the
+// <subject>:processing list, leasing it until the time its score in the
+// <subject>:leases sorted set holds. Acknowledging a message removes it from
+// both, and messages whose lease expired are queued again, first.
+type redisBroker struct {
+	u      *url.URL
+	client *redis.Client
+}
+
+// newRedis connects to the Redis server of u.
+func newRedis(ctx context.Context, u *url.URL) (*redisBroker, error) {
+	opts, err := redis.ParseURL(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL %s: %w", redact(u), err)
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", redact(u), err)
+	}
+	return &redisBroker{u: u, client: client}, nil
+}
+
+// Publish appends msg to the list of subject, behind an id of its own so
+// that identical messages are leased apart.
+func (b *redisBroker) Publish(ctx context.Context, subject string, msg []byte) error {
+	if err := b.client.RPush(ctx, subject, envelope(msg)).Err(); err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", subject, err)
+	}
+	return nil
+}
+
+// Subscribe returns a subscription taking from the list of subject.
+func (b *redisBroker) Subscribe(ctx context.Context, subject string, ackWait time.Duration) (Subscription, error) {
+	if ackWait <= 0 {
+		ackWait = DefaultAckWait
+	}
+	return &redisSub{b: b, subject: subject, processing: subject + ":processing", leases: subject + ":leases", ackWait: ackWait}, nil
+}
+
+// Name returns the URL of the server.
+func (b *redisBroker) Name() string {
+	return redact(b.u)
+}
+
+// Close closes the connections. Messages received and not acknowledged are
+// delivered again once their lease expires.
+func (b *redisBroker) Close() error {
+	return b.client.Close()
+}
+
+// redisClaim puts back at the head of KEYS[1] the messages of KEYS[2] whose
+// lease in KEYS[3] expired by ARGV[1], leases until ARGV[2] those without one,
+// moved by a subscriber that died before leasing them, then moves the oldest
+// message of KEYS[1] to KEYS[2], leased until ARGV[2], and returns it.
+var redisClaim = redis.NewScript(`
+for _, m in ipairs(redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1])) do
+	if redis.call('LREM', KEYS[2], 1, m) > 0 then
+		redis.call('LPUSH', KEYS[1], m)
+	end
+	redis.call('ZREM', KEYS[3], m)
+end
+for _, m in ipairs(redis.call('LRANGE', KEYS[2], 0, -1)) do
+	redis.call('ZADD', KEYS[3], 'NX', ARGV[2], m)
+end
+local m = redis.call('LMOVE', KEYS[1], KEYS[2], 'LEFT', 'RIGHT')
+if m then
+	redis.call('ZADD', KEYS[3], ARGV[2], m)
+end
+return m
+`)
+
+// redisAck removes the message ARGV[1] from KEYS[1] and its lease from
+// KEYS[2].
+var redisAck = redis.NewScript(`
+redis.call('LREM', KEYS[1], 1, ARGV[1])
+return redis.call('ZREM', KEYS[2], ARGV[1])
+`)
+
+// redisSub leases the messages of a subject from its list.
+type redisSub struct {
+	b          *redisBroker
+	subject    string
+	processing string
+	leases     string
+	ackWait    time.Duration
+}
+
+// Next leases the oldest message of the list, waiting for one.
+func (s *redisSub) Next(ctx context.Context) (Message, error) {
+	keys := []string{s.subject, s.processing, s.leases}
+	for {
+		if err := ctx.Err(); err != nil {
+			return Message{}, err
+		}
+		now := time.Now()
+		m, err := redisClaim.Run(ctx, s.b.client, keys, now.UnixMilli(), now.Add(s.ackWait).UnixMilli()).Text()
+		if errors.Is(err, redis.Nil) {
+			// wait for a message, leased once moved
+			m, err = s.b.client.BLMove(ctx, s.subject, s.processing, "LEFT", "RIGHT", redisPoll).Result()
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err == nil {
+				err = s.b.client.ZAdd(ctx, s.leases, redis.Z{Score: float64(time.Now().Add(s.ackWait).UnixMilli()), Member: m}).Err()
+			}
+		}
+		if errors.Is(err, redis.ErrClosed) {
+			return Message{}, ErrClosed
+		}
+		if err != nil {
+			return Message{}, fmt.Errorf("failed to receive from %s: %w", s.subject, err)
+		}
+		return Message{Data: unwrap(m), ack: func(ctx context.Context) error {
+			if err := redisAck.Run(ctx, s.b.client, []string{s.processing, s.leases}, m).Err(); err != nil && !errors.Is(err, redis.Nil) {
+				return fmt.Errorf("failed to acknowledge on %s: %w", s.subject, err)
+			}
+			return nil
+		}}, nil
+	}
+}
+
+// Close is a no-op: messages stay in the lists until acknowledged.
+func (s *redisSub) Close() error {
+	return nil
+}
+
+// envelope prefixes msg with 16 random hex digits and a space.
+func envelope(msg []byte) string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id) + " " + string(msg)
+}
+
+// unwrap returns the message of an envelope.
+func unwrap(m string) []byte {
+	if len(m) > 16 && m[16] == ' ' {
+		return []byte(m[17:])
+	}
+	return []byte(m)
+}
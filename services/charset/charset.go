@@ -0,0 +1,166 @@
+// Package charset transcodes file content to UTF-8 before it is indexed, so
+// that UTF-16 and legacy single-byte files embed as text rather than bytes.
+package charset
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Auto detects the encoding of each file.
+const Auto = "auto"
+
+const (
+	// sampleSize is how much of a file is scanned to guess UTF-16 without a
+	// byte order mark.
+	sampleSize = 2048
+	// minUTF16Zeros is the share of NUL high bytes that marks UTF-16 text,
+	// mostly ASCII in source code.
+	minUTF16Zeros = 0.4
+	// maxUTF16Zeros is the share of NUL low bytes above which content is
+	// binary rather than UTF-16.
+	maxUTF16Zeros = 0.05
+)
+
+// ErrUndecodable is returned for content that isn't text in the expected
+// encoding.
+var ErrUndecodable = errors.New("undecodable content")
+
+var (
+	utf8BOM    = []byte{0xef, 0xbb, 0xbf}
+	utf16LEBOM = []byte{0xff, 0xfe}
+	utf16BEBOM = []byte{0xfe, 0xff}
+
+	utf16LE = unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	utf16BE = unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+)
+
+// Lookup checks that name is Auto or an encoding label of the WHATWG
+// Encoding Standard, such as utf-16le, latin1 or shift_jis, and returns its
+// canonical name.
+func Lookup(name string) (string, error) {
+	if name == Auto {
+		return Auto, nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return "", fmt.Errorf("unknown encoding %q", name)
+	}
+	canonical, err := htmlindex.Name(enc)
+	if err != nil {
+		return "", fmt.Errorf("unknown encoding %q", name)
+	}
+	return canonical, nil
+}
+
+// Decode returns content transcoded to UTF-8 from the encoding name, and the
+// canonical name of that encoding. With Auto, a byte order mark selects
+// UTF-8 or UTF-16, then content is read as UTF-8 when valid, as UTF-16 when
+// every other byte is NUL, else as fallback. An empty fallback rejects
+// content that isn't UTF-8 or UTF-16.
+//
+// Content holding NUL bytes or invalid sequences once decoded is binary or in
+// another encoding, and fails with ErrUndecodable.
+func Decode(content []byte, name, fallback string) ([]byte, string, error) {
+	if name != Auto {
+		return decodeAs(content, name)
+	}
+
+	switch {
+	case bytes.HasPrefix(content, utf8BOM):
+		return decodeAs(content[len(utf8BOM):], "utf-8")
+	case bytes.HasPrefix(content, utf16LEBOM):
+		return decodeWith(content[len(utf16LEBOM):], utf16LE, "utf-16le")
+	case bytes.HasPrefix(content, utf16BEBOM):
+		return decodeWith(content[len(utf16BEBOM):], utf16BE, "utf-16be")
+	}
+
+	// ASCII in UTF-16 is valid UTF-8 too, so it is detected first
+	switch guessUTF16(content) {
+	case "utf-16le":
+		return decodeWith(content, utf16LE, "utf-16le")
+	case "utf-16be":
+		return decodeWith(content, utf16BE, "utf-16be")
+	}
+	if utf8.Valid(content) {
+		return decodeAs(content, "utf-8")
+	}
+	if fallback == "" {
+		return nil, "", fmt.Errorf("%w: not UTF-8 and no fallback encoding", ErrUndecodable)
+	}
+	return decodeAs(content, fallback)
+}
+
+// decodeAs transcodes content from the encoding labelled name.
+func decodeAs(content []byte, name string) ([]byte, string, error) {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("unknown encoding %q", name)
+	}
+	canonical, _ := htmlindex.Name(enc)
+	if canonical == "utf-8" {
+		// valid UTF-8 is used as is
+		if !utf8.Valid(content) {
+			return nil, canonical, fmt.Errorf("%w: invalid utf-8", ErrUndecodable)
+		}
+		return checkText(content, canonical)
+	}
+	return decodeWith(content, enc, canonical)
+}
+
+// decodeWith transcodes content with enc, named name.
+func decodeWith(content []byte, enc encoding.Encoding, name string) ([]byte, string, error) {
+	out, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return nil, name, fmt.Errorf("%w: %s: %v", ErrUndecodable, name, err)
+	}
+	// decoders replace invalid sequences rather than failing
+	if bytes.ContainsRune(out, utf8.RuneError) && !bytes.ContainsRune(content, utf8.RuneError) {
+		return nil, name, fmt.Errorf("%w: invalid %s", ErrUndecodable, name)
+	}
+	return checkText(out, name)
+}
+
+// checkText rejects decoded text holding NUL bytes, which text files don't.
+func checkText(text []byte, name string) ([]byte, string, error) {
+	if bytes.IndexByte(text, 0) >= 0 {
+		return nil, name, fmt.Errorf("%w: binary content", ErrUndecodable)
+	}
+	return text, name, nil
+}
+
+// guessUTF16 returns utf-16le or utf-16be when the NUL bytes of content fall
+// on the high bytes of its characters, as in UTF-16 text without a byte order
+// mark, or "" otherwise.
+func guessUTF16(content []byte) string {
+	if len(content) > sampleSize {
+		content = content[:sampleSize]
+	}
+	pairs := len(content) / 2
+	if pairs == 0 {
+		return ""
+	}
+	var even, odd int
+	for i := 0; i+1 < len(content); i += 2 {
+		if content[i] == 0 {
+			even++
+		}
+		if content[i+1] == 0 {
+			odd++
+		}
+	}
+	share := func(n int) float64 { return float64(n) / float64(pairs) }
+	switch {
+	case share(odd) >= minUTF16Zeros && share(even) <= maxUTF16Zeros:
+		return "utf-16le"
+	case share(even) >= minUTF16Zeros && share(odd) <= maxUTF16Zeros:
+		return "utf-16be"
+	}
+	return ""
+}
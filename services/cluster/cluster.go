@@ -0,0 +1,120 @@
+// Package cluster groups vectors by cosine similarity with k-means, and
+// projects them onto a plane for plotting. Runs are deterministic: the same
+// vectors in the same order always give the same clusters, so that results
+// derived from them are stable across runs.
+package cluster
+
+import (
+	"sort"
+
+	index "github.com/codectx/tokens/services/index"
+)
+
+// iterations bounds the refinement rounds of KMeans, which usually converges
+// well before.
+const iterations = 25
+
+// KMeans groups vectors into at most k clusters, returned as the indexes of
+// their vectors in ascending order. Clusters are ordered by their first
+// vector; empty clusters are dropped. Centroids start at the first vector,
+// then at the vector farthest from those already picked.
+func KMeans(vectors [][]float32, k int) [][]int {
+	if len(vectors) == 0 || k <= 0 {
+		return nil
+	}
+	k = min(k, len(vectors))
+
+	// farthest-point seeding
+	centroids := [][]float32{vectors[0]}
+	nearest := make([]float32, len(vectors))
+	for i, v := range vectors {
+		nearest[i] = index.CosineDistance(v, vectors[0])
+	}
+	for len(centroids) < k {
+		far := 0
+		for i := range vectors {
+			if nearest[i] > nearest[far] {
+				far = i
+			}
+		}
+		if nearest[far] == 0 {
+			// fewer distinct vectors than k
+			break
+		}
+		centroids = append(centroids, vectors[far])
+		for i, v := range vectors {
+			nearest[i] = min(nearest[i], index.CosineDistance(v, vectors[far]))
+		}
+	}
+
+	assign := make([]int, len(vectors))
+	for round := 0; round < iterations; round++ {
+		changed := false
+		for i, v := range vectors {
+			best, bestD := 0, index.CosineDistance(v, centroids[0])
+			for c := 1; c < len(centroids); c++ {
+				if d := index.CosineDistance(v, centroids[c]); d < bestD {
+					best, bestD = c, d
+				}
+			}
+			if round == 0 || assign[i] != best {
+				assign[i], changed = best, true
+			}
+		}
+		if !changed {
+			break
+		}
+		centroids = means(vectors, assign, centroids)
+	}
+
+	groups := make([][]int, len(centroids))
+	for i, c := range assign {
+		groups[c] = append(groups[c], i)
+	}
+	out := groups[:0]
+	for _, g := range groups {
+		if len(g) > 0 {
+			out = append(out, g)
+		}
+	}
+	// clusters are seeded in order of discovery, not of their vectors
+	sort.Slice(out, func(i, j int) bool { return out[i][0] < out[j][0] })
+	return out
+}
+
+// Centroid returns the mean of vectors.
+func Centroid(vectors [][]float32) []float32 {
+	if len(vectors) == 0 {
+		return nil
+	}
+	c := make([]float32, len(vectors[0]))
+	for _, v := range vectors {
+		for j := range c {
+			if j < len(v) {
+				c[j] += v[j]
+			}
+		}
+	}
+	for j := range c {
+		c[j] /= float32(len(vectors))
+	}
+	return c
+}
+
+// means returns the centroid of the vectors assigned to each cluster,
+// keeping the previous centroid of clusters left empty.
+func means(vectors [][]float32, assign []int, prev [][]float32) [][]float32 {
+	members := make([][][]float32, len(prev))
+	for i, c := range assign {
+		members[c] = append(members[c], vectors[i])
+	}
+	out := make([][]float32, len(prev))
+	for c := range prev {
+		if len(members[c]) == 0 {
+			out[c] = prev[c]
+			continue
+		}
+		out[c] = Centroid(members[c])
+	}
+	return out
+}
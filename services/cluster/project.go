@@ -0,0 +1,98 @@
+package cluster
+
+import "math"
+
+// powerRounds bounds the power iterations finding each principal component.
+const powerRounds = 50
+
+// Project maps vectors onto the plane of their first two principal
+// components, after scaling them to unit length so that distances on the
+// plane follow cosine similarity. Components are found by power iteration
+// from a fixed start, so the same vectors always land at the same points.
+func Project(vectors [][]float32) [][2]float64 {
+	out := make([][2]float64, len(vectors))
+	if len(vectors) == 0 {
+		return out
+	}
+	dims := len(vectors[0])
+
+	// unit vectors, centered on their mean
+	xs := make([][]float64, len(vectors))
+	mean := make([]float64, dims)
+	for i, v := range vectors {
+		x := make([]float64, dims)
+		var norm float64
+		for j := 0; j < dims && j < len(v); j++ {
+			x[j] = float64(v[j])
+			norm += x[j] * x[j]
+		}
+		if norm > 0 {
+			norm = math.Sqrt(norm)
+			for j := range x {
+				x[j] /= norm
+			}
+		}
+		for j := range x {
+			mean[j] += x[j] / float64(len(vectors))
+		}
+		xs[i] = x
+	}
+	for _, x := range xs {
+		for j := range x {
+			x[j] -= mean[j]
+		}
+	}
+
+	var components [][]float64
+	for c := 0; c < 2; c++ {
+		w := make([]float64, dims)
+		for j := range w {
+			// any start not orthogonal to the component will do
+			w[j] = 1 / float64(j+c+1)
+		}
+		flat := false
+		for round := 0; round < powerRounds && !flat; round++ {
+			next := make([]float64, dims)
+			for _, x := range xs {
+				p := dot(x, w)
+				for j := range next {
+					next[j] += p * x[j]
+				}
+			}
+			// stay orthogonal to the components already found
+			for _, prev := range components {
+				p := dot(next, prev)
+				for j := range next {
+					next[j] -= p * prev[j]
+				}
+			}
+			norm := math.Sqrt(dot(next, next))
+			if norm == 0 {
+				// no variance left, e.g. fewer than three distinct vectors
+				flat = true
+				continue
+			}
+			for j := range next {
+				next[j] /= norm
+			}
+			w = next
+		}
+		if flat {
+			continue
+		}
+		components = append(components, w)
+		for i, x := range xs {
+			out[i][c] = dot(x, w)
+		}
+	}
+	return out
+}
+
+// dot returns the dot product of a and b.
+func dot(a, b []float64) float64 {
+	var s float64
+	for i := range a {
+		s += a[i] * b[i]
+	}
+	return s
+}
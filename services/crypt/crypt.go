@@ -0,0 +1,155 @@
+// Package crypt provides optional encryption at rest for the index.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+const (
+	// KeyEnv holds the key itself, hex or base64 encoded.
+	KeyEnv = "CODECTX_ENCRYPTION_KEY"
+	// KeyFileEnv holds the path to a file containing the key.
+	KeyFileEnv = "CODECTX_ENCRYPTION_KEY_FILE"
+	// KeychainEnv holds the keychain service name the key is stored under.
+	KeychainEnv = "CODECTX_ENCRYPTION_KEYCHAIN"
+
+	keySize = 32
+)
+
+// magic prefixes every sealed blob so plaintext rows can be told apart.
+var magic = []byte("ctx1")
+
+// ErrNoCipher is returned when an encrypted blob is read without a key.
+var ErrNoCipher = errors.New("data is encrypted but no encryption key is configured")
+
+// Cipher seals and opens blobs persisted by the store.
+type Cipher interface {
+	// Seal encrypts plaintext, binding it to aad (e.g. the row id).
+	Seal(plaintext, aad []byte) ([]byte, error)
+	// Open decrypts a blob produced by Seal with the same aad.
+	Open(sealed, aad []byte) ([]byte, error)
+}
+
+// aesGCM implements Cipher.
+type aesGCM struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCM returns a Cipher using AES-256-GCM with the given 32 byte key.
+func NewAESGCM(key []byte) (Cipher, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", keySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return &aesGCM{aead: aead}, nil
+}
+
+// Seal encrypts plaintext as magic | nonce | ciphertext.
+func (c *aesGCM) Seal(plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	out := make([]byte, 0, len(magic)+len(nonce)+len(plaintext)+c.aead.Overhead())
+	out = append(out, magic...)
+	out = append(out, nonce...)
+	return c.aead.Seal(out, nonce, plaintext, aad), nil
+}
+
+// Open decrypts a blob produced by Seal.
+func (c *aesGCM) Open(sealed, aad []byte) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, errors.New("blob is not encrypted")
+	}
+	rest := sealed[len(magic):]
+	ns := c.aead.NonceSize()
+	if len(rest) < ns {
+		return nil, errors.New("encrypted blob is truncated")
+	}
+	out, err := c.aead.Open(nil, rest[:ns], rest[ns:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return out, nil
+}
+
+// IsSealed reports whether b looks like a blob produced by Seal.
+func IsSealed(b []byte) bool {
+	return bytes.HasPrefix(b, magic)
+}
+
+// LoadKey resolves the encryption key from the environment, a key file or
+// the OS keychain, in that order. It returns nil when none is configured.
+func LoadKey() ([]byte, error) {
+	if v := os.Getenv(KeyEnv); v != "" {
+		return decodeKey(v)
+	}
+
+	if p := os.Getenv(KeyFileEnv); p != "" {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		return decodeKey(string(b))
+	}
+
+	if svc := os.Getenv(KeychainEnv); svc != "" {
+		v, err := keychainLookup(svc)
+		if err != nil {
+			return nil, err
+		}
+		return decodeKey(v)
+	}
+
+	return nil, nil
+}
+
+// decodeKey accepts a hex or base64 encoded 32 byte key.
+func decodeKey(v string) ([]byte, error) {
+	v = strings.TrimSpace(v)
+	if b, err := hex.DecodeString(v); err == nil && len(b) == keySize {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(v); err == nil && len(b) == keySize {
+		return b, nil
+	}
+	return nil, fmt.Errorf("encryption key must be %d bytes encoded as hex or base64", keySize)
+}
+
+// keychainLookup reads a secret from the macOS keychain or the freedesktop
+// secret service.
+func keychainLookup(service string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-w")
+	case "linux", "freebsd", "openbsd":
+		cmd = exec.Command("secret-tool", "lookup", "service", service)
+	default:
+		return "", fmt.Errorf("keychain lookup is not supported on %s", runtime.GOOS)
+	}
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("keychain lookup failed: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
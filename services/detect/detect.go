@@ -0,0 +1,100 @@
+// Package detect classifies files before they are indexed.
+package detect
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// lineComments start the comment lines of leading comments, and
+// blockComments open and close their comment blocks.
+var (
+	lineComments  = []string{"//", "#", "--", ";", "%"}
+	blockComments = [][2]string{{"/*", "*/"}, {"<!--", "-->"}}
+)
+
+const (
+	// headerSize is how much of a file is scanned for generated markers.
+	headerSize = 2048
+	// maxAvgLineLength is the average line length above which content is
+	// considered minified.
+	maxAvgLineLength = 300
+	// minMinifiedSize avoids flagging short files with a single long line.
+	minMinifiedSize = 1024
+)
+
+var (
+	// goGenerated is the marker defined by https://go.dev/s/generatedcode.
+	goGenerated = regexp.MustCompile(`(?m)^// Code generated .* DO NOT EDIT\.$`)
+	// headerMarkers are common "generated" banners in other ecosystems,
+	// matched in the leading comment of a file only.
+	headerMarkers = regexp.MustCompile(`@generated|(?i:do not edit)`)
+	// sourceMap matches JS/CSS sourcemap comments.
+	sourceMap = regexp.MustCompile(`(//|/\*)# sourceMappingURL=`)
+)
+
+// Generated reports whether content looks generated or minified, and why.
+func Generated(content []byte) (bool, string) {
+	header := content
+	if len(header) > headerSize {
+		header = header[:headerSize]
+	}
+
+	if goGenerated.Match(header) {
+		return true, "code generated marker"
+	}
+	if headerMarkers.Match(leadingComment(header)) {
+		return true, "generated header"
+	}
+	if sourceMap.Match(content) {
+		return true, "sourcemap"
+	}
+	if len(content) >= minMinifiedSize {
+		lines := bytes.Count(content, []byte("\n")) + 1
+		if len(content)/lines > maxAvgLineLength {
+			return true, "long lines"
+		}
+	}
+
+	return false, ""
+}
+
+// leadingComment returns the comment lines and blocks content starts with,
+// blank lines aside, up to the first line of code.
+func leadingComment(content []byte) []byte {
+	var (
+		out []byte
+		end string
+	)
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		trimmed := bytes.TrimSpace(line)
+		if end != "" {
+			out = append(append(out, line...), '\n')
+			if bytes.Contains(trimmed, []byte(end)) {
+				end = ""
+			}
+			continue
+		}
+		if len(trimmed) == 0 {
+			continue
+		}
+		comment := false
+		for _, b := range blockComments {
+			if bytes.HasPrefix(trimmed, []byte(b[0])) {
+				comment = true
+				if !bytes.Contains(trimmed[len(b[0]):], []byte(b[1])) {
+					end = b[1]
+				}
+				break
+			}
+		}
+		for _, p := range lineComments {
+			comment = comment || bytes.HasPrefix(trimmed, []byte(p))
+		}
+		if !comment {
+			break
+		}
+		out = append(append(out, line...), '\n')
+	}
+	return out
+}
@@ -0,0 +1,39 @@
+package detect
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGenerated(t *testing.T) {
+	self, err := os.ReadFile("detect.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name      string
+		content   string
+		generated bool
+	}{
+		{"go marker", "// Code generated by protoc-gen-go. DO NOT EDIT.\n\npackage pb\n", true},
+		{"go marker after the license", "// Copyright 2024\n\n// Code generated by stringer; DO NOT EDIT.\n\npackage x\n", true},
+		{"@generated line comment", "// @generated by relay-compiler\nexport const x = 1;\n", true},
+		{"hash banner", "#!/bin/sh\n# Autogenerated file. Do not edit.\necho hi\n", true},
+		{"block banner", "/*\n * This file was generated from schema.graphql.\n * DO NOT EDIT\n */\nexport type T = {};\n", true},
+		{"html banner", "<!-- @generated -->\n<html></html>\n", true},
+		{"detect.go itself", string(self), false},
+		{"package doc mentioning generation", "// Package gen parses the code generated by tools.\npackage gen\n", false},
+		{"marker after the code starts", "package x\n\n// Do not edit this by hand.\nvar x = 1\n", false},
+		{"marker in a string", "package x\n\nconst note = \"@generated\"\n", false},
+		{"plain source", "package x\n\nfunc f() {}\n", false},
+		{"sourcemap", "var a=1;\n//# sourceMappingURL=app.js.map\n", true},
+		{"long lines", strings.Repeat("x", 2000), true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got, reason := Generated([]byte(c.content)); got != c.generated {
+				t.Errorf("Generated = %v (%s), want %v", got, reason, c.generated)
+			}
+		})
+	}
+}
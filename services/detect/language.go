@@ -0,0 +1,153 @@
+package detect
+
+import (
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// languages maps lower-cased file extensions to language names.
+var languages = map[string]string{
+	".go":     "go",
+	".py":     "python",
+	".pyi":    "python",
+	".ipynb":  "python",
+	".js":     "javascript",
+	".mjs":    "javascript",
+	".cjs":    "javascript",
+	".jsx":    "javascript",
+	".ts":     "typescript",
+	".tsx":    "typescript",
+	".rs":     "rust",
+	".java":   "java",
+	".kt":     "kotlin",
+	".kts":    "kotlin",
+	".scala":  "scala",
+	".swift":  "swift",
+	".c":      "c",
+	".cc":     "cpp",
+	".cpp":    "cpp",
+	".cxx":    "cpp",
+	".hpp":    "cpp",
+	".hh":     "cpp",
+	".cs":     "csharp",
+	".rb":     "ruby",
+	".php":    "php",
+	".sh":     "shell",
+	".bash":   "shell",
+	".zsh":    "shell",
+	".sql":    "sql",
+	".html":   "html",
+	".htm":    "html",
+	".css":    "css",
+	".scss":   "css",
+	".md":     "markdown",
+	".rst":    "markdown",
+	".yaml":   "yaml",
+	".yml":    "yaml",
+	".json":   "json",
+	".jsonl":  "json",
+	".toml":   "toml",
+	".proto":  "protobuf",
+	".tf":     "terraform",
+	".lua":    "lua",
+	".ex":     "elixir",
+	".exs":    "elixir",
+	".erl":    "erlang",
+	".hs":     "haskell",
+	".ml":     "ocaml",
+	".dart":   "dart",
+	".vue":    "vue",
+	".svelte": "svelte",
+}
+
+// filenames maps well-known file names to languages.
+var filenames = map[string]string{
+	"dockerfile":     "dockerfile",
+	"makefile":       "makefile",
+	"gnumakefile":    "makefile",
+	"go.mod":         "go",
+	"go.sum":         "go",
+	"cargo.toml":     "rust",
+	"gemfile":        "ruby",
+	"rakefile":       "ruby",
+	"jenkinsfile":    "groovy",
+	"cmakelists.txt": "cmake",
+}
+
+var (
+	// shebang captures the interpreter of a script without its version, e.g.
+	// python from "#!/usr/bin/env python3".
+	shebang = regexp.MustCompile(`^#!\s*(?:\S*/)?(?:env\s+(?:-\S+\s+)*)?([A-Za-z]+)`)
+	// interpreters maps shebang interpreters, without version digits, to
+	// languages.
+	interpreters = map[string]string{
+		"python": "python",
+		"node":   "javascript",
+		"deno":   "typescript",
+		"bash":   "shell",
+		"sh":     "shell",
+		"zsh":    "shell",
+		"ruby":   "ruby",
+		"perl":   "perl",
+		"php":    "php",
+	}
+	// cppMarkers are C++ constructs telling C++ headers from C ones.
+	cppMarkers = regexp.MustCompile(`(?m)^\s*(class|namespace|template\s*<)|\bstd::|#include\s*<(iostream|string|vector|memory)>`)
+)
+
+// Language returns the language of the file at path, from its name or
+// extension, else from a shebang line, or "" when it can't be told.
+// Ambiguous .h headers are classified from their content.
+func Language(path string, content []byte) string {
+	base := strings.ToLower(filepath.Base(path))
+	if lang, ok := filenames[base]; ok {
+		return lang
+	}
+	if strings.HasPrefix(base, "dockerfile.") {
+		return "dockerfile"
+	}
+
+	ext := filepath.Ext(base)
+	if ext == ".h" {
+		if cppMarkers.Match(header(content)) {
+			return "cpp"
+		}
+		return "c"
+	}
+	if lang, ok := languages[ext]; ok {
+		return lang
+	}
+
+	if m := shebang.FindSubmatch(header(content)); m != nil {
+		return interpreters[string(m[1])]
+	}
+	return ""
+}
+
+// Languages lists the languages Language can return, sorted.
+func Languages() []string {
+	seen := map[string]bool{}
+	for _, m := range []map[string]string{languages, filenames, interpreters} {
+		for _, lang := range m {
+			seen[lang] = true
+		}
+	}
+	seen["c"], seen["cpp"] = true, true
+	out := make([]string, 0, len(seen))
+	for lang := range seen {
+		out = append(out, lang)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// header returns the beginning of content that heuristics look at.
+func header(content []byte) []byte {
+	if len(content) > headerSize {
+		content = content[:headerSize]
+	}
+	return bytes.TrimPrefix(content, []byte("\ufeff"))
+}
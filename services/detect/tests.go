@@ -0,0 +1,50 @@
+package detect
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// testNames match the file names of tests by the conventions of each
+// ecosystem, the name of the tested file being the first non-empty group.
+var testNames = []*regexp.Regexp{
+	// Go, Python, Ruby, Rust, Elixir, C and others: foo_test.go,
+	// foo_test.py, foo_spec.rb
+	regexp.MustCompile(`^(.+)_(?:test|spec)s?\.(?:go|py|rb|rs|exs?|c|cc|cpp|[cm]?[jt]sx?|lua|sh|dart|zig)$`),
+	// Python: test_foo.py
+	regexp.MustCompile(`^test_(.+)\.py$`),
+	// JavaScript and TypeScript: foo.test.ts, foo.spec.jsx
+	regexp.MustCompile(`^(.+)\.(?:test|spec)\.[cm]?[jt]sx?$`),
+	// Java, Kotlin, C#, Scala, PHP and Swift: FooTest.java, FooTests.cs,
+	// FooSpec.scala, FooIT.java, TestFoo.java
+	regexp.MustCompile(`^(\w+?)(?:Tests?|Spec|IT)\.(?:java|kt|kts|cs|scala|php|swift)$`),
+	regexp.MustCompile(`^Test([A-Z]\w*)\.(?:java|kt|cs|scala)$`),
+}
+
+// testDirs are the directories whose files are all tests.
+var testDirs = map[string]bool{
+	"test": true, "tests": true, "__tests__": true, "spec": true, "specs": true,
+}
+
+// Test reports whether p, a slash-separated path relative to the root of
+// its repository, names a test file, by its name or by a test directory it
+// is in. It also returns the base name, without extension, of the file it
+// tests when its name gives it: foo for foo_test.go, test_foo.py or
+// foo.spec.ts, Foo for FooTest.java.
+func Test(p string) (subject string, ok bool) {
+	base := path.Base(p)
+	for _, re := range testNames {
+		if m := re.FindStringSubmatch(base); m != nil {
+			return m[1], true
+		}
+	}
+	dir := path.Dir(p)
+	for dir != "." && dir != "/" && dir != "" {
+		if testDirs[strings.ToLower(path.Base(dir))] {
+			return "", true
+		}
+		dir = path.Dir(dir)
+	}
+	return "", false
+}
@@ -0,0 +1,125 @@
+package embed
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// latencyTolerance is how much slower than the best observed latency the
+// provider may get before concurrency is reduced.
+const latencyTolerance = 2.0
+
+// Adaptive is an EmbeddingService that tunes how many embeddings run at
+// once, AIMD-style: the limit grows by one per round trip while latency stays
+// close to the best observed, and is halved on errors or latency spikes.
+type Adaptive struct {
+	EmbeddingService
+	min, max int
+	onChange func(limit int)
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	// released is closed and replaced whenever a slot frees up.
+	released chan struct{}
+	// smoothed and baseline are latencies in milliseconds.
+	smoothed     float64
+	baseline     float64
+	lastDecrease time.Time
+}
+
+// NewAdaptive limits svc to between lo and hi concurrent embeddings,
+// starting at start. onChange, if set, is called when the limit changes.
+func NewAdaptive(svc EmbeddingService, lo, hi, start int, onChange func(limit int)) *Adaptive {
+	lo = max(lo, 1)
+	hi = max(hi, lo)
+	return &Adaptive{
+		EmbeddingService: svc,
+		min:              lo,
+		max:              hi,
+		onChange:         onChange,
+		limit:            float64(min(max(start, lo), hi)),
+		released:         make(chan struct{}),
+	}
+}
+
+// Get generates an embedding once a slot is available.
+func (a *Adaptive) Get(ctx context.Context, text string) ([]float32, Meta, error) {
+	if err := a.acquire(ctx); err != nil {
+		return nil, Meta{}, err
+	}
+	start := time.Now()
+	vec, meta, err := a.EmbeddingService.Get(ctx, text)
+	a.release(time.Since(start), err != nil && ctx.Err() == nil)
+	return vec, meta, err
+}
+
+// Limit returns the current concurrency limit.
+func (a *Adaptive) Limit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return int(a.limit)
+}
+
+// acquire waits for a free slot.
+func (a *Adaptive) acquire(ctx context.Context) error {
+	for {
+		a.mu.Lock()
+		if a.inflight < int(a.limit) {
+			a.inflight++
+			a.mu.Unlock()
+			return nil
+		}
+		released := a.released
+		a.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+// release frees a slot and adjusts the limit from the call outcome.
+func (a *Adaptive) release(latency time.Duration, failed bool) {
+	a.mu.Lock()
+	prev := int(a.limit)
+	a.inflight--
+
+	ms := float64(latency.Microseconds()) / 1000
+	if a.smoothed == 0 {
+		a.smoothed = ms
+	} else {
+		a.smoothed = 0.8*a.smoothed + 0.2*ms
+	}
+	if a.baseline == 0 || a.smoothed < a.baseline {
+		a.baseline = a.smoothed
+	}
+
+	if failed || a.smoothed > latencyTolerance*a.baseline {
+		// Decrease at most once per round trip, since calls that were in
+		// flight together fail or slow down together
+		if time.Since(a.lastDecrease) > time.Duration(a.smoothed*float64(time.Millisecond)) {
+			a.limit = math.Max(float64(a.min), a.limit/2)
+			a.lastDecrease = time.Now()
+			if !failed {
+				// let the baseline follow a provider that got slower for good
+				a.baseline = a.smoothed / latencyTolerance
+			}
+		}
+	} else {
+		a.limit = math.Min(float64(a.max), a.limit+1/a.limit)
+	}
+
+	close(a.released)
+	a.released = make(chan struct{})
+	limit := int(a.limit)
+	a.mu.Unlock()
+
+	if limit != prev && a.onChange != nil {
+		a.onChange(limit)
+	}
+}
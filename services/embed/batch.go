@@ -0,0 +1,308 @@
+package embed
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BatchProvider is a Provider embedding several texts per request.
+type BatchProvider interface {
+	Provider
+	// EmbedBatch generates an embedding for each of texts, in order.
+	EmbedBatch(ctx context.Context, texts []string) ([][]float32, Meta, error)
+}
+
+// Limits bound the requests made to a provider, 0 for no bound.
+type Limits struct {
+	// MaxTokens bounds the tokens of each input. Longer texts are handled
+	// by Truncate.
+	MaxTokens int
+	// Truncate is the policy of texts over MaxTokens, TruncateSplit when
+	// empty.
+	Truncate string
+	// MaxBatchSize bounds the inputs of a request.
+	MaxBatchSize int
+	// MaxBatchTokens bounds the tokens of the inputs of a request.
+	MaxBatchTokens int
+}
+
+// Truncation reports a text, or with TruncateSplit a line of a text, longer
+// than Limits.MaxTokens and cut to fit.
+type Truncation struct {
+	// Policy is the truncation policy applied.
+	Policy string
+	// Tokens is the length of the text cut, Kept what is left of it.
+	Tokens int
+	Kept   int
+}
+
+// batcher packs the embeddings of concurrent callers into the requests of
+// a BatchProvider.
+type batcher struct {
+	p          BatchProvider
+	limits     Limits
+	count      func(string) int
+	onTruncate func(context.Context, Truncation)
+
+	mu       sync.Mutex
+	pending  []*piece
+	tokens   int
+	inflight int
+}
+
+// piece is an input of a request: a text, or the part of a text split to
+// fit Limits.MaxTokens.
+type piece struct {
+	ctx    context.Context
+	text   string
+	tokens int
+
+	vec  []float32
+	meta Meta
+	err  error
+	done chan struct{}
+}
+
+// NewBatcher returns p embedding the texts of the Get calls arriving while
+// a request is in flight together, in requests within limits, their tokens
+// counted by count. Texts over limits.MaxTokens are cut by limits.Truncate,
+// or split at line breaks and embedded as the mean of their parts, weighted
+// by tokens, with lines over it on their own cut; each cut is reported to
+// onTruncate with the context of the caller. Providers that aren't a
+// BatchProvider embed the inputs of a request one by one.
+func NewBatcher(p Provider, limits Limits, count func(string) int, onTruncate func(context.Context, Truncation)) EmbeddingService {
+	bp, ok := p.(BatchProvider)
+	if !ok {
+		bp = serialBatch{p}
+	}
+	return FromProvider(&batcher{p: bp, limits: limits, count: count, onTruncate: onTruncate})
+}
+
+// serialBatch embeds the texts of a batch one by one.
+type serialBatch struct {
+	Provider
+}
+
+// EmbedBatch generates an embedding for each of texts, in order.
+func (p serialBatch) EmbedBatch(ctx context.Context, texts []string) ([][]float32, Meta, error) {
+	var (
+		out = make([][]float32, len(texts))
+		sum Meta
+	)
+	for i, t := range texts {
+		vec, meta, err := p.Embed(ctx, t)
+		sum.Tokens += meta.Tokens
+		sum.Duration += meta.Duration
+		sum.ProviderName, sum.ProviderModel = meta.ProviderName, meta.ProviderModel
+		if err != nil {
+			return nil, sum, err
+		}
+		out[i] = vec
+	}
+	return out, sum, nil
+}
+
+// Embed generates an embedding of text, in a request shared with the other
+// callers waiting.
+func (b *batcher) Embed(ctx context.Context, text string) ([]float32, Meta, error) {
+	// Batches are of documents only
+	if IsQuery(ctx) {
+		return b.p.Embed(ctx, text)
+	}
+	start := time.Now()
+	pieces := b.split(ctx, text)
+	for _, p := range pieces {
+		b.add(p)
+	}
+
+	var (
+		vec   []float32
+		meta  Meta
+		total float32
+	)
+	for _, p := range pieces {
+		select {
+		case <-ctx.Done():
+			return nil, meta, fmt.Errorf("failed to embed text: %w", ctx.Err())
+		case <-p.done:
+		}
+		if p.err != nil {
+			return nil, p.meta, p.err
+		}
+		if vec == nil {
+			vec = make([]float32, len(p.vec))
+		}
+		w := float32(max(p.tokens, 1))
+		for j := range vec {
+			if j < len(p.vec) {
+				vec[j] += w * p.vec[j]
+			}
+		}
+		total += w
+		meta.Tokens += p.meta.Tokens
+		meta.ProviderName, meta.ProviderModel = p.meta.ProviderName, p.meta.ProviderModel
+	}
+	for j := range vec {
+		vec[j] /= total
+	}
+	meta.Duration = int(time.Since(start).Milliseconds())
+	return vec, meta, nil
+}
+
+// Name returns the name of the provider.
+func (b *batcher) Name() string {
+	return b.p.Name()
+}
+
+// split returns the pieces of text within MaxTokens.
+func (b *batcher) split(ctx context.Context, text string) []*piece {
+	newPiece := func(text string, tokens int) *piece {
+		return &piece{ctx: ctx, text: text, tokens: tokens, done: make(chan struct{})}
+	}
+	n := b.count(text)
+	if b.limits.MaxTokens <= 0 || n <= b.limits.MaxTokens {
+		return []*piece{newPiece(text, n)}
+	}
+	if policy := b.limits.Truncate; policy != "" && policy != TruncateSplit {
+		return []*piece{newPiece(b.cut(ctx, text, n, policy))}
+	}
+
+	var (
+		out    []*piece
+		cur    strings.Builder
+		tokens int
+	)
+	flush := func() {
+		if cur.Len() > 0 {
+			out = append(out, newPiece(cur.String(), tokens))
+			cur.Reset()
+			tokens = 0
+		}
+	}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		n := b.count(line)
+		if n > b.limits.MaxTokens {
+			line, n = b.cut(ctx, line, n, TruncateSplit)
+		}
+		if tokens+n > b.limits.MaxTokens {
+			flush()
+		}
+		cur.WriteString(line)
+		tokens += n
+	}
+	flush()
+	return out
+}
+
+// cut returns text, of n tokens, cut to MaxTokens by policy, and its
+// tokens.
+func (b *batcher) cut(ctx context.Context, text string, n int, policy string) (string, int) {
+	text, kept := Truncate(text, b.limits.MaxTokens, policy, b.count)
+	if b.onTruncate != nil {
+		b.onTruncate(ctx, Truncation{Policy: policy, Tokens: n, Kept: kept})
+	}
+	return text, kept
+}
+
+// add queues p, sending the pending pieces once full, or right away when no
+// request is in flight.
+func (b *batcher) add(p *piece) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.pending) > 0 && b.full(p) {
+		b.inflight++
+		go b.send(b.take())
+	}
+	b.pending = append(b.pending, p)
+	b.tokens += p.tokens
+	if b.inflight == 0 {
+		b.inflight++
+		go b.send(b.take())
+	}
+}
+
+// full reports whether adding p would take the pending pieces over limits.
+func (b *batcher) full(p *piece) bool {
+	if b.limits.MaxBatchSize > 0 && len(b.pending)+1 > b.limits.MaxBatchSize {
+		return true
+	}
+	return b.limits.MaxBatchTokens > 0 && b.tokens+p.tokens > b.limits.MaxBatchTokens
+}
+
+// take returns the pending pieces whose callers still wait.
+func (b *batcher) take() []*piece {
+	var batch []*piece
+	for _, p := range b.pending {
+		if err := p.ctx.Err(); err != nil {
+			p.err = fmt.Errorf("failed to embed text: %w", err)
+			close(p.done)
+			continue
+		}
+		batch = append(batch, p)
+	}
+	b.pending, b.tokens = nil, 0
+	return batch
+}
+
+// send embeds batch, then the pieces queued meanwhile, until none are left.
+func (b *batcher) send(batch []*piece) {
+	for {
+		if len(batch) > 0 {
+			b.request(batch)
+		}
+		b.mu.Lock()
+		if len(b.pending) == 0 {
+			b.inflight--
+			b.mu.Unlock()
+			return
+		}
+		batch = b.take()
+		b.mu.Unlock()
+	}
+}
+
+// request embeds batch in one request, cancelled once every caller gave up.
+func (b *batcher) request(batch []*piece) {
+	ctx, cancel := context.WithCancel(context.WithoutCancel(batch[0].ctx))
+	defer cancel()
+	var waiting atomic.Int32
+	waiting.Store(int32(len(batch)))
+	for _, p := range batch {
+		stop := context.AfterFunc(p.ctx, func() {
+			if waiting.Add(-1) == 0 {
+				cancel()
+			}
+		})
+		defer stop()
+	}
+
+	texts := make([]string, len(batch))
+	for i, p := range batch {
+		texts[i] = p.text
+	}
+	vecs, meta, err := b.p.EmbedBatch(ctx, texts)
+	if err == nil && len(vecs) != len(batch) {
+		err = fmt.Errorf("failed to embed text: %d embeddings for %d inputs", len(vecs), len(batch))
+	}
+	// Tokens are shared out by the inputs' estimated tokens
+	var estimated int
+	for _, p := range batch {
+		estimated += p.tokens
+	}
+	for i, p := range batch {
+		p.err, p.meta = err, meta
+		p.meta.Tokens = 0
+		if estimated > 0 {
+			p.meta.Tokens = meta.Tokens * p.tokens / estimated
+		}
+		if err == nil {
+			p.vec = vecs[i]
+		}
+		close(p.done)
+	}
+}
@@ -0,0 +1,166 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a Breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets every embedding through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen pauses embeddings until the cooldown expires.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe through to test the provider.
+	BreakerHalfOpen
+)
+
+// String returns the state name.
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// probeInterval is how often callers waiting on a half-open breaker check
+// whether the probe succeeded.
+const probeInterval = 100 * time.Millisecond
+
+// Breaker is an EmbeddingService that stops calling a failing provider.
+// After threshold consecutive failures it opens and Get waits for the
+// cooldown instead of failing, then a single probe decides whether to close
+// or to stay open for another cooldown.
+type Breaker struct {
+	EmbeddingService
+	threshold int
+	cooldown  time.Duration
+	onChange  func(state BreakerState, err error)
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	until    time.Time
+	probing  bool
+}
+
+// NewBreaker wraps svc with a circuit breaker. onChange, if set, is called
+// on every state change with the error that caused it.
+func NewBreaker(svc EmbeddingService, threshold int, cooldown time.Duration, onChange func(state BreakerState, err error)) *Breaker {
+	return &Breaker{EmbeddingService: svc, threshold: threshold, cooldown: cooldown, onChange: onChange}
+}
+
+// Get generates an embedding, waiting first while the breaker is open.
+func (b *Breaker) Get(ctx context.Context, text string) ([]float32, Meta, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, Meta{}, err
+	}
+	vec, meta, err := b.EmbeddingService.Get(ctx, text)
+	if errors.Is(err, context.Canceled) && ctx.Err() != nil {
+		// the caller gave up; that says nothing about the provider
+		b.release()
+		return vec, meta, err
+	}
+	b.record(err)
+	return vec, meta, err
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// RetryAfter returns how long until the next probe while the breaker is open.
+func (b *Breaker) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerOpen {
+		return 0
+	}
+	return max(time.Until(b.until), 0)
+}
+
+// wait blocks while the breaker is open or another caller is probing.
+func (b *Breaker) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		var delay time.Duration
+		switch b.state {
+		case BreakerClosed:
+			b.mu.Unlock()
+			return nil
+		case BreakerOpen:
+			delay = time.Until(b.until)
+			if delay <= 0 {
+				b.state, b.probing = BreakerHalfOpen, true
+				b.mu.Unlock()
+				b.notify(BreakerHalfOpen, nil)
+				return nil
+			}
+		case BreakerHalfOpen:
+			if !b.probing {
+				b.probing = true
+				b.mu.Unlock()
+				return nil
+			}
+			delay = probeInterval
+		}
+		b.mu.Unlock()
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// release gives up a probe without recording an outcome.
+func (b *Breaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// record updates the breaker with the outcome of a call.
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	b.probing = false
+	prev := b.state
+	if err == nil {
+		b.failures = 0
+		b.state = BreakerClosed
+	} else {
+		b.failures++
+		// calls already in flight when the breaker opened don't extend the cooldown
+		if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.threshold) {
+			b.state = BreakerOpen
+			b.until = time.Now().Add(b.cooldown)
+		}
+	}
+	state := b.state
+	b.mu.Unlock()
+
+	if state != prev {
+		b.notify(state, err)
+	}
+}
+
+// notify reports a state change.
+func (b *Breaker) notify(state BreakerState, err error) {
+	if b.onChange != nil {
+		b.onChange(state, err)
+	}
+}
@@ -0,0 +1,89 @@
+package embed
+
+import (
+	"context"
+	"strings"
+)
+
+// Capabilities describe the requests a provider accepts and the vectors it
+// returns, each 0 or false when unknown.
+type Capabilities struct {
+	// MaxInputTokens is the context of the model: longer inputs are
+	// truncated by the provider.
+	MaxInputTokens int `json:"max_input_tokens,omitempty"`
+	// MaxBatchSize and MaxBatchTokens bound the inputs of a request and
+	// their tokens.
+	MaxBatchSize   int `json:"max_batch_size,omitempty"`
+	MaxBatchTokens int `json:"max_batch_tokens,omitempty"`
+	// Dims is the size of the vectors.
+	Dims int `json:"dims,omitempty"`
+	// InputTypes reports whether queries are embedded apart from documents,
+	// for contexts made by AsQuery.
+	InputTypes bool `json:"input_types,omitempty"`
+}
+
+// ollamaCapabilities are those of well-known Ollama models, without their
+// tag.
+var ollamaCapabilities = map[string]Capabilities{
+	ollamaModelName:     {MaxInputTokens: 8192, Dims: 768},
+	"nomic-embed-text":  {MaxInputTokens: 8192, Dims: 768},
+	"mxbai-embed-large": {MaxInputTokens: 512, Dims: 1024},
+	"all-minilm":        {MaxInputTokens: 256, Dims: 384},
+	"bge-m3":            {MaxInputTokens: 8192, Dims: 1024},
+}
+
+// voyageCapabilities are those of Voyage models, which all take 1,000
+// inputs a request and tell queries from documents.
+var voyageCapabilities = map[string]Capabilities{
+	"voyage-code-3":  {MaxInputTokens: 32000, MaxBatchTokens: 120000, Dims: 1024},
+	"voyage-3-large": {MaxInputTokens: 32000, MaxBatchTokens: 120000, Dims: 1024},
+	"voyage-3.5":     {MaxInputTokens: 32000, MaxBatchTokens: 320000, Dims: 1024},
+	"voyage-3":       {MaxInputTokens: 32000, MaxBatchTokens: 120000, Dims: 1024},
+	"voyage-3-lite":  {MaxInputTokens: 32000, MaxBatchTokens: 1000000, Dims: 512},
+	"voyage-code-2":  {MaxInputTokens: 16000, MaxBatchTokens: 120000, Dims: 1536},
+}
+
+// queryKey marks the contexts of query embeddings.
+type queryKey struct{}
+
+// AsQuery returns ctx marking the text embedded with it as a query, which
+// providers with Capabilities.InputTypes embed apart from documents.
+func AsQuery(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queryKey{}, true)
+}
+
+// IsQuery reports whether ctx was made by AsQuery.
+func IsQuery(ctx context.Context) bool {
+	q, _ := ctx.Value(queryKey{}).(bool)
+	return q
+}
+
+// Capabilities returns those of the Ollama model, known for well-known
+// models only.
+func (p *ollamaProvider) Capabilities() Capabilities {
+	name, _, _ := strings.Cut(p.model, ":")
+	return ollamaCapabilities[name]
+}
+
+// Capabilities returns those of the Voyage model.
+func (p *voyageProvider) Capabilities() Capabilities {
+	c := voyageCapabilities[p.model]
+	c.MaxBatchSize, c.InputTypes = 1000, true
+	return c
+}
+
+// Capabilities returns none: plugins don't report theirs.
+func (p *execProvider) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// Capabilities returns none: the embedders serving the queue may run any
+// provider.
+func (p *queueProvider) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// Capabilities returns those of the provider batched.
+func (b *batcher) Capabilities() Capabilities {
+	return b.p.Capabilities()
+}
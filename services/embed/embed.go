@@ -7,13 +7,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
 	ollama "github.com/ollama/ollama/api"
-	"github.com/sugarme/tokenizer"
 )
 
 // EmbeddingsRequest represents the payload sent to the VoyageAI embeddings endpoint.
@@ -44,13 +42,14 @@ type EmbeddingService interface {
 
 // embeddingService implements EmbeddingService.
 type embeddingService struct {
-	tk     *tokenizer.Tokenizer
+	tk     Tokenizer
 	client *ollama.Client
 }
 
 // NewEmbedService returns an EmbeddingService instance.
 // You might inject additional dependencies (e.g., Voyage clients) as needed.
-func NewEmbedService(oClient *ollama.Client, tk *tokenizer.Tokenizer) EmbeddingService {
+// tk counts the tokens of texts Ollama fails to embed.
+func NewEmbedService(oClient *ollama.Client, tk Tokenizer) EmbeddingService {
 	if oClient == nil {
 		panic("ollama client is not initialized")
 	}
@@ -76,13 +75,6 @@ type Meta struct {
 // Get obtains an embedding using the Ollama client
 // In production, handle tokens, model name, error checking, etc.
 func (s *embeddingService) Get(ctx context.Context, value string) ([]float32, Meta, error) {
-	// optional
-	en, err := s.tk.EncodeSingle(value)
-	if err != nil {
-		slog.Error("Failed to encode text", "error", err)
-		os.Exit(1)
-	}
-
 	start := time.Now()
 	emb, err := s.client.Embed(ctx, &ollama.EmbedRequest{
 		Model: ollamaModelName,
@@ -92,7 +84,7 @@ func (s *embeddingService) Get(ctx context.Context, value string) ([]float32, Me
 	if err != nil {
 		return nil,
 			Meta{
-				Tokens:        en.Len(),
+				Tokens:        s.tk.Count(value),
 				Duration:      int(time.Since(start).Milliseconds()),
 				ProviderName:  "ollama",
 				ProviderModel: ollamaModelName,
@@ -109,14 +101,61 @@ func (s *embeddingService) Get(ctx context.Context, value string) ([]float32, Me
 		}, nil
 }
 
+// EnsureModel pulls the Ollama embedding model unless it is already available.
+// progress, if set, is called with each status update reported by Ollama.
+func EnsureModel(ctx context.Context, client *ollama.Client, progress func(ollama.ProgressResponse)) error {
+	list, err := client.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list models: %w", err)
+	}
+	for _, m := range list.Models {
+		if strings.TrimSuffix(m.Name, ":latest") == ollamaModelName {
+			return nil
+		}
+	}
+
+	err = client.Pull(ctx, &ollama.PullRequest{Model: ollamaModelName}, func(p ollama.ProgressResponse) error {
+		if progress != nil {
+			progress(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pull model %s: %w", ollamaModelName, err)
+	}
+	return nil
+}
+
+// inputType returns the Voyage input type of the texts embedded with ctx.
+func inputType(ctx context.Context) embeddingsRequestInputType {
+	if IsQuery(ctx) {
+		return embeddingsRequestInputTypeQuery
+	}
+	return embeddingsRequestInputTypeDocument
+}
+
 // embedVoyage embeds the given value using the VoyageAI API.
 func (s *embeddingService) Voyage(key, value string) ([]float32, Meta, error) {
+	return voyage(context.Background(), key, voyageModelName, value)
+}
 
+// voyage embeds value as a document with the given VoyageAI model.
+func voyage(ctx context.Context, key, model, value string) ([]float32, Meta, error) {
+	vecs, meta, err := voyageBatch(ctx, key, model, embeddingsRequestInputTypeDocument, []string{value})
+	if err != nil {
+		return nil, meta, err
+	}
+	return vecs[0], meta, nil
+}
+
+// voyageBatch embeds values as inputs of the given type with the given
+// VoyageAI model, in one request.
+func voyageBatch(ctx context.Context, key, model string, typ embeddingsRequestInputType, values []string) ([][]float32, Meta, error) {
 	// Prepare request body
 	requestBody := EmbeddingsRequest{
-		Input:     value,
-		Model:     voyageModelName,
-		InputType: embeddingsRequestInputTypeDocument,
+		Input:     values,
+		Model:     model,
+		InputType: typ,
 	}
 
 	jsonData, err := json.Marshal(requestBody)
@@ -125,7 +164,7 @@ func (s *embeddingService) Voyage(key, value string) ([]float32, Meta, error) {
 	}
 
 	// Create HTTP request
-	req, err := http.NewRequest(http.MethodPost, voyageURL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, voyageURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, Meta{}, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
@@ -146,6 +185,9 @@ func (s *embeddingService) Voyage(key, value string) ([]float32, Meta, error) {
 	if err != nil {
 		return nil, Meta{}, fmt.Errorf("failed to read response body: %w", err)
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, Meta{}, fmt.Errorf("voyage returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
 
 	// fmt.Println(string(body))
 
@@ -154,11 +196,21 @@ func (s *embeddingService) Voyage(key, value string) ([]float32, Meta, error) {
 	if err := json.Unmarshal(body, &res); err != nil {
 		return nil, Meta{}, fmt.Errorf("failed to unmarshal JSON: %w", err)
 	}
+	if len(res.Data) != len(values) {
+		return nil, Meta{}, fmt.Errorf("voyage returned %d embeddings for %d inputs", len(res.Data), len(values))
+	}
+	vecs := make([][]float32, len(values))
+	for i, d := range res.Data {
+		if d.Index < 0 || d.Index >= len(vecs) {
+			d.Index = i
+		}
+		vecs[d.Index] = d.Embedding
+	}
 
-	return res.Data[0].Embedding, Meta{
+	return vecs, Meta{
 		Tokens:        res.Usage.TotalTokens,
 		ProviderName:  "voyageai",
-		ProviderModel: voyageModelName,
+		ProviderModel: model,
 		Duration:      int(time.Since(start).Milliseconds()),
 	}, nil
 }
@@ -168,6 +220,7 @@ type voyageAIResponse struct {
 	Data   []struct {
 		Object    string    `json:"object"`
 		Embedding []float32 `json:"embedding"`
+		Index     int       `json:"index"`
 	}
 	Model string `json:"model"`
 	Usage struct {
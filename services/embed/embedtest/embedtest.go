@@ -0,0 +1,219 @@
+// Package embedtest provides a fake embedding provider, so that indexing and
+// search can be exercised without Ollama or an API key.
+//
+// Its vectors are deterministic: the words of the text are hashed into the
+// dimensions of the vector, which is then normalized. Texts sharing words
+// get close vectors, so that searches, including through the HNSW graph,
+// return the files sharing the most words with the query first.
+//
+// Importing the package registers the provider as fake[:dims] with
+// embed.ParseProvider. Tests import it; the codectx binary only does when
+// built with the embedtest tag, keeping the fake out of releases.
+package embedtest
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	embed "github.com/codectx/tokens/services/embed"
+)
+
+func init() {
+	embed.Register("fake", func(model string) (embed.Provider, error) {
+		if model == "" {
+			return NewProvider(0), nil
+		}
+		dims, err := strconv.Atoi(model)
+		if err != nil || dims <= 0 {
+			return nil, fmt.Errorf("invalid fake provider %q: use fake or fake:<dimensions>", "fake:"+model)
+		}
+		return NewProvider(dims), nil
+	})
+	embed.RegisterTokenizer("fake", func(string) (embed.Tokenizer, error) {
+		return Tokenizer{}, nil
+	})
+}
+
+// DefaultDims is the size of the vectors of a provider made with 0 dims.
+const DefaultDims = 64
+
+// Provider is a fake embed.Provider recording the texts it embeds.
+type Provider struct {
+	dims int
+
+	mu      sync.Mutex
+	calls   []string
+	batches []int
+	err     error
+}
+
+// NewProvider returns a provider of vectors of dims dimensions, DefaultDims
+// when 0.
+func NewProvider(dims int) *Provider {
+	if dims <= 0 {
+		dims = DefaultDims
+	}
+	return &Provider{dims: dims}
+}
+
+// Embed returns the vector of text, or the error set by Fail.
+func (p *Provider) Embed(ctx context.Context, text string) ([]float32, embed.Meta, error) {
+	meta := embed.Meta{ProviderName: "fake", ProviderModel: p.model(), Tokens: len(Words(text))}
+	if err := ctx.Err(); err != nil {
+		return nil, meta, fmt.Errorf("failed to embed text: %w", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return nil, meta, fmt.Errorf("failed to embed text: %w", p.err)
+	}
+	p.calls = append(p.calls, text)
+	return Vector(text, p.dims), meta, nil
+}
+
+// EmbedBatch returns the vector of each of texts, recording their number
+// as one request.
+func (p *Provider) EmbedBatch(ctx context.Context, texts []string) ([][]float32, embed.Meta, error) {
+	meta := embed.Meta{ProviderName: "fake", ProviderModel: p.model()}
+	for _, t := range texts {
+		meta.Tokens += len(Words(t))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, meta, fmt.Errorf("failed to embed text: %w", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return nil, meta, fmt.Errorf("failed to embed text: %w", p.err)
+	}
+	out := make([][]float32, len(texts))
+	for i, t := range texts {
+		out[i] = Vector(t, p.dims)
+	}
+	p.calls = append(p.calls, texts...)
+	p.batches = append(p.batches, len(texts))
+	return out, meta, nil
+}
+
+// Capabilities returns the dimensions of the vectors.
+func (p *Provider) Capabilities() embed.Capabilities {
+	return embed.Capabilities{Dims: p.dims}
+}
+
+// Name returns fake:<dims>.
+func (p *Provider) Name() string {
+	return "fake:" + p.model()
+}
+
+func (p *Provider) model() string {
+	return fmt.Sprint(p.dims)
+}
+
+// Calls returns the texts embedded so far, in order, to check what a change
+// re-embedded.
+func (p *Provider) Calls() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.calls...)
+}
+
+// Batches returns the number of texts of each EmbedBatch call so far, in
+// order.
+func (p *Provider) Batches() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]int(nil), p.batches...)
+}
+
+// Reset forgets the texts embedded so far.
+func (p *Provider) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls, p.batches = nil, nil
+}
+
+// Fail makes the following calls fail with err, until Fail(nil).
+func (p *Provider) Fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// Tokenizer is the embed.Tokenizer of the provider: a token per word, as
+// its embeddings count them.
+type Tokenizer struct{}
+
+// Count returns the number of words of text.
+func (Tokenizer) Count(text string) int {
+	return len(Words(text))
+}
+
+// Name returns fake.
+func (Tokenizer) Name() string {
+	return "fake"
+}
+
+// Vector returns the vector of dims dimensions of text: the hash of each of
+// its words adds or subtracts one to a dimension, and the sum is normalized.
+// A text without words gets the unit vector of the first dimension.
+func Vector(text string, dims int) []float32 {
+	vec := make([]float32, dims)
+	for _, w := range Words(text) {
+		h := fnv.New64a()
+		h.Write([]byte(w))
+		sum := h.Sum64()
+		if sum>>63 == 0 {
+			vec[sum%uint64(dims)]++
+		} else {
+			vec[sum%uint64(dims)]--
+		}
+	}
+	var norm float64
+	for _, v := range vec {
+		norm += float64(v * v)
+	}
+	if norm == 0 {
+		vec[0] = 1
+		return vec
+	}
+	for i := range vec {
+		vec[i] = float32(float64(vec[i]) / math.Sqrt(norm))
+	}
+	return vec
+}
+
+// Words splits text into the lowercase words Vector hashes: runs of letters
+// and digits, with camelCase and snake_case identifiers split apart.
+func Words(text string) []string {
+	var (
+		words []string
+		word  []rune
+		prev  rune
+	)
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	for _, r := range text {
+		switch {
+		case unicode.IsUpper(r) && unicode.IsLower(prev):
+			flush()
+			word = append(word, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, r)
+		default:
+			flush()
+		}
+		prev = r
+	}
+	flush()
+	return words
+}
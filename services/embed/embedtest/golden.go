@@ -0,0 +1,32 @@
+package embedtest
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Fixture is a text and its vector of 8 dimensions.
+type Fixture struct {
+	Text   string
+	Vector []float32
+}
+
+// Golden pins vectors of Vector, so that indexes and expected results
+// recorded with the fake provider stay valid.
+var Golden = []Fixture{
+	{"", []float32{1, 0, 0, 0, 0, 0, 0, 0}},
+	{"retry policy", []float32{0, 0.70710677, 0, 0, 0, 0, 0, -0.70710677}},
+	{"parse_config file", []float32{0, 0, 0, -0.57735026, 0.57735026, 0, 0, 0.57735026}},
+	{"Parse the config file", []float32{0, 0, 0, -0.4082483, 0.8164966, 0, 0, 0.4082483}},
+}
+
+// CheckGolden returns an error when Vector no longer gives the Golden
+// vectors.
+func CheckGolden() error {
+	for _, f := range Golden {
+		if got := Vector(f.Text, len(f.Vector)); !slices.Equal(got, f.Vector) {
+			return fmt.Errorf("vector of %q = %v, want %v", f.Text, got, f.Vector)
+		}
+	}
+	return nil
+}
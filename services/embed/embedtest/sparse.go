@@ -0,0 +1,52 @@
+package embedtest
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+
+	embed "github.com/codectx/tokens/services/embed"
+)
+
+func init() {
+	embed.RegisterSparse("fake", func(model string) (embed.SparseProvider, error) {
+		if model != "" {
+			return nil, fmt.Errorf("invalid fake sparse provider %q: use fake", "fake:"+model)
+		}
+		return SparseProvider{}, nil
+	})
+}
+
+// SparseProvider is a fake embed.SparseProvider weighting the words of text.
+type SparseProvider struct{}
+
+// EmbedSparse returns the sparse vector of text.
+func (SparseProvider) EmbedSparse(ctx context.Context, text string) (embed.SparseVector, embed.Meta, error) {
+	meta := embed.Meta{ProviderName: "fake", ProviderModel: "sparse", Tokens: len(Words(text))}
+	if err := ctx.Err(); err != nil {
+		return nil, meta, fmt.Errorf("failed to embed text: %w", err)
+	}
+	return SparseVector(text), meta, nil
+}
+
+// Name returns fake:sparse.
+func (SparseProvider) Name() string {
+	return "fake:sparse"
+}
+
+// SparseVector returns the sparse vector of text: each of its words, hashed
+// into a term id, weighs one plus the log of its count.
+func SparseVector(text string) embed.SparseVector {
+	counts := map[uint32]int{}
+	for _, w := range Words(text) {
+		h := fnv.New32a()
+		h.Write([]byte(w))
+		counts[h.Sum32()]++
+	}
+	vec := make(embed.SparseVector, len(counts))
+	for id, n := range counts {
+		vec[id] = float32(1 + math.Log(float64(n)))
+	}
+	return vec
+}
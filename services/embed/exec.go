@@ -0,0 +1,44 @@
+package embed
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	plugin "github.com/codectx/tokens/services/plugin"
+)
+
+// execProvider embeds text with an external executable or a WebAssembly
+// module, see the plugin package for its protocol.
+type execProvider struct {
+	plugin *plugin.Plugin
+}
+
+// Embed generates an embedding with the plugin.
+func (p *execProvider) Embed(ctx context.Context, text string) ([]float32, Meta, error) {
+	start := time.Now()
+	emb, err := p.plugin.Embed(ctx, text)
+	meta := Meta{
+		Duration:      int(time.Since(start).Milliseconds()),
+		ProviderName:  p.kind(),
+		ProviderModel: emb.Model,
+		Tokens:        emb.Tokens,
+	}
+	if err != nil {
+		return nil, meta, fmt.Errorf("failed to embed text: %w", err)
+	}
+	return emb.Vector, meta, nil
+}
+
+// Name returns exec:<program> or wasm:<module>.
+func (p *execProvider) Name() string {
+	return p.kind() + ":" + p.plugin.Name()
+}
+
+// kind returns wasm for a module plugin, else exec.
+func (p *execProvider) kind() string {
+	if p.plugin.Sandboxed() {
+		return "wasm"
+	}
+	return "exec"
+}
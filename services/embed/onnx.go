@@ -0,0 +1,188 @@
+//go:build onnx
+
+package embed
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sugarme/tokenizer"
+	"github.com/sugarme/tokenizer/pretrained"
+	ort "github.com/yalue/onnxruntime_go"
+)
+
+// onnxMaxTokens truncates inputs to the context of small BERT-style models.
+const onnxMaxTokens = 512
+
+func init() {
+	factories["onnx"] = newONNXProvider
+	RegisterTokenizer("onnx", func(dir string) (Tokenizer, error) {
+		if dir == "" {
+			dir = os.Getenv("CODECTX_ONNX_MODEL")
+		}
+		return TokenizerFile(dir, filepath.Join(dir, "tokenizer.json"))
+	})
+}
+
+// ortInit initializes the process-wide onnxruntime environment once.
+var ortInit = sync.OnceValue(func() error {
+	if lib := os.Getenv("ONNXRUNTIME_LIB"); lib != "" {
+		ort.SetSharedLibraryPath(lib)
+	}
+	return ort.InitializeEnvironment()
+})
+
+// onnxProvider runs an exported sentence-embedding model in-process.
+type onnxProvider struct {
+	dir     string
+	tk      *tokenizer.Tokenizer
+	session *ort.DynamicAdvancedSession
+	inputs  []string
+}
+
+// newONNXProvider loads model.onnx and tokenizer.json from dir, or from
+// CODECTX_ONNX_MODEL when dir is empty.
+func newONNXProvider(dir string) (Provider, error) {
+	if dir == "" {
+		dir = os.Getenv("CODECTX_ONNX_MODEL")
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("onnx requires a model directory: onnx:/path/to/model or CODECTX_ONNX_MODEL")
+	}
+	if err := ortInit(); err != nil {
+		return nil, fmt.Errorf("failed to initialize onnxruntime (set ONNXRUNTIME_LIB): %w", err)
+	}
+
+	tk, err := pretrained.FromFile(filepath.Join(dir, "tokenizer.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tokenizer: %w", err)
+	}
+
+	model := filepath.Join(dir, "model.onnx")
+	ins, outs, err := ort.GetInputOutputInfo(model)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect model: %w", err)
+	}
+	if len(outs) == 0 {
+		return nil, fmt.Errorf("model %s has no outputs", model)
+	}
+	var inputs []string
+	for _, in := range ins {
+		switch in.Name {
+		case "input_ids", "attention_mask", "token_type_ids":
+			inputs = append(inputs, in.Name)
+		default:
+			return nil, fmt.Errorf("model %s has unsupported input %q", model, in.Name)
+		}
+	}
+
+	session, err := ort.NewDynamicAdvancedSession(model, inputs, []string{outs[0].Name}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load model: %w", err)
+	}
+	return &onnxProvider{dir: dir, tk: tk, session: session, inputs: inputs}, nil
+}
+
+// Capabilities returns the context the inputs are truncated to.
+func (p *onnxProvider) Capabilities() Capabilities {
+	return Capabilities{MaxInputTokens: onnxMaxTokens}
+}
+
+// Embed tokenizes text, runs the model and mean-pools its token embeddings.
+func (p *onnxProvider) Embed(ctx context.Context, text string) ([]float32, Meta, error) {
+	start := time.Now()
+	meta := Meta{ProviderName: "onnx", ProviderModel: filepath.Base(p.dir)}
+	if err := ctx.Err(); err != nil {
+		return nil, meta, err
+	}
+
+	en, err := p.tk.EncodeSingle(text, true)
+	if err != nil {
+		return nil, meta, fmt.Errorf("failed to encode text: %w", err)
+	}
+	n := min(len(en.Ids), onnxMaxTokens)
+	meta.Tokens = n
+
+	columns := map[string][]int{"input_ids": en.Ids, "attention_mask": en.AttentionMask, "token_type_ids": en.TypeIds}
+	inputs := make([]ort.Value, len(p.inputs))
+	defer func() {
+		for _, v := range inputs {
+			if v != nil {
+				v.Destroy()
+			}
+		}
+	}()
+	for i, name := range p.inputs {
+		data := make([]int64, n)
+		for j, v := range columns[name][:n] {
+			data[j] = int64(v)
+		}
+		if inputs[i], err = ort.NewTensor(ort.NewShape(1, int64(n)), data); err != nil {
+			return nil, meta, fmt.Errorf("failed to create %s tensor: %w", name, err)
+		}
+	}
+
+	outputs := []ort.Value{nil}
+	if err := p.session.Run(inputs, outputs); err != nil {
+		return nil, meta, fmt.Errorf("failed to run model: %w", err)
+	}
+	defer outputs[0].Destroy()
+
+	out, ok := outputs[0].(*ort.Tensor[float32])
+	if !ok {
+		return nil, meta, fmt.Errorf("model output is not a float32 tensor")
+	}
+	vec, err := meanPool(out.GetData(), out.GetShape(), en.AttentionMask[:n])
+	meta.Duration = int(time.Since(start).Milliseconds())
+	return vec, meta, err
+}
+
+// Name returns onnx:<model directory>.
+func (p *onnxProvider) Name() string {
+	return "onnx:" + p.dir
+}
+
+// meanPool turns the model output into a normalized vector: [1, dim] outputs are
+// already pooled, [1, tokens, dim] outputs are averaged over attended tokens.
+func meanPool(data []float32, shape ort.Shape, mask []int) ([]float32, error) {
+	var vec []float32
+	switch len(shape) {
+	case 2:
+		vec = append([]float32(nil), data...)
+	case 3:
+		tokens, dim := int(shape[1]), int(shape[2])
+		vec = make([]float32, dim)
+		var count float32
+		for t := 0; t < tokens; t++ {
+			if mask[t] == 0 {
+				continue
+			}
+			count++
+			for d := 0; d < dim; d++ {
+				vec[d] += data[t*dim+d]
+			}
+		}
+		for d := range vec {
+			vec[d] /= max(count, 1)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected model output shape %v", shape)
+	}
+
+	var norm float64
+	for _, v := range vec {
+		norm += float64(v) * float64(v)
+	}
+	if norm > 0 {
+		inv := float32(1 / math.Sqrt(norm))
+		for i := range vec {
+			vec[i] *= inv
+		}
+	}
+	return vec, nil
+}
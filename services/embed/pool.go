@@ -0,0 +1,116 @@
+package embed
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	ollama "github.com/ollama/ollama/api"
+)
+
+// sidelineDuration is how long a failing service is skipped. Failing
+// services answer fast and would otherwise look the least loaded.
+const sidelineDuration = 10 * time.Second
+
+// pool spreads embeddings across several services.
+type pool struct {
+	services []EmbeddingService
+
+	mu       sync.Mutex
+	inflight []int
+	// until is when a failing service may be picked again.
+	until []time.Time
+	next  int
+}
+
+// NewPool dispatches each embedding to the least loaded of services,
+// round-robin among equally loaded ones. Services that just failed are
+// skipped for a while unless all of them did.
+func NewPool(services []EmbeddingService) EmbeddingService {
+	if len(services) == 1 {
+		return services[0]
+	}
+	return &pool{services: services, inflight: make([]int, len(services)), until: make([]time.Time, len(services))}
+}
+
+// Get generates an embedding with the least loaded service.
+func (p *pool) Get(ctx context.Context, text string) ([]float32, Meta, error) {
+	i := p.pick()
+	vec, meta, err := p.services[i].Get(ctx, text)
+	p.done(i, err != nil && ctx.Err() == nil)
+	return vec, meta, err
+}
+
+// Voyage generates an embedding with the first service.
+func (p *pool) Voyage(key, value string) ([]float32, Meta, error) {
+	return p.services[0].Voyage(key, value)
+}
+
+// pick reserves the least loaded service.
+func (p *pool) pick() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	best := -1
+	for n := range p.services {
+		i := (p.next + n) % len(p.services)
+		if best == -1 || p.better(i, best, now) {
+			best = i
+		}
+	}
+	p.next = (best + 1) % len(p.services)
+	p.inflight[best]++
+	return best
+}
+
+// better reports whether service i should be preferred over j.
+func (p *pool) better(i, j int, now time.Time) bool {
+	iUp, jUp := !now.Before(p.until[i]), !now.Before(p.until[j])
+	if iUp != jUp {
+		return iUp
+	}
+	return p.inflight[i] < p.inflight[j]
+}
+
+// done releases a service reserved by pick, sidelining it when it failed.
+func (p *pool) done(i int, failed bool) {
+	p.mu.Lock()
+	p.inflight[i]--
+	if failed {
+		p.until[i] = time.Now().Add(sidelineDuration)
+	}
+	p.mu.Unlock()
+}
+
+// ParseHosts returns an Ollama client per comma-separated host. Hosts
+// default to http and port 11434, like OLLAMA_HOST.
+func ParseHosts(hosts string) ([]*ollama.Client, error) {
+	var clients []*ollama.Client
+	for _, h := range strings.Split(hosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if !strings.Contains(h, "://") {
+			h = "http://" + h
+		}
+		u, err := url.Parse(h)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid Ollama host %q", h)
+		}
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "11434")
+		}
+		clients = append(clients, ollama.NewClient(u, http.DefaultClient))
+	}
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no Ollama host in %q", hosts)
+	}
+	return clients, nil
+}
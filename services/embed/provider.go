@@ -0,0 +1,200 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	plugin "github.com/codectx/tokens/services/plugin"
+	secrets "github.com/codectx/tokens/services/secrets"
+	ollama "github.com/ollama/ollama/api"
+)
+
+// Provider embeds text with a single provider and model.
+type Provider interface {
+	// Embed generates an embedding for the given text.
+	Embed(ctx context.Context, text string) ([]float32, Meta, error)
+	// Name returns the provider and model as `provider:model`.
+	Name() string
+	// Capabilities reports the limits and vectors of the model.
+	Capabilities() Capabilities
+}
+
+// factories creates the providers compiled in behind build tags, or
+// registered by other packages, by name.
+var factories = map[string]func(model string) (Provider, error){}
+
+// Register makes the providers made by factory available to ParseProvider
+// as name[:model]. It is meant to be called from init functions.
+func Register(name string, factory func(model string) (Provider, error)) {
+	factories[name] = factory
+}
+
+// ParseProvider returns the provider described by spec, `ollama` or
+// `voyage` optionally followed by `:model`, `exec:` followed by the command
+// of a plugin, `wasm:` followed by the path of a plugin module or `queue:`
+// followed by the URL of a broker embedders serve ServeQueue on. Voyage reads its API key with APIKey.
+func ParseProvider(spec string, client *ollama.Client) (Provider, error) {
+	name, model, _ := strings.Cut(spec, ":")
+	switch name {
+	case "ollama":
+		if model == "" {
+			model = ollamaModelName
+		}
+		if client == nil {
+			return nil, fmt.Errorf("ollama client is not initialized")
+		}
+		return &ollamaProvider{client: client, model: model}, nil
+	case "voyage", "voyageai":
+		if model == "" {
+			model = voyageModelName
+		}
+		key, err := voyageKey()
+		if err != nil {
+			return nil, err
+		}
+		return &voyageProvider{key: key, model: model}, nil
+	case "exec", "wasm":
+		if name == "wasm" {
+			model = "wasm:" + model
+		}
+		p, err := plugin.New(model)
+		if err != nil {
+			return nil, err
+		}
+		return &execProvider{plugin: p}, nil
+	case "queue":
+		return newQueueProvider(model)
+	default:
+		if f, ok := factories[name]; ok {
+			return f(model)
+		}
+		return nil, fmt.Errorf("unknown embedding provider %q: use ollama[:model], voyage[:model], exec:<command>, wasm:<module>, queue:<broker>, fake[:dims] (built with -tags embedtest) or onnx:<dir> (built with -tags onnx)", spec)
+	}
+}
+
+// providerService adapts a Provider to EmbeddingService.
+type providerService struct {
+	Provider
+}
+
+// FromProvider returns an EmbeddingService that embeds with p.
+func FromProvider(p Provider) EmbeddingService {
+	return &providerService{Provider: p}
+}
+
+// Get generates an embedding with the provider.
+func (s *providerService) Get(ctx context.Context, text string) ([]float32, Meta, error) {
+	return s.Embed(ctx, text)
+}
+
+// Voyage generates an embedding with VoyageAI, whatever the provider.
+func (s *providerService) Voyage(key, value string) ([]float32, Meta, error) {
+	return voyage(context.Background(), key, voyageModelName, value)
+}
+
+// voyageKey loads the VoyageAI API key.
+func voyageKey() (string, error) {
+	return APIKey("voyage")
+}
+
+// APIKey loads the API key of provider from $<PROVIDER>_API_KEY, the file
+// named by $<PROVIDER>_API_KEY_FILE, else the OS keyring entry recorded by
+// `auth login`. The variable may also hold a password manager reference such
+// as op://vault/item/field or pass:path, read with the manager's CLI.
+func APIKey(provider string) (string, error) {
+	env := strings.ToUpper(provider) + "_API_KEY"
+	if key := os.Getenv(env); key != "" {
+		if secrets.IsReference(key) {
+			return secrets.Resolve(key)
+		}
+		return key, nil
+	}
+	if path := os.Getenv(env + "_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read API key: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	key, err := secrets.Lookup(provider)
+	if errors.Is(err, secrets.ErrNotFound) {
+		return "", fmt.Errorf("%s requires %s, %s_FILE or `auth login %s`", provider, env, env, provider)
+	}
+	return key, err
+}
+
+// ollamaProvider embeds text with a local Ollama model.
+type ollamaProvider struct {
+	client *ollama.Client
+	model  string
+}
+
+// Embed generates an embedding with Ollama.
+func (p *ollamaProvider) Embed(ctx context.Context, text string) ([]float32, Meta, error) {
+	start := time.Now()
+	emb, err := p.client.Embed(ctx, &ollama.EmbedRequest{Model: p.model, Input: text})
+	meta := Meta{
+		Duration:      int(time.Since(start).Milliseconds()),
+		ProviderName:  "ollama",
+		ProviderModel: p.model,
+	}
+	if err != nil {
+		return nil, meta, fmt.Errorf("failed to embed text: %w", err)
+	}
+	if len(emb.Embeddings) == 0 {
+		return nil, meta, fmt.Errorf("failed to embed text: empty response")
+	}
+	meta.Tokens = emb.PromptEvalCount
+	return emb.Embeddings[0], meta, nil
+}
+
+// EmbedBatch generates an embedding for each of texts in one Ollama request.
+func (p *ollamaProvider) EmbedBatch(ctx context.Context, texts []string) ([][]float32, Meta, error) {
+	start := time.Now()
+	emb, err := p.client.Embed(ctx, &ollama.EmbedRequest{Model: p.model, Input: texts})
+	meta := Meta{
+		Duration:      int(time.Since(start).Milliseconds()),
+		ProviderName:  "ollama",
+		ProviderModel: p.model,
+	}
+	if err != nil {
+		return nil, meta, fmt.Errorf("failed to embed text: %w", err)
+	}
+	meta.Tokens = emb.PromptEvalCount
+	return emb.Embeddings, meta, nil
+}
+
+// Name returns ollama:<model>.
+func (p *ollamaProvider) Name() string {
+	return "ollama:" + p.model
+}
+
+// voyageProvider embeds text with the VoyageAI API.
+type voyageProvider struct {
+	key   string
+	model string
+}
+
+// Embed generates an embedding with VoyageAI.
+func (p *voyageProvider) Embed(ctx context.Context, text string) ([]float32, Meta, error) {
+	vecs, meta, err := voyageBatch(ctx, p.key, p.model, inputType(ctx), []string{text})
+	if err != nil {
+		return nil, meta, err
+	}
+	return vecs[0], meta, nil
+}
+
+// EmbedBatch generates an embedding for each of texts in one VoyageAI
+// request.
+func (p *voyageProvider) EmbedBatch(ctx context.Context, texts []string) ([][]float32, Meta, error) {
+	return voyageBatch(ctx, p.key, p.model, inputType(ctx), texts)
+}
+
+// Name returns voyage:<model>.
+func (p *voyageProvider) Name() string {
+	return "voyage:" + p.model
+}
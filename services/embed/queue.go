@@ -0,0 +1,200 @@
+package embed
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	broker "github.com/codectx/tokens/services/broker"
+)
+
+// QueueSubject is the subject the queue provider publishes texts to, for
+// the processes serving ServeQueue to embed.
+const QueueSubject = "codectx.embed"
+
+// QueueRequest is a text to embed, published to QueueSubject.
+type QueueRequest struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	// Query is set for the texts embedded with AsQuery.
+	Query bool `json:"query,omitempty"`
+	// Reply is the subject the QueueReply is published to.
+	Reply string `json:"reply"`
+}
+
+// QueueReply is the embedding of a QueueRequest.
+type QueueReply struct {
+	ID     string    `json:"id"`
+	Vector []float32 `json:"vector,omitempty"`
+	Model  string    `json:"model,omitempty"`
+	Tokens int       `json:"tokens,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// queueProvider embeds text with the processes serving ServeQueue on a
+// broker, receiving their replies on a subject of its own.
+type queueProvider struct {
+	b     broker.BrokerService
+	reply string
+	mu    sync.Mutex
+	// waiting holds the requests in flight, by id.
+	waiting map[string]chan QueueReply
+}
+
+// newQueueProvider connects to the broker at url, as queue:<url>.
+func newQueueProvider(url string) (Provider, error) {
+	if url == "" {
+		return nil, errors.New("queue provider needs a broker: queue:redis://host or queue:nats://host")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	b, err := broker.NewBrokerService(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	p := &queueProvider{b: b, reply: QueueSubject + ".reply." + randomID(), waiting: map[string]chan QueueReply{}}
+	sub, err := b.Subscribe(ctx, p.reply, 0)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	go p.receive(sub)
+	return p, nil
+}
+
+// receive hands the replies to the requests waiting for them until the
+// broker is closed. Replies to requests that timed out are dropped.
+func (p *queueProvider) receive(sub broker.Subscription) {
+	for {
+		msg, err := sub.Next(context.Background())
+		if err != nil {
+			return
+		}
+		msg.Ack(context.Background())
+		var r QueueReply
+		if json.Unmarshal(msg.Data, &r) != nil {
+			continue
+		}
+		p.mu.Lock()
+		ch := p.waiting[r.ID]
+		delete(p.waiting, r.ID)
+		p.mu.Unlock()
+		if ch != nil {
+			ch <- r
+		}
+	}
+}
+
+// Embed publishes text and waits for its vector, until ctx is done.
+func (p *queueProvider) Embed(ctx context.Context, text string) ([]float32, Meta, error) {
+	start := time.Now()
+	meta := Meta{ProviderName: "queue"}
+	req := QueueRequest{ID: randomID(), Text: text, Query: IsQuery(ctx), Reply: p.reply}
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return nil, meta, err
+	}
+
+	ch := make(chan QueueReply, 1)
+	p.mu.Lock()
+	p.waiting[req.ID] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.waiting, req.ID)
+		p.mu.Unlock()
+	}()
+	if err := p.b.Publish(ctx, QueueSubject, msg); err != nil {
+		return nil, meta, fmt.Errorf("failed to embed text: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, meta, fmt.Errorf("failed to embed text: no embedder replied: %w", ctx.Err())
+	case r := <-ch:
+		meta.Duration = int(time.Since(start).Milliseconds())
+		meta.ProviderModel, meta.Tokens = r.Model, r.Tokens
+		if r.Error != "" {
+			return nil, meta, fmt.Errorf("failed to embed text: %s", r.Error)
+		}
+		return r.Vector, meta, nil
+	}
+}
+
+// Name returns queue:<broker>.
+func (p *queueProvider) Name() string {
+	return "queue:" + p.b.Name()
+}
+
+// ServeQueue embeds the texts published to QueueSubject on b with emb,
+// workers at a time, until ctx is done or the broker fails. Failures to
+// embed are replied to the requester; onError is called with the others.
+// Requests are acknowledged once replied to, so that those of an embedder
+// that dies are embedded by another.
+func ServeQueue(ctx context.Context, b broker.BrokerService, emb EmbeddingService, workers int, onError func(error)) error {
+	sub, err := b.Subscribe(ctx, QueueSubject, 0)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	var (
+		wg     sync.WaitGroup
+		once   sync.Once
+		failed error
+	)
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				msg, err := sub.Next(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						once.Do(func() { failed = err })
+					}
+					return
+				}
+				var req QueueRequest
+				if err := json.Unmarshal(msg.Data, &req); err != nil || req.Reply == "" {
+					onError(fmt.Errorf("invalid request: %s", msg.Data))
+					msg.Ack(ctx)
+					continue
+				}
+				ectx := ctx
+				if req.Query {
+					ectx = AsQuery(ctx)
+				}
+				vec, meta, err := emb.Get(ectx, req.Text)
+				r := QueueReply{ID: req.ID, Vector: vec, Model: meta.ProviderModel, Tokens: meta.Tokens}
+				if err != nil {
+					r = QueueReply{ID: req.ID, Error: err.Error()}
+				}
+				out, err := json.Marshal(r)
+				if err == nil {
+					err = b.Publish(ctx, req.Reply, out)
+				}
+				if err == nil {
+					err = msg.Ack(ctx)
+				}
+				if err != nil {
+					onError(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+// randomID returns 16 random hex digits.
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
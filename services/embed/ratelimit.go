@@ -0,0 +1,48 @@
+package embed
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimited spaces the embeddings of another service evenly.
+type rateLimited struct {
+	EmbeddingService
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// WithRateLimit bounds the Get calls of svc to perMinute a minute, spaced
+// evenly, so that a provider's quota isn't blown through. Callers wait their
+// turn in order. A zero perMinute returns svc unchanged.
+func WithRateLimit(svc EmbeddingService, perMinute int) EmbeddingService {
+	if perMinute <= 0 {
+		return svc
+	}
+	return &rateLimited{EmbeddingService: svc, interval: time.Minute / time.Duration(perMinute)}
+}
+
+// Get generates an embedding once the rate allows it.
+func (s *rateLimited) Get(ctx context.Context, text string) ([]float32, Meta, error) {
+	s.mu.Lock()
+	at := time.Now()
+	if at.Before(s.next) {
+		at = s.next
+	}
+	s.next = at.Add(s.interval)
+	s.mu.Unlock()
+
+	if delay := time.Until(at); delay > 0 {
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, Meta{}, ctx.Err()
+		case <-t.C:
+		}
+	}
+	return s.EmbeddingService.Get(ctx, text)
+}
@@ -0,0 +1,138 @@
+package embed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SparseVector maps the ids of the vocabulary terms of a sparse model to
+// their weights; terms missing from it weigh 0.
+type SparseVector map[uint32]float32
+
+// Dot returns the dot product of v and o, the relevance of a document to a
+// query for SPLADE models.
+func (v SparseVector) Dot(o SparseVector) float32 {
+	if len(o) < len(v) {
+		v, o = o, v
+	}
+	var sum float32
+	for id, w := range v {
+		sum += w * o[id]
+	}
+	return sum
+}
+
+// SparseProvider encodes text into a sparse term-weight vector, as SPLADE
+// models do: the terms of the text, and those they imply, weighted.
+type SparseProvider interface {
+	// EmbedSparse generates the sparse vector of the given text.
+	EmbedSparse(ctx context.Context, text string) (SparseVector, Meta, error)
+	// Name returns the provider and model as `provider:model`.
+	Name() string
+}
+
+// sparseFactories creates the sparse providers registered by other
+// packages, by name.
+var sparseFactories = map[string]func(model string) (SparseProvider, error){}
+
+// RegisterSparse makes the sparse providers made by factory available to
+// ParseSparseProvider as name[:model]. It is meant to be called from init
+// functions.
+func RegisterSparse(name string, factory func(model string) (SparseProvider, error)) {
+	sparseFactories[name] = factory
+}
+
+// ParseSparseProvider returns the sparse provider described by spec: `tei:`
+// followed by the URL of a text-embeddings-inference server running a
+// SPLADE model, or a registered provider such as fake.
+func ParseSparseProvider(spec string) (SparseProvider, error) {
+	name, model, _ := strings.Cut(spec, ":")
+	switch name {
+	case "tei":
+		if model == "" {
+			return nil, fmt.Errorf("the tei sparse provider needs a URL: use tei:http://host:port")
+		}
+		return &teiSparseProvider{url: strings.TrimSuffix(model, "/"), client: &http.Client{Timeout: teiSparseTimeout}}, nil
+	default:
+		if f, ok := sparseFactories[name]; ok {
+			return f(model)
+		}
+		return nil, fmt.Errorf("unknown sparse provider %q: use tei:<url> or fake (built with -tags embedtest)", spec)
+	}
+}
+
+// teiSparseProvider encodes text with the /embed_sparse endpoint of a
+// text-embeddings-inference server.
+type teiSparseProvider struct {
+	url    string
+	client *http.Client
+}
+
+// teiSparseTimeout bounds a request to a text-embeddings-inference server,
+// so that a hung one fails the file or the query instead of holding it.
+const teiSparseTimeout = time.Minute
+
+// teiSparseRequest is the body of an /embed_sparse request.
+type teiSparseRequest struct {
+	Inputs   string `json:"inputs"`
+	Truncate bool   `json:"truncate"`
+}
+
+// teiSparseValue is a weighted term of an /embed_sparse response.
+type teiSparseValue struct {
+	Index uint32  `json:"index"`
+	Value float32 `json:"value"`
+}
+
+// EmbedSparse generates a sparse vector with text-embeddings-inference.
+func (p *teiSparseProvider) EmbedSparse(ctx context.Context, text string) (SparseVector, Meta, error) {
+	meta := Meta{ProviderName: "tei", ProviderModel: p.url}
+	body, err := json.Marshal(teiSparseRequest{Inputs: text, Truncate: true})
+	if err != nil {
+		return nil, meta, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/embed_sparse", bytes.NewReader(body))
+	if err != nil {
+		return nil, meta, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, meta, fmt.Errorf("failed to execute HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	meta.Duration = int(time.Since(start).Milliseconds())
+	if err != nil {
+		return nil, meta, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, meta, fmt.Errorf("tei returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	var res [][]teiSparseValue
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, meta, fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+	if len(res) == 0 {
+		return nil, meta, fmt.Errorf("tei returned no sparse vector")
+	}
+	vec := make(SparseVector, len(res[0]))
+	for _, v := range res[0] {
+		vec[v.Index] = v.Value
+	}
+	return vec, meta, nil
+}
+
+// Name returns tei:<url>.
+func (p *teiSparseProvider) Name() string {
+	return "tei:" + p.url
+}
@@ -0,0 +1,124 @@
+package embed
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statsWindow is how many of the latest embeddings of a provider its
+// percentiles are computed over.
+const statsWindow = 1024
+
+// Stats records the latency of the embeddings of the providers it wraps.
+type Stats struct {
+	mu        sync.Mutex
+	providers map[string]*latencies
+}
+
+// latencies are the embeddings of one provider.
+type latencies struct {
+	requests int64
+	errors   int64
+	total    time.Duration
+	max      time.Duration
+	// window holds the latest statsWindow latencies, next is the oldest
+	// once it is full.
+	window []time.Duration
+	next   int
+}
+
+// ProviderStats summarizes the embeddings of a provider since it was
+// wrapped.
+type ProviderStats struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+	// MeanMS is over every embedding, P50MS and P95MS over the latest
+	// statsWindow.
+	MeanMS float64 `json:"mean_ms"`
+	P50MS  float64 `json:"p50_ms"`
+	P95MS  float64 `json:"p95_ms"`
+	MaxMS  float64 `json:"max_ms"`
+}
+
+// NewStats returns an empty Stats.
+func NewStats() *Stats {
+	return &Stats{providers: map[string]*latencies{}}
+}
+
+// Wrap returns svc, recording the latency of its embeddings under name.
+// Embeddings cancelled by their caller aren't recorded.
+func (s *Stats) Wrap(name string, svc EmbeddingService) EmbeddingService {
+	s.mu.Lock()
+	if s.providers[name] == nil {
+		s.providers[name] = &latencies{}
+	}
+	s.mu.Unlock()
+	return &statsService{EmbeddingService: svc, stats: s, name: name}
+}
+
+// record adds an embedding of provider name.
+func (s *Stats) record(name string, d time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.providers[name]
+	l.requests++
+	if failed {
+		l.errors++
+	}
+	l.total += d
+	l.max = max(l.max, d)
+	if len(l.window) < statsWindow {
+		l.window = append(l.window, d)
+		return
+	}
+	l.window[l.next] = d
+	l.next = (l.next + 1) % statsWindow
+}
+
+// Snapshot returns the stats of every provider, by name.
+func (s *Stats) Snapshot() []ProviderStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ProviderStats, 0, len(s.providers))
+	for name, l := range s.providers {
+		ps := ProviderStats{Name: name, Requests: l.requests, Errors: l.errors, MaxMS: ms(l.max)}
+		if l.requests > 0 {
+			ps.MeanMS = ms(l.total / time.Duration(l.requests))
+		}
+		if len(l.window) > 0 {
+			sorted := slices.Clone(l.window)
+			slices.Sort(sorted)
+			ps.P50MS = ms(sorted[len(sorted)/2])
+			ps.P95MS = ms(sorted[len(sorted)*95/100])
+		}
+		out = append(out, ps)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// ms returns d in milliseconds.
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// statsService records the embeddings of another service.
+type statsService struct {
+	EmbeddingService
+	stats *Stats
+	name  string
+}
+
+// Get generates an embedding and records its latency.
+func (s *statsService) Get(ctx context.Context, text string) ([]float32, Meta, error) {
+	start := time.Now()
+	vec, meta, err := s.EmbeddingService.Get(ctx, text)
+	if ctx.Err() == nil || err == nil {
+		s.stats.record(s.name, time.Since(start), err != nil)
+	}
+	return vec, meta, err
+}
@@ -0,0 +1,35 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// timeoutService bounds the embeddings of another service.
+type timeoutService struct {
+	EmbeddingService
+	timeout time.Duration
+}
+
+// WithTimeout bounds every Get call of svc to d so that a hung provider
+// request can't stall its caller. A zero d returns svc unchanged.
+func WithTimeout(svc EmbeddingService, d time.Duration) EmbeddingService {
+	if d <= 0 {
+		return svc
+	}
+	return &timeoutService{EmbeddingService: svc, timeout: d}
+}
+
+// Get generates an embedding, giving up after the configured timeout.
+func (s *timeoutService) Get(ctx context.Context, text string) ([]float32, Meta, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	vec, meta, err := s.EmbeddingService.Get(ctx, text)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, meta, fmt.Errorf("embedding timed out after %s: %w", s.timeout, err)
+	}
+	return vec, meta, err
+}
@@ -0,0 +1,149 @@
+package embed
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sugarme/tokenizer"
+	"github.com/sugarme/tokenizer/pretrained"
+)
+
+// Tokenizer counts the tokens of texts with the vocabulary of a model.
+type Tokenizer interface {
+	// Count returns the number of tokens of text.
+	Count(text string) int
+	// Name names the vocabulary, approximate for the estimate.
+	Name() string
+}
+
+// Approximate estimates tokens with ApproxTokens, for models whose
+// vocabulary isn't known.
+var Approximate Tokenizer = approximate{}
+
+type approximate struct{}
+
+func (approximate) Count(text string) int { return ApproxTokens(text) }
+func (approximate) Name() string          { return "approximate" }
+
+// ApproxTokens estimates the tokens of text at one per four bytes, and at
+// least one per word.
+func ApproxTokens(text string) int {
+	return max((len(text)+3)/4, len(strings.Fields(text)))
+}
+
+// tokenizerFactories creates the tokenizers of the models of a provider, by
+// provider name.
+var tokenizerFactories = map[string]func(model string) (Tokenizer, error){}
+
+// RegisterTokenizer makes the tokenizers made by factory those of the
+// models of the provider name, as ParseProvider names it. It is meant to be
+// called from init functions, like Register.
+func RegisterTokenizer(name string, factory func(model string) (Tokenizer, error)) {
+	tokenizerFactories[name] = factory
+}
+
+// ollamaTokenizers maps Ollama models, without their tag, to the Hugging
+// Face repository of their tokenizer.
+var ollamaTokenizers = map[string]string{
+	ollamaModelName:     "jinaai/jina-embeddings-v2-base-code",
+	"nomic-embed-text":  "nomic-ai/nomic-embed-text-v1.5",
+	"mxbai-embed-large": "mixedbread-ai/mxbai-embed-large-v1",
+	"all-minilm":        "sentence-transformers/all-MiniLM-L6-v2",
+	"bge-m3":            "BAAI/bge-m3",
+}
+
+func init() {
+	RegisterTokenizer("ollama", func(model string) (Tokenizer, error) {
+		if model == "" {
+			model = ollamaModelName
+		}
+		name, _, _ := strings.Cut(model, ":")
+		repo, ok := ollamaTokenizers[name]
+		if !ok {
+			return nil, fmt.Errorf("no known tokenizer for ollama model %q", model)
+		}
+		return HuggingFace(repo)
+	})
+	// Voyage publishes the tokenizer of each model under its name
+	RegisterTokenizer("voyage", func(model string) (Tokenizer, error) {
+		if model == "" {
+			model = voyageModelName
+		}
+		return HuggingFace("voyageai/" + model)
+	})
+}
+
+// loaded holds the tokenizers made by TokenizerFor, by spec, each loaded
+// once.
+var loaded sync.Map
+
+// TokenizerFor returns the tokenizer of the model of spec, a provider as
+// ParseProvider takes it. When none is registered for the provider, or it
+// fails to load, it returns Approximate and the reason.
+func TokenizerFor(spec string) (Tokenizer, error) {
+	type result struct {
+		tk  Tokenizer
+		err error
+	}
+	load := func() result {
+		name, model, _ := strings.Cut(spec, ":")
+		if name == "voyageai" {
+			name = "voyage"
+		}
+		f, ok := tokenizerFactories[name]
+		if !ok {
+			return result{Approximate, fmt.Errorf("no known tokenizer for provider %q", name)}
+		}
+		tk, err := f(model)
+		if err != nil {
+			return result{Approximate, err}
+		}
+		return result{tk, nil}
+	}
+	v, _ := loaded.LoadOrStore(spec, sync.OnceValue(load))
+	r := v.(func() result)()
+	return r.tk, r.err
+}
+
+// hfTokenizer counts tokens with a tokenizer.json of Hugging Face.
+type hfTokenizer struct {
+	name string
+	tk   *tokenizer.Tokenizer
+}
+
+// HuggingFace returns the tokenizer of the Hugging Face repository repo,
+// its tokenizer.json downloaded once into the cache of the tokenizer
+// package.
+func HuggingFace(repo string) (Tokenizer, error) {
+	path, err := tokenizer.CachedPath(repo, "tokenizer.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tokenizer of %s: %w", repo, err)
+	}
+	return TokenizerFile(repo, path)
+}
+
+// TokenizerFile returns the tokenizer of the tokenizer.json at path, named
+// name.
+func TokenizerFile(name, path string) (Tokenizer, error) {
+	tk, err := pretrained.FromFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tokenizer %s: %w", name, err)
+	}
+	return &hfTokenizer{name: name, tk: tk}, nil
+}
+
+// Count returns the number of tokens of text, estimated when it can't be
+// encoded.
+func (t *hfTokenizer) Count(text string) int {
+	en, err := t.tk.EncodeSingle(text)
+	if err != nil {
+		return ApproxTokens(text)
+	}
+	return en.Len()
+}
+
+// Name returns the repository or path of the tokenizer.
+func (t *hfTokenizer) Name() string {
+	return t.name
+}
@@ -0,0 +1,86 @@
+package embed
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// Policies of texts over Limits.MaxTokens.
+const (
+	// TruncateSplit splits texts at line breaks, embedding the mean of their
+	// parts. Lines over the limit on their own lose their end.
+	TruncateSplit = "split"
+	// TruncateHead drops the start of texts.
+	TruncateHead = "head"
+	// TruncateTail drops the end of texts.
+	TruncateTail = "tail"
+	// TruncateMiddle drops the middle of texts, keeping as many tokens of
+	// their start as of their end.
+	TruncateMiddle = "middle"
+)
+
+// ParseTruncate validates policy, "" for TruncateSplit.
+func ParseTruncate(policy string) (string, error) {
+	switch policy {
+	case "":
+		return TruncateSplit, nil
+	case TruncateSplit, TruncateHead, TruncateTail, TruncateMiddle:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown truncation policy %q: use split, head, tail or middle", policy)
+	}
+}
+
+// Truncate returns text cut to maxTokens tokens counted by count, by
+// dropping its start, end or middle as policy says, TruncateTail for
+// TruncateSplit, and the tokens kept.
+func Truncate(text string, maxTokens int, policy string, count func(string) int) (string, int) {
+	switch policy {
+	case TruncateHead:
+		text = text[suffixWithin(text, maxTokens, count):]
+	case TruncateMiddle:
+		head := text[:prefixWithin(text, maxTokens/2, count)]
+		rest := text[len(head):]
+		tail := rest[suffixWithin(rest, maxTokens-count(head), count):]
+		text = head + tail
+	default:
+		text = text[:prefixWithin(text, maxTokens, count)]
+	}
+	return text, count(text)
+}
+
+// prefixWithin returns the length of the longest prefix of text within
+// maxTokens, ending before a rune.
+func prefixWithin(text string, maxTokens int, count func(string) int) int {
+	lo, hi := 0, len(text)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if count(text[:mid]) <= maxTokens {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	for lo > 0 && lo < len(text) && !utf8.RuneStart(text[lo]) {
+		lo--
+	}
+	return lo
+}
+
+// suffixWithin returns the start of the longest suffix of text within
+// maxTokens, at a rune.
+func suffixWithin(text string, maxTokens int, count func(string) int) int {
+	lo, hi := 0, len(text)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if count(text[mid:]) <= maxTokens {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	for lo < len(text) && !utf8.RuneStart(text[lo]) {
+		lo++
+	}
+	return lo
+}
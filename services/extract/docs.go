@@ -0,0 +1,110 @@
+//go:build docs
+
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// Document extractors are only compiled with `-tags docs` to keep the
+// default binary slim.
+func init() {
+	Register(officeExtractor{ext: ".docx", part: "word/document.xml"})
+	Register(officeExtractor{ext: ".odt", part: "content.xml"})
+	Register(pdfExtractor{})
+}
+
+// officeExtractor reads the text of zipped XML documents (docx, odt).
+type officeExtractor struct {
+	ext  string
+	part string
+}
+
+// Match handles files with the extractor's extension.
+func (e officeExtractor) Match(path string, _ []byte) bool {
+	return strings.EqualFold(filepath.Ext(path), e.ext)
+}
+
+// Extract returns the document text with one line per paragraph.
+func (e officeExtractor) Extract(_ string, content []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", e.ext, err)
+	}
+
+	f, err := zr.Open(e.part)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", e.part, err)
+	}
+	defer f.Close()
+
+	return xmlText(f)
+}
+
+// xmlText collects character data, breaking lines at paragraphs, headings
+// and explicit breaks. Both WordprocessingML and ODF use these local names.
+func xmlText(r io.Reader) (string, error) {
+	var b strings.Builder
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to parse document XML: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.CharData:
+			b.Write(t)
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "tab":
+				b.WriteByte('\t')
+			case "br", "line-break":
+				b.WriteByte('\n')
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "p", "h":
+				b.WriteByte('\n')
+			}
+		}
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// pdfExtractor reads the plain text of PDF files.
+type pdfExtractor struct{}
+
+// Match handles .pdf files.
+func (pdfExtractor) Match(path string, _ []byte) bool {
+	return strings.EqualFold(filepath.Ext(path), ".pdf")
+}
+
+// Extract returns the text of every page.
+func (pdfExtractor) Extract(_ string, content []byte) (string, error) {
+	r, err := pdf.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", fmt.Errorf("failed to open pdf: %w", err)
+	}
+	txt, err := r.GetPlainText()
+	if err != nil {
+		return "", fmt.Errorf("failed to read pdf text: %w", err)
+	}
+	b, err := io.ReadAll(txt)
+	if err != nil {
+		return "", fmt.Errorf("failed to read pdf text: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,51 @@
+// Package extract pulls meaningful text out of structured files before embedding.
+package extract
+
+import (
+	"sync"
+)
+
+// Extractor turns a structured file into the text that gets embedded.
+type Extractor interface {
+	// Match reports whether the extractor handles the file.
+	Match(path string, content []byte) bool
+	// Extract returns the meaningful text of content.
+	Extract(path string, content []byte) (string, error)
+}
+
+var (
+	mu         sync.RWMutex
+	extractors = []Extractor{
+		notebookExtractor{},
+		manifestExtractor{},
+		protoExtractor{},
+		openAPIExtractor{},
+	}
+)
+
+// Register adds an extractor. Extractors registered later take precedence.
+func Register(e Extractor) {
+	mu.Lock()
+	defer mu.Unlock()
+	extractors = append([]Extractor{e}, extractors...)
+}
+
+// Text returns the text to embed for the file: the output of the first
+// matching extractor, or the raw content when none matches. ok is false when
+// the raw content is returned.
+func Text(path string, content []byte) (text string, ok bool, err error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	for _, e := range extractors {
+		if !e.Match(path, content) {
+			continue
+		}
+		text, err := e.Extract(path, content)
+		if err != nil {
+			return string(content), false, err
+		}
+		return text, true, nil
+	}
+	return string(content), false, nil
+}
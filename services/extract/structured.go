@@ -0,0 +1,246 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// notebookExtractor keeps the source of Jupyter notebook cells and drops
+// outputs, execution counts and metadata.
+type notebookExtractor struct{}
+
+// Match handles .ipynb files.
+func (notebookExtractor) Match(path string, _ []byte) bool {
+	return strings.EqualFold(filepath.Ext(path), ".ipynb")
+}
+
+// Extract joins markdown and code cells in order.
+func (notebookExtractor) Extract(_ string, content []byte) (string, error) {
+	var nb struct {
+		Cells []struct {
+			CellType string          `json:"cell_type"`
+			Source   json.RawMessage `json:"source"`
+		} `json:"cells"`
+	}
+	if err := json.Unmarshal(content, &nb); err != nil {
+		return "", fmt.Errorf("failed to parse notebook: %w", err)
+	}
+
+	var parts []string
+	for _, c := range nb.Cells {
+		if c.CellType != "markdown" && c.CellType != "code" {
+			continue
+		}
+		// source is either a string or a list of lines
+		var src string
+		if err := json.Unmarshal(c.Source, &src); err != nil {
+			var lines []string
+			if err := json.Unmarshal(c.Source, &lines); err != nil {
+				return "", fmt.Errorf("failed to parse notebook cell: %w", err)
+			}
+			src = strings.Join(lines, "")
+		}
+		if strings.TrimSpace(src) != "" {
+			parts = append(parts, src)
+		}
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// manifestExtractor keeps the descriptive fields of package manifests.
+type manifestExtractor struct{}
+
+// Match handles package.json and composer.json.
+func (manifestExtractor) Match(path string, _ []byte) bool {
+	switch filepath.Base(path) {
+	case "package.json", "composer.json":
+		return true
+	}
+	return false
+}
+
+// Extract returns the name, description, keywords, scripts and dependencies.
+func (manifestExtractor) Extract(_ string, content []byte) (string, error) {
+	var m struct {
+		Name            string            `json:"name"`
+		Description     string            `json:"description"`
+		Keywords        []string          `json:"keywords"`
+		Scripts         map[string]string `json:"scripts"`
+		Dependencies    map[string]any    `json:"dependencies"`
+		DevDependencies map[string]any    `json:"devDependencies"`
+		Require         map[string]any    `json:"require"`
+		RequireDev      map[string]any    `json:"require-dev"`
+	}
+	if err := json.Unmarshal(content, &m); err != nil {
+		return "", fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	var b strings.Builder
+	writeField(&b, "name", m.Name)
+	writeField(&b, "description", m.Description)
+	writeField(&b, "keywords", strings.Join(m.Keywords, ", "))
+	for _, k := range sortedKeys(m.Scripts) {
+		writeField(&b, "script "+k, m.Scripts[k])
+	}
+	writeField(&b, "dependencies", strings.Join(append(sortedKeys(m.Dependencies), sortedKeys(m.Require)...), ", "))
+	writeField(&b, "dev dependencies", strings.Join(append(sortedKeys(m.DevDependencies), sortedKeys(m.RequireDev)...), ", "))
+	return b.String(), nil
+}
+
+// protoExtractor keeps comments and declarations of protobuf files, dropping
+// options, imports and field numbers.
+type protoExtractor struct{}
+
+var (
+	protoNoise = regexp.MustCompile(`^\s*(option|import|syntax)\b`)
+	protoTag   = regexp.MustCompile(`\s*=\s*\d+\s*(\[[^\]]*\])?\s*;`)
+)
+
+// Match handles .proto files.
+func (protoExtractor) Match(path string, _ []byte) bool {
+	return filepath.Ext(path) == ".proto"
+}
+
+// Extract returns the declarations and comments line by line.
+func (protoExtractor) Extract(_ string, content []byte) (string, error) {
+	var out []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if protoNoise.MatchString(line) || strings.TrimSpace(line) == "" {
+			continue
+		}
+		line = protoTag.ReplaceAllString(line, "")
+		out = append(out, strings.TrimRight(line, " \t"))
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// openAPIExtractor keeps the human readable parts of OpenAPI and Swagger specs.
+type openAPIExtractor struct{}
+
+// openAPIMarker quickly rules out JSON and YAML files that aren't specs.
+var openAPIMarker = regexp.MustCompile(`(?m)^\s*"?(openapi|swagger)"?\s*:`)
+
+// Match handles JSON and YAML files declaring an openapi or swagger version.
+func (openAPIExtractor) Match(path string, content []byte) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".yaml", ".yml":
+	default:
+		return false
+	}
+	head := content
+	if len(head) > 4096 {
+		head = head[:4096]
+	}
+	return openAPIMarker.Match(head) || bytes.Contains(head, []byte(`"openapi":`)) || bytes.Contains(head, []byte(`"swagger":`))
+}
+
+// Extract returns the API title and description, one line per operation and
+// the descriptions of named schemas.
+func (openAPIExtractor) Extract(_ string, content []byte) (string, error) {
+	// YAML is a superset of JSON, so one decoder handles both.
+	var spec struct {
+		Info struct {
+			Title       string `yaml:"title"`
+			Description string `yaml:"description"`
+		} `yaml:"info"`
+		Paths      map[string]map[string]yaml.Node `yaml:"paths"`
+		Components struct {
+			Schemas map[string]openAPISchema `yaml:"schemas"`
+		} `yaml:"components"`
+		Definitions map[string]openAPISchema `yaml:"definitions"`
+	}
+	if err := yaml.Unmarshal(content, &spec); err != nil {
+		return "", fmt.Errorf("failed to parse OpenAPI spec: %w", err)
+	}
+
+	var b strings.Builder
+	writeField(&b, "api", spec.Info.Title)
+	writeField(&b, "description", spec.Info.Description)
+
+	for _, p := range sortedKeys(spec.Paths) {
+		ops := spec.Paths[p]
+		for _, method := range sortedKeys(ops) {
+			// path items also hold parameters, servers, etc.
+			if !httpMethods[method] {
+				continue
+			}
+			var op openAPIOperation
+			node := ops[method]
+			if err := node.Decode(&op); err != nil {
+				return "", fmt.Errorf("failed to parse operation %s %s: %w", method, p, err)
+			}
+			text := strings.TrimSpace(strings.Join(nonEmpty(op.OperationID, op.Summary, op.Description), ". "))
+			writeField(&b, strings.ToUpper(method)+" "+p, text)
+		}
+	}
+
+	schemas := spec.Components.Schemas
+	if len(schemas) == 0 {
+		schemas = spec.Definitions
+	}
+	for _, name := range sortedKeys(schemas) {
+		s := schemas[name]
+		text := s.Description
+		if props := sortedKeys(s.Properties); len(props) > 0 {
+			text = strings.TrimSpace(text + " fields: " + strings.Join(props, ", "))
+		}
+		writeField(&b, "schema "+name, text)
+	}
+	return b.String(), nil
+}
+
+// httpMethods are the path item keys holding operations.
+var httpMethods = map[string]bool{
+	"get": true, "put": true, "post": true, "delete": true,
+	"options": true, "head": true, "patch": true, "trace": true,
+}
+
+// openAPIOperation is the subset of an operation object worth embedding.
+type openAPIOperation struct {
+	OperationID string `yaml:"operationId"`
+	Summary     string `yaml:"summary"`
+	Description string `yaml:"description"`
+}
+
+// openAPISchema is the subset of a schema object worth embedding.
+type openAPISchema struct {
+	Description string         `yaml:"description"`
+	Properties  map[string]any `yaml:"properties"`
+}
+
+// writeField writes a `key: value` line unless value is empty.
+func writeField(b *strings.Builder, key, value string) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return
+	}
+	fmt.Fprintf(b, "%s: %s\n", key, value)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// nonEmpty returns the non-blank values.
+func nonEmpty(values ...string) []string {
+	var out []string
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			out = append(out, strings.TrimSpace(v))
+		}
+	}
+	return out
+}
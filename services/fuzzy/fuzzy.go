@@ -0,0 +1,190 @@
+// Package fuzzy scores how well the words of a query match a file path, in
+// the style of fzf: a word matches when its letters appear in order in the
+// path, and scores higher when they are consecutive and start at segment
+// boundaries.
+package fuzzy
+
+import (
+	"path"
+	"strings"
+	"unicode"
+)
+
+const (
+	// minWord is the length of the shortest query word matched against
+	// paths; shorter ones match almost anything.
+	minWord = 3
+	// minMatch is the lowest word score that counts: scattered letters are
+	// coincidences rather than path fragments.
+	minMatch = 0.5
+	// dirFactor scales the score of words matched outside the base name.
+	dirFactor = 0.8
+)
+
+// Path is a path prepared to be matched against many queries.
+type Path struct {
+	lower string
+	// letters has the bit of every letter of lower set.
+	letters uint64
+}
+
+// NewPath prepares p for Filter.May.
+func NewPath(p string) Path {
+	lower := strings.ToLower(strings.ReplaceAll(p, "\\", "/"))
+	return Path{lower: lower, letters: letters(lower)}
+}
+
+// Filter rules out the paths a query can't match before they are scored.
+type Filter struct {
+	words []filterWord
+}
+
+// filterWord is a query word of minWord letters or more.
+type filterWord struct {
+	letters uint64
+	head    string
+}
+
+// NewFilter returns the filter of query.
+func NewFilter(query string) Filter {
+	var f Filter
+	for _, w := range strings.FieldsFunc(strings.ToLower(query), isSeparator) {
+		if len(w) >= minWord {
+			f.words = append(f.words, filterWord{letters: letters(w), head: w[:minWord]})
+		}
+	}
+	return f
+}
+
+// May reports whether Score may be above 0 for p: a word matches only
+// when the path has all of its letters, or when a path word it starts with
+// is there, and so its first letters in a row.
+func (f Filter) May(p Path) bool {
+	for _, w := range f.words {
+		if w.letters&^p.letters == 0 || strings.Contains(p.lower, w.head) {
+			return true
+		}
+	}
+	return false
+}
+
+// letters returns a mask with a bit set for each letter of s, letters
+// beyond 64 sharing bits.
+func letters(s string) uint64 {
+	var m uint64
+	for _, r := range s {
+		m |= 1 << (uint32(r) % 64)
+	}
+	return m
+}
+
+// Score returns how well query names p, from 0 when none of its words match
+// to 1. Each matching word contributes its score, capped at 1 in total, so
+// that a single strong fragment such as "store" is enough, while prose words
+// without a match don't dilute it.
+func Score(query, p string) float64 {
+	p = strings.ToLower(strings.ReplaceAll(p, "\\", "/"))
+	base := path.Base(p)
+
+	baseWords := strings.FieldsFunc(base, isSeparator)
+	dirWords := strings.FieldsFunc(path.Dir(p), isSeparator)
+
+	var total float64
+	for _, w := range strings.FieldsFunc(strings.ToLower(query), isSeparator) {
+		if len(w) < minWord {
+			continue
+		}
+		s := max(Match(w, base), stem(w, baseWords))
+		if d := max(Match(w, p), stem(w, dirWords)) * dirFactor; d > s {
+			s = d
+		}
+		if s >= minMatch {
+			total += s
+		}
+	}
+	return min(total, 1)
+}
+
+// Match returns how well the letters of word appear in order in s, from 0
+// when they don't to 1 when s contains word at a segment boundary. Both are
+// expected in lower case.
+func Match(word, s string) float64 {
+	w, t := []rune(word), []rune(s)
+	if len(w) == 0 || !subsequence(w, t) {
+		return 0
+	}
+
+	// best[j] is the best score of the word so far with its last matched
+	// letter at t[j], or -1 when it can't end there.
+	best := make([]float64, len(t))
+	next := make([]float64, len(t))
+	for j := range t {
+		best[j] = -1
+		if t[j] == w[0] {
+			best[j] = 1 + boundary(t, j)
+		}
+	}
+	for i := 1; i < len(w); i++ {
+		// prev is the best score ending strictly before j-1, i.e. with a gap
+		prev := -1.0
+		for j := range t {
+			next[j] = -1
+			if j >= 2 && best[j-2] > prev {
+				prev = best[j-2]
+			}
+			if t[j] != w[i] {
+				continue
+			}
+			if prev >= 0 {
+				next[j] = prev + 1 + boundary(t, j)
+			}
+			if j >= 1 && best[j-1] >= 0 {
+				// consecutive letters earn the boundary bonus too
+				next[j] = max(next[j], best[j-1]+2)
+			}
+		}
+		best, next = next, best
+	}
+
+	var top float64
+	for _, v := range best {
+		top = max(top, v)
+	}
+	return min(top/float64(2*len(w)), 1)
+}
+
+// stem scores path words that are a prefix of the query word w, such as
+// "embed" for "embeddings", by the share of w they cover.
+func stem(w string, words []string) float64 {
+	var best float64
+	for _, pw := range words {
+		if len(pw) >= minWord && strings.HasPrefix(w, pw) {
+			best = max(best, float64(len(pw))/float64(len(w)))
+		}
+	}
+	return best
+}
+
+// subsequence reports whether the letters of w appear in order in t.
+func subsequence(w, t []rune) bool {
+	i := 0
+	for _, r := range t {
+		if i < len(w) && r == w[i] {
+			i++
+		}
+	}
+	return i == len(w)
+}
+
+// boundary returns 1 when t[j] starts a path segment or word, 0 otherwise.
+func boundary(t []rune, j int) float64 {
+	if j == 0 || isSeparator(t[j-1]) {
+		return 1
+	}
+	return 0
+}
+
+// isSeparator reports whether r separates words in paths and queries.
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
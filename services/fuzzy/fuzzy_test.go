@@ -0,0 +1,24 @@
+package fuzzy
+
+import "testing"
+
+// TestFilter checks that the filter keeps every path a query scores, and
+// rules out paths missing the letters of its words.
+func TestFilter(t *testing.T) {
+	paths := []string{
+		"services/store/store.go", "services/embed/embed.go", "main.go", `cmd\Upsert.go`,
+		"docs/README.md", "services/fuzzy/fuzzy.go", "x/ünïcode.go", "internal/strutil/trim.go",
+	}
+	queries := []string{"store upsert duckdb", "embeddings", "readme", "fzy", "ünï", "trim strings", "zzz qqq"}
+	for _, q := range queries {
+		f := NewFilter(q)
+		for _, p := range paths {
+			if Score(q, p) > 0 && !f.May(NewPath(p)) {
+				t.Errorf("the filter of %q rules out %s, which it matches", q, p)
+			}
+		}
+	}
+	if NewFilter("zzz qqq").May(NewPath("services/store/store.go")) {
+		t.Error("the filter of \"zzz qqq\" keeps services/store/store.go")
+	}
+}
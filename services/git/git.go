@@ -0,0 +1,218 @@
+// Package git wraps the git command line for repository metadata.
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// uncommitted is the sha git blame reports for lines not committed yet.
+const uncommitted = "0000000000000000000000000000000000000000"
+
+// Blame summarises the ownership of a file.
+type Blame struct {
+	// Author is the author of the most lines.
+	Author string
+	// LastCommit is the most recent commit touching the file.
+	LastCommit string
+	// lines holds the commit of each line, uncommitted ones zero.
+	lines []blameLine
+}
+
+// blameLine is the commit a line of a file was last changed in.
+type blameLine struct {
+	author string
+	sha    string
+	time   int64
+}
+
+// BlameFile runs git blame on file, relative to dir and at rev when set, and
+// returns its dominant author and last modifying commit. Uncommitted lines
+// are ignored.
+func BlameFile(ctx context.Context, dir, file, rev string) (Blame, error) {
+	args := []string{"-C", dir, "blame", "--line-porcelain"}
+	if rev != "" {
+		args = append(args, rev)
+	}
+	cmd := exec.CommandContext(ctx, "git", append(args, "--", file)...)
+	out, err := cmd.Output()
+	if err != nil {
+		return Blame{}, fmt.Errorf("git blame failed: %w", err)
+	}
+
+	var (
+		lines []blameLine
+		cur   blameLine
+	)
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "\t"):
+			// content line, ends the header of the current line
+			if cur.sha == uncommitted {
+				cur = blameLine{}
+			}
+			lines = append(lines, cur)
+		case strings.HasPrefix(line, "author "):
+			cur.author = strings.TrimPrefix(line, "author ")
+		case strings.HasPrefix(line, "committer-time "):
+			cur.time, _ = strconv.ParseInt(strings.TrimPrefix(line, "committer-time "), 10, 64)
+		default:
+			// header line: <sha> <orig-line> <final-line> [<count>]
+			if f := strings.Fields(line); len(f) >= 3 && len(f[0]) == len(uncommitted) {
+				cur = blameLine{sha: f[0]}
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return Blame{}, fmt.Errorf("failed to read git blame output: %w", err)
+	}
+
+	b := Blame{lines: lines}
+	return b.Lines(1, len(lines)), nil
+}
+
+// Lines returns the dominant author and last modifying commit of the lines
+// start to end of the file, 1-based and inclusive, ignoring uncommitted
+// ones. The range is clamped to the lines of the file.
+func (b Blame) Lines(start, end int) Blame {
+	start, end = max(start, 1), min(end, len(b.lines))
+	var (
+		counts   = map[string]int{}
+		latestTS int64
+		out      = Blame{lines: b.lines}
+	)
+	for i := start - 1; i < end; i++ {
+		l := b.lines[i]
+		if l.sha == "" {
+			continue
+		}
+		counts[l.author]++
+		if l.time > latestTS {
+			latestTS, out.LastCommit = l.time, l.sha
+		}
+	}
+	best := 0
+	for author, n := range counts {
+		if n > best || (n == best && author < out.Author) {
+			out.Author, best = author, n
+		}
+	}
+	return out
+}
+
+// ResolveRev returns the full commit sha of rev in the repository at repo.
+func ResolveRev(ctx context.Context, repo, rev string) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", repo, "rev-parse", "--verify", rev+"^{commit}").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve revision %q: %w", rev, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Prefix returns the path of dir in its repository, with a trailing slash,
+// empty at the root of the repository.
+func Prefix(ctx context.Context, dir string) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "--show-prefix").Output()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse failed: %w", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// RevFiles returns the paths of the files under repo in the tree of rev,
+// relative to the repository root even when repo is a subdirectory of it.
+func RevFiles(ctx context.Context, repo, rev string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", repo, "ls-tree", "-r", "-z", "--name-only", "--full-name", rev).Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-tree failed: %w", err)
+	}
+
+	var paths []string
+	for _, p := range strings.Split(string(out), "\x00") {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// BlobReader reads file contents from the object store of a repository
+// without touching its working tree. It is safe for concurrent use.
+type BlobReader struct {
+	mu    sync.Mutex
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	out   *bufio.Reader
+}
+
+// NewBlobReader starts a `git cat-file --batch` process for the repository.
+func NewBlobReader(ctx context.Context, repo string) (*BlobReader, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repo, "cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open git stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open git stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start git cat-file: %w", err)
+	}
+	return &BlobReader{cmd: cmd, stdin: stdin, out: bufio.NewReader(stdout)}, nil
+}
+
+// Read returns the content of path at rev, or an error wrapping
+// fs.ErrNotExist when rev has no such path.
+func (r *BlobReader) Read(rev, path string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := fmt.Fprintf(r.stdin, "%s:%s\n", rev, path); err != nil {
+		return nil, fmt.Errorf("failed to query git cat-file: %w", err)
+	}
+
+	// <sha> <type> <size>, or <object> missing
+	header, err := r.out.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read git cat-file header: %w", err)
+	}
+	f := strings.Fields(header)
+	if len(f) == 2 && f[1] == "missing" {
+		return nil, fmt.Errorf("%s:%s: %w", rev, path, fs.ErrNotExist)
+	}
+	if len(f) != 3 {
+		return nil, fmt.Errorf("%s:%s: %s", rev, path, strings.TrimSpace(header))
+	}
+	size, err := strconv.Atoi(f[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid git cat-file header %q", strings.TrimSpace(header))
+	}
+
+	// content is followed by a newline
+	buf := make([]byte, size+1)
+	if _, err := io.ReadFull(r.out, buf); err != nil {
+		return nil, fmt.Errorf("failed to read blob: %w", err)
+	}
+	if f[1] != "blob" {
+		return nil, fmt.Errorf("%s:%s is a %s, not a blob", rev, path, f[1])
+	}
+	return buf[:size], nil
+}
+
+// Close stops the git process.
+func (r *BlobReader) Close() error {
+	r.stdin.Close()
+	return r.cmd.Wait()
+}
@@ -0,0 +1,183 @@
+// Package highlight colors lines of source code with ANSI escapes for
+// terminal previews. It only knows keywords, strings, numbers and line
+// comments, which is enough to read a chunk at a glance.
+package highlight
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ANSI styles of the highlighted tokens.
+const (
+	reset   = "\x1b[0m"
+	keyword = "\x1b[35m"
+	str     = "\x1b[32m"
+	number  = "\x1b[33m"
+	comment = "\x1b[90m"
+)
+
+// syntax describes the tokens of a language.
+type syntax struct {
+	// comments start a comment running to the end of the line.
+	comments []string
+	// quotes delimit strings.
+	quotes   string
+	keywords map[string]bool
+}
+
+// words returns the set of the space-separated words of s.
+func words(s string) map[string]bool {
+	m := map[string]bool{}
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var (
+	cLike = syntax{
+		comments: []string{"//"},
+		quotes:   `"'`,
+		keywords: words("auto break case char const continue default do double else enum extern float for goto if inline int long register return short signed sizeof static struct switch typedef union unsigned void volatile while class namespace template typename public private protected virtual override new delete this nullptr true false bool using try catch throw"),
+	}
+	hashComments = syntax{comments: []string{"#"}, quotes: `"'`}
+
+	syntaxes = map[string]syntax{
+		"go": {
+			comments: []string{"//"},
+			quotes:   "\"'`",
+			keywords: words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota"),
+		},
+		"python": {
+			comments: []string{"#"},
+			quotes:   `"'`,
+			keywords: words("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self"),
+		},
+		"javascript": {
+			comments: []string{"//"},
+			quotes:   "\"'`",
+			keywords: words("async await break case catch class const continue debugger default delete do else export extends finally for function if import in instanceof let new of return super switch this throw try typeof var void while yield null undefined true false"),
+		},
+		"typescript": {
+			comments: []string{"//"},
+			quotes:   "\"'`",
+			keywords: words("async await break case catch class const continue debugger default delete do else enum export extends finally for function if implements import in instanceof interface let new of private protected public readonly return super switch this throw try type typeof var void while yield null undefined true false any string number boolean"),
+		},
+		"rust": {
+			comments: []string{"//"},
+			quotes:   `"`,
+			keywords: words("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while Some None Ok Err"),
+		},
+		"java": {
+			comments: []string{"//"},
+			quotes:   `"'`,
+			keywords: words("abstract assert boolean break byte case catch char class const continue default do double else enum extends final finally float for if implements import instanceof int interface long native new package private protected public return short static super switch synchronized this throw throws transient try void volatile while null true false var record"),
+		},
+		"kotlin": {
+			comments: []string{"//"},
+			quotes:   `"'`,
+			keywords: words("as break class continue do else false for fun if in interface is null object package return super this throw true try typealias val var when while data sealed override private public internal open companion"),
+		},
+		"csharp": {
+			comments: []string{"//"},
+			quotes:   `"'`,
+			keywords: words("abstract as async await base bool break case catch class const continue default delegate do else enum event false finally for foreach if interface internal is namespace new null override private protected public readonly return sealed static string struct switch this throw true try using var virtual void while"),
+		},
+		"c":   cLike,
+		"cpp": cLike,
+		"ruby": {
+			comments: []string{"#"},
+			quotes:   `"'`,
+			keywords: words("alias and begin break case class def defined do else elsif end ensure false for if in module next nil not or redo rescue retry return self super then true undef unless until when while yield"),
+		},
+		"php": {
+			comments: []string{"//", "#"},
+			quotes:   `"'`,
+			keywords: words("abstract array as break case catch class const continue default do echo else elseif extends final for foreach function if implements interface new null private protected public return static switch throw trait true false try use while"),
+		},
+		"shell": {
+			comments: []string{"#"},
+			quotes:   `"'`,
+			keywords: words("if then else elif fi case esac for while until do done in function return local export set"),
+		},
+		"sql": {
+			comments: []string{"--"},
+			quotes:   `'`,
+			keywords: words("select from where and or not insert into values update set delete create table index drop alter join left right inner outer on group by order having limit as distinct union null is in exists primary key SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE INDEX DROP ALTER JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING LIMIT AS DISTINCT UNION NULL IS IN EXISTS PRIMARY KEY"),
+		},
+		"lua": {
+			comments: []string{"--"},
+			quotes:   `"'`,
+			keywords: words("and break do else elseif end false for function if in local nil not or repeat return then true until while"),
+		},
+		"yaml":       hashComments,
+		"toml":       hashComments,
+		"makefile":   hashComments,
+		"dockerfile": hashComments,
+		"terraform":  {comments: []string{"#", "//"}, quotes: `"`},
+	}
+)
+
+// Line returns line with ANSI colors for the given language, as detected by
+// the detect package. Lines of unknown languages are returned as is.
+func Line(line, language string) string {
+	s, ok := syntaxes[language]
+	if !ok {
+		return line
+	}
+
+	var b strings.Builder
+	rs := []rune(line)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case startsComment(rs[i:], s.comments):
+			b.WriteString(comment + string(rs[i:]) + reset)
+			return b.String()
+		case strings.ContainsRune(s.quotes, r):
+			j := i + 1
+			for j < len(rs) && rs[j] != r {
+				if rs[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(rs))
+			b.WriteString(str + string(rs[i:j]) + reset)
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_') {
+				j++
+			}
+			w := string(rs[i:j])
+			if s.keywords[w] {
+				w = keyword + w + reset
+			}
+			b.WriteString(w)
+			i = j
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || unicode.IsLetter(rs[j]) || rs[j] == '.' || rs[j] == '_') {
+				j++
+			}
+			b.WriteString(number + string(rs[i:j]) + reset)
+			i = j
+		default:
+			b.WriteRune(r)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// startsComment reports whether rs starts with one of the comment markers.
+func startsComment(rs []rune, markers []string) bool {
+	for _, m := range markers {
+		if strings.HasPrefix(string(rs[:min(len(rs), len(m))]), m) {
+			return true
+		}
+	}
+	return false
+}
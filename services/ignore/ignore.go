@@ -0,0 +1,70 @@
+// Package ignore provides built-in ignore patterns for common ecosystems.
+package ignore
+
+import "sort"
+
+// Packs maps an ecosystem to the gitignore-style patterns skipped by default.
+var Packs = map[string][]string{
+	"general": {
+		".git/",
+		".DS_Store",
+		"Thumbs.db",
+		".*.swp",
+		".idea/",
+		".vscode/",
+		"*.db",
+		"*.db.wal",
+		"*.log",
+	},
+	"go": {
+		"vendor/",
+		"*.test",
+		"*.exe",
+	},
+	"node": {
+		"node_modules/",
+		"dist/",
+		"build/",
+		"coverage/",
+		".next/",
+		".nuxt/",
+		"*.min.js",
+		"*.min.css",
+		"*.map",
+		"package-lock.json",
+		"yarn.lock",
+		"pnpm-lock.yaml",
+	},
+	"python": {
+		"__pycache__/",
+		"*.pyc",
+		"*.pyo",
+		".venv/",
+		"venv/",
+		".tox/",
+		".nox/",
+		".pytest_cache/",
+		".mypy_cache/",
+		"*.egg-info/",
+	},
+	"rust": {
+		"target/",
+		"Cargo.lock",
+		"*.rlib",
+	},
+}
+
+// Defaults returns the patterns of every pack, in a stable order.
+func Defaults() []string {
+	names := make([]string, 0, len(Packs))
+	for name := range Packs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out []string
+	for _, name := range names {
+		out = append(out, Packs[name]...)
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+package index
+
+import "sync"
+
+// autoIndex implements IndexService with a flat index while it is small,
+// and moves its vectors into an hnsw graph once it holds more than
+// flatLimit. It never moves back, so an index shrinking around the limit
+// doesn't rebuild its graph over and over.
+type autoIndex struct {
+	mu sync.RWMutex
+	config
+	cur IndexService
+	// flat is cur while the index is still flat, nil afterwards.
+	flat *exactIndex
+}
+
+// Add inserts or replaces the vector stored under id.
+func (s *autoIndex) Add(id string, vec []float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cur.Add(id, vec)
+	if s.flat != nil && s.flat.Len() > s.flatLimit {
+		g := newGraphIndex(s.config)
+		s.flat.each(g.Add)
+		s.cur, s.flat = g, nil
+	}
+}
+
+// Delete removes id from the index.
+func (s *autoIndex) Delete(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cur.Delete(id)
+}
+
+// Search returns the k nearest neighbours of q, nearest first.
+func (s *autoIndex) Search(q []float32, k int) []Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cur.Search(q, k)
+}
+
+// Len returns the number of vectors in the index.
+func (s *autoIndex) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cur.Len()
+}
+
+// Dims returns the dimension of the stored vectors, 0 when empty.
+func (s *autoIndex) Dims() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cur.Dims()
+}
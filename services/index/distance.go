@@ -0,0 +1,36 @@
+package index
+
+import "github.com/viterin/vek/vek32"
+
+// Distance kernels use AVX2 and FMA instructions when the CPU has them, and
+// fall back to plain Go loops otherwise.
+
+// CosineDistance returns one minus the cosine similarity of a and b, 1 when
+// they are empty or either has a zero norm, whose similarity is NaN and
+// would otherwise break the ordering of results.
+func CosineDistance(a, b []float32) float32 {
+	if len(a) == 0 {
+		return 1
+	}
+	sim := vek32.CosineSimilarity(a, b)
+	if sim != sim {
+		return 1
+	}
+	return 1 - sim
+}
+
+// EuclideanDistance returns the euclidean distance between a and b.
+func EuclideanDistance(a, b []float32) float32 {
+	if len(a) == 0 {
+		return 0
+	}
+	return vek32.Distance(a, b)
+}
+
+// Dot returns the dot product of a and b.
+func Dot(a, b []float32) float32 {
+	if len(a) == 0 {
+		return 0
+	}
+	return vek32.Dot(a, b)
+}
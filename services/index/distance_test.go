@@ -0,0 +1,112 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/viterin/vek/vek32"
+)
+
+// benchDims is the size of the vectors benchmarked, that of common code
+// embedding models.
+const benchDims = 768
+
+// simd is whether the kernels use SIMD instructions on this CPU, before
+// benchmarks toggle them.
+var simd = vek32.Info().Acceleration
+
+// kernels runs bench once with the plain Go kernels and once with the SIMD
+// ones, when the CPU has them.
+func kernels(b *testing.B, bench func(b *testing.B)) {
+	defer vek32.SetAcceleration(simd)
+	vek32.SetAcceleration(false)
+	b.Run("scalar", bench)
+	if !simd {
+		b.Log("no AVX2 and FMA: SIMD kernels not benchmarked")
+		return
+	}
+	vek32.SetAcceleration(true)
+	b.Run("simd", bench)
+}
+
+// randomVectors returns n random vectors of dims dimensions.
+func randomVectors(n, dims int) [][]float32 {
+	r := rand.New(rand.NewSource(1))
+	out := make([][]float32, n)
+	for i := range out {
+		out[i] = make([]float32, dims)
+		for j := range out[i] {
+			out[i][j] = r.Float32()*2 - 1
+		}
+	}
+	return out
+}
+
+// sink keeps the compiler from dropping benchmarked calls.
+var sink float32
+
+func BenchmarkCosine(b *testing.B) {
+	v := randomVectors(2, benchDims)
+	kernels(b, func(b *testing.B) {
+		for range b.N {
+			sink = CosineDistance(v[0], v[1])
+		}
+	})
+}
+
+func BenchmarkEuclidean(b *testing.B) {
+	v := randomVectors(2, benchDims)
+	kernels(b, func(b *testing.B) {
+		for range b.N {
+			sink = EuclideanDistance(v[0], v[1])
+		}
+	})
+}
+
+func BenchmarkDot(b *testing.B) {
+	v := randomVectors(2, benchDims)
+	kernels(b, func(b *testing.B) {
+		for range b.N {
+			sink = Dot(v[0], v[1])
+		}
+	})
+}
+
+func BenchmarkHalfCosine(b *testing.B) {
+	v := randomVectors(2, benchDims)
+	x, y := packHalf(v[0]), packHalf(v[1])
+	kernels(b, func(b *testing.B) {
+		for range b.N {
+			sink = halfCosineDistance(x, y)
+		}
+	})
+}
+
+// BenchmarkSearch measures the query path: the top 10 of 5000 vectors, in
+// the flat index and through the hnsw graph.
+func BenchmarkSearch(b *testing.B) {
+	const n, k = 5000, 10
+	vecs := randomVectors(n+1, benchDims)
+	q := vecs[n]
+	for _, e := range []struct {
+		name string
+		idx  IndexService
+	}{
+		{"flat", NewExactIndexService()},
+		{"hnsw", NewIndexService()},
+	} {
+		for i, v := range vecs[:n] {
+			e.idx.Add(fmt.Sprintf("f%d", i), v)
+		}
+		b.Run(e.name, func(b *testing.B) {
+			kernels(b, func(b *testing.B) {
+				for range b.N {
+					if len(e.idx.Search(q, k)) != k {
+						b.Fatal("short results")
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// tables numbers the temporary tables of DuckDB indexes sharing a database.
+var tables atomic.Int64
+
+// duckBatch is how many added vectors are written in one insert.
+const duckBatch = 256
+
+// duckIndex implements IndexService on a temporary DuckDB table, so that
+// vectors live in DuckDB's buffer pool, which spills to disk past its memory
+// limit, instead of on the Go heap. Searches scan the table with
+// array_cosine_distance, or use an HNSW index of the vss extension, which
+// the extension keeps in memory: only scans keep vectors out of memory.
+type duckIndex struct {
+	ctx     context.Context
+	onError func(error)
+
+	mu sync.Mutex
+	// conn holds the temporary table, which is only visible to it.
+	conn  *sql.Conn
+	table string
+	vss   bool
+	dims  int
+	n     int
+	// pending holds the vectors added since the last insert, by id, in the
+	// order they were added.
+	pending []pendingVector
+	queued  map[string]int
+}
+
+// pendingVector is a vector added to a DuckDB index but not inserted yet,
+// as an array literal.
+type pendingVector struct {
+	id  string
+	lit string
+}
+
+// NewDuckDBIndexService returns an empty IndexService storing its vectors in
+// db, released when ctx is done. Searches use the HNSW index of the vss
+// extension when hnsw is set and it can be loaded, which must fit in memory,
+// and scan otherwise. The interface has no errors, so failed statements are
+// passed to onError, and the operation is skipped.
+func NewDuckDBIndexService(ctx context.Context, db *sql.DB, hnsw bool, onError func(error)) (IndexService, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("open connection failed: %w", err)
+	}
+	s := &duckIndex{ctx: ctx, onError: onError, conn: conn, table: fmt.Sprintf("index_vectors_%d", tables.Add(1)), queued: map[string]int{}}
+	// the extension is downloaded on first use, and may be unavailable offline
+	if hnsw {
+		if _, err := conn.ExecContext(ctx, "INSTALL vss; LOAD vss"); err == nil {
+			s.vss = true
+		}
+	}
+	// the table is dropped along with the connection
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	return s, nil
+}
+
+// VSS reports whether searches of idx use the HNSW index of the DuckDB vss
+// extension. It is false for other index implementations.
+func VSS(idx IndexService) bool {
+	s, ok := idx.(*duckIndex)
+	return ok && s.vss
+}
+
+// create creates the table for vectors of dims dimensions.
+func (s *duckIndex) create(dims int) error {
+	q := fmt.Sprintf("CREATE TEMP TABLE %s (id VARCHAR, vec FLOAT[%d])", s.table, dims)
+	if _, err := s.conn.ExecContext(s.ctx, q); err != nil {
+		return fmt.Errorf("create vector table failed: %w", err)
+	}
+	s.dims = dims
+	if s.vss {
+		q := fmt.Sprintf("CREATE INDEX %s_hnsw ON %s USING HNSW (vec) WITH (metric = 'cosine')", s.table, s.table)
+		if _, err := s.conn.ExecContext(s.ctx, q); err != nil {
+			s.vss = false
+			return fmt.Errorf("create hnsw index failed, scanning instead: %w", err)
+		}
+	}
+	return nil
+}
+
+// Add inserts or replaces the vector stored under id. Vectors are written
+// in batches, before the next read of the index.
+func (s *duckIndex) Add(id string, vec []float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dims == 0 {
+		if err := s.create(len(vec)); err != nil {
+			s.onError(err)
+			if s.dims == 0 {
+				return
+			}
+		}
+	}
+	if len(vec) != s.dims {
+		s.onError(fmt.Errorf("add %s failed: %d dimensions, the index holds %d", id, len(vec), s.dims))
+		return
+	}
+
+	if i, ok := s.queued[id]; ok {
+		s.pending[i].lit = arrayLiteral(vec)
+		return
+	}
+	s.queued[id] = len(s.pending)
+	s.pending = append(s.pending, pendingVector{id: id, lit: arrayLiteral(vec)})
+	if len(s.pending) >= duckBatch {
+		s.flush()
+	}
+}
+
+// flush writes the pending vectors in one transaction, replacing the rows
+// of their ids.
+func (s *duckIndex) flush() {
+	if len(s.pending) == 0 {
+		return
+	}
+	batch := s.pending
+	s.pending, s.queued = nil, map[string]int{}
+
+	ids := make([]any, len(batch))
+	values := make([]any, 0, 2*len(batch))
+	for i, p := range batch {
+		ids[i] = p.id
+		values = append(values, p.id, p.lit)
+	}
+	tx, err := s.conn.BeginTx(s.ctx, nil)
+	if err != nil {
+		s.onError(fmt.Errorf("insert vectors failed: %w", err))
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(s.ctx, fmt.Sprintf("DELETE FROM %s WHERE id IN (?%s)", s.table, strings.Repeat(", ?", len(ids)-1)), ids...)
+	if err != nil {
+		s.onError(fmt.Errorf("insert vectors failed: %w", err))
+		return
+	}
+	deleted, _ := res.RowsAffected()
+	row := fmt.Sprintf("(?, ?::FLOAT[%d])", s.dims)
+	q := fmt.Sprintf("INSERT INTO %s VALUES %s%s", s.table, row, strings.Repeat(", "+row, len(batch)-1))
+	if _, err := tx.ExecContext(s.ctx, q, values...); err != nil {
+		s.onError(fmt.Errorf("insert vectors failed: %w", err))
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		s.onError(fmt.Errorf("insert vectors failed: %w", err))
+		return
+	}
+	s.n += len(batch) - int(deleted)
+}
+
+// Delete removes id from the index.
+func (s *duckIndex) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+	return s.delete(id)
+}
+
+// delete removes id from the table.
+func (s *duckIndex) delete(id string) bool {
+	if s.dims == 0 {
+		return false
+	}
+	res, err := s.conn.ExecContext(s.ctx, fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.table), id)
+	if err != nil {
+		s.onError(fmt.Errorf("delete vector failed: %w", err))
+		return false
+	}
+	n, _ := res.RowsAffected()
+	s.n -= int(n)
+	return n > 0
+}
+
+// Search returns the k nearest neighbours of q, nearest first and ordered by
+// id on equal distances.
+func (s *duckIndex) Search(q []float32, k int) []Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+	if s.n == 0 || k <= 0 {
+		return nil
+	}
+	if len(q) != s.dims {
+		s.onError(fmt.Errorf("search failed: %d dimensions, the index holds %d", len(q), s.dims))
+		return nil
+	}
+
+	// ordering by the distance expression alone lets vss use its index
+	query := fmt.Sprintf(`SELECT id, array_cosine_distance(vec, ?::FLOAT[%d]) AS dist, vec FROM %s
+		ORDER BY array_cosine_distance(vec, ?::FLOAT[%d]) LIMIT ?`, s.dims, s.table, s.dims)
+	lit := arrayLiteral(q)
+	rows, err := s.conn.QueryContext(s.ctx, query, lit, lit, k)
+	if err != nil {
+		s.onError(fmt.Errorf("search failed: %w", err))
+		return nil
+	}
+	defer rows.Close()
+
+	var out []Result
+	for rows.Next() {
+		var (
+			r   Result
+			vec []any
+		)
+		if err := rows.Scan(&r.ID, &r.Distance, &vec); err != nil {
+			s.onError(fmt.Errorf("scan result failed: %w", err))
+			return nil
+		}
+		r.Vector = make([]float32, len(vec))
+		for i, v := range vec {
+			r.Vector[i], _ = v.(float32)
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		s.onError(fmt.Errorf("search failed: %w", err))
+		return nil
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Distance != out[j].Distance {
+			return out[i].Distance < out[j].Distance
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Len returns the number of vectors in the index.
+func (s *duckIndex) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+	return s.n
+}
+
+// Dims returns the dimension of the stored vectors, 0 when empty.
+func (s *duckIndex) Dims() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+	if s.n == 0 {
+		return 0
+	}
+	return s.dims
+}
+
+// arrayLiteral formats vec as a DuckDB array literal, since the driver
+// can't bind slices.
+func arrayLiteral(vec []float32) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, v := range vec {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(v), 'g', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
@@ -0,0 +1,47 @@
+package index
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"testing"
+
+	_ "github.com/marcboeker/go-duckdb"
+)
+
+// TestDuckDBBatches checks that vectors added in batches, replaced while
+// pending or once written, and deleted, are searched as added.
+func TestDuckDBBatches(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idx, err := NewDuckDBIndexService(ctx, db, false, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := duckBatch + duckBatch/2
+	for i := range n {
+		idx.Add(fmt.Sprintf("f%03d.go", i), []float32{0, 1})
+	}
+	// f000.go was written with the first batch, f300.go is still pending
+	idx.Add("f000.go", []float32{1, 0})
+	idx.Add(fmt.Sprintf("f%03d.go", n-1), []float32{1, 0.1})
+	if got := idx.Len(); got != n {
+		t.Errorf("Len = %d, want %d", got, n)
+	}
+	if got, want := resultIDs(idx.Search([]float32{1, 0}, 2)), []string{"f000.go", fmt.Sprintf("f%03d.go", n-1)}; !slices.Equal(got, want) {
+		t.Errorf("Search = %v, want %v", got, want)
+	}
+	if !idx.Delete("f000.go") || idx.Delete("f000.go") {
+		t.Error("Delete didn't remove f000.go once")
+	}
+	if got := idx.Len(); got != n-1 {
+		t.Errorf("Len after Delete = %d, want %d", got, n-1)
+	}
+}
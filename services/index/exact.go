@@ -0,0 +1,185 @@
+package index
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// exactIndex implements IndexService by comparing the query with every
+// stored vector. It is slower than the hnsw graph on large indexes but never
+// misses a neighbour, which makes it the reference to measure the recall of
+// approximate search against.
+type exactIndex struct {
+	mu sync.RWMutex
+	config
+	dims int
+	ids  []string
+	vecs [][]float32
+	// pos is the position of each id in ids and vecs.
+	pos map[string]int
+}
+
+// NewExactIndexService returns an empty IndexService searched exhaustively.
+func NewExactIndexService(opts ...Option) IndexService {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return newExactIndex(c)
+}
+
+// newExactIndex returns an empty exhaustively searched index.
+func newExactIndex(c config) *exactIndex {
+	return &exactIndex{config: c, pos: map[string]int{}}
+}
+
+// Add inserts or replaces the vector stored under id.
+func (s *exactIndex) Add(id string, vec []float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dims = len(vec)
+	if s.half {
+		vec = packHalf(vec)
+	}
+	if i, ok := s.pos[id]; ok {
+		s.vecs[i] = vec
+		return
+	}
+	s.pos[id] = len(s.ids)
+	s.ids = append(s.ids, id)
+	s.vecs = append(s.vecs, vec)
+}
+
+// Delete removes id from the index.
+func (s *exactIndex) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok := s.pos[id]
+	if !ok {
+		return false
+	}
+	// move the last vector into the freed slot
+	last := len(s.ids) - 1
+	s.ids[i], s.vecs[i] = s.ids[last], s.vecs[last]
+	s.pos[s.ids[i]] = i
+	s.ids, s.vecs = s.ids[:last], s.vecs[:last]
+	delete(s.pos, id)
+	return true
+}
+
+// Search returns the k nearest neighbours of q, nearest first and ordered by
+// id on equal distances. Distances are computed in parallel, one slice of the
+// vectors per CPU, each keeping only its k best candidates so that nothing
+// beyond them is ever sorted.
+func (s *exactIndex) Search(q []float32, k int) []Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := len(s.ids)
+	if n == 0 || k <= 0 {
+		return nil
+	}
+
+	distance := CosineDistance
+	if s.half {
+		q = packHalf(q)
+		distance = halfCosineDistance
+	}
+	workers := min(runtime.GOMAXPROCS(0), n)
+	size := (n + workers - 1) / workers
+	tops := make([]topK, workers)
+	var wg sync.WaitGroup
+	for w := range tops {
+		start, end := w*size, min((w+1)*size, n)
+		tops[w] = topK{k: k, ids: s.ids}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				tops[w].offer(i, distance(q, s.vecs[i]))
+			}
+		}()
+	}
+	wg.Wait()
+
+	best := topK{k: k, ids: s.ids}
+	for _, t := range tops {
+		for _, c := range t.best {
+			best.offer(c.i, c.dist)
+		}
+	}
+	out := make([]Result, 0, len(best.best))
+	for _, c := range best.best {
+		r := Result{ID: s.ids[c.i], Distance: c.dist, Vector: s.vecs[c.i]}
+		if s.half {
+			r.Vector = unpackHalf(s.vecs[c.i], s.dims)
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// each calls fn with every stored id and its unpacked vector.
+func (s *exactIndex) each(fn func(id string, vec []float32)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, id := range s.ids {
+		vec := s.vecs[i]
+		if s.half {
+			vec = unpackHalf(vec, s.dims)
+		}
+		fn(id, vec)
+	}
+}
+
+// candidate is the position of a stored vector and its distance to a query.
+type candidate struct {
+	i    int
+	dist float32
+}
+
+// topK keeps the k nearest candidates offered to it, nearest first.
+type topK struct {
+	k    int
+	ids  []string
+	best []candidate
+}
+
+// offer keeps candidate i when it is nearer than the farthest of the k best so far.
+func (t *topK) offer(i int, dist float32) {
+	less := func(a, b candidate) bool {
+		if a.dist != b.dist {
+			return a.dist < b.dist
+		}
+		return t.ids[a.i] < t.ids[b.i]
+	}
+	c := candidate{i, dist}
+	if len(t.best) == t.k {
+		if !less(c, t.best[t.k-1]) {
+			return
+		}
+		t.best = t.best[:t.k-1]
+	}
+	at := sort.Search(len(t.best), func(j int) bool { return less(c, t.best[j]) })
+	t.best = append(t.best, candidate{})
+	copy(t.best[at+1:], t.best[at:])
+	t.best[at] = c
+}
+
+// Len returns the number of vectors in the index.
+func (s *exactIndex) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.ids)
+}
+
+// Dims returns the dimension of the stored vectors, 0 when empty.
+func (s *exactIndex) Dims() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.ids) == 0 {
+		return 0
+	}
+	return s.dims
+}
@@ -0,0 +1,139 @@
+package index
+
+import "math"
+
+// Vectors of float16 indexes are packed two halves per float32 slot, so
+// that the hnsw graph, which only stores []float32, holds them in half the
+// memory. Distances unpack the halves on the fly.
+
+// packHalf converts vec to float16 and packs it into len(vec)/2 rounded up
+// float32 slots.
+func packHalf(vec []float32) []float32 {
+	out := make([]float32, (len(vec)+1)/2)
+	for i, v := range vec {
+		h := uint32(toHalf(v))
+		bits := math.Float32bits(out[i/2])
+		if i%2 == 0 {
+			bits |= h
+		} else {
+			bits |= h << 16
+		}
+		out[i/2] = math.Float32frombits(bits)
+	}
+	return out
+}
+
+// unpackHalf returns the dims float32 values packed in p.
+func unpackHalf(p []float32, dims int) []float32 {
+	out := make([]float32, dims)
+	for i := range out {
+		bits := math.Float32bits(p[i/2])
+		if i%2 == 1 {
+			bits >>= 16
+		}
+		out[i] = halfTable[uint16(bits)]
+	}
+	return out
+}
+
+// halfChunk is how many halves are converted at a time before the vector
+// kernels run on them.
+const halfChunk = 64
+
+// halfCosineDistance is the cosine distance of two packed vectors.
+func halfCosineDistance(a, b []float32) float32 {
+	var (
+		x, y        [halfChunk]float32
+		dot, na, nb float32
+	)
+	for start := 0; start < len(a); start += halfChunk / 2 {
+		end := min(start+halfChunk/2, len(a))
+		n := 2 * (end - start)
+		for i := start; i < end; i++ {
+			ba, bb := math.Float32bits(a[i]), math.Float32bits(b[i])
+			j := 2 * (i - start)
+			x[j], x[j+1] = halfTable[uint16(ba)], halfTable[uint16(ba>>16)]
+			y[j], y[j+1] = halfTable[uint16(bb)], halfTable[uint16(bb>>16)]
+		}
+		dot += Dot(x[:n], y[:n])
+		na += Dot(x[:n], x[:n])
+		nb += Dot(y[:n], y[:n])
+	}
+	if na == 0 || nb == 0 {
+		return 1
+	}
+	return 1 - dot/float32(math.Sqrt(float64(na))*math.Sqrt(float64(nb)))
+}
+
+// halfTable maps every half to its float32 value, so that distances look
+// halves up instead of decoding them.
+var halfTable = func() *[1 << 16]float32 {
+	var t [1 << 16]float32
+	for h := range t {
+		t[h] = fromHalf(uint16(h))
+	}
+	return &t
+}()
+
+// toHalf converts f to the nearest IEEE 754 half precision value. Values
+// too large for a half become infinite, too small ones zero or subnormal.
+func toHalf(f float32) uint16 {
+	b := math.Float32bits(f)
+	sign := uint16(b>>16) & 0x8000
+	exp := int((b>>23)&0xff) - 127 + 15
+	mant := b & 0x7fffff
+
+	switch {
+	case (b>>23)&0xff == 0xff:
+		// infinity or NaN
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	case exp >= 0x1f:
+		return sign | 0x7c00
+	case exp <= 0:
+		if exp < -10 {
+			return sign
+		}
+		// subnormal: shift the mantissa with its implicit leading 1
+		mant |= 0x800000
+		shift := uint(14 - exp)
+		h := mant >> shift
+		if rem := mant & (1<<shift - 1); rem > 1<<(shift-1) || (rem == 1<<(shift-1) && h&1 == 1) {
+			h++
+		}
+		return sign | uint16(h)
+	}
+
+	h := uint32(exp)<<10 | mant>>13
+	// round to nearest even, which may carry into the exponent
+	if rem := mant & 0x1fff; rem > 0x1000 || (rem == 0x1000 && h&1 == 1) {
+		h++
+	}
+	return sign | uint16(h)
+}
+
+// fromHalf converts the half precision value h to a float32.
+func fromHalf(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch {
+	case exp == 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case exp == 0:
+		if mant == 0 {
+			return math.Float32frombits(sign)
+		}
+		// subnormal: normalize the mantissa
+		e := uint32(127 - 15 + 1)
+		for mant&0x400 == 0 {
+			mant <<= 1
+			e--
+		}
+		return math.Float32frombits(sign | e<<23 | (mant&0x3ff)<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13)
+}
@@ -0,0 +1,74 @@
+package index
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+// TestHalfRoundTrip checks the float16 conversions on exact, rounded and
+// out of range values.
+func TestHalfRoundTrip(t *testing.T) {
+	inf := float32(math.Inf(1))
+	for _, c := range []struct {
+		name string
+		in   float32
+		half uint16
+		want float32
+	}{
+		{"zero", 0, 0x0000, 0},
+		{"negative zero", float32(math.Copysign(0, -1)), 0x8000, float32(math.Copysign(0, -1))},
+		{"one", 1, 0x3c00, 1},
+		{"negative", -2, 0xc000, -2},
+		{"largest", 65504, 0x7bff, 65504},
+		{"smallest normal", 1.0 / (1 << 14), 0x0400, 1.0 / (1 << 14)},
+		{"smallest subnormal", 1.0 / (1 << 24), 0x0001, 1.0 / (1 << 24)},
+		{"rounded", 1.0 / 3, 0x3555, 0.333251953125},
+		{"ties to even", 1 + 1.0/(1<<11), 0x3c00, 1},
+		{"overflow", 65520, 0x7c00, inf},
+		{"underflow", 1e-8, 0x0000, 0},
+		{"infinity", -inf, 0xfc00, -inf},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			h := toHalf(c.in)
+			if h != c.half {
+				t.Errorf("toHalf(%v) = %#04x, want %#04x", c.in, h, c.half)
+			}
+			if got := fromHalf(h); math.Float32bits(got) != math.Float32bits(c.want) {
+				t.Errorf("fromHalf(%#04x) = %v, want %v", h, got, c.want)
+			}
+		})
+	}
+
+	if got := fromHalf(toHalf(float32(math.NaN()))); got == got {
+		t.Errorf("NaN converted to %v", got)
+	}
+	for h := range 1 << 16 {
+		f := fromHalf(uint16(h))
+		if f != f {
+			continue
+		}
+		if got := toHalf(f); got != uint16(h) {
+			t.Errorf("toHalf(fromHalf(%#04x)) = %#04x", h, got)
+		}
+	}
+}
+
+// TestPackHalf checks that packed vectors of odd and even lengths unpack to
+// their float16 values.
+func TestPackHalf(t *testing.T) {
+	for _, vec := range [][]float32{
+		{},
+		{1},
+		{1, -0.5, 2},
+		{0.25, 65504, -1, 1.0 / (1 << 24)},
+	} {
+		p := packHalf(vec)
+		if len(p) != (len(vec)+1)/2 {
+			t.Errorf("packHalf(%v) has %d slots", vec, len(p))
+		}
+		if got := unpackHalf(p, len(vec)); !slices.Equal(got, vec) {
+			t.Errorf("unpackHalf(packHalf(%v)) = %v", vec, got)
+		}
+	}
+}
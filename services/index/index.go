@@ -0,0 +1,200 @@
+// Package index provides a concurrency-safe in-memory vector index.
+package index
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/coder/hnsw"
+)
+
+// Result is a single nearest neighbour match.
+type Result struct {
+	// ID is the key of the matched node, i.e. the file path.
+	ID string
+	// Distance is the cosine distance between the query and the node.
+	Distance float32
+	// Vector is the stored embedding of the node.
+	Vector []float32
+}
+
+// IndexService defines the interface for nearest neighbour search.
+type IndexService interface {
+	// Add inserts or replaces the vector stored under id.
+	Add(id string, vec []float32)
+	// Delete removes id from the index.
+	Delete(id string) bool
+	// Search returns the k nearest neighbours of q.
+	Search(q []float32, k int) []Result
+	// Len returns the number of vectors in the index.
+	Len() int
+	// Dims returns the dimension of the stored vectors, 0 when empty.
+	Dims() int
+}
+
+// indexService implements IndexService on top of an hnsw graph.
+type indexService struct {
+	mu sync.RWMutex
+	g  *hnsw.Graph[string]
+	config
+	// dims is the unpacked dimension of float16 vectors.
+	dims int
+}
+
+// config holds the settings shared by every index implementation.
+type config struct {
+	// half packs vectors as float16.
+	half bool
+	// flatLimit is how many vectors are searched exhaustively before an
+	// hnsw graph is built, 0 to always use the graph.
+	flatLimit int
+	// seed seeds the levels of hnsw nodes, 0 to seed them from the clock.
+	seed int64
+}
+
+// Option configures an index.
+type Option func(*config)
+
+// WithFloat16 stores vectors as float16, halving their memory at the cost
+// of precision and of converting them in every distance computation.
+func WithFloat16() Option {
+	return func(c *config) {
+		c.half = true
+	}
+}
+
+// WithFlatLimit searches indexes of up to n vectors exhaustively, which is
+// exact and fast enough on small corpora, and only builds the hnsw graph once
+// they grow larger.
+func WithFlatLimit(n int) Option {
+	return func(c *config) {
+		c.flatLimit = n
+	}
+}
+
+// WithSeed seeds the levels hnsw draws for its nodes, so that graphs given
+// the same vectors in the same order are built alike.
+func WithSeed(seed int64) Option {
+	return func(c *config) {
+		c.seed = seed
+	}
+}
+
+// NewIndexService returns an empty IndexService backed by an hnsw graph, or
+// by a flat index until it outgrows the WithFlatLimit size.
+func NewIndexService(opts ...Option) IndexService {
+	var c config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.flatLimit > 0 {
+		flat := newExactIndex(c)
+		return &autoIndex{config: c, cur: flat, flat: flat}
+	}
+	return newGraphIndex(c)
+}
+
+// newGraphIndex returns an empty index backed by an hnsw graph.
+func newGraphIndex(c config) *indexService {
+	s := &indexService{config: c}
+	s.g = s.newGraph()
+	return s
+}
+
+// newGraph returns an empty graph comparing vectors as stored.
+func (s *indexService) newGraph() *hnsw.Graph[string] {
+	g := hnsw.NewGraph[string]()
+	g.Distance = CosineDistance
+	if s.half {
+		g.Distance = halfCosineDistance
+	}
+	if s.seed != 0 {
+		g.Rng = rand.New(rand.NewSource(s.seed))
+	}
+	return g
+}
+
+// Add inserts or replaces the vector stored under id.
+func (s *indexService) Add(id string, vec []float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// hnsw panics when re-adding an existing key, so replace explicitly.
+	if _, ok := s.g.Lookup(id); ok {
+		s.delete(id)
+	}
+	if s.half {
+		s.dims = len(vec)
+		vec = packHalf(vec)
+	}
+	s.g.Add(hnsw.MakeNode(id, vec))
+}
+
+// Delete removes id from the index.
+func (s *indexService) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delete(id)
+}
+
+// delete removes id from the graph. hnsw keeps the emptied layers of a graph
+// whose last node was deleted and then panics on the next Add or Search, so
+// an empty graph is replaced with a new one.
+func (s *indexService) delete(id string) bool {
+	ok := s.g.Delete(id)
+	if ok && s.g.Len() == 0 {
+		s.g = s.newGraph()
+	}
+	return ok
+}
+
+// Search returns the k nearest neighbours of q, nearest first. Equal
+// distances are ordered by id so that results are stable across runs.
+func (s *indexService) Search(q []float32, k int) []Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.g.Len() == 0 {
+		return nil
+	}
+
+	if s.half {
+		q = packHalf(q)
+	}
+	nodes := s.g.Search(q, k)
+	out := make([]Result, 0, len(nodes))
+	for _, n := range nodes {
+		r := Result{ID: n.Key, Distance: s.g.Distance(q, n.Value), Vector: n.Value}
+		if s.half {
+			r.Vector = unpackHalf(n.Value, s.dims)
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Distance != out[j].Distance {
+			return out[i].Distance < out[j].Distance
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Len returns the number of vectors in the index.
+func (s *indexService) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.g.Len()
+}
+
+// Dims returns the dimension of the stored vectors, 0 when empty.
+func (s *indexService) Dims() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.g.Len() == 0 {
+		return 0
+	}
+	if s.half {
+		return s.dims
+	}
+	return s.g.Dims()
+}
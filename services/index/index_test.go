@@ -0,0 +1,215 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// TestSearchTies checks that equal distances are ordered by id, whatever
+// order the vectors were added in.
+func TestSearchTies(t *testing.T) {
+	var ids []string
+	for i := range 12 {
+		ids = append(ids, fmt.Sprintf("f%02d.go", i))
+	}
+	near, far := []float32{1, 0, 0}, []float32{0, 1, 0}
+	// the even ids are at equal distance of the query, ahead of the odd ones
+	vector := func(i int) []float32 {
+		if i%2 == 0 {
+			return near
+		}
+		return far
+	}
+	var want []string
+	for i, id := range ids {
+		if i%2 == 0 {
+			want = append(want, id)
+		}
+	}
+	for i, id := range ids {
+		if i%2 != 0 {
+			want = append(want, id)
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		new  func(...Option) IndexService
+	}{
+		{"flat", NewExactIndexService},
+		{"hnsw", NewIndexService},
+		{"flat float16", func(opts ...Option) IndexService { return NewExactIndexService(append(opts, WithFloat16())...) }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			for seed := range int64(5) {
+				idx := c.new()
+				order := rand.New(rand.NewSource(seed)).Perm(len(ids))
+				for _, i := range order {
+					idx.Add(ids[i], vector(i))
+				}
+				if got := resultIDs(idx.Search(near, len(ids))); !slices.Equal(got, want) {
+					t.Errorf("insert order %v: Search = %v, want %v", order, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestExactSearchTiesTopK checks that the flat index keeps the first ids of
+// a tie when it is cut by k, on every CPU slice of the vectors.
+func TestExactSearchTiesTopK(t *testing.T) {
+	idx := NewExactIndexService()
+	var want []string
+	for i := 99; i >= 0; i-- {
+		idx.Add(fmt.Sprintf("f%02d.go", i), []float32{1, 1})
+	}
+	for i := range 5 {
+		want = append(want, fmt.Sprintf("f%02d.go", i))
+	}
+	if got := resultIDs(idx.Search([]float32{1, 1}, 5)); !slices.Equal(got, want) {
+		t.Errorf("Search = %v, want %v", got, want)
+	}
+}
+
+// resultIDs returns the ids of results, in order.
+func resultIDs(results []Result) []string {
+	out := make([]string, len(results))
+	for i, r := range results {
+		out[i] = r.ID
+	}
+	return out
+}
+
+// TestSeededGraphs builds two seeded graphs of the same vectors, added in
+// the same order, and checks that every query finds the same neighbours in
+// both.
+func TestSeededGraphs(t *testing.T) {
+	const n, k = 2000, 10
+	vecs := randomVectors(n+100, 32)
+	build := func() IndexService {
+		idx := NewIndexService(WithSeed(1))
+		for i, v := range vecs[:n] {
+			idx.Add(fmt.Sprintf("f%04d", i), v)
+		}
+		return idx
+	}
+	a, b := build(), build()
+	for i, q := range vecs[n:] {
+		if got, want := resultIDs(b.Search(q, k)), resultIDs(a.Search(q, k)); !slices.Equal(got, want) {
+			t.Fatalf("query %d: second graph found %v, first %v", i, got, want)
+		}
+	}
+}
+
+// TestTopK checks that candidates are kept nearest first, ties by id, and
+// cut at k whatever order they are offered in.
+func TestTopK(t *testing.T) {
+	ids := []string{"a", "b", "c", "d"}
+	offers := []candidate{{2, 0.5}, {0, 0.1}, {3, 0.5}, {1, 0.9}}
+	for _, c := range []struct {
+		k    int
+		want []string
+	}{
+		{1, []string{"a"}},
+		{2, []string{"a", "c"}},
+		{3, []string{"a", "c", "d"}},
+		{10, []string{"a", "c", "d", "b"}},
+	} {
+		for seed := range int64(5) {
+			top := topK{k: c.k, ids: ids}
+			for _, i := range rand.New(rand.NewSource(seed)).Perm(len(offers)) {
+				top.offer(offers[i].i, offers[i].dist)
+			}
+			var got []string
+			for _, b := range top.best {
+				got = append(got, ids[b.i])
+			}
+			if !slices.Equal(got, c.want) {
+				t.Errorf("k %d, seed %d: kept %v, want %v", c.k, seed, got, c.want)
+			}
+		}
+	}
+}
+
+// TestZeroNorm checks that vectors of zero norm are at distance 1 of
+// everything, ranked after the nearer ones, rather than NaN.
+func TestZeroNorm(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		new  func(...Option) IndexService
+	}{
+		{"flat", NewExactIndexService},
+		{"hnsw", NewIndexService},
+		{"flat float16", func(opts ...Option) IndexService { return NewExactIndexService(append(opts, WithFloat16())...) }},
+		{"hnsw float16", func(opts ...Option) IndexService { return NewIndexService(append(opts, WithFloat16())...) }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			idx := c.new()
+			idx.Add("a.go", []float32{0, 0, 0})
+			idx.Add("b.go", []float32{1, 0, 0})
+			idx.Add("c.go", []float32{1, 1, 0})
+
+			for _, q := range []struct {
+				vec  []float32
+				want []string
+			}{
+				{[]float32{1, 0, 0}, []string{"b.go", "c.go", "a.go"}},
+				{[]float32{0, 0, 0}, []string{"a.go", "b.go", "c.go"}},
+			} {
+				results := idx.Search(q.vec, 3)
+				if got := resultIDs(results); !slices.Equal(got, q.want) {
+					t.Errorf("Search(%v) = %v, want %v", q.vec, got, q.want)
+				}
+				for _, r := range results {
+					if r.Distance != r.Distance {
+						t.Errorf("Search(%v): %s at distance NaN", q.vec, r.ID)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestFlatLimit checks that an index stays flat, and exact, up to its limit,
+// then moves every vector into a graph past it.
+func TestFlatLimit(t *testing.T) {
+	const limit, k = 50, 5
+	vecs := randomVectors(limit+20, 16)
+	queries, vecs := vecs[:10], vecs[10:]
+
+	idx := NewIndexService(WithFlatLimit(limit), WithSeed(1)).(*autoIndex)
+	exact := NewExactIndexService()
+	for i, v := range vecs {
+		id := fmt.Sprintf("f%02d", i)
+		idx.Add(id, v)
+		exact.Add(id, v)
+
+		if flat := i+1 <= limit; (idx.flat != nil) != flat {
+			t.Fatalf("after %d vectors: flat %v, want %v", i+1, idx.flat != nil, flat)
+		}
+		if i+1 != limit {
+			continue
+		}
+		for j, q := range queries {
+			if got, want := resultIDs(idx.Search(q, k)), resultIDs(exact.Search(q, k)); !slices.Equal(got, want) {
+				t.Errorf("query %d: Search = %v, want %v", j, got, want)
+			}
+		}
+	}
+
+	g := idx.cur.(*indexService)
+	for i, v := range vecs {
+		id := fmt.Sprintf("f%02d", i)
+		if got, ok := g.g.Lookup(id); !ok || !slices.Equal(got, v) {
+			t.Errorf("graph holds %s as %v, %v, want %v", id, got, ok, v)
+		}
+	}
+	if got := idx.Len(); got != len(vecs) {
+		t.Errorf("Len = %d, want %d", got, len(vecs))
+	}
+	if got := idx.Dims(); got != 16 {
+		t.Errorf("Dims = %d, want 16", got)
+	}
+}
@@ -0,0 +1,113 @@
+package index
+
+import (
+	"sort"
+	"sync"
+)
+
+// shardedIndex implements IndexService with one graph per shard, e.g. per
+// top-level directory of a monorepo. Graphs stay small enough to rebuild
+// quickly, and are searched in parallel.
+type shardedIndex struct {
+	shardOf func(id string) string
+	opts    []Option
+
+	mu     sync.RWMutex
+	shards map[string]IndexService
+	// owner is the shard each id was added to, so that deletes find it.
+	owner map[string]string
+}
+
+// NewShardedIndexService returns an empty IndexService that stores each id
+// in the graph of shardOf(id), each graph configured by opts.
+func NewShardedIndexService(shardOf func(id string) string, opts ...Option) IndexService {
+	return &shardedIndex{shardOf: shardOf, opts: opts, shards: map[string]IndexService{}, owner: map[string]string{}}
+}
+
+// Add inserts or replaces the vector stored under id.
+func (s *shardedIndex) Add(id string, vec []float32) {
+	name := s.shardOf(id)
+
+	s.mu.Lock()
+	if prev, ok := s.owner[id]; ok && prev != name {
+		s.shards[prev].Delete(id)
+	}
+	shard, ok := s.shards[name]
+	if !ok {
+		shard = NewIndexService(s.opts...)
+		s.shards[name] = shard
+	}
+	s.owner[id] = name
+	s.mu.Unlock()
+
+	// each shard locks itself, so shards are filled concurrently
+	shard.Add(id, vec)
+}
+
+// Delete removes id from the index.
+func (s *shardedIndex) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, ok := s.owner[id]
+	if !ok {
+		return false
+	}
+	delete(s.owner, id)
+	return s.shards[name].Delete(id)
+}
+
+// Search returns the k nearest neighbours of q across every shard, nearest
+// first, searching shards in parallel.
+func (s *shardedIndex) Search(q []float32, k int) []Result {
+	s.mu.RLock()
+	shards := make([]IndexService, 0, len(s.shards))
+	for _, shard := range s.shards {
+		shards = append(shards, shard)
+	}
+	s.mu.RUnlock()
+
+	results := make([][]Result, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = shard.Search(q, k)
+		}()
+	}
+	wg.Wait()
+
+	var out []Result
+	for _, r := range results {
+		out = append(out, r...)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Distance != out[j].Distance {
+			return out[i].Distance < out[j].Distance
+		}
+		return out[i].ID < out[j].ID
+	})
+	if len(out) > k {
+		out = out[:k]
+	}
+	return out
+}
+
+// Len returns the number of vectors in the index.
+func (s *shardedIndex) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.owner)
+}
+
+// Dims returns the dimension of the stored vectors, 0 when empty.
+func (s *shardedIndex) Dims() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, shard := range s.shards {
+		if d := shard.Dims(); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
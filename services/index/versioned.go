@@ -0,0 +1,81 @@
+package index
+
+import (
+	"hash/maphash"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// versionedIndex implements IndexService on top of another, counting the
+// changes made to it.
+type versionedIndex struct {
+	IndexService
+	version atomic.Uint64
+
+	mu sync.Mutex
+	// sums fingerprint the vector of every id, so that adding a file again
+	// unchanged, as every rescan does, isn't a change.
+	sums map[string]uint64
+	seed maphash.Seed
+}
+
+// NewVersionedIndexService returns idx at version, which is incremented
+// whenever a vector is added, replaced by another or removed, so that what
+// was computed from its searches can be told stale.
+func NewVersionedIndexService(idx IndexService, version uint64) IndexService {
+	s := &versionedIndex{IndexService: idx, sums: map[string]uint64{}, seed: maphash.MakeSeed()}
+	s.version.Store(version)
+	return s
+}
+
+// Add inserts or replaces the vector stored under id.
+func (s *versionedIndex) Add(id string, vec []float32) {
+	var h maphash.Hash
+	h.SetSeed(s.seed)
+	var b [4]byte
+	for _, v := range vec {
+		bits := math.Float32bits(v)
+		b[0], b[1], b[2], b[3] = byte(bits), byte(bits>>8), byte(bits>>16), byte(bits>>24)
+		h.Write(b[:])
+	}
+	sum := h.Sum64()
+
+	s.IndexService.Add(id, vec)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.sums[id]; !ok || old != sum {
+		s.sums[id] = sum
+		s.version.Add(1)
+	}
+}
+
+// Delete removes id from the index.
+func (s *versionedIndex) Delete(id string) bool {
+	if !s.IndexService.Delete(id) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sums, id)
+	s.version.Add(1)
+	return true
+}
+
+// Version returns the version of idx, given to NewVersionedIndexService and
+// incremented by every change since. It is 0 for other index
+// implementations.
+func Version(idx IndexService) uint64 {
+	s, ok := idx.(*versionedIndex)
+	if !ok {
+		return 0
+	}
+	return s.version.Load()
+}
+
+// Versioned reports whether idx counts its changes, so that Version tells
+// when it changed.
+func Versioned(idx IndexService) bool {
+	_, ok := idx.(*versionedIndex)
+	return ok
+}
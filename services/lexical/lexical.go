@@ -0,0 +1,236 @@
+// Package lexical provides an in-memory BM25 index, used when no embedding
+// provider is available and blended into vector ranking by hybrid search.
+package lexical
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters.
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// Result is a single lexical match.
+type Result struct {
+	// ID is the key of the matched document, i.e. the file path.
+	ID string
+	// Score is the BM25 score of the document; higher is better.
+	Score float64
+}
+
+// LexicalService defines the interface for keyword search.
+type LexicalService interface {
+	// Add inserts or replaces the text stored under id.
+	Add(id, text string)
+	// Delete removes id from the index.
+	Delete(id string) bool
+	// Search returns the k best matches of query.
+	Search(query string, k int) []Result
+	// Score returns the score of id for query, 0 when it doesn't match.
+	Score(query, id string) float64
+	// Len returns the number of documents in the index.
+	Len() int
+}
+
+// doc holds the term frequencies of a document.
+type doc struct {
+	tf  map[string]int
+	len int
+}
+
+// lexicalService implements LexicalService.
+type lexicalService struct {
+	mu       sync.RWMutex
+	docs     map[string]doc
+	df       map[string]int
+	totalLen int
+}
+
+// NewLexicalService returns an empty LexicalService.
+func NewLexicalService() LexicalService {
+	return &lexicalService{docs: map[string]doc{}, df: map[string]int{}}
+}
+
+// Add inserts or replaces the text stored under id.
+func (s *lexicalService) Add(id, text string) {
+	terms := Tokenize(text)
+	d := doc{tf: make(map[string]int, len(terms)/2), len: len(terms)}
+	for _, t := range terms {
+		d.tf[t]++
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+	s.docs[id] = d
+	s.totalLen += d.len
+	for t := range d.tf {
+		s.df[t]++
+	}
+}
+
+// Delete removes id from the index.
+func (s *lexicalService) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(id)
+}
+
+// remove drops id from the index; the caller holds the lock.
+func (s *lexicalService) remove(id string) bool {
+	d, ok := s.docs[id]
+	if !ok {
+		return false
+	}
+	for t := range d.tf {
+		if s.df[t]--; s.df[t] == 0 {
+			delete(s.df, t)
+		}
+	}
+	s.totalLen -= d.len
+	delete(s.docs, id)
+	return true
+}
+
+// Search returns the k best matches of query, by descending score.
+func (s *lexicalService) Search(query string, k int) []Result {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	terms := s.terms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	var results []Result
+	for id, d := range s.docs {
+		if score := s.score(terms, d); score > 0 {
+			results = append(results, Result{ID: id, Score: score})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
+
+// Score returns the score of id for query, 0 when it doesn't match.
+func (s *lexicalService) Score(query, id string) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.docs[id]
+	if !ok {
+		return 0
+	}
+	return s.score(s.terms(query), d)
+}
+
+// terms returns the distinct terms of query found in the index; the caller
+// holds the lock.
+func (s *lexicalService) terms(query string) []string {
+	var terms []string
+	seen := map[string]bool{}
+	for _, t := range Tokenize(query) {
+		if !seen[t] && s.df[t] > 0 {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// score returns the BM25 score of d for terms; the caller holds the lock.
+func (s *lexicalService) score(terms []string, d doc) float64 {
+	n := float64(len(s.docs))
+	avg := float64(s.totalLen) / n
+
+	var score float64
+	for _, t := range terms {
+		tf := float64(d.tf[t])
+		if tf == 0 {
+			continue
+		}
+		df := float64(s.df[t])
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		score += idf * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(d.len)/avg))
+	}
+	return score
+}
+
+// Len returns the number of documents in the index.
+func (s *lexicalService) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.docs)
+}
+
+// Tokenize lowercases text and splits it into words of letters, digits and
+// underscores, dropping single characters. Identifiers are also split into
+// their camelCase and snake_case parts, so that "storage service" matches
+// NewStorageService and storage_service as well as the whole words.
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	var out []string
+	for _, w := range words {
+		if len(w) > 1 {
+			out = append(out, strings.ToLower(w))
+		}
+		if parts := Subwords(w); len(parts) > 1 {
+			for _, p := range parts {
+				if len(p) > 1 {
+					out = append(out, p)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// Subwords splits an identifier at underscores and case changes, lowercased:
+// HTTPServerError gives http, server and error, parse_v2_url gives parse, v2
+// and url.
+func Subwords(ident string) []string {
+	var (
+		out  []string
+		word []rune
+	)
+	flush := func() {
+		if len(word) > 0 {
+			out = append(out, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	runes := []rune(ident)
+	for i, r := range runes {
+		if r == '_' {
+			flush()
+			continue
+		}
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			// a new word starts at aB, and at the last capital of ABc
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				flush()
+			}
+		}
+		word = append(word, r)
+	}
+	flush()
+	return out
+}
@@ -0,0 +1,149 @@
+// Package normalize rewrites text before it is embedded so that vectors
+// capture what code does rather than its boilerplate. The text shown to
+// users is left as is.
+package normalize
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The normalization steps, applied in the order of Steps.
+const (
+	// License strips a license header from the top of a file.
+	License = "license"
+	// Literals replaces long base64 and hex literals with a placeholder.
+	Literals = "literals"
+	// Whitespace collapses indentation, runs of spaces and blank lines.
+	Whitespace = "whitespace"
+)
+
+// Steps lists every step in the order Text applies them.
+var Steps = []string{License, Literals, Whitespace}
+
+// Parse returns the steps of a comma-separated list, "all" for every step,
+// in the order Text applies them.
+func Parse(spec string) ([]string, error) {
+	want := map[string]bool{}
+	for _, s := range strings.Split(spec, ",") {
+		switch s = strings.TrimSpace(s); s {
+		case "":
+		case "all":
+			for _, step := range Steps {
+				want[step] = true
+			}
+		case License, Literals, Whitespace:
+			want[s] = true
+		default:
+			return nil, fmt.Errorf("unknown normalization %q: use %s or all", s, strings.Join(Steps, ", "))
+		}
+	}
+	var out []string
+	for _, step := range Steps {
+		if want[step] {
+			out = append(out, step)
+		}
+	}
+	return out, nil
+}
+
+// Text applies steps to text. Text left empty, such as a file holding only
+// its license, is returned unchanged.
+func Text(text string, steps []string) string {
+	out := text
+	for _, step := range steps {
+		switch step {
+		case License:
+			out = StripLicense(out)
+		case Literals:
+			out = StripLiterals(out)
+		case Whitespace:
+			out = CollapseWhitespace(out)
+		}
+	}
+	if strings.TrimSpace(out) == "" {
+		return text
+	}
+	return out
+}
+
+var (
+	// licenseMarkers are the words of license headers.
+	licenseMarkers = regexp.MustCompile(`(?i)copyright|licen[cs]e|spdx-license-identifier|all rights reserved`)
+	// lineComment matches the lines of comments of the usual languages.
+	lineComment = regexp.MustCompile(`^\s*(//|#|--|;|\*|/\*|\*/|<!--|-->|"""|''')`)
+)
+
+// StripLicense removes the first comment block of text, after a shebang
+// line, when it reads as a license or copyright notice.
+func StripLicense(text string) string {
+	lines := strings.SplitAfter(text, "\n")
+	i := 0
+	if i < len(lines) && strings.HasPrefix(lines[i], "#!") {
+		i++
+	}
+	for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+		i++
+	}
+	start, end := i, i
+	inBlock := false
+	for end < len(lines) {
+		line := strings.TrimSpace(lines[end])
+		if !inBlock && !lineComment.MatchString(line) {
+			break
+		}
+		if strings.HasPrefix(line, "/*") && !strings.Contains(line, "*/") {
+			inBlock = true
+		} else if strings.Contains(line, "*/") {
+			inBlock = false
+		}
+		end++
+	}
+	if end == start || !licenseMarkers.MatchString(strings.Join(lines[start:end], "")) {
+		return text
+	}
+	return strings.Join(lines[:start], "") + strings.TrimLeft(strings.Join(lines[end:], ""), "\n")
+}
+
+var (
+	// base64Literal matches long runs of base64, such as embedded images
+	// and keys.
+	base64Literal = regexp.MustCompile(`[A-Za-z0-9+/]{80,}={0,2}`)
+	// hexLiteral matches long hex strings and byte arrays.
+	hexLiteral = regexp.MustCompile(`\b(0x)?[0-9a-fA-F]{64,}\b|(?:0x[0-9a-fA-F]{2},\s*){32,}(0x[0-9a-fA-F]{2})?`)
+)
+
+// StripLiterals replaces long base64 and hex literals with <base64> and
+// <hex>. Long identifiers aren't taken for base64: a literal must mix
+// digits and both cases.
+func StripLiterals(text string) string {
+	text = hexLiteral.ReplaceAllString(text, "<hex>")
+	return base64Literal.ReplaceAllStringFunc(text, func(s string) string {
+		if strings.ContainsAny(s, "0123456789") && strings.ToLower(s) != s && strings.ToUpper(s) != s {
+			return "<base64>"
+		}
+		return s
+	})
+}
+
+// CollapseWhitespace trims lines, collapses runs of spaces and tabs within
+// them, and runs of blank lines into one.
+func CollapseWhitespace(text string) string {
+	var b strings.Builder
+	blank := true
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			if !blank {
+				b.WriteString("\n")
+			}
+			blank = true
+			continue
+		}
+		b.WriteString(strings.Join(fields, " "))
+		b.WriteString("\n")
+		blank = false
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
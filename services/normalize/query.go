@@ -0,0 +1,83 @@
+package normalize
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Boilerplate are the phrases of natural-language queries that say nothing
+// of the code searched, stripped by default. Code embedding models match
+// "retry backoff" better than "where is the code that does retry backoff".
+var Boilerplate = []string{
+	"where is the code that",
+	"where is the code for",
+	"where is the code",
+	"where's the code that",
+	"show me the code that",
+	"show me the code for",
+	"show me where",
+	"show me",
+	"find the code that",
+	"find the code for",
+	"can you find",
+	"find me",
+	"i'm looking for",
+	"i am looking for",
+	"looking for",
+	"the code that",
+	"the code for",
+	"the part that",
+	"where do we",
+	"where does",
+	"where is",
+	"where are",
+	"in this repository",
+	"in this repo",
+	"in this codebase",
+	"in this project",
+	"in the codebase",
+	"in the repo",
+	"in our codebase",
+	"please",
+}
+
+// QueryCleaner strips boilerplate phrases from queries before they are
+// embedded. A nil cleaner leaves queries unchanged.
+type QueryCleaner struct {
+	re *regexp.Regexp
+}
+
+// NewQueryCleaner returns a cleaner of phrases, matched as whole words
+// whatever their case and spacing; nil without any.
+func NewQueryCleaner(phrases []string) *QueryCleaner {
+	var alts []string
+	for _, p := range phrases {
+		if words := strings.Fields(p); len(words) > 0 {
+			for i, w := range words {
+				words[i] = regexp.QuoteMeta(w)
+			}
+			alts = append(alts, strings.Join(words, `\s+`))
+		}
+	}
+	if len(alts) == 0 {
+		return nil
+	}
+	// the longest phrases first, so that they win over their prefixes
+	sort.SliceStable(alts, func(i, j int) bool { return len(alts[i]) > len(alts[j]) })
+	return &QueryCleaner{re: regexp.MustCompile(`(?i)\b(?:` + strings.Join(alts, "|") + `)\b`)}
+}
+
+// Clean strips the phrases of c from query, and the question mark ending
+// it. A query left empty, made of boilerplate only, is returned unchanged.
+func (c *QueryCleaner) Clean(query string) string {
+	if c == nil {
+		return query
+	}
+	out := strings.TrimRight(c.re.ReplaceAllString(query, " "), " ?")
+	out = strings.Join(strings.Fields(out), " ")
+	if out == "" {
+		return query
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+)
+
+// Decl is a declaration returned by a chunker, where files are chunked.
+type Decl struct {
+	Name string `json:"name"`
+	// Line is the 1-based line the declaration starts at, its doc comment
+	// included.
+	Line int `json:"line"`
+	// Kind is func, type, var, module or section, empty when unknown.
+	Kind string `json:"kind,omitempty"`
+}
+
+// Chunk asks a chunker for the top-level declarations of text, the file at
+// path detected as language. Method chunk, params {"path", "language",
+// "text"}, result {"declarations": [{"name", "line", "kind"}]}. No declarations
+// leave the file to the built-in chunker.
+func (p *Plugin) Chunk(ctx context.Context, path, language, text string) ([]Decl, error) {
+	var result struct {
+		Declarations []Decl `json:"declarations"`
+	}
+	params := map[string]string{"path": path, "language": language, "text": text}
+	if err := p.Call(ctx, "chunk", params, &result); err != nil {
+		return nil, err
+	}
+	return result.Declarations, nil
+}
+
+// Embedding is the result of Embed.
+type Embedding struct {
+	Vector []float32 `json:"embedding"`
+	Model  string    `json:"model"`
+	Tokens int       `json:"tokens"`
+}
+
+// Embed asks an embedding provider for the vector of text. Method embed,
+// params {"text"}, result {"embedding": [...], "model", "tokens"}.
+func (p *Plugin) Embed(ctx context.Context, text string) (Embedding, error) {
+	var result Embedding
+	if err := p.Call(ctx, "embed", map[string]string{"text": text}, &result); err != nil {
+		return result, err
+	}
+	if len(result.Vector) == 0 {
+		return result, fmt.Errorf("plugin %s returned an empty embedding", p.Name())
+	}
+	return result, nil
+}
+
+// Document is a candidate result sent to a reranker.
+type Document struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// Rerank asks a reranker for the relevance of each of docs to query,
+// higher being more relevant. Method rerank, params {"query", "documents":
+// [{"id", "text"}]}, result {"scores": [...]}, one per document in order.
+func (p *Plugin) Rerank(ctx context.Context, query string, docs []Document) ([]float32, error) {
+	var result struct {
+		Scores []float32 `json:"scores"`
+	}
+	params := map[string]any{"query": query, "documents": docs}
+	if err := p.Call(ctx, "rerank", params, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Scores) != len(docs) {
+		return nil, fmt.Errorf("plugin %s returned %d scores for %d documents", p.Name(), len(result.Scores), len(docs))
+	}
+	return result.Scores, nil
+}
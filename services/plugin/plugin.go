@@ -0,0 +1,219 @@
+// Package plugin runs extensions as external executables speaking JSON
+// over stdio, so that chunkers, embedding providers and rerankers can be
+// written in any language without rebuilding codectx.
+//
+// A plugin is a long-lived process. It reads one request per line on its
+// stdin, {"id": 1, "method": "chunk", "params": {...}}, and answers each on
+// a line of its stdout, {"id": 1, "result": {...}} or {"id": 1, "error":
+// "..."}, in order. Its stderr is passed through. It should exit when its
+// stdin is closed.
+//
+// A plugin can also be a WebAssembly module using WASI, named wasm:<path>,
+// which speaks the same protocol but is sandboxed: each request runs a fresh
+// instance with the request line as its whole stdin, no files, network or
+// environment, bounded memory and the deadline of the call. A module that
+// loops over its stdin until it is closed therefore works either way.
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// maxLine bounds a response line, which holds vectors or chunk lists.
+const maxLine = 64 << 20
+
+// request is a line written to a plugin.
+type request struct {
+	ID     int    `json:"id"`
+	Method string `json:"method"`
+	Params any    `json:"params"`
+}
+
+// response is a line read from a plugin.
+type response struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// Plugin is an external executable answering requests one at a time. It is
+// started on the first call, and again on the next call after it exits.
+type Plugin struct {
+	command string
+	// wasm is the module of a wasm: plugin, run in place of a process.
+	wasm *wasmModule
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+	nextID int
+}
+
+// New returns the plugin run by command, a program and its arguments
+// separated by spaces, or wasm:<path> for a WebAssembly module.
+func New(command string) (*Plugin, error) {
+	if len(strings.Fields(command)) == 0 {
+		return nil, errors.New("empty plugin command")
+	}
+	if path, ok := strings.CutPrefix(command, wasmPrefix); ok {
+		return &Plugin{command: command, wasm: &wasmModule{path: strings.TrimSpace(path)}}, nil
+	}
+	return &Plugin{command: command}, nil
+}
+
+// Name returns the program of the plugin, or the file name of its module.
+func (p *Plugin) Name() string {
+	if p.wasm != nil {
+		return filepath.Base(p.wasm.path)
+	}
+	return strings.Fields(p.command)[0]
+}
+
+// Sandboxed reports whether the plugin is a WebAssembly module rather than
+// a process.
+func (p *Plugin) Sandboxed() bool {
+	return p.wasm != nil
+}
+
+// Call sends method and params to the plugin and decodes its result into
+// result. Calls are serialized.
+func (p *Plugin) Call(ctx context.Context, method string, params, result any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nextID++
+	req := request{ID: p.nextID, Method: method, Params: params}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("plugin %s: %w", p.Name(), err)
+	}
+	var line []byte
+	if p.wasm != nil {
+		line, err = p.wasm.call(ctx, b)
+	} else {
+		line, err = p.exchange(ctx, b)
+	}
+	if err != nil {
+		return err
+	}
+	var resp response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		p.stop()
+		return fmt.Errorf("plugin %s failed: %w", p.Name(), err)
+	}
+
+	if resp.ID != req.ID {
+		p.stop()
+		return fmt.Errorf("plugin %s answered request %d to request %d", p.Name(), resp.ID, req.ID)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("plugin %s: %s", p.Name(), resp.Error)
+	}
+	if result != nil {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("plugin %s returned an invalid %s result: %w", p.Name(), method, err)
+		}
+	}
+	return nil
+}
+
+// exchange writes the request line b to the plugin process, starting it if
+// needed, and reads the line it answers.
+func (p *Plugin) exchange(ctx context.Context, b []byte) ([]byte, error) {
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	// A plugin that doesn't answer in time is killed, since its next
+	// answer would be late for the next call
+	done := make(chan error, 1)
+	go func() {
+		if _, err := p.stdin.Write(append(b, '\n')); err != nil {
+			done <- err
+			return
+		}
+		if !p.stdout.Scan() {
+			err := p.stdout.Err()
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			done <- err
+			return
+		}
+		done <- nil
+	}()
+	select {
+	case <-ctx.Done():
+		p.stop()
+		<-done
+		return nil, fmt.Errorf("plugin %s: %w", p.Name(), ctx.Err())
+	case err := <-done:
+		if err != nil {
+			p.stop()
+			return nil, fmt.Errorf("plugin %s failed: %w", p.Name(), err)
+		}
+	}
+	return p.stdout.Bytes(), nil
+}
+
+// Close stops the plugin, closing its stdin first.
+func (p *Plugin) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.wasm != nil {
+		return p.wasm.close()
+	}
+	if p.cmd == nil {
+		return nil
+	}
+	p.stdin.Close()
+	err := p.cmd.Wait()
+	p.cmd = nil
+	return err
+}
+
+// start launches the plugin process.
+func (p *Plugin) start() error {
+	args := strings.Fields(p.command)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("plugin %s: %w", p.Name(), err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("plugin %s: %w", p.Name(), err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start plugin %s: %w", p.Name(), err)
+	}
+	p.cmd, p.stdin = cmd, stdin
+	p.stdout = bufio.NewScanner(stdout)
+	p.stdout.Buffer(make([]byte, 0, 64<<10), maxLine)
+	return nil
+}
+
+// stop kills the plugin, to be started again by the next call.
+func (p *Plugin) stop() {
+	if p.cmd == nil {
+		return
+	}
+	p.cmd.Process.Kill()
+	p.stdin.Close()
+	p.cmd.Wait()
+	p.cmd = nil
+}
@@ -0,0 +1,129 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// wasmPrefix marks a plugin command naming a WebAssembly module.
+const wasmPrefix = "wasm:"
+
+// wasmMemoryPages bounds the memory of a module instance, in 64 KiB pages.
+const wasmMemoryPages = 1024
+
+// wasmTimeout bounds a call to a module when its context has no deadline,
+// so that a module stuck in a loop can't hold a worker forever.
+const wasmTimeout = time.Minute
+
+// wasmModule is a WASI module compiled on its first call, of which every
+// call runs a fresh instance.
+type wasmModule struct {
+	path string
+
+	once     sync.Once
+	err      error
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+// load compiles the module, once.
+func (m *wasmModule) load() error {
+	m.once.Do(func() {
+		ctx := context.Background()
+		b, err := os.ReadFile(m.path)
+		if err != nil {
+			m.err = fmt.Errorf("failed to read plugin module: %w", err)
+			return
+		}
+		// Closing instances when the context is done is what lets a call
+		// time out a module stuck in a loop
+		config := wazero.NewRuntimeConfig().
+			WithMemoryLimitPages(wasmMemoryPages).
+			WithCloseOnContextDone(true)
+		// Compiling takes seconds, so the machine code is kept across runs
+		if dir, err := os.UserCacheDir(); err == nil {
+			if cache, err := wazero.NewCompilationCacheWithDir(filepath.Join(dir, "codectx", "wasm")); err == nil {
+				config = config.WithCompilationCache(cache)
+			}
+		}
+		m.runtime = wazero.NewRuntimeWithConfig(ctx, config)
+		wasi_snapshot_preview1.MustInstantiate(ctx, m.runtime)
+		if m.compiled, m.err = m.runtime.CompileModule(ctx, b); m.err != nil {
+			m.err = fmt.Errorf("failed to compile plugin module %s: %w", m.path, m.err)
+		}
+	})
+	return m.err
+}
+
+// call runs an instance of the module on the request line b and returns the
+// first line it writes.
+func (m *wasmModule) call(ctx context.Context, b []byte) ([]byte, error) {
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wasmTimeout)
+		defer cancel()
+	}
+	stdout := &limitedBuffer{max: maxLine}
+	// WithName("") lets instances run concurrently with others of the
+	// same runtime. There are no mounts, environment or host clock
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithStdin(bytes.NewReader(append(b, '\n'))).
+		WithStdout(stdout).
+		WithStderr(os.Stderr)
+	mod, err := m.runtime.InstantiateModule(ctx, m.compiled, config)
+	if mod != nil {
+		mod.Close(ctx)
+	}
+	var exit *sys.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 0 {
+		err = nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("plugin module %s failed: %w", m.path, err)
+	}
+	line, _, _ := bytes.Cut(stdout.Bytes(), []byte("\n"))
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil, fmt.Errorf("plugin module %s failed: %w", m.path, io.ErrUnexpectedEOF)
+	}
+	return line, nil
+}
+
+// close releases the runtime of the module.
+func (m *wasmModule) close() error {
+	if m.runtime == nil {
+		return nil
+	}
+	return m.runtime.Close(context.Background())
+}
+
+// limitedBuffer is a buffer failing writes past max bytes, so that a module
+// can't grow our memory with its output.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		return 0, errors.New("plugin output too large")
+	}
+	return b.Buffer.Write(p)
+}
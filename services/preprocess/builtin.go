@@ -0,0 +1,50 @@
+package preprocess
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// privateKey matches PEM private key blocks.
+	privateKey = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)
+	// tokens match the keys and tokens of well-known services.
+	tokens = regexp.MustCompile(`\b(?:AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{40,}|xox[abposr]-[A-Za-z0-9-]{10,}|sk-[A-Za-z0-9_-]{20,}|AIza[0-9A-Za-z_-]{35})\b`)
+	// assignments match string literals assigned to names of secrets, as
+	// in password = "hunter22".
+	assignments = regexp.MustCompile(`(?i)\b(\w*(?:password|passwd|secret|api[_-]?key|access[_-]?key|token)\w*["']?)(\s*[:=]\s*)(["'])[^\s"']{8,}(["'])`)
+)
+
+// Redact replaces private keys, the tokens of well-known services and the
+// strings assigned to names of secrets with <redacted>, so that they aren't
+// sent to the embedding provider.
+func Redact(text string) string {
+	text = privateKey.ReplaceAllString(text, "<redacted>")
+	text = tokens.ReplaceAllString(text, "<redacted>")
+	return assignments.ReplaceAllString(text, "$1$2$3<redacted>$4")
+}
+
+// protobufAccessor matches the first line of the getters protoc-gen-go
+// writes for every field.
+var protobufAccessor = regexp.MustCompile(`^func \(x \*\w+\) Get\w+\(\) `)
+
+// StripProtobufAccessors removes the field getters of Go protobuf code, which
+// repeat the fields of every message.
+func StripProtobufAccessors(text string) string {
+	lines := strings.SplitAfter(text, "\n")
+	out := lines[:0]
+	skipping := false
+	for _, line := range lines {
+		switch {
+		case skipping:
+			if strings.TrimRight(line, "\r\n") == "}" {
+				skipping = false
+			}
+		case protobufAccessor.MatchString(line):
+			skipping = !strings.HasSuffix(strings.TrimRight(line, "\r\n"), "}")
+		default:
+			out = append(out, line)
+		}
+	}
+	return strings.Join(out, "")
+}
@@ -0,0 +1,151 @@
+// Package preprocess rewrites the text of files before it is embedded,
+// through pipelines of steps configured per file type. Built-in steps
+// redact secrets and normalize text; programs embedding codectx register
+// their own with Register.
+package preprocess
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	normalize "github.com/codectx/tokens/services/normalize"
+)
+
+// Preprocessor is a step of a pipeline.
+type Preprocessor interface {
+	// Process returns text, of the file at path, rewritten for embedding.
+	Process(path, text string) (string, error)
+}
+
+// Func adapts a function to a Preprocessor.
+type Func func(path, text string) (string, error)
+
+// Process calls f.
+func (f Func) Process(path, text string) (string, error) { return f(path, text) }
+
+// text adapts a function that can't fail to a Preprocessor.
+func text(fn func(string) string) Preprocessor {
+	return Func(func(_, text string) (string, error) { return fn(text), nil })
+}
+
+var (
+	mu    sync.RWMutex
+	steps = map[string]Preprocessor{
+		"redact":             text(Redact),
+		normalize.License:    text(normalize.StripLicense),
+		normalize.Literals:   text(normalize.StripLiterals),
+		normalize.Whitespace: text(normalize.CollapseWhitespace),
+		"protobuf-accessors": text(StripProtobufAccessors),
+	}
+)
+
+// Register adds a step under name, replacing any step of that name.
+func Register(name string, p Preprocessor) {
+	mu.Lock()
+	defer mu.Unlock()
+	steps[name] = p
+}
+
+// Names lists the registered steps, sorted.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(steps))
+	for n := range steps {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup returns the step registered under name.
+func lookup(name string) (Preprocessor, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	p, ok := steps[name]
+	return p, ok
+}
+
+// rule applies steps to the files matching pattern.
+type rule struct {
+	pattern string
+	steps   []Preprocessor
+}
+
+// match reports whether the rule applies to the file at path, detected as
+// language. Patterns are globs of file names, such as *.pb.go, or
+// lang:<language>.
+func (r rule) match(p, language string) bool {
+	if lang, ok := strings.CutPrefix(r.pattern, "lang:"); ok {
+		return lang == language
+	}
+	ok, _ := path.Match(r.pattern, path.Base(p))
+	return ok
+}
+
+// Pipeline runs the steps of the first rule matching a file, in order.
+type Pipeline struct {
+	rules []rule
+}
+
+// Parse returns the pipeline of spec, comma-separated rules of a pattern,
+// =, and the names of steps joined by +, as in
+// `*.pb.go=redact+protobuf-accessors,*=redact+whitespace`. Files matching no
+// rule are embedded as they are.
+func Parse(spec string) (*Pipeline, error) {
+	p := &Pipeline{}
+	for _, r := range strings.Split(spec, ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		pattern, list, ok := strings.Cut(r, "=")
+		if !ok || strings.TrimSpace(pattern) == "" {
+			return nil, fmt.Errorf("invalid rule %q: use PATTERN=STEP+STEP", r)
+		}
+		ru := rule{pattern: strings.TrimSpace(pattern)}
+		if _, err := path.Match(ru.pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", ru.pattern, err)
+		}
+		for _, name := range strings.Split(list, "+") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			step, ok := lookup(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown step %q: use one of %s", name, strings.Join(Names(), ", "))
+			}
+			ru.steps = append(ru.steps, step)
+		}
+		p.rules = append(p.rules, ru)
+	}
+	return p, nil
+}
+
+// Process runs the steps of the first rule matching the file at path,
+// detected as language, on text. Text left empty by the steps is returned
+// unchanged, so that the file is still embedded.
+func (p *Pipeline) Process(path, language, text string) (string, error) {
+	if p == nil {
+		return text, nil
+	}
+	for _, r := range p.rules {
+		if !r.match(path, language) {
+			continue
+		}
+		out := text
+		for _, step := range r.steps {
+			var err error
+			if out, err = step.Process(path, out); err != nil {
+				return "", err
+			}
+		}
+		if strings.TrimSpace(out) == "" {
+			return text, nil
+		}
+		return out, nil
+	}
+	return text, nil
+}
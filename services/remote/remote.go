@@ -0,0 +1,233 @@
+// Package remote copies the index database to and from shared storage, so
+// that a team can search a centrally built index.
+package remote
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// RemoteService defines the interface for a remote copy of the index.
+type RemoteService interface {
+	// Push uploads the file at path.
+	Push(ctx context.Context, path string) error
+	// Pull downloads the remote copy to path.
+	Pull(ctx context.Context, path string) error
+	// URL returns where the remote copy is stored, redacted so that it can
+	// be logged.
+	URL() string
+}
+
+// NewRemoteService returns the RemoteService of rawURL. s3:// and gs://
+// URLs are copied with the aws and gcloud command lines, using their
+// configured credentials; http(s):// URLs, e.g. presigned ones, with PUT
+// and GET.
+func NewRemoteService(rawURL string) (RemoteService, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid remote %q", rawURL)
+	}
+	switch u.Scheme {
+	case "s3":
+		return &cliRemote{url: rawURL, bin: "aws", args: []string{"s3", "cp", "--only-show-errors"}}, nil
+	case "gs":
+		return &cliRemote{url: rawURL, bin: "gcloud", args: []string{"storage", "cp"}}, nil
+	case "http", "https":
+		return &httpRemote{url: rawURL, client: &http.Client{Timeout: 10 * time.Minute}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported remote %q: use s3://, gs:// or http(s)://", rawURL)
+	}
+}
+
+// CachePath returns where the local copy of the remote at rawURL is kept.
+// The query string is left out, so that every signature of a presigned URL
+// shares the same copy.
+func CachePath(rawURL string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	key := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		u.RawQuery, u.Fragment = "", ""
+		key = u.String()
+	}
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(dir, "codectx", hex.EncodeToString(sum[:8])+".db"), nil
+}
+
+// Redact returns rawURL with its userinfo and query string, which signs
+// presigned URLs, replaced by REDACTED, so that it can be logged.
+func Redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	return u.String()
+}
+
+// redacted returns err with the URL of the request that failed redacted, as
+// the http client puts it in its errors.
+func redacted(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		ue.URL = Redact(ue.URL)
+	}
+	return err
+}
+
+// Cached returns the path of a local copy of r, pulling it first when it is
+// missing or older than ttl. A stale copy is kept when the pull fails, so
+// that searches keep working offline; onStale is then called with the error.
+func Cached(ctx context.Context, r RemoteService, ttl time.Duration, onStale func(error)) (string, error) {
+	path, err := CachePath(r.URL())
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(path)
+	if err == nil && time.Since(fi.ModTime()) < ttl {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	if err := pull(ctx, r, path); err != nil {
+		if fi == nil {
+			return "", fmt.Errorf("failed to pull %s: %w", r.URL(), err)
+		}
+		if onStale != nil {
+			onStale(err)
+		}
+	}
+	return path, nil
+}
+
+// pull downloads r next to path, then moves it in place so that a failed
+// download never leaves a truncated database behind.
+func pull(ctx context.Context, r RemoteService, path string) error {
+	tmp := path + ".pull"
+	defer os.Remove(tmp)
+	if err := r.Pull(ctx, tmp); err != nil {
+		return err
+	}
+	// the write-ahead log of the previous copy belongs to it
+	os.Remove(path + ".wal")
+	return os.Rename(tmp, path)
+}
+
+// cliRemote copies files with a cloud provider command line.
+type cliRemote struct {
+	url  string
+	bin  string
+	args []string
+}
+
+// Push uploads the file at path.
+func (r *cliRemote) Push(ctx context.Context, path string) error {
+	return r.cp(ctx, path, r.url)
+}
+
+// Pull downloads the remote copy to path.
+func (r *cliRemote) Pull(ctx context.Context, path string) error {
+	return r.cp(ctx, r.url, path)
+}
+
+// URL returns where the remote copy is stored, redacted.
+func (r *cliRemote) URL() string {
+	return Redact(r.url)
+}
+
+// cp runs the copy command from src to dst.
+func (r *cliRemote) cp(ctx context.Context, src, dst string) error {
+	if _, err := exec.LookPath(r.bin); err != nil {
+		return fmt.Errorf("%s is required for %s: %w", r.bin, r.URL(), err)
+	}
+	out, err := exec.CommandContext(ctx, r.bin, append(r.args, src, dst)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s cp failed: %w: %s", r.bin, err, out)
+	}
+	return nil
+}
+
+// httpRemote copies files with plain HTTP requests.
+type httpRemote struct {
+	url    string
+	client *http.Client
+}
+
+// Push uploads the file at path.
+func (r *httpRemote) Push(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, r.url, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload failed: %w", redacted(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("upload failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// Pull downloads the remote copy to path.
+func (r *httpRemote) Pull(ctx context.Context, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", redacted(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return fmt.Errorf("download failed: %w", err)
+	}
+	return f.Close()
+}
+
+// URL returns where the remote copy is stored, redacted.
+func (r *httpRemote) URL() string {
+	return Redact(r.url)
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package secrets
+
+import "errors"
+
+// errNoCredentials is returned by the Credential Manager outside Windows.
+var errNoCredentials = errors.New("the credential manager is only on windows")
+
+func credGet(name string) (string, error) { return "", errNoCredentials }
+func credStore(name, value string) error  { return errNoCredentials }
+func credRemove(name string) error        { return errNoCredentials }
@@ -0,0 +1,154 @@
+// Package secrets keeps API keys in the OS keyring, or reads them from a
+// password manager, so that they never sit in environment variables or plain
+// files.
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// service is the keyring service every secret is stored under, with the
+// provider name as account.
+const service = "codectx"
+
+// Reference prefixes of secrets read from a password manager.
+const (
+	onePasswordPrefix = "op://"
+	passPrefix        = "pass:"
+)
+
+// ErrNotFound is returned when no secret is stored under a name.
+var ErrNotFound = errors.New("secret not found")
+
+// Lookup returns the secret stored under name in the keyring. A stored
+// reference to a password manager entry, as recorded by Store with such a
+// value, is resolved with the manager's CLI.
+func Lookup(name string) (string, error) {
+	v, err := keyringGet(name)
+	if err != nil {
+		return "", err
+	}
+	if IsReference(v) {
+		return Resolve(v)
+	}
+	return v, nil
+}
+
+// Store saves value under name in the keyring, replacing any previous one.
+// value is either the secret itself or a reference such as
+// op://vault/item/field or pass:path/to/entry.
+func Store(name, value string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		// security reads the command on stdin so that the secret isn't in
+		// its arguments, which other users can list
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n", quote(service), quote(name), quote(value)))
+	case "windows":
+		return credStore(name, value)
+	case "linux", "freebsd", "openbsd":
+		cmd = exec.Command("secret-tool", "store", "--label", service+" "+name, "service", service, "account", name)
+		cmd.Stdin = strings.NewReader(value)
+	default:
+		return fmt.Errorf("keyring is not supported on %s", runtime.GOOS)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("keyring store failed: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// quote quotes s as a single argument of the interactive mode of security.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Remove deletes the secret stored under name from the keyring.
+func Remove(name string) error {
+	if _, err := keyringGet(name); err != nil {
+		return err
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "delete-generic-password", "-s", service, "-a", name)
+	case "windows":
+		return credRemove(name)
+	default:
+		cmd = exec.Command("secret-tool", "clear", "service", service, "account", name)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("keyring delete failed: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// Source describes where the secret stored under name comes from, for status
+// reports, without revealing it: "keyring" or the stored reference.
+func Source(name string) (string, error) {
+	v, err := keyringGet(name)
+	if err != nil {
+		return "", err
+	}
+	if IsReference(v) {
+		return v, nil
+	}
+	return "keyring", nil
+}
+
+// IsReference reports whether v points to a password manager entry rather
+// than being a secret.
+func IsReference(v string) bool {
+	return strings.HasPrefix(v, onePasswordPrefix) || strings.HasPrefix(v, passPrefix)
+}
+
+// Resolve reads the secret a reference points to: op://vault/item/field with
+// the 1Password CLI, pass:path/to/entry from the first line of a pass entry.
+func Resolve(ref string) (string, error) {
+	var cmd *exec.Cmd
+	switch {
+	case strings.HasPrefix(ref, onePasswordPrefix):
+		cmd = exec.Command("op", "read", "--no-newline", ref)
+	case strings.HasPrefix(ref, passPrefix):
+		cmd = exec.Command("pass", "show", strings.TrimPrefix(ref, passPrefix))
+	default:
+		return "", fmt.Errorf("unsupported secret reference %q: use op://vault/item/field or pass:path", ref)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", ref, err)
+	}
+	first, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(first), nil
+}
+
+// keyringGet reads the raw value stored under name, ErrNotFound when there is
+// none or the keyring can't be reached.
+func keyringGet(name string) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", name, "-w")
+	case "windows":
+		return credGet(name)
+	case "linux", "freebsd", "openbsd":
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", name)
+	default:
+		return "", fmt.Errorf("keyring is not supported on %s", runtime.GOOS)
+	}
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", fmt.Errorf("%w: keyring tool %s is not installed", ErrNotFound, cmd.Path)
+	}
+	v := strings.TrimSpace(string(out))
+	if err != nil || v == "" {
+		return "", fmt.Errorf("%w: %s in the keyring", ErrNotFound, name)
+	}
+	return v, nil
+}
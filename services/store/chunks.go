@@ -0,0 +1,230 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Chunk is the embedded chunk of a file, a top-level declaration or a
+// piece of one.
+type Chunk struct {
+	// ID is the chunk id, path#symbol@hash, which changes with its content.
+	ID   string
+	File string
+	// StartLine and EndLine are 1-based and inclusive.
+	StartLine int
+	EndLine   int
+	Vector    []float32
+}
+
+// createChunks creates the chunks table of the namespace. It has no primary
+// key: DuckDB rejects deleting and re-inserting the same key within a
+// transaction.
+func (s *storageService) createChunks() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        file TEXT,
+        id TEXT,
+        start_line INTEGER,
+        end_line INTEGER,
+        embedding BLOB
+    )
+    `, s.chunks))
+	return err
+}
+
+// ReplaceChunks replaces the chunks of file, removing them when chunks is
+// empty.
+func (s *storageService) ReplaceChunks(ctx context.Context, file string, chunks []Chunk) error {
+	defer s.changed()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("ReplaceChunks failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+s.chunks+" WHERE file = ?;", file); err != nil {
+		return fmt.Errorf("ReplaceChunks failed: %w", err)
+	}
+	for _, c := range chunks {
+		vec, err := s.seal(c.ID, float32SliceToBytes(c.Vector))
+		if err != nil {
+			return fmt.Errorf("ReplaceChunks failed: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+s.chunks+" (file, id, start_line, end_line, embedding) VALUES (?, ?, ?, ?, ?);",
+			file, c.ID, c.StartLine, c.EndLine, vec); err != nil {
+			return fmt.Errorf("ReplaceChunks failed: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ReplaceChunks failed: %w", err)
+	}
+	return nil
+}
+
+// Chunks fetches every stored chunk, by file then line.
+func (s *storageService) Chunks(ctx context.Context) ([]Chunk, error) {
+	// Not bounded by the query timeout, like GetAll.
+	rows, err := s.db.QueryContext(ctx, "SELECT file, id, start_line, end_line, embedding FROM "+s.chunks+" ORDER BY file, start_line;")
+	if err != nil {
+		return nil, fmt.Errorf("Chunks failed: %w", err)
+	}
+	return s.scanChunks(rows)
+}
+
+// FileChunks fetches the stored chunks of file, by line.
+func (s *storageService) FileChunks(ctx context.Context, file string) ([]Chunk, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT file, id, start_line, end_line, embedding FROM "+s.chunks+" WHERE file = ? ORDER BY start_line;", file)
+	if err != nil {
+		return nil, fmt.Errorf("FileChunks failed: %w", err)
+	}
+	return s.scanChunks(rows)
+}
+
+// scanChunks reads and closes rows of file, id, start_line, end_line and
+// embedding.
+func (s *storageService) scanChunks(rows *sql.Rows) ([]Chunk, error) {
+	defer rows.Close()
+
+	var out []Chunk
+	for rows.Next() {
+		var (
+			c   Chunk
+			vec []byte
+			err error
+		)
+		if err = rows.Scan(&c.File, &c.ID, &c.StartLine, &c.EndLine, &vec); err != nil {
+			return nil, fmt.Errorf("Chunks scan failed: %w", err)
+		}
+		if vec, err = s.open(c.ID, vec); err != nil {
+			return nil, fmt.Errorf("Chunks failed: %w", err)
+		}
+		c.Vector = bytesToFloat32Slice(vec)
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// ChunkHash is a chunk a file was split into when it was last indexed.
+type ChunkHash struct {
+	File string
+	// Key names the chunk within its file: its symbol, suffixed with ~n for
+	// the nth chunk of the same symbol.
+	Key  string
+	Hash string
+	// StartLine and EndLine are 1-based and inclusive.
+	StartLine int
+	EndLine   int
+	// Author is the dominant git blame author of the lines of the chunk,
+	// and LastCommit the last commit that modified them, when blame was
+	// enabled.
+	Author     string
+	LastCommit string
+}
+
+// createChunkHashes creates the chunk_hashes table of the namespace. Like
+// chunks, it has no primary key.
+func (s *storageService) createChunkHashes() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        file TEXT,
+        key TEXT,
+        hash TEXT,
+        start_line INTEGER,
+        end_line INTEGER
+    )
+    `, s.chunkHashes))
+	if err != nil {
+		return err
+	}
+	// Add the blame columns to tables created before them
+	for _, col := range []string{"author", "last_commit"} {
+		if _, err := s.db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s TEXT DEFAULT ''`, s.chunkHashes, col)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChunkHashes fetches the chunks file was split into, by line.
+func (s *storageService) ChunkHashes(ctx context.Context, file string) ([]ChunkHash, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT key, hash, start_line, end_line, author, last_commit FROM "+s.chunkHashes+" WHERE file = ? ORDER BY start_line;", file)
+	if err != nil {
+		return nil, fmt.Errorf("ChunkHashes failed: %w", err)
+	}
+	defer rows.Close()
+
+	var out []ChunkHash
+	for rows.Next() {
+		h := ChunkHash{File: file}
+		if err := rows.Scan(&h.Key, &h.Hash, &h.StartLine, &h.EndLine, &h.Author, &h.LastCommit); err != nil {
+			return nil, fmt.Errorf("ChunkHashes scan failed: %w", err)
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+// UpdateChunkHashes removes the chunks of file under the keys of remove,
+// then inserts add, leaving the other chunks of the file untouched.
+func (s *storageService) UpdateChunkHashes(ctx context.Context, file string, remove []string, add []ChunkHash) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("UpdateChunkHashes failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, key := range remove {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+s.chunkHashes+" WHERE file = ? AND key = ?;", file, key); err != nil {
+			return fmt.Errorf("UpdateChunkHashes failed: %w", err)
+		}
+	}
+	for _, h := range add {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+s.chunkHashes+" (file, key, hash, start_line, end_line, author, last_commit) VALUES (?, ?, ?, ?, ?, ?, ?);",
+			file, h.Key, h.Hash, h.StartLine, h.EndLine, h.Author, h.LastCommit); err != nil {
+			return fmt.Errorf("UpdateChunkHashes failed: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("UpdateChunkHashes failed: %w", err)
+	}
+	return nil
+}
+
+// UpdateChunks removes the chunks of file with the ids of remove, then
+// inserts add, leaving the other chunks of the file untouched.
+func (s *storageService) UpdateChunks(ctx context.Context, file string, remove []string, add []Chunk) error {
+	defer s.changed()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("UpdateChunks failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, id := range remove {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+s.chunks+" WHERE file = ? AND id = ?;", file, id); err != nil {
+			return fmt.Errorf("UpdateChunks failed: %w", err)
+		}
+	}
+	for _, c := range add {
+		vec, err := s.seal(c.ID, float32SliceToBytes(c.Vector))
+		if err != nil {
+			return fmt.Errorf("UpdateChunks failed: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+s.chunks+" (file, id, start_line, end_line, embedding) VALUES (?, ?, ?, ?, ?);",
+			file, c.ID, c.StartLine, c.EndLine, vec); err != nil {
+			return fmt.Errorf("UpdateChunks failed: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("UpdateChunks failed: %w", err)
+	}
+	return nil
+}
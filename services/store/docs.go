@@ -0,0 +1,100 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// createDocs creates the docs table of the namespace, holding the vectors
+// of the comments of files embedded apart from their code.
+func (s *storageService) createDocs() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        file TEXT PRIMARY KEY,
+        hash TEXT,
+        embedding BLOB
+    )
+    `, s.docs))
+	return err
+}
+
+// UpsertDoc stores the vector of the comments of file, read from comments
+// of the given hash.
+func (s *storageService) UpsertDoc(ctx context.Context, file, hash string, vector []float32) error {
+	defer s.changed()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	vec, err := s.seal(file, float32SliceToBytes(vector))
+	if err != nil {
+		return fmt.Errorf("UpsertDoc failed: %w", err)
+	}
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO "+s.docs+" (file, hash, embedding) VALUES (?, ?, ?) ON CONFLICT(file) DO UPDATE SET hash = excluded.hash, embedding = excluded.embedding;",
+		file, hash, vec); err != nil {
+		return fmt.Errorf("UpsertDoc failed: %w", err)
+	}
+	return nil
+}
+
+// MatchDoc reports whether the comments of file were embedded from comments
+// of the given hash.
+func (s *storageService) MatchDoc(ctx context.Context, file, hash string) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var n int
+	if err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM "+s.docs+" WHERE file = ? AND hash = ?;", file, hash).Scan(&n); err != nil {
+		return false, fmt.Errorf("MatchDoc query failed: %w", err)
+	}
+	return n > 0, nil
+}
+
+// DeleteDoc removes the vector of the comments of file.
+func (s *storageService) DeleteDoc(ctx context.Context, file string) error {
+	defer s.changed()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM "+s.docs+" WHERE file = ?;", file); err != nil {
+		return fmt.Errorf("DeleteDoc failed: %w", err)
+	}
+	return nil
+}
+
+// Docs fetches the vectors of the comments of files, of every file when
+// files is empty.
+func (s *storageService) Docs(ctx context.Context, files ...string) (map[string][]float32, error) {
+	// Not bounded by the query timeout when reading every file, like GetAll.
+	query, params := "SELECT file, embedding FROM "+s.docs, make([]any, len(files))
+	if len(files) > 0 {
+		var cancel func()
+		ctx, cancel = s.withTimeout(ctx)
+		defer cancel()
+		query += " WHERE file IN (?" + strings.Repeat(", ?", len(files)-1) + ")"
+		for i, f := range files {
+			params[i] = f
+		}
+	}
+	rows, err := s.db.QueryContext(ctx, query+";", params...)
+	if err != nil {
+		return nil, fmt.Errorf("Docs failed: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[string][]float32{}
+	for rows.Next() {
+		var (
+			file string
+			vec  []byte
+		)
+		if err := rows.Scan(&file, &vec); err != nil {
+			return nil, fmt.Errorf("Docs scan failed: %w", err)
+		}
+		if vec, err = s.open(file, vec); err != nil {
+			return nil, fmt.Errorf("Docs failed: %w", err)
+		}
+		out[file] = bytesToFloat32Slice(vec)
+	}
+	return out, rows.Err()
+}
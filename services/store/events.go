@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// IndexEvent is something indexing did to a file: embedding it, skipping
+// it or failing to embed it.
+type IndexEvent struct {
+	ID string
+	// Time is when it happened, now when recorded without one.
+	Time time.Time
+	// Action is what happened, such as embedded, skipped or failed.
+	Action string
+	// Duration is how long handling the file took.
+	Duration time.Duration
+	// Tokens are those the provider reported embedding.
+	Tokens int
+	// Provider is the provider and model embedding the file, empty when
+	// nothing was embedded.
+	Provider string
+	// Hash is the hash of the content handled.
+	Hash string
+	// Detail is the reason of a skip or the error of a failure.
+	Detail string
+}
+
+// createEvents creates the index_events table of the namespace.
+func (s *storageService) createEvents() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        id TEXT,
+        at TIMESTAMP,
+        action TEXT,
+        duration_ms BIGINT,
+        tokens INTEGER,
+        provider TEXT,
+        hash TEXT,
+        detail TEXT
+    )
+    `, s.events))
+	return err
+}
+
+// EventsKept is how many of the latest events of a file are kept.
+const EventsKept = 50
+
+// RecordEvent appends e to the history of its file, unless the last event
+// of the file has the same action, hash and detail, such as a skip of the
+// same content on every pass. Events beyond the latest EventsKept of the
+// file are dropped.
+func (s *storageService) RecordEvent(ctx context.Context, e IndexEvent) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("RecordEvent failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	var action, hash, detail string
+	err = tx.QueryRowContext(ctx, "SELECT action, hash, detail FROM "+s.events+" WHERE id = ? ORDER BY at DESC, rowid DESC LIMIT 1;", e.ID).Scan(&action, &hash, &detail)
+	switch {
+	case err == nil && action == e.Action && hash == e.Hash && detail == e.Detail:
+		return nil
+	case err != nil && !errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("RecordEvent failed: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO `+s.events+` (id, at, action, duration_ms, tokens, provider, hash, detail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?);`,
+		e.ID, e.Time.UTC(), e.Action, e.Duration.Milliseconds(), e.Tokens, e.Provider, e.Hash, e.Detail); err != nil {
+		return fmt.Errorf("RecordEvent failed: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+s.events+" WHERE id = ? AND rowid NOT IN (SELECT rowid FROM "+s.events+" WHERE id = ? ORDER BY at DESC, rowid DESC LIMIT ?);",
+		e.ID, e.ID, EventsKept); err != nil {
+		return fmt.Errorf("RecordEvent failed: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("RecordEvent failed: %w", err)
+	}
+	return nil
+}
+
+// Events lists the last limit events of the file id, newest first, all of
+// them when limit is 0.
+func (s *storageService) Events(ctx context.Context, id string, limit int) ([]IndexEvent, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := "SELECT id, at, action, duration_ms, tokens, provider, hash, detail FROM " + s.events + " WHERE id = ? ORDER BY at DESC, rowid DESC"
+	params := []any{id}
+	if limit > 0 {
+		query += " LIMIT ?"
+		params = append(params, limit)
+	}
+	rows, err := s.db.QueryContext(ctx, query+";", params...)
+	if err != nil {
+		return nil, fmt.Errorf("Events failed: %w", err)
+	}
+	defer rows.Close()
+
+	var out []IndexEvent
+	for rows.Next() {
+		var (
+			e  IndexEvent
+			ms int64
+		)
+		if err := rows.Scan(&e.ID, &e.Time, &e.Action, &ms, &e.Tokens, &e.Provider, &e.Hash, &e.Detail); err != nil {
+			return nil, fmt.Errorf("Events scan failed: %w", err)
+		}
+		e.Duration = time.Duration(ms) * time.Millisecond
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Judgment is the net feedback given to a result of a logged query.
+type Judgment struct {
+	QueryID string
+	Query   string
+	ID      string
+	// Votes is the number of good judgments minus the bad ones.
+	Votes int
+}
+
+// createFeedback creates the query_log and feedback tables of the namespace.
+// feedback has no primary key: every judgment is kept and votes are summed.
+func (s *storageService) createFeedback() error {
+	if _, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        id TEXT PRIMARY KEY,
+        query TEXT,
+        last_run TIMESTAMP DEFAULT current_timestamp
+    )
+    `, s.queries)); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        query_id TEXT,
+        id TEXT,
+        vote INTEGER,
+        created_at TIMESTAMP DEFAULT current_timestamp
+    )
+    `, s.feedback))
+	return err
+}
+
+// LogQuery records that query was searched under id, so that feedback can
+// refer to it later.
+func (s *storageService) LogQuery(ctx context.Context, id, query string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO `+s.queries+` (id, query) VALUES (?, ?)
+		ON CONFLICT(id) DO UPDATE SET last_run = now();`, id, query)
+	if err != nil {
+		return fmt.Errorf("LogQuery failed: %w", err)
+	}
+	return nil
+}
+
+// LoggedQuery returns the query logged under id, and false if there is none.
+func (s *storageService) LoggedQuery(ctx context.Context, id string) (string, bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var query string
+	err := s.db.QueryRowContext(ctx, "SELECT query FROM "+s.queries+" WHERE id = ?;", id).Scan(&query)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("LoggedQuery failed: %w", err)
+	}
+	return query, true, nil
+}
+
+// RecordFeedback records whether id was a good result of the logged query.
+func (s *storageService) RecordFeedback(ctx context.Context, queryID, id string, good bool) error {
+	defer s.changed()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	vote := -1
+	if good {
+		vote = 1
+	}
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO "+s.feedback+" (query_id, id, vote) VALUES (?, ?, ?);", queryID, id, vote); err != nil {
+		return fmt.Errorf("RecordFeedback failed: %w", err)
+	}
+	return nil
+}
+
+// Votes returns the net votes per result of the logged query.
+func (s *storageService) Votes(ctx context.Context, queryID string) (map[string]int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id, sum(vote) FROM "+s.feedback+" WHERE query_id = ? GROUP BY id;", queryID)
+	if err != nil {
+		return nil, fmt.Errorf("Votes failed: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[string]int{}
+	for rows.Next() {
+		var (
+			id    string
+			votes int
+		)
+		if err := rows.Scan(&id, &votes); err != nil {
+			return nil, fmt.Errorf("Votes scan failed: %w", err)
+		}
+		out[id] = votes
+	}
+	return out, rows.Err()
+}
+
+// Judgments lists the net votes of every judged result, by query then result.
+func (s *storageService) Judgments(ctx context.Context) ([]Judgment, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT f.query_id, q.query, f.id, sum(f.vote) FROM `+s.feedback+` f
+		JOIN `+s.queries+` q ON q.id = f.query_id GROUP BY f.query_id, q.query, f.id ORDER BY q.query, f.id;`)
+	if err != nil {
+		return nil, fmt.Errorf("Judgments failed: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Judgment
+	for rows.Next() {
+		var j Judgment
+		if err := rows.Scan(&j.QueryID, &j.Query, &j.ID, &j.Votes); err != nil {
+			return nil, fmt.Errorf("Judgments scan failed: %w", err)
+		}
+		out = append(out, j)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// JournalEntry is a file whose rows were being rewritten: its embedding,
+// chunks, symbols and comments may not all have been updated yet.
+type JournalEntry struct {
+	ID string
+	// Hash is the hash of the content being indexed.
+	Hash string
+	// Started is when the update began.
+	Started time.Time
+}
+
+// createJournal creates the journal table of the namespace.
+func (s *storageService) createJournal() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        id TEXT PRIMARY KEY,
+        hash TEXT,
+        started TIMESTAMP DEFAULT current_timestamp
+    )
+    `, s.journal))
+	return err
+}
+
+// BeginUpdate journals that the rows of id are about to be rewritten from
+// content of the given hash.
+func (s *storageService) BeginUpdate(ctx context.Context, id, hash string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// Started is set here rather than by the database, whose clock reads in
+	// its own time zone, so that it compares with the time of the process
+	_, err := s.db.ExecContext(ctx, `INSERT INTO `+s.journal+` (id, hash, started) VALUES (?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET hash = excluded.hash, started = excluded.started;`, id, hash, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("BeginUpdate failed: %w", err)
+	}
+	return nil
+}
+
+// EndUpdate removes id from the journal once all of its rows are written.
+func (s *storageService) EndUpdate(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM "+s.journal+" WHERE id = ?;", id); err != nil {
+		return fmt.Errorf("EndUpdate failed: %w", err)
+	}
+	return nil
+}
+
+// Unfinished lists the updates begun and never ended, oldest first.
+func (s *storageService) Unfinished(ctx context.Context) ([]JournalEntry, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, hash, started FROM "+s.journal+" ORDER BY started, id;")
+	if err != nil {
+		return nil, fmt.Errorf("Unfinished failed: %w", err)
+	}
+	defer rows.Close()
+
+	var out []JournalEntry
+	for rows.Next() {
+		var e JournalEntry
+		if err := rows.Scan(&e.ID, &e.Hash, &e.Started); err != nil {
+			return nil, fmt.Errorf("Unfinished scan failed: %w", err)
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
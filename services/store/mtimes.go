@@ -0,0 +1,56 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// createModTimes creates the mod_times table of the namespace.
+func (s *storageService) createModTimes() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        file TEXT PRIMARY KEY,
+        mtime TIMESTAMP
+    )
+    `, s.modTimes))
+	return err
+}
+
+// SetModTime records the modification time of file when it was last
+// indexed.
+func (s *storageService) SetModTime(ctx context.Context, file string, mtime time.Time) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO "+s.modTimes+" (file, mtime) VALUES (?, ?) ON CONFLICT(file) DO UPDATE SET mtime = excluded.mtime;",
+		file, mtime.UTC()); err != nil {
+		return fmt.Errorf("SetModTime failed: %w", err)
+	}
+	return nil
+}
+
+// ModTimes fetches the modification times recorded for every file.
+func (s *storageService) ModTimes(ctx context.Context) (map[string]time.Time, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT file, mtime FROM "+s.modTimes+";")
+	if err != nil {
+		return nil, fmt.Errorf("ModTimes failed: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[string]time.Time{}
+	for rows.Next() {
+		var (
+			file  string
+			mtime time.Time
+		)
+		if err := rows.Scan(&file, &mtime); err != nil {
+			return nil, fmt.Errorf("ModTimes scan failed: %w", err)
+		}
+		out[file] = mtime
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// createMultiVectors creates the multivectors table of the namespace,
+// holding the vectors of the segments of files for late interaction. Rows
+// are replaced per file, never updated.
+func (s *storageService) createMultiVectors() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        file TEXT,
+        hash TEXT,
+        pos INTEGER,
+        embedding BLOB
+    )
+    `, s.multiVectors))
+	return err
+}
+
+// ReplaceMultiVectors replaces the segment vectors of file, embedded from
+// text of the given hash, removing them when vectors is empty.
+func (s *storageService) ReplaceMultiVectors(ctx context.Context, file, hash string, vectors [][]float32) error {
+	defer s.changed()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("ReplaceMultiVectors failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+s.multiVectors+" WHERE file = ?;", file); err != nil {
+		return fmt.Errorf("ReplaceMultiVectors failed: %w", err)
+	}
+	for i, v := range vectors {
+		vec, err := s.seal(file, float32SliceToBytes(v))
+		if err != nil {
+			return fmt.Errorf("ReplaceMultiVectors failed: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO "+s.multiVectors+" (file, hash, pos, embedding) VALUES (?, ?, ?, ?);",
+			file, hash, i, vec); err != nil {
+			return fmt.Errorf("ReplaceMultiVectors failed: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ReplaceMultiVectors failed: %w", err)
+	}
+	return nil
+}
+
+// MatchMultiVectors reports whether the segment vectors of file were
+// embedded from text of the given hash.
+func (s *storageService) MatchMultiVectors(ctx context.Context, file, hash string) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var n int
+	if err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM "+s.multiVectors+" WHERE file = ? AND hash = ?;", file, hash).Scan(&n); err != nil {
+		return false, fmt.Errorf("MatchMultiVectors query failed: %w", err)
+	}
+	return n > 0, nil
+}
+
+// MultiVectors fetches the segment vectors of files, in order.
+func (s *storageService) MultiVectors(ctx context.Context, files ...string) (map[string][][]float32, error) {
+	out := map[string][][]float32{}
+	if len(files) == 0 {
+		return out, nil
+	}
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	params := make([]any, len(files))
+	for i, f := range files {
+		params[i] = f
+	}
+	rows, err := s.db.QueryContext(ctx, "SELECT file, embedding FROM "+s.multiVectors+" WHERE file IN (?"+strings.Repeat(", ?", len(files)-1)+") ORDER BY file, pos;", params...)
+	if err != nil {
+		return nil, fmt.Errorf("MultiVectors failed: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			file string
+			vec  []byte
+		)
+		if err := rows.Scan(&file, &vec); err != nil {
+			return nil, fmt.Errorf("MultiVectors scan failed: %w", err)
+		}
+		if vec, err = s.open(file, vec); err != nil {
+			return nil, fmt.Errorf("MultiVectors failed: %w", err)
+		}
+		out[file] = append(out[file], bytesToFloat32Slice(vec))
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// DropOrphans removes the chunks, symbols, comments, segments, sparse
+// vectors and file summaries of files without a row, as left behind by
+// deletes, and returns how many rows were removed. Modification times are kept: they are also recorded for
+// skipped files, so that -fresh doesn't read them again.
+func (s *storageService) DropOrphans(ctx context.Context) (int, error) {
+	defer s.changed()
+	defer s.dropPostings()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("DropOrphans failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	var removed int64
+	for _, q := range []string{
+		"DELETE FROM " + s.chunks + " WHERE file NOT IN (SELECT id FROM " + s.table + ");",
+		"DELETE FROM " + s.chunkHashes + " WHERE file NOT IN (SELECT id FROM " + s.table + ");",
+		"DELETE FROM " + s.symbols + " WHERE id NOT IN (SELECT id FROM " + s.table + ");",
+		"DELETE FROM " + s.symbolFiles + " WHERE id NOT IN (SELECT id FROM " + s.table + ");",
+		"DELETE FROM " + s.docs + " WHERE file NOT IN (SELECT id FROM " + s.table + ");",
+		"DELETE FROM " + s.multiVectors + " WHERE file NOT IN (SELECT id FROM " + s.table + ");",
+		"DELETE FROM " + s.sparse + " WHERE file NOT IN (SELECT id FROM " + s.table + ");",
+		"DELETE FROM " + s.summaries + " WHERE kind = '" + SummaryFile + "' AND id NOT IN (SELECT id FROM " + s.table + ");",
+	} {
+		res, err := tx.ExecContext(ctx, q)
+		if err != nil {
+			return 0, fmt.Errorf("DropOrphans failed: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("DropOrphans failed: %w", err)
+		}
+		removed += n
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("DropOrphans failed: %w", err)
+	}
+	return int(removed), nil
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SavedQuery is a named query re-run to track retrieval changes.
+type SavedQuery struct {
+	Name  string
+	Query string
+	K     int
+}
+
+// SavedResult is a result of the last run of a saved query.
+type SavedResult struct {
+	Rank  int
+	Path  string
+	Score float32
+}
+
+// QueryStore defines the interface for saved queries and their results.
+type QueryStore interface {
+	// Save creates or replaces a saved query.
+	Save(ctx context.Context, q SavedQuery) error
+	// List returns every saved query by name.
+	List(ctx context.Context) ([]SavedQuery, error)
+	// Remove deletes a saved query and its results.
+	Remove(ctx context.Context, name string) error
+	// Results returns the last results of a query against a namespace and
+	// when they were recorded.
+	Results(ctx context.Context, name, namespace string) ([]SavedResult, time.Time, error)
+	// SetResults replaces the last results of a query against a namespace.
+	SetResults(ctx context.Context, name, namespace string, results []SavedResult) error
+}
+
+// queryStore implements QueryStore.
+type queryStore struct {
+	db *sql.DB
+}
+
+// NewQueryStore prepares the saved query tables.
+func NewQueryStore(db *sql.DB) (QueryStore, error) {
+	for _, q := range []string{
+		`CREATE TABLE IF NOT EXISTS saved_queries (
+			name TEXT PRIMARY KEY,
+			query TEXT,
+			k INTEGER
+		)`,
+		`CREATE TABLE IF NOT EXISTS saved_results (
+			name TEXT,
+			namespace TEXT,
+			rank INTEGER,
+			path TEXT,
+			score FLOAT,
+			run_at TIMESTAMP
+		)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			return nil, fmt.Errorf("failed to create saved query tables: %w", err)
+		}
+	}
+	return &queryStore{db: db}, nil
+}
+
+// Save creates or replaces a saved query.
+func (s *queryStore) Save(ctx context.Context, q SavedQuery) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO saved_queries (name, query, k) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET query = excluded.query, k = excluded.k;`, q.Name, q.Query, q.K)
+	if err != nil {
+		return fmt.Errorf("Save failed: %w", err)
+	}
+	return nil
+}
+
+// List returns every saved query by name.
+func (s *queryStore) List(ctx context.Context) ([]SavedQuery, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT name, query, k FROM saved_queries ORDER BY name;")
+	if err != nil {
+		return nil, fmt.Errorf("List failed: %w", err)
+	}
+	defer rows.Close()
+
+	var out []SavedQuery
+	for rows.Next() {
+		var q SavedQuery
+		if err := rows.Scan(&q.Name, &q.Query, &q.K); err != nil {
+			return nil, fmt.Errorf("List scan failed: %w", err)
+		}
+		out = append(out, q)
+	}
+	return out, rows.Err()
+}
+
+// Remove deletes a saved query and its results.
+func (s *queryStore) Remove(ctx context.Context, name string) error {
+	for _, q := range []string{"DELETE FROM saved_results WHERE name = ?;", "DELETE FROM saved_queries WHERE name = ?;"} {
+		if _, err := s.db.ExecContext(ctx, q, name); err != nil {
+			return fmt.Errorf("Remove failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// Results returns the last results of a query against a namespace.
+func (s *queryStore) Results(ctx context.Context, name, namespace string) ([]SavedResult, time.Time, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT rank, path, score, run_at FROM saved_results WHERE name = ? AND namespace = ? ORDER BY rank;", name, namespace)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("Results failed: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		out   []SavedResult
+		runAt time.Time
+	)
+	for rows.Next() {
+		var r SavedResult
+		if err := rows.Scan(&r.Rank, &r.Path, &r.Score, &runAt); err != nil {
+			return nil, time.Time{}, fmt.Errorf("Results scan failed: %w", err)
+		}
+		out = append(out, r)
+	}
+	return out, runAt, rows.Err()
+}
+
+// SetResults replaces the last results of a query against a namespace.
+// saved_results has no primary key: DuckDB rejects deleting and re-inserting
+// the same key within a transaction.
+func (s *queryStore) SetResults(ctx context.Context, name, namespace string, results []SavedResult) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("SetResults failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM saved_results WHERE name = ? AND namespace = ?;", name, namespace); err != nil {
+		return fmt.Errorf("SetResults failed: %w", err)
+	}
+	now := time.Now()
+	for _, r := range results {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO saved_results (name, namespace, rank, path, score, run_at) VALUES (?, ?, ?, ?, ?, ?);",
+			name, namespace, r.Rank, r.Path, r.Score, now); err != nil {
+			return fmt.Errorf("SetResults failed: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("SetResults failed: %w", err)
+	}
+	return nil
+}
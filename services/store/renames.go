@@ -0,0 +1,267 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	crypt "github.com/codectx/tokens/services/crypt"
+)
+
+// HashIDs lists the ids of the rows embedded from content of hash, by id.
+func (s *storageService) HashIDs(ctx context.Context, hash string) ([]string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM "+s.table+" WHERE hash = ? ORDER BY id;", hash)
+	if err != nil {
+		return nil, fmt.Errorf("HashIDs failed: %w", err)
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("HashIDs scan failed: %w", err)
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// Hashes lists the ids of every row by the hash of their content, by id.
+func (s *storageService) Hashes(ctx context.Context) (map[string][]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT hash, id FROM "+s.table+" ORDER BY id;")
+	if err != nil {
+		return nil, fmt.Errorf("Hashes failed: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[string][]string{}
+	for rows.Next() {
+		var hash, id string
+		if err := rows.Scan(&hash, &id); err != nil {
+			return nil, fmt.Errorf("Hashes scan failed: %w", err)
+		}
+		out[hash] = append(out[hash], id)
+	}
+	return out, rows.Err()
+}
+
+// sealedColumn is a column of blobs sealed with an id that a rename
+// changes: prefix, then the value of the column key, then suffix, for the
+// rows of a file selected by where.
+type sealedColumn struct {
+	table, column, where, key, prefix, suffix string
+}
+
+// keyedTable is a table with a primary key naming a file by its column key,
+// and by kind when set, as for file summaries.
+type keyedTable struct {
+	table, key, kind string
+}
+
+// match returns the condition selecting the row of a file in t, the column
+// names prefixed with alias.
+func (t keyedTable) match(alias string) string {
+	cond := alias + t.key + " = ?"
+	if t.kind != "" {
+		cond = alias + "kind = '" + t.kind + "' AND " + cond
+	}
+	return cond
+}
+
+// Rename moves the rows of the file from to the file to, replacing those to
+// had: its vector, chunks, symbols, comments, segments, sparse vector, file
+// summary, modification time and history. Chunk ids keep their symbol and
+// hash, only their path changes, so their vectors are reused. Sealed blobs
+// are opened with their former id and sealed again with the new one. It all
+// happens in one transaction.
+func (s *storageService) Rename(ctx context.Context, from, to string) error {
+	defer s.changed()
+	defer s.dropPostings()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Rename failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	// DuckDB rejects a key deleted within the transaction coming back, so
+	// the row of to is overwritten by that of from rather than replaced.
+	for _, t := range []keyedTable{
+		{table: s.table, key: "id"},
+		{table: s.symbolFiles, key: "id"},
+		{table: s.docs, key: "file"},
+		{table: s.sparse, key: "file"},
+		{table: s.summaries, key: "id", kind: SummaryFile},
+		{table: s.modTimes, key: "file"},
+	} {
+		if err := s.renameKeyed(ctx, tx, t, from, to); err != nil {
+			return fmt.Errorf("Rename failed: %w", err)
+		}
+	}
+	for _, q := range []struct {
+		query  string
+		params []any
+	}{
+		{"DELETE FROM " + s.chunks + " WHERE file = ?;", []any{to}},
+		// substr counts characters, not bytes
+		{"UPDATE " + s.chunks + " SET file = ?, id = ? || substr(id, ?) WHERE file = ?;", []any{to, to, utf8.RuneCountInString(from) + 1, from}},
+		{"DELETE FROM " + s.chunkHashes + " WHERE file = ?;", []any{to}},
+		{"UPDATE " + s.chunkHashes + " SET file = ? WHERE file = ?;", []any{to, from}},
+		{"DELETE FROM " + s.symbols + " WHERE id = ?;", []any{to}},
+		{"UPDATE " + s.symbols + " SET id = ? WHERE id = ?;", []any{to, from}},
+		{"DELETE FROM " + s.multiVectors + " WHERE file = ?;", []any{to}},
+		{"UPDATE " + s.multiVectors + " SET file = ? WHERE file = ?;", []any{to, from}},
+		{"UPDATE " + s.events + " SET id = ? WHERE id = ?;", []any{to, from}},
+	} {
+		if _, err := tx.ExecContext(ctx, q.query, q.params...); err != nil {
+			return fmt.Errorf("Rename failed: %w", err)
+		}
+	}
+
+	if s.cipher != nil {
+		file := "kind = '" + SummaryFile + "' AND id = ?"
+		for _, c := range []sealedColumn{
+			{s.table, "embedding", "id = ?", "id", "", ""},
+			{s.chunks, "embedding", "file = ?", "id", "", ""},
+			{s.docs, "embedding", "file = ?", "file", "", ""},
+			{s.multiVectors, "embedding", "file = ?", "file", "", ""},
+			{s.sparse, "terms", "file = ?", "file", "", ""},
+			{s.summaries, "embedding", file, "id", SummaryFile + ":", ""},
+			{s.summaries, "summary", file, "id", SummaryFile + ":", ":summary"},
+		} {
+			if err := s.reseal(ctx, tx, c, from, to); err != nil {
+				return fmt.Errorf("Rename failed: %w", err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Rename failed: %w", err)
+	}
+	return nil
+}
+
+// normalizeIDs moves the files stored under ids with backslashes, as indexed
+// on Windows before ids were normalized, to their ids with slashes, in every
+// table, so that looking up the aliases of a path needn't scan the table.
+func (s *storageService) normalizeIDs(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM "+s.table+` WHERE contains(id, '\');`)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := s.Rename(ctx, id, strings.ReplaceAll(id, `\`, "/")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameKeyed moves the row of the file from in t to the file to. When both
+// have one, the columns of the row of to are set to those of from, which is
+// deleted; when only to has one, it is deleted.
+func (s *storageService) renameKeyed(ctx context.Context, tx *sql.Tx, t keyedTable, from, to string) error {
+	rows, err := tx.QueryContext(ctx, `SELECT column_name FROM information_schema.columns
+		WHERE table_catalog = current_database() AND table_schema = current_schema() AND table_name = ? ORDER BY ordinal_position;`,
+		strings.Trim(t.table, `"`))
+	if err != nil {
+		return err
+	}
+	var set []string
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			rows.Close()
+			return err
+		}
+		if col != t.key && (t.kind == "" || col != "kind") {
+			set = append(set, col+" = f."+col)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	exists := "EXISTS (SELECT 1 FROM " + t.table + " WHERE " + t.match("") + ")"
+	for _, q := range []struct {
+		query  string
+		params []any
+	}{
+		{"DELETE FROM " + t.table + " WHERE " + t.match("") + " AND NOT " + exists + ";", []any{to, from}},
+		{"UPDATE " + t.table + " AS d SET " + strings.Join(set, ", ") + " FROM " + t.table + " AS f WHERE " + t.match("d.") + " AND " + t.match("f.") + ";", []any{to, from}},
+		{"DELETE FROM " + t.table + " WHERE " + t.match("") + " AND " + exists + ";", []any{from, to}},
+		{"UPDATE " + t.table + " SET " + t.key + " = ? WHERE " + t.match("") + ";", []any{to, from}},
+	} {
+		if _, err := tx.ExecContext(ctx, q.query, q.params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reseal seals the blobs of column c of the rows moved from the file from to
+// the file to again, with the id of their new row. Plaintext blobs, written
+// before encryption was enabled, are left as they are.
+func (s *storageService) reseal(ctx context.Context, tx *sql.Tx, c sealedColumn, from, to string) error {
+	rows, err := tx.QueryContext(ctx, "SELECT rowid, "+c.key+", "+c.column+" FROM "+c.table+" WHERE "+c.where+";", to)
+	if err != nil {
+		return err
+	}
+	type blob struct {
+		rowid int64
+		b     []byte
+	}
+	var blobs []blob
+	for rows.Next() {
+		var (
+			rowid int64
+			key   string
+			b     []byte
+		)
+		if err := rows.Scan(&rowid, &key, &b); err != nil {
+			rows.Close()
+			return err
+		}
+		if !crypt.IsSealed(b) {
+			continue
+		}
+		old := c.prefix + from + strings.TrimPrefix(key, to) + c.suffix
+		if b, err = s.open(old, b); err != nil {
+			rows.Close()
+			return err
+		}
+		if b, err = s.seal(c.prefix+key+c.suffix, b); err != nil {
+			rows.Close()
+			return err
+		}
+		blobs = append(blobs, blob{rowid, b})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, b := range blobs {
+		if _, err := tx.ExecContext(ctx, "UPDATE "+c.table+" SET "+c.column+" = ? WHERE rowid = ?;", b.b, b.rowid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
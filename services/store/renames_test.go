@@ -0,0 +1,210 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	crypt "github.com/codectx/tokens/services/crypt"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// TestRenameSealed renames a file in an encrypted store and reads its rows
+// back: their blobs were sealed with the former id.
+func TestRenameSealed(t *testing.T) {
+	ctx := context.Background()
+	c, err := crypt.NewAESGCM(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("duckdb", filepath.Join(t.TempDir(), "sealed.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s, err := store.NewStorageService(db, store.WithCipher(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := store.Embedding{ID: "old/a.go", Hash: "h1", Vector: []float32{1, 2}, Language: "go"}
+	chunk := store.Chunk{ID: "old/a.go#main@abc", File: "old/a.go", StartLine: 1, EndLine: 9, Vector: []float32{3}}
+	sum := store.Summary{ID: "old/a.go", Kind: store.SummaryFile, Hash: "h1", Text: "entry point", Vector: []float32{4}, Children: []string{}}
+	for _, err := range []error{
+		s.Upsert(ctx, e),
+		// new/a.go holds a stale row, replaced by the move
+		s.Upsert(ctx, store.Embedding{ID: "new/a.go", Hash: "h0", Vector: []float32{9}}),
+		s.ReplaceChunks(ctx, "old/a.go", []store.Chunk{chunk}),
+		s.UpsertDoc(ctx, "old/a.go", "d1", []float32{5}),
+		s.ReplaceMultiVectors(ctx, "old/a.go", "m1", [][]float32{{6}, {7}}),
+		s.UpsertSparse(ctx, "old/a.go", "s1", map[uint32]float32{42: 0.5}),
+		s.UpsertSummary(ctx, sum),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Rename(ctx, "old/a.go", "new/a.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := s.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ID = "new/a.go"
+	if want := map[string]store.Embedding{"new/a.go": e}; !reflect.DeepEqual(all, want) {
+		t.Errorf("GetAll = %v, want %v", all, want)
+	}
+	chunks, err := s.Chunks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk.ID, chunk.File = "new/a.go#main@abc", "new/a.go"
+	if want := []store.Chunk{chunk}; !reflect.DeepEqual(chunks, want) {
+		t.Errorf("Chunks = %v, want %v", chunks, want)
+	}
+	docs, err := s.Docs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]float32{"new/a.go": {5}}; !reflect.DeepEqual(docs, want) {
+		t.Errorf("Docs = %v, want %v", docs, want)
+	}
+	multi, err := s.MultiVectors(ctx, "new/a.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][][]float32{"new/a.go": {{6}, {7}}}; !reflect.DeepEqual(multi, want) {
+		t.Errorf("MultiVectors = %v, want %v", multi, want)
+	}
+	sparse, err := s.Sparse(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]map[uint32]float32{"new/a.go": {42: 0.5}}; !reflect.DeepEqual(sparse, want) {
+		t.Errorf("Sparse = %v, want %v", sparse, want)
+	}
+	sums, err := s.Summaries(ctx, store.SummaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum.ID = "new/a.go"
+	if want := []store.Summary{sum}; !reflect.DeepEqual(sums, want) {
+		t.Errorf("Summaries = %v, want %v", sums, want)
+	}
+}
+
+// TestRenameNonASCII renames a file whose path has multibyte characters: the
+// ids of its chunks keep their suffix.
+func TestRenameNonASCII(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("duckdb", filepath.Join(t.TempDir(), "names.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s, err := store.NewStorageService(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := store.Chunk{ID: "docs/日本語.go#main@abc", File: "docs/日本語.go", StartLine: 1, EndLine: 9, Vector: []float32{3}}
+	if err := s.Upsert(ctx, store.Embedding{ID: "docs/日本語.go", Hash: "h1", Vector: []float32{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReplaceChunks(ctx, "docs/日本語.go", []store.Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rename(ctx, "docs/日本語.go", "b.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := s.Chunks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk.ID, chunk.File = "b.go#main@abc", "b.go"
+	if want := []store.Chunk{chunk}; !reflect.DeepEqual(chunks, want) {
+		t.Errorf("Chunks = %v, want %v", chunks, want)
+	}
+}
+
+// TestNormalizeIDs opens a store holding a file indexed on Windows before
+// ids were normalized: its rows are moved to the id with slashes.
+func TestNormalizeIDs(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("duckdb", filepath.Join(t.TempDir(), "windows.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s, err := store.NewStorageService(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := store.Chunk{ID: `dir\a.go#main@abc`, File: `dir\a.go`, StartLine: 1, EndLine: 9, Vector: []float32{3}}
+	if err := s.Upsert(ctx, store.Embedding{ID: `dir\a.go`, Hash: "h1", Vector: []float32{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReplaceChunks(ctx, `dir\a.go`, []store.Chunk{chunk}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err = store.NewStorageService(db); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := s.IDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dir/a.go"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("IDs = %v, want %v", ids, want)
+	}
+	chunks, err := s.Chunks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk.ID, chunk.File = "dir/a.go#main@abc", "dir/a.go"
+	if want := []store.Chunk{chunk}; !reflect.DeepEqual(chunks, want) {
+		t.Errorf("Chunks = %v, want %v", chunks, want)
+	}
+}
+
+// TestGetAllWrongKey reads rows sealed with another key: GetAll fails rather
+// than leaving them out.
+func TestGetAllWrongKey(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "keys.db")
+	open := func(key byte) (*sql.DB, store.StorageService) {
+		c, err := crypt.NewAESGCM(bytes.Repeat([]byte{key}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := sql.Open("duckdb", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := store.NewStorageService(db, store.WithCipher(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db, s
+	}
+
+	db, s := open(1)
+	if err := s.Upsert(ctx, store.Embedding{ID: "a.go", Hash: "h1", Vector: []float32{1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, s = open(2)
+	defer db.Close()
+	if all, err := s.GetAll(ctx); err == nil {
+		t.Errorf("GetAll = %v, want an error", all)
+	}
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Retry is a file that failed to embed and is waiting to be retried.
+type Retry struct {
+	ID       string
+	Error    string
+	Attempts int
+	// LastAttempt is when the file last failed.
+	LastAttempt time.Time
+}
+
+// createRetries creates the pending_retries table of the namespace.
+func (s *storageService) createRetries() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        id TEXT PRIMARY KEY,
+        error TEXT,
+        attempts INTEGER DEFAULT 1,
+        last_attempt TIMESTAMP DEFAULT current_timestamp
+    )
+    `, s.retries))
+	return err
+}
+
+// RecordFailure adds id to the retry queue, or counts another failed attempt.
+func (s *storageService) RecordFailure(ctx context.Context, id string, cause error) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO `+s.retries+` (id, error) VALUES (?, ?)
+		ON CONFLICT(id) DO UPDATE SET error = excluded.error, attempts = attempts + 1, last_attempt = now();`,
+		id, cause.Error())
+	if err != nil {
+		return fmt.Errorf("RecordFailure failed: %w", err)
+	}
+	return nil
+}
+
+// ClearFailure removes id from the retry queue.
+func (s *storageService) ClearFailure(ctx context.Context, id string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM "+s.retries+" WHERE id = ?;", id); err != nil {
+		return fmt.Errorf("ClearFailure failed: %w", err)
+	}
+	return nil
+}
+
+// Pending lists the retry queue, oldest failures first.
+func (s *storageService) Pending(ctx context.Context) ([]Retry, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, error, attempts, last_attempt FROM "+s.retries+" ORDER BY last_attempt, id;")
+	if err != nil {
+		return nil, fmt.Errorf("Pending failed: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Retry
+	for rows.Next() {
+		var r Retry
+		if err := rows.Scan(&r.ID, &r.Error, &r.Attempts, &r.LastAttempt); err != nil {
+			return nil, fmt.Errorf("Pending scan failed: %w", err)
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Rules of path rules.
+const (
+	// RulePin re-checks the matching files before every search.
+	RulePin = "pin"
+	// RuleExclude leaves the matching files out of indexing and results.
+	RuleExclude = "exclude"
+)
+
+// PathRule applies Rule to the files matching Pattern, a gitignore pattern.
+type PathRule struct {
+	Pattern string
+	Rule    string
+	// Added is when the rule was set.
+	Added time.Time
+}
+
+// createRules creates the path_rules table of the namespace.
+func (s *storageService) createRules() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        pattern TEXT PRIMARY KEY,
+        rule TEXT,
+        added TIMESTAMP DEFAULT current_timestamp
+    )
+    `, s.rules))
+	return err
+}
+
+// SetPathRule applies rule to the files matching pattern, replacing the rule
+// pattern had.
+func (s *storageService) SetPathRule(ctx context.Context, pattern, rule string) error {
+	defer s.changed()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `INSERT INTO `+s.rules+` (pattern, rule) VALUES (?, ?)
+		ON CONFLICT(pattern) DO UPDATE SET rule = excluded.rule, added = now();`, pattern, rule)
+	if err != nil {
+		return fmt.Errorf("SetPathRule failed: %w", err)
+	}
+	return nil
+}
+
+// DeletePathRule removes the rule of pattern, and reports whether it had
+// one.
+func (s *storageService) DeletePathRule(ctx context.Context, pattern string) (bool, error) {
+	defer s.changed()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM "+s.rules+" WHERE pattern = ?;", pattern)
+	if err != nil {
+		return false, fmt.Errorf("DeletePathRule failed: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("DeletePathRule failed: %w", err)
+	}
+	return n > 0, nil
+}
+
+// PathRules lists the path rules, by pattern.
+func (s *storageService) PathRules(ctx context.Context) ([]PathRule, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT pattern, rule, added FROM "+s.rules+" ORDER BY pattern;")
+	if err != nil {
+		return nil, fmt.Errorf("PathRules failed: %w", err)
+	}
+	defer rows.Close()
+
+	var out []PathRule
+	for rows.Next() {
+		var r PathRule
+		if err := rows.Scan(&r.Pattern, &r.Rule, &r.Added); err != nil {
+			return nil, fmt.Errorf("PathRules scan failed: %w", err)
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
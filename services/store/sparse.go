@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+)
+
+// createSparse creates the sparse table of the namespace, holding the
+// sparse term-weight vectors of files.
+func (s *storageService) createSparse() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        file TEXT PRIMARY KEY,
+        hash TEXT,
+        terms BLOB
+    )
+    `, s.sparse))
+	return err
+}
+
+// UpsertSparse stores the sparse vector of file, by term id, encoded from
+// text of the given hash.
+func (s *storageService) UpsertSparse(ctx context.Context, file, hash string, terms map[uint32]float32) error {
+	defer s.changed()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	b, err := s.seal(file, sparseToBytes(terms))
+	if err != nil {
+		return fmt.Errorf("UpsertSparse failed: %w", err)
+	}
+	defer s.dropPostings()
+	if _, err := s.db.ExecContext(ctx, "INSERT INTO "+s.sparse+" (file, hash, terms) VALUES (?, ?, ?) ON CONFLICT(file) DO UPDATE SET hash = excluded.hash, terms = excluded.terms;",
+		file, hash, b); err != nil {
+		return fmt.Errorf("UpsertSparse failed: %w", err)
+	}
+	return nil
+}
+
+// MatchSparse reports whether the sparse vector of file was encoded from
+// text of the given hash.
+func (s *storageService) MatchSparse(ctx context.Context, file, hash string) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var n int
+	if err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM "+s.sparse+" WHERE file = ? AND hash = ?;", file, hash).Scan(&n); err != nil {
+		return false, fmt.Errorf("MatchSparse query failed: %w", err)
+	}
+	return n > 0, nil
+}
+
+// Sparse fetches the sparse vectors of files, of every file when files is
+// empty.
+func (s *storageService) Sparse(ctx context.Context, files ...string) (map[string]map[uint32]float32, error) {
+	// Not bounded by the query timeout when reading every file, like GetAll.
+	query, params := "SELECT file, terms FROM "+s.sparse, make([]any, len(files))
+	if len(files) > 0 {
+		var cancel func()
+		ctx, cancel = s.withTimeout(ctx)
+		defer cancel()
+		query += " WHERE file IN (?" + strings.Repeat(", ?", len(files)-1) + ")"
+		for i, f := range files {
+			params[i] = f
+		}
+	}
+	rows, err := s.db.QueryContext(ctx, query+";", params...)
+	if err != nil {
+		return nil, fmt.Errorf("Sparse failed: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[string]map[uint32]float32{}
+	for rows.Next() {
+		var (
+			file string
+			b    []byte
+		)
+		if err := rows.Scan(&file, &b); err != nil {
+			return nil, fmt.Errorf("Sparse scan failed: %w", err)
+		}
+		if b, err = s.open(file, b); err != nil {
+			return nil, fmt.Errorf("Sparse failed: %w", err)
+		}
+		out[file] = bytesToSparse(b)
+	}
+	return out, rows.Err()
+}
+
+// posting is the weight of a term in the sparse vector of a file.
+type posting struct {
+	file   string
+	weight float32
+}
+
+// SparseMatches returns the dot product of terms with the sparse vector of
+// each file sharing terms with it, when positive. It reads the postings of
+// the terms only, from an inverted index of the table kept in memory: the
+// rows may be sealed, so the postings can't be stored in clear.
+func (s *storageService) SparseMatches(ctx context.Context, terms map[uint32]float32) (map[string]float32, error) {
+	s.postingsMu.Lock()
+	defer s.postingsMu.Unlock()
+	if s.postings == nil {
+		files, err := s.Sparse(ctx)
+		if err != nil {
+			return nil, err
+		}
+		postings := map[uint32][]posting{}
+		for file, v := range files {
+			for id, w := range v {
+				postings[id] = append(postings[id], posting{file: file, weight: w})
+			}
+		}
+		s.postings = postings
+	}
+
+	out := map[string]float32{}
+	for id, w := range terms {
+		for _, p := range s.postings[id] {
+			out[p.file] += w * p.weight
+		}
+	}
+	maps.DeleteFunc(out, func(_ string, score float32) bool { return score <= 0 })
+	return out, nil
+}
+
+// dropPostings drops the inverted index of SparseMatches once the table is
+// written, to build it again on the next match.
+func (s *storageService) dropPostings() {
+	s.postingsMu.Lock()
+	s.postings = nil
+	s.postingsMu.Unlock()
+}
+
+// sparseToBytes encodes terms as little-endian pairs of term id and weight,
+// by term id.
+func sparseToBytes(terms map[uint32]float32) []byte {
+	ids := make([]uint32, 0, len(terms))
+	for id := range terms {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	b := make([]byte, 0, 8*len(ids))
+	for _, id := range ids {
+		b = binary.LittleEndian.AppendUint32(b, id)
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(terms[id]))
+	}
+	return b
+}
+
+// bytesToSparse decodes the terms encoded by sparseToBytes.
+func bytesToSparse(b []byte) map[uint32]float32 {
+	terms := make(map[uint32]float32, len(b)/8)
+	for ; len(b) >= 8; b = b[8:] {
+		terms[binary.LittleEndian.Uint32(b)] = math.Float32frombits(binary.LittleEndian.Uint32(b[4:]))
+	}
+	return terms
+}
@@ -7,7 +7,13 @@ import (
 	"database/sql"
 	"encoding/binary"
 	"fmt"
-	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	crypt "github.com/codectx/tokens/services/crypt"
 
 	// Import the DuckDB driver
 	_ "github.com/marcboeker/go-duckdb"
@@ -18,72 +24,565 @@ type Embedding struct {
 	ID     string
 	Hash   string
 	Vector []float32
+	// Generated is set for files detected as generated or minified.
+	Generated bool
+	// Author is the dominant git blame author, when blame was enabled.
+	Author string
+	// LastCommit is the last commit that modified the file.
+	LastCommit string
+	// Blamed is set once blame ran on the file, even when it found no
+	// author, so that unchanged files aren't blamed again.
+	Blamed bool
+	// Shard is the top-level directory of the file under the indexed path,
+	// empty for files at its root.
+	Shard string
+	// Language is the detected language of the file, empty when unknown.
+	Language string
+	// Model is the provider and model the vector was embedded with, as
+	// embed.Provider names them, empty for rows stored before vectors were
+	// tagged.
+	Model string
 }
 
 // StorageService defines the interface for CRUD operations on DuckDB.
 type StorageService interface {
 	// Upsert inserts or updates a row
-	Upsert(context.Context, string, string, []float32) error
+	Upsert(ctx context.Context, e Embedding) error
 	// GetAll fetches all rows.
 	GetAll(ctx context.Context) (map[string]Embedding, error)
 	// Get fetches multiple rows by ids.
 	Get(ctx context.Context, id []string) ([]Embedding, error)
+	// IDs lists the ids of every row, or of the rows detected as one of
+	// languages when given, without loading their vectors.
+	IDs(ctx context.Context, languages ...string) ([]string, error)
+	// Languages counts the rows of each detected language, "" for unknown.
+	Languages(ctx context.Context) (map[string]int, error)
+	// Models counts the rows of each embedding model, "" for untagged rows.
+	Models(ctx context.Context) (map[string]int, error)
 	// MatchHash checks if the given hash matches the stored hash for the given id.
 	MatchHash(ctx context.Context, id, hash string) (bool, error)
+	// Aliases fetches the rows whose id spells id differently: with
+	// backslashes for slashes, or, when foldCase is set, in another case.
+	Aliases(ctx context.Context, id string, foldCase bool) ([]Embedding, error)
 	// Delete removes a row by id.
 	Delete(ctx context.Context, id string) error
+	// HashIDs lists the ids of the rows embedded from content of hash.
+	HashIDs(ctx context.Context, hash string) ([]string, error)
+	// Hashes lists the ids of every row by the hash of their content, in
+	// one scan.
+	Hashes(ctx context.Context) (map[string][]string, error)
+	// Rename moves the rows of the file from, with its chunks, symbols,
+	// comments, segments, sparse vector and history, to the file to.
+	Rename(ctx context.Context, from, to string) error
+	// RecordFailure queues id to be retried after it failed to embed.
+	RecordFailure(ctx context.Context, id string, cause error) error
+	// ClearFailure removes id from the retry queue.
+	ClearFailure(ctx context.Context, id string) error
+	// Pending lists the files waiting to be retried.
+	Pending(ctx context.Context) ([]Retry, error)
+	// LogQuery records a searched query under its id.
+	LogQuery(ctx context.Context, id, query string) error
+	// LoggedQuery returns the query logged under id, and false if there is none.
+	LoggedQuery(ctx context.Context, id string) (string, bool, error)
+	// RecordFeedback records whether id was a good result of a logged query.
+	RecordFeedback(ctx context.Context, queryID, id string, good bool) error
+	// Votes returns the net votes per result of a logged query.
+	Votes(ctx context.Context, queryID string) (map[string]int, error)
+	// Judgments lists the net votes of every judged result.
+	Judgments(ctx context.Context) ([]Judgment, error)
+	// UpsertSummary inserts or updates a file or package summary.
+	UpsertSummary(ctx context.Context, sum Summary) error
+	// Summaries fetches every summary of kind.
+	Summaries(ctx context.Context, kind string) ([]Summary, error)
+	// MatchSummary checks if the summary of kind for id was made from
+	// content with the given hash.
+	MatchSummary(ctx context.Context, kind, id, hash string) (bool, error)
+	// DeleteSummary removes the summary of kind for id.
+	DeleteSummary(ctx context.Context, kind, id string) error
+	// ReplaceSymbols replaces the definitions and usages recorded for id.
+	ReplaceSymbols(ctx context.Context, id, hash string, symbols []Symbol) error
+	// MatchSymbols checks if the symbols of id were read from content with
+	// the given hash.
+	MatchSymbols(ctx context.Context, id, hash string) (bool, error)
+	// FindSymbols fetches the definitions or usages of a name.
+	FindSymbols(ctx context.Context, kind, name string, foldCase bool) ([]Symbol, error)
+	// SymbolNames lists the distinct names of the symbols of kind.
+	SymbolNames(ctx context.Context, kind string) ([]string, error)
+	// ReplaceChunks replaces the embedded chunks of a file.
+	ReplaceChunks(ctx context.Context, file string, chunks []Chunk) error
+	// Chunks fetches every embedded chunk.
+	Chunks(ctx context.Context) ([]Chunk, error)
+	// FileChunks fetches the embedded chunks of a file.
+	FileChunks(ctx context.Context, file string) ([]Chunk, error)
+	// UpdateChunks removes and inserts embedded chunks of a file.
+	UpdateChunks(ctx context.Context, file string, remove []string, add []Chunk) error
+	// ChunkHashes fetches the chunks a file was split into when it was last
+	// indexed.
+	ChunkHashes(ctx context.Context, file string) ([]ChunkHash, error)
+	// UpdateChunkHashes removes and inserts chunks a file was split into.
+	UpdateChunkHashes(ctx context.Context, file string, remove []string, add []ChunkHash) error
+	// SetModTime records the modification time of a file when indexed.
+	SetModTime(ctx context.Context, file string, mtime time.Time) error
+	// ModTimes fetches the modification times recorded for every file.
+	ModTimes(ctx context.Context) (map[string]time.Time, error)
+	// UpsertDoc stores the vector of the comments of a file.
+	UpsertDoc(ctx context.Context, file, hash string, vector []float32) error
+	// MatchDoc checks whether the comments of a file were embedded from
+	// comments of the given hash.
+	MatchDoc(ctx context.Context, file, hash string) (bool, error)
+	// DeleteDoc removes the vector of the comments of a file.
+	DeleteDoc(ctx context.Context, file string) error
+	// Docs fetches the vectors of the comments of files, of every file
+	// when none is given.
+	Docs(ctx context.Context, files ...string) (map[string][]float32, error)
+	// ReplaceMultiVectors replaces the vectors of the segments of a file,
+	// embedded from text of the given hash, removing them when empty.
+	ReplaceMultiVectors(ctx context.Context, file, hash string, vectors [][]float32) error
+	// MatchMultiVectors checks whether the segments of a file were embedded
+	// from text of the given hash.
+	MatchMultiVectors(ctx context.Context, file, hash string) (bool, error)
+	// MultiVectors fetches the vectors of the segments of files, in order.
+	MultiVectors(ctx context.Context, files ...string) (map[string][][]float32, error)
+	// UpsertSparse stores the sparse vector of a file, by term id, encoded
+	// from text of the given hash.
+	UpsertSparse(ctx context.Context, file, hash string, terms map[uint32]float32) error
+	// MatchSparse checks whether the sparse vector of a file was encoded
+	// from text of the given hash.
+	MatchSparse(ctx context.Context, file, hash string) (bool, error)
+	// Sparse fetches the sparse vectors of files, of every file when none
+	// is given.
+	Sparse(ctx context.Context, files ...string) (map[string]map[uint32]float32, error)
+	// SparseMatches returns the dot product of terms with the sparse vector
+	// of each file sharing terms with it, when positive.
+	SparseMatches(ctx context.Context, terms map[uint32]float32) (map[string]float32, error)
+	// BeginUpdate journals that the rows of id are about to be rewritten.
+	BeginUpdate(ctx context.Context, id, hash string) error
+	// EndUpdate removes id from the journal once its rows are written.
+	EndUpdate(ctx context.Context, id string) error
+	// Unfinished lists the updates begun and never ended, such as by a
+	// crash.
+	Unfinished(ctx context.Context) ([]JournalEntry, error)
+	// Generation counts the writes through the service that can change
+	// search results, such as rows, chunks, summaries, feedback and path
+	// rules, so that what was computed from them can be told stale. Writes
+	// made by other services and processes aren't counted.
+	Generation() uint64
+	// RecordEvent appends e to the history of its file, unless the last
+	// event of the file has the same action, hash and detail, and keeps the
+	// latest EventsKept of them.
+	RecordEvent(ctx context.Context, e IndexEvent) error
+	// Events lists the last limit events of the file id, newest first, all
+	// of them when limit is 0.
+	Events(ctx context.Context, id string, limit int) ([]IndexEvent, error)
+	// SetPathRule applies rule, RulePin or RuleExclude, to the files
+	// matching pattern.
+	SetPathRule(ctx context.Context, pattern, rule string) error
+	// DeletePathRule removes the rule of pattern, and reports whether it
+	// had one.
+	DeletePathRule(ctx context.Context, pattern string) (bool, error)
+	// PathRules lists the path rules, by pattern.
+	PathRules(ctx context.Context) ([]PathRule, error)
+	// DropOrphans removes the chunks, symbols, comments, segments, sparse
+	// vectors and file summaries of files without a row, and returns how
+	// many rows were removed.
+	DropOrphans(ctx context.Context) (int, error)
+	// PushWork queues files as a batch of a distributed indexing run.
+	PushWork(ctx context.Context, files []string) error
+	// ClaimWork leases the oldest batch not leased, or whose lease expired,
+	// to worker, and returns false when there is none.
+	ClaimWork(ctx context.Context, worker string, lease time.Duration) (WorkBatch, bool, error)
+	// FinishWork removes a batch claimed by worker once its files are
+	// indexed, false when its lease was lost to another claim.
+	FinishWork(ctx context.Context, worker string, b WorkBatch) (bool, error)
+	// WorkLeft counts the queued files.
+	WorkLeft(ctx context.Context) (int, error)
 }
 
 // storageService implements StorageService.
 type storageService struct {
-	db *sql.DB
+	db        *sql.DB
+	cipher    crypt.Cipher
+	namespace string
+	table     string
+	retries   string
+	queries   string
+	feedback  string
+	summaries string
+	// symbols and symbolFiles hold the symbol table.
+	symbols     string
+	symbolFiles string
+	// chunks holds the vectors of the chunks of files, chunkHashes the
+	// chunks files were split into.
+	chunks      string
+	chunkHashes string
+	// modTimes holds the modification time of files when last indexed.
+	modTimes string
+	// docs holds the vectors of the comments of files.
+	docs string
+	// multiVectors holds the vectors of the segments of files.
+	multiVectors string
+	// sparse holds the sparse term-weight vectors of files.
+	sparse string
+	// postings is the inverted index of the sparse vectors, by term, built
+	// on the first SparseMatches and dropped by writes to sparse.
+	postingsMu sync.Mutex
+	postings   map[uint32][]posting
+	// generation counts the writes that can change search results.
+	generation atomic.Uint64
+	// journal holds the files whose rows are being rewritten.
+	journal string
+	// events holds what indexing did to each file.
+	events string
+	// rules holds the files pinned or excluded at runtime.
+	rules string
+	// work holds the batches of files of a distributed indexing run.
+	work     string
+	timeout  time.Duration
+	readOnly bool
 	// mu sync.Mutex
 }
 
+// Generation counts the writes through s that can change search results.
+func (s *storageService) Generation() uint64 {
+	return s.generation.Load()
+}
+
+// changed counts a write that can change search results.
+func (s *storageService) changed() {
+	s.generation.Add(1)
+}
+
+// namespaceRe restricts namespaces to names that are safe to use in table names.
+var namespaceRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// ValidateNamespace returns an error if ns cannot be used as a namespace.
+// The empty string selects the default namespace and is always valid.
+func ValidateNamespace(ns string) error {
+	if ns != "" && !namespaceRe.MatchString(ns) {
+		return fmt.Errorf("invalid index name %q: use lowercase letters, digits, dashes and underscores", ns)
+	}
+	return nil
+}
+
+// Namespace describes a named index stored in the database.
+type Namespace struct {
+	// Name is the namespace, empty for the default one.
+	Name string
+	// Rows is the number of stored embeddings.
+	Rows int
+}
+
+// Namespaces lists the namespaces stored in db.
+func Namespaces(ctx context.Context, db *sql.DB) ([]Namespace, error) {
+	rows, err := db.QueryContext(ctx, `SELECT table_name FROM information_schema.tables
+		WHERE table_name = 'embeddings' OR table_name LIKE 'embeddings\_%' ESCAPE '\' ORDER BY table_name;`)
+	if err != nil {
+		return nil, fmt.Errorf("Namespaces failed: %w", err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("Namespaces scan failed: %w", err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	out := make([]Namespace, 0, len(names))
+	for _, name := range names {
+		ns := Namespace{Name: strings.TrimPrefix(strings.TrimPrefix(name, "embeddings"), "_")}
+		if err := db.QueryRowContext(ctx, "SELECT count(*) FROM "+quoteIdent(name)+";").Scan(&ns.Rows); err != nil {
+			return nil, fmt.Errorf("Namespaces count failed: %w", err)
+		}
+		out = append(out, ns)
+	}
+	return out, nil
+}
+
+// Option configures a storage service.
+type Option func(*storageService)
+
+// WithCipher encrypts stored vectors at rest using c.
+func WithCipher(c crypt.Cipher) Option {
+	return func(s *storageService) {
+		s.cipher = c
+	}
+}
+
+// WithNamespace scopes the service to its own embeddings table so that
+// several independent indexes can share one database.
+func WithNamespace(ns string) Option {
+	return func(s *storageService) {
+		s.namespace = ns
+	}
+}
+
+// WithTimeout bounds every single-row query to d. A zero d disables the bound.
+func WithTimeout(d time.Duration) Option {
+	return func(s *storageService) {
+		s.timeout = d
+	}
+}
+
+// WithReadOnly skips creating and migrating tables, for databases opened
+// read-only. Writes fail.
+func WithReadOnly() Option {
+	return func(s *storageService) {
+		s.readOnly = true
+	}
+}
+
 // NewStorageService opens or creates local.db and prepares the embeddings table.
-// Panics on failure.
-func NewStorageService(db *sql.DB) StorageService {
+func NewStorageService(db *sql.DB, opts ...Option) (StorageService, error) {
+	s := &storageService{db: db}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := ValidateNamespace(s.namespace); err != nil {
+		return nil, err
+	}
+	s.table = tableName("embeddings", s.namespace)
+	s.retries = tableName("pending_retries", s.namespace)
+	s.queries = tableName("query_log", s.namespace)
+	s.feedback = tableName("feedback", s.namespace)
+	s.summaries = tableName("summaries", s.namespace)
+	s.symbols = tableName("symbols", s.namespace)
+	s.symbolFiles = tableName("symbol_files", s.namespace)
+	s.chunks = tableName("chunks", s.namespace)
+	s.chunkHashes = tableName("chunk_hashes", s.namespace)
+	s.modTimes = tableName("mod_times", s.namespace)
+	s.docs = tableName("docs", s.namespace)
+	s.multiVectors = tableName("multivectors", s.namespace)
+	s.sparse = tableName("sparse", s.namespace)
+	s.journal = tableName("journal", s.namespace)
+	s.events = tableName("index_events", s.namespace)
+	s.rules = tableName("path_rules", s.namespace)
+	s.work = tableName("work_queue", s.namespace)
+	if s.readOnly {
+		return s, nil
+	}
 
 	// Create table if it doesn't exist.
-	createTableSQL := `
-    CREATE TABLE IF NOT EXISTS embeddings (
+	createTableSQL := fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
         id TEXT PRIMARY KEY,
         hash TEXT,
         embedding BLOB
     )
-    `
+    `, s.table)
 
 	if _, err := db.Exec(createTableSQL); err != nil {
-		panic(fmt.Sprintf("Failed to create embeddings table: %v", err))
+		return nil, fmt.Errorf("failed to create %s table: %w", s.table, err)
+	}
+
+	if err := s.createRetries(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.retries, err)
+	}
+
+	if err := s.createFeedback(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.feedback, err)
+	}
+
+	if err := s.createSummaries(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.summaries, err)
+	}
+
+	if err := s.createSymbols(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.symbols, err)
+	}
+
+	if err := s.createChunks(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.chunks, err)
+	}
+
+	if err := s.createChunkHashes(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.chunkHashes, err)
+	}
+
+	if err := s.createModTimes(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.modTimes, err)
+	}
+
+	if err := s.createDocs(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.docs, err)
+	}
+
+	if err := s.createMultiVectors(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.multiVectors, err)
+	}
+
+	if err := s.createSparse(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.sparse, err)
+	}
+
+	if err := s.createJournal(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.journal, err)
+	}
+
+	if err := s.createEvents(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.events, err)
+	}
+
+	if err := s.createRules(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.rules, err)
+	}
+
+	if err := s.createWork(); err != nil {
+		return nil, fmt.Errorf("failed to create %s table: %w", s.work, err)
+	}
+
+	// Add columns introduced after the table was first created.
+	for _, m := range migrations {
+		if _, err := db.Exec(fmt.Sprintf(m, s.table)); err != nil {
+			return nil, fmt.Errorf("failed to migrate %s table: %w", s.table, err)
+		}
+	}
+	if err := s.normalizeIDs(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to migrate %s table: %w", s.table, err)
 	}
 
-	return &storageService{db: db}
+	return s, nil
+}
+
+// migrations add columns to existing embeddings tables. %s is the table name.
+var migrations = []string{
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS generated BOOLEAN DEFAULT false`,
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS author TEXT DEFAULT ''`,
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS last_commit TEXT DEFAULT ''`,
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS shard TEXT DEFAULT ''`,
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS language TEXT DEFAULT ''`,
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS model TEXT DEFAULT ''`,
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS blamed BOOLEAN DEFAULT false`,
 }
 
+// columns lists the embeddings table columns read by scanEmbedding.
+const columns = "id, hash, embedding, generated, author, last_commit, shard, language, model, blamed"
+
 // Upsert inserts or updates a row.
-func (s *storageService) Upsert(ctx context.Context, id, hash string, vector []float32) error {
+func (s *storageService) Upsert(ctx context.Context, e Embedding) error {
+	defer s.changed()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	// Insert or update the row.
-	upsertSQL := `INSERT INTO embeddings (id, hash, embedding) VALUES (?, ?, ?) 
-		ON CONFLICT(id) DO UPDATE SET hash = excluded.hash, embedding = excluded.embedding;`
+	upsertSQL := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) 
+		ON CONFLICT(id) DO UPDATE SET hash = excluded.hash, embedding = excluded.embedding, generated = excluded.generated,
+		author = excluded.author, last_commit = excluded.last_commit, shard = excluded.shard,
+		language = excluded.language, model = excluded.model, blamed = excluded.blamed;`, s.table, columns)
 
 	// s.mu.Lock()
 	// defer s.mu.Unlock()
 
-	_, err := s.db.ExecContext(ctx, upsertSQL, id, hash, float32SliceToBytes(vector))
+	b, err := s.seal(e.ID, float32SliceToBytes(e.Vector))
+	if err != nil {
+		return fmt.Errorf("Upsert failed: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, upsertSQL, e.ID, e.Hash, b, e.Generated, e.Author, e.LastCommit, e.Shard, e.Language, e.Model, e.Blamed)
 	if err != nil {
 		return fmt.Errorf("Upsert failed: %w", err)
 	}
 	return nil
 }
 
+// IDs lists the ids of every row, or of the rows detected as one of
+// languages when given, without loading their vectors.
+func (s *storageService) IDs(ctx context.Context, languages ...string) ([]string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := "SELECT id FROM " + s.table
+	params := make([]any, len(languages))
+	if len(languages) > 0 {
+		query += " WHERE language IN (?" + strings.Repeat(", ?", len(languages)-1) + ")"
+		for i, lang := range languages {
+			params[i] = lang
+		}
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY id;", params...)
+	if err != nil {
+		return nil, fmt.Errorf("IDs failed: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("IDs scan failed: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Languages counts the rows of each detected language, "" for unknown.
+func (s *storageService) Languages(ctx context.Context) (map[string]int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT language, count(*) FROM "+s.table+" GROUP BY language;")
+	if err != nil {
+		return nil, fmt.Errorf("Languages failed: %w", err)
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var (
+			lang string
+			n    int
+		)
+		if err := rows.Scan(&lang, &n); err != nil {
+			return nil, fmt.Errorf("Languages scan failed: %w", err)
+		}
+		counts[lang] = n
+	}
+	return counts, rows.Err()
+}
+
+// Models counts the rows of each embedding model, "" for untagged rows.
+func (s *storageService) Models(ctx context.Context) (map[string]int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, "SELECT model, count(*) FROM "+s.table+" GROUP BY model;")
+	if err != nil {
+		return nil, fmt.Errorf("Models failed: %w", err)
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var (
+			model string
+			n     int
+		)
+		if err := rows.Scan(&model, &n); err != nil {
+			return nil, fmt.Errorf("Models scan failed: %w", err)
+		}
+		counts[model] = n
+	}
+	return counts, rows.Err()
+}
+
 // Get fetches multiple rows by ids.
 func (s *storageService) Get(ctx context.Context, id []string) ([]Embedding, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	// build query with IN clause or do repeated SELECT.
 	if len(id) == 0 {
 		return nil, nil
 	}
 	// naive approach: SELECT * FROM embeddings WHERE id IN (?,?,?)
-	query := "SELECT id, hash, embedding FROM embeddings WHERE id IN ("
+	query := "SELECT " + columns + " FROM " + s.table + " WHERE id IN ("
 	params := make([]interface{}, 0, len(id))
 	for i, v := range id {
 		if i > 0 {
@@ -106,15 +605,10 @@ func (s *storageService) Get(ctx context.Context, id []string) ([]Embedding, err
 
 	var results []Embedding
 	for rows.Next() {
-		var (
-			e Embedding
-			b []byte
-		)
-		err := rows.Scan(&e.ID, &e.Hash, &b)
+		e, err := s.scanEmbedding(rows)
 		if err != nil {
 			return nil, fmt.Errorf("Get scan failed: %w", err)
 		}
-		e.Vector = bytesToFloat32Slice(b)
 		results = append(results, e)
 	}
 	if rows.Err() != nil {
@@ -125,10 +619,14 @@ func (s *storageService) Get(ctx context.Context, id []string) ([]Embedding, err
 
 // Delete removes a row by key.
 func (s *storageService) Delete(ctx context.Context, id string) error {
+	defer s.changed()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
 	// s.mu.Lock()
 	// defer s.mu.Unlock()
 
-	_, err := s.db.ExecContext(ctx, "DELETE FROM embeddings WHERE id = ?;", id)
+	_, err := s.db.ExecContext(ctx, "DELETE FROM "+s.table+" WHERE id = ?;", id)
 	if err != nil {
 		return fmt.Errorf("Delete failed: %w", err)
 	}
@@ -138,7 +636,10 @@ func (s *storageService) Delete(ctx context.Context, id string) error {
 // MatchHash checks if the given hash matches the stored hash for the given id.
 // Returns true if the hashes match, false if they don't, or an error.
 func (s *storageService) MatchHash(ctx context.Context, id, hash string) (bool, error) {
-	query := "SELECT COALESCE((SELECT CASE WHEN hash = ? THEN 1 ELSE 0 END FROM embeddings WHERE id = ?), 0);"
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	query := "SELECT COALESCE((SELECT CASE WHEN hash = ? THEN 1 ELSE 0 END FROM " + s.table + " WHERE id = ?), 0);"
 
 	var match int
 
@@ -152,12 +653,43 @@ func (s *storageService) MatchHash(ctx context.Context, id, hash string) (bool,
 	return match == 1, nil
 }
 
+// Aliases fetches the rows whose id spells id differently: with backslashes
+// for slashes, as Windows paths, or, when foldCase is set, in another case.
+func (s *storageService) Aliases(ctx context.Context, id string, foldCase bool) ([]Embedding, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	key, spelling := `replace(id, '\', '/')`, id
+	if foldCase {
+		key, spelling = "lower("+key+")", strings.ToLower(id)
+	}
+	query := "SELECT " + columns + " FROM " + s.table + " WHERE " + key + ` = replace(?, '\', '/') AND id <> ?;`
+	rows, err := s.db.QueryContext(ctx, query, spelling, id)
+	if err != nil {
+		return nil, fmt.Errorf("Aliases failed: %w", err)
+	}
+	defer rows.Close()
+
+	var results []Embedding
+	for rows.Next() {
+		e, err := s.scanEmbedding(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Aliases scan failed: %w", err)
+		}
+		results = append(results, e)
+	}
+	return results, rows.Err()
+}
+
 // GetAll fetches all rows from the embeddings table.
 func (s *storageService) GetAll(ctx context.Context) (map[string]Embedding, error) {
+	// Not bounded by the query timeout: loading a large table legitimately
+	// takes a while.
+
 	// s.mu.Lock()
 	// defer s.mu.Unlock()
 
-	rows, err := s.db.QueryContext(ctx, "SELECT id, hash, embedding FROM embeddings;")
+	rows, err := s.db.QueryContext(ctx, "SELECT "+columns+" FROM "+s.table+";")
 	if err != nil {
 		return nil, fmt.Errorf("GetAll failed: %w", err)
 	}
@@ -169,17 +701,10 @@ func (s *storageService) GetAll(ctx context.Context) (map[string]Embedding, erro
 
 	// iterate over rows
 	for rows.Next() {
-		var (
-			e Embedding
-			b []byte
-		)
-		err := rows.Scan(&e.ID, &e.Hash, &b)
+		e, err := s.scanEmbedding(rows)
 		if err != nil {
-			slog.Error("Failed to scan row", "error", err)
-			continue
+			return nil, fmt.Errorf("GetAll scan failed: %w", err)
 		}
-
-		e.Vector = bytesToFloat32Slice(b)
 		results[e.ID] = e
 	}
 
@@ -191,6 +716,65 @@ func (s *storageService) GetAll(ctx context.Context) (map[string]Embedding, erro
 	return results, nil
 }
 
+// scanEmbedding reads the current row, listed in columns order.
+func (s *storageService) scanEmbedding(rows *sql.Rows) (Embedding, error) {
+	var (
+		e Embedding
+		b []byte
+	)
+	if err := rows.Scan(&e.ID, &e.Hash, &b, &e.Generated, &e.Author, &e.LastCommit, &e.Shard, &e.Language, &e.Model, &e.Blamed); err != nil {
+		return e, err
+	}
+	b, err := s.open(e.ID, b)
+	if err != nil {
+		return e, err
+	}
+	e.Vector = bytesToFloat32Slice(b)
+	return e, nil
+}
+
+// withTimeout derives a context bounded by the configured query timeout.
+func (s *storageService) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+// tableName returns the quoted, namespaced name of a table.
+func tableName(base, ns string) string {
+	if ns == "" {
+		return quoteIdent(base)
+	}
+	return quoteIdent(base + "_" + ns)
+}
+
+// quoteIdent quotes a SQL identifier. Namespaces are validated, so names
+// never contain quotes.
+func quoteIdent(name string) string {
+	return `"` + name + `"`
+}
+
+// seal encrypts b when a cipher is configured, binding it to the row id.
+func (s *storageService) seal(id string, b []byte) ([]byte, error) {
+	if s.cipher == nil {
+		return b, nil
+	}
+	return s.cipher.Seal(b, []byte(id))
+}
+
+// open decrypts b when it was sealed. Plaintext rows written before
+// encryption was enabled are returned as-is.
+func (s *storageService) open(id string, b []byte) ([]byte, error) {
+	if !crypt.IsSealed(b) {
+		return b, nil
+	}
+	if s.cipher == nil {
+		return nil, crypt.ErrNoCipher
+	}
+	return s.cipher.Open(b, []byte(id))
+}
+
 // float32SliceToBytes converts []float32 to a binary representation.
 // This is a naive approach. For production, consider carefully handling endianness.
 func float32SliceToBytes(vec []float32) []byte {
@@ -0,0 +1,43 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	store "github.com/codectx/tokens/services/store"
+	"github.com/codectx/tokens/services/store/storetest"
+)
+
+// TestDuckDB runs the conformance checks against the DuckDB service, each
+// on a database file of its own.
+func TestDuckDB(t *testing.T) {
+	dir := t.TempDir()
+	n := 0
+	err := storetest.TestStorageService(context.Background(), func() store.StorageService {
+		n++
+		db, err := sql.Open("duckdb", filepath.Join(dir, fmt.Sprintf("check%d.db", n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		s, err := store.NewStorageService(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestMemory runs the conformance checks against the in-memory service, so
+// that tests of its consumers rely on the behavior of the DuckDB one.
+func TestMemory(t *testing.T) {
+	if err := storetest.TestStorageService(context.Background(), storetest.NewStorageService); err != nil {
+		t.Error(err)
+	}
+}
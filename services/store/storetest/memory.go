@@ -0,0 +1,1159 @@
+package storetest
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	store "github.com/codectx/tokens/services/store"
+)
+
+// memoryService implements store.StorageService in memory.
+type memoryService struct {
+	mu         sync.Mutex
+	embeddings map[string]store.Embedding
+	retries    map[string]store.Retry
+	queries    map[string]string
+	// votes holds the net votes per result, by query id.
+	votes       map[string]map[string]int
+	summaries   map[string]store.Summary
+	symbols     map[string][]store.Symbol
+	symbolFiles map[string]string
+	chunks      map[string][]store.Chunk
+	chunkHashes map[string][]store.ChunkHash
+	modTimes    map[string]time.Time
+	docs        map[string]doc
+	multi       map[string]multiVectors
+	sparse      map[string]sparseVector
+	journal     map[string]store.JournalEntry
+	events      []store.IndexEvent
+	rules       map[string]store.PathRule
+	// work holds the queued files of a distributed indexing run.
+	work map[string]workItem
+	// generation counts the writes that can change search results.
+	generation atomic.Uint64
+}
+
+// workItem is a queued file and the lease of its batch.
+type workItem struct {
+	batch    int64
+	worker   string
+	leased   time.Time
+	attempts int
+}
+
+// doc is the stored vector of the comments of a file.
+type doc struct {
+	hash   string
+	vector []float32
+}
+
+// multiVectors are the stored vectors of the segments of a file.
+type multiVectors struct {
+	hash    string
+	vectors [][]float32
+}
+
+// sparseVector is the stored sparse vector of a file.
+type sparseVector struct {
+	hash  string
+	terms map[uint32]float32
+}
+
+// NewStorageService returns an empty in-memory storage service, behaving
+// like the DuckDB one for consumers to be tested without a database. It is
+// safe for concurrent use and keeps copies of what it is given.
+func NewStorageService() store.StorageService {
+	return &memoryService{
+		embeddings:  map[string]store.Embedding{},
+		retries:     map[string]store.Retry{},
+		queries:     map[string]string{},
+		votes:       map[string]map[string]int{},
+		summaries:   map[string]store.Summary{},
+		symbols:     map[string][]store.Symbol{},
+		symbolFiles: map[string]string{},
+		chunks:      map[string][]store.Chunk{},
+		chunkHashes: map[string][]store.ChunkHash{},
+		modTimes:    map[string]time.Time{},
+		docs:        map[string]doc{},
+		multi:       map[string]multiVectors{},
+		sparse:      map[string]sparseVector{},
+		journal:     map[string]store.JournalEntry{},
+		rules:       map[string]store.PathRule{},
+		work:        map[string]workItem{},
+	}
+}
+
+// lock locks the service unless ctx is done, like a query would fail.
+func (s *memoryService) lock(ctx context.Context, op string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s failed: %w", op, err)
+	}
+	s.mu.Lock()
+	return nil
+}
+
+// Generation counts the writes that can change search results.
+func (s *memoryService) Generation() uint64 {
+	return s.generation.Load()
+}
+
+// changed counts a write that can change search results.
+func (s *memoryService) changed() {
+	s.generation.Add(1)
+}
+
+// Upsert inserts or updates a row.
+func (s *memoryService) Upsert(ctx context.Context, e store.Embedding) error {
+	defer s.changed()
+	if err := s.lock(ctx, "Upsert"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	e.Vector = slices.Clone(e.Vector)
+	s.embeddings[e.ID] = e
+	return nil
+}
+
+// GetAll fetches all rows.
+func (s *memoryService) GetAll(ctx context.Context) (map[string]store.Embedding, error) {
+	if err := s.lock(ctx, "GetAll"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	out := make(map[string]store.Embedding, len(s.embeddings))
+	for id, e := range s.embeddings {
+		out[id] = cloneEmbedding(e)
+	}
+	return out, nil
+}
+
+// Get fetches the rows of the ids found.
+func (s *memoryService) Get(ctx context.Context, ids []string) ([]store.Embedding, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if err := s.lock(ctx, "Get"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var out []store.Embedding
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if e, ok := s.embeddings[id]; ok && !seen[id] {
+			seen[id] = true
+			out = append(out, cloneEmbedding(e))
+		}
+	}
+	return out, nil
+}
+
+// IDs lists the ids of every row, or of the rows detected as one of
+// languages when given, by id.
+func (s *memoryService) IDs(ctx context.Context, languages ...string) ([]string, error) {
+	if err := s.lock(ctx, "IDs"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var ids []string
+	for id, e := range s.embeddings {
+		if len(languages) == 0 || slices.Contains(languages, e.Language) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// Languages counts the rows of each detected language, "" for unknown.
+func (s *memoryService) Languages(ctx context.Context) (map[string]int, error) {
+	if err := s.lock(ctx, "Languages"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	counts := map[string]int{}
+	for _, e := range s.embeddings {
+		counts[e.Language]++
+	}
+	return counts, nil
+}
+
+// Models counts the rows of each embedding model, "" for untagged rows.
+func (s *memoryService) Models(ctx context.Context) (map[string]int, error) {
+	if err := s.lock(ctx, "Models"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	counts := map[string]int{}
+	for _, e := range s.embeddings {
+		counts[e.Model]++
+	}
+	return counts, nil
+}
+
+// MatchHash checks if the given hash matches the stored hash for id, false
+// when there is no row.
+func (s *memoryService) MatchHash(ctx context.Context, id, hash string) (bool, error) {
+	if err := s.lock(ctx, "MatchHash"); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	e, ok := s.embeddings[id]
+	return ok && e.Hash == hash, nil
+}
+
+// Aliases fetches the rows whose id spells id differently: with backslashes
+// for slashes, or, when foldCase is set, in another case.
+func (s *memoryService) Aliases(ctx context.Context, id string, foldCase bool) ([]store.Embedding, error) {
+	if err := s.lock(ctx, "Aliases"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	key := func(id string) string {
+		id = strings.ReplaceAll(id, `\`, "/")
+		if foldCase {
+			id = strings.ToLower(id)
+		}
+		return id
+	}
+	var out []store.Embedding
+	for other, e := range s.embeddings {
+		if other != id && key(other) == key(id) {
+			out = append(out, cloneEmbedding(e))
+		}
+	}
+	return out, nil
+}
+
+// Delete removes a row by id.
+func (s *memoryService) Delete(ctx context.Context, id string) error {
+	defer s.changed()
+	if err := s.lock(ctx, "Delete"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	delete(s.embeddings, id)
+	return nil
+}
+
+// HashIDs lists the ids of the rows embedded from content of hash, by id.
+func (s *memoryService) HashIDs(ctx context.Context, hash string) ([]string, error) {
+	if err := s.lock(ctx, "HashIDs"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var out []string
+	for id, e := range s.embeddings {
+		if e.Hash == hash {
+			out = append(out, id)
+		}
+	}
+	slices.Sort(out)
+	return out, nil
+}
+
+// Hashes lists the ids of every row by the hash of their content, by id.
+func (s *memoryService) Hashes(ctx context.Context) (map[string][]string, error) {
+	if err := s.lock(ctx, "Hashes"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	out := map[string][]string{}
+	for id, e := range s.embeddings {
+		out[e.Hash] = append(out[e.Hash], id)
+	}
+	for _, ids := range out {
+		slices.Sort(ids)
+	}
+	return out, nil
+}
+
+// Rename moves the rows of the file from to the file to, replacing those to
+// had, the path of chunk ids included.
+func (s *memoryService) Rename(ctx context.Context, from, to string) error {
+	defer s.changed()
+	if err := s.lock(ctx, "Rename"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	if e, ok := s.embeddings[from]; ok {
+		e.ID = to
+		s.embeddings[to] = e
+	} else {
+		delete(s.embeddings, to)
+	}
+	delete(s.embeddings, from)
+
+	delete(s.chunks, to)
+	for _, c := range s.chunks[from] {
+		c.File, c.ID = to, to+strings.TrimPrefix(c.ID, from)
+		s.chunks[to] = append(s.chunks[to], c)
+	}
+	delete(s.chunks, from)
+	delete(s.chunkHashes, to)
+	for _, h := range s.chunkHashes[from] {
+		h.File = to
+		s.chunkHashes[to] = append(s.chunkHashes[to], h)
+	}
+	delete(s.chunkHashes, from)
+	delete(s.symbols, to)
+	for _, sym := range s.symbols[from] {
+		sym.ID = to
+		s.symbols[to] = append(s.symbols[to], sym)
+	}
+	delete(s.symbols, from)
+
+	renameKey(s.symbolFiles, from, to)
+	renameKey(s.docs, from, to)
+	renameKey(s.multi, from, to)
+	renameKey(s.sparse, from, to)
+	renameKey(s.modTimes, from, to)
+	delete(s.summaries, store.SummaryFile+":"+to)
+	if sum, ok := s.summaries[store.SummaryFile+":"+from]; ok {
+		sum.ID = to
+		s.summaries[store.SummaryFile+":"+to] = sum
+		delete(s.summaries, store.SummaryFile+":"+from)
+	}
+	for i := range s.events {
+		if s.events[i].ID == from {
+			s.events[i].ID = to
+		}
+	}
+	return nil
+}
+
+// renameKey moves the value of from in m to to, replacing the value of to.
+func renameKey[V any](m map[string]V, from, to string) {
+	delete(m, to)
+	if v, ok := m[from]; ok {
+		m[to] = v
+		delete(m, from)
+	}
+}
+
+// RecordFailure adds id to the retry queue, or counts another failed attempt.
+func (s *memoryService) RecordFailure(ctx context.Context, id string, cause error) error {
+	if err := s.lock(ctx, "RecordFailure"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	r := s.retries[id]
+	r.ID, r.Error, r.LastAttempt = id, cause.Error(), time.Now().UTC()
+	r.Attempts++
+	s.retries[id] = r
+	return nil
+}
+
+// ClearFailure removes id from the retry queue.
+func (s *memoryService) ClearFailure(ctx context.Context, id string) error {
+	if err := s.lock(ctx, "ClearFailure"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	delete(s.retries, id)
+	return nil
+}
+
+// Pending lists the retry queue, oldest failures first.
+func (s *memoryService) Pending(ctx context.Context) ([]store.Retry, error) {
+	if err := s.lock(ctx, "Pending"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var out []store.Retry
+	for _, r := range s.retries {
+		out = append(out, r)
+	}
+	slices.SortFunc(out, func(a, b store.Retry) int {
+		return cmp.Or(a.LastAttempt.Compare(b.LastAttempt), strings.Compare(a.ID, b.ID))
+	})
+	return out, nil
+}
+
+// LogQuery records that query was searched under id, keeping the query
+// first logged under it.
+func (s *memoryService) LogQuery(ctx context.Context, id, query string) error {
+	if err := s.lock(ctx, "LogQuery"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	if _, ok := s.queries[id]; !ok {
+		s.queries[id] = query
+	}
+	return nil
+}
+
+// LoggedQuery returns the query logged under id, and false if there is none.
+func (s *memoryService) LoggedQuery(ctx context.Context, id string) (string, bool, error) {
+	if err := s.lock(ctx, "LoggedQuery"); err != nil {
+		return "", false, err
+	}
+	defer s.mu.Unlock()
+	query, ok := s.queries[id]
+	return query, ok, nil
+}
+
+// RecordFeedback records whether id was a good result of the logged query.
+func (s *memoryService) RecordFeedback(ctx context.Context, queryID, id string, good bool) error {
+	defer s.changed()
+	if err := s.lock(ctx, "RecordFeedback"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	if s.votes[queryID] == nil {
+		s.votes[queryID] = map[string]int{}
+	}
+	if good {
+		s.votes[queryID][id]++
+	} else {
+		s.votes[queryID][id]--
+	}
+	return nil
+}
+
+// Votes returns the net votes per result of the logged query.
+func (s *memoryService) Votes(ctx context.Context, queryID string) (map[string]int, error) {
+	if err := s.lock(ctx, "Votes"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	out := map[string]int{}
+	for id, n := range s.votes[queryID] {
+		out[id] = n
+	}
+	return out, nil
+}
+
+// Judgments lists the net votes of every judged result of logged queries,
+// by query then result.
+func (s *memoryService) Judgments(ctx context.Context) ([]store.Judgment, error) {
+	if err := s.lock(ctx, "Judgments"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var out []store.Judgment
+	for queryID, votes := range s.votes {
+		query, ok := s.queries[queryID]
+		if !ok {
+			continue
+		}
+		for id, n := range votes {
+			out = append(out, store.Judgment{QueryID: queryID, Query: query, ID: id, Votes: n})
+		}
+	}
+	slices.SortFunc(out, func(a, b store.Judgment) int {
+		return cmp.Or(strings.Compare(a.Query, b.Query), strings.Compare(a.ID, b.ID))
+	})
+	return out, nil
+}
+
+// UpsertSummary inserts or updates a summary.
+func (s *memoryService) UpsertSummary(ctx context.Context, sum store.Summary) error {
+	defer s.changed()
+	if err := s.lock(ctx, "UpsertSummary"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	s.summaries[sum.Kind+":"+sum.ID] = cloneSummary(sum)
+	return nil
+}
+
+// Summaries fetches every summary of kind, by id.
+func (s *memoryService) Summaries(ctx context.Context, kind string) ([]store.Summary, error) {
+	if err := s.lock(ctx, "Summaries"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var out []store.Summary
+	for _, sum := range s.summaries {
+		if sum.Kind == kind {
+			out = append(out, cloneSummary(sum))
+		}
+	}
+	slices.SortFunc(out, func(a, b store.Summary) int { return strings.Compare(a.ID, b.ID) })
+	return out, nil
+}
+
+// MatchSummary checks if the summary of kind for id was made from content
+// with the given hash.
+func (s *memoryService) MatchSummary(ctx context.Context, kind, id, hash string) (bool, error) {
+	if err := s.lock(ctx, "MatchSummary"); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	sum, ok := s.summaries[kind+":"+id]
+	return ok && sum.Hash == hash, nil
+}
+
+// DeleteSummary removes the summary of kind for id.
+func (s *memoryService) DeleteSummary(ctx context.Context, kind, id string) error {
+	defer s.changed()
+	if err := s.lock(ctx, "DeleteSummary"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	delete(s.summaries, kind+":"+id)
+	return nil
+}
+
+// ReplaceSymbols replaces the symbols of the file id, read from its content
+// with the given hash.
+func (s *memoryService) ReplaceSymbols(ctx context.Context, id, hash string, symbols []store.Symbol) error {
+	defer s.changed()
+	if err := s.lock(ctx, "ReplaceSymbols"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	syms := make([]store.Symbol, len(symbols))
+	for i, sym := range symbols {
+		sym.ID = id
+		syms[i] = sym
+	}
+	s.symbols[id] = syms
+	s.symbolFiles[id] = hash
+	return nil
+}
+
+// MatchSymbols checks if the symbols of id were read from content with the
+// given hash.
+func (s *memoryService) MatchSymbols(ctx context.Context, id, hash string) (bool, error) {
+	if err := s.lock(ctx, "MatchSymbols"); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	h, ok := s.symbolFiles[id]
+	return ok && h == hash, nil
+}
+
+// FindSymbols fetches the symbols of kind named name, or qualified as in
+// Type.name, in indexed files only, by file then line.
+func (s *memoryService) FindSymbols(ctx context.Context, kind, name string, foldCase bool) ([]store.Symbol, error) {
+	if err := s.lock(ctx, "FindSymbols"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	if foldCase {
+		name = strings.ToLower(name)
+	}
+	var out []store.Symbol
+	for id, syms := range s.symbols {
+		if _, ok := s.embeddings[id]; !ok {
+			continue
+		}
+		for _, sym := range syms {
+			key := sym.Name
+			if foldCase {
+				key = strings.ToLower(key)
+			}
+			if sym.Kind == kind && (key == name || strings.HasSuffix(key, "."+name)) {
+				out = append(out, sym)
+			}
+		}
+	}
+	slices.SortFunc(out, func(a, b store.Symbol) int {
+		return cmp.Or(strings.Compare(a.ID, b.ID), cmp.Compare(a.Line, b.Line))
+	})
+	return out, nil
+}
+
+// SymbolNames lists the distinct names of the symbols of kind in indexed
+// files.
+func (s *memoryService) SymbolNames(ctx context.Context, kind string) ([]string, error) {
+	if err := s.lock(ctx, "SymbolNames"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var out []string
+	for id, syms := range s.symbols {
+		if _, ok := s.embeddings[id]; !ok {
+			continue
+		}
+		for _, sym := range syms {
+			if sym.Kind == kind {
+				out = append(out, sym.Name)
+			}
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out), nil
+}
+
+// ReplaceChunks replaces the chunks of file, removing them when chunks is
+// empty.
+func (s *memoryService) ReplaceChunks(ctx context.Context, file string, chunks []store.Chunk) error {
+	defer s.changed()
+	if err := s.lock(ctx, "ReplaceChunks"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	delete(s.chunks, file)
+	s.addChunks(file, chunks)
+	return nil
+}
+
+// Chunks fetches every stored chunk, by file then line.
+func (s *memoryService) Chunks(ctx context.Context) ([]store.Chunk, error) {
+	if err := s.lock(ctx, "Chunks"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var out []store.Chunk
+	for _, chunks := range s.chunks {
+		for _, c := range chunks {
+			out = append(out, cloneChunk(c))
+		}
+	}
+	slices.SortStableFunc(out, func(a, b store.Chunk) int {
+		return cmp.Or(strings.Compare(a.File, b.File), cmp.Compare(a.StartLine, b.StartLine))
+	})
+	return out, nil
+}
+
+// FileChunks fetches the stored chunks of file, by line.
+func (s *memoryService) FileChunks(ctx context.Context, file string) ([]store.Chunk, error) {
+	if err := s.lock(ctx, "FileChunks"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var out []store.Chunk
+	for _, c := range s.chunks[file] {
+		out = append(out, cloneChunk(c))
+	}
+	slices.SortStableFunc(out, func(a, b store.Chunk) int { return cmp.Compare(a.StartLine, b.StartLine) })
+	return out, nil
+}
+
+// UpdateChunks removes the chunks of file with the ids of remove, then
+// inserts add.
+func (s *memoryService) UpdateChunks(ctx context.Context, file string, remove []string, add []store.Chunk) error {
+	defer s.changed()
+	if err := s.lock(ctx, "UpdateChunks"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	s.chunks[file] = slices.DeleteFunc(s.chunks[file], func(c store.Chunk) bool {
+		return slices.Contains(remove, c.ID)
+	})
+	s.addChunks(file, add)
+	return nil
+}
+
+// addChunks appends copies of chunks to those of file, which they belong
+// to whatever their File.
+func (s *memoryService) addChunks(file string, chunks []store.Chunk) {
+	for _, c := range chunks {
+		c = cloneChunk(c)
+		c.File = file
+		s.chunks[file] = append(s.chunks[file], c)
+	}
+	if len(s.chunks[file]) == 0 {
+		delete(s.chunks, file)
+	}
+}
+
+// ChunkHashes fetches the chunks file was split into, by line.
+func (s *memoryService) ChunkHashes(ctx context.Context, file string) ([]store.ChunkHash, error) {
+	if err := s.lock(ctx, "ChunkHashes"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	out := slices.Clone(s.chunkHashes[file])
+	slices.SortStableFunc(out, func(a, b store.ChunkHash) int { return cmp.Compare(a.StartLine, b.StartLine) })
+	return out, nil
+}
+
+// UpdateChunkHashes removes the chunks of file under the keys of remove,
+// then inserts add.
+func (s *memoryService) UpdateChunkHashes(ctx context.Context, file string, remove []string, add []store.ChunkHash) error {
+	if err := s.lock(ctx, "UpdateChunkHashes"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	hashes := slices.DeleteFunc(s.chunkHashes[file], func(h store.ChunkHash) bool {
+		return slices.Contains(remove, h.Key)
+	})
+	for _, h := range add {
+		h.File = file
+		hashes = append(hashes, h)
+	}
+	if len(hashes) == 0 {
+		delete(s.chunkHashes, file)
+	} else {
+		s.chunkHashes[file] = hashes
+	}
+	return nil
+}
+
+// SetModTime records the modification time of file, in UTC to the
+// microsecond like a TIMESTAMP column.
+func (s *memoryService) SetModTime(ctx context.Context, file string, mtime time.Time) error {
+	if err := s.lock(ctx, "SetModTime"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	s.modTimes[file] = mtime.UTC().Truncate(time.Microsecond)
+	return nil
+}
+
+// ModTimes fetches the modification times recorded for every file.
+func (s *memoryService) ModTimes(ctx context.Context) (map[string]time.Time, error) {
+	if err := s.lock(ctx, "ModTimes"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	out := make(map[string]time.Time, len(s.modTimes))
+	for file, mtime := range s.modTimes {
+		out[file] = mtime
+	}
+	return out, nil
+}
+
+// UpsertDoc stores the vector of the comments of file, read from comments
+// of the given hash.
+func (s *memoryService) UpsertDoc(ctx context.Context, file, hash string, vector []float32) error {
+	defer s.changed()
+	if err := s.lock(ctx, "UpsertDoc"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	s.docs[file] = doc{hash: hash, vector: slices.Clone(vector)}
+	return nil
+}
+
+// MatchDoc reports whether the comments of file were embedded from comments
+// of the given hash.
+func (s *memoryService) MatchDoc(ctx context.Context, file, hash string) (bool, error) {
+	if err := s.lock(ctx, "MatchDoc"); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	d, ok := s.docs[file]
+	return ok && d.hash == hash, nil
+}
+
+// DeleteDoc removes the vector of the comments of file.
+func (s *memoryService) DeleteDoc(ctx context.Context, file string) error {
+	defer s.changed()
+	if err := s.lock(ctx, "DeleteDoc"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	delete(s.docs, file)
+	return nil
+}
+
+// Docs fetches the vectors of the comments of files, of every file when
+// files is empty.
+func (s *memoryService) Docs(ctx context.Context, files ...string) (map[string][]float32, error) {
+	if err := s.lock(ctx, "Docs"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	out := map[string][]float32{}
+	for file, d := range s.docs {
+		if len(files) == 0 || slices.Contains(files, file) {
+			out[file] = slices.Clone(d.vector)
+		}
+	}
+	return out, nil
+}
+
+// ReplaceMultiVectors replaces the segment vectors of file, embedded from
+// text of the given hash, removing them when vectors is empty.
+func (s *memoryService) ReplaceMultiVectors(ctx context.Context, file, hash string, vectors [][]float32) error {
+	defer s.changed()
+	if err := s.lock(ctx, "ReplaceMultiVectors"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	if len(vectors) == 0 {
+		delete(s.multi, file)
+		return nil
+	}
+	m := multiVectors{hash: hash, vectors: make([][]float32, len(vectors))}
+	for i, v := range vectors {
+		m.vectors[i] = slices.Clone(v)
+	}
+	s.multi[file] = m
+	return nil
+}
+
+// MatchMultiVectors reports whether the segment vectors of file were
+// embedded from text of the given hash.
+func (s *memoryService) MatchMultiVectors(ctx context.Context, file, hash string) (bool, error) {
+	if err := s.lock(ctx, "MatchMultiVectors"); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	m, ok := s.multi[file]
+	return ok && m.hash == hash, nil
+}
+
+// MultiVectors fetches the segment vectors of files, in order.
+func (s *memoryService) MultiVectors(ctx context.Context, files ...string) (map[string][][]float32, error) {
+	if err := s.lock(ctx, "MultiVectors"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	out := map[string][][]float32{}
+	for _, file := range files {
+		if m, ok := s.multi[file]; ok {
+			vectors := make([][]float32, len(m.vectors))
+			for i, v := range m.vectors {
+				vectors[i] = slices.Clone(v)
+			}
+			out[file] = vectors
+		}
+	}
+	return out, nil
+}
+
+// UpsertSparse stores the sparse vector of file, by term id, encoded from
+// text of the given hash.
+func (s *memoryService) UpsertSparse(ctx context.Context, file, hash string, terms map[uint32]float32) error {
+	defer s.changed()
+	if err := s.lock(ctx, "UpsertSparse"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	s.sparse[file] = sparseVector{hash: hash, terms: maps.Clone(terms)}
+	return nil
+}
+
+// MatchSparse reports whether the sparse vector of file was encoded from
+// text of the given hash.
+func (s *memoryService) MatchSparse(ctx context.Context, file, hash string) (bool, error) {
+	if err := s.lock(ctx, "MatchSparse"); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	v, ok := s.sparse[file]
+	return ok && v.hash == hash, nil
+}
+
+// Sparse fetches the sparse vectors of files, of every file when files is
+// empty.
+func (s *memoryService) Sparse(ctx context.Context, files ...string) (map[string]map[uint32]float32, error) {
+	if err := s.lock(ctx, "Sparse"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	out := map[string]map[uint32]float32{}
+	for file, v := range s.sparse {
+		if len(files) == 0 || slices.Contains(files, file) {
+			out[file] = maps.Clone(v.terms)
+		}
+	}
+	return out, nil
+}
+
+// SparseMatches returns the dot product of terms with the sparse vector of
+// each file sharing terms with it, when positive.
+func (s *memoryService) SparseMatches(ctx context.Context, terms map[uint32]float32) (map[string]float32, error) {
+	if err := s.lock(ctx, "SparseMatches"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	out := map[string]float32{}
+	for file, v := range s.sparse {
+		var score float32
+		for id, w := range terms {
+			score += w * v.terms[id]
+		}
+		if score > 0 {
+			out[file] = score
+		}
+	}
+	return out, nil
+}
+
+// BeginUpdate journals that the rows of id are about to be rewritten.
+func (s *memoryService) BeginUpdate(ctx context.Context, id, hash string) error {
+	if err := s.lock(ctx, "BeginUpdate"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	s.journal[id] = store.JournalEntry{ID: id, Hash: hash, Started: time.Now().UTC()}
+	return nil
+}
+
+// EndUpdate removes id from the journal.
+func (s *memoryService) EndUpdate(ctx context.Context, id string) error {
+	if err := s.lock(ctx, "EndUpdate"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	delete(s.journal, id)
+	return nil
+}
+
+// Unfinished lists the journaled updates, oldest first.
+func (s *memoryService) Unfinished(ctx context.Context) ([]store.JournalEntry, error) {
+	if err := s.lock(ctx, "Unfinished"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var out []store.JournalEntry
+	for _, e := range s.journal {
+		out = append(out, e)
+	}
+	slices.SortFunc(out, func(a, b store.JournalEntry) int {
+		return cmp.Or(a.Started.Compare(b.Started), strings.Compare(a.ID, b.ID))
+	})
+	return out, nil
+}
+
+// RecordEvent appends e to the history of its file.
+func (s *memoryService) RecordEvent(ctx context.Context, e store.IndexEvent) error {
+	if err := s.lock(ctx, "RecordEvent"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	// Times are kept to the microsecond, as TIMESTAMP columns are, and
+	// durations to the millisecond
+	e.Time = e.Time.UTC().Truncate(time.Microsecond)
+	e.Duration = e.Duration.Truncate(time.Millisecond)
+	var history []int
+	for i, other := range s.events {
+		if other.ID == e.ID {
+			history = append(history, i)
+		}
+	}
+	// the latest event is the last of the latest time
+	slices.SortStableFunc(history, func(i, j int) int { return s.events[i].Time.Compare(s.events[j].Time) })
+	if n := len(history); n > 0 {
+		if last := s.events[history[n-1]]; last.Action == e.Action && last.Hash == e.Hash && last.Detail == e.Detail {
+			return nil
+		}
+	}
+	s.events = append(s.events, e)
+	if drop := len(history) + 1 - store.EventsKept; drop > 0 {
+		dropped := map[int]bool{}
+		for _, i := range history[:drop] {
+			dropped[i] = true
+		}
+		kept := s.events[:0]
+		for i, other := range s.events {
+			if !dropped[i] {
+				kept = append(kept, other)
+			}
+		}
+		s.events = kept
+	}
+	return nil
+}
+
+// Events lists the last limit events of the file id, newest first, all of
+// them when limit is 0.
+func (s *memoryService) Events(ctx context.Context, id string, limit int) ([]store.IndexEvent, error) {
+	if err := s.lock(ctx, "Events"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var out []store.IndexEvent
+	for i := len(s.events) - 1; i >= 0; i-- {
+		if s.events[i].ID == id {
+			out = append(out, s.events[i])
+		}
+	}
+	slices.SortStableFunc(out, func(a, b store.IndexEvent) int { return b.Time.Compare(a.Time) })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// SetPathRule applies rule to the files matching pattern.
+func (s *memoryService) SetPathRule(ctx context.Context, pattern, rule string) error {
+	defer s.changed()
+	if err := s.lock(ctx, "SetPathRule"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	s.rules[pattern] = store.PathRule{Pattern: pattern, Rule: rule, Added: time.Now().UTC().Truncate(time.Microsecond)}
+	return nil
+}
+
+// DeletePathRule removes the rule of pattern, and reports whether it had
+// one.
+func (s *memoryService) DeletePathRule(ctx context.Context, pattern string) (bool, error) {
+	defer s.changed()
+	if err := s.lock(ctx, "DeletePathRule"); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	_, ok := s.rules[pattern]
+	delete(s.rules, pattern)
+	return ok, nil
+}
+
+// PathRules lists the path rules, by pattern.
+func (s *memoryService) PathRules(ctx context.Context) ([]store.PathRule, error) {
+	if err := s.lock(ctx, "PathRules"); err != nil {
+		return nil, err
+	}
+	defer s.mu.Unlock()
+	var out []store.PathRule
+	for _, r := range s.rules {
+		out = append(out, r)
+	}
+	slices.SortFunc(out, func(a, b store.PathRule) int { return strings.Compare(a.Pattern, b.Pattern) })
+	return out, nil
+}
+
+// DropOrphans removes the chunks, symbols, comments and file summaries of
+// files without a row.
+func (s *memoryService) DropOrphans(ctx context.Context) (int, error) {
+	defer s.changed()
+	if err := s.lock(ctx, "DropOrphans"); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+	removed := 0
+	for file, chunks := range s.chunks {
+		if _, ok := s.embeddings[file]; !ok {
+			removed += len(chunks)
+			delete(s.chunks, file)
+		}
+	}
+	for file, hashes := range s.chunkHashes {
+		if _, ok := s.embeddings[file]; !ok {
+			removed += len(hashes)
+			delete(s.chunkHashes, file)
+		}
+	}
+	for id, symbols := range s.symbols {
+		if _, ok := s.embeddings[id]; !ok {
+			removed += len(symbols)
+			delete(s.symbols, id)
+		}
+	}
+	for id := range s.symbolFiles {
+		if _, ok := s.embeddings[id]; !ok {
+			removed++
+			delete(s.symbolFiles, id)
+		}
+	}
+	for file := range s.docs {
+		if _, ok := s.embeddings[file]; !ok {
+			removed++
+			delete(s.docs, file)
+		}
+	}
+	for file, m := range s.multi {
+		if _, ok := s.embeddings[file]; !ok {
+			removed += len(m.vectors)
+			delete(s.multi, file)
+		}
+	}
+	for file := range s.sparse {
+		if _, ok := s.embeddings[file]; !ok {
+			removed++
+			delete(s.sparse, file)
+		}
+	}
+	for key, sum := range s.summaries {
+		if _, ok := s.embeddings[sum.ID]; !ok && sum.Kind == store.SummaryFile {
+			removed++
+			delete(s.summaries, key)
+		}
+	}
+	return removed, nil
+}
+
+// PushWork queues files as a new batch, leaving queued files in theirs.
+func (s *memoryService) PushWork(ctx context.Context, files []string) error {
+	if err := s.lock(ctx, "PushWork"); err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	batch := int64(1)
+	for _, w := range s.work {
+		batch = max(batch, w.batch+1)
+	}
+	for _, f := range files {
+		if _, ok := s.work[f]; !ok {
+			s.work[f] = workItem{batch: batch}
+		}
+	}
+	return nil
+}
+
+// ClaimWork leases the oldest batch not leased, or whose lease expired.
+func (s *memoryService) ClaimWork(ctx context.Context, worker string, lease time.Duration) (store.WorkBatch, bool, error) {
+	if err := s.lock(ctx, "ClaimWork"); err != nil {
+		return store.WorkBatch{}, false, err
+	}
+	defer s.mu.Unlock()
+	now := time.Now()
+	batch := int64(-1)
+	for _, w := range s.work {
+		if (w.leased.IsZero() || w.leased.Before(now)) && (batch < 0 || w.batch < batch) {
+			batch = w.batch
+		}
+	}
+	if batch < 0 {
+		return store.WorkBatch{}, false, nil
+	}
+	b := store.WorkBatch{ID: batch}
+	for f, w := range s.work {
+		if w.batch == batch {
+			w.worker, w.leased = worker, now.Add(lease)
+			w.attempts++
+			s.work[f] = w
+			b.Files = append(b.Files, f)
+			b.Attempts = w.attempts
+		}
+	}
+	return b, true, nil
+}
+
+// FinishWork removes the batch, unless claimed again since b.
+func (s *memoryService) FinishWork(ctx context.Context, worker string, b store.WorkBatch) (bool, error) {
+	if err := s.lock(ctx, "FinishWork"); err != nil {
+		return false, err
+	}
+	defer s.mu.Unlock()
+	found := false
+	for f, w := range s.work {
+		if w.batch == b.ID && w.worker == worker && w.attempts == b.Attempts {
+			delete(s.work, f)
+			found = true
+		}
+	}
+	return found, nil
+}
+
+// WorkLeft counts the queued files.
+func (s *memoryService) WorkLeft(ctx context.Context) (int, error) {
+	if err := s.lock(ctx, "WorkLeft"); err != nil {
+		return 0, err
+	}
+	defer s.mu.Unlock()
+	return len(s.work), nil
+}
+
+func cloneEmbedding(e store.Embedding) store.Embedding {
+	e.Vector = slices.Clone(e.Vector)
+	return e
+}
+
+func cloneSummary(sum store.Summary) store.Summary {
+	sum.Vector = slices.Clone(sum.Vector)
+	sum.Children = append([]string{}, sum.Children...)
+	return sum
+}
+
+func cloneChunk(c store.Chunk) store.Chunk {
+	c.Vector = slices.Clone(c.Vector)
+	return c
+}
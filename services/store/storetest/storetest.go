@@ -0,0 +1,1123 @@
+// Package storetest checks implementations of store.StorageService against
+// the behavior of the DuckDB one, and provides an in-memory implementation
+// for testing their consumers without a database.
+//
+// A backend passes when TestStorageService returns nil:
+//
+//	err := storetest.TestStorageService(ctx, func() store.StorageService {
+//		return pgvector.NewStorageService(freshDatabase())
+//	})
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	store "github.com/codectx/tokens/services/store"
+)
+
+// check is a conformance check run against an empty storage service.
+type check struct {
+	name string
+	run  func(ctx context.Context, s store.StorageService) error
+}
+
+// checks are run in order, each against a storage service of its own.
+var checks = []check{
+	{"embeddings", checkEmbeddings},
+	{"aliases", checkAliases},
+	{"retries", checkRetries},
+	{"feedback", checkFeedback},
+	{"summaries", checkSummaries},
+	{"symbols", checkSymbols},
+	{"chunks", checkChunks},
+	{"chunk hashes", checkChunkHashes},
+	{"mod times", checkModTimes},
+	{"docs", checkDocs},
+	{"multi-vectors", checkMultiVectors},
+	{"sparse", checkSparse},
+	{"journal", checkJournal},
+	{"events", checkEvents},
+	{"path rules", checkPathRules},
+	{"renames", checkRenames},
+	{"orphans", checkOrphans},
+	{"work", checkWork},
+	{"generation", checkGeneration},
+}
+
+// TestStorageService checks that the storage services returned by open
+// behave like the DuckDB one. open must return an empty storage service at
+// each call. The error lists every failed check, nil when all passed.
+func TestStorageService(ctx context.Context, open func() store.StorageService) error {
+	var errs []error
+	for _, c := range checks {
+		if err := c.run(ctx, open()); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expect returns an error describing got when it differs from want.
+func expect(what string, got, want any) error {
+	if reflect.DeepEqual(got, want) {
+		return nil
+	}
+	return fmt.Errorf("%s = %v, want %v", what, got, want)
+}
+
+func checkEmbeddings(ctx context.Context, s store.StorageService) error {
+	a := store.Embedding{ID: "src/a.go", Hash: "h1", Vector: []float32{0.5, -1, 2}, Language: "go"}
+	b := store.Embedding{ID: "lib/b.py", Hash: "h2", Vector: []float32{1, 0}, Generated: true,
+		Author: "Ada", LastCommit: "abc123", Blamed: true, Shard: "lib", Language: "python", Model: "voyage:voyage-code-3"}
+	for _, e := range []store.Embedding{a, b} {
+		if err := s.Upsert(ctx, e); err != nil {
+			return err
+		}
+	}
+	a.Hash, a.Vector = "h3", []float32{3, 4}
+	if err := s.Upsert(ctx, a); err != nil {
+		return err
+	}
+
+	got, err := s.Get(ctx, []string{b.ID, a.ID, "missing"})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(got, func(x, y store.Embedding) int { return strings.Compare(x.ID, y.ID) })
+	if err := expect("Get", got, []store.Embedding{b, a}); err != nil {
+		return err
+	}
+	if got, err := s.Get(ctx, nil); err != nil || len(got) != 0 {
+		return fmt.Errorf("Get of no ids = %v, %v, want none", got, err)
+	}
+	all, err := s.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	if err := expect("GetAll", all, map[string]store.Embedding{a.ID: a, b.ID: b}); err != nil {
+		return err
+	}
+
+	ids, err := s.IDs(ctx)
+	if err != nil {
+		return err
+	}
+	if err := expect("IDs", ids, []string{b.ID, a.ID}); err != nil {
+		return err
+	}
+	if ids, err = s.IDs(ctx, "go", "rust"); err != nil {
+		return err
+	}
+	if err := expect("IDs of go and rust", ids, []string{a.ID}); err != nil {
+		return err
+	}
+	langs, err := s.Languages(ctx)
+	if err != nil {
+		return err
+	}
+	if err := expect("Languages", langs, map[string]int{"go": 1, "python": 1}); err != nil {
+		return err
+	}
+	models, err := s.Models(ctx)
+	if err != nil {
+		return err
+	}
+	if err := expect("Models", models, map[string]int{"": 1, "voyage:voyage-code-3": 1}); err != nil {
+		return err
+	}
+
+	for _, m := range []struct {
+		id, hash string
+		want     bool
+	}{{a.ID, "h3", true}, {a.ID, "h1", false}, {"missing", "h1", false}} {
+		ok, err := s.MatchHash(ctx, m.id, m.hash)
+		if err != nil {
+			return err
+		}
+		if err := expect(fmt.Sprintf("MatchHash(%s, %s)", m.id, m.hash), ok, m.want); err != nil {
+			return err
+		}
+	}
+
+	if err := s.Delete(ctx, a.ID); err != nil {
+		return err
+	}
+	if err := s.Delete(ctx, "missing"); err != nil {
+		return err
+	}
+	if ids, err = s.IDs(ctx); err != nil {
+		return err
+	}
+	return expect("IDs after Delete", ids, []string{b.ID})
+}
+
+func checkAliases(ctx context.Context, s store.StorageService) error {
+	for _, id := range []string{"dir/File.go", `dir\File.go`, "dir/file.go", "dir/other.go"} {
+		if err := s.Upsert(ctx, store.Embedding{ID: id, Hash: "h", Vector: []float32{1}}); err != nil {
+			return err
+		}
+	}
+	for _, a := range []struct {
+		id       string
+		foldCase bool
+		want     []string
+	}{
+		{"dir/File.go", false, []string{`dir\File.go`}},
+		{"dir/File.go", true, []string{"dir/file.go", `dir\File.go`}},
+		{"DIR/FILE.GO", true, []string{"dir/File.go", "dir/file.go", `dir\File.go`}},
+		{"dir/other.go", true, nil},
+	} {
+		got, err := s.Aliases(ctx, a.id, a.foldCase)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for _, e := range got {
+			ids = append(ids, e.ID)
+		}
+		slices.Sort(ids)
+		if err := expect(fmt.Sprintf("Aliases(%s, %t)", a.id, a.foldCase), ids, a.want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkRetries(ctx context.Context, s store.StorageService) error {
+	for _, f := range []struct{ id, cause string }{{"a.go", "timeout"}, {"b.go", "refused"}, {"a.go", "reset"}} {
+		if err := s.RecordFailure(ctx, f.id, errors.New(f.cause)); err != nil {
+			return err
+		}
+		// Timestamps need to tell the attempts apart
+		time.Sleep(2 * time.Millisecond)
+	}
+	pending, err := s.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) != 2 {
+		return fmt.Errorf("Pending = %v, want b.go then a.go", pending)
+	}
+	if pending[0].LastAttempt.After(pending[1].LastAttempt) || pending[1].LastAttempt.IsZero() {
+		return fmt.Errorf("Pending = %v, want oldest failures first", pending)
+	}
+	for i := range pending {
+		pending[i].LastAttempt = time.Time{}
+	}
+	if err := expect("Pending", pending, []store.Retry{{ID: "b.go", Error: "refused", Attempts: 1}, {ID: "a.go", Error: "reset", Attempts: 2}}); err != nil {
+		return err
+	}
+
+	if err := s.ClearFailure(ctx, "a.go"); err != nil {
+		return err
+	}
+	if pending, err = s.Pending(ctx); err != nil {
+		return err
+	}
+	if len(pending) != 1 || pending[0].ID != "b.go" {
+		return fmt.Errorf("Pending after ClearFailure = %v, want b.go", pending)
+	}
+	return nil
+}
+
+func checkFeedback(ctx context.Context, s store.StorageService) error {
+	if _, ok, err := s.LoggedQuery(ctx, "q1"); err != nil || ok {
+		return fmt.Errorf("LoggedQuery of an unknown id = %t, %v, want false", ok, err)
+	}
+	for _, l := range []struct{ id, query string }{{"q1", "retry policy"}, {"q2", "auth"}, {"q1", "other"}} {
+		if err := s.LogQuery(ctx, l.id, l.query); err != nil {
+			return err
+		}
+	}
+	query, ok, err := s.LoggedQuery(ctx, "q1")
+	if err != nil {
+		return err
+	}
+	if err := expect("LoggedQuery(q1)", []any{query, ok}, []any{"retry policy", true}); err != nil {
+		return err
+	}
+
+	for _, v := range []struct {
+		queryID, id string
+		good        bool
+	}{{"q1", "a.go", true}, {"q1", "a.go", true}, {"q1", "b.go", false}, {"q2", "a.go", false}, {"unlogged", "a.go", true}} {
+		if err := s.RecordFeedback(ctx, v.queryID, v.id, v.good); err != nil {
+			return err
+		}
+	}
+	votes, err := s.Votes(ctx, "q1")
+	if err != nil {
+		return err
+	}
+	if err := expect("Votes(q1)", votes, map[string]int{"a.go": 2, "b.go": -1}); err != nil {
+		return err
+	}
+	if votes, err = s.Votes(ctx, "none"); err != nil {
+		return err
+	}
+	if len(votes) != 0 {
+		return fmt.Errorf("Votes of a query without feedback = %v, want none", votes)
+	}
+
+	judgments, err := s.Judgments(ctx)
+	if err != nil {
+		return err
+	}
+	return expect("Judgments", judgments, []store.Judgment{
+		{QueryID: "q2", Query: "auth", ID: "a.go", Votes: -1},
+		{QueryID: "q1", Query: "retry policy", ID: "a.go", Votes: 2},
+		{QueryID: "q1", Query: "retry policy", ID: "b.go", Votes: -1},
+	})
+}
+
+func checkSummaries(ctx context.Context, s store.StorageService) error {
+	file := store.Summary{ID: "pkg/b.go", Kind: store.SummaryFile, Hash: "h1", Text: "Parses flags.", Vector: []float32{1, 2}, Children: []string{}}
+	other := store.Summary{ID: "pkg/a.go", Kind: store.SummaryFile, Hash: "h2", Text: "Runs.", Vector: []float32{3}, Children: []string{}}
+	pkg := store.Summary{ID: "pkg", Kind: store.SummaryPackage, Hash: "h3", Text: "Command line.", Vector: []float32{4}, Children: []string{}}
+	cluster := store.Summary{ID: "c1", Kind: store.SummaryCluster, Hash: "h4", Text: "CLI.", Vector: []float32{5}, Level: 2, Children: []string{"c0", "c2"}}
+	for _, sum := range []store.Summary{file, other, pkg, cluster} {
+		if err := s.UpsertSummary(ctx, sum); err != nil {
+			return err
+		}
+	}
+	file.Hash, file.Text = "h5", "Parses flags and env."
+	if err := s.UpsertSummary(ctx, file); err != nil {
+		return err
+	}
+
+	for kind, want := range map[string][]store.Summary{
+		store.SummaryFile:    {other, file},
+		store.SummaryPackage: {pkg},
+		store.SummaryCluster: {cluster},
+	} {
+		got, err := s.Summaries(ctx, kind)
+		if err != nil {
+			return err
+		}
+		if err := expect("Summaries("+kind+")", got, want); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range []struct {
+		kind, id, hash string
+		want           bool
+	}{{store.SummaryFile, file.ID, "h5", true}, {store.SummaryFile, file.ID, "h1", false}, {store.SummaryPackage, file.ID, "h5", false}} {
+		ok, err := s.MatchSummary(ctx, m.kind, m.id, m.hash)
+		if err != nil {
+			return err
+		}
+		if err := expect(fmt.Sprintf("MatchSummary(%s, %s, %s)", m.kind, m.id, m.hash), ok, m.want); err != nil {
+			return err
+		}
+	}
+
+	if err := s.DeleteSummary(ctx, store.SummaryFile, file.ID); err != nil {
+		return err
+	}
+	got, err := s.Summaries(ctx, store.SummaryFile)
+	if err != nil {
+		return err
+	}
+	return expect("Summaries after DeleteSummary", got, []store.Summary{other})
+}
+
+func checkSymbols(ctx context.Context, s store.StorageService) error {
+	for _, id := range []string{"a.go", "b.go"} {
+		if err := s.Upsert(ctx, store.Embedding{ID: id, Hash: "h", Vector: []float32{1}}); err != nil {
+			return err
+		}
+	}
+	files := map[string][]store.Symbol{
+		"a.go": {
+			{Name: "Parse", Kind: store.SymbolDef, Line: 10},
+			{Name: "Config.parse", Kind: store.SymbolDef, Line: 3},
+			{Name: "Config", Kind: store.SymbolRef, Line: 11},
+		},
+		"b.go": {
+			{Name: "Parse", Kind: store.SymbolRef, Line: 7},
+			{Name: "a_b", Kind: store.SymbolDef, Line: 1},
+			{Name: "T.axb", Kind: store.SymbolDef, Line: 2},
+		},
+		// c.go isn't indexed, so its symbols are never returned
+		"c.go": {{Name: "Parse", Kind: store.SymbolDef, Line: 1}},
+	}
+	for id, syms := range files {
+		if err := s.ReplaceSymbols(ctx, id, "h-"+id, syms); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range []struct {
+		kind, name string
+		foldCase   bool
+		want       []store.Symbol
+	}{
+		{store.SymbolDef, "Parse", false, []store.Symbol{{ID: "a.go", Name: "Parse", Kind: store.SymbolDef, Line: 10}}},
+		{store.SymbolDef, "parse", true, []store.Symbol{
+			{ID: "a.go", Name: "Config.parse", Kind: store.SymbolDef, Line: 3},
+			{ID: "a.go", Name: "Parse", Kind: store.SymbolDef, Line: 10},
+		}},
+		{store.SymbolRef, "Parse", false, []store.Symbol{{ID: "b.go", Name: "Parse", Kind: store.SymbolRef, Line: 7}}},
+		// Names are matched literally, not as LIKE patterns
+		{store.SymbolDef, "a_b", false, []store.Symbol{{ID: "b.go", Name: "a_b", Kind: store.SymbolDef, Line: 1}}},
+		{store.SymbolDef, "%b", false, nil},
+	} {
+		got, err := s.FindSymbols(ctx, f.kind, f.name, f.foldCase)
+		if err != nil {
+			return err
+		}
+		if err := expect(fmt.Sprintf("FindSymbols(%s, %s, %t)", f.kind, f.name, f.foldCase), got, f.want); err != nil {
+			return err
+		}
+	}
+	names, err := s.SymbolNames(ctx, store.SymbolDef)
+	if err != nil {
+		return err
+	}
+	if err := expect("SymbolNames(def)", names, []string{"Config.parse", "Parse", "T.axb", "a_b"}); err != nil {
+		return err
+	}
+
+	if err := s.ReplaceSymbols(ctx, "a.go", "h2", []store.Symbol{{Name: "Run", Kind: store.SymbolDef, Line: 1}}); err != nil {
+		return err
+	}
+	if names, err = s.SymbolNames(ctx, store.SymbolDef); err != nil {
+		return err
+	}
+	if err := expect("SymbolNames after ReplaceSymbols", names, []string{"Run", "T.axb", "a_b"}); err != nil {
+		return err
+	}
+	for _, m := range []struct {
+		id, hash string
+		want     bool
+	}{{"a.go", "h2", true}, {"a.go", "h-a.go", false}, {"c.go", "h-c.go", true}, {"d.go", "", false}} {
+		ok, err := s.MatchSymbols(ctx, m.id, m.hash)
+		if err != nil {
+			return err
+		}
+		if err := expect(fmt.Sprintf("MatchSymbols(%s, %s)", m.id, m.hash), ok, m.want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkChunks(ctx context.Context, s store.StorageService) error {
+	b1 := store.Chunk{ID: "b.go#Run@1", File: "b.go", StartLine: 20, EndLine: 30, Vector: []float32{1}}
+	b2 := store.Chunk{ID: "b.go#main@1", File: "b.go", StartLine: 1, EndLine: 19, Vector: []float32{2, 3}}
+	a1 := store.Chunk{ID: "a.go#A@1", File: "a.go", StartLine: 5, EndLine: 9, Vector: []float32{4}}
+	if err := s.ReplaceChunks(ctx, "b.go", []store.Chunk{b1, b2}); err != nil {
+		return err
+	}
+	if err := s.ReplaceChunks(ctx, "a.go", []store.Chunk{a1}); err != nil {
+		return err
+	}
+
+	got, err := s.FileChunks(ctx, "b.go")
+	if err != nil {
+		return err
+	}
+	if err := expect("FileChunks(b.go)", got, []store.Chunk{b2, b1}); err != nil {
+		return err
+	}
+	if got, err = s.Chunks(ctx); err != nil {
+		return err
+	}
+	if err := expect("Chunks", got, []store.Chunk{a1, b2, b1}); err != nil {
+		return err
+	}
+
+	b3 := store.Chunk{ID: "b.go#Run@2", File: "b.go", StartLine: 20, EndLine: 31, Vector: []float32{5}}
+	if err := s.UpdateChunks(ctx, "b.go", []string{b1.ID, "b.go#gone@1"}, []store.Chunk{b3}); err != nil {
+		return err
+	}
+	if got, err = s.FileChunks(ctx, "b.go"); err != nil {
+		return err
+	}
+	if err := expect("FileChunks after UpdateChunks", got, []store.Chunk{b2, b3}); err != nil {
+		return err
+	}
+
+	if err := s.ReplaceChunks(ctx, "b.go", nil); err != nil {
+		return err
+	}
+	if got, err = s.Chunks(ctx); err != nil {
+		return err
+	}
+	return expect("Chunks after ReplaceChunks with none", got, []store.Chunk{a1})
+}
+
+func checkChunkHashes(ctx context.Context, s store.StorageService) error {
+	run := store.ChunkHash{File: "a.go", Key: "Run", Hash: "h1", StartLine: 12, EndLine: 20, Author: "Ada", LastCommit: "abc123"}
+	main := store.ChunkHash{File: "a.go", Key: "main", Hash: "h2", StartLine: 1, EndLine: 11}
+	other := store.ChunkHash{File: "b.go", Key: "main", Hash: "h3", StartLine: 1, EndLine: 5}
+	if err := s.UpdateChunkHashes(ctx, "a.go", nil, []store.ChunkHash{run, main}); err != nil {
+		return err
+	}
+	if err := s.UpdateChunkHashes(ctx, "b.go", nil, []store.ChunkHash{other}); err != nil {
+		return err
+	}
+	got, err := s.ChunkHashes(ctx, "a.go")
+	if err != nil {
+		return err
+	}
+	if err := expect("ChunkHashes(a.go)", got, []store.ChunkHash{main, run}); err != nil {
+		return err
+	}
+
+	run2 := store.ChunkHash{File: "a.go", Key: "Run~1", Hash: "h4", StartLine: 21, EndLine: 22}
+	if err := s.UpdateChunkHashes(ctx, "a.go", []string{"main"}, []store.ChunkHash{run2}); err != nil {
+		return err
+	}
+	if got, err = s.ChunkHashes(ctx, "a.go"); err != nil {
+		return err
+	}
+	if err := expect("ChunkHashes after UpdateChunkHashes", got, []store.ChunkHash{run, run2}); err != nil {
+		return err
+	}
+	if got, err = s.ChunkHashes(ctx, "b.go"); err != nil {
+		return err
+	}
+	return expect("ChunkHashes(b.go)", got, []store.ChunkHash{other})
+}
+
+func checkModTimes(ctx context.Context, s store.StorageService) error {
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	a := time.Date(2024, 3, 1, 12, 30, 15, 123456789, zone)
+	b := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	for file, mtime := range map[string]time.Time{"a.go": b, "b.go": b} {
+		if err := s.SetModTime(ctx, file, mtime); err != nil {
+			return err
+		}
+	}
+	if err := s.SetModTime(ctx, "a.go", a); err != nil {
+		return err
+	}
+	got, err := s.ModTimes(ctx)
+	if err != nil {
+		return err
+	}
+	// Times are kept to the microsecond, as TIMESTAMP columns are
+	want := map[string]time.Time{"a.go": a.Truncate(time.Microsecond), "b.go": b}
+	if !maps.EqualFunc(got, want, time.Time.Equal) {
+		return fmt.Errorf("ModTimes = %v, want %v", got, want)
+	}
+	return nil
+}
+
+func checkDocs(ctx context.Context, s store.StorageService) error {
+	for _, d := range []struct {
+		file, hash string
+		vector     []float32
+	}{{"a.go", "h1", []float32{1, 2}}, {"b.go", "h2", []float32{3}}, {"a.go", "h3", []float32{4, 5}}} {
+		if err := s.UpsertDoc(ctx, d.file, d.hash, d.vector); err != nil {
+			return err
+		}
+	}
+	for _, m := range []struct {
+		file, hash string
+		want       bool
+	}{{"a.go", "h3", true}, {"a.go", "h1", false}, {"c.go", "h1", false}} {
+		ok, err := s.MatchDoc(ctx, m.file, m.hash)
+		if err != nil {
+			return err
+		}
+		if err := expect(fmt.Sprintf("MatchDoc(%s, %s)", m.file, m.hash), ok, m.want); err != nil {
+			return err
+		}
+	}
+
+	docs, err := s.Docs(ctx)
+	if err != nil {
+		return err
+	}
+	if err := expect("Docs", docs, map[string][]float32{"a.go": {4, 5}, "b.go": {3}}); err != nil {
+		return err
+	}
+	if docs, err = s.Docs(ctx, "b.go", "c.go"); err != nil {
+		return err
+	}
+	if err := expect("Docs(b.go, c.go)", docs, map[string][]float32{"b.go": {3}}); err != nil {
+		return err
+	}
+
+	if err := s.DeleteDoc(ctx, "a.go"); err != nil {
+		return err
+	}
+	if docs, err = s.Docs(ctx); err != nil {
+		return err
+	}
+	return expect("Docs after DeleteDoc", docs, map[string][]float32{"b.go": {3}})
+}
+
+func checkMultiVectors(ctx context.Context, s store.StorageService) error {
+	for _, m := range []struct {
+		file, hash string
+		vectors    [][]float32
+	}{{"a.go", "h1", [][]float32{{1}, {2}, {3}}}, {"b.go", "h2", [][]float32{{4}}}, {"a.go", "h3", [][]float32{{5}, {6}}}} {
+		if err := s.ReplaceMultiVectors(ctx, m.file, m.hash, m.vectors); err != nil {
+			return err
+		}
+	}
+	for _, m := range []struct {
+		file, hash string
+		want       bool
+	}{{"a.go", "h3", true}, {"a.go", "h1", false}, {"c.go", "h1", false}} {
+		ok, err := s.MatchMultiVectors(ctx, m.file, m.hash)
+		if err != nil {
+			return err
+		}
+		if err := expect(fmt.Sprintf("MatchMultiVectors(%s, %s)", m.file, m.hash), ok, m.want); err != nil {
+			return err
+		}
+	}
+
+	multi, err := s.MultiVectors(ctx, "a.go", "b.go", "c.go")
+	if err != nil {
+		return err
+	}
+	if err := expect("MultiVectors", multi, map[string][][]float32{"a.go": {{5}, {6}}, "b.go": {{4}}}); err != nil {
+		return err
+	}
+
+	if err := s.ReplaceMultiVectors(ctx, "a.go", "h4", nil); err != nil {
+		return err
+	}
+	if multi, err = s.MultiVectors(ctx, "a.go", "b.go"); err != nil {
+		return err
+	}
+	return expect("MultiVectors after removal", multi, map[string][][]float32{"b.go": {{4}}})
+}
+
+func checkSparse(ctx context.Context, s store.StorageService) error {
+	for _, v := range []struct {
+		file, hash string
+		terms      map[uint32]float32
+	}{{"a.go", "h1", map[uint32]float32{1: 0.5}}, {"b.go", "h2", map[uint32]float32{7: 1, 3: 2.5}}, {"a.go", "h3", map[uint32]float32{2: 1.5, 9: 0.25}}} {
+		if err := s.UpsertSparse(ctx, v.file, v.hash, v.terms); err != nil {
+			return err
+		}
+	}
+	for _, m := range []struct {
+		file, hash string
+		want       bool
+	}{{"a.go", "h3", true}, {"a.go", "h1", false}, {"c.go", "h1", false}} {
+		ok, err := s.MatchSparse(ctx, m.file, m.hash)
+		if err != nil {
+			return err
+		}
+		if err := expect(fmt.Sprintf("MatchSparse(%s, %s)", m.file, m.hash), ok, m.want); err != nil {
+			return err
+		}
+	}
+
+	sparse, err := s.Sparse(ctx)
+	if err != nil {
+		return err
+	}
+	if err := expect("Sparse", sparse, map[string]map[uint32]float32{"a.go": {2: 1.5, 9: 0.25}, "b.go": {3: 2.5, 7: 1}}); err != nil {
+		return err
+	}
+	if sparse, err = s.Sparse(ctx, "b.go", "c.go"); err != nil {
+		return err
+	}
+	if err := expect("Sparse(b.go, c.go)", sparse, map[string]map[uint32]float32{"b.go": {3: 2.5, 7: 1}}); err != nil {
+		return err
+	}
+
+	matches, err := s.SparseMatches(ctx, map[uint32]float32{2: 2, 3: 1, 5: 1})
+	if err != nil {
+		return err
+	}
+	if err := expect("SparseMatches", matches, map[string]float32{"a.go": 3, "b.go": 2.5}); err != nil {
+		return err
+	}
+	// the matches follow writes
+	if err := s.UpsertSparse(ctx, "b.go", "h4", map[uint32]float32{5: 4}); err != nil {
+		return err
+	}
+	if matches, err = s.SparseMatches(ctx, map[uint32]float32{3: 1, 5: 1}); err != nil {
+		return err
+	}
+	return expect("SparseMatches after an update", matches, map[string]float32{"b.go": 4})
+}
+
+func checkJournal(ctx context.Context, s store.StorageService) error {
+	for _, u := range []struct{ id, hash string }{{"a.go", "h1"}, {"b.go", "h2"}, {"a.go", "h3"}} {
+		if err := s.BeginUpdate(ctx, u.id, u.hash); err != nil {
+			return err
+		}
+		// Timestamps need to tell the updates apart
+		time.Sleep(2 * time.Millisecond)
+	}
+	unfinished, err := s.Unfinished(ctx)
+	if err != nil {
+		return err
+	}
+	if len(unfinished) != 2 || unfinished[1].Started.IsZero() || unfinished[0].Started.After(unfinished[1].Started) {
+		return fmt.Errorf("Unfinished = %v, want b.go then a.go, oldest first", unfinished)
+	}
+	for i := range unfinished {
+		unfinished[i].Started = time.Time{}
+	}
+	if err := expect("Unfinished", unfinished, []store.JournalEntry{{ID: "b.go", Hash: "h2"}, {ID: "a.go", Hash: "h3"}}); err != nil {
+		return err
+	}
+
+	for _, id := range []string{"a.go", "c.go"} {
+		if err := s.EndUpdate(ctx, id); err != nil {
+			return err
+		}
+	}
+	if unfinished, err = s.Unfinished(ctx); err != nil {
+		return err
+	}
+	if len(unfinished) != 1 || unfinished[0].ID != "b.go" {
+		return fmt.Errorf("Unfinished after EndUpdate = %v, want b.go", unfinished)
+	}
+	return nil
+}
+
+func checkEvents(ctx context.Context, s store.StorageService) error {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	embedded := store.IndexEvent{ID: "a.go", Time: at, Action: "embedded", Duration: 1500 * time.Millisecond,
+		Tokens: 42, Provider: "fake:64", Hash: "h1"}
+	failed := store.IndexEvent{ID: "a.go", Time: at.Add(time.Minute), Action: "failed", Hash: "h2", Detail: "timeout"}
+	other := store.IndexEvent{ID: "b.go", Time: at, Action: "skipped", Detail: "generated"}
+	for _, e := range []store.IndexEvent{embedded, failed, other} {
+		if err := s.RecordEvent(ctx, e); err != nil {
+			return err
+		}
+	}
+	events, err := s.Events(ctx, "a.go", 0)
+	if err != nil {
+		return err
+	}
+	if err := expect("Events", events, []store.IndexEvent{failed, embedded}); err != nil {
+		return err
+	}
+	if events, err = s.Events(ctx, "a.go", 1); err != nil {
+		return err
+	}
+	if err := expect("Events with a limit", events, []store.IndexEvent{failed}); err != nil {
+		return err
+	}
+
+	// Events recorded without a time happen now
+	if err := s.RecordEvent(ctx, store.IndexEvent{ID: "c.go", Action: "embedded"}); err != nil {
+		return err
+	}
+	if events, err = s.Events(ctx, "c.go", 0); err != nil {
+		return err
+	}
+	if len(events) != 1 || time.Since(events[0].Time) > time.Minute {
+		return fmt.Errorf("Events of an event recorded without a time = %v, want one of now", events)
+	}
+	if events, err = s.Events(ctx, "missing.go", 0); err != nil || len(events) != 0 {
+		return fmt.Errorf("Events of a file without any = %v, %v, want none", events, err)
+	}
+
+	// Only changes are recorded, and the latest events kept
+	again := failed
+	again.Time = at.Add(2 * time.Minute)
+	if err := s.RecordEvent(ctx, again); err != nil {
+		return err
+	}
+	if events, err = s.Events(ctx, "a.go", 0); err != nil {
+		return err
+	}
+	if err := expect("Events after the same failure", events, []store.IndexEvent{failed, embedded}); err != nil {
+		return err
+	}
+	for i := range store.EventsKept {
+		e := store.IndexEvent{ID: "d.go", Time: at.Add(time.Duration(i) * time.Second), Action: "embedded", Hash: fmt.Sprint(i)}
+		if err := s.RecordEvent(ctx, e); err != nil {
+			return err
+		}
+	}
+	last := store.IndexEvent{ID: "d.go", Time: at.Add(time.Hour), Action: "failed", Hash: "x"}
+	if err := s.RecordEvent(ctx, last); err != nil {
+		return err
+	}
+	if events, err = s.Events(ctx, "d.go", 0); err != nil {
+		return err
+	}
+	if len(events) != store.EventsKept || events[0] != last || events[len(events)-1].Hash != "1" {
+		return fmt.Errorf("Events of a file past EventsKept = %d events from %v to %v, want %d from the latest to hash 1", len(events), events[0], events[len(events)-1], store.EventsKept)
+	}
+	return nil
+}
+
+func checkPathRules(ctx context.Context, s store.StorageService) error {
+	for _, r := range []struct{ pattern, rule string }{
+		{"vendor/", store.RuleExclude}, {"gen/api.go", store.RuleExclude}, {"gen/api.go", store.RulePin},
+	} {
+		if err := s.SetPathRule(ctx, r.pattern, r.rule); err != nil {
+			return err
+		}
+	}
+	rules, err := s.PathRules(ctx)
+	if err != nil {
+		return err
+	}
+	if len(rules) != 2 || rules[0].Added.IsZero() {
+		return fmt.Errorf("PathRules = %v, want gen/api.go then vendor/, with the time they were added", rules)
+	}
+	for i := range rules {
+		rules[i].Added = time.Time{}
+	}
+	want := []store.PathRule{{Pattern: "gen/api.go", Rule: store.RulePin}, {Pattern: "vendor/", Rule: store.RuleExclude}}
+	if err := expect("PathRules", rules, want); err != nil {
+		return err
+	}
+
+	for _, d := range []struct {
+		pattern string
+		had     bool
+	}{{"vendor/", true}, {"vendor/", false}} {
+		had, err := s.DeletePathRule(ctx, d.pattern)
+		if err != nil {
+			return err
+		}
+		if had != d.had {
+			return fmt.Errorf("DeletePathRule(%q) = %v, want %v", d.pattern, had, d.had)
+		}
+	}
+	if rules, err = s.PathRules(ctx); err != nil {
+		return err
+	}
+	if len(rules) != 1 || rules[0].Pattern != "gen/api.go" {
+		return fmt.Errorf("PathRules after DeletePathRule = %v, want gen/api.go", rules)
+	}
+	return nil
+}
+
+func checkRenames(ctx context.Context, s store.StorageService) error {
+	old := store.Embedding{ID: "old/a.go", Hash: "h1", Vector: []float32{1, 2}, Language: "go", Model: "fake:2"}
+	// new/a.go holds a stale row, replaced by the move
+	stale := store.Embedding{ID: "new/a.go", Hash: "h0", Vector: []float32{3, 4}}
+	for _, e := range []store.Embedding{old, stale} {
+		if err := s.Upsert(ctx, e); err != nil {
+			return err
+		}
+	}
+	if err := s.ReplaceChunks(ctx, "old/a.go", []store.Chunk{{ID: "old/a.go#main@abc", File: "old/a.go", StartLine: 1, EndLine: 9, Vector: []float32{1}}}); err != nil {
+		return err
+	}
+	if err := s.ReplaceChunks(ctx, "new/a.go", []store.Chunk{{ID: "new/a.go#init@def", File: "new/a.go", StartLine: 1, EndLine: 2, Vector: []float32{2}}}); err != nil {
+		return err
+	}
+	if err := s.UpdateChunkHashes(ctx, "old/a.go", nil, []store.ChunkHash{{File: "old/a.go", Key: "main", Hash: "abc", StartLine: 1, EndLine: 9}}); err != nil {
+		return err
+	}
+	if err := s.ReplaceSymbols(ctx, "old/a.go", "h1", []store.Symbol{{ID: "old/a.go", Name: "main", Kind: store.SymbolDef, Line: 3}}); err != nil {
+		return err
+	}
+	if err := s.UpsertDoc(ctx, "old/a.go", "d1", []float32{5}); err != nil {
+		return err
+	}
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := s.SetModTime(ctx, "old/a.go", mtime); err != nil {
+		return err
+	}
+	if err := s.RecordEvent(ctx, store.IndexEvent{ID: "old/a.go", Time: mtime, Action: "embedded", Hash: "h1"}); err != nil {
+		return err
+	}
+
+	ids, err := s.HashIDs(ctx, "h1")
+	if err != nil {
+		return err
+	}
+	if err := expect("HashIDs", ids, []string{"old/a.go"}); err != nil {
+		return err
+	}
+	byHash, err := s.Hashes(ctx)
+	if err != nil {
+		return err
+	}
+	if err := expect("Hashes", byHash["h1"], []string{"old/a.go"}); err != nil {
+		return err
+	}
+	if err := s.Rename(ctx, "old/a.go", "new/a.go"); err != nil {
+		return err
+	}
+
+	rows, err := s.Get(ctx, []string{"old/a.go", "new/a.go"})
+	if err != nil {
+		return err
+	}
+	moved := old
+	moved.ID = "new/a.go"
+	if err := expect("Get after Rename", rows, []store.Embedding{moved}); err != nil {
+		return err
+	}
+	chunks, err := s.Chunks(ctx)
+	if err != nil {
+		return err
+	}
+	if err := expect("Chunks after Rename", chunks, []store.Chunk{{ID: "new/a.go#main@abc", File: "new/a.go", StartLine: 1, EndLine: 9, Vector: []float32{1}}}); err != nil {
+		return err
+	}
+	hashes, err := s.ChunkHashes(ctx, "new/a.go")
+	if err != nil {
+		return err
+	}
+	if err := expect("ChunkHashes after Rename", hashes, []store.ChunkHash{{File: "new/a.go", Key: "main", Hash: "abc", StartLine: 1, EndLine: 9}}); err != nil {
+		return err
+	}
+	if match, err := s.MatchSymbols(ctx, "new/a.go", "h1"); err != nil || !match {
+		return fmt.Errorf("MatchSymbols after Rename = %v, %v, want true", match, err)
+	}
+	syms, err := s.FindSymbols(ctx, store.SymbolDef, "main", false)
+	if err != nil {
+		return err
+	}
+	if len(syms) != 1 || syms[0].ID != "new/a.go" {
+		return fmt.Errorf("FindSymbols after Rename = %v, want main in new/a.go", syms)
+	}
+	if match, err := s.MatchDoc(ctx, "new/a.go", "d1"); err != nil || !match {
+		return fmt.Errorf("MatchDoc after Rename = %v, %v, want true", match, err)
+	}
+	mtimes, err := s.ModTimes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(mtimes) != 1 || !mtimes["new/a.go"].Equal(mtime) {
+		return fmt.Errorf("ModTimes after Rename = %v, want new/a.go at %v", mtimes, mtime)
+	}
+	events, err := s.Events(ctx, "new/a.go", 0)
+	if err != nil {
+		return err
+	}
+	if len(events) != 1 || events[0].Hash != "h1" {
+		return fmt.Errorf("Events after Rename = %v, want the history of old/a.go", events)
+	}
+	if ids, err = s.HashIDs(ctx, "h0"); err != nil || len(ids) != 0 {
+		return fmt.Errorf("HashIDs of the replaced row = %v, %v, want none", ids, err)
+	}
+	return nil
+}
+
+func checkOrphans(ctx context.Context, s store.StorageService) error {
+	if err := s.Upsert(ctx, store.Embedding{ID: "a.go", Hash: "h1", Vector: []float32{1}}); err != nil {
+		return err
+	}
+	// b.go has no row: its chunks, symbols, comments, segments, sparse vector
+	// and file summary are orphans, its package summary and modification
+	// time are not
+	for _, file := range []string{"a.go", "b.go"} {
+		chunks := []store.Chunk{
+			{ID: file + "#main@1", File: file, StartLine: 1, EndLine: 9, Vector: []float32{1}},
+			{ID: file + "#Run@1", File: file, StartLine: 10, EndLine: 20, Vector: []float32{2}},
+		}
+		if err := s.ReplaceChunks(ctx, file, chunks); err != nil {
+			return err
+		}
+		if err := s.UpdateChunkHashes(ctx, file, nil, []store.ChunkHash{{File: file, Key: "main", Hash: "h1", StartLine: 1, EndLine: 9}}); err != nil {
+			return err
+		}
+		if err := s.ReplaceSymbols(ctx, file, "h1", []store.Symbol{{Name: "Run", Kind: store.SymbolDef, Line: 10}}); err != nil {
+			return err
+		}
+		if err := s.UpsertDoc(ctx, file, "h1", []float32{3}); err != nil {
+			return err
+		}
+		if err := s.ReplaceMultiVectors(ctx, file, "h1", [][]float32{{4}}); err != nil {
+			return err
+		}
+		if err := s.UpsertSparse(ctx, file, "h1", map[uint32]float32{5: 1}); err != nil {
+			return err
+		}
+		if err := s.UpsertSummary(ctx, store.Summary{ID: file, Kind: store.SummaryFile, Hash: "h1", Text: file + "."}); err != nil {
+			return err
+		}
+	}
+	if err := s.UpsertSummary(ctx, store.Summary{ID: "b.go", Kind: store.SummaryPackage, Hash: "h1", Text: "b."}); err != nil {
+		return err
+	}
+	if err := s.SetModTime(ctx, "b.go", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		return err
+	}
+
+	removed, err := s.DropOrphans(ctx)
+	if err != nil {
+		return err
+	}
+	// two chunks, a chunk hash, a symbol and its file, a comment, a segment,
+	// a sparse vector, a summary
+	if err := expect("DropOrphans", removed, 9); err != nil {
+		return err
+	}
+
+	chunks, err := s.Chunks(ctx)
+	if err != nil {
+		return err
+	}
+	files := map[string]bool{}
+	for _, c := range chunks {
+		files[c.File] = true
+	}
+	if err := expect("files of Chunks", files, map[string]bool{"a.go": true}); err != nil {
+		return err
+	}
+	hashes, err := s.ChunkHashes(ctx, "b.go")
+	if err != nil {
+		return err
+	}
+	if len(hashes) != 0 {
+		return fmt.Errorf("ChunkHashes(b.go) = %v, want none", hashes)
+	}
+	defs, err := s.FindSymbols(ctx, store.SymbolDef, "Run", false)
+	if err != nil {
+		return err
+	}
+	if len(defs) != 1 || defs[0].ID != "a.go" {
+		return fmt.Errorf("FindSymbols(Run) = %v, want a.go only", defs)
+	}
+	if ok, err := s.MatchSymbols(ctx, "b.go", "h1"); err != nil || ok {
+		return fmt.Errorf("MatchSymbols(b.go) = %v, %v, want false", ok, err)
+	}
+	docs, err := s.Docs(ctx)
+	if err != nil {
+		return err
+	}
+	if err := expect("Docs", docs, map[string][]float32{"a.go": {3}}); err != nil {
+		return err
+	}
+	for kind, want := range map[string][]string{store.SummaryFile: {"a.go"}, store.SummaryPackage: {"b.go"}} {
+		sums, err := s.Summaries(ctx, kind)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for _, sum := range sums {
+			ids = append(ids, sum.ID)
+		}
+		if err := expect("Summaries("+kind+")", ids, want); err != nil {
+			return err
+		}
+	}
+	mtimes, err := s.ModTimes(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := mtimes["b.go"]; !ok {
+		return fmt.Errorf("ModTimes = %v, want b.go kept", mtimes)
+	}
+
+	if removed, err = s.DropOrphans(ctx); err != nil {
+		return err
+	}
+	return expect("DropOrphans again", removed, 0)
+}
+
+func checkWork(ctx context.Context, s store.StorageService) error {
+	for _, files := range [][]string{{"a.go", "b.go"}, {"c.go", "a.go"}} {
+		if err := s.PushWork(ctx, files); err != nil {
+			return err
+		}
+	}
+	left, err := s.WorkLeft(ctx)
+	if err != nil {
+		return err
+	}
+	if err := expect("WorkLeft", left, 3); err != nil {
+		return err
+	}
+
+	first, ok, err := s.ClaimWork(ctx, "w1", time.Minute)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("ClaimWork found no batch")
+	}
+	slices.Sort(first.Files)
+	if err := expect("ClaimWork", first.Files, []string{"a.go", "b.go"}); err != nil {
+		return err
+	}
+	// the first batch is leased, the second is next; a.go stays in the first
+	second, _, err := s.ClaimWork(ctx, "w2", 200*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	if err := expect("second ClaimWork", second.Files, []string{"c.go"}); err != nil {
+		return err
+	}
+	if _, ok, err = s.ClaimWork(ctx, "w3", time.Minute); err != nil {
+		return err
+	}
+	if ok {
+		return errors.New("ClaimWork leased a leased batch")
+	}
+
+	// the lease of w2 expires, the batch is claimed again
+	time.Sleep(300 * time.Millisecond)
+	again, ok, err := s.ClaimWork(ctx, "w3", time.Minute)
+	if err != nil {
+		return err
+	}
+	if err := expect("ClaimWork of an expired lease", []any{ok, again.ID, again.Attempts}, []any{true, second.ID, 2}); err != nil {
+		return err
+	}
+
+	// w2 finishes late: its batch is w3's now
+	if ok, err = s.FinishWork(ctx, "w2", second); err != nil {
+		return err
+	}
+	if ok {
+		return errors.New("FinishWork removed a batch claimed again")
+	}
+	for _, c := range []struct {
+		worker string
+		b      store.WorkBatch
+	}{{"w1", first}, {"w3", again}} {
+		if ok, err = s.FinishWork(ctx, c.worker, c.b); err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("FinishWork(%s, %d) found no batch", c.worker, c.b.ID)
+		}
+	}
+	if left, err = s.WorkLeft(ctx); err != nil {
+		return err
+	}
+	return expect("WorkLeft after FinishWork", left, 0)
+}
+
+func checkGeneration(ctx context.Context, s store.StorageService) error {
+	g := s.Generation()
+	if err := s.LogQuery(ctx, "q1", "retry"); err != nil {
+		return err
+	}
+	if err := s.RecordEvent(ctx, store.IndexEvent{ID: "a.go", Action: "skipped"}); err != nil {
+		return err
+	}
+	if err := expect("Generation after logging", s.Generation(), g); err != nil {
+		return err
+	}
+	for _, write := range []func() error{
+		func() error { return s.Upsert(ctx, store.Embedding{ID: "a.go", Hash: "h1", Vector: []float32{1}}) },
+		func() error { return s.RecordFeedback(ctx, "q1", "a.go", true) },
+		func() error { return s.SetPathRule(ctx, "a.go", store.RulePin) },
+		func() error { return s.Delete(ctx, "a.go") },
+	} {
+		if err := write(); err != nil {
+			return err
+		}
+		next := s.Generation()
+		if next <= g {
+			return fmt.Errorf("Generation after a write = %d, want more than %d", next, g)
+		}
+		g = next
+	}
+	return nil
+}
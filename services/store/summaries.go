@@ -0,0 +1,155 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Kinds of summaries.
+const (
+	// SummaryFile summarizes a file, its id being the file's.
+	SummaryFile = "file"
+	// SummaryPackage summarizes a directory from the summaries of its
+	// files, its id being the directory's.
+	SummaryPackage = "package"
+	// SummaryCluster summarizes a cluster of similar files, or of clusters
+	// of the level below.
+	SummaryCluster = "cluster"
+)
+
+// Summary is the embedded summary of a file, package or cluster, written
+// by a generative model.
+type Summary struct {
+	ID   string
+	Kind string
+	// Hash is the hash of what was summarized: the file contents, or the
+	// summaries of the package's files or the cluster's members.
+	Hash   string
+	Text   string
+	Vector []float32
+	// Level is the height of a cluster in the hierarchy, 1 for clusters of
+	// files, 0 for files and packages.
+	Level int
+	// Children are the ids of the files or clusters a cluster summarizes.
+	Children []string
+}
+
+// createSummaries creates the summaries table of the namespace.
+func (s *storageService) createSummaries() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        kind TEXT,
+        id TEXT,
+        hash TEXT,
+        summary BLOB,
+        embedding BLOB,
+        PRIMARY KEY (kind, id)
+    )
+    `, s.summaries))
+	if err != nil {
+		return err
+	}
+	for _, m := range summaryMigrations {
+		if _, err := s.db.Exec(fmt.Sprintf(m, s.summaries)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summaryMigrations add columns to existing summaries tables. %s is the
+// table name.
+var summaryMigrations = []string{
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS level INTEGER DEFAULT 0`,
+	`ALTER TABLE %s ADD COLUMN IF NOT EXISTS children TEXT DEFAULT '[]'`,
+}
+
+// UpsertSummary inserts or updates a summary.
+func (s *storageService) UpsertSummary(ctx context.Context, sum Summary) error {
+	defer s.changed()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	key := sum.Kind + ":" + sum.ID
+	text, err := s.seal(key+":summary", []byte(sum.Text))
+	if err != nil {
+		return fmt.Errorf("UpsertSummary failed: %w", err)
+	}
+	vec, err := s.seal(key, float32SliceToBytes(sum.Vector))
+	if err != nil {
+		return fmt.Errorf("UpsertSummary failed: %w", err)
+	}
+	children, err := json.Marshal(append([]string{}, sum.Children...))
+	if err != nil {
+		return fmt.Errorf("UpsertSummary failed: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO `+s.summaries+` (kind, id, hash, summary, embedding, level, children) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(kind, id) DO UPDATE SET hash = excluded.hash, summary = excluded.summary, embedding = excluded.embedding,
+		level = excluded.level, children = excluded.children;`,
+		sum.Kind, sum.ID, sum.Hash, text, vec, sum.Level, string(children))
+	if err != nil {
+		return fmt.Errorf("UpsertSummary failed: %w", err)
+	}
+	return nil
+}
+
+// Summaries fetches every summary of kind.
+func (s *storageService) Summaries(ctx context.Context, kind string) ([]Summary, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, hash, summary, embedding, level, children FROM "+s.summaries+" WHERE kind = ? ORDER BY id;", kind)
+	if err != nil {
+		return nil, fmt.Errorf("Summaries failed: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Summary
+	for rows.Next() {
+		var (
+			sum       = Summary{Kind: kind}
+			text, vec []byte
+			children  string
+		)
+		if err := rows.Scan(&sum.ID, &sum.Hash, &text, &vec, &sum.Level, &children); err != nil {
+			return nil, fmt.Errorf("Summaries scan failed: %w", err)
+		}
+		if err := json.Unmarshal([]byte(children), &sum.Children); err != nil {
+			return nil, fmt.Errorf("Summaries scan failed: %w", err)
+		}
+		key := kind + ":" + sum.ID
+		if text, err = s.open(key+":summary", text); err != nil {
+			return nil, fmt.Errorf("Summaries failed: %w", err)
+		}
+		if vec, err = s.open(key, vec); err != nil {
+			return nil, fmt.Errorf("Summaries failed: %w", err)
+		}
+		sum.Text, sum.Vector = string(text), bytesToFloat32Slice(vec)
+		out = append(out, sum)
+	}
+	return out, rows.Err()
+}
+
+// MatchSummary checks if the summary of kind for id was made from content
+// with the given hash.
+func (s *storageService) MatchSummary(ctx context.Context, kind, id, hash string) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var n int
+	err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM "+s.summaries+" WHERE kind = ? AND id = ? AND hash = ?;", kind, id, hash).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("MatchSummary query failed: %w", err)
+	}
+	return n > 0, nil
+}
+
+// DeleteSummary removes the summary of kind for id.
+func (s *storageService) DeleteSummary(ctx context.Context, kind, id string) error {
+	defer s.changed()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, "DELETE FROM "+s.summaries+" WHERE kind = ? AND id = ?;", kind, id); err != nil {
+		return fmt.Errorf("DeleteSummary failed: %w", err)
+	}
+	return nil
+}
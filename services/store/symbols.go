@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Kinds of symbols.
+const (
+	// SymbolDef is where a symbol is declared.
+	SymbolDef = "def"
+	// SymbolRef is where a symbol is used.
+	SymbolRef = "ref"
+)
+
+// symbolBatch is the number of symbols inserted per statement.
+const symbolBatch = 256
+
+// Symbol is a definition or usage of a name in a file.
+type Symbol struct {
+	// ID is the file the symbol is in.
+	ID   string
+	Name string
+	Kind string
+	// Line is 1-based.
+	Line int
+}
+
+// createSymbols creates the symbols table of the namespace, and the
+// symbol_files table holding the hash of each file its symbols were read
+// from. symbols has no primary key: DuckDB rejects deleting and re-inserting
+// the same key within a transaction.
+func (s *storageService) createSymbols() error {
+	if _, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        id TEXT,
+        name TEXT,
+        kind TEXT,
+        line INTEGER
+    )
+    `, s.symbols)); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        id TEXT PRIMARY KEY,
+        hash TEXT
+    )
+    `, s.symbolFiles))
+	return err
+}
+
+// ReplaceSymbols replaces the symbols of the file id, read from its content
+// with the given hash.
+func (s *storageService) ReplaceSymbols(ctx context.Context, id, hash string, symbols []Symbol) error {
+	defer s.changed()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("ReplaceSymbols failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+s.symbols+" WHERE id = ?;", id); err != nil {
+		return fmt.Errorf("ReplaceSymbols failed: %w", err)
+	}
+	for start := 0; start < len(symbols); start += symbolBatch {
+		batch := symbols[start:min(start+symbolBatch, len(symbols))]
+		params := make([]any, 0, 4*len(batch))
+		for _, sym := range batch {
+			params = append(params, id, sym.Name, sym.Kind, sym.Line)
+		}
+		query := "INSERT INTO " + s.symbols + " (id, name, kind, line) VALUES (?, ?, ?, ?)" +
+			strings.Repeat(", (?, ?, ?, ?)", len(batch)-1) + ";"
+		if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+			return fmt.Errorf("ReplaceSymbols failed: %w", err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO `+s.symbolFiles+` (id, hash) VALUES (?, ?)
+		ON CONFLICT(id) DO UPDATE SET hash = excluded.hash;`, id, hash); err != nil {
+		return fmt.Errorf("ReplaceSymbols failed: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ReplaceSymbols failed: %w", err)
+	}
+	return nil
+}
+
+// MatchSymbols checks if the symbols of id were read from content with the
+// given hash.
+func (s *storageService) MatchSymbols(ctx context.Context, id, hash string) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var n int
+	if err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM "+s.symbolFiles+" WHERE id = ? AND hash = ?;", id, hash).Scan(&n); err != nil {
+		return false, fmt.Errorf("MatchSymbols query failed: %w", err)
+	}
+	return n > 0, nil
+}
+
+// FindSymbols fetches the symbols of kind named name, or, for methods,
+// qualified by their receiver as in Type.name, in indexed files only. With
+// foldCase, names are compared ignoring case.
+func (s *storageService) FindSymbols(ctx context.Context, kind, name string, foldCase bool) ([]Symbol, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	key := "name"
+	if foldCase {
+		key, name = "lower(name)", strings.ToLower(name)
+	}
+	qualified := "%." + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(name)
+	rows, err := s.db.QueryContext(ctx, "SELECT id, name, kind, line FROM "+s.symbols+
+		" WHERE kind = ? AND ("+key+" = ? OR "+key+` LIKE ? ESCAPE '\')`+
+		" AND id IN (SELECT id FROM "+s.table+") ORDER BY id, line;", kind, name, qualified)
+	if err != nil {
+		return nil, fmt.Errorf("FindSymbols failed: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Symbol
+	for rows.Next() {
+		var sym Symbol
+		if err := rows.Scan(&sym.ID, &sym.Name, &sym.Kind, &sym.Line); err != nil {
+			return nil, fmt.Errorf("FindSymbols scan failed: %w", err)
+		}
+		out = append(out, sym)
+	}
+	return out, rows.Err()
+}
+
+// SymbolNames lists the distinct names of the symbols of kind in indexed
+// files.
+func (s *storageService) SymbolNames(ctx context.Context, kind string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT DISTINCT name FROM "+s.symbols+
+		" WHERE kind = ? AND id IN (SELECT id FROM "+s.table+") ORDER BY name;", kind)
+	if err != nil {
+		return nil, fmt.Errorf("SymbolNames failed: %w", err)
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("SymbolNames scan failed: %w", err)
+		}
+		out = append(out, name)
+	}
+	return out, rows.Err()
+}
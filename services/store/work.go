@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// workInsertBatch is the number of files queued per statement.
+const workInsertBatch = 512
+
+// WorkBatch is a batch of files of a distributed indexing run, claimed by a
+// worker until its lease expires.
+type WorkBatch struct {
+	ID    int64
+	Files []string
+	// Attempts counts the claims of the batch, this one included: more than
+	// one means a worker died or overran its lease on it. It tells the
+	// lease apart from the later ones of other claims.
+	Attempts int
+}
+
+// createWork creates the work_queue table of the namespace. It has no
+// primary key: DuckDB can fail updates of indexed rows, and claims update
+// every row of a batch.
+func (s *storageService) createWork() error {
+	_, err := s.db.Exec(fmt.Sprintf(`
+    CREATE TABLE IF NOT EXISTS %s (
+        file TEXT,
+        batch BIGINT,
+        worker TEXT,
+        leased_until TIMESTAMP,
+        attempts INTEGER DEFAULT 0
+    )
+    `, s.work))
+	return err
+}
+
+// PushWork queues files as a new batch, after every batch already queued.
+// Files already queued are left in their batch.
+func (s *storageService) PushWork(ctx context.Context, files []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("PushWork failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	var batch int64
+	if err := tx.QueryRowContext(ctx, "SELECT coalesce(max(batch), 0) + 1 FROM "+s.work+";").Scan(&batch); err != nil {
+		return fmt.Errorf("PushWork failed: %w", err)
+	}
+	for start := 0; start < len(files); start += workInsertBatch {
+		chunk := files[start:min(start+workInsertBatch, len(files))]
+		params := make([]any, 0, len(chunk)+1)
+		params = append(params, batch)
+		for _, f := range chunk {
+			params = append(params, f)
+		}
+		query := "INSERT INTO " + s.work + " (file, batch) SELECT DISTINCT v.file, ? FROM (VALUES (?)" + strings.Repeat(", (?)", len(chunk)-1) +
+			") AS v(file) WHERE v.file NOT IN (SELECT file FROM " + s.work + ");"
+		if _, err := tx.ExecContext(ctx, query, params...); err != nil {
+			return fmt.Errorf("PushWork failed: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("PushWork failed: %w", err)
+	}
+	return nil
+}
+
+// ClaimWork leases the oldest batch that isn't leased, or whose lease
+// expired, to worker for lease, and returns false when there is none. Leases
+// are timed by the database, so that the clocks of workers don't matter.
+func (s *storageService) ClaimWork(ctx context.Context, worker string, lease time.Duration) (WorkBatch, bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	// One statement, so that two workers never hold the same lease
+	rows, err := s.db.QueryContext(ctx, `UPDATE `+s.work+` SET worker = ?, leased_until = now()::TIMESTAMP + to_milliseconds(?), attempts = attempts + 1
+		WHERE batch = (SELECT min(batch) FROM `+s.work+` WHERE leased_until IS NULL OR leased_until < now()::TIMESTAMP)
+		RETURNING batch, file, attempts;`, worker, lease.Milliseconds())
+	if err != nil {
+		return WorkBatch{}, false, fmt.Errorf("ClaimWork failed: %w", err)
+	}
+	defer rows.Close()
+
+	var b WorkBatch
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&b.ID, &file, &b.Attempts); err != nil {
+			return WorkBatch{}, false, fmt.Errorf("ClaimWork scan failed: %w", err)
+		}
+		b.Files = append(b.Files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return WorkBatch{}, false, fmt.Errorf("ClaimWork failed: %w", err)
+	}
+	return b, len(b.Files) > 0, nil
+}
+
+// FinishWork removes the batch b claimed by worker once its files are
+// indexed, and returns false, leaving it queued, when its lease expired and
+// the batch was claimed again since.
+func (s *storageService) FinishWork(ctx context.Context, worker string, b WorkBatch) (bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	res, err := s.db.ExecContext(ctx, "DELETE FROM "+s.work+" WHERE batch = ? AND worker = ? AND attempts = ?;", b.ID, worker, b.Attempts)
+	if err != nil {
+		return false, fmt.Errorf("FinishWork failed: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("FinishWork failed: %w", err)
+	}
+	return n > 0, nil
+}
+
+// WorkLeft counts the queued files, in batches leased or not.
+func (s *storageService) WorkLeft(ctx context.Context) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var n int
+	if err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM "+s.work+";").Scan(&n); err != nil {
+		return 0, fmt.Errorf("WorkLeft failed: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,159 @@
+// Package summary writes short natural-language summaries of files and
+// packages with a generative model. Summaries are embedded alongside the
+// code, so that searches of large repositories can first find the packages
+// and files a query is about.
+package summary
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	ollama "github.com/ollama/ollama/api"
+)
+
+const (
+	// DefaultModel is the Ollama model summaries are written with.
+	DefaultModel = "llama3.2"
+	// maxInput bounds the text sent per summary, in bytes, so that large
+	// files fit the context window of small models.
+	maxInput = 12000
+)
+
+// SummaryService defines the interface for summarizing code.
+type SummaryService interface {
+	// File summarizes the text of the file at path.
+	File(ctx context.Context, path, text string) (string, error)
+	// Package summarizes the directory dir from the summaries of its
+	// files, by path.
+	Package(ctx context.Context, dir string, files map[string]string) (string, error)
+	// Cluster summarizes what a group of similar files or clusters have in
+	// common from their summaries.
+	Cluster(ctx context.Context, summaries []string) (string, error)
+	// Label names in a few words the topic shared by a group of files,
+	// from their summaries or excerpts by path.
+	Label(ctx context.Context, files map[string]string) (string, error)
+	// Model is the name of the model summaries are written with.
+	Model() string
+}
+
+// summaryService implements SummaryService with Ollama.
+type summaryService struct {
+	client *ollama.Client
+	model  string
+}
+
+// NewSummaryService returns a SummaryService generating summaries with
+// model, DefaultModel when empty, served by client.
+func NewSummaryService(client *ollama.Client, model string) SummaryService {
+	if model == "" {
+		model = DefaultModel
+	}
+	return &summaryService{client: client, model: model}
+}
+
+// File summarizes the text of the file at path.
+func (s *summaryService) File(ctx context.Context, path, text string) (string, error) {
+	prompt := fmt.Sprintf(`Summarize what the following file does in two to four sentences, for a developer searching the repository. Name its main types and functions and the concepts they handle. Answer with the summary only.
+
+File: %s
+
+%s`, path, truncate(text))
+	return s.generate(ctx, prompt)
+}
+
+// Package summarizes the directory dir from the summaries of its files.
+func (s *summaryService) Package(ctx context.Context, dir string, files map[string]string) (string, error) {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	for _, p := range paths {
+		fmt.Fprintf(&b, "- %s: %s\n", p, files[p])
+	}
+	prompt := fmt.Sprintf(`Summarize what the following package does in two to four sentences, for a developer searching the repository, from the summaries of its files. Answer with the summary only.
+
+Package: %s
+
+%s`, dir, truncate(b.String()))
+	return s.generate(ctx, prompt)
+}
+
+// Cluster summarizes what a group of similar files or clusters have in
+// common from their summaries.
+func (s *summaryService) Cluster(ctx context.Context, summaries []string) (string, error) {
+	var b strings.Builder
+	for _, sum := range summaries {
+		fmt.Fprintf(&b, "- %s\n", sum)
+	}
+	prompt := fmt.Sprintf(`The following summaries describe related parts of a repository. Summarize in two to four sentences what they implement together and the concepts they share, for a developer searching the repository. Answer with the summary only.
+
+%s`, truncate(b.String()))
+	return s.generate(ctx, prompt)
+}
+
+// Label names in a few words the topic shared by a group of files.
+func (s *summaryService) Label(ctx context.Context, files map[string]string) (string, error) {
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	for _, p := range paths {
+		fmt.Fprintf(&b, "- %s: %s\n", p, files[p])
+	}
+	prompt := fmt.Sprintf(`The following files of a repository are similar. Name the topic they share in two to six words, such as "HTTP request routing" or "database migrations". Answer with the name only.
+
+%s`, truncate(b.String()))
+	label, err := s.generate(ctx, prompt)
+	if err != nil {
+		return "", err
+	}
+	// small models quote or punctuate their answers
+	return strings.Trim(strings.SplitN(label, "\n", 2)[0], `"'. `), nil
+}
+
+// Model is the name of the model summaries are written with.
+func (s *summaryService) Model() string {
+	return s.model
+}
+
+// generate returns the completion of prompt.
+func (s *summaryService) generate(ctx context.Context, prompt string) (string, error) {
+	stream := false
+	req := &ollama.GenerateRequest{
+		Model:   s.model,
+		Prompt:  prompt,
+		Stream:  &stream,
+		Options: map[string]any{"temperature": 0},
+	}
+	var b strings.Builder
+	err := s.client.Generate(ctx, req, func(resp ollama.GenerateResponse) error {
+		b.WriteString(resp.Response)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("summary with %s failed: %w", s.model, err)
+	}
+	summary := strings.TrimSpace(b.String())
+	if summary == "" {
+		return "", fmt.Errorf("summary with %s failed: empty response", s.model)
+	}
+	return summary, nil
+}
+
+// truncate cuts text to maxInput bytes, at a line break when there is one.
+func truncate(text string) string {
+	if len(text) <= maxInput {
+		return text
+	}
+	text = text[:maxInput]
+	if i := strings.LastIndexByte(text, '\n'); i > 0 {
+		text = text[:i]
+	}
+	return text + "\n[...]"
+}
@@ -0,0 +1,90 @@
+package symbols
+
+import (
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// hashComments are the languages whose comments start with #.
+var hashComments = map[string]bool{"python": true, "shell": true, "ruby": true}
+
+// Comments returns the comments and docstrings of text, a file in the given
+// language, one per line without their markers, so that they can be
+// embedded on their own. Go is parsed and its directives left out; other
+// languages are read line by line, trailing comments being left out. It
+// returns "" for markdown, which is all prose, and languages it doesn't
+// know.
+func Comments(language, text string) string {
+	if language == "go" {
+		if c, ok := goComments(text); ok {
+			return c
+		}
+	}
+	if language == "markdown" || patterns[language] == nil {
+		return ""
+	}
+
+	var (
+		out   []string
+		block string // the end marker of the block comment being read
+	)
+	add := func(line string) {
+		if line = strings.TrimSpace(strings.Trim(strings.TrimSpace(line), "*")); line != "" {
+			out = append(out, line)
+		}
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if block != "" {
+			if before, _, ok := strings.Cut(line, block); ok {
+				add(before)
+				block = ""
+				continue
+			}
+			add(line)
+			continue
+		}
+		switch {
+		case hashComments[language] && strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "#!"):
+			add(strings.TrimLeft(line, "#"))
+		case language == "lua" && strings.HasPrefix(line, "--"):
+			add(strings.TrimLeft(line, "-"))
+		case language == "python" && (strings.HasPrefix(line, `"""`) || strings.HasPrefix(line, "'''")):
+			block = line[:3]
+			line = line[3:]
+			if before, _, ok := strings.Cut(line, block); ok {
+				add(before)
+				block = ""
+				continue
+			}
+			add(line)
+		case !hashComments[language] && strings.HasPrefix(line, "//"):
+			add(strings.TrimLeft(line, "/!"))
+		case !hashComments[language] && strings.HasPrefix(line, "/*"):
+			line = line[2:]
+			if before, _, ok := strings.Cut(line, "*/"); ok {
+				add(before)
+				continue
+			}
+			block = "*/"
+			add(line)
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// goComments returns the comment text of Go source, reporting false when it
+// doesn't parse.
+func goComments(text string) (string, bool) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", text, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return "", false
+	}
+	var b strings.Builder
+	for _, g := range f.Comments {
+		b.WriteString(g.Text())
+	}
+	return strings.TrimSpace(b.String()), true
+}
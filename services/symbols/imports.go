@@ -0,0 +1,70 @@
+package symbols
+
+import (
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// importPatterns match the modules imported by a line per language, the
+// module being the first non-empty group.
+var importPatterns = map[string]*regexp.Regexp{
+	"python":     regexp.MustCompile(`^\s*(?:from\s+([\w.]+)\s+import|import\s+([\w.]+))`),
+	"javascript": regexp.MustCompile(`(?:\bfrom\s+|\brequire\(\s*|^\s*import\s+)['"]([^'"]+)['"]`),
+	"typescript": regexp.MustCompile(`(?:\bfrom\s+|\brequire\(\s*|^\s*import\s+)['"]([^'"]+)['"]`),
+	"java":       regexp.MustCompile(`^\s*import\s+(?:static\s+)?([\w.]+)\s*;`),
+	"kotlin":     regexp.MustCompile(`^\s*import\s+([\w.]+)`),
+	"csharp":     regexp.MustCompile(`^\s*using\s+(?:static\s+)?([\w.]+)\s*;`),
+	"rust":       regexp.MustCompile(`^\s*use\s+([\w:]+)`),
+	"ruby":       regexp.MustCompile(`^\s*require(?:_relative)?\s*\(?\s*['"]([^'"]+)['"]`),
+	"php":        regexp.MustCompile(`^\s*(?:use\s+([\w\\]+)|(?:require|include)(?:_once)?\s*\(?\s*['"]([^'"]+)['"])`),
+	"c":          regexp.MustCompile(`^\s*#\s*include\s+"([^"]+)"`),
+	"cpp":        regexp.MustCompile(`^\s*#\s*include\s+"([^"]+)"`),
+	"lua":        regexp.MustCompile(`\brequire\s*\(?\s*['"]([^'"]+)['"]`),
+}
+
+// Imports returns the modules imported by text, a file in the given
+// language as detected by the detect package, as written: Go import paths,
+// dotted Python modules or relative JavaScript paths. It returns nil for
+// languages it doesn't know.
+func Imports(language, text string) []string {
+	if language == "go" {
+		return goImports(text)
+	}
+	re, ok := importPatterns[language]
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, line := range strings.Split(text, "\n") {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		for _, g := range m[1:] {
+			if g != "" {
+				out = append(out, g)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// goImports returns the import paths of Go source, nil when it doesn't
+// parse.
+func goImports(text string) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), "", text, parser.ImportsOnly)
+	if err != nil {
+		return nil
+	}
+	out := make([]string, 0, len(f.Imports))
+	for _, spec := range f.Imports {
+		if p, err := strconv.Unquote(spec.Path.Value); err == nil {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,250 @@
+// Package symbols finds the top-level declarations of source files, the
+// boundaries files are chunked at, and the modules they import. Go is
+// parsed; other languages are matched line by line against the shapes their
+// declarations and imports usually take.
+package symbols
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strings"
+)
+
+// Decl is a top-level declaration.
+type Decl struct {
+	// Name is the declared symbol, Receiver.Method for Go methods.
+	Name string
+	// Line is the 0-based line the declaration starts at, its doc comment
+	// included.
+	Line int
+	// Kind is one of the Kind constants.
+	Kind string
+}
+
+// Kinds of declarations.
+const (
+	// KindFunc declares a function or a method.
+	KindFunc = "func"
+	// KindType declares a type: a class, struct, interface, enum or trait.
+	KindType = "type"
+	// KindVar declares a variable or a constant.
+	KindVar = "var"
+	// KindModule declares a module or a namespace.
+	KindModule = "module"
+	// KindSection is a markdown heading.
+	KindSection = "section"
+)
+
+// Kinds lists every kind of declaration.
+var Kinds = []string{KindFunc, KindType, KindVar, KindModule, KindSection}
+
+// kindKeywords map the keywords declaring a symbol to its kind.
+var kindKeywords = map[string]string{
+	"def": KindFunc, "function": KindFunc, "fn": KindFunc, "fun": KindFunc, "func": KindFunc,
+	"class": KindType, "struct": KindType, "interface": KindType, "@interface": KindType, "enum": KindType,
+	"trait": KindType, "type": KindType, "record": KindType, "union": KindType, "object": KindType, "impl": KindType,
+	"const": KindVar, "let": KindVar, "var": KindVar, "val": KindVar, "static": KindVar,
+	"mod": KindModule, "module": KindModule, "namespace": KindModule,
+	"protocol": KindType, "extension": KindType, "actor": KindType, "typealias": KindType, "mixin": KindType,
+	"typedef": KindType, "newtype": KindType, "instance": KindType, "message": KindType, "service": KindType,
+	"table": KindType, "view": KindType, "resource": KindType, "data": KindType,
+	"procedure": KindFunc, "trigger": KindFunc, "defp": KindFunc, "defmacro": KindFunc, "defmacrop": KindFunc,
+	"variable": KindVar, "output": KindVar, "defmodule": KindModule, "provider": KindModule,
+}
+
+// patterns match a declaration line per language, the name being the first
+// non-empty group.
+var patterns = map[string]*regexp.Regexp{
+	"python":     regexp.MustCompile(`^(?:async\s+)?(?:def|class)\s+(\w+)`),
+	"javascript": regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:async\s+)?(?:function\*?\s+(\w+)|class\s+(\w+)|(?:const|let|var)\s+(\w+)\s*=)`),
+	"typescript": regexp.MustCompile(`^(?:export\s+)?(?:default\s+)?(?:declare\s+)?(?:abstract\s+)?(?:async\s+)?(?:function\*?\s+(\w+)|class\s+(\w+)|interface\s+(\w+)|type\s+(\w+)|enum\s+(\w+)|(?:const|let|var)\s+(\w+)\s*[=:])`),
+	"rust":       regexp.MustCompile(`^(?:pub(?:\([\w:]+\))?\s+)?(?:async\s+)?(?:unsafe\s+)?(?:fn|struct|enum|trait|mod|type|const|static)\s+(\w+)|^impl(?:<[^>]*>)?\s+(?:[\w:<>]+\s+for\s+)?(\w+)`),
+	"java":       regexp.MustCompile(`^\s{0,4}(?:(?:public|private|protected|static|final|abstract|sealed|synchronized)\s+)*(?:class|interface|enum|record|@interface)\s+(\w+)|^\s{4}(?:(?:public|private|protected|static|final|abstract|synchronized)\s+)+[\w<>\[\],\s]+?\s(\w+)\s*\(`),
+	"kotlin":     regexp.MustCompile(`^\s{0,4}(?:(?:public|private|internal|protected|open|abstract|data|sealed|inline|suspend|override)\s+)*(?:class|interface|object|fun|val|var)\s+(?:<[^>]*>\s*)?(?:\w+\.)?(\w+)`),
+	"csharp":     regexp.MustCompile(`^\s{0,8}(?:(?:public|private|protected|internal|static|sealed|abstract|partial|async|override|virtual)\s+)*(?:class|interface|struct|enum|record)\s+(\w+)|^\s{8}(?:(?:public|private|protected|internal|static|async|override|virtual)\s+)+[\w<>\[\],\s]+?\s(\w+)\s*\(`),
+	"c":          regexp.MustCompile(`^(?:static\s+|inline\s+|extern\s+)*(?:struct\s+|enum\s+|unsigned\s+)?\w[\w\s\*]*?\b(\w+)\s*\([^;]*$|^(?:typedef\s+)?(?:struct|enum|union)\s+(\w+)\s*\{`),
+	"cpp":        regexp.MustCompile(`^(?:template\s*<[^>]*>\s*)?(?:static\s+|inline\s+|virtual\s+|extern\s+)*\w[\w\s\*&:<>,]*?\b(\w+)\s*\([^;]*$|^(?:class|struct|enum|union|namespace)\s+(\w+)`),
+	"ruby":       regexp.MustCompile(`^\s{0,2}(?:def\s+(?:self\.)?([\w?!]+)|class\s+(\w+)|module\s+(\w+))`),
+	"php":        regexp.MustCompile(`^\s{0,4}(?:(?:public|private|protected|static|abstract|final)\s+)*(?:function\s+(\w+)|class\s+(\w+)|interface\s+(\w+)|trait\s+(\w+))`),
+	"shell":      regexp.MustCompile(`^(?:function\s+(\w+)|(\w+)\s*\(\)\s*\{?)`),
+	"lua":        regexp.MustCompile(`^(?:local\s+)?function\s+([\w.:]+)`),
+	"scala":      regexp.MustCompile(`^\s{0,2}(?:(?:private|protected|final|sealed|abstract|implicit|case|override|lazy)\s+)*(?:def|class|object|trait|enum|type|val|var)\s+(\w+)`),
+	"swift":      regexp.MustCompile(`^\s{0,4}(?:(?:public|private|fileprivate|internal|open|static|final|override|mutating|@\w+)\s+)*(?:func|class|struct|enum|protocol|extension|actor|typealias)\s+(\w+)`),
+	"dart":       regexp.MustCompile(`^(?:(?:abstract|sealed|base|final|interface)\s+)*(?:class|mixin|enum|extension|typedef)\s+(\w+)|^[\w<>?,]+(?:\s+[\w<>?,]+)?\s+(\w+)\s*\([^;]*\)\s*(?:async\s*)?\{`),
+	"sql":        regexp.MustCompile(`(?i)^create\s+(?:or\s+replace\s+)?(?:temp(?:orary)?\s+)?(?:table|view|materialized\s+view|function|procedure|trigger|type)\s+(?:if\s+not\s+exists\s+)?"?([\w.]+)`),
+	"protobuf":   regexp.MustCompile(`^(?:message|service|enum|extend)\s+([\w.]+)`),
+	"terraform":  regexp.MustCompile(`^(?:resource|data)\s+"[\w-]+"\s+"([\w-]+)"|^(?:module|variable|output|provider)\s+"([\w-]+)"`),
+	"elixir":     regexp.MustCompile(`^\s{0,2}(?:defmodule\s+([\w.]+)|(?:def|defp|defmacro|defmacrop)\s+([\w?!]+))`),
+	"erlang":     regexp.MustCompile(`^([a-z]\w*)\(.*\)\s*(?:when\b.*)?->`),
+	"haskell":    regexp.MustCompile(`^(?:data|newtype|type|class|instance)\s+(?:\([^)]*\)\s*=>\s*)?(\w+)|^(\w+)\s*::`),
+	"ocaml":      regexp.MustCompile(`^(?:let|and)\s+(?:rec\s+)?(\w+)|^(?:type|module)\s+(?:rec\s+|type\s+)?(\w+)`),
+	"markdown":   regexp.MustCompile(`^#{1,6}\s+(.+)`),
+}
+
+// commentPrefixes start the lines of comments and annotations that belong to
+// the declaration below them.
+var commentPrefixes = []string{"//", "#", "/*", "*", "--", "@"}
+
+// Declarations returns the top-level declarations of text, a file in the
+// given language as detected by the detect package, in order. It returns
+// nil for languages it doesn't know.
+func Declarations(language, text string) []Decl {
+	if language == "go" {
+		if decls, ok := goDeclarations(text); ok {
+			return decls
+		}
+	}
+	re, ok := patterns[language]
+	if !ok {
+		return nil
+	}
+
+	lines := strings.Split(text, "\n")
+	var decls []Decl
+	for i, line := range lines {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		name := ""
+		for _, g := range m[1:] {
+			if g != "" {
+				name = g
+				break
+			}
+		}
+		if name == "" || isKeyword(name) {
+			continue
+		}
+		start, kind := i, KindSection
+		if language != "markdown" {
+			start, kind = withComments(lines, i), declKind(m[0], name)
+		}
+		decls = append(decls, Decl{Name: strings.TrimSpace(name), Line: start, Kind: kind})
+	}
+	return decls
+}
+
+// declKind returns the kind of the declaration of name matched by match: a
+// function declaring keyword, else the parameters of a function, as in C
+// and Java where the return type may read `struct`, else the keyword
+// before the name.
+func declKind(match, name string) string {
+	words := strings.Fields(strings.NewReplacer("(", " ( ", "*", " ").Replace(match[:strings.Index(match, name)]))
+	for _, w := range words {
+		if kindKeywords[strings.ToLower(w)] == KindFunc {
+			return KindFunc
+		}
+	}
+	if strings.Contains(match[strings.Index(match, name):], "(") {
+		return KindFunc
+	}
+	for _, w := range words {
+		// SQL keywords are written in either case
+		if kind, ok := kindKeywords[strings.ToLower(w)]; ok {
+			return kind
+		}
+	}
+	return KindFunc
+}
+
+// isKeyword reports whether name is a control keyword that function-shaped
+// patterns catch, as in `if (x) {`.
+func isKeyword(name string) bool {
+	switch name {
+	case "if", "for", "while", "switch", "return", "catch", "sizeof", "else", "do":
+		return true
+	}
+	return false
+}
+
+// withComments returns the line of the first comment line right above line
+// i, or i.
+func withComments(lines []string, i int) int {
+	for i > 0 {
+		prev := strings.TrimSpace(lines[i-1])
+		if prev == "" || !hasCommentPrefix(prev) {
+			break
+		}
+		i--
+	}
+	return i
+}
+
+// hasCommentPrefix reports whether line starts like a comment.
+func hasCommentPrefix(line string) bool {
+	for _, p := range commentPrefixes {
+		if strings.HasPrefix(line, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// goDeclarations parses Go source, reporting false when it doesn't parse.
+func goDeclarations(text string) ([]Decl, bool) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", text, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return nil, false
+	}
+	line := func(pos token.Pos, doc *ast.CommentGroup) int {
+		if doc != nil {
+			pos = doc.Pos()
+		}
+		return fset.Position(pos).Line - 1
+	}
+
+	var decls []Decl
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			name := d.Name.Name
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				name = receiver(d.Recv.List[0].Type) + "." + name
+			}
+			decls = append(decls, Decl{Name: name, Line: line(d.Pos(), d.Doc), Kind: KindFunc})
+		case *ast.GenDecl:
+			if d.Tok == token.IMPORT {
+				continue
+			}
+			// groups are named after their first spec
+			name := ""
+			if len(d.Specs) > 0 {
+				switch s := d.Specs[0].(type) {
+				case *ast.TypeSpec:
+					name = s.Name.Name
+				case *ast.ValueSpec:
+					name = s.Names[0].Name
+				}
+			}
+			kind := KindVar
+			if d.Tok == token.TYPE {
+				kind = KindType
+			}
+			decls = append(decls, Decl{Name: name, Line: line(d.Pos(), d.Doc), Kind: kind})
+		}
+	}
+	return decls, true
+}
+
+// receiver returns the type name of a method receiver, without pointer or
+// type parameters.
+func receiver(t ast.Expr) string {
+	for {
+		switch x := t.(type) {
+		case *ast.StarExpr:
+			t = x.X
+		case *ast.IndexExpr:
+			t = x.X
+		case *ast.IndexListExpr:
+			t = x.X
+		case *ast.Ident:
+			return x.Name
+		default:
+			return "_"
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package symbols
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeclarations(t *testing.T) {
+	for _, c := range []struct {
+		language string
+		text     string
+		want     []Decl
+	}{
+		{"scala", "package a\n\nobject Main {\n  def run(): Unit = {}\n}\n", []Decl{{"Main", 2, KindType}, {"run", 3, KindFunc}}},
+		{"swift", "import Foundation\n\n/// A client.\nstruct Client {\n    func send() {}\n}\n", []Decl{{"Client", 2, KindType}, {"send", 4, KindFunc}}},
+		{"dart", "import 'x.dart';\n\nclass Client {}\n\nvoid main() {\n}\n", []Decl{{"Client", 2, KindType}, {"main", 4, KindFunc}}},
+		{"sql", "-- users\nCREATE TABLE IF NOT EXISTS users (id INT);\n\ncreate or replace function touch() returns trigger as $$\n", []Decl{{"users", 0, KindType}, {"touch", 3, KindFunc}}},
+		{"protobuf", "syntax = \"proto3\";\n\nmessage User {}\n\nservice Users {}\n", []Decl{{"User", 2, KindType}, {"Users", 4, KindType}}},
+		{"terraform", "provider \"aws\" {}\n\nresource \"aws_s3_bucket\" \"logs\" {}\n\nvariable \"region\" {}\n", []Decl{{"aws", 0, KindModule}, {"logs", 2, KindType}, {"region", 4, KindVar}}},
+		{"elixir", "defmodule App.Client do\n  def send(x), do: x\n  defp encode(x), do: x\nend\n", []Decl{{"App.Client", 0, KindModule}, {"send", 1, KindFunc}, {"encode", 2, KindFunc}}},
+		{"erlang", "-module(client).\n\nsend(X) when is_list(X) ->\n    ok.\n", []Decl{{"send", 2, KindFunc}}},
+		{"haskell", "module Main where\n\n-- | A user.\ndata User = User\n\nmain :: IO ()\nmain = pure ()\n", []Decl{{"User", 2, KindType}, {"main", 5, KindFunc}}},
+		{"ocaml", "type user = { name : string }\n\nlet default_port = 80\n", []Decl{{"user", 0, KindType}, {"default_port", 2, KindVar}}},
+		{"yaml", "key: value\n", nil},
+	} {
+		t.Run(c.language, func(t *testing.T) {
+			if got := Declarations(c.language, c.text); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Declarations = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package symbols
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strings"
+)
+
+// Symbol is a name at a line of a file.
+type Symbol struct {
+	Name string
+	// Line is the 0-based line of the name itself.
+	Line int
+}
+
+// identifier matches the identifiers of the languages matched line by line.
+var identifier = regexp.MustCompile(`[A-Za-z_$][\w$]*`)
+
+// keywords are left out of the usages of languages matched line by line,
+// as are identifiers of one letter.
+var keywords = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`
+		abstract and as assert async await break case catch class const continue def default del delete do elif else
+		elsif end enum except export extends extern false final finally fn for from func function global if impl
+		implements import in include instanceof interface internal is lambda let local loop match mod module mut
+		namespace new nil none not null object of or override package pass private protected pub public raise
+		require return self static struct super switch then this throw throws trait true try type typeof undefined
+		union unless unsafe until use using val var void when where while with yield
+		True False None int float bool string str char byte long short double unsigned signed`) {
+		keywords[k] = true
+	}
+}
+
+// Supported reports whether Definitions and References know language.
+func Supported(language string) bool {
+	_, ok := patterns[language]
+	return language == "go" || ok && language != "markdown"
+}
+
+// Definitions returns the symbols declared at the top level of text, a file
+// in the given language as detected by the detect package, in order. Unlike
+// Declarations, each name of a Go declaration group is returned, at the line
+// of the name rather than of its doc comment. It returns nil for languages
+// it doesn't know and for markdown.
+func Definitions(language, text string) []Symbol {
+	if language == "go" {
+		if f, fset, ok := parseGo(text); ok {
+			return goDefinitions(f, fset)
+		}
+	}
+	re, ok := patterns[language]
+	if !ok || language == "markdown" {
+		return nil
+	}
+	var defs []Symbol
+	for i, line := range strings.Split(text, "\n") {
+		if name := declared(re, line); name != "" {
+			defs = append(defs, Symbol{Name: name, Line: i})
+		}
+	}
+	return defs
+}
+
+// References returns the identifiers used in text, outside of the
+// declarations Definitions returns, once per line. Go is parsed and every
+// identifier is returned, selectors included, as Upsert in db.Upsert; other
+// languages are tokenized, skipping comment lines and keywords. It returns
+// nil for languages it doesn't know and for markdown.
+func References(language, text string) []Symbol {
+	if language == "go" {
+		if f, fset, ok := parseGo(text); ok {
+			return goReferences(f, fset)
+		}
+	}
+	re, ok := patterns[language]
+	if !ok || language == "markdown" {
+		return nil
+	}
+	var refs []Symbol
+	for i, line := range strings.Split(text, "\n") {
+		if hasCommentPrefix(strings.TrimSpace(line)) {
+			continue
+		}
+		name := declared(re, line)
+		seen := map[string]bool{name: true}
+		for _, id := range identifier.FindAllString(line, -1) {
+			if len(id) < 2 || keywords[id] || seen[id] {
+				continue
+			}
+			seen[id] = true
+			refs = append(refs, Symbol{Name: id, Line: i})
+		}
+	}
+	return refs
+}
+
+// declared returns the name declared by line, empty when it declares none.
+func declared(re *regexp.Regexp, line string) string {
+	m := re.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	for _, g := range m[1:] {
+		if g != "" {
+			if isKeyword(g) {
+				return ""
+			}
+			return strings.TrimSpace(g)
+		}
+	}
+	return ""
+}
+
+// parseGo parses Go source, reporting false when it doesn't parse.
+func parseGo(text string) (*ast.File, *token.FileSet, bool) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", text, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, nil, false
+	}
+	return f, fset, true
+}
+
+// goDefinitions returns the top-level names of f.
+func goDefinitions(f *ast.File, fset *token.FileSet) []Symbol {
+	var defs []Symbol
+	add := func(name string, pos token.Pos) {
+		if name != "_" {
+			defs = append(defs, Symbol{Name: name, Line: fset.Position(pos).Line - 1})
+		}
+	}
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			name := d.Name.Name
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				name = receiver(d.Recv.List[0].Type) + "." + name
+			}
+			add(name, d.Name.Pos())
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					add(s.Name.Name, s.Name.Pos())
+				case *ast.ValueSpec:
+					for _, n := range s.Names {
+						add(n.Name, n.Pos())
+					}
+				}
+			}
+		}
+	}
+	return defs
+}
+
+// goReferences returns the identifiers of f other than the top-level names
+// it declares and its package name, once per line.
+func goReferences(f *ast.File, fset *token.FileSet) []Symbol {
+	decl := map[*ast.Ident]bool{f.Name: true}
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			decl[d.Name] = true
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					decl[s.Name] = true
+				case *ast.ValueSpec:
+					for _, n := range s.Names {
+						decl[n] = true
+					}
+				case *ast.ImportSpec:
+					if s.Name != nil {
+						decl[s.Name] = true
+					}
+				}
+			}
+		}
+	}
+
+	type key struct {
+		name string
+		line int
+	}
+	seen := map[key]bool{}
+	var refs []Symbol
+	ast.Inspect(f, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || decl[id] || id.Name == "_" {
+			return true
+		}
+		k := key{id.Name, fset.Position(id.Pos()).Line - 1}
+		if !seen[k] {
+			seen[k] = true
+			refs = append(refs, Symbol{Name: k.name, Line: k.line})
+		}
+		return true
+	})
+	return refs
+}
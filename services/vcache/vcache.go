@@ -0,0 +1,230 @@
+// Package vcache shares embedding vectors between machines, keyed by the
+// hash of the model and of the text embedded, so that teammates and CI
+// embed each unchanged file once between them.
+package vcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	broker "github.com/codectx/tokens/services/broker"
+	embed "github.com/codectx/tokens/services/embed"
+)
+
+// Cache stores vectors under the keys given by Key.
+type Cache interface {
+	// Get returns the vector stored under key, and false when missing.
+	Get(ctx context.Context, key string) ([]float32, bool, error)
+	// Put stores vec under key.
+	Put(ctx context.Context, key string, vec []float32) error
+	// Name returns the URL of the cache, without credentials.
+	Name() string
+	// Close releases the connections of the cache.
+	Close() error
+}
+
+// New returns the cache at rawURL: http(s):// for a server answering GET
+// and PUT of <url>/<key>, with 404 for missing keys, or redis(s):// for
+// Redis keys prefixed with codectx:vec:, expiring after ttl unless it is 0.
+func New(ctx context.Context, rawURL string, ttl time.Duration) (Cache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid embedding cache %q", rawURL)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &httpCache{url: strings.TrimSuffix(rawURL, "/"), client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "redis", "rediss":
+		kv, err := broker.NewKV(ctx, rawURL)
+		if err != nil {
+			return nil, err
+		}
+		return &redisCache{kv: kv, ttl: ttl}, nil
+	default:
+		return nil, fmt.Errorf("unsupported embedding cache %q: use http(s):// or redis(s)://", u.Redacted())
+	}
+}
+
+// maxVectorBytes bounds the cached vectors read, of 65,536 dimensions at
+// most.
+const maxVectorBytes = 4 << 16
+
+// Key returns the key of the vector of text embedded by model, as a query
+// when query is set. The vectors of texts over limits.MaxTokens depend on
+// how they are cut, so the bound and its policy are part of the key.
+func Key(model string, limits embed.Limits, text string, query bool) string {
+	if query {
+		model += "\x00query"
+	}
+	if limits.MaxTokens > 0 {
+		model += fmt.Sprintf("\x00%d:%s", limits.MaxTokens, limits.Truncate)
+	}
+	sum := sha256.Sum256([]byte(model + "\x00" + text))
+	return hex.EncodeToString(sum[:])
+}
+
+// cached consults a cache before embedding with another service.
+type cached struct {
+	embed.EmbeddingService
+	cache   Cache
+	model   string
+	limits  embed.Limits
+	onError func(error)
+	// dims is the size of the vectors of the model, learned from the first
+	// vector svc makes when not known up front.
+	dims atomic.Int64
+}
+
+// Wrap returns svc consulting c before each Get, and storing the vectors it
+// makes in c. model names the provider and model, and limits the bounds
+// svc cuts texts to, so that vectors of different models never mix. dims
+// is the size of the vectors of the model, 0 when unknown: cached vectors
+// of another size are ignored. The cache failing never fails Get: the
+// error is passed to onError and svc embeds the text.
+func Wrap(svc embed.EmbeddingService, c Cache, model string, limits embed.Limits, dims int, onError func(error)) embed.EmbeddingService {
+	s := &cached{EmbeddingService: svc, cache: c, model: model, limits: limits, onError: onError}
+	s.dims.Store(int64(dims))
+	return s
+}
+
+// Get returns the cached vector of text, or embeds and caches it.
+func (s *cached) Get(ctx context.Context, text string) ([]float32, embed.Meta, error) {
+	key := Key(s.model, s.limits, text, embed.IsQuery(ctx))
+	vec, ok, err := s.cache.Get(ctx, key)
+	if err != nil {
+		s.onError(err)
+	}
+	if dims := s.dims.Load(); ok && dims != 0 && int64(len(vec)) != dims {
+		s.onError(fmt.Errorf("ignored cached vector of %d dimensions, want %d", len(vec), dims))
+		ok = false
+	}
+	if ok {
+		return vec, embed.Meta{ProviderName: "cache", ProviderModel: s.model}, nil
+	}
+	vec, meta, err := s.EmbeddingService.Get(ctx, text)
+	if err != nil {
+		return nil, meta, err
+	}
+	s.dims.CompareAndSwap(0, int64(len(vec)))
+	if err := s.cache.Put(ctx, key, vec); err != nil {
+		s.onError(err)
+	}
+	return vec, meta, nil
+}
+
+// httpCache stores vectors with plain HTTP requests.
+type httpCache struct {
+	url    string
+	client *http.Client
+}
+
+func (c *httpCache) Get(ctx context.Context, key string) ([]float32, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/"+key, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("embedding cache lookup failed: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("embedding cache lookup failed: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxVectorBytes+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("embedding cache lookup failed: %w", err)
+	}
+	vec, err := decode(b)
+	return vec, err == nil, err
+}
+
+func (c *httpCache) Put(ctx context.Context, key string, vec []float32) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url+"/"+key, bytes.NewReader(encode(vec)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("embedding cache store failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("embedding cache store failed: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *httpCache) Name() string {
+	u, _ := url.Parse(c.url)
+	return u.Redacted()
+}
+
+func (c *httpCache) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// redisCache stores vectors in Redis keys.
+type redisCache struct {
+	kv  broker.KV
+	ttl time.Duration
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]float32, bool, error) {
+	b, ok, err := c.kv.Get(ctx, "codectx:vec:"+key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	vec, err := decode(b)
+	return vec, err == nil, err
+}
+
+func (c *redisCache) Put(ctx context.Context, key string, vec []float32) error {
+	return c.kv.Set(ctx, "codectx:vec:"+key, encode(vec), c.ttl)
+}
+
+func (c *redisCache) Name() string {
+	return c.kv.Name()
+}
+
+func (c *redisCache) Close() error {
+	return c.kv.Close()
+}
+
+// encode returns vec as little-endian float32s.
+func encode(vec []float32) []byte {
+	b := make([]byte, 0, 4*len(vec))
+	for _, v := range vec {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+	}
+	return b
+}
+
+// decode returns the vector encoded by encode.
+func decode(b []byte) ([]float32, error) {
+	if len(b) == 0 || len(b)%4 != 0 || len(b) > maxVectorBytes {
+		return nil, fmt.Errorf("invalid cached vector of %d bytes", len(b))
+	}
+	vec := make([]float32, len(b)/4)
+	for i := range vec {
+		vec[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return vec, nil
+}
@@ -0,0 +1,60 @@
+package vcache_test
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	embed "github.com/codectx/tokens/services/embed"
+	"github.com/codectx/tokens/services/embed/embedtest"
+	vcache "github.com/codectx/tokens/services/vcache"
+)
+
+// TestCachedVectors serves cached vectors of the wrong size and too large:
+// they are ignored and the text is embedded by the provider.
+func TestCachedVectors(t *testing.T) {
+	ctx := context.Background()
+	limits := embed.Limits{MaxTokens: 512, Truncate: embed.TruncateSplit}
+	bodies := map[string][]byte{
+		"/" + vcache.Key("fake", limits, "short", false): make([]byte, 4*3),
+		"/" + vcache.Key("fake", limits, "large", false): bytes.Repeat([]byte{1}, 1<<20),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := bodies[r.URL.Path]
+		switch {
+		case r.Method == http.MethodPut:
+		case !ok:
+			http.NotFound(w, r)
+		default:
+			w.Write(b)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := vcache.New(ctx, srv.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var errs int
+	svc := vcache.Wrap(embed.FromProvider(embedtest.NewProvider(8)), c, "fake", limits, 8, func(error) { errs++ })
+	for _, text := range []string{"short", "large"} {
+		vec, meta, err := svc.Get(ctx, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vec) != 8 || meta.ProviderName == "cache" {
+			t.Errorf("Get(%s) = %d dimensions from %s, want 8 from the provider", text, len(vec), meta.ProviderName)
+		}
+	}
+	if errs != 2 {
+		t.Errorf("%d errors reported, want 2", errs)
+	}
+
+	if vcache.Key("fake", limits, "text", false) == vcache.Key("fake", embed.Limits{MaxTokens: 512, Truncate: embed.TruncateHead}, "text", false) {
+		t.Error("Key ignores -truncate")
+	}
+}
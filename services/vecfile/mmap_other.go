@@ -0,0 +1,15 @@
+//go:build !unix
+
+package vecfile
+
+import "os"
+
+// mmap reads the file at path: memory mapping is only implemented on unix,
+// elsewhere vectors are held in memory.
+func mmap(path string) ([]byte, func() error, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,201 @@
+// Package vecfile stores the vectors of an index in a flat file that is
+// memory-mapped when loaded, so that large indexes start without decoding
+// every row: each vector is copied straight out of the mapping when read.
+//
+// A file is a 24 byte header (magic, dimensions, count, offset of the ids),
+// the vectors as little-endian float32s, then the namespace and the id and
+// shard of each vector as length-prefixed strings.
+package vecfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"unsafe"
+)
+
+// magic identifies vector files and their format version.
+const magic = "CTXVEC01"
+
+const headerSize = 24
+
+// Entry is a vector to write with its id and shard.
+type Entry struct {
+	ID     string
+	Shard  string
+	Vector []float32
+}
+
+// Write stores the entries of namespace ns at path. Every vector must have
+// the same dimension.
+func Write(path, ns string, entries []Entry) error {
+	dims := 0
+	if len(entries) > 0 {
+		dims = len(entries[0].Vector)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	idsAt := uint64(headerSize) + uint64(len(entries))*uint64(dims)*4
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.LittleEndian.PutUint32(header[8:], uint32(dims))
+	binary.LittleEndian.PutUint32(header[12:], uint32(len(entries)))
+	binary.LittleEndian.PutUint64(header[16:], idsAt)
+	w.Write(header)
+
+	buf := make([]byte, 4)
+	for _, e := range entries {
+		if len(e.Vector) != dims {
+			return fmt.Errorf("vector of %s has %d dimensions, want %d", e.ID, len(e.Vector), dims)
+		}
+		for _, v := range e.Vector {
+			binary.LittleEndian.PutUint32(buf, math.Float32bits(v))
+			w.Write(buf)
+		}
+	}
+
+	writeString(w, ns)
+	for _, e := range entries {
+		writeString(w, e.ID)
+		writeString(w, e.Shard)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeString writes s prefixed by its uint32 length.
+func writeString(w io.Writer, s string) {
+	binary.Write(w, binary.LittleEndian, uint32(len(s)))
+	io.WriteString(w, s)
+}
+
+// File is an open vector file. Vectors are copied out of the mapped file,
+// so they stay valid after Close.
+type File struct {
+	data      []byte
+	unmap     func() error
+	namespace string
+	dims      int
+	ids       []string
+	shards    []string
+	vectors   []float32
+}
+
+// Open maps the vector file at path.
+func Open(path string) (*File, error) {
+	if !littleEndian() {
+		return nil, errors.New("vector files can only be mapped on little-endian hosts")
+	}
+
+	data, unmap, err := mmap(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map %s: %w", path, err)
+	}
+	f := &File{data: data, unmap: unmap}
+	if err := f.parse(); err != nil {
+		unmap()
+		return nil, fmt.Errorf("invalid vector file %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// parse reads the header and ids, and points vectors at the mapped data.
+func (f *File) parse() error {
+	if len(f.data) < headerSize || string(f.data[:8]) != magic {
+		return errors.New("bad header")
+	}
+	f.dims = int(binary.LittleEndian.Uint32(f.data[8:]))
+	count := int(binary.LittleEndian.Uint32(f.data[12:]))
+	idsAt := binary.LittleEndian.Uint64(f.data[16:])
+	if idsAt != uint64(headerSize)+uint64(count)*uint64(f.dims)*4 || idsAt > uint64(len(f.data)) {
+		return errors.New("truncated vectors")
+	}
+
+	if n := count * f.dims; n > 0 {
+		f.vectors = unsafe.Slice((*float32)(unsafe.Pointer(&f.data[headerSize])), n)
+	}
+
+	rest := f.data[idsAt:]
+	next := func() (string, error) {
+		if len(rest) < 4 {
+			return "", errors.New("truncated ids")
+		}
+		n := binary.LittleEndian.Uint32(rest)
+		if uint64(len(rest)-4) < uint64(n) {
+			return "", errors.New("truncated ids")
+		}
+		s := string(rest[4 : 4+n])
+		rest = rest[4+n:]
+		return s, nil
+	}
+
+	var err error
+	if f.namespace, err = next(); err != nil {
+		return err
+	}
+	f.ids = make([]string, count)
+	f.shards = make([]string, count)
+	for i := range count {
+		if f.ids[i], err = next(); err != nil {
+			return err
+		}
+		if f.shards[i], err = next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Namespace returns the namespace the vectors were exported from.
+func (f *File) Namespace() string {
+	return f.namespace
+}
+
+// Len returns the number of vectors.
+func (f *File) Len() int {
+	return len(f.ids)
+}
+
+// Dims returns the dimension of the vectors.
+func (f *File) Dims() int {
+	return f.dims
+}
+
+// ID returns the id of vector i.
+func (f *File) ID(i int) string {
+	return f.ids[i]
+}
+
+// Shard returns the shard of vector i.
+func (f *File) Shard(i int) string {
+	return f.shards[i]
+}
+
+// Vector returns a copy of vector i.
+func (f *File) Vector(i int) []float32 {
+	return slices.Clone(f.vectors[i*f.dims : (i+1)*f.dims])
+}
+
+// Close unmaps the file.
+func (f *File) Close() error {
+	return f.unmap()
+}
+
+// littleEndian reports whether the host stores float32s like vector files.
+func littleEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}
@@ -0,0 +1,107 @@
+package vecfile
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestRoundTrip writes entries and checks that they read back, and that
+// vectors stay valid once the file is closed.
+func TestRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{ID: "a.go", Shard: "", Vector: []float32{1, 0, -0.5}},
+		{ID: "dir/b.go", Shard: "dir", Vector: []float32{0.25, 2, 3}},
+		{ID: "c.go", Shard: "", Vector: []float32{0, 0, 0}},
+	}
+	for _, c := range []struct {
+		name    string
+		entries []Entry
+		dims    int
+	}{
+		{"vectors", entries, 3},
+		{"empty", nil, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "vectors")
+			if err := Write(path, "backend", c.entries); err != nil {
+				t.Fatal(err)
+			}
+			f, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Namespace() != "backend" || f.Len() != len(c.entries) || f.Dims() != c.dims {
+				t.Errorf("Open = %q, %d vectors of %d dims, want %q, %d of %d", f.Namespace(), f.Len(), f.Dims(), "backend", len(c.entries), c.dims)
+			}
+			var vectors [][]float32
+			for i, e := range c.entries {
+				if f.ID(i) != e.ID || f.Shard(i) != e.Shard {
+					t.Errorf("entry %d = %q in %q, want %q in %q", i, f.ID(i), f.Shard(i), e.ID, e.Shard)
+				}
+				vectors = append(vectors, f.Vector(i))
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for i, e := range c.entries {
+				if !slices.Equal(vectors[i], e.Vector) {
+					t.Errorf("vector %d after Close = %v, want %v", i, vectors[i], e.Vector)
+				}
+			}
+		})
+	}
+}
+
+// TestWriteDims checks that vectors of mixed dimensions are refused.
+func TestWriteDims(t *testing.T) {
+	err := Write(filepath.Join(t.TempDir(), "vectors"), "", []Entry{
+		{ID: "a.go", Vector: []float32{1, 2}},
+		{ID: "b.go", Vector: []float32{1, 2, 3}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "b.go") {
+		t.Errorf("Write = %v, want an error naming b.go", err)
+	}
+}
+
+// TestOpenInvalid checks that damaged files are refused rather than mapped.
+func TestOpenInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vectors")
+	if err := Write(path, "backend", []Entry{{ID: "a.go", Vector: []float32{1, 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "bad header"},
+		{"magic", append([]byte("CTXVEC00"), valid[8:]...), "bad header"},
+		{"short header", valid[:headerSize-1], "bad header"},
+		{"vectors", valid[:headerSize+4], "truncated vectors"},
+		{"namespace", valid[:headerSize+8+2], "truncated ids"},
+		{"ids", valid[:len(valid)-1], "truncated ids"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			bad := filepath.Join(t.TempDir(), "vectors")
+			if err := os.WriteFile(bad, c.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			f, err := Open(bad)
+			if err == nil {
+				f.Close()
+				t.Fatal("Open succeeded")
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("Open = %v, want %q", err, c.want)
+			}
+		})
+	}
+}
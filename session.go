@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionTTL is how long an idle session is remembered.
+	sessionTTL = 30 * time.Minute
+	// sessionTurns is how many previous queries expand a follow-up.
+	sessionTurns = 3
+	// sessionFiles is how many files returned per previous query expand a
+	// follow-up.
+	sessionFiles = 3
+)
+
+// turn is a previous query of a session and the files it returned.
+type turn struct {
+	query string
+	files []string
+}
+
+// session remembers the recent turns of a client conversation.
+type session struct {
+	turns    []turn
+	lastUsed time.Time
+}
+
+// sessions holds the live sessions of a server, keyed by namespace and
+// client chosen id. Idle sessions are dropped after sessionTTL.
+type sessions struct {
+	mu sync.Mutex
+	m  map[string]*session
+}
+
+// expand returns query with the previous turns of the session appended, so
+// that follow-ups such as "what calls that function?" embed close to what
+// they refer to. The query is returned unchanged for a new session.
+func (s *sessions) expand(key, query string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.m[key]
+	if !ok || len(sess.turns) == 0 || time.Since(sess.lastUsed) > sessionTTL {
+		return query
+	}
+
+	var b strings.Builder
+	b.WriteString(query)
+	b.WriteString("\n\nFollowing up on:")
+	for _, t := range sess.turns {
+		b.WriteString("\n- ")
+		b.WriteString(t.query)
+		if len(t.files) > 0 {
+			b.WriteString(" (")
+			b.WriteString(strings.Join(t.files, ", "))
+			b.WriteString(")")
+		}
+	}
+	return b.String()
+}
+
+// record adds a turn to the session, creating it if needed, and forgets
+// sessions that have been idle for longer than sessionTTL.
+func (s *sessions) record(key, query string, ids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, sess := range s.m {
+		if now.Sub(sess.lastUsed) > sessionTTL {
+			delete(s.m, k)
+		}
+	}
+	if s.m == nil {
+		s.m = map[string]*session{}
+	}
+
+	sess, ok := s.m[key]
+	if !ok {
+		sess = &session{}
+		s.m[key] = sess
+	}
+	sess.lastUsed = now
+
+	t := turn{query: query}
+	for _, id := range ids[:min(len(ids), sessionFiles)] {
+		t.files = append(t.files, filepath.Base(id))
+	}
+	sess.turns = append(sess.turns, t)
+	if len(sess.turns) > sessionTurns {
+		sess.turns = sess.turns[len(sess.turns)-sessionTurns:]
+	}
+}
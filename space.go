@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	embed "github.com/codectx/tokens/services/embed"
+	store "github.com/codectx/tokens/services/store"
+	ollama "github.com/ollama/ollama/api"
+)
+
+const (
+	// spaceRefuse fails on indexes embedded with another provider or model.
+	spaceRefuse = "refuse"
+	// spaceReembed embeds such indexes again with the provider selected.
+	spaceReembed = "reembed"
+)
+
+// providers returns the comma-separated providers of -provider, in order of
+// preference.
+func (o *options) providers() []string {
+	var out []string
+	for _, spec := range strings.Split(o.provider, ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			out = append(out, spec)
+		}
+	}
+	return out
+}
+
+// selectEmbedder returns the embedder of the first provider of -provider
+// that answers a probe, its capabilities and its name, which tags the
+// vectors it embeds. The last provider isn't probed, having no fallback, so
+// a single one is set up as it always was. The provider is selected once:
+// vectors of different providers don't compare, so the run never switches.
+func selectEmbedder(ctx context.Context, o *options, clients []*ollama.Client, stats *embed.Stats) (embed.EmbeddingService, embed.Capabilities, string, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	specs := o.providers()
+	if len(specs) == 1 {
+		return newEmbedder(ctx, o, specs[0], clients, stats)
+	}
+	var errs []error
+	for i, spec := range specs {
+		svc, caps, name, err := newEmbedder(ctx, o, spec, clients, stats)
+		if err == nil && i < len(specs)-1 {
+			_, _, err = svc.Get(ctx, "ping")
+		}
+		if err != nil {
+			l.Warn("embedding provider unavailable", "provider", spec, "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", spec, err))
+			continue
+		}
+		l.Info("embedding provider", "provider", name, "fallback", i > 0)
+		return svc, caps, name, nil
+	}
+	return nil, embed.Capabilities{}, "", errors.Join(errs...)
+}
+
+// checkSpace applies -space-policy to the vectors of the index embedded
+// with another provider or model than a.space, whose distances to the
+// vectors of a.space mean nothing: refuse fails, and reembed drops them, with
+// the comments, segments and chunks of their files, for the next indexing
+// run to embed again. Untagged vectors, stored before vectors were tagged,
+// count as those of a.space.
+func (a *app) checkSpace(ctx context.Context) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+	o := a.opts
+
+	if a.database == nil || a.space == "" {
+		return nil
+	}
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+	models, err := db.Models(ctx)
+	if err != nil {
+		return err
+	}
+	var (
+		others []string
+		n      int
+	)
+	for m, count := range models {
+		if m != "" && m != a.space {
+			others = append(others, m)
+			n += count
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+	sort.Strings(others)
+	held := fmt.Sprintf("index %s holds vectors of %s, not of %s", displayName(o.namespace), strings.Join(others, ", "), a.space)
+	if o.spacePolicy != spaceReembed {
+		return fmt.Errorf("%s: search it with that -provider, or embed it again with -space-policy reembed", held)
+	}
+	if a.readOnly {
+		return fmt.Errorf("%s and is read-only: it can't be embedded again", held)
+	}
+
+	all, err := db.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	for id, e := range all {
+		if e.Model != "" && e.Model != a.space {
+			if err := db.Delete(ctx, id); err != nil {
+				return err
+			}
+			recordEvent(ctx, db, store.IndexEvent{ID: id, Action: eventDropped, Hash: e.Hash, Detail: "embedded by " + e.Model + ", not " + a.space})
+		}
+	}
+	if _, err := db.DropOrphans(ctx); err != nil {
+		return err
+	}
+	l.Warn("embedding index again", "index", displayName(o.namespace), "from", strings.Join(others, ", "), "to", a.space, "files", n)
+	return nil
+}
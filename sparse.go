@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	store "github.com/codectx/tokens/services/store"
+)
+
+// recordSparse encodes the file id with the -sparse model, once rewritten
+// by the preprocessing pipeline, unless it was encoded from the same text.
+func recordSparse(ctx context.Context, a *app, db store.StorageService, id, language, text string) error {
+	t, err := a.preprocess.Process(id, language, text)
+	if err != nil {
+		return fmt.Errorf("failed to preprocess %s: %w", id, err)
+	}
+	hash := computeHash([]byte(t))
+	if match, err := db.MatchSparse(ctx, id, hash); err != nil || match {
+		return err
+	}
+	vec, _, err := a.sparse.EmbedSparse(ctx, t)
+	if err != nil {
+		return err
+	}
+	return db.UpsertSparse(ctx, id, hash, vec)
+}
+
+// sparseScores returns the dot product of the sparse vector of the query
+// with that of each file sharing terms with it.
+func sparseScores(ctx context.Context, a *app, db store.StorageService, req searchRequest) (map[string]float32, error) {
+	q, _, err := a.sparse.EmbedSparse(ctx, a.cleaner.Clean(req.Query))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode query: %w", err)
+	}
+	return db.SparseMatches(ctx, q)
+}
+
+// sparseCandidates returns the best sparse matches of the query missing
+// from hits, so that files matching its terms compete with the nearest
+// vectors.
+func sparseCandidates(ctx context.Context, db store.StorageService, req searchRequest, hits []hit) ([]hit, error) {
+	seen := make(map[string]bool, len(hits))
+	for _, h := range hits {
+		seen[h.ID] = true
+	}
+	var ids []string
+	for id := range req.Sparse {
+		if !seen[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if si, sj := req.Sparse[ids[i]], req.Sparse[ids[j]]; si != sj {
+			return si > sj
+		}
+		return ids[i] < ids[j]
+	})
+	if n := candidates(req); len(ids) > n {
+		ids = ids[:n]
+	}
+	return vectorHits(ctx, db, req, ids)
+}
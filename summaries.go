@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+const (
+	// summaryWorkers is the number of summaries generated concurrently;
+	// generation is much slower than embedding and a local model serves few
+	// requests at once.
+	summaryWorkers = 2
+	// summaryPackages is the number of packages whose files are searched
+	// first when summaries are enabled.
+	summaryPackages = 3
+)
+
+// summarizeTree writes and embeds a summary of every file of db that changed
+// since it was last summarized, see summarizeFiles.
+func summarizeTree(ctx context.Context, a *app, db store.StorageService, src source) {
+	summarizeFiles(ctx, a, db, src, nil)
+}
+
+// summarizeHits summarizes the files of hits, see summarizeFiles. Searches
+// call it once their results are out rather than summarizing the whole
+// tree before their first answer, so summaries build up as files are
+// returned.
+func summarizeHits(ctx context.Context, a *app, db store.StorageService, src source, hits []hit) {
+	ids := make([]string, len(hits))
+	for i, h := range hits {
+		ids[i] = h.ID
+	}
+	summarizeFiles(ctx, a, db, src, ids)
+}
+
+// summarizeFiles writes and embeds a summary of each of the files ids, every
+// file of db when nil, that changed since it was last summarized, then of
+// every package, the directory of files, whose file summaries changed, and
+// clusters them again with -hierarchy. Summaries of removed files and
+// packages are deleted. It stops early once ctx is done.
+func summarizeFiles(ctx context.Context, a *app, db store.StorageService, src source, ids []string) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	all, err := db.IDs(ctx)
+	if err != nil {
+		l.Error("Failed to list files to summarize", "error", err)
+		return
+	}
+	if ids == nil {
+		ids = all
+	}
+
+	files := make(chan string, 5)
+	var wg sync.WaitGroup
+	for i := 0; i < summaryWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range files {
+				if err := summarizeFile(ctx, a, db, src, id); err != nil {
+					l.Error("Failed to summarize file", "path", id, "error", err)
+				}
+			}
+		}()
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		files <- id
+	}
+	close(files)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err := summarizePackages(ctx, a, db, all); err != nil {
+		l.Error("Failed to summarize packages", "error", err)
+	}
+	if a.opts.hierarchy {
+		if err := buildHierarchy(ctx, a, db); err != nil {
+			l.Error("Failed to build the summary hierarchy", "error", err)
+		}
+	}
+}
+
+// summarizeFile summarizes the file id unless its summary was made from its
+// current content.
+func summarizeFile(ctx context.Context, a *app, db store.StorageService, src source, id string) error {
+	rows, err := db.Get(ctx, []string{id})
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+	hash := rows[0].Hash
+	if match, err := db.MatchSummary(ctx, store.SummaryFile, id, hash); err != nil || match {
+		return err
+	}
+
+	text, err := readText(ctx, a, src, id)
+	if err != nil {
+		// rows of files outside the walked tree
+		l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+		l.Debug("skip unreadable", "path", id, "error", err)
+		return nil
+	}
+	sum, err := a.summaries.File(ctx, id, text)
+	if err != nil {
+		return err
+	}
+	_, err = embedSummary(ctx, a, db, store.Summary{ID: id, Kind: store.SummaryFile, Hash: hash, Text: sum})
+	return err
+}
+
+// summarizePackages summarizes every directory of the files ids from the
+// summaries of its files, and deletes the summaries of files and packages
+// no longer indexed.
+func summarizePackages(ctx context.Context, a *app, db store.StorageService, ids []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	indexed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		indexed[id] = true
+	}
+	fileSums, err := db.Summaries(ctx, store.SummaryFile)
+	if err != nil {
+		return err
+	}
+	byDir := map[string][]store.Summary{}
+	for _, s := range fileSums {
+		if !indexed[s.ID] {
+			if err := db.DeleteSummary(ctx, store.SummaryFile, s.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		dir := path.Dir(s.ID)
+		byDir[dir] = append(byDir[dir], s)
+	}
+
+	pkgSums, err := db.Summaries(ctx, store.SummaryPackage)
+	if err != nil {
+		return err
+	}
+	for _, s := range pkgSums {
+		if _, ok := byDir[s.ID]; !ok {
+			if err := db.DeleteSummary(ctx, store.SummaryPackage, s.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	dirs := make([]string, 0, len(byDir))
+	for dir := range byDir {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		// the package changes with the summaries of its files, which are
+		// sorted by id
+		var b strings.Builder
+		texts := map[string]string{}
+		for _, s := range byDir[dir] {
+			fmt.Fprintf(&b, "%s\x00%s\n", s.ID, s.Hash)
+			texts[path.Base(s.ID)] = s.Text
+		}
+		hash := computeHash([]byte(b.String()))
+		if match, err := db.MatchSummary(ctx, store.SummaryPackage, dir, hash); err != nil {
+			return err
+		} else if match {
+			continue
+		}
+
+		sum, err := a.summaries.Package(ctx, dir, texts)
+		if err != nil {
+			l.Error("Failed to summarize package", "path", dir, "error", err)
+			continue
+		}
+		if _, err := embedSummary(ctx, a, db, store.Summary{ID: dir, Kind: store.SummaryPackage, Hash: hash, Text: sum}); err != nil {
+			l.Error("Failed to summarize package", "path", dir, "error", err)
+		}
+	}
+	return nil
+}
+
+// embedSummary embeds the text of sum and stores it, returning it with its
+// vector.
+func embedSummary(ctx context.Context, a *app, db store.StorageService, sum store.Summary) (store.Summary, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	vec, _, err := a.emb.Get(ctx, sum.Text)
+	if err != nil {
+		return sum, fmt.Errorf("failed to embed summary: %w", err)
+	}
+	sum.Vector = vec
+	if err := db.UpsertSummary(ctx, sum); err != nil {
+		return sum, err
+	}
+	l.Debug("summarized", "kind", sum.Kind, "path", sum.ID)
+	return sum, nil
+}
+
+// summaryDistance is a summary scored by the distance of its vector to the
+// query.
+type summaryDistance struct {
+	store.Summary
+	distance float32
+}
+
+// nearestSummaries returns the summaries of kind scored against the query
+// vector, nearest first.
+func nearestSummaries(ctx context.Context, db store.StorageService, kind string, q []float32) ([]summaryDistance, error) {
+	sums, err := db.Summaries(ctx, kind)
+	if err != nil {
+		return nil, err
+	}
+	return rankSummaries(sums, q), nil
+}
+
+// rankSummaries scores sums against the query vector, nearest first.
+// Summaries embedded with other dimensions are left out.
+func rankSummaries(sums []store.Summary, q []float32) []summaryDistance {
+	out := make([]summaryDistance, 0, len(sums))
+	for _, s := range sums {
+		if len(s.Vector) == len(q) {
+			out = append(out, summaryDistance{Summary: s, distance: index.CosineDistance(q, s.Vector)})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].distance != out[j].distance {
+			return out[i].distance < out[j].distance
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// summaryHits searches summaries first: the files of the packages whose
+// summaries best match the query, ranked by their own summaries, then the
+// best matching file summaries of other packages when they are too few.
+// The ids of every summarized file are also returned.
+func summaryHits(ctx context.Context, db store.StorageService, req searchRequest) ([]hit, map[string]bool, error) {
+	files, err := nearestSummaries(ctx, db, store.SummaryFile, req.Vector)
+	if err != nil || len(files) == 0 {
+		return nil, nil, err
+	}
+	pkgs, err := nearestSummaries(ctx, db, store.SummaryPackage, req.Vector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	best := map[string]bool{}
+	for _, p := range pkgs[:min(len(pkgs), summaryPackages)] {
+		best[p.ID] = true
+	}
+	return pickSummaries(ctx, db, req, files, func(id string) bool { return best[path.Dir(id)] })
+}
+
+// pickSummaries returns hits for the files whose summaries best match the
+// query, nearest first in files, those preferred before the others. They
+// are scored by the mean distance of their file vector and of their
+// summary. The ids of every summarized file are also returned.
+func pickSummaries(ctx context.Context, db store.StorageService, req searchRequest, files []summaryDistance, preferred func(id string) bool) ([]hit, map[string]bool, error) {
+	n := candidates(req)
+	picked := make([]summaryDistance, 0, n)
+	for _, f := range files {
+		if len(picked) < n && preferred(f.ID) {
+			picked = append(picked, f)
+		}
+	}
+	for _, f := range files {
+		if len(picked) >= n {
+			break
+		}
+		if !preferred(f.ID) {
+			picked = append(picked, f)
+		}
+	}
+
+	ids := make([]string, len(picked))
+	distances := make(map[string]float32, len(picked))
+	for i, f := range picked {
+		ids[i] = f.ID
+		distances[f.ID] = f.distance
+	}
+	hits, err := vectorHits(ctx, db, req, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range hits {
+		h := &hits[i]
+		h.adjust("summary", (distances[h.ID]-h.Score)/2)
+	}
+	summarized := make(map[string]bool, len(files))
+	for _, f := range files {
+		summarized[f.ID] = true
+	}
+	return hits, summarized, nil
+}
@@ -0,0 +1,27 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// notifyResize does nothing: only unix signals terminal resizes, elsewhere the
+// size read when the terminal UI starts is kept.
+func notifyResize(ch chan<- os.Signal) {}
+
+// errNoTerminal is returned by the terminal outside unix, where reads of the
+// console can't time out to hand it over to an editor.
+var errNoTerminal = errors.New("tui needs a unix terminal")
+
+// terminal is the terminal UI's terminal, unavailable here.
+type terminal struct{}
+
+// openTerminal fails: the terminal UI only runs on unix.
+func openTerminal() (*terminal, error) { return nil, errNoTerminal }
+
+func (t *terminal) raw() error                   { return errNoTerminal }
+func (t *terminal) restore() error               { return errNoTerminal }
+func (t *terminal) size() (int, int, error)      { return 0, 0, errNoTerminal }
+func (t *terminal) read(buf []byte) (int, error) { return 0, errNoTerminal }
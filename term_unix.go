@@ -0,0 +1,68 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// notifyResize sends to ch whenever the terminal is resized.
+func notifyResize(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGWINCH)
+}
+
+// terminal is the terminal on stdin that the terminal UI runs in.
+type terminal struct {
+	fd int
+	// saved holds the settings of the terminal before raw mode.
+	saved *term.State
+}
+
+// openTerminal returns the terminal on stdin, failing when stdin isn't one.
+func openTerminal() (*terminal, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("tui needs an interactive terminal")
+	}
+	return &terminal{fd: fd}, nil
+}
+
+// raw switches the terminal to reading keys as they are typed, without echo.
+func (t *terminal) raw() error {
+	saved, err := term.MakeRaw(t.fd)
+	if err != nil {
+		return err
+	}
+	t.saved = saved
+	return nil
+}
+
+// restore puts back the settings the terminal had before raw.
+func (t *terminal) restore() error {
+	if t.saved == nil {
+		return nil
+	}
+	return term.Restore(t.fd, t.saved)
+}
+
+// size returns the rows and columns of the terminal.
+func (t *terminal) size() (int, int, error) {
+	cols, rows, err := term.GetSize(t.fd)
+	return rows, cols, err
+}
+
+// read reads what is typed, returning nothing after a tenth of a second
+// without input, so that the input lock is released in time for an editor.
+func (t *terminal) read(buf []byte) (int, error) {
+	fds := []unix.PollFd{{Fd: int32(t.fd), Events: unix.POLLIN}}
+	if n, err := unix.Poll(fds, 100); n <= 0 {
+		return 0, err
+	}
+	return os.Stdin.Read(buf)
+}
@@ -0,0 +1,28 @@
+"""Server-side sessions keyed by a signed cookie."""
+
+import secrets
+import time
+
+SESSION_TTL = 3600
+
+
+class SessionStore:
+    """Keeps sessions in memory until they expire."""
+
+    def __init__(self):
+        self.sessions = {}
+
+    def create(self, user_id):
+        session_id = secrets.token_urlsafe(32)
+        self.sessions[session_id] = {"user": user_id, "expires": time.time() + SESSION_TTL}
+        return session_id
+
+    def get(self, session_id):
+        session = self.sessions.get(session_id)
+        if session is None or session["expires"] < time.time():
+            self.sessions.pop(session_id, None)
+            return None
+        return session
+
+    def logout(self, session_id):
+        self.sessions.pop(session_id, None)
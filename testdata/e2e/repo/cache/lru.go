@@ -0,0 +1,48 @@
+// Package cache holds recently used values in memory.
+package cache
+
+import "container/list"
+
+// LRU is a cache evicting the least recently used entry once it holds
+// capacity entries.
+type LRU struct {
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type entry struct {
+	key   string
+	value any
+}
+
+// NewLRU returns an empty cache of the given capacity.
+func NewLRU(capacity int) *LRU {
+	return &LRU{capacity: capacity, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Get returns the cached value of key and marks it recently used.
+func (c *LRU) Get(key string) (any, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*entry).value, true
+}
+
+// Put caches value under key, evicting the least recently used entry
+// when the cache is full.
+func (c *LRU) Put(key string, value any) {
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*entry).value = value
+		c.order.MoveToFront(el)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+	c.entries[key] = c.order.PushFront(&entry{key, value})
+}
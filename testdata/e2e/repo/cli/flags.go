@@ -0,0 +1,31 @@
+// Package cli parses the command line of the server.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Config is the configuration read from command-line flags.
+type Config struct {
+	Addr    string
+	Verbose bool
+	Workers int
+}
+
+// ParseFlags reads the command-line flags into a Config, exiting with the
+// usage message on invalid arguments.
+func ParseFlags(args []string) Config {
+	var cfg Config
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	fs.StringVar(&cfg.Addr, "addr", ":8080", "listen address")
+	fs.BoolVar(&cfg.Verbose, "verbose", false, "log every request")
+	fs.IntVar(&cfg.Workers, "workers", 4, "number of worker goroutines")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: server [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	return cfg
+}
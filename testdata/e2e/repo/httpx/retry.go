@@ -0,0 +1,42 @@
+// Package httpx wraps HTTP calls with retries.
+package httpx
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy bounds the attempts of a request and the backoff between
+// them.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Backoff returns the exponential backoff delay before attempt, with
+// jitter, capped at MaxDelay.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << attempt
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Do sends the request, retrying server errors with backoff.
+func (p RetryPolicy) Do(client *http.Client, req *http.Request) (*http.Response, error) {
+	var (
+		resp *http.Response
+		err  error
+	)
+	for attempt := 0; attempt < p.MaxAttempts; attempt++ {
+		resp, err = client.Do(req)
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		time.Sleep(p.Backoff(attempt))
+	}
+	return resp, err
+}
@@ -0,0 +1,16 @@
+"""Tests of the session store."""
+
+from auth.session import SessionStore
+
+
+def test_create_and_get_session():
+    store = SessionStore()
+    session_id = store.create("alice")
+    assert store.get(session_id)["user"] == "alice"
+
+
+def test_logout_removes_session():
+    store = SessionStore()
+    session_id = store.create("bob")
+    store.logout(session_id)
+    assert store.get(session_id) is None
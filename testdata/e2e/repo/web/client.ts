@@ -0,0 +1,20 @@
+// Typed fetch wrapper of the browser client, aborting slow requests.
+
+export interface RequestOptions {
+  timeoutMs?: number;
+  headers?: Record<string, string>;
+}
+
+export async function fetchJSON<T>(url: string, options: RequestOptions = {}): Promise<T> {
+  const controller = new AbortController();
+  const timer = setTimeout(() => controller.abort(), options.timeoutMs ?? 5000);
+  try {
+    const response = await fetch(url, { headers: options.headers, signal: controller.signal });
+    if (!response.ok) {
+      throw new Error(`request failed with status ${response.status}`);
+    }
+    return (await response.json()) as T;
+  } finally {
+    clearTimeout(timer);
+  }
+}
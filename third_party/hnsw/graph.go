@@ -0,0 +1,514 @@
+package hnsw
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/coder/hnsw/heap"
+	"golang.org/x/exp/maps"
+)
+
+type Vector = []float32
+
+// Node is a node in the graph.
+type Node[K cmp.Ordered] struct {
+	Key   K
+	Value Vector
+}
+
+func MakeNode[K cmp.Ordered](key K, vec Vector) Node[K] {
+	return Node[K]{Key: key, Value: vec}
+}
+
+// layerNode is a node in a layer of the graph.
+type layerNode[K cmp.Ordered] struct {
+	Node[K]
+
+	// neighbors is map of neighbor keys to neighbor nodes.
+	// It is a map and not a slice to allow for efficient deletes, esp.
+	// when M is high.
+	neighbors map[K]*layerNode[K]
+}
+
+// addNeighbor adds a o neighbor to the node, replacing the neighbor
+// with the worst distance if the neighbor set is full.
+func (n *layerNode[K]) addNeighbor(newNode *layerNode[K], m int, dist DistanceFunc) {
+	if n.neighbors == nil {
+		n.neighbors = make(map[K]*layerNode[K], m)
+	}
+
+	n.neighbors[newNode.Key] = newNode
+	if len(n.neighbors) <= m {
+		return
+	}
+
+	// Find the neighbor with the worst distance.
+	var (
+		worstDist = float32(math.Inf(-1))
+		worst     *layerNode[K]
+	)
+	for _, neighbor := range n.neighbors {
+		d := dist(neighbor.Value, n.Value)
+		// d > worstDist may always be false if the distance function
+		// returns NaN, e.g., when the embeddings are zero. Equal distances
+		// drop the greatest key, whatever the map order.
+		if d > worstDist || worst == nil || d == worstDist && neighbor.Key > worst.Key {
+			worstDist = d
+			worst = neighbor
+		}
+	}
+
+	delete(n.neighbors, worst.Key)
+	// Delete backlink from the worst neighbor.
+	delete(worst.neighbors, n.Key)
+	worst.replenish(m)
+}
+
+type searchCandidate[K cmp.Ordered] struct {
+	node *layerNode[K]
+	dist float32
+}
+
+func (s searchCandidate[K]) Less(o searchCandidate[K]) bool {
+	return s.dist < o.dist
+}
+
+// search returns the layer node closest to the target node
+// within the same layer.
+func (n *layerNode[K]) search(
+	// k is the number of candidates in the result set.
+	k int,
+	efSearch int,
+	target Vector,
+	distance DistanceFunc,
+) []searchCandidate[K] {
+	// This is a basic greedy algorithm to find the entry point at the given level
+	// that is closest to the target node.
+	candidates := heap.Heap[searchCandidate[K]]{}
+	candidates.Init(make([]searchCandidate[K], 0, efSearch))
+	candidates.Push(
+		searchCandidate[K]{
+			node: n,
+			dist: distance(n.Value, target),
+		},
+	)
+	var (
+		result  = heap.Heap[searchCandidate[K]]{}
+		visited = make(map[K]bool)
+	)
+	result.Init(make([]searchCandidate[K], 0, k))
+
+	// Begin with the entry node in the result set.
+	result.Push(candidates.Min())
+	visited[n.Key] = true
+
+	for candidates.Len() > 0 {
+		var (
+			current  = candidates.Pop().node
+			improved = false
+		)
+
+		// We iterate the map in a sorted, deterministic fashion for
+		// tests.
+		neighborKeys := maps.Keys(current.neighbors)
+		slices.Sort(neighborKeys)
+		for _, neighborID := range neighborKeys {
+			neighbor := current.neighbors[neighborID]
+			if visited[neighborID] {
+				continue
+			}
+			visited[neighborID] = true
+
+			dist := distance(neighbor.Value, target)
+			improved = improved || dist < result.Min().dist
+			if result.Len() < k {
+				result.Push(searchCandidate[K]{node: neighbor, dist: dist})
+			} else if dist < result.Max().dist {
+				result.PopLast()
+				result.Push(searchCandidate[K]{node: neighbor, dist: dist})
+			}
+
+			candidates.Push(searchCandidate[K]{node: neighbor, dist: dist})
+			// Always store candidates if we haven't reached the limit.
+			if candidates.Len() > efSearch {
+				candidates.PopLast()
+			}
+		}
+
+		// Termination condition: no improvement in distance and at least
+		// kMin candidates in the result set.
+		if !improved && result.Len() >= k {
+			break
+		}
+	}
+
+	return result.Slice()
+}
+
+func (n *layerNode[K]) replenish(m int) {
+	if len(n.neighbors) >= m {
+		return
+	}
+
+	// Restore connectivity by adding new neighbors.
+	// This is a naive implementation that could be improved by
+	// using a priority queue to find the best candidates.
+	// Neighbors are visited in key order so that the same insertions
+	// always build the same graph.
+	for _, neighborKey := range sortedKeys(n.neighbors) {
+		neighbor, ok := n.neighbors[neighborKey]
+		if !ok {
+			continue
+		}
+		for _, key := range sortedKeys(neighbor.neighbors) {
+			candidate := neighbor.neighbors[key]
+			if _, ok := n.neighbors[key]; ok {
+				// do not add duplicates
+				continue
+			}
+			if candidate == n {
+				continue
+			}
+			n.addNeighbor(candidate, m, CosineDistance)
+			if len(n.neighbors) >= m {
+				return
+			}
+		}
+	}
+}
+
+// isolates remove the node from the graph by removing all connections
+// to neighbors.
+func (n *layerNode[K]) isolate(m int) {
+	for _, key := range sortedKeys(n.neighbors) {
+		neighbor := n.neighbors[key]
+		delete(neighbor.neighbors, n.Key)
+		neighbor.replenish(m)
+	}
+}
+
+type layer[K cmp.Ordered] struct {
+	// nodes is a map of nodes IDs to nodes.
+	// All nodes in a higher layer are also in the lower layers, an essential
+	// property of the graph.
+	//
+	// nodes is exported for interop with encoding/gob.
+	nodes map[K]*layerNode[K]
+}
+
+// sortedKeys returns the keys of m in ascending order.
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := maps.Keys(m)
+	slices.Sort(keys)
+	return keys
+}
+
+// entry returns the entry node of the layer, that of the least key so
+// that searches entering the layer start from the same node whatever the
+// map order. It is only called on the highest layers, which hold few nodes.
+func (l *layer[K]) entry() *layerNode[K] {
+	if l == nil {
+		return nil
+	}
+	var entry *layerNode[K]
+	for key, node := range l.nodes {
+		if entry == nil || key < entry.Key {
+			entry = node
+		}
+	}
+	return entry
+}
+
+func (l *layer[K]) size() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.nodes)
+}
+
+// Graph is a Hierarchical Navigable Small World graph.
+// All public parameters must be set before adding nodes to the graph.
+// K is cmp.Ordered instead of of comparable so that they can be sorted.
+type Graph[K cmp.Ordered] struct {
+	// Distance is the distance function used to compare embeddings.
+	Distance DistanceFunc
+
+	// Rng is used for level generation. It may be set to a deterministic value
+	// for reproducibility. Note that deterministic number generation can lead to
+	// degenerate graphs when exposed to adversarial inputs.
+	Rng *rand.Rand
+
+	// M is the maximum number of neighbors to keep for each node.
+	// A good default for OpenAI embeddings is 16.
+	M int
+
+	// Ml is the level generation factor.
+	// E.g., for Ml = 0.25, each layer is 1/4 the size of the previous layer.
+	Ml float64
+
+	// EfSearch is the number of nodes to consider in the search phase.
+	// 20 is a reasonable default. Higher values improve search accuracy at
+	// the expense of memory.
+	EfSearch int
+
+	// layers is a slice of layers in the graph.
+	layers []*layer[K]
+}
+
+func defaultRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// NewGraph returns a new graph with default parameters, roughly designed for
+// storing OpenAI embeddings.
+func NewGraph[K cmp.Ordered]() *Graph[K] {
+	return &Graph[K]{
+		M:        16,
+		Ml:       0.25,
+		Distance: CosineDistance,
+		EfSearch: 20,
+		Rng:      defaultRand(),
+	}
+}
+
+// maxLevel returns an upper-bound on the number of levels in the graph
+// based on the size of the base layer.
+func maxLevel(ml float64, numNodes int) int {
+	if ml == 0 {
+		panic("ml must be greater than 0")
+	}
+
+	if numNodes == 0 {
+		return 1
+	}
+
+	l := math.Log(float64(numNodes))
+	l /= math.Log(1 / ml)
+
+	m := int(math.Round(l)) + 1
+
+	return m
+}
+
+// randomLevel generates a random level for a new node.
+func (h *Graph[K]) randomLevel() int {
+	// max avoids having to accept an additional parameter for the maximum level
+	// by calculating a probably good one from the size of the base layer.
+	max := 1
+	if len(h.layers) > 0 {
+		if h.Ml == 0 {
+			panic("(*Graph).Ml must be greater than 0")
+		}
+		max = maxLevel(h.Ml, h.layers[0].size())
+	}
+
+	for level := 0; level < max; level++ {
+		if h.Rng == nil {
+			h.Rng = defaultRand()
+		}
+		r := h.Rng.Float64()
+		if r > h.Ml {
+			return level
+		}
+	}
+
+	return max
+}
+
+func (g *Graph[K]) assertDims(n Vector) {
+	if len(g.layers) == 0 {
+		return
+	}
+	hasDims := g.Dims()
+	if hasDims != len(n) {
+		panic(fmt.Sprint("embedding dimension mismatch: ", hasDims, " != ", len(n)))
+	}
+}
+
+// Dims returns the number of dimensions in the graph, or
+// 0 if the graph is empty.
+func (g *Graph[K]) Dims() int {
+	if len(g.layers) == 0 {
+		return 0
+	}
+	for _, node := range g.layers[0].nodes {
+		return len(node.Value)
+	}
+	return 0
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// Add inserts nodes into the graph.
+// If another node with the same ID exists, it is replaced.
+func (g *Graph[K]) Add(nodes ...Node[K]) {
+	for _, node := range nodes {
+		key := node.Key
+		vec := node.Value
+
+		g.assertDims(vec)
+		insertLevel := g.randomLevel()
+		// Create layers that don't exist yet.
+		for insertLevel >= len(g.layers) {
+			g.layers = append(g.layers, &layer[K]{})
+		}
+
+		if insertLevel < 0 {
+			panic("invalid level")
+		}
+
+		var elevator *K
+
+		preLen := g.Len()
+
+		// Insert node at each layer, beginning with the highest.
+		for i := len(g.layers) - 1; i >= 0; i-- {
+			layer := g.layers[i]
+			newNode := &layerNode[K]{
+				Node: Node[K]{
+					Key:   key,
+					Value: vec,
+				},
+			}
+
+			// Insert the new node into the layer.
+			if layer.size() == 0 {
+				layer.nodes = map[K]*layerNode[K]{key: newNode}
+				continue
+			}
+
+			// Now at the highest layer with more than one node, so we can begin
+			// searching for the best way to enter the graph. On subsequent
+			// layers, we use the elevator node to enter the graph at the best
+			// point.
+			var searchPoint *layerNode[K]
+			if elevator != nil {
+				searchPoint = layer.nodes[*elevator]
+			} else {
+				searchPoint = layer.entry()
+			}
+
+			if g.Distance == nil {
+				panic("(*Graph).Distance must be set")
+			}
+
+			neighborhood := searchPoint.search(g.M, g.EfSearch, vec, g.Distance)
+			if len(neighborhood) == 0 {
+				// This should never happen because the searchPoint itself
+				// should be in the result set.
+				panic("no nodes found")
+			}
+
+			// Re-set the elevator node for the next layer.
+			elevator = ptr(neighborhood[0].node.Key)
+
+			if insertLevel >= i {
+				if _, ok := layer.nodes[key]; ok {
+					g.Delete(key)
+				}
+				// Insert the new node into the layer.
+				layer.nodes[key] = newNode
+				for _, node := range neighborhood {
+					// Create a bi-directional edge between the new node and the best node.
+					node.node.addNeighbor(newNode, g.M, g.Distance)
+					newNode.addNeighbor(node.node, g.M, g.Distance)
+				}
+			}
+		}
+
+		// Invariant check: the node should have been added to the graph.
+		if g.Len() != preLen+1 {
+			panic("node not added")
+		}
+	}
+}
+
+// Search finds the k nearest neighbors from the target node.
+func (h *Graph[K]) Search(near Vector, k int) []Node[K] {
+	h.assertDims(near)
+	if len(h.layers) == 0 {
+		return nil
+	}
+
+	var (
+		efSearch = h.EfSearch
+
+		elevator *K
+	)
+
+	for layer := len(h.layers) - 1; layer >= 0; layer-- {
+		var searchPoint *layerNode[K]
+		if elevator != nil {
+			searchPoint = h.layers[layer].nodes[*elevator]
+		} else {
+			searchPoint = h.layers[layer].entry()
+		}
+
+		// Descending hierarchies
+		if layer > 0 {
+			nodes := searchPoint.search(1, efSearch, near, h.Distance)
+			elevator = ptr(nodes[0].node.Key)
+			continue
+		}
+
+		nodes := searchPoint.search(k, efSearch, near, h.Distance)
+		out := make([]Node[K], 0, len(nodes))
+
+		for _, node := range nodes {
+			out = append(out, node.node.Node)
+		}
+
+		return out
+	}
+
+	panic("unreachable")
+}
+
+// Len returns the number of nodes in the graph.
+func (h *Graph[K]) Len() int {
+	if len(h.layers) == 0 {
+		return 0
+	}
+	return h.layers[0].size()
+}
+
+// Delete removes a node from the graph by key.
+// It tries to preserve the clustering properties of the graph by
+// replenishing connectivity in the affected neighborhoods.
+func (h *Graph[K]) Delete(key K) bool {
+	if len(h.layers) == 0 {
+		return false
+	}
+
+	var deleted bool
+	for _, layer := range h.layers {
+		node, ok := layer.nodes[key]
+		if !ok {
+			continue
+		}
+		delete(layer.nodes, key)
+		node.isolate(h.M)
+		deleted = true
+	}
+
+	return deleted
+}
+
+// Lookup returns the vector with the given key.
+func (h *Graph[K]) Lookup(key K) (Vector, bool) {
+	if len(h.layers) == 0 {
+		return nil, false
+	}
+
+	node, ok := h.layers[0].nodes[key]
+	if !ok {
+		return nil, false
+	}
+	return node.Value, ok
+}
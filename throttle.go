@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cpuWindow is the period over which the CPU used by indexing is
+	// measured against -max-cpu.
+	cpuWindow = time.Second
+	// cpuPoll is how often workers held back by -max-cpu check again.
+	cpuPoll = 250 * time.Millisecond
+)
+
+// throttle holds back indexing workers between files, while indexing is
+// paused or the process uses more than maxCPU percent of the machine.
+type throttle struct {
+	maxCPU float64
+
+	mu     sync.Mutex
+	paused bool
+	// resumed is closed when indexing resumes.
+	resumed chan struct{}
+	// the last CPU sample and the usage it measured
+	sampledAt  time.Time
+	sampledCPU time.Duration
+	usage      float64
+}
+
+// pause holds back workers before their next file; files being indexed
+// finish.
+func (t *throttle) pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.paused {
+		t.paused, t.resumed = true, make(chan struct{})
+	}
+}
+
+// resume lets paused workers go on.
+func (t *throttle) resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.paused {
+		t.paused = false
+		close(t.resumed)
+	}
+}
+
+// isPaused reports whether indexing is paused.
+func (t *throttle) isPaused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paused
+}
+
+// wait blocks while indexing is paused, then while the CPU usage is above
+// maxCPU, until ctx is done.
+func (t *throttle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	paused, resumed := t.paused, t.resumed
+	t.mu.Unlock()
+	if paused {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-resumed:
+		}
+	}
+
+	if t.maxCPU <= 0 {
+		return nil
+	}
+	for t.cpuUsage() > t.maxCPU {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(cpuPoll):
+		}
+	}
+	return nil
+}
+
+// cpuUsage returns the percent of the machine's CPU the process used over
+// the last cpuWindow, 0 when the platform doesn't report it.
+func (t *throttle) cpuUsage() float64 {
+	cpu, ok := processCPU()
+	if !ok {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.sampledAt.IsZero() {
+		t.sampledAt, t.sampledCPU = now, cpu
+		return 0
+	}
+	if wall := now.Sub(t.sampledAt); wall >= cpuWindow {
+		t.usage = 100 * float64(cpu-t.sampledCPU) / float64(wall) / float64(runtime.NumCPU())
+		t.sampledAt, t.sampledCPU = now, cpu
+	}
+	return t.usage
+}
+
+// runPause pauses the background indexing of a running serve.
+func runPause(ctx context.Context, args []string) error {
+	return controlIndexing(ctx, "pause", args)
+}
+
+// runResume resumes the background indexing of a running serve.
+func runResume(ctx context.Context, args []string) error {
+	return controlIndexing(ctx, "resume", args)
+}
+
+// controlIndexing POSTs action to the /index endpoints of the server at
+// -addr and prints the state of its indexing.
+func controlIndexing(ctx context.Context, action string, args []string) error {
+	fs := newFlagSet(action)
+	addr := fs.String("addr", "http://localhost:8080", "URL of the running serve")
+	token := fs.String("token", "", "bearer token of the served namespace when serve has -tokens, else its -admin-token")
+	fs.Parse(args)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(*addr, "/")+"/index/"+action, nil)
+	if err != nil {
+		return err
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to %s indexing: %w", action, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to %s indexing: %s: %s", action, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var st indexStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return fmt.Errorf("failed to read indexing state: %w", err)
+	}
+	state := "running"
+	if st.Paused {
+		state = "paused"
+	}
+	fmt.Printf("indexing %s, cpu %.0f%%\n", state, st.CPU)
+	return nil
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	detect "github.com/codectx/tokens/services/detect"
+	highlight "github.com/codectx/tokens/services/highlight"
+	index "github.com/codectx/tokens/services/index"
+	lexical "github.com/codectx/tokens/services/lexical"
+)
+
+const (
+	// tuiDebounce is how long typing pauses before the query is searched.
+	tuiDebounce = 150 * time.Millisecond
+	// tuiTabWidth is the number of spaces tabs are expanded to in previews.
+	tuiTabWidth = 4
+)
+
+// ANSI escapes drawing the terminal UI.
+const (
+	altScreen  = "\x1b[?1049h"
+	mainScreen = "\x1b[?1049l"
+	clearLine  = "\x1b[K"
+	reverse    = "\x1b[7m"
+	dim        = "\x1b[2m"
+	resetStyle = "\x1b[0m"
+)
+
+// key is a key read from the terminal: a named key such as up or enter, or
+// the rune typed.
+type key struct {
+	name string
+	r    rune
+}
+
+// tuiResult is the outcome of searching a query typed in the terminal UI.
+type tuiResult struct {
+	query string
+	hits  []hit
+	took  time.Duration
+	err   error
+}
+
+// preview is the text of a file shown in the preview pane, and its line best
+// matching query.
+type preview struct {
+	lines    []string
+	language string
+	err      error
+	query    string
+	match    int
+}
+
+// browser is the state of the terminal UI.
+type browser struct {
+	// search returns the hits of a query.
+	search func(ctx context.Context, query string) ([]hit, error)
+	// text returns the text of a file, for its preview.
+	text func(id string) (string, error)
+	// tty is the terminal the UI is drawn in.
+	tty *terminal
+	// root is the indexed path, paths are shown relative to it.
+	root string
+	mode string
+
+	query    []rune
+	hits     []hit
+	selected int
+	// scroll moves the preview away from the best matching line, in lines.
+	scroll     int
+	status     string
+	rows, cols int
+	previews   map[string]*preview
+	// input is held while stdin is read, and while an editor runs so that
+	// keys go to the editor.
+	input sync.Mutex
+}
+
+// runTUI indexes the given path, then searches it as the query is typed,
+// listing the results next to a preview of the selected one. Enter, or alt
+// and the number of a result, opens it in $EDITOR at its best matching line.
+func runTUI(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("tui")
+	o := &options{}
+	o.register(fs)
+	k := fs.Int("k", 20, "number of results listed")
+	fs.Parse(args)
+
+	wd := "."
+	if fs.NArg() > 0 {
+		wd = fs.Arg(0)
+	}
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	tty, err := openTerminal()
+	if err != nil {
+		return err
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+
+	// Check the provider upfront rather than failing every query
+	if o.mode == modeAuto {
+		o.mode = modeVector
+		if _, _, err := a.emb.Get(ctx, "ping"); err != nil {
+			l.Warn("embedding provider unavailable, falling back to lexical search", "error", err)
+			o.mode = modeLexical
+		}
+	}
+
+	request := func(query string) (searchRequest, error) {
+		pq, err := parseQuery(query)
+		if err != nil {
+			return searchRequest{}, err
+		}
+		req := searchRequest{K: *k, Author: o.author, Languages: o.languages(), Tests: o.tests, Root: wd,
+			InContext: parseContextFiles(wd, o.inContext), InContextMode: o.inContextMode, Src: src}
+		req.Grep, _ = parseGrep(o.grep)
+		pq.apply(&req)
+		return req, nil
+	}
+	var search func(ctx context.Context, query string) ([]hit, error)
+	if o.mode == modeLexical {
+		lex := lexical.NewLexicalService()
+		indexLexical(ctx, a, lex, src)
+		search = func(ctx context.Context, query string) ([]hit, error) {
+			req, err := request(query)
+			if err != nil {
+				return nil, err
+			}
+			return searchLexical(ctx, a, db, lex, req)
+		}
+	} else {
+		var idx index.IndexService
+		refresh := !a.readOnly && !o.noWalk
+		if !refresh {
+			if idx, err = loadIndex(ctx, a, o.namespace); err != nil {
+				return fmt.Errorf("failed to load namespace %q: %w", o.namespace, err)
+			}
+		} else {
+			idx = a.newIndex(ctx, src.shard, storedFiles(ctx, a, o.namespace), a.caps.Dims)
+			indexTree(ctx, a, db, idx, src, nil)
+		}
+		var hybrid lexical.LexicalService
+		if o.lexicalWeight > 0 {
+			hybrid = lexical.NewLexicalService()
+			indexLexical(ctx, a, hybrid, src)
+		}
+		var not []float32
+		if o.not != "" {
+			if not, _, err = a.embedQuery(ctx, o.not); err != nil {
+				return fmt.Errorf("failed to embed the -not query: %w", err)
+			}
+		}
+		search = func(ctx context.Context, query string) ([]hit, error) {
+			req, err := request(query)
+			if err != nil {
+				return nil, err
+			}
+			req.Lex = hybrid
+			req.Not = not
+			if req.Vector, _, err = a.embedQuery(ctx, req.Query); err != nil {
+				return nil, fmt.Errorf("failed to embed query: %w", err)
+			}
+			// pinned files are re-checked before every search
+			if refresh {
+				refreshPinned(ctx, a, db, idx, src, loadPathRules(ctx, db))
+			}
+			return searchIndex(ctx, a, db, idx, req)
+		}
+	}
+
+	// Logs would draw over the screen
+	ctx = context.WithValue(ctx, LoggerCtxKey, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	b := &browser{
+		search: search,
+		text: func(id string) (string, error) {
+			f, err := src.read(id)
+			if err != nil {
+				return "", err
+			}
+			text, _, err := fileText(ctx, a, id, f)
+			return text, err
+		},
+		tty:      tty,
+		root:     wd,
+		mode:     o.mode,
+		previews: map[string]*preview{},
+	}
+	return b.run(ctx)
+}
+
+// run draws the UI and handles keys until the user quits.
+func (b *browser) run(ctx context.Context) error {
+	if err := b.tty.raw(); err != nil {
+		return fmt.Errorf("failed to set up the terminal: %w", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		// wait for the pending read, later ones block on input
+		b.input.Lock()
+		fmt.Print(mainScreen)
+		b.tty.restore()
+	}()
+	fmt.Print(altScreen)
+	b.resize()
+
+	input := make(chan []byte)
+	go b.readInput(ctx, input)
+	resized := make(chan os.Signal, 1)
+	notifyResize(resized)
+	defer signal.Stop(resized)
+
+	results := make(chan tuiResult)
+	debounce := time.NewTimer(tuiDebounce)
+	debounce.Stop()
+	stopSearch := func() {}
+	defer func() { stopSearch() }()
+
+	for {
+		b.draw()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-resized:
+			b.resize()
+		case r := <-results:
+			if r.query != string(b.query) {
+				continue
+			}
+			b.hits, b.selected, b.scroll = r.hits, 0, 0
+			b.status = fmt.Sprintf("%d results · %s · %dms", len(r.hits), b.mode, r.took.Milliseconds())
+			if r.err != nil {
+				b.status = "search failed: " + r.err.Error()
+			}
+		case <-debounce.C:
+			stopSearch()
+			stopSearch = b.startSearch(ctx, string(b.query), results)
+		case in := <-input:
+			before := string(b.query)
+			for _, k := range parseKeys(in) {
+				if quit := b.handle(k); quit {
+					return nil
+				}
+			}
+			if string(b.query) == before {
+				continue
+			}
+			stopSearch()
+			if strings.TrimSpace(string(b.query)) == "" {
+				debounce.Stop()
+				b.hits, b.status = nil, ""
+				continue
+			}
+			b.status = "searching…"
+			debounce.Reset(tuiDebounce)
+		}
+	}
+}
+
+// startSearch searches query in the background and sends the result to
+// results, unless the returned function cancels it first.
+func (b *browser) startSearch(ctx context.Context, query string, results chan<- tuiResult) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		begin := time.Now()
+		hits, err := b.search(ctx, query)
+		select {
+		case results <- tuiResult{query: query, hits: hits, took: time.Since(begin), err: err}:
+		case <-ctx.Done():
+		}
+	}()
+	return cancel
+}
+
+// handle applies a key, reporting whether the user quits.
+func (b *browser) handle(k key) bool {
+	switch k.name {
+	case "esc", "ctrl-c":
+		return true
+	case "enter":
+		if len(b.hits) > 0 {
+			b.open()
+		}
+	case "alt":
+		// alt-n opens the nth result
+		if n := int(k.r - '0'); n <= len(b.hits) {
+			b.selected, b.scroll = n-1, 0
+			b.open()
+		}
+	case "up":
+		b.selected, b.scroll = max(b.selected-1, 0), 0
+	case "down":
+		b.selected, b.scroll = min(b.selected+1, max(len(b.hits)-1, 0)), 0
+	case "pgup":
+		b.scroll -= b.rows / 2
+	case "pgdn":
+		b.scroll += b.rows / 2
+	case "backspace":
+		if len(b.query) > 0 {
+			b.query = b.query[:len(b.query)-1]
+		}
+	case "ctrl-u":
+		b.query = nil
+	case "ctrl-w":
+		q := strings.TrimRight(string(b.query), " ")
+		b.query = []rune(q[:strings.LastIndex(q, " ")+1])
+	case "":
+		b.query = append(b.query, k.r)
+	}
+	return false
+}
+
+// open runs the editor on the selected hit at its best matching line, with
+// the terminal restored, then resumes the UI.
+func (b *browser) open() {
+	h := b.hits[b.selected]
+	p := b.preview(h)
+
+	b.input.Lock()
+	defer b.input.Unlock()
+	fmt.Print(mainScreen)
+	b.tty.restore()
+	err := editorCommand(osPath(h.ID), p.match+1).Run()
+	b.tty.raw()
+	fmt.Print(altScreen)
+
+	// the file may have been edited
+	delete(b.previews, h.ID)
+	if err != nil {
+		b.status = "failed to run the editor: " + err.Error()
+	}
+}
+
+// resize reads the size of the terminal, 80x24 when unknown.
+func (b *browser) resize() {
+	b.rows, b.cols = 24, 80
+	if rows, cols, err := b.tty.size(); err == nil && rows > 0 && cols > 0 {
+		b.rows, b.cols = rows, cols
+	}
+}
+
+// readInput sends what is typed to input until ctx is done.
+func (b *browser) readInput(ctx context.Context, input chan<- []byte) {
+	buf := make([]byte, 256)
+	for ctx.Err() == nil {
+		b.input.Lock()
+		n, _ := b.tty.read(buf)
+		b.input.Unlock()
+		if n == 0 {
+			continue
+		}
+		select {
+		case input <- append([]byte(nil), buf[:n]...):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// parseKeys decodes the keys of a read from the terminal, ignoring the
+// escape sequences of keys the UI doesn't use.
+func parseKeys(in []byte) []key {
+	var keys []key
+	for len(in) > 0 {
+		c := in[0]
+		switch {
+		case c == 0x1b && len(in) > 2 && (in[1] == '[' || in[1] == 'O'):
+			// CSI: parameters up to a final byte
+			i := 2
+			for i < len(in) && (in[i] < 0x40 || in[i] > 0x7e) {
+				i++
+			}
+			if i == len(in) {
+				return keys
+			}
+			switch string(in[2 : i+1]) {
+			case "A":
+				keys = append(keys, key{name: "up"})
+			case "B":
+				keys = append(keys, key{name: "down"})
+			case "5~":
+				keys = append(keys, key{name: "pgup"})
+			case "6~":
+				keys = append(keys, key{name: "pgdn"})
+			}
+			in = in[i+1:]
+			continue
+		case c == 0x1b && len(in) > 1 && in[1] >= '1' && in[1] <= '9':
+			keys = append(keys, key{name: "alt", r: rune(in[1])})
+			in = in[2:]
+			continue
+		case c == 0x1b:
+			keys = append(keys, key{name: "esc"})
+		case c == '\r' || c == '\n':
+			keys = append(keys, key{name: "enter"})
+		case c == 0x7f || c == 0x08:
+			keys = append(keys, key{name: "backspace"})
+		case c == 0x03:
+			keys = append(keys, key{name: "ctrl-c"})
+		case c == 0x15:
+			keys = append(keys, key{name: "ctrl-u"})
+		case c == 0x17:
+			keys = append(keys, key{name: "ctrl-w"})
+		case c == 0x10:
+			keys = append(keys, key{name: "up"})
+		case c == 0x0e:
+			keys = append(keys, key{name: "down"})
+		case c >= 0x20:
+			r, size := utf8.DecodeRune(in)
+			keys = append(keys, key{r: r})
+			in = in[size:]
+			continue
+		}
+		in = in[1:]
+	}
+	return keys
+}
+
+// draw redraws the screen: the query, a status line, then the results next
+// to the preview of the selected one.
+func (b *browser) draw() {
+	var w strings.Builder
+	row := func(n int, s string) {
+		fmt.Fprintf(&w, "\x1b[%d;1H%s%s", n, s, clearLine)
+	}
+
+	query := string(b.query)
+	if n, room := len(b.query), max(b.cols-3, 1); n > room {
+		query = string(b.query[n-room:])
+	}
+	row(1, "> "+query)
+	status := b.status
+	if status == "" {
+		status = "type to search"
+	}
+	row(2, dim+fit(status+" · ↑↓ select · PgUp/PgDn scroll · enter open · esc quit", b.cols)+resetStyle)
+
+	listWidth := min(max(b.cols*2/5, 20), b.cols)
+	previewWidth := max(b.cols-listWidth-3, 0)
+	height := max(b.rows-2, 0)
+	top := max(b.selected-height+1, 0)
+	var pane []string
+	if len(b.hits) > 0 {
+		pane = b.previewPane(b.hits[b.selected], previewWidth, height)
+	}
+	for i := 0; i < height; i++ {
+		item := fit("", listWidth)
+		if j := top + i; j < len(b.hits) {
+			item = fit(fmt.Sprintf("%2d %s", j+1, relPath(b.root, b.hits[j].ID)), listWidth)
+			if j == b.selected {
+				item = reverse + item + resetStyle
+			}
+		}
+		line := ""
+		if i < len(pane) {
+			line = pane[i]
+		}
+		row(3+i, item+dim+" │ "+resetStyle+line)
+	}
+
+	// leave the cursor after the query
+	fmt.Fprintf(&w, "\x1b[1;%dH", min(3+utf8.RuneCountInString(query), b.cols))
+	os.Stdout.WriteString(w.String())
+}
+
+// previewPane returns the lines of the preview of h: its path and best
+// matching line, then the text around that line, highlighted.
+func (b *browser) previewPane(h hit, width, height int) []string {
+	if height == 0 {
+		return nil
+	}
+	p := b.preview(h)
+	if p.err != nil {
+		return []string{fit(p.err.Error(), width)}
+	}
+
+	// keep the match a third down the pane, within the text
+	base := p.match - (height-1)/3
+	start := min(max(base+b.scroll, 0), max(len(p.lines)-1, 0))
+	b.scroll = start - base
+
+	out := []string{dim + fit(fmt.Sprintf("%s:%d %s", relPath(b.root, h.ID), p.match+1, p.language), width) + resetStyle}
+	numWidth := len(strconv.Itoa(len(p.lines)))
+	for n := start; n < len(p.lines) && len(out) < height; n++ {
+		num := fmt.Sprintf("%*d ", numWidth, n+1)
+		text := highlight.Line(fit(p.lines[n], max(width-len(num), 0)), p.language)
+		style := dim
+		if n == p.match {
+			style = reverse
+		}
+		out = append(out, style+num+resetStyle+text)
+	}
+	return out
+}
+
+// preview returns the preview of h, reading its file the first time.
+func (b *browser) preview(h hit) *preview {
+	p, ok := b.previews[h.ID]
+	if !ok {
+		p = &preview{language: h.Meta.Language, query: "\x00"}
+		text, err := b.text(h.ID)
+		if err != nil {
+			p.err = fmt.Errorf("failed to read %s: %w", h.ID, err)
+		}
+		if p.language == "" {
+			p.language = detect.Language(h.ID, []byte(text))
+		}
+		p.lines = strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+		b.previews[h.ID] = p
+	}
+	if q := string(b.query); p.query != q {
+		text := q
+		if pq, err := parseQuery(q); err == nil {
+			text = pq.Text
+		}
+		p.query, p.match = q, bestLine(p.lines, text)
+	}
+	return p
+}
+
+// bestLine returns the index of the line matching the most distinct words of
+// query, the first line when none does.
+func bestLine(lines []string, query string) int {
+	terms := map[string]bool{}
+	for _, t := range lexical.Tokenize(query) {
+		terms[t] = true
+	}
+	best, bestCount := 0, 0
+	for i, line := range lines {
+		seen := map[string]bool{}
+		for _, t := range lexical.Tokenize(line) {
+			if terms[t] {
+				seen[t] = true
+			}
+		}
+		if len(seen) > bestCount {
+			best, bestCount = i, len(seen)
+		}
+	}
+	return best
+}
+
+// fit returns s on one line of exactly width cells: tabs expanded, control
+// characters blanked, C1 ones such as U+009B CSI included so that file
+// content can't send escapes to the terminal, cut or padded with spaces.
+func fit(s string, width int) string {
+	width = max(width, 0)
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if n >= width {
+			break
+		}
+		switch {
+		case r == '\t':
+			spaces := min(tuiTabWidth-n%tuiTabWidth, width-n)
+			b.WriteString(strings.Repeat(" ", spaces))
+			n += spaces
+			continue
+		case r < 0x20 || (r >= 0x7f && r <= 0x9f):
+			r = ' '
+		}
+		b.WriteRune(r)
+		n++
+	}
+	b.WriteString(strings.Repeat(" ", width-n))
+	return b.String()
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestFit(t *testing.T) {
+	for _, c := range []struct {
+		name, in string
+		width    int
+		want     string
+	}{
+		{"padded", "ab", 4, "ab  "},
+		{"cut", "abcdef", 3, "abc"},
+		{"tab", "a\tb", 6, "a   b "},
+		{"C0 escape", "a\x1b[2Jb", 6, "a [2Jb"},
+		{"delete", "a\x7fb", 3, "a b"},
+		{"C1 CSI", "a\u009b2Jb", 5, "a 2Jb"},
+		{"C1 OSC", "a\u009d0;x\u009cb", 7, "a 0;x b"},
+		{"printable runes kept", "é→", 2, "é→"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := fit(c.in, c.width); got != c.want {
+				t.Errorf("fit(%q, %d) = %q, want %q", c.in, c.width, got, c.want)
+			}
+		})
+	}
+}
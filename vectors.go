@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	crypt "github.com/codectx/tokens/services/crypt"
+	vecfile "github.com/codectx/tokens/services/vecfile"
+)
+
+// runExportVectors writes the vectors of a stored index to a flat file that
+// -vectors memory-maps, so that large indexes load without decoding rows.
+func runExportVectors(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("export-vectors")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeLexical) // exporting doesn't embed
+	out := fs.String("o", "", "output `file` (default <index>.vec)")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	// The flat file can't be encrypted, don't leak vectors sealed at rest
+	if key, err := crypt.LoadKey(); err != nil {
+		return err
+	} else if key != nil {
+		return fmt.Errorf("vectors are encrypted at rest and would be written in plain text")
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	path := *out
+	if path == "" {
+		path = "default.vec"
+		if o.namespace != "" {
+			path = o.namespace + ".vec"
+		}
+	}
+
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+	all, err := db.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	entries := make([]vecfile.Entry, 0, len(all))
+	for id, e := range all {
+		entries = append(entries, vecfile.Entry{ID: id, Shard: e.Shard, Vector: e.Vector})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	if err := vecfile.Write(path, o.namespace, entries); err != nil {
+		return fmt.Errorf("failed to write vectors: %w", err)
+	}
+	l.Info("exported vectors", "index", displayName(o.namespace), "file", path, "count", len(entries))
+	return nil
+}
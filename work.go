@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	broker "github.com/codectx/tokens/services/broker"
+	embed "github.com/codectx/tokens/services/embed"
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// workPoll is how often workers look for a batch while the queue is empty,
+// and the coordinator for the progress of the workers.
+const workPoll = 2 * time.Second
+
+// runCoordinate queues the files of a tree in batches for the work
+// processes sharing the database to embed, on this machine or others, then
+// waits until they are all indexed. With -queue, batches go through a broker
+// and the database isn't opened, so that a single writer may hold it.
+func runCoordinate(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("coordinate")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeLexical) // the workers embed
+	batch := fs.Int("batch", 64, "number of files of a batch, claimed by one worker at a time")
+	wait := fs.Bool("wait", true, "wait until the workers indexed every queued file, logging their progress")
+	waitTimeout := fs.Duration("wait-timeout", 0, "fail once the workers took this long to index the queued files, 0 to wait for them forever")
+	queueURL := fs.String("queue", "", "redis://, rediss:// or nats:// `broker` to queue the batches on instead of the database")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if *batch < 1 {
+		return errors.New("-batch must be positive")
+	}
+	wd := "."
+	if fs.NArg() > 0 {
+		wd = fs.Arg(0)
+	}
+
+	var (
+		a  *app
+		db store.StorageService
+	)
+	if *queueURL != "" {
+		// Only walking: the writer may hold a database opened by a single
+		// process
+		a = &app{opts: o, ignore: loadIgnore(ctx, o)}
+	} else {
+		var err error
+		if a, err = newApp(ctx, o); err != nil {
+			return err
+		}
+		defer a.Close()
+		if a.readOnly {
+			return errors.New("coordinate needs to write to the database")
+		}
+		if db, err = a.store(o.namespace); err != nil {
+			return err
+		}
+	}
+
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	q, err := newWorkQueue(ctx, db, *queueURL, o.namespace, "", 0, true)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	var known map[string]bool
+	if db != nil {
+		left, err := q.left(ctx)
+		if err != nil {
+			return err
+		}
+		// Updates journaled by the workers of a run in progress aren't over
+		if left == 0 {
+			rollBackUpdates(ctx, db, index.NewExactIndexService())
+		} else {
+			l.Info("joining the run in progress", "queued", left)
+		}
+		known = indexedFiles(ctx, db)
+	}
+
+	// Batches are claimed in the order they are queued, by priority
+	files := newQueue()
+	walkCtx, cancel := withTimeout(ctx, o.walkTimeout)
+	defer cancel()
+	var rules pathRules
+	if db != nil {
+		rules = loadPathRules(ctx, db)
+	}
+	err = src.walk(walkCtx, func(path string) {
+		if !rules.excluded(path) {
+			files.push(path, priority(a, known, path))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+	files.close()
+
+	queued, batches := 0, 0
+	var b []string
+	flush := func() error {
+		if len(b) == 0 {
+			return nil
+		}
+		if err := q.push(ctx, b); err != nil {
+			return err
+		}
+		queued, batches, b = queued+len(b), batches+1, nil
+		return nil
+	}
+	for {
+		path, ok := files.pop()
+		if !ok {
+			break
+		}
+		if b = append(b, path); len(b) == *batch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	l.Info("queued", "index", displayName(o.namespace), "files", queued, "batches", batches,
+		"high", files.counts[priorityHigh], "normal", files.counts[priorityNormal], "low", files.counts[priorityLow])
+	if !*wait {
+		return nil
+	}
+
+	start := time.Now()
+	last := -1
+	for {
+		left, err := q.left(ctx)
+		if err != nil {
+			return err
+		}
+		if left == 0 {
+			break
+		}
+		if *waitTimeout > 0 && time.Since(start) > *waitTimeout {
+			return fmt.Errorf("%d files still queued after -wait-timeout %s: are workers running?", left, *waitTimeout)
+		}
+		if left != last {
+			l.Info("indexing", "left", left, "elapsed", time.Since(start).Round(time.Second))
+			last = left
+		}
+		// brokers wait for finished batches, the database is polled
+		if *queueURL == "" {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(workPoll):
+			}
+		}
+	}
+	l.Info("indexed", "index", displayName(o.namespace), "files", queued, "elapsed", time.Since(start).Round(time.Second))
+
+	if db == nil {
+		return nil
+	}
+	pending, err := db.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		l.Warn("files failed to embed, retry them with retry-failed", "count", len(pending))
+	}
+	return nil
+}
+
+// runWork claims batches of files queued by coordinate and indexes them
+// into the shared database, embedding with the local provider, or with the
+// embedders of -provider queue:<broker>, until the queue stays empty for
+// -idle. Files are read from the tree at the path the coordinator was given,
+// which must hold the same files here.
+func runWork(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("work")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeVector) // needs embeddings
+	lease := fs.Duration("lease", 10*time.Minute, "how long a claimed batch is held before other workers may claim it, longer than a batch takes to embed")
+	idle := fs.Duration("idle", time.Minute, "exit once the queue was empty for this long, 0 to wait for batches forever")
+	queueURL := fs.String("queue", "", "redis://, rediss:// or nats:// `broker` coordinate -queue queues the batches on")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if *lease <= 0 {
+		return errors.New("-lease must be positive")
+	}
+	wd := "."
+	if fs.NArg() > 0 {
+		wd = fs.Arg(0)
+	}
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	if a.readOnly {
+		return errors.New("work needs to write to the database")
+	}
+
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	host, _ := os.Hostname()
+	worker := fmt.Sprintf("%s:%d", host, os.Getpid())
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+	q, err := newWorkQueue(ctx, db, *queueURL, o.namespace, worker, *lease, false)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	l.Info("working", "worker", worker, "index", displayName(o.namespace), "workers", a.workers())
+
+	files, batches := 0, 0
+	waiting := time.Now()
+	for {
+		b, ok, err := q.claim(ctx)
+		if err != nil {
+			// such as a conflict with the claim of another worker
+			l.Warn("failed to claim a batch, trying again", "error", err)
+		}
+		if !ok {
+			if *idle > 0 && time.Since(waiting) > *idle {
+				break
+			}
+			// brokers wait for a batch, the database is polled
+			if *queueURL == "" {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(workPoll):
+				}
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if b.attempts > 1 {
+			l.Warn("reclaimed batch, a worker died or overran its -lease", "batch", b.id, "attempts", b.attempts)
+		}
+		start := time.Now()
+		if err := indexBatch(ctx, a, db, src, b.files); err != nil {
+			return err
+		}
+		if d := time.Since(start); d > *lease {
+			l.Warn("batch outlasted its lease, raise -lease", "batch", b.id, "elapsed", d.Round(time.Second), "lease", *lease)
+		}
+		if err := q.finish(ctx, b); err != nil {
+			return err
+		}
+		files, batches = files+len(b.files), batches+1
+		l.Debug("finished batch", "batch", b.id, "files", len(b.files), "ms", time.Since(start).Milliseconds())
+		waiting = time.Now()
+	}
+
+	if paths := a.undecodable.drain(); len(paths) > 0 {
+		l.Warn("skipped undecodable files", "count", len(paths), "paths", paths, "encoding", o.encoding)
+	}
+	l.Info("no more work", "worker", worker, "batches", batches, "files", files)
+	return nil
+}
+
+// indexBatch indexes files with the workers of a. The graph built along is
+// dropped: searches load theirs from the shared database.
+func indexBatch(ctx context.Context, a *app, db store.StorageService, src source, files []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	idx := index.NewExactIndexService()
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	for range min(a.workers(), len(files)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				// held back while over -max-cpu
+				if err := a.throttle.wait(ctx); err != nil {
+					continue
+				}
+				if err := handleAndRecord(ctx, a, db, idx, src, nil, path); err != nil {
+					l.Error("Failed to handle file", "error", err)
+				}
+			}
+		}()
+	}
+	for _, path := range files {
+		paths <- path
+	}
+	close(paths)
+	wg.Wait()
+	return ctx.Err()
+}
+
+// runEmbedder embeds the texts published on a broker by the processes
+// using -provider queue:<broker>, with the local provider, until
+// interrupted. It needs neither the database nor the tree.
+func runEmbedder(ctx context.Context, args []string) error {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	fs := newFlagSet("embedder")
+	o := &options{}
+	o.register(fs)
+	fs.Set("mode", modeVector) // needs embeddings
+	queueURL := fs.String("queue", "", "redis://, rediss:// or nats:// `broker` to embed the texts of")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if *queueURL == "" {
+		return errors.New("embedder needs -queue")
+	}
+	if slices.ContainsFunc(o.providers(), func(spec string) bool { return strings.HasPrefix(spec, "queue:") }) {
+		return errors.New("embedder embeds with a local -provider, not queue:")
+	}
+
+	a := &app{opts: o}
+	if err := a.setupEmbedding(ctx); err != nil {
+		return err
+	}
+	if a.vcache != nil {
+		defer a.vcache.Close()
+	}
+	b, err := broker.NewBrokerService(ctx, *queueURL)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	l.Info("embedding", "queue", b.Name(), "provider", a.space, "workers", a.workers())
+	return embed.ServeQueue(ctx, b, a.emb, a.workers(), func(err error) {
+		l.Error("Failed to serve embedding", "error", err)
+	})
+}
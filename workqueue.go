@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	broker "github.com/codectx/tokens/services/broker"
+	store "github.com/codectx/tokens/services/store"
+)
+
+// workQueue hands the batches of files queued by coordinate to the work
+// processes: the work_queue table of the database, or a broker set by
+// -queue.
+type workQueue interface {
+	// push queues files as a batch.
+	push(ctx context.Context, files []string) error
+	// claim returns the next batch, false when none came within workPoll.
+	claim(ctx context.Context) (workItem, bool, error)
+	// finish reports that the files of b are indexed.
+	finish(ctx context.Context, b workItem) error
+	// left returns the number of files queued and not yet indexed.
+	left(ctx context.Context) (int, error)
+	// Close releases the connections of the queue.
+	Close() error
+}
+
+// workItem is a batch of files of a distributed indexing run.
+type workItem struct {
+	id    int64
+	files []string
+	// run is the coordinate run that queued the batch, for -queue.
+	run string
+	// attempts counts the claims of the batch, with the database queue.
+	attempts int
+	// msg is the message of the batch, acknowledged once finished, with
+	// -queue.
+	msg broker.Message
+}
+
+// newWorkQueue returns the queue of the batches of namespace ns, claimed
+// by worker for lease: the database of db unless url sets a broker. A
+// coordinator listens for the batches workers finish, a worker for the
+// batches queued.
+func newWorkQueue(ctx context.Context, db store.StorageService, url, ns, worker string, lease time.Duration, coordinator bool) (workQueue, error) {
+	if url == "" {
+		return &dbQueue{db: db, worker: worker, lease: lease}, nil
+	}
+	b, err := broker.NewBrokerService(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	q := &brokerQueue{b: b, worker: worker, files: workSubject("files", ns), done: workSubject("done", ns)}
+	subject := q.files
+	if coordinator {
+		q.run, q.pending, subject = randomRun(), map[int64]int{}, q.done
+	}
+	if q.sub, err = b.Subscribe(ctx, subject, lease); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// workSubject returns the subject of the batches of kind of namespace ns.
+func workSubject(kind, ns string) string {
+	if ns == "" {
+		return "codectx." + kind
+	}
+	return "codectx." + kind + "." + ns
+}
+
+// randomRun returns the id of a coordinate run.
+func randomRun() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// dbQueue queues batches in the work_queue table, leasing them to workers.
+type dbQueue struct {
+	db     store.StorageService
+	worker string
+	lease  time.Duration
+}
+
+func (q *dbQueue) push(ctx context.Context, files []string) error {
+	return q.db.PushWork(ctx, files)
+}
+
+func (q *dbQueue) claim(ctx context.Context) (workItem, bool, error) {
+	b, ok, err := q.db.ClaimWork(ctx, q.worker, q.lease)
+	if err != nil || !ok {
+		return workItem{}, false, err
+	}
+	return workItem{id: b.ID, files: b.Files, attempts: b.Attempts}, true, nil
+}
+
+func (q *dbQueue) finish(ctx context.Context, b workItem) error {
+	ok, err := q.db.FinishWork(ctx, q.worker, store.WorkBatch{ID: b.id, Files: b.files, Attempts: b.attempts})
+	if err == nil && !ok {
+		ctx.Value(LoggerCtxKey).(*slog.Logger).Warn("batch was claimed again after its lease expired, raise -lease", "batch", b.id)
+	}
+	return err
+}
+
+func (q *dbQueue) left(ctx context.Context) (int, error) {
+	return q.db.WorkLeft(ctx)
+}
+
+// Close is a no-op, the database belongs to the app.
+func (q *dbQueue) Close() error {
+	return nil
+}
+
+// brokerQueue publishes batches to codectx.files[.<namespace>], and the
+// batches workers finish to codectx.done[.<namespace>]. A batch is
+// acknowledged once finished: the batch of a worker that dies is delivered
+// again when its lease expires.
+type brokerQueue struct {
+	b      broker.BrokerService
+	worker string
+	files  string
+	done   string
+	// sub receives the batches queued, or for a coordinator the batches
+	// finished.
+	sub broker.Subscription
+	// run, next and pending track the batches a coordinator queued and
+	// their files, by id.
+	run     string
+	next    int64
+	pending map[int64]int
+}
+
+// workMessage is a batch, as published.
+type workMessage struct {
+	Run   string   `json:"run"`
+	Batch int64    `json:"batch"`
+	Files []string `json:"files,omitempty"`
+	// Worker is set on the batches finished.
+	Worker string `json:"worker,omitempty"`
+}
+
+func (q *brokerQueue) push(ctx context.Context, files []string) error {
+	q.next++
+	msg, err := json.Marshal(workMessage{Run: q.run, Batch: q.next, Files: files})
+	if err != nil {
+		return err
+	}
+	if err := q.b.Publish(ctx, q.files, msg); err != nil {
+		return err
+	}
+	q.pending[q.next] = len(files)
+	return nil
+}
+
+func (q *brokerQueue) claim(ctx context.Context) (workItem, bool, error) {
+	msg, err := q.receive(ctx, workPoll)
+	if err != nil || msg == nil {
+		return workItem{}, false, err
+	}
+	var m workMessage
+	if err := json.Unmarshal(msg.Data, &m); err != nil {
+		msg.Ack(ctx)
+		return workItem{}, false, fmt.Errorf("invalid batch: %w", err)
+	}
+	return workItem{id: m.Batch, files: m.Files, run: m.Run, msg: *msg}, true, nil
+}
+
+func (q *brokerQueue) finish(ctx context.Context, b workItem) error {
+	msg, err := json.Marshal(workMessage{Run: b.run, Batch: b.id, Worker: q.worker})
+	if err != nil {
+		return err
+	}
+	if err := q.b.Publish(ctx, q.done, msg); err != nil {
+		return err
+	}
+	return b.msg.Ack(ctx)
+}
+
+// left collects the batches finished since it was last called, and counts
+// the files of the others. Batches of other runs are ignored.
+func (q *brokerQueue) left(ctx context.Context) (int, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+	for wait := workPoll; ; wait = 0 {
+		msg, err := q.receive(ctx, wait)
+		if err != nil {
+			return 0, err
+		}
+		if msg == nil {
+			break
+		}
+		if err := msg.Ack(ctx); err != nil {
+			return 0, err
+		}
+		var m workMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil || m.Run != q.run {
+			continue
+		}
+		delete(q.pending, m.Batch)
+		l.Debug("finished batch", "batch", m.Batch, "worker", m.Worker)
+	}
+	n := 0
+	for _, files := range q.pending {
+		n += files
+	}
+	return n, nil
+}
+
+// receive returns the next message of the subscription, nil when none came
+// within wait.
+func (q *brokerQueue) receive(ctx context.Context, wait time.Duration) (*broker.Message, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, max(wait, time.Millisecond))
+	defer cancel()
+	msg, err := q.sub.Next(waitCtx)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (q *brokerQueue) Close() error {
+	q.sub.Close()
+	return q.b.Close()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	fuzzy "github.com/codectx/tokens/services/fuzzy"
+	index "github.com/codectx/tokens/services/index"
+	store "github.com/codectx/tokens/services/store"
+	symbols "github.com/codectx/tokens/services/symbols"
+)
+
+// xrefSchema is the schema of the JSON output of def and refs.
+const xrefSchema = "codectx.xref/v1"
+
+// How the locations of def and refs matched the symbol asked for.
+const (
+	matchExact = "exact"
+	// matchCase ignores case.
+	matchCase = "case"
+	// matchFuzzy is a definition of a similar name.
+	matchFuzzy = "fuzzy"
+	// matchSemantic is the line best matching the symbol in the files
+	// nearest to it by vector search.
+	matchSemantic = "semantic"
+)
+
+const (
+	// fuzzyMatch is the minimum fuzzy score of the similar names of fuzzy
+	// matches.
+	fuzzyMatch = 0.6
+	// fuzzyNames bounds the number of similar names looked up.
+	fuzzyNames = 5
+)
+
+// location is a match of def or refs.
+type location struct {
+	Path string `json:"path"`
+	// Line is 1-based.
+	Line int    `json:"line"`
+	Name string `json:"name,omitempty"`
+	Text string `json:"text"`
+}
+
+// xrefOutput is the JSON output of def and refs, schema codectx.xref/v1.
+type xrefOutput struct {
+	Schema    string     `json:"schema"`
+	Symbol    string     `json:"symbol"`
+	Kind      string     `json:"kind"`
+	Match     string     `json:"match"`
+	Locations []location `json:"locations"`
+}
+
+// recordSymbols replaces the symbol table entries of the file id with the
+// definitions and usages of its text, unless they were read from the same
+// content.
+func recordSymbols(ctx context.Context, db store.StorageService, id, hash, language, text string) error {
+	if match, err := db.MatchSymbols(ctx, id, hash); err != nil || match {
+		return err
+	}
+	var syms []store.Symbol
+	for _, d := range symbols.Definitions(language, text) {
+		syms = append(syms, store.Symbol{Name: d.Name, Kind: store.SymbolDef, Line: d.Line + 1})
+	}
+	for _, r := range symbols.References(language, text) {
+		syms = append(syms, store.Symbol{Name: r.Name, Kind: store.SymbolRef, Line: r.Line + 1})
+	}
+	return db.ReplaceSymbols(ctx, id, hash, syms)
+}
+
+// runDef prints where a symbol is defined.
+func runDef(ctx context.Context, args []string) error {
+	return runXref(ctx, "def", store.SymbolDef, args)
+}
+
+// runRefs prints where a symbol is used.
+func runRefs(ctx context.Context, args []string) error {
+	return runXref(ctx, "refs", store.SymbolRef, args)
+}
+
+// runXref looks up the symbols of kind named by the first argument in the
+// symbol table recorded while indexing the path of the second, "." when
+// missing. Without an exact match, names are compared ignoring case, then
+// definitions of similar names are looked up, then files are searched for
+// the symbol by their vectors.
+func runXref(ctx context.Context, command, kind string, args []string) error {
+	fs := newFlagSet(command)
+	o := &options{}
+	o.register(fs)
+	k := fs.Int("k", defaultTopK, "number of files searched by their vectors when no symbol matches by name")
+	fs.Parse(args)
+
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("usage: %s SYMBOL [path]", command)
+	}
+	name, wd := fs.Arg(0), "."
+	if fs.NArg() > 1 {
+		wd = fs.Arg(1)
+	}
+	// keep stdout for the locations
+	l := newLogger(os.Stderr)
+	ctx = context.WithValue(ctx, LoggerCtxKey, l)
+
+	a, err := newApp(ctx, o)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	src, err := newSource(ctx, a, wd)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	db, err := a.store(o.namespace)
+	if err != nil {
+		return err
+	}
+
+	// Refresh the symbol table of changed files, which needs embedding
+	var idx index.IndexService
+	switch {
+	case a.emb == nil:
+	case a.readOnly || o.noWalk:
+		idx, err = loadIndex(ctx, a, o.namespace)
+	default:
+		idx = a.newIndex(ctx, src.shard, storedFiles(ctx, a, o.namespace), a.caps.Dims)
+		indexTree(ctx, a, db, idx, src, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	out := xrefOutput{Schema: xrefSchema, Symbol: name, Kind: kind, Locations: []location{}}
+	syms, folded, err := lookupSymbols(ctx, db, kind, name)
+	if err != nil {
+		return err
+	}
+	if len(syms) > 0 {
+		out.Match = matchExact
+		if folded {
+			out.Match = matchCase
+		}
+	} else if syms, err = similarSymbols(ctx, db, kind, name); err != nil {
+		return err
+	} else if len(syms) > 0 {
+		out.Match = matchFuzzy
+	}
+
+	lines := map[string][]string{}
+	text := func(id string, line int) string {
+		if _, ok := lines[id]; !ok {
+			t, _ := readText(ctx, a, src, id)
+			lines[id] = strings.Split(t, "\n")
+		}
+		if line < 1 || line > len(lines[id]) {
+			return ""
+		}
+		return strings.TrimSpace(lines[id][line-1])
+	}
+	for _, s := range syms {
+		out.Locations = append(out.Locations, location{Path: relPath(wd, s.ID), Line: s.Line, Name: s.Name, Text: text(s.ID, s.Line)})
+	}
+
+	if len(syms) == 0 && idx != nil {
+		hits, err := semanticSymbols(ctx, a, db, idx, wd, name, *k)
+		if err != nil {
+			return err
+		}
+		out.Match = matchSemantic
+		for _, h := range hits {
+			text(h.ID, 1)
+			line := bestLine(lines[h.ID], name) + 1
+			out.Locations = append(out.Locations, location{Path: relPath(wd, h.ID), Line: line, Text: text(h.ID, line)})
+		}
+	}
+	l.Info(command, "symbol", name, "match", out.Match, "locations", len(out.Locations))
+
+	if o.json {
+		return json.NewEncoder(os.Stdout).Encode(out)
+	}
+	for _, loc := range out.Locations {
+		fmt.Printf("%s:%d: %s\n", loc.Path, loc.Line, loc.Text)
+	}
+	return nil
+}
+
+// lookupSymbols returns the symbols of kind named name, or qualified by a
+// receiver as in Type.name, else those named so ignoring case, reporting
+// true then.
+func lookupSymbols(ctx context.Context, db store.StorageService, kind, name string) ([]store.Symbol, bool, error) {
+	syms, err := db.FindSymbols(ctx, kind, name, false)
+	if err != nil || len(syms) > 0 {
+		return syms, false, err
+	}
+	syms, err = db.FindSymbols(ctx, kind, name, true)
+	return syms, true, err
+}
+
+// similarSymbols returns the symbols of kind of the defined names fuzzily
+// matching name, best first.
+func similarSymbols(ctx context.Context, db store.StorageService, kind, name string) ([]store.Symbol, error) {
+	names, err := db.SymbolNames(ctx, store.SymbolDef)
+	if err != nil {
+		return nil, err
+	}
+	type scored struct {
+		name  string
+		score float64
+	}
+	var similar []scored
+	word := strings.ToLower(name)
+	for _, n := range names {
+		if s := fuzzy.Match(word, strings.ToLower(n)); s >= fuzzyMatch {
+			similar = append(similar, scored{n, s})
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool { return similar[i].score > similar[j].score })
+
+	var out []store.Symbol
+	for _, s := range similar[:min(len(similar), fuzzyNames)] {
+		// usages of methods name them without their receiver
+		want := s.name
+		if kind == store.SymbolRef {
+			want = want[strings.LastIndex(want, ".")+1:]
+		}
+		syms, err := db.FindSymbols(ctx, kind, want, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, sym := range syms {
+			// not the other methods of the same name
+			if sym.Name == want {
+				out = append(out, sym)
+			}
+		}
+	}
+	return out, nil
+}
+
+// semanticSymbols returns the k files nearest to name by vector search,
+// leaving out those of languages without symbols, such as markdown.
+func semanticSymbols(ctx context.Context, a *app, db store.StorageService, idx index.IndexService, root, name string, k int) ([]hit, error) {
+	l := ctx.Value(LoggerCtxKey).(*slog.Logger)
+
+	q, _, err := a.emb.Get(ctx, name)
+	if err != nil {
+		l.Warn("Failed to embed symbol, no semantic matches", "error", err)
+		return nil, nil
+	}
+	hits, err := searchIndex(ctx, a, db, idx, searchRequest{Query: name, Vector: q, K: k * overfetch, Root: root})
+	if err != nil {
+		return nil, err
+	}
+	out := hits[:0]
+	for _, h := range hits {
+		if symbols.Supported(h.Meta.Language) && len(out) < k {
+			out = append(out, h)
+		}
+	}
+	return out, nil
+}